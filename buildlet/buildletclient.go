@@ -9,6 +9,8 @@ package buildlet // import "golang.org/x/build/buildlet"
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,10 +21,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/net/http2"
 	"golang.org/x/oauth2"
 )
 
@@ -84,7 +89,10 @@ func (c *Client) Close() error {
 		if err == nil {
 			err = ErrClosed
 		}
-		for _, fn := range c.closeFuncs {
+		c.mu.Lock()
+		closeFuncs := c.closeFuncs
+		c.mu.Unlock()
+		for _, fn := range closeFuncs {
 			fn()
 		}
 		c.setPeerDead(err) // which will also cause c.heartbeatFailure to run
@@ -92,6 +100,54 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// Halt halts the buildlet immediately, killing any commands it's
+// running: its process exits, and its host halts or reboots if the
+// buildlet is configured to do so. Unlike Close, it reports errors,
+// and leaves the Client open; callers should still Close it.
+func (c *Client) Halt(ctx context.Context) error {
+	_, err := c.halt(ctx, url.Values{"mode": {"immediate"}})
+	return err
+}
+
+// HaltGraceful halts the buildlet like Halt, but first lets the
+// commands it's running finish, for up to timeout if positive. The
+// buildlet refuses new commands meanwhile. HaltGraceful reports
+// whether the commands finished before the timeout, after which the
+// buildlet halts regardless. The context bounds only how long
+// HaltGraceful waits: the buildlet halts even if it's canceled.
+//
+// Buildlets older than version 43 halt immediately, and HaltGraceful
+// reports that their commands didn't finish.
+func (c *Client) HaltGraceful(ctx context.Context, timeout time.Duration) (drained bool, err error) {
+	form := url.Values{"mode": {"graceful"}}
+	if timeout > 0 {
+		form.Set("timeout", timeout.String())
+	}
+	res, err := c.halt(ctx, form)
+	if err != nil {
+		return false, err
+	}
+	return res.Header.Get("X-Buildlet-Halt-Drained") == "true", nil
+}
+
+func (c *Client) halt(ctx context.Context, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.URL()+"/halt", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return nil, fmt.Errorf("%v; body: %s", res.Status, slurp)
+	}
+	return res, nil
+}
+
 func (c *Client) setPeerDead(err error) {
 	c.setPeerDeadOnce.Do(func() {
 		c.MarkBroken()
@@ -129,6 +185,51 @@ func (c *Client) SetHTTPClient(httpClient *http.Client) {
 	c.httpClient = httpClient
 }
 
+// EnableHTTP2 makes the client send its requests over HTTP/2, so
+// concurrent ones, such as status polls during a long Exec or
+// parallel file transfers, share a single connection to the buildlet
+// rather than each dialing its own. That matters most for reverse
+// buildlets, every connection to which must be dialed back through
+// their one connection to the coordinator. Requests that upgrade
+// their connection, such as ConnectSSH's, keep using HTTP/1.1.
+//
+// The buildlet must be version 45 or later; older ones only speak
+// HTTP/1.1. EnableHTTP2 has no effect on gomote clients, whose
+// requests go through the coordinator.
+func (c *Client) EnableHTTP2() {
+	if c.remoteBuildlet != "" {
+		return
+	}
+	dial := c.getDialer()
+	if !c.tls.IsZero() {
+		tlsDial := c.tls.tlsDialer(http2.NextProtoTLS)
+		dial = func(context.Context) (net.Conn, error) {
+			conn, err := tlsDial("tcp", c.ipPort)
+			if err != nil {
+				return nil, err
+			}
+			if p := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+				conn.Close()
+				return nil, fmt.Errorf("buildlet negotiated protocol %q, not HTTP/2", p)
+			}
+			return conn, nil
+		}
+	}
+	tr := &http2.Transport{
+		// Buildlets without TLS speak HTTP/2 with prior knowledge.
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+			defer cancel()
+			return dial(ctx)
+		},
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.h2Client = &http.Client{Transport: tr}
+	c.closeFuncs = append(c.closeFuncs, tr.CloseIdleConnections)
+}
+
 // SetDialer sets the function that creates a new connection to the buildlet.
 // By default, net.Dialer.DialContext is used. SetDialer has effect only when
 // TLS isn't used.
@@ -166,8 +267,9 @@ type Client struct {
 	name            string                                  // optional name for debugging, returned by Name
 	gceInstanceName string                                  // instance name for GCE VMs
 
-	closeFuncs  []func() // optional extra code to run on close
+	closeFuncs  []func() // optional extra code to run on close; guarded by mu
 	releaseMode bool
+	h2Client    *http.Client // non-nil once EnableHTTP2 is called; guarded by mu
 
 	ctx              context.Context
 	ctxCancel        context.CancelFunc
@@ -270,7 +372,15 @@ func (c *Client) do(req *http.Request) (*http.Response, error) {
 	if c.remoteBuildlet != "" {
 		req.Header.Set("X-Buildlet-Proxy", c.remoteBuildlet)
 	}
-	return c.httpClient.Do(req)
+	hc := c.httpClient
+	if req.Header.Get("Upgrade") == "" {
+		c.mu.Lock()
+		if c.h2Client != nil {
+			hc = c.h2Client
+		}
+		c.mu.Unlock()
+	}
+	return hc.Do(req)
 }
 
 // ProxyTCP connects to the given port on the remote buildlet.
@@ -279,6 +389,11 @@ func (c *Client) do(req *http.Request) (*http.Response, error) {
 // created for RDP to Windows machines, but it might get reused for other
 // purposes in the future.
 func (c *Client) ProxyTCP(port int) (io.ReadWriteCloser, error) {
+	return c.ProxyTCPContext(context.Background(), port)
+}
+
+// ProxyTCPContext is like ProxyTCP but uses ctx to bound connecting.
+func (c *Client) ProxyTCPContext(ctx context.Context, port int) (io.ReadWriteCloser, error) {
 	if c.RemoteName() == "" {
 		return nil, errors.New("ProxyTCP currently only supports gomote-created buildlets")
 	}
@@ -287,7 +402,7 @@ func (c *Client) ProxyTCP(port int) (io.ReadWriteCloser, error) {
 		return nil, err
 	}
 	req.Header.Add("X-Target-Port", fmt.Sprint(port))
-	res, err := c.do(req)
+	res, err := c.do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -422,13 +537,89 @@ func (c *Client) doOK(req *http.Request) error {
 // The dir is created if necessary.
 // The Reader must be of a tar.gz file.
 func (c *Client) PutTar(ctx context.Context, r io.Reader, dir string) error {
+	return c.PutTarOpts(ctx, r, dir, TarOpts{})
+}
+
+// Encodings of tar files, as listed in Status.TarEncodings.
+const (
+	TarEncodingGzip     = "gzip"
+	TarEncodingIdentity = "identity" // uncompressed
+)
+
+// TarOpts are options for Client.PutTarOpts and Client.GetTarOpts.
+type TarOpts struct {
+	// Encoding is the compression of the tar file: TarEncodingGzip,
+	// the default, or TarEncodingIdentity, which requires buildlet
+	// version 30. See Client.NegotiateTarEncoding.
+	Encoding string
+
+	// GzipLevel, if non-zero, is the compression level of gzipped
+	// tar files the buildlet produces, from gzip.HuffmanOnly to
+	// gzip.BestCompression. Higher levels pay off on slow links.
+	// It is ignored by buildlets older than version 30.
+	GzipLevel int
+
+	// Include, if non-empty, limits the tar file GetTarOpts
+	// returns to the files matching any of these patterns, in
+	// path.Match syntax, and the contents of matching directories,
+	// so clients can fetch just what they need. Patterns containing
+	// a slash are matched against paths relative to the directory
+	// fetched, and others against base names.
+	//
+	// Exclude are patterns of files and directories to leave out,
+	// even if Include matches them.
+	//
+	// The buildlet evaluates both, which requires version 47;
+	// GetTarOpts fails rather than fetch everything from older
+	// buildlets. PutTarOpts ignores them.
+	Include []string
+	Exclude []string
+}
+
+// PutTarOpts is like PutTar, but the tar file read from r is
+// compressed according to opts.Encoding.
+//
+// If r is a large file, or otherwise supports io.ReaderAt and
+// io.Seeker, and the buildlet supports it (see Status.UploadChunks),
+// PutTar and PutTarOpts upload it in chunks, several at once, to make
+// better use of high-latency links.
+func (c *Client) PutTarOpts(ctx context.Context, r io.Reader, dir string, opts TarOpts) error {
+	if sr, ok := chunkable(r); ok {
+		st, err := c.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if st.UploadChunks > 0 {
+			return c.putTarChunked(ctx, sr, dir, opts, st.UploadChunks)
+		}
+	}
 	req, err := http.NewRequest("PUT", c.URL()+"/writetgz?dir="+url.QueryEscape(dir), r)
 	if err != nil {
 		return err
 	}
+	if opts.Encoding != "" {
+		req.Header.Set("X-Tar-Encoding", opts.Encoding)
+	}
 	return c.doOK(req.WithContext(ctx))
 }
 
+// NegotiateTarEncoding returns the first of the encodings in prefer
+// that the buildlet supports, or TarEncodingGzip if none is.
+func (c *Client) NegotiateTarEncoding(ctx context.Context, prefer ...string) (string, error) {
+	st, err := c.Status(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range prefer {
+		for _, e := range st.TarEncodings {
+			if p == e {
+				return p, nil
+			}
+		}
+	}
+	return TarEncodingGzip, nil
+}
+
 // PutTarFromURL tells the buildlet to download the tar.gz file from tarURL
 // and write it to dir, a relative directory from the workdir.
 // If dir is empty, they're placed at the root of the buildlet's work directory.
@@ -462,11 +653,13 @@ func (c *Client) Put(ctx context.Context, r io.Reader, path string, mode os.File
 // GetTar returns a .tar.gz stream of the given directory, relative to the buildlet's work dir.
 // The provided dir may be empty to get everything.
 func (c *Client) GetTar(ctx context.Context, dir string) (io.ReadCloser, error) {
-	var args string
-	if c.releaseMode {
-		args = "&pargzip=0"
-	}
-	req, err := http.NewRequest("GET", c.URL()+"/tgz?dir="+url.QueryEscape(dir)+args, nil)
+	return c.GetTarOpts(ctx, dir, TarOpts{})
+}
+
+// GetTarOpts is like GetTar, but the returned tar stream is
+// compressed according to opts.
+func (c *Client) GetTarOpts(ctx context.Context, dir string, opts TarOpts) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.URL()+"/tgz?"+c.tarArgs(dir, opts).Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -479,15 +672,59 @@ func (c *Client) GetTar(ctx context.Context, dir string) (io.ReadCloser, error)
 		res.Body.Close()
 		return nil, fmt.Errorf("%v; body: %s", res.Status, slurp)
 	}
+	if err := checkTarOpts(res, opts); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
 	return res.Body, nil
 }
 
+// tarArgs returns the /tgz query parameters to fetch dir according
+// to opts.
+func (c *Client) tarArgs(dir string, opts TarOpts) url.Values {
+	args := url.Values{"dir": {dir}}
+	if c.releaseMode {
+		args.Set("pargzip", "0")
+	}
+	if opts.Encoding != "" {
+		args.Set("encoding", opts.Encoding)
+	}
+	if opts.GzipLevel != 0 {
+		args.Set("level", fmt.Sprint(opts.GzipLevel))
+	}
+	if len(opts.Include) > 0 || len(opts.Exclude) > 0 {
+		args["include"] = opts.Include
+		args["exclude"] = opts.Exclude
+	}
+	return args
+}
+
+// checkTarOpts returns an error if the /tgz response res ignored
+// any of opts.
+func checkTarOpts(res *http.Response, opts TarOpts) error {
+	if opts.Encoding != "" && opts.Encoding != TarEncodingGzip && res.Header.Get("X-Tar-Encoding") != opts.Encoding {
+		// Older buildlets ignore the encoding and send gzip.
+		return fmt.Errorf("buildlet does not support tar encoding %q", opts.Encoding)
+	}
+	if (len(opts.Include) > 0 || len(opts.Exclude) > 0) && res.Header.Get("X-Tar-Filtered") == "" {
+		// Older buildlets ignore the patterns and send everything.
+		return errors.New("buildlet does not support tar include and exclude patterns")
+	}
+	return nil
+}
+
 // ExecOpts are options for a remote command invocation.
 type ExecOpts struct {
 	// Output is the output of stdout and stderr.
 	// If nil, the output is discarded.
 	Output io.Writer
 
+	// Stderr, if non-nil, receives the command's standard error
+	// separately, and Output then only receives its standard
+	// output. Buildlets older than version 31 do not separate
+	// them, and write both to Output.
+	Stderr io.Writer
+
 	// Dir is the directory from which to execute the command.
 	// It is optional. If not specified, it defaults to the directory of
 	// the command, or the work directory if SystemLevel is set.
@@ -522,6 +759,127 @@ type ExecOpts struct {
 	// response from the buildlet, but before the output begins
 	// writing to Output.
 	OnStartExec func()
+
+	// OnExit is an optional hook that runs with the exit status of
+	// the command once it completes, whether or not it succeeded.
+	OnExit func(ExitStatus)
+
+	// Limits optionally limits the resources the command may use.
+	// Buildlets older than version 33 ignore it.
+	Limits ExecLimits
+
+	// CrashDumps, if true, asks the buildlet to collect the core
+	// files or Windows minidumps of the command's processes that
+	// crash, and to run Go programs with GOTRACEBACK=crash unless
+	// ExtraEnv sets it. The names of the collected dumps are in
+	// ExitStatus.CrashDumps; see GetCrashDump. It requires
+	// FeatureCrashDumps.
+	CrashDumps bool
+}
+
+// ExecLimits are resource limits of a command run by Client.Exec.
+// Zero values mean no limit.
+type ExecLimits struct {
+	// CPUs limits the command to that many CPUs' worth of time,
+	// such as 1.5.
+	CPUs float64
+	// Memory limits the command's memory use, in bytes. On Linux,
+	// the command is killed if it uses more; on Windows, its
+	// allocations beyond the limit fail.
+	Memory int64
+	// Timeout is how long the command may run before the buildlet
+	// kills it.
+	Timeout time.Duration
+}
+
+// Names of limits in ExitStatus.Limit.
+const (
+	LimitTime   = "time"
+	LimitMemory = "memory"
+)
+
+// ExitStatus describes how a command run by Client.Exec exited.
+type ExitStatus struct {
+	// Code is the command's exit code, or -1 if it did not exit
+	// normally, such as when killed by a signal.
+	Code int
+	// Signal names the signal that terminated the command, if any.
+	// It is always empty for buildlets older than version 31.
+	Signal string
+	// Duration is how long the command ran. It is zero for
+	// buildlets older than version 31.
+	Duration time.Duration
+	// Limit names the ExecLimits limit the command was killed for
+	// exceeding, LimitTime or LimitMemory, if known.
+	Limit string
+	// CrashDumps are the names of the crash dumps collected from
+	// the command, if ExecOpts.CrashDumps was set.
+	CrashDumps []string
+}
+
+// ExitError is the remoteErr returned by Client.Exec for a command
+// that failed.
+type ExitError struct {
+	ExitStatus
+	// State is the buildlet's description of the failure, such as
+	// "exit status 1".
+	State string
+}
+
+func (e *ExitError) Error() string { return e.State }
+
+// exitStatus returns the exit status described by the trailers of an
+// /exec response whose Process-State trailer is state.
+func exitStatus(trailer http.Header, state string) ExitStatus {
+	es := ExitStatus{Code: -1, Signal: trailer.Get("Process-Signal")}
+	if code, err := strconv.Atoi(trailer.Get("Process-Exit-Code")); err == nil {
+		es.Code = code
+	} else if state == "ok" {
+		es.Code = 0
+	} else if _, err := fmt.Sscanf(state, "exit status %d", &es.Code); err != nil {
+		// Older buildlets only report the state.
+		es.Code = -1
+	}
+	es.Duration, _ = time.ParseDuration(trailer.Get("Process-Duration"))
+	es.Limit = trailer.Get("Process-Limit")
+	for _, name := range strings.Split(trailer.Get("Process-Crash-Dumps"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			es.CrashDumps = append(es.CrashDumps, name)
+		}
+	}
+	return es
+}
+
+// Stream IDs of frames in framed /exec responses.
+const (
+	frameStdout = 1
+	frameStderr = 2
+)
+
+// copyFrames copies the framed /exec output from r to stdout and
+// stderr by stream: each frame is a byte naming its stream, a 4-byte
+// big-endian payload length, and the payload.
+func copyFrames(stdout, stderr io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var hdr [5]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		w := stdout
+		switch hdr[0] {
+		case frameStdout:
+		case frameStderr:
+			w = stderr
+		default:
+			return fmt.Errorf("unknown exec output stream %d", hdr[0])
+		}
+		if _, err := io.CopyN(w, br, int64(binary.BigEndian.Uint32(hdr[1:]))); err != nil {
+			return err
+		}
+	}
 }
 
 var ErrTimeout = errors.New("buildlet: timeout waiting for command to complete")
@@ -534,8 +892,11 @@ var ErrTimeout = errors.New("buildlet: timeout waiting for command to complete")
 // seen to completition. If execErr is non-nil, the remoteErr is
 // meaningless.
 //
-// If the context's deadline is exceeded, the returned execErr is
-// ErrTimeout.
+// If the context is canceled or its deadline is exceeded, Exec returns
+// promptly, and the buildlet kills the command. The returned execErr
+// is then the context's error, or ErrTimeout for an exceeded
+// deadline. As before, a command abandoned after it started marks the
+// client as broken.
 func (c *Client) Exec(ctx context.Context, cmd string, opts ExecOpts) (remoteErr, execErr error) {
 	var mode string
 	if opts.SystemLevel {
@@ -556,6 +917,21 @@ func (c *Client) Exec(ctx context.Context, cmd string, opts ExecOpts) (remoteErr
 		"path":   path,
 		"debug":  {fmt.Sprint(opts.Debug)},
 	}
+	if opts.Stderr != nil {
+		form.Set("framed", "1")
+	}
+	if l := opts.Limits; l.CPUs > 0 {
+		form.Set("cpuLimit", strconv.FormatFloat(l.CPUs, 'g', -1, 64))
+	}
+	if l := opts.Limits; l.Memory > 0 {
+		form.Set("memLimit", strconv.FormatInt(l.Memory, 10))
+	}
+	if l := opts.Limits; l.Timeout > 0 {
+		form.Set("timeLimit", l.Timeout.String())
+	}
+	if opts.CrashDumps {
+		form.Set("crashDumps", "1")
+	}
 	req, err := http.NewRequest("POST", c.URL()+"/exec", strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, err
@@ -567,6 +943,12 @@ func (c *Client) Exec(ctx context.Context, cmd string, opts ExecOpts) (remoteErr
 	// 10 seconds should be plenty of time, regardless of where on the planet
 	// (Atlanta, Paris, etc) the reverse buildlet is:
 	res, err := c.doHeaderTimeout(req, 10*time.Second)
+	if ctx.Err() != nil {
+		if err == nil {
+			res.Body.Close()
+		}
+		return nil, execContextErr(ctx)
+	}
 	if err == errHeaderTimeout {
 		c.MarkBroken()
 		return nil, errors.New("buildlet: timeout waiting for exec header response")
@@ -591,7 +973,13 @@ func (c *Client) Exec(ctx context.Context, cmd string, opts ExecOpts) (remoteErr
 		if out == nil {
 			out = ioutil.Discard
 		}
-		if _, err := io.Copy(out, res.Body); err != nil {
+		var err error
+		if res.Header.Get("X-Exec-Framed") == "1" {
+			err = copyFrames(out, opts.Stderr, res.Body)
+		} else {
+			_, err = io.Copy(out, res.Body)
+		}
+		if err != nil {
 			resc <- errs{execErr: fmt.Errorf("error copying response: %v", err)}
 			return
 		}
@@ -606,8 +994,10 @@ func (c *Client) Exec(ctx context.Context, cmd string, opts ExecOpts) (remoteErr
 			resc <- errs{execErr: errors.New("missing Process-State trailer from HTTP response; buildlet built with old (<= 1.4) Go?")}
 			return
 		}
+		es := exitStatus(res.Trailer, state)
+		condRunExit(opts.OnExit, es)
 		if state != "ok" {
-			resc <- errs{remoteErr: errors.New(state)}
+			resc <- errs{remoteErr: &ExitError{ExitStatus: es, State: state}}
 		} else {
 			resc <- errs{} // success
 		}
@@ -616,18 +1006,32 @@ func (c *Client) Exec(ctx context.Context, cmd string, opts ExecOpts) (remoteErr
 	case res := <-resc:
 		if res.execErr != nil {
 			c.MarkBroken()
-			if res.execErr == context.DeadlineExceeded {
-				// Historical pre-context value.
-				// TODO: update docs & callers to just use the context value.
-				res.execErr = ErrTimeout
+			if ctx.Err() != nil {
+				return nil, execContextErr(ctx)
 			}
 		}
 		return res.remoteErr, res.execErr
+	case <-ctx.Done():
+		// Closing the response body (deferred above) ends the
+		// request, and the buildlet kills the command. The
+		// command's state is unknown, so don't reuse the client.
+		c.MarkBroken()
+		return nil, execContextErr(ctx)
 	case <-c.peerDead:
 		return nil, c.deadErr
 	}
 }
 
+// execContextErr returns the error for Exec to return once ctx is
+// done.
+func execContextErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		// Historical pre-context value.
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
 // RemoveAll deletes the provided paths, relative to the work directory.
 func (c *Client) RemoveAll(ctx context.Context, paths ...string) error {
 	if len(paths) == 0 {
@@ -644,11 +1048,16 @@ func (c *Client) RemoveAll(ctx context.Context, paths ...string) error {
 
 // DestroyVM shuts down the buildlet and destroys the VM instance.
 func (c *Client) DestroyVM(ts oauth2.TokenSource, proj, zone, instance string) error {
+	return c.DestroyVMContext(context.Background(), ts, proj, zone, instance)
+}
+
+// DestroyVMContext is like DestroyVM but uses ctx for the GCE request.
+func (c *Client) DestroyVMContext(ctx context.Context, ts oauth2.TokenSource, proj, zone, instance string) error {
 	// TODO(bradfitz): move GCE stuff out of this package?
 	gceErrc := make(chan error, 1)
 	buildletErrc := make(chan error, 1)
 	go func() {
-		gceErrc <- DestroyVM(ts, proj, zone, instance)
+		gceErrc <- DestroyVMContext(ctx, ts, proj, zone, instance)
 	}()
 	go func() {
 		buildletErrc <- c.Close()
@@ -670,6 +1079,8 @@ func (c *Client) DestroyVM(ts oauth2.TokenSource, proj, zone, instance string) e
 				retErr = err
 			}
 			buildletDone = true
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-timeout.C:
 			e := ""
 			if !buildletDone {
@@ -693,6 +1104,45 @@ func (c *Client) DestroyVM(ts oauth2.TokenSource, proj, zone, instance string) e
 // to do with a buildlet.
 type Status struct {
 	Version int // buildlet version, coordinator rejects any value less than 1.
+
+	// ActiveExecs is the number of commands currently being run by
+	// the buildlet. It is always zero for buildlets older than
+	// version 26.
+	ActiveExecs int `json:",omitempty"`
+
+	// Started is when the buildlet process started. It is the zero
+	// time for buildlets older than version 28. A reverse buildlet
+	// exits after each session with the coordinator, so a change in
+	// Started means a session has completed.
+	Started time.Time
+
+	// TarEncodings are the compression encodings of tar files the
+	// buildlet accepts and produces, such as "gzip" and "identity"
+	// for uncompressed. It is empty for buildlets older than version
+	// 30, which only support gzip.
+	TarEncodings []string `json:",omitempty"`
+
+	// UploadChunks is how many chunks of a tar file upload the
+	// buildlet is willing to receive in parallel. It is zero for
+	// buildlets older than version 37, which don't support chunked
+	// uploads.
+	UploadChunks int `json:",omitempty"`
+
+	// WorkdirQuota is the maximum size of the work directory in
+	// bytes, beyond which the buildlet removes its least recently
+	// modified top-level directories. It is zero if the buildlet
+	// has no quota or is older than version 39.
+	WorkdirQuota int64 `json:",omitempty"`
+
+	// WorkdirUsage is the size of the work directory in bytes, as
+	// last measured by the buildlet, which it does about once a
+	// minute. It is only reported along with a WorkdirQuota.
+	WorkdirUsage int64 `json:",omitempty"`
+
+	// Halting is whether the buildlet has been asked to halt, and
+	// refuses to run new commands. It is always false for buildlets
+	// older than version 43.
+	Halting bool `json:",omitempty"`
 }
 
 // Status returns an Status value describing this buildlet.
@@ -708,7 +1158,9 @@ func (c *Client) Status(ctx context.Context) (Status, error) {
 		return Status{}, err
 	}
 	req = req.WithContext(ctx)
-	resp, err := c.doHeaderTimeout(req, 10*time.Second) // plenty of time
+	resp, err := c.replay(req, func(req *http.Request) (*http.Response, error) {
+		return c.doHeaderTimeout(req, 10*time.Second) // plenty of time
+	})
 	if err != nil {
 		return Status{}, err
 	}
@@ -734,7 +1186,9 @@ func (c *Client) WorkDir(ctx context.Context) (string, error) {
 		return "", err
 	}
 	req = req.WithContext(ctx)
-	resp, err := c.doHeaderTimeout(req, 10*time.Second) // plenty of time
+	resp, err := c.replay(req, func(req *http.Request) (*http.Response, error) {
+		return c.doHeaderTimeout(req, 10*time.Second) // plenty of time
+	})
 	if err != nil {
 		return "", err
 	}
@@ -788,6 +1242,30 @@ func (de DirEntry) IsDir() bool {
 	return de.line[0] == 'd'
 }
 
+// Size returns the size of a regular file, or -1 if de isn't one.
+func (de DirEntry) Size() int64 {
+	f := strings.Split(de.line, "\t")
+	if len(f) < 3 {
+		return -1
+	}
+	n, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// ModTime returns the modification time of a regular file, or the
+// zero time if de isn't one.
+func (de DirEntry) ModTime() time.Time {
+	f := strings.Split(de.line, "\t")
+	if len(f) < 4 {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, f[3])
+	return t
+}
+
 // Digest returns the SHA-1 digest of the file, such as "da39a3ee5e6b4b0d3255bfef95601890afd80709".
 // It returns the empty string if the digest isn't included.
 func (de DirEntry) Digest() string {
@@ -812,23 +1290,69 @@ type ListDirOpts struct {
 	// Digest controls whether the SHA-1 digests of regular files
 	// are returned.
 	Digest bool
+
+	// Glob, if non-empty, limits the entries listed to those
+	// matching any of the patterns, in path.Match syntax. Patterns
+	// containing a slash are matched against the entry's path
+	// relative to the listed directory, and others against its
+	// base name. Directories are descended into whether or not
+	// they match.
+	Glob []string
+
+	// MaxDepth, if positive, limits how deep a recursive listing
+	// goes: 1 only lists the directory's own entries, 2 also those
+	// of its subdirectories, and so on.
+	MaxDepth int
+}
+
+// Match reports whether the entry with the slash-separated path name,
+// relative to the listed directory, is included by o's Glob and
+// MaxDepth. A trailing slash is ignored, and invalid patterns match
+// nothing.
+func (o ListDirOpts) Match(name string) bool {
+	name = strings.TrimSuffix(name, "/")
+	if o.MaxDepth > 0 && strings.Count(name, "/") >= o.MaxDepth {
+		return false
+	}
+	if len(o.Glob) == 0 {
+		return true
+	}
+	for _, pat := range o.Glob {
+		target := name
+		if !strings.Contains(pat, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pat, target); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // ListDir lists the contents of a directory.
 // The fn callback is run for each entry.
 // The directory dir itself is not included.
 func (c *Client) ListDir(ctx context.Context, dir string, opts ListDirOpts, fn func(DirEntry)) error {
+	for _, pat := range opts.Glob {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("bad glob pattern %q: %v", pat, err)
+		}
+	}
 	param := url.Values{
 		"dir":       {dir},
 		"recursive": {fmt.Sprint(opts.Recursive)},
 		"skip":      opts.Skip,
 		"digest":    {fmt.Sprint(opts.Digest)},
+		"glob":      opts.Glob,
+	}
+	if opts.MaxDepth > 0 {
+		param.Set("depth", strconv.Itoa(opts.MaxDepth))
 	}
 	req, err := http.NewRequest("GET", c.URL()+"/ls?"+param.Encode(), nil)
 	if err != nil {
 		return err
 	}
-	resp, err := c.do(req.WithContext(ctx))
+	resp, err := c.doReplay(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -839,8 +1363,12 @@ func (c *Client) ListDir(ctx context.Context, dir string, opts ListDirOpts, fn f
 	}
 	sc := bufio.NewScanner(resp.Body)
 	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		fn(DirEntry{line: line})
+		de := DirEntry{line: strings.TrimSpace(sc.Text())}
+		// Buildlets older than version 36 ignore Glob and
+		// MaxDepth.
+		if opts.Match(de.Name()) {
+			fn(de)
+		}
 	}
 	return sc.Err()
 }
@@ -866,49 +1394,95 @@ func (c *Client) dialWithNetDial(ctx context.Context) (net.Conn, error) {
 // The authorizedPubKey must be a line from an ~/.ssh/authorized_keys file
 // and correspond to the private key to be used to communicate over the net.Conn.
 func (c *Client) ConnectSSH(user, authorizedPubKey string) (net.Conn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	return c.ConnectSSHContext(context.Background(), user, authorizedPubKey)
+}
+
+// ConnectSSHContext is like ConnectSSH but uses ctx to bound
+// connecting, for which it allows up to 15 seconds.
+func (c *Client) ConnectSSHContext(ctx context.Context, user, authorizedPubKey string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
-	conn, err := c.getDialer()(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error dialing HTTP connection before SSH upgrade: %v", err)
-	}
-	deadline, _ := ctx.Deadline()
-	conn.SetDeadline(deadline)
 	req, err := http.NewRequest("POST", "/connect-ssh", nil)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 	req.Header.Add("X-Go-Ssh-User", user)
 	req.Header.Add("X-Go-Authorized-Key", authorizedPubKey)
+	return c.connectUpgrade(ctx, req)
+}
+
+// connectUpgrade sends req, which the buildlet answers by upgrading
+// the connection to a proxy, on a new connection to the buildlet, and
+// returns the connection once upgraded.
+func (c *Client) connectUpgrade(ctx context.Context, req *http.Request) (net.Conn, error) {
+	path := req.URL.Path
+	conn, err := c.getDialer()(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing HTTP connection before %s upgrade: %v", path, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Interrupt the handshake below if ctx is canceled first.
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-handshakeDone:
+		}
+	}()
 	if !c.tls.IsZero() {
 		req.SetBasicAuth(c.authUsername(), c.password)
 	}
 	if err := req.Write(conn); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("writing /connect-ssh HTTP request failed: %v", err)
+		return nil, fmt.Errorf("writing %s HTTP request failed: %v", path, err)
 	}
 	bufr := bufio.NewReader(conn)
 	res, err := http.ReadResponse(bufr, req)
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("reading /connect-ssh response: %v", err)
+		return nil, fmt.Errorf("reading %s response: %v", path, err)
 	}
 	if res.StatusCode != http.StatusSwitchingProtocols {
 		slurp, _ := ioutil.ReadAll(res.Body)
 		conn.Close()
-		return nil, fmt.Errorf("unexpected /connect-ssh response: %v, %s", res.Status, slurp)
+		return nil, fmt.Errorf("unexpected %s response: %v, %s", path, res.Status, slurp)
+	}
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return nil, err
 	}
 	conn.SetDeadline(time.Time{})
+	if bufr.Buffered() > 0 {
+		// The proxied server already sent something.
+		return bufferedConn{conn, bufr}, nil
+	}
 	return conn, nil
 }
 
+// bufferedConn is a net.Conn whose reads come through r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
 func condRun(fn func()) {
 	if fn != nil {
 		fn()
 	}
 }
 
+func condRunExit(fn func(ExitStatus), es ExitStatus) {
+	if fn != nil {
+		fn(es)
+	}
+}
+
 type onEOFReadCloser struct {
 	rc io.ReadCloser
 	fn func()
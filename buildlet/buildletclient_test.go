@@ -8,11 +8,16 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestConnectSSHTLS(t *testing.T) {
@@ -85,7 +90,7 @@ func TestConnectSSHTLS(t *testing.T) {
 				authUser: tc.authUser,
 				dialer:   tc.dialer,
 			}
-			gotConn, gotErr := c.ConnectSSH(tc.user, tc.key)
+			gotConn, gotErr := c.ConnectSSHContext(context.Background(), tc.user, tc.key)
 			if gotErr != nil {
 				t.Fatalf("Client.ConnectSSH(%s, %s) = %v, %v; want no error", tc.user, tc.key, gotConn, gotErr)
 			}
@@ -156,7 +161,7 @@ func TestConnectSSHNonTLS(t *testing.T) {
 				authUser: tc.authUser,
 				dialer:   tc.dialer,
 			}
-			gotConn, gotErr := c.ConnectSSH(tc.user, tc.key)
+			gotConn, gotErr := c.ConnectSSHContext(context.Background(), tc.user, tc.key)
 			if (gotErr != nil) != tc.wantErr {
 				t.Fatalf("Client.ConnectSSH(%q, %q) = %v, %v; want net.Conn, error=%t", tc.user, tc.key, gotConn, gotErr, tc.wantErr)
 			}
@@ -171,3 +176,123 @@ func createKeyPair(t *testing.T) KeyPair {
 	}
 	return kp
 }
+
+func TestListDirOptsMatch(t *testing.T) {
+	for _, tt := range []struct {
+		opts ListDirOpts
+		name string
+		want bool
+	}{
+		{ListDirOpts{}, "a/b/c.go", true},
+		{ListDirOpts{Glob: []string{"*.go"}}, "a/b/c.go", true},
+		{ListDirOpts{Glob: []string{"*.go"}}, "a/b/c.txt", false},
+		{ListDirOpts{Glob: []string{"a/*"}}, "a/b/", true},
+		{ListDirOpts{Glob: []string{"a/*"}}, "a/b/c.go", false},
+		{ListDirOpts{Glob: []string{"*.txt", "*.go"}}, "c.go", true},
+		{ListDirOpts{Glob: []string{"["}}, "c.go", false},
+		{ListDirOpts{MaxDepth: 2}, "a/b/", true},
+		{ListDirOpts{MaxDepth: 2}, "a/b/c.go", false},
+	} {
+		if got := tt.opts.Match(tt.name); got != tt.want {
+			t.Errorf("%+v.Match(%q) = %v, wanted %v", tt.opts, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnableHTTP2(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tls=%v", useTLS), func(t *testing.T) {
+			const n = 5
+			var (
+				mu       sync.Mutex
+				conns    int
+				arrived  = make(chan bool, n)
+				proceed  = make(chan bool)
+				upgraded = make(chan int, 1)
+			)
+			h2s := &http2.Server{}
+			ts := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Upgrade") != "" {
+					upgraded <- r.ProtoMajor
+					w.WriteHeader(http.StatusSwitchingProtocols)
+					return
+				}
+				if r.ProtoMajor != 2 {
+					t.Errorf("%s request used %s; want HTTP/2", r.URL.Path, r.Proto)
+				}
+				arrived <- true
+				<-proceed
+				fmt.Fprintln(w, `{"version": 45}`)
+			}), h2s))
+			ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					mu.Lock()
+					conns++
+					mu.Unlock()
+				}
+			}
+			if err := http2.ConfigureServer(ts.Config, h2s); err != nil {
+				t.Fatal(err)
+			}
+			kp := NoKeyPair
+			if useTLS {
+				kp = createKeyPair(t)
+				cert, err := tls.X509KeyPair([]byte(kp.CertPEM), []byte(kp.KeyPEM))
+				if err != nil {
+					t.Fatal(err)
+				}
+				ts.TLS = &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+				}
+				ts.StartTLS()
+			} else {
+				ts.Start()
+			}
+			defer ts.Close()
+
+			c := NewClient(ts.Listener.Addr().String(), kp)
+			c.EnableHTTP2()
+			errc := make(chan error, n)
+			for i := 0; i < n; i++ {
+				go func() {
+					_, err := c.Status(context.Background())
+					errc <- err
+				}()
+			}
+			// Wait for all the requests to be in flight at once.
+			for i := 0; i < n; i++ {
+				<-arrived
+			}
+			close(proceed)
+			for i := 0; i < n; i++ {
+				if err := <-errc; err != nil {
+					t.Errorf("Status: %v", err)
+				}
+			}
+			mu.Lock()
+			if conns != 1 {
+				t.Errorf("%d concurrent requests used %d connections; want 1", n, conns)
+			}
+			mu.Unlock()
+
+			if !useTLS {
+				// Upgrades need HTTP/1.1.
+				req, err := http.NewRequest("POST", c.URL()+"/connect", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "test")
+				res, err := c.do(req)
+				if err != nil {
+					t.Fatalf("upgrade request: %v", err)
+				}
+				res.Body.Close()
+				if major := <-upgraded; major != 1 {
+					t.Errorf("upgrade request used HTTP/%d; want HTTP/1.1", major)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// A CrashDump is a core file or Windows minidump that a buildlet
+// collected from a command run with ExecOpts.CrashDumps.
+type CrashDump struct {
+	// Name identifies the dump on the buildlet.
+	Name string `json:"name"`
+	// Size is the size of the dump in bytes.
+	Size int64 `json:"size"`
+	// Time is when the dump was collected.
+	Time time.Time `json:"time"`
+}
+
+// CrashDumps returns the crash dumps that the buildlet holds, oldest
+// first. The buildlet keeps a limited number of them, removing the
+// oldest ones as it collects new ones. It requires FeatureCrashDumps.
+func (c *Client) CrashDumps(ctx context.Context) ([]CrashDump, error) {
+	var dumps []CrashDump
+	req, err := http.NewRequest("GET", c.URL()+"/debug/crashdumps", nil)
+	if err != nil {
+		return nil, err
+	}
+	err = c.getJSON(ctx, req, &dumps)
+	return dumps, err
+}
+
+// GetCrashDump returns the contents of the named crash dump. The
+// caller must close it.
+func (c *Client) GetCrashDump(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.URL()+"/debug/crashdumps?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.doReplay(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
+		res.Body.Close()
+		return nil, fmt.Errorf("%v; body: %s", res.Status, slurp)
+	}
+	return res.Body, nil
+}
+
+// DeleteCrashDump deletes the named crash dump from the buildlet.
+func (c *Client) DeleteCrashDump(ctx context.Context, name string) error {
+	req, err := http.NewRequest("DELETE", c.URL()+"/debug/crashdumps?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	return c.doOK(req.WithContext(ctx))
+}
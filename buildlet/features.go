@@ -0,0 +1,181 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Optional buildlet features, as listed by Client.Features.
+const (
+	// FeatureResumableTransfers is resumable tar uploads and
+	// downloads (see PutTarResumable).
+	FeatureResumableTransfers = "resumable-transfers"
+	// FeatureExecStreams is Exec output with stdout and stderr
+	// kept apart, and the exit status in trailers.
+	FeatureExecStreams = "exec-streams"
+	// FeatureManifests is workdir manifests (see Manifest).
+	FeatureManifests = "manifests"
+	// FeatureSnapshots is workdir snapshots (see Snapshot).
+	FeatureSnapshots = "snapshots"
+	// FeatureExecLimits is per-command CPU, memory, and time
+	// limits (see ExecOpts).
+	FeatureExecLimits = "exec-limits"
+	// FeatureTCPTunnel is TCP port forwarding (see DialPort).
+	FeatureTCPTunnel = "tcp-tunnel"
+	// FeatureListGlob is ListDir glob patterns and depth limits.
+	FeatureListGlob = "ls-glob"
+	// FeatureUploadChunks is parallel chunked tar uploads.
+	FeatureUploadChunks = "upload-chunks"
+	// FeatureExecIsolation is that the buildlet runs commands
+	// isolated in containers or a chroot. Unlike the others, it
+	// depends on how the buildlet is run, not just its version.
+	FeatureExecIsolation = "exec-isolation"
+	// FeatureGracefulHalt is graceful halts (see HaltGraceful).
+	FeatureGracefulHalt = "graceful-halt"
+	// FeatureTarLinks is that tar files keep symlinks, hard links,
+	// and the holes of sparse files.
+	FeatureTarLinks = "tar-links"
+	// FeatureHTTP2 is HTTP/2 support (see EnableHTTP2).
+	FeatureHTTP2 = "http2"
+	// FeatureTarFilter is GetTarOpts include and exclude patterns
+	// (see TarOpts).
+	FeatureTarFilter = "tar-filter"
+	// FeatureCrashDumps is the collection of crash dumps of
+	// commands (see ExecOpts.CrashDumps and CrashDumps). Like
+	// FeatureExecIsolation, it depends on the buildlet's host:
+	// only Linux and Windows buildlets that can find the dumps
+	// support it.
+	FeatureCrashDumps = "crash-dumps"
+	// FeatureFileDownload is single-file downloads in parallel,
+	// resumable chunks (see GetFile).
+	FeatureFileDownload = "file-download"
+	// FeatureTCPListen is listening on TCP ports for remote port
+	// forwarding (see ListenPort).
+	FeatureTCPListen = "tcp-listen"
+)
+
+// featureVersions maps the features that every buildlet of a version
+// supports to the version that introduced them.
+var featureVersions = map[string]int{
+	FeatureResumableTransfers: 29,
+	FeatureExecStreams:        31,
+	FeatureManifests:          32,
+	FeatureSnapshots:          32,
+	FeatureExecLimits:         33,
+	FeatureTCPTunnel:          34,
+	FeatureListGlob:           36,
+	FeatureUploadChunks:       37,
+	FeatureGracefulHalt:       43,
+	FeatureTarLinks:           44,
+	FeatureHTTP2:              45,
+	FeatureTarFilter:          47,
+	FeatureFileDownload:       51,
+	FeatureTCPListen:          54,
+}
+
+// featuresMinVersion is the first buildlet version to serve /features.
+const featuresMinVersion = 46
+
+// Features is a set of optional buildlet features, such as
+// FeatureHTTP2. Features that a Client doesn't know the name of may
+// be present too.
+type Features map[string]bool
+
+// Has reports whether f includes the named feature.
+func (f Features) Has(name string) bool { return f[name] }
+
+// List returns the names of the features in f, sorted.
+func (f Features) List() []string {
+	var names []string
+	for name, ok := range f {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MarshalJSON encodes f as a sorted list of names.
+func (f Features) MarshalJSON() ([]byte, error) {
+	names := f.List()
+	if names == nil {
+		names = []string{}
+	}
+	return json.Marshal(names)
+}
+
+// UnmarshalJSON decodes a list of names.
+func (f *Features) UnmarshalJSON(b []byte) error {
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return err
+	}
+	*f = make(Features, len(names))
+	for _, name := range names {
+		(*f)[name] = true
+	}
+	return nil
+}
+
+// FeaturesOfVersion returns the features that every buildlet of the
+// given version supports.
+func FeaturesOfVersion(version int) Features {
+	f := make(Features)
+	for name, v := range featureVersions {
+		if version >= v {
+			f[name] = true
+		}
+	}
+	return f
+}
+
+// Features returns the optional features that the buildlet supports,
+// so callers can use them without breaking older buildlets. Buildlets
+// older than version 46 don't list their features, so for them it
+// returns FeaturesOfVersion of their version, which lacks
+// FeatureExecIsolation and FeatureCrashDumps.
+func (c *Client) Features(ctx context.Context) (Features, error) {
+	req, err := http.NewRequest("GET", c.URL()+"/features", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.replay(req, func(req *http.Request) (*http.Response, error) {
+		return c.doHeaderTimeout(req, 10*time.Second) // plenty of time
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		status, err := c.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if status.Version < featuresMinVersion {
+			return FeaturesOfVersion(status.Version), nil
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var f Features
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		version  int
+		features string // or "" for no /features
+		want     []string
+	}{
+		{"listed", 46, `["http2","tar-links","some-future-feature"]`, []string{FeatureHTTP2, "some-future-feature", FeatureTarLinks}},
+		{"none listed", 46, `[]`, nil},
+		{"inferred", 42, "", []string{FeatureExecLimits, FeatureExecStreams, FeatureListGlob, FeatureManifests, FeatureResumableTransfers, FeatureSnapshots, FeatureTCPTunnel, FeatureUploadChunks}},
+		{"ancient", 20, "", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/status":
+					fmt.Fprintf(w, `{"Version": %d}`, tt.version)
+				case "/features":
+					if tt.features == "" {
+						http.NotFound(w, r)
+						return
+					}
+					fmt.Fprint(w, tt.features)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer ts.Close()
+			c := NewClient(strings.TrimPrefix(ts.URL, "http://"), NoKeyPair)
+			defer c.Close()
+			f, err := c.Features(context.Background())
+			if err != nil {
+				t.Fatalf("Features: %v", err)
+			}
+			if got := f.List(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Features = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeaturesNotFound(t *testing.T) {
+	// A buildlet new enough to list its features that says 404
+	// isn't mistaken for an old one.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			fmt.Fprint(w, `{"Version": 46}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), NoKeyPair)
+	defer c.Close()
+	if f, err := c.Features(context.Background()); err == nil {
+		t.Errorf("Features = %q; want error", f.List())
+	}
+}
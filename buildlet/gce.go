@@ -277,9 +277,14 @@ OpLoop:
 // currently (2015-01-19) very slow for no good reason. This function
 // returns once it's been requested, not when it's done.
 func DestroyVM(ts oauth2.TokenSource, proj, zone, instance string) error {
-	computeService, _ := compute.New(oauth2.NewClient(context.TODO(), ts))
+	return DestroyVMContext(context.Background(), ts, proj, zone, instance)
+}
+
+// DestroyVMContext is like DestroyVM but uses ctx for the request.
+func DestroyVMContext(ctx context.Context, ts oauth2.TokenSource, proj, zone, instance string) error {
+	computeService, _ := compute.New(oauth2.NewClient(ctx, ts))
 	apiGate()
-	_, err := computeService.Instances.Delete(proj, zone, instance).Do()
+	_, err := computeService.Instances.Delete(proj, zone, instance).Context(ctx).Do()
 	return err
 }
 
@@ -0,0 +1,38 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import "time"
+
+// HostMetrics describes the health of a buildlet's host. Reverse
+// buildlets, version 40 and newer, periodically send theirs to the
+// coordinator with a POST to /reverse/heartbeat, using the same
+// X-Go-Host-Type, X-Go-Builder-Key, X-Go-Builder-Hostname, and
+// X-Go-Builder-Session headers as their /reverse registration.
+//
+// Fields the host can't measure are left zero.
+type HostMetrics struct {
+	// Time is when the metrics were collected.
+	Time time.Time
+
+	// NumCPU is the number of logical CPUs of the host.
+	NumCPU int
+
+	// LoadAvg is the 1, 5, and 15 minute load average.
+	LoadAvg [3]float64
+
+	// DiskFree and DiskTotal are the bytes available and in total
+	// on the filesystem holding the buildlet's work directory.
+	DiskFree  int64 `json:",omitempty"`
+	DiskTotal int64 `json:",omitempty"`
+
+	// Temperature is the highest temperature of the host's
+	// thermal sensors, in degrees Celsius.
+	Temperature float64 `json:",omitempty"`
+
+	// Throttled is whether the CPUs were throttled since the
+	// previous heartbeat, due to overheating or insufficient power.
+	Throttled bool `json:",omitempty"`
+}
@@ -41,8 +41,9 @@ func (kp KeyPair) Password() string {
 }
 
 // tlsDialer returns a TLS dialer for http.Transport.DialTLS that expects
-// exactly our TLS cert.
-func (kp KeyPair) tlsDialer() func(network, addr string) (net.Conn, error) {
+// exactly our TLS cert. The dialer offers the application protocols
+// in nextProtos, if any, by ALPN.
+func (kp KeyPair) tlsDialer(nextProtos ...string) func(network, addr string) (net.Conn, error) {
 	if kp.IsZero() {
 		// Unused.
 		return nil
@@ -58,7 +59,7 @@ func (kp KeyPair) tlsDialer() func(network, addr string) (net.Conn, error) {
 		if err != nil {
 			return nil, err
 		}
-		tlsConn := tls.Client(plainConn, &tls.Config{InsecureSkipVerify: true})
+		tlsConn := tls.Client(plainConn, &tls.Config{InsecureSkipVerify: true, NextProtos: nextProtos})
 		if err := tlsConn.Handshake(); err != nil {
 			return nil, err
 		}
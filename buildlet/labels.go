@@ -0,0 +1,87 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Reverse buildlets, version 48 and newer, may advertise labels
+// describing their host, such as its rack, owner, or performance
+// class, when registering with the coordinator. They're sent in the
+// X-Go-Builder-Labels header of the /reverse request, in the form
+// that FormatLabels returns, along with an optional capacity hint in
+// X-Go-Builder-Max-Sessions: how many buildlets registered with the
+// same hostname the coordinator may use at once.
+
+// ParseLabels parses comma-separated key=value labels, such as
+// "rack=b4,class=fast". Keys consist of letters, digits, '-', '_',
+// and '.', and values of anything but commas. Spaces around labels
+// are ignored.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("label %q is not of the form key=value", kv)
+		}
+		k, v := kv[:i], kv[i+1:]
+		if !validLabelKey(k) {
+			return nil, fmt.Errorf("invalid label key %q", k)
+		}
+		if _, dup := labels[k]; dup {
+			return nil, fmt.Errorf("duplicate label %q", k)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+func validLabelKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, r := range k {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FormatLabels formats labels as ParseLabels parses them, sorted by
+// key.
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]string, len(keys))
+	for i, k := range keys {
+		kvs[i] = k + "=" + labels[k]
+	}
+	return strings.Join(kvs, ",")
+}
+
+// HasLabels reports whether labels includes each of want's keys with
+// the same value.
+func HasLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
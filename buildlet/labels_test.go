@@ -0,0 +1,40 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"rack=b4", map[string]string{"rack": "b4"}, false},
+		{" rack=b4, class=fast ,owner=", map[string]string{"rack": "b4", "class": "fast", "owner": ""}, false},
+		{"url=http://x/?a=b", map[string]string{"url": "http://x/?a=b"}, false},
+		{"rack", nil, true},
+		{"=b4", nil, true},
+		{"r ack=b4", nil, true},
+		{"rack=b4,rack=b5", nil, true},
+	} {
+		got, err := ParseLabels(tt.in)
+		if (err != nil) != tt.wantErr || (err == nil && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("ParseLabels(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil {
+			if again, _ := ParseLabels(FormatLabels(got)); !reflect.DeepEqual(again, got) {
+				t.Errorf("ParseLabels(FormatLabels(%v)) = %v", got, again)
+			}
+		}
+	}
+	if s := FormatLabels(map[string]string{"b": "2", "a": "1", "a-b": "3"}); s != "a=1,a-b=3,b=2" {
+		t.Errorf("FormatLabels = %q; want sorted by key", s)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// reconnectWindow is how long idempotent requests are replayed when
+// the connection to the buildlet fails, such as while a reverse
+// buildlet reconnects to the coordinator to resume its session.
+var reconnectWindow = 20 * time.Second
+
+// reconnectDelay is how long to wait before the first replay. It
+// doubles with each replay, up to maxReconnectDelay.
+var reconnectDelay = 250 * time.Millisecond
+
+const maxReconnectDelay = 4 * time.Second
+
+// replay sends req, which must have no body and be safe to repeat,
+// with do. If no response arrives because the connection failed, it
+// sends req again, until a response arrives, reconnectWindow passes,
+// req's context is done, or the buildlet is known to be dead.
+// Timeouts waiting for headers aren't retried: they mean that the
+// buildlet is connected but unresponsive.
+func (c *Client) replay(req *http.Request, do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	deadline := time.Now().Add(reconnectWindow)
+	delay := reconnectDelay
+	for {
+		res, err := do(req)
+		if err == nil || err == errHeaderTimeout || req.Context().Err() != nil || time.Now().Add(delay).After(deadline) {
+			return res, err
+		}
+		log.Printf("%s: %s %s failed: %v; retrying in %v", c.Name(), req.Method, req.URL.Path, err, delay)
+		select {
+		case <-req.Context().Done():
+			return nil, err
+		case <-c.peerDead:
+			return nil, err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// doReplay is c.do with replay.
+func (c *Client) doReplay(req *http.Request) (*http.Response, error) {
+	return c.replay(req, c.do)
+}
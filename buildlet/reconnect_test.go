@@ -0,0 +1,62 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails the first fails round trips, as if the
+// connection dropped.
+type flakyTransport struct {
+	fails int
+	tries int
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.tries++
+	if f.tries <= f.fails {
+		return nil, errors.New("connection reset by peer")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestReplay(t *testing.T) {
+	oldDelay, oldWindow := reconnectDelay, reconnectWindow
+	defer func() { reconnectDelay, reconnectWindow = oldDelay, oldWindow }()
+	reconnectDelay, reconnectWindow = time.Millisecond, time.Second
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("/work"))
+	}))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		fails   int
+		wantErr bool
+	}{
+		{0, false},
+		{3, false},
+		{1 << 20, true},
+	} {
+		c := NewClient(strings.TrimPrefix(ts.URL, "http://"), NoKeyPair)
+		ft := &flakyTransport{fails: tt.fails}
+		c.SetHTTPClient(&http.Client{Transport: ft})
+		dir, err := c.WorkDir(context.Background())
+		if (err != nil) != tt.wantErr || (err == nil && dir != "/work") {
+			t.Errorf("WorkDir with %d failed connections = %q, %v, wanted an error: %t", tt.fails, dir, err, tt.wantErr)
+		}
+		if !tt.wantErr && ft.tries != tt.fails+1 {
+			t.Errorf("WorkDir with %d failed connections tried %d times, wanted %d", tt.fails, ft.tries, tt.fails+1)
+		}
+		c.Close()
+	}
+}
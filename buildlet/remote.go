@@ -7,6 +7,7 @@ package buildlet
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -214,6 +215,39 @@ func (cc *CoordinatorClient) NamedBuildlet(name string) (*Client, error) {
 	return c, nil
 }
 
+// Extend asks the coordinator to keep the remote buildlet at least d
+// longer before it expires, or its idle timeout if d is zero, and
+// returns its new expiration time. The coordinator limits how long d
+// may be. It requires a client from NamedBuildlet.
+func (c *Client) Extend(ctx context.Context, d time.Duration) (time.Time, error) {
+	if c.RemoteName() == "" {
+		return time.Time{}, errors.New("Extend only supports gomote-created buildlets")
+	}
+	form := url.Values{}
+	if d != 0 {
+		form.Set("duration", d.String())
+	}
+	req, err := http.NewRequest("POST", c.URL()+"/keepalive", strings.NewReader(form.Encode()))
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		slurp, _ := ioutil.ReadAll(res.Body)
+		return time.Time{}, fmt.Errorf("%s: %s", res.Status, slurp)
+	}
+	var rb RemoteBuildlet
+	if err := json.NewDecoder(res.Body).Decode(&rb); err != nil {
+		return time.Time{}, err
+	}
+	return rb.Expires, nil
+}
+
 var (
 	flagsRegistered bool
 	gomoteUserFlag  string
@@ -238,8 +272,9 @@ func username() string {
 	return os.Getenv("USER")
 }
 
-// configDir finds the OS-dependent config dir.
-func configDir() string {
+// ConfigDir returns the OS-dependent directory of the user's gomote
+// configuration, such as their token.
+func ConfigDir() string {
 	if runtime.GOOS == "windows" {
 		return filepath.Join(os.Getenv("APPDATA"), "Gomote")
 	}
@@ -254,7 +289,7 @@ func userToken() (string, error) {
 	if gomoteUserFlag == "" {
 		panic("userToken called with user flag empty")
 	}
-	keyDir := configDir()
+	keyDir := ConfigDir()
 	userPath := filepath.Join(keyDir, "user-"+gomoteUserFlag+".user")
 	b, err := ioutil.ReadFile(userPath)
 	if err == nil {
@@ -0,0 +1,183 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A Manifest describes the contents of a directory on a buildlet.
+type Manifest struct {
+	// Dir is the directory described, relative to the work
+	// directory.
+	Dir string
+	// Entries are the files and directories in Dir, recursively,
+	// sorted by Path.
+	Entries []ManifestEntry
+}
+
+// ManifestEntry describes a file or directory in a Manifest.
+type ManifestEntry struct {
+	// Path is the slash-separated path of the entry, relative to
+	// the Manifest's Dir. Directories end in a slash.
+	Path string
+	Mode os.FileMode
+	// Size and SHA256, the hex SHA-256 digest of the content, are
+	// only set for regular files.
+	Size   int64  `json:",omitempty"`
+	SHA256 string `json:",omitempty"`
+	// Link is the target of a symbolic link.
+	Link string `json:",omitempty"`
+}
+
+// ManifestDiff lists the paths that differ between two Manifests.
+type ManifestDiff struct {
+	Added    []string `json:",omitempty"` // only in the newer Manifest
+	Removed  []string `json:",omitempty"` // only in the older Manifest
+	Modified []string `json:",omitempty"` // in both, with different type, mode, or content
+}
+
+// Empty reports whether d lists no differences.
+func (d ManifestDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+func (d ManifestDiff) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d modified", len(d.Added), len(d.Removed), len(d.Modified))
+}
+
+// Diff returns the differences from m to newer, such as the files
+// added to a directory since m was taken.
+func (m Manifest) Diff(newer Manifest) ManifestDiff {
+	old := make(map[string]ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		old[e.Path] = e
+	}
+	var d ManifestDiff
+	seen := make(map[string]bool, len(newer.Entries))
+	for _, e := range newer.Entries {
+		seen[e.Path] = true
+		o, ok := old[e.Path]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, e.Path)
+		case o != e:
+			d.Modified = append(d.Modified, e.Path)
+		}
+	}
+	for _, e := range m.Entries {
+		if !seen[e.Path] {
+			d.Removed = append(d.Removed, e.Path)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+	return d
+}
+
+// getJSON sends req and decodes its JSON response into v. GET
+// requests are replayed if the connection fails.
+func (c *Client) getJSON(ctx context.Context, req *http.Request, v interface{}) error {
+	req = req.WithContext(ctx)
+	do := c.do
+	if req.Method == "GET" {
+		do = c.doReplay
+	}
+	res, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return fmt.Errorf("%v; body: %s", res.Status, slurp)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// postForm returns a POST request of form to the buildlet's path.
+func (c *Client) postForm(path string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest("POST", c.URL()+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// Manifest returns the Manifest of dir, relative to the work
+// directory. It requires buildlet version 32 or later.
+func (c *Client) Manifest(ctx context.Context, dir string) (Manifest, error) {
+	var m Manifest
+	req, err := http.NewRequest("GET", c.URL()+"/manifest?dir="+url.QueryEscape(dir), nil)
+	if err != nil {
+		return m, err
+	}
+	err = c.getJSON(ctx, req, &m)
+	return m, err
+}
+
+// Snapshot records the state of dir, relative to the work directory,
+// on the buildlet as the snapshot name, replacing any snapshot of that
+// name, so that it can later be restored with RestoreSnapshot. The
+// buildlet keeps a copy of each file. It returns the Manifest of the
+// snapshot.
+//
+// Snapshots require buildlet version 32 or later.
+func (c *Client) Snapshot(ctx context.Context, name, dir string) (Manifest, error) {
+	var m Manifest
+	req, err := c.postForm("/snapshot", url.Values{"name": {name}, "dir": {dir}})
+	if err != nil {
+		return m, err
+	}
+	err = c.getJSON(ctx, req, &m)
+	return m, err
+}
+
+// SnapshotDiff returns the differences from the snapshot name to the
+// current state of its directory.
+func (c *Client) SnapshotDiff(ctx context.Context, name string) (ManifestDiff, error) {
+	var d ManifestDiff
+	req, err := http.NewRequest("GET", c.URL()+"/snapshot?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return d, err
+	}
+	err = c.getJSON(ctx, req, &d)
+	return d, err
+}
+
+// RestoreSnapshot returns the directory of the snapshot name to its
+// state when the snapshot was taken: files added since are removed,
+// and files removed or modified since are restored. It returns the
+// differences that were undone.
+func (c *Client) RestoreSnapshot(ctx context.Context, name string) (ManifestDiff, error) {
+	var d ManifestDiff
+	req, err := c.postForm("/snapshot/restore", url.Values{"name": {name}})
+	if err != nil {
+		return d, err
+	}
+	err = c.getJSON(ctx, req, &d)
+	return d, err
+}
+
+// DeleteSnapshot deletes the snapshot name, and the copies of files
+// no other snapshot refers to.
+func (c *Client) DeleteSnapshot(ctx context.Context, name string) error {
+	req, err := http.NewRequest("DELETE", c.URL()+"/snapshot?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	return c.doOK(req.WithContext(ctx))
+}
@@ -0,0 +1,524 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// maxTransferAttempts is how many times PutTarResumable,
+// GetTarResumable, and each chunk of GetFile try to complete a
+// transfer that keeps being interrupted.
+const maxTransferAttempts = 5
+
+// transferRetryDelay is how long to wait after the first interrupted
+// attempt at a transfer. It grows linearly with each attempt.
+var transferRetryDelay = 500 * time.Millisecond
+
+// ErrChanged is returned by downloads whose parts turn out not to
+// belong together, because what is downloaded changed on the buildlet
+// in between, or because the start of the download the caller already
+// had was of something else. Starting over may succeed.
+var ErrChanged = errors.New("changed during the download")
+
+// statusError is an error response from the buildlet.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// retryable reports whether a transfer that failed with err may
+// succeed if tried again: it was interrupted, rather than refused by
+// the buildlet or canceled by the caller.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrChanged) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+	return true
+}
+
+// readStatusError returns the *statusError for the non-2xx response
+// res, and closes its body.
+func readStatusError(res *http.Response) error {
+	slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
+	res.Body.Close()
+	return &statusError{res.StatusCode, fmt.Sprintf("%v; body: %s", res.Status, slurp)}
+}
+
+// retryTransfer calls attempt until it succeeds, fails with an error
+// that is not retryable, or has been called maxTransferAttempts
+// times, and returns its last error.
+func (c *Client) retryTransfer(ctx context.Context, what string, attempt func() error) error {
+	var err error
+	for i := 1; i <= maxTransferAttempts; i++ {
+		if err = attempt(); err == nil || !retryable(ctx, err) {
+			return err
+		}
+		if i == maxTransferAttempts {
+			break
+		}
+		log.Printf("%s: %s interrupted (attempt %d of %d): %v; resuming", c.Name(), what, i, maxTransferAttempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(i) * transferRetryDelay):
+		}
+	}
+	return fmt.Errorf("%s failed after %d attempts: %w", what, maxTransferAttempts, err)
+}
+
+// PutTarResumable is like PutTar, but continues an interrupted upload
+// from where the buildlet's copy of it ends, rather than starting
+// over. The upload is identified by the SHA-256 digest of r, so a
+// later call with the same content, such as from a new process,
+// resumes it too.
+//
+// r is read once to compute its digest, and then again from the
+// offsets the buildlet reports. It requires buildlet version 29 or
+// later.
+func (c *Client) PutTarResumable(ctx context.Context, r io.ReadSeeker, dir string) error {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	id := hex.EncodeToString(h.Sum(nil))
+	uploadURL := c.URL() + "/upload?id=" + id
+	err = c.retryTransfer(ctx, "upload", func() error {
+		offset, err := c.uploadOffset(ctx, uploadURL)
+		if err != nil {
+			return err
+		}
+		if offset > size {
+			return fmt.Errorf("buildlet has %d bytes of a %d byte upload", offset, size)
+		}
+		if offset == size {
+			return nil
+		}
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		body := &detachableReader{r: r}
+		req, err := http.NewRequest("PUT", uploadURL+"&offset="+strconv.FormatInt(offset, 10), body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size - offset
+		res, err := c.do(req.WithContext(ctx))
+		// The transport may still be sending the body if the
+		// buildlet responded early; stop it before r is seeked.
+		body.detach()
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return readStatusError(res)
+		}
+		res.Body.Close()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.commitUpload(ctx, id, dir, "")
+}
+
+// commitUpload has the buildlet extract the staged upload id, a tar
+// file of the given encoding, into dir.
+func (c *Client) commitUpload(ctx context.Context, id, dir, encoding string) error {
+	form := url.Values{"upload": {id}}
+	if encoding != "" {
+		form.Set("encoding", encoding)
+	}
+	req, err := http.NewRequest("POST", c.URL()+"/writetgz?dir="+url.QueryEscape(dir), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.doOK(req.WithContext(ctx))
+}
+
+var (
+	// chunkedUploadMin is the size from which PutTarOpts uploads
+	// tar files in chunks.
+	chunkedUploadMin int64 = 32 << 20
+	// uploadChunkSize is the size of the chunks.
+	uploadChunkSize int64 = 8 << 20
+)
+
+// maxUploadParallelism is the most chunks PutTarOpts uploads at once.
+const maxUploadParallelism = 4
+
+// chunkable returns the rest of r as a *io.SectionReader, if r
+// supports random access and the rest of it is large enough to upload
+// in chunks.
+func chunkable(r io.Reader) (*io.SectionReader, bool) {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return nil, false
+	}
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return nil, false
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if _, serr := s.Seek(cur, io.SeekStart); err != nil || serr != nil || end-cur < chunkedUploadMin {
+		return nil, false
+	}
+	return io.NewSectionReader(ra, cur, end-cur), true
+}
+
+// putTarChunked uploads the tar file r in chunks, up to parallel at
+// once, and extracts it into dir.
+func (c *Client) putTarChunked(ctx context.Context, r *io.SectionReader, dir string, opts TarOpts, parallel int) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(h.Sum(nil))
+	uploadURL := c.URL() + "/upload?id=" + id
+	size := r.Size()
+	// A previous upload of the same file may be complete.
+	if offset, err := c.uploadOffset(ctx, uploadURL); err != nil {
+		return err
+	} else if offset != size {
+		if parallel > maxUploadParallelism {
+			parallel = maxUploadParallelism
+		}
+		g, gctx := errgroup.WithContext(ctx)
+		sem := make(chan bool, parallel)
+		for off := int64(0); off < size; off += uploadChunkSize {
+			off, n := off, uploadChunkSize
+			if off+n > size {
+				n = size - off
+			}
+			sem <- true
+			g.Go(func() error {
+				defer func() { <-sem }()
+				return c.putUploadChunk(gctx, uploadURL, io.NewSectionReader(r, off, n), off)
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", uploadURL+"&size="+strconv.FormatInt(size, 10), nil)
+		if err != nil {
+			return err
+		}
+		if err := c.doOK(req.WithContext(ctx)); err != nil {
+			return err
+		}
+	}
+	return c.commitUpload(ctx, id, dir, opts.Encoding)
+}
+
+// putUploadChunk uploads the chunk r of an upload, at offset off,
+// retrying if interrupted.
+func (c *Client) putUploadChunk(ctx context.Context, uploadURL string, r *io.SectionReader, off int64) error {
+	return c.retryTransfer(ctx, fmt.Sprintf("upload of chunk at %d", off), func() error {
+		// Each attempt reads its own copy of the section, in case
+		// the transport is still reading the last one.
+		req, err := http.NewRequest("PUT", uploadURL+"&at="+strconv.FormatInt(off, 10), io.NewSectionReader(r, 0, r.Size()))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = r.Size()
+		res, err := c.do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return readStatusError(res)
+		}
+		res.Body.Close()
+		return nil
+	})
+}
+
+// uploadOffset returns how many bytes of the upload at uploadURL the
+// buildlet has.
+func (c *Client) uploadOffset(ctx context.Context, uploadURL string) (int64, error) {
+	req, err := http.NewRequest("HEAD", uploadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.doHeaderTimeout(req.WithContext(ctx), 30*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, &statusError{res.StatusCode, res.Status}
+	}
+	offset, err := strconv.ParseInt(res.Header.Get("X-Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("buildlet does not support resumable uploads: %v", err)
+	}
+	return offset, nil
+}
+
+// GetTarResumable writes the .tar.gz stream of the given directory,
+// as returned by GetTar, to w. If the download is interrupted, it
+// continues from the last byte written to w, rather than starting
+// over. It returns an error wrapping ErrChanged if the parts
+// downloaded do not belong to the same stream, such as if files in dir
+// changed in between.
+//
+// It requires buildlet version 29 or later.
+func (c *Client) GetTarResumable(ctx context.Context, dir string, w io.Writer) error {
+	return c.GetTarResumableOpts(ctx, dir, TarOpts{}, nil, w)
+}
+
+// GetTarResumableOpts is like GetTarResumable, but the tar stream is
+// compressed and filtered according to opts, as for GetTarOpts.
+//
+// If have is non-nil, it is read for the start of the stream, as
+// written to w by an earlier download that was interrupted for good,
+// such as by the process exiting. Only the rest of the stream is
+// then written to w, and the whole is checked to belong together.
+// The stream must be requested with the same dir and opts again.
+func (c *Client) GetTarResumableOpts(ctx context.Context, dir string, opts TarOpts, have io.Reader, w io.Writer) error {
+	h := sha256.New()
+	var written int64
+	if have != nil {
+		n, err := io.Copy(h, have)
+		if err != nil {
+			return err
+		}
+		written = n
+	}
+	args := c.tarArgs(dir, opts)
+	return c.retryTransfer(ctx, "download", func() error {
+		args.Set("offset", strconv.FormatInt(written, 10))
+		req, err := http.NewRequest("GET", c.URL()+"/tgz?"+args.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return readStatusError(res)
+		}
+		if got := res.Header.Get("X-Upload-Offset"); got != strconv.FormatInt(written, 10) {
+			return &statusError{http.StatusNotImplemented, "buildlet does not support resumable downloads"}
+		}
+		if err := checkTarOpts(res, opts); err != nil {
+			return &statusError{http.StatusNotImplemented, err.Error()}
+		}
+		n, err := io.Copy(io.MultiWriter(w, h), res.Body)
+		written += n
+		if err != nil {
+			return err
+		}
+		return checkTarSHA256(res.Trailer.Get("X-Tar-Sha256"), h)
+	})
+}
+
+// checkTarSHA256 returns an error unless want is the hex digest of h.
+func checkTarSHA256(want string, h hash.Hash) error {
+	if want == "" {
+		return errors.New("missing X-Tar-Sha256 trailer; download interrupted")
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("downloaded tarball has SHA-256 %s, wanted %s: directory %w", got, want, ErrChanged)
+	}
+	return nil
+}
+
+// detachableReader is an io.ReadCloser reading from r until detached.
+type detachableReader struct {
+	mu       sync.Mutex
+	r        io.Reader
+	detached bool
+}
+
+func (d *detachableReader) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.detached {
+		return 0, errors.New("request body detached")
+	}
+	return d.r.Read(p)
+}
+
+func (d *detachableReader) Close() error { return nil }
+
+// detach makes further reads fail, waiting for any in progress.
+func (d *detachableReader) detach() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.detached = true
+}
+
+// downloadChunkSize is the size of the chunks GetFile fetches.
+var downloadChunkSize int64 = 8 << 20
+
+// maxDownloadParallelism is the most chunks GetFile fetches at once.
+const maxDownloadParallelism = 8
+
+// GetFileOpts are options for Client.GetFile.
+type GetFileOpts struct {
+	// Offset is how much of the file w already has, such as from
+	// a download that was interrupted for good. Only the rest is
+	// fetched. The caller is responsible for the start of the
+	// file not having changed since.
+	Offset int64
+
+	// Parallel is how many chunks of the file to fetch at once,
+	// up to 8. Zero means one at a time.
+	Parallel int
+
+	// Progress, if non-nil, is called as the download proceeds
+	// with how many bytes of the file w has, and the file's size.
+	// Calls are serialized.
+	Progress func(have, size int64)
+}
+
+// GetFile writes the regular file at path, relative to the workdir,
+// to w, and returns its size. It fetches the file in chunks, several
+// at once if opts.Parallel says so, each of which resumes from where
+// it stopped if interrupted. It returns an error wrapping ErrChanged
+// if the file changes during the download.
+//
+// It requires buildlet version 51 or later (see FeatureFileDownload).
+func (c *Client) GetFile(ctx context.Context, path string, w io.WriterAt, opts GetFileOpts) (int64, error) {
+	fileURL := c.URL() + "/file?path=" + url.QueryEscape(path)
+	req, err := http.NewRequest("HEAD", fileURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// HEAD responses have no body to explain them.
+		return 0, &statusError{res.StatusCode, fmt.Sprintf("%s: %v", path, res.Status)}
+	}
+	size := res.ContentLength
+	lastMod := res.Header.Get("Last-Modified")
+	if size < 0 || lastMod == "" || res.Header.Get("Accept-Ranges") != "bytes" {
+		return 0, errors.New("buildlet does not support file downloads")
+	}
+	if opts.Offset > size {
+		return 0, fmt.Errorf("%s is only %d bytes, but %d are already downloaded", path, size, opts.Offset)
+	}
+
+	var mu sync.Mutex
+	have := opts.Offset
+	progress := func(n int64) {
+		if opts.Progress == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		have += n
+		opts.Progress(have, size)
+	}
+	progress(0)
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	} else if parallel > maxDownloadParallelism {
+		parallel = maxDownloadParallelism
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan bool, parallel)
+	for off := opts.Offset; off < size; off += downloadChunkSize {
+		off, n := off, downloadChunkSize
+		if off+n > size {
+			n = size - off
+		}
+		sem <- true
+		g.Go(func() error {
+			defer func() { <-sem }()
+			return c.getFileChunk(gctx, fileURL, lastMod, &sectionWriter{w: w, off: off, progress: progress}, off+n)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// getFileChunk writes the bytes of the file at fileURL from sw.off to
+// end to sw, retrying from where it stopped if interrupted. lastMod
+// is the file's Last-Modified time at the start of the download.
+func (c *Client) getFileChunk(ctx context.Context, fileURL, lastMod string, sw *sectionWriter, end int64) error {
+	return c.retryTransfer(ctx, fmt.Sprintf("download of chunk at %d", sw.off), func() error {
+		req, err := http.NewRequest("GET", fileURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", sw.off, end-1))
+		req.Header.Set("If-Range", lastMod)
+		res, err := c.do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		switch res.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// The buildlet ignored the range because the
+			// file is no longer the one If-Range names.
+			return fmt.Errorf("file %w", ErrChanged)
+		default:
+			return readStatusError(res)
+		}
+		if _, err := io.Copy(sw, io.LimitReader(res.Body, end-sw.off)); err != nil {
+			return err
+		}
+		if sw.off < end {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+}
+
+// sectionWriter writes sequentially to w from offset off, reporting
+// the length of each write to progress.
+type sectionWriter struct {
+	w        io.WriterAt
+	off      int64
+	progress func(n int64)
+}
+
+func (s *sectionWriter) Write(p []byte) (int, error) {
+	n, err := s.w.WriteAt(p, s.off)
+	s.off += int64(n)
+	s.progress(int64(n))
+	return n, err
+}
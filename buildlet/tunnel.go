@@ -0,0 +1,156 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildlet
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DialPort opens a connection to the TCP port on the buildlet's host,
+// such as one a server started by a test listens on, proxied over
+// HTTP so that it works for reverse buildlets behind NATs. It
+// requires buildlet version 34 or later.
+func (c *Client) DialPort(ctx context.Context, port int) (net.Conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequest("POST", "/connect-tcp?port="+strconv.Itoa(port), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.connectUpgrade(ctx, req)
+}
+
+// ForwardPort accepts connections on ln and forwards each to the TCP
+// port on the buildlet's host with DialPort, until ctx is done or ln
+// fails. It closes ln before returning.
+func (c *Client) ForwardPort(ctx context.Context, ln net.Listener, port int) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	defer ln.Close()
+	for {
+		lc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			defer lc.Close()
+			rc, err := c.DialPort(ctx, port)
+			if err != nil {
+				log.Printf("%s: forwarding to port %d: %v", c.Name(), port, err)
+				return
+			}
+			defer rc.Close()
+			errc := make(chan error, 1)
+			go func() {
+				_, err := io.Copy(rc, lc)
+				errc <- err
+			}()
+			go func() {
+				_, err := io.Copy(lc, rc)
+				errc <- err
+			}()
+			select {
+			case <-errc:
+			case <-ctx.Done():
+			}
+		}()
+	}
+}
+
+// ListenPort asks the buildlet to listen on the TCP port on its host's
+// localhost, such as for a test on the host to connect to a server
+// running elsewhere, until the returned PortListener is closed. It
+// requires buildlet version 54 or later.
+func (c *Client) ListenPort(ctx context.Context, port int) (*PortListener, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequest("POST", "/listen-tcp?port="+strconv.Itoa(port), nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.connectUpgrade(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &PortListener{c: c, conn: conn, br: bufio.NewReader(conn), port: port}, nil
+}
+
+// AcceptPort returns the connection that a PortListener's Next
+// returned the ID of, proxied over HTTP like DialPort's. The buildlet
+// closes connections that aren't accepted within 30 seconds.
+func (c *Client) AcceptPort(ctx context.Context, id string) (net.Conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequest("POST", "/accept-tcp?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.connectUpgrade(ctx, req)
+}
+
+// A PortListener is a TCP port that the buildlet listens on for a
+// client, as returned by ListenPort. It implements net.Listener.
+type PortListener struct {
+	c    *Client
+	conn net.Conn
+	br   *bufio.Reader
+	port int
+}
+
+// Next waits for the buildlet to accept a connection, and returns its
+// ID, for AcceptPort. Callers that can't use Accept, as they hand
+// connections to other processes, such as the coordinator's SSH
+// gateway, use it.
+func (l *PortListener) Next() (string, error) {
+	line, err := l.br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// Accept waits for the buildlet to accept a connection, and returns
+// it, proxied with AcceptPort.
+func (l *PortListener) Accept() (net.Conn, error) {
+	id, err := l.Next()
+	if err != nil {
+		return nil, err
+	}
+	return l.c.AcceptPort(context.Background(), id)
+}
+
+// Close stops the buildlet from listening.
+func (l *PortListener) Close() error { return l.conn.Close() }
+
+// Addr returns the address the buildlet listens on, on its host.
+func (l *PortListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: l.port}
+}
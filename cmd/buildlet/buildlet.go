@@ -18,7 +18,9 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -38,6 +40,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
@@ -47,19 +50,37 @@ import (
 	"golang.org/x/build/buildlet"
 	"golang.org/x/build/internal/cloud"
 	"golang.org/x/build/pargzip"
+	"golang.org/x/build/tarutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	haltEntireOS = flag.Bool("halt", true, "halt OS in /halt handler. If false, the buildlet process just ends.")
-	rebootOnHalt = flag.Bool("reboot", false, "reboot system in /halt handler.")
-	workDir      = flag.String("workdir", "", "Temporary directory to use. The contents of this directory may be deleted at any time. If empty, TempDir is used to create one.")
-	listenAddr   = flag.String("listen", "AUTO", "address to listen on. Unused in reverse mode. Warning: this service is inherently insecure and offers no protection of its own. Do not expose this port to the world.")
-	reverseType  = flag.String("reverse-type", "", "if non-empty, go into reverse mode where the buildlet dials the coordinator instead of listening for connections. The value is the dashboard/builders.go Hosts map key, naming a HostConfig. This buildlet will receive work for any BuildConfig specifying this named HostConfig.")
-	coordinator  = flag.String("coordinator", "localhost:8119", "address of coordinator, in production use farmer.golang.org. Only used in reverse mode.")
-	hostname     = flag.String("hostname", "", "hostname to advertise to coordinator for reverse mode; default is actual hostname")
-	healthAddr   = flag.String("health-addr", "localhost:8080", "For reverse buildlets, address to listen for /healthz requests separately from the reverse dialer to the coordinator.")
+	haltEntireOS  = flag.Bool("halt", true, "halt OS in /halt handler. If false, the buildlet process just ends.")
+	rebootOnHalt  = flag.Bool("reboot", false, "reboot system in /halt handler.")
+	workDir       = flag.String("workdir", "", "Temporary directory to use. The contents of this directory may be deleted at any time. If empty, TempDir is used to create one.")
+	listenAddr    = flag.String("listen", "AUTO", "address to listen on. Unused in reverse mode. Warning: this service is inherently insecure and offers no protection of its own. Do not expose this port to the world.")
+	reverseType   = flag.String("reverse-type", "", "if non-empty, go into reverse mode where the buildlet dials the coordinator instead of listening for connections. The value is the dashboard/builders.go Hosts map key, naming a HostConfig. This buildlet will receive work for any BuildConfig specifying this named HostConfig.")
+	coordinator   = flag.String("coordinator", "localhost:8119", "address of coordinator, in production use farmer.golang.org. Only used in reverse mode.")
+	hostname      = flag.String("hostname", "", "hostname to advertise to coordinator for reverse mode; default is actual hostname")
+	healthAddr    = flag.String("health-addr", "localhost:8080", "For reverse buildlets, address to listen for /healthz requests, and /status requests with the builder key as password, separately from the reverse dialer to the coordinator.")
+	reverseResume = flag.Duration("reverse-resume", time.Minute, "For reverse buildlets, how long to keep redialing the coordinator after losing the connection to it, resuming the session, before exiting. Zero exits right away.")
+	workdirQuota  = flag.Int64("workdir-quota", 0, "If positive, the maximum size of the workdir in bytes. When it's exceeded, the least recently modified top-level directories of the workdir not in use by a command are removed until it isn't.")
+	execIsolation = flag.String("exec-isolation", "", "If non-empty, run each command isolated from the host: \"docker:IMAGE\" or \"podman:IMAGE\" runs it in a new container of IMAGE, and (on Linux) \"chroot:DIR\" runs it chrooted to DIR. The workdir is at the same path in either.")
+	serviceMode   = flag.String("service", "", "Windows only. If \"install\", register the buildlet as a Windows service run as LocalSystem with the other flags given, start it, and exit. If \"uninstall\", stop and remove that service. The service itself runs with \"run\", logging to the Application event log.")
 )
 
+// Reverse buildlets' registration details for the coordinator's
+// scheduler.
+var (
+	reverseLabels      = flag.String("reverse-labels", "", "For reverse buildlets, comma-separated key=value labels describing the host to advertise to the coordinator, such as rack=b4,class=fast. Host types may require labels of their reverse buildlets.")
+	reverseMaxSessions = flag.Int("reverse-max-sessions", 0, "For reverse buildlets, a hint of how many buildlets with this -hostname the host has capacity to run builds on at once, which the coordinator won't exceed. Zero means no limit.")
+)
+
+// crashDumpMaxSize limits the crash dumps that commands run with
+// crashDumps=1 may leave; see crashdump.go.
+var crashDumpMaxSize = flag.Int64("crash-dump-max-size", 1<<30, "The maximum size in bytes of a crash dump collected from a command. Larger core files are truncated by RLIMIT_CORE where possible, and otherwise discarded.")
+
 // Bump this whenever something notable happens, or when another
 // component needs a certain feature. This shows on the coordinator
 // per reverse client, and is also accessible via the buildlet
@@ -80,7 +101,36 @@ var (
 //   23: revdial v2
 //   24: removeAllIncludingReadonly
 //   25: use removeAllIncludingReadonly for all work area cleanup
-const buildletVersion = 25
+//   26: report running commands in /status, also served on -health-addr
+//   27: read the reverse buildlet key from QEMU fw_cfg with GO_BUILDER_ENV=qemu_vm
+//   28: report the process start time in /status
+//   29: resumable tar uploads (/upload) and downloads (/tgz?offset=)
+//   30: uncompressed tar transfers and gzip level control, listed in /status
+//   31: framed exec output with separate stderr, and exit status trailers
+//   32: workdir manifests (/manifest) and snapshots (/snapshot)
+//   33: per-command CPU, memory, and time limits
+//   34: TCP port forwarding (/connect-tcp)
+//   35: reverse buildlets resume their session after losing the coordinator connection
+//   36: /ls glob patterns and recursion depth limits
+//   37: parallel chunked uploads, and parallel fetches of large tar.gz URLs
+//   38: Windows service mode (-service)
+//   39: workdir quota (-workdir-quota), with workdir usage in /status
+//   40: reverse buildlets send host metrics heartbeats (/reverse/heartbeat)
+//   41: isolated exec in containers or a chroot (-exec-isolation)
+//   42: SFTP server (/connect-sftp)
+//   43: graceful halts (/halt?mode=graceful), refusing new commands while halting
+//   44: tar files keep symlinks, hard links, and the holes of sparse files
+//   45: HTTP/2, with and without TLS
+//   46: optional features listed in /features
+//   47: /tgz include and exclude patterns
+//   48: reverse buildlets advertise labels and a capacity hint (-reverse-labels, -reverse-max-sessions)
+//   49: Windows long paths in file APIs
+//   50: crash dump collection (/exec?crashDumps=1, /debug/crashdumps)
+//   51: single-file downloads with byte ranges (/file)
+//   52: require the builder key for /status on -health-addr
+//   53: remove the SFTP server; gomote sftp uses the SSH server's sftp subsystem
+//   54: listening on TCP ports for remote port forwarding (/listen-tcp, /accept-tcp)
+const buildletVersion = 54
 
 func defaultListenAddr() string {
 	if runtime.GOOS == "darwin" {
@@ -105,6 +155,7 @@ func defaultListenAddr() string {
 var (
 	configureSerialLogOutput func()
 	setOSRlimit              func() error
+	serviceCommand           func(mode string)
 )
 
 // If non-empty, the $TMPDIR and $GOCACHE environment variables to use
@@ -151,6 +202,13 @@ func main() {
 	log.Printf("buildlet starting.")
 	flag.Parse()
 
+	if *serviceMode != "" {
+		if serviceCommand == nil {
+			log.Fatalf("-service is only supported on Windows")
+		}
+		serviceCommand(*serviceMode)
+	}
+
 	if builderEnv == "android-amd64-emu" {
 		startAndroidEmulator()
 	}
@@ -170,6 +228,14 @@ func main() {
 	}
 
 	isReverse := *reverseType != ""
+	if isReverse {
+		if _, err := buildlet.ParseLabels(*reverseLabels); err != nil {
+			log.Fatalf("bad -reverse-labels: %v", err)
+		}
+		if *reverseMaxSessions < 0 {
+			log.Fatalf("bad -reverse-max-sessions %d", *reverseMaxSessions)
+		}
+	}
 
 	if *listenAddr == "AUTO" && !isReverse {
 		v := defaultListenAddr()
@@ -211,6 +277,9 @@ func main() {
 	if _, err := os.Lstat(*workDir); err != nil {
 		log.Fatalf("invalid --workdir %q: %v", *workDir, err)
 	}
+	if *workdirQuota > 0 {
+		go enforceWorkdirQuota(*workdirQuota)
+	}
 
 	// Set up and clean $TMPDIR and $GOCACHE directories.
 	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
@@ -220,6 +289,13 @@ func main() {
 		removeAllAndMkdir(processGoCacheEnv)
 	}
 
+	if *execIsolation != "" {
+		var err error
+		if isolator, err = parseExecIsolation(*execIsolation); err != nil {
+			log.Fatalf("setting up -exec-isolation: %v", err)
+		}
+	}
+
 	initGorootBootstrap()
 
 	http.HandleFunc("/", handleRoot)
@@ -233,27 +309,40 @@ func main() {
 		return requirePasswordHandler{http.HandlerFunc(handler), password}
 	}
 	http.Handle("/debug/goroutines", requireAuth(handleGoroutines))
+	http.Handle("/debug/crashdumps", requireAuth(handleCrashDumps))
 	http.Handle("/writetgz", requireAuth(handleWriteTGZ))
+	http.Handle("/upload", requireAuth(handleUpload))
 	http.Handle("/write", requireAuth(handleWrite))
 	http.Handle("/exec", requireAuth(handleExec))
 	http.Handle("/halt", requireAuth(handleHalt))
 	http.Handle("/tgz", requireAuth(handleGetTGZ))
+	http.Handle("/file", requireAuth(handleGetFile))
 	http.Handle("/removeall", requireAuth(handleRemoveAll))
 	http.Handle("/workdir", requireAuth(handleWorkDir))
 	http.Handle("/status", requireAuth(handleStatus))
+	http.Handle("/features", requireAuth(handleFeatures))
 	http.Handle("/ls", requireAuth(handleLs))
+	http.Handle("/manifest", requireAuth(handleManifest))
+	http.Handle("/snapshot", requireAuth(handleSnapshot))
+	http.Handle("/snapshot/restore", requireAuth(handleSnapshotRestore))
 	http.Handle("/connect-ssh", requireAuth(handleConnectSSH))
+	http.Handle("/connect-tcp", requireAuth(handleConnectTCP))
+	http.Handle("/listen-tcp", requireAuth(handleListenTCP))
+	http.Handle("/accept-tcp", requireAuth(handleAcceptTCP))
 	http.HandleFunc("/healthz", handleHealthz)
 
 	if !isReverse {
 		listenForCoordinator()
 	} else {
+		// The health listener needs the key to check /status
+		// requests, so load it before either listener starts.
+		loadReverseKey()
 		go func() {
 			if err := serveReverseHealth(); err != nil {
 				log.Printf("Error in serveReverseHealth: %v", err)
 			}
 		}()
-		if err := dialCoordinator(); err != nil {
+		if err := serveReverse(); err != nil {
 			log.Fatalf("Error dialing coordinator: %v", err)
 		}
 		log.Printf("buildlet reverse mode exiting.")
@@ -291,6 +380,7 @@ func listenForCoordinator() {
 	ln = tcpKeepAliveListener{ln.(*net.TCPListener)}
 
 	var srv http.Server
+	configureHTTP2(&srv)
 	if tlsCert != "" {
 		cert, err := tls.X509KeyPair([]byte(tlsCert), []byte(tlsKey))
 		if err != nil {
@@ -298,6 +388,7 @@ func listenForCoordinator() {
 		}
 		tlsConf := &tls.Config{
 			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
 		}
 		ln = tls.NewListener(ln, tlsConf)
 	}
@@ -329,6 +420,23 @@ func listenForCoordinator() {
 	os.Exit(0)
 }
 
+// configureHTTP2 makes srv serve HTTP/2 as well as HTTP/1.1, so
+// clients can multiplex their requests over one connection: with
+// prior knowledge ("h2c") on plain connections, and by ALPN on TLS
+// ones. Requests that hijack their connection, like /connect-ssh's,
+// must still use HTTP/1.1.
+func configureHTTP2(srv *http.Server) {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		log.Fatalf("configuring HTTP/2: %v", err)
+	}
+	h := srv.Handler
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	srv.Handler = h2c.NewHandler(h, h2s)
+}
+
 // registerSignal if non-nil registers shutdown signals with the provided chan.
 var registerSignal func(chan<- os.Signal)
 
@@ -557,58 +665,73 @@ func handleGetTGZ(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bogus dir", http.StatusBadRequest)
 		return
 	}
-	var zw io.WriteCloser
-	if r.FormValue("pargzip") == "0" {
-		zw = gzip.NewWriter(w)
-	} else {
-		zw = pargzip.NewWriter(w)
+	encoding := r.FormValue("encoding")
+	if encoding == "" {
+		encoding = tarEncodingGzip
 	}
-	tw := tar.NewWriter(zw)
-	base := filepath.Join(*workDir, filepath.FromSlash(dir))
-	err := filepath.Walk(base, func(path string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		rel := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(path, base)), "/")
-		var linkName string
-		if fi.Mode()&os.ModeSymlink != 0 {
-			linkName, err = os.Readlink(path)
-			if err != nil {
-				return err
-			}
-		}
-		th, err := tar.FileInfoHeader(fi, linkName)
-		if err != nil {
-			return err
-		}
-		th.Name = rel
-		if fi.IsDir() && !strings.HasSuffix(th.Name, "/") {
-			th.Name += "/"
-		}
-		if th.Name == "/" {
-			return nil
-		}
-		if err := tw.WriteHeader(th); err != nil {
-			return err
+	if !validTarEncoding(encoding) {
+		http.Error(w, fmt.Sprintf("unsupported encoding %q", encoding), http.StatusBadRequest)
+		return
+	}
+	level := gzip.DefaultCompression
+	if s := r.FormValue("level"); s != "" {
+		var err error
+		level, err = strconv.Atoi(s)
+		if err != nil || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			http.Error(w, "bogus gzip level", http.StatusBadRequest)
+			return
 		}
-		if fi.Mode().IsRegular() {
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			if _, err := io.Copy(tw, f); err != nil {
-				return err
-			}
+	}
+	filter := tarutil.Filter{Include: r.Form["include"], Exclude: r.Form["exclude"]}
+	if err := filter.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(hdrTarEncoding, encoding)
+	if len(filter.Include) > 0 || len(filter.Exclude) > 0 {
+		w.Header().Set(hdrTarFiltered, "1")
+	}
+	// A resumable download must generate the same stream each time,
+	// so it is compressed with gzip rather than pargzip, whose output
+	// is not reproducible.
+	var ow *offsetWriter
+	var out io.Writer = w
+	if s := r.FormValue("offset"); s != "" {
+		offset, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "bogus offset", http.StatusBadRequest)
+			return
 		}
-		return nil
-	})
-	if err != nil {
+		ow = &offsetWriter{w: w, skip: offset, h: sha256.New()}
+		out = ow
+		w.Header().Set(hdrUploadOffset, s)
+		w.Header().Set("Trailer", hdrTarSHA256)
+	}
+	var zw io.WriteCloser
+	switch {
+	case encoding == tarEncodingIdentity:
+		zw = nopWriteCloser{out}
+	case r.FormValue("pargzip") == "0" || ow != nil || r.FormValue("level") != "":
+		// pargzip only compresses at the default level.
+		zw, _ = gzip.NewWriterLevel(out, level)
+	default:
+		zw = pargzip.NewWriter(out)
+	}
+	tw := tar.NewWriter(zw)
+	base := longPath(filepath.Join(*workDir, filepath.FromSlash(dir)))
+	if err := tarutil.WriteDirFilter(tw, base, filter); err != nil {
 		log.Printf("Walk error: %v", err)
 		panic(http.ErrAbortHandler)
 	}
 	tw.Close()
 	zw.Close()
+	if ow != nil {
+		if ow.skip > 0 {
+			log.Printf("tgz: offset beyond the end of the stream")
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set(hdrTarSHA256, hex.EncodeToString(ow.h.Sum(nil)))
+	}
 }
 
 func handleWriteTGZ(w http.ResponseWriter, r *http.Request) {
@@ -645,11 +768,36 @@ func handleWriteTGZ(w http.ResponseWriter, r *http.Request) {
 
 	var tgz io.Reader
 	var urlStr string
+	encoding := tarEncodingGzip
 	switch r.Method {
 	case "PUT":
+		if e := r.Header.Get(hdrTarEncoding); e != "" {
+			encoding = e
+		}
 		tgz = r.Body
 		log.Printf("writetgz: untarring Request.Body into %s", baseDir)
 	case "POST":
+		if id := r.FormValue("upload"); id != "" {
+			f, err := openUpload(id)
+			if err != nil {
+				status := http.StatusInternalServerError
+				if he, ok := err.(httpStatuser); ok {
+					status = he.httpStatus()
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			defer func() {
+				f.Close()
+				os.Remove(f.Name())
+			}()
+			tgz = f
+			if e := r.FormValue("encoding"); e != "" {
+				encoding = e
+			}
+			log.Printf("writetgz: untarring upload %s into %s", id, baseDir)
+			break
+		}
 		urlStr = r.FormValue("url")
 		if urlStr == "" {
 			log.Printf("writetgz: missing url POST param")
@@ -670,6 +818,18 @@ func handleWriteTGZ(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		tgz = res.Body
+		if f, err := fetchParallel(r.Context(), res, urlStr); err != nil {
+			log.Printf("writetgz: failed to fetch tgz URL %s in parallel: %v", urlStr, err)
+			http.Error(w, fmt.Sprintf("fetching URL %s: %v", urlStr, err), http.StatusInternalServerError)
+			return
+		} else if f != nil {
+			defer func() {
+				f.Close()
+				os.Remove(f.Name())
+			}()
+			tgz = f
+			log.Printf("writetgz: fetched %s in parallel in %v", urlStr, time.Since(t0))
+		}
 		log.Printf("writetgz: untarring %s (got headers in %v) into %s", urlStr, time.Since(t0), baseDir)
 	default:
 		log.Printf("writetgz: invalid method %q", r.Method)
@@ -677,7 +837,11 @@ func handleWriteTGZ(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := untar(tgz, baseDir)
+	if !validTarEncoding(encoding) {
+		http.Error(w, fmt.Sprintf("unsupported encoding %q", encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+	err := untar(tgz, baseDir, encoding)
 	if err != nil {
 		status := http.StatusInternalServerError
 		if he, ok := err.(httpStatuser); ok {
@@ -703,7 +867,7 @@ func handleWrite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	path = filepath.FromSlash(path)
-	path = filepath.Join(*workDir, path)
+	path = longPath(filepath.Join(*workDir, path))
 
 	modeInt, err := strconv.ParseInt(param.Get("mode"), 10, 64)
 	mode := os.FileMode(modeInt)
@@ -746,25 +910,37 @@ func writeFile(r io.Reader, path string, mode os.FileMode) error {
 	return f.Close()
 }
 
-// untar reads the gzip-compressed tar file from r and writes it into dir.
-func untar(r io.Reader, dir string) (err error) {
+// untar reads the tar file from r, compressed with encoding, and
+// writes it into dir.
+func untar(r io.Reader, dir, encoding string) (err error) {
 	t0 := time.Now()
-	nFiles := 0
-	madeDir := map[string]bool{}
+	nFiles, nDirs := 0, 0
 	defer func() {
 		td := time.Since(t0)
 		if err == nil {
-			log.Printf("extracted tarball into %s: %d files, %d dirs (%v)", dir, nFiles, len(madeDir), td)
+			log.Printf("extracted tarball into %s: %d files, %d dirs (%v)", dir, nFiles, nDirs, td)
 		} else {
-			log.Printf("error extracting tarball into %s after %d files, %d dirs, %v: %v", dir, nFiles, len(madeDir), td, err)
+			log.Printf("error extracting tarball into %s after %d files, %d dirs, %v: %v", dir, nFiles, nDirs, td, err)
 		}
 	}()
-	zr, err := gzip.NewReader(r)
-	if err != nil {
-		return badRequest("requires gzip-compressed body: " + err.Error())
+	if encoding == tarEncodingGzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return badRequest("requires gzip-compressed body: " + err.Error())
+		}
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	x := &tarutil.Extractor{
+		Dir: longPath(dir),
+		// Clamp modtimes at system time. See
+		// golang.org/issue/19062 when clock on buildlet was
+		// behind the gitmirror server doing the git-archive.
+		MaxModTime: t0,
+		// Builders may lack the permission to create symlinks,
+		// which builds haven't needed.
+		IgnoreSymlinkErrors: runtime.GOOS == "windows" || runtime.GOOS == "plan9",
 	}
-	tr := tar.NewReader(zr)
-	loggedChtimesError := false
 	for {
 		f, err := tr.Next()
 		if err == io.EOF {
@@ -784,70 +960,17 @@ func untar(r io.Reader, dir string) (err error) {
 		if !validRelPath(f.Name) {
 			return badRequest(fmt.Sprintf("tar file contained invalid name %q", f.Name))
 		}
-		rel := filepath.FromSlash(f.Name)
-		abs := filepath.Join(dir, rel)
-
-		fi := f.FileInfo()
-		mode := fi.Mode()
-		switch {
-		case mode.IsRegular():
-			// Make the directory. This is redundant because it should
-			// already be made by a directory entry in the tar
-			// beforehand. Thus, don't check for errors; the next
-			// write will fail with the same error.
-			dir := filepath.Dir(abs)
-			if !madeDir[dir] {
-				if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
-					return err
-				}
-				madeDir[dir] = true
-			}
-			wf, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode.Perm())
-			if err != nil {
-				return err
-			}
-			n, err := io.Copy(wf, tr)
-			if closeErr := wf.Close(); closeErr != nil && err == nil {
-				err = closeErr
-			}
-			if err != nil {
-				return fmt.Errorf("error writing to %s: %v", abs, err)
-			}
-			if n != f.Size {
-				return fmt.Errorf("only wrote %d bytes to %s; expected %d", n, abs, f.Size)
-			}
-			modTime := f.ModTime
-			if modTime.After(t0) {
-				// Clamp modtimes at system time. See
-				// golang.org/issue/19062 when clock on
-				// buildlet was behind the gitmirror server
-				// doing the git-archive.
-				modTime = t0
-			}
-			if !modTime.IsZero() {
-				if err := os.Chtimes(abs, modTime, modTime); err != nil && !loggedChtimesError {
-					// benign error. Gerrit doesn't even set the
-					// modtime in these, and we don't end up relying
-					// on it anywhere (the gomote push command relies
-					// on digests only), so this is a little pointless
-					// for now.
-					log.Printf("error changing modtime: %v (further Chtimes errors suppressed)", err)
-					loggedChtimesError = true // once is enough
-				}
+		if err := x.Extract(f, tr); err != nil {
+			if _, ok := err.(*tarutil.BadEntryError); ok {
+				return badRequest(err.Error())
 			}
+			return err
+		}
+		switch f.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeLink:
 			nFiles++
-		case mode.IsDir():
-			if err := os.MkdirAll(abs, 0755); err != nil {
-				return err
-			}
-			madeDir[abs] = true
-		case mode&os.ModeSymlink != 0:
-			// TODO: ignore these for now. They were breaking x/build tests.
-			// Implement these if/when we ever have a test that needs them.
-			// But maybe we'd have to skip creating them on Windows for some builders
-			// without permissions.
-		default:
-			return badRequest(fmt.Sprintf("tar file entry %s contained unsupported file type %v", f.Name, mode))
+		case tar.TypeDir:
+			nDirs++
 		}
 	}
 	return nil
@@ -857,9 +980,36 @@ func untar(r io.Reader, dir string) (err error) {
 // on success, or os.ProcessState.String() on failure.
 const hdrProcessState = "Process-State"
 
+// activeExecs is the number of commands currently being run by
+// handleExec, including ones still being set up. It is accessed
+// atomically.
+var activeExecs int32
+
+// execMu is held to check halting and count a new command in
+// activeExecs, and to set halting, so that a graceful halt waits for
+// commands that are about to start too.
+var execMu sync.Mutex
+
+// beginExec counts a new command in activeExecs, unless the buildlet
+// is halting, and reports whether it did.
+func beginExec() bool {
+	execMu.Lock()
+	defer execMu.Unlock()
+	if atomic.LoadInt32(&halting) != 0 {
+		return false
+	}
+	atomic.AddInt32(&activeExecs, 1)
+	return true
+}
+
+// processStarted is when the buildlet process started, reported in
+// /status.
+var processStarted = time.Now()
+
 func handleExec(w http.ResponseWriter, r *http.Request) {
-	cn := w.(http.CloseNotifier)
-	clientGone := cn.CloseNotify()
+	// The request's context is canceled when the client goes away,
+	// such as when it gives up on the command, which is then killed.
+	clientGone := r.Context().Done()
 	handlerDone := make(chan bool)
 	defer close(handlerDone)
 
@@ -867,6 +1017,11 @@ func handleExec(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "requires POST method", http.StatusBadRequest)
 		return
 	}
+	if !beginExec() {
+		http.Error(w, "buildlet is halting", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt32(&activeExecs, -1)
 	if r.ProtoMajor*10+r.ProtoMinor < 11 {
 		// We need trailers, only available in HTTP/1.1 or HTTP/2.
 		http.Error(w, "HTTP/1.1 or higher required", http.StatusBadRequest)
@@ -890,7 +1045,46 @@ func handleExec(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Trailer", hdrProcessState) // declare it so we can set it
+	limits, err := parseExecLimits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var lim procLimiter
+	if (limits.cpus > 0 || limits.memory > 0) && (isolator == nil || !isolator.enforcesLimits()) {
+		if newProcLimiter == nil {
+			http.Error(w, "CPU and memory limits are not supported on "+runtime.GOOS, http.StatusNotImplemented)
+			return
+		}
+		if lim, err = newProcLimiter(limits); err != nil {
+			http.Error(w, "limiting command: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			if err := lim.close(); err != nil {
+				log.Printf("Releasing command limits: %v", err)
+			}
+		}()
+	}
+
+	var dumper crashDumper
+	if r.FormValue("crashDumps") == "1" {
+		if newCrashDumper == nil {
+			http.Error(w, "crash dump collection is not supported on "+runtime.GOOS, http.StatusNotImplemented)
+			return
+		}
+		if dumper, err = newCrashDumper(); err != nil {
+			http.Error(w, "collecting crash dumps: "+err.Error(), http.StatusNotImplemented)
+			return
+		}
+	}
+
+	// Declare them so we can set them.
+	w.Header().Set("Trailer", strings.Join([]string{hdrProcessState, hdrExitCode, hdrExitSignal, hdrExecDuration, hdrExitLimit, hdrCrashDumps}, ", "))
+	framed := r.FormValue("framed") == "1"
+	if framed {
+		w.Header().Set(hdrExecFramed, "1")
+	}
 
 	cmdPath := r.FormValue("cmd") // required
 	absCmd := cmdPath
@@ -966,10 +1160,22 @@ func handleExec(w http.ResponseWriter, r *http.Request) {
 	}
 	cmd.Args = append(cmd.Args, r.PostForm["cmdArg"]...)
 	cmd.Dir = dir
-	cmdOutput := flushWriter{w}
+	var cmdOutput io.Writer = flushWriter{w}
 	cmd.Stdout = cmdOutput
 	cmd.Stderr = cmdOutput
+	if framed {
+		fw := &frameWriter{w: cmdOutput}
+		cmdOutput = fw.stream(frameStdout)
+		cmd.Stdout = cmdOutput
+		cmd.Stderr = fw.stream(frameStderr)
+	}
 	cmd.Env = env
+	if dumper != nil {
+		if err := dumper.prepare(cmd); err != nil {
+			http.Error(w, "collecting crash dumps: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
 	log.Printf("[%p] Running %s with args %q and env %q in dir %s",
 		cmd, cmd.Path, cmd.Args, cmd.Env, cmd.Dir)
@@ -979,13 +1185,58 @@ func handleExec(w http.ResponseWriter, r *http.Request) {
 			cmd.Path, cmd.Args, cmd.Env, cmd.Dir)
 	}
 
+	kill := killProcessTree
+	if isolator != nil {
+		k, err := isolator.prepare(cmd, limits)
+		if err != nil {
+			http.Error(w, "isolating command: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if k != nil {
+			kill = k
+		}
+	}
+	if lim != nil {
+		if err := lim.prepare(cmd); err != nil {
+			http.Error(w, "limiting command: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := r.Context().Err(); err != nil {
+		log.Printf("[%p] Not running command: client went away", cmd)
+		return
+	}
 	t0 := time.Now()
-	err := cmd.Start()
+	var timedOut int32
+	err = cmd.Start()
+	if err == nil && lim != nil {
+		if err = lim.started(cmd); err != nil {
+			kill(cmd.Process)
+			cmd.Wait()
+			err = fmt.Errorf("limiting command: %v", err)
+		}
+	}
+	if err == nil && dumper != nil {
+		if err := dumper.started(cmd); err != nil {
+			log.Printf("[%p] Enabling crash dumps: %v", cmd, err)
+		}
+	}
 	if err == nil {
+		defer useWorkdirRoot(cmd.Dir)()
+		if limits.timeout > 0 {
+			timer := time.AfterFunc(limits.timeout, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				if err := kill(cmd.Process); err != nil {
+					log.Printf("Kill after time limit failed: %v", err)
+				}
+			})
+			defer timer.Stop()
+		}
 		go func() {
 			select {
 			case <-clientGone:
-				err := killProcessTree(cmd.Process)
+				err := kill(cmd.Process)
 				if err != nil {
 					log.Printf("Kill failed: %v", err)
 				}
@@ -1003,6 +1254,33 @@ func handleExec(w http.ResponseWriter, r *http.Request) {
 			state = err.Error()
 		}
 	}
+	if ps := cmd.ProcessState; ps != nil {
+		w.Header().Set(hdrExitCode, fmt.Sprint(ps.ExitCode()))
+		w.Header().Set(hdrExitSignal, exitSignal(ps))
+	} else {
+		w.Header().Set(hdrExitCode, "-1")
+	}
+	var limit string
+	if err != nil && atomic.LoadInt32(&timedOut) != 0 {
+		limit = limitTime
+	} else if err != nil && lim != nil {
+		limit = lim.exceeded()
+	}
+	if limit != "" {
+		state += " (exceeded " + limit + " limit)"
+		w.Header().Set(hdrExitLimit, limit)
+	}
+	if err != nil && dumper != nil && cmd.ProcessState != nil {
+		// File times may lag the clock by a tick or so.
+		paths, err := dumper.dumps(cmd, t0.Add(-time.Second))
+		if err != nil {
+			log.Printf("[%p] Finding crash dumps: %v", cmd, err)
+		}
+		if names := collectCrashDumps(paths); len(names) > 0 {
+			w.Header().Set(hdrCrashDumps, strings.Join(names, ", "))
+		}
+	}
+	w.Header().Set(hdrExecDuration, time.Since(t0).String())
 	w.Header().Set(hdrProcessState, state)
 	log.Printf("[%p] Run = %s, after %v", cmd, state, time.Since(t0))
 }
@@ -1192,11 +1470,53 @@ func windowsPath(old string, goarch string) string {
 	return strings.Join(newPath, string(filepath.ListSeparator))
 }
 
+// hdrHaltDrained is the HTTP header of a graceful /halt response
+// saying whether the running commands finished before the timeout.
+const hdrHaltDrained = "X-Buildlet-Halt-Drained"
+
+// halting is 1 once the buildlet has been asked to halt, after which
+// it refuses to run new commands. It is accessed atomically.
+var halting int32
+
+// handleHalt halts the buildlet. With mode "graceful", it first
+// waits for the running commands to finish, for up to the timeout
+// given, if any, before responding and halting. The default mode,
+// "immediate", halts right away, killing them.
 func handleHalt(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "requires POST method", http.StatusBadRequest)
 		return
 	}
+	var graceful bool
+	switch mode := r.FormValue("mode"); mode {
+	case "", "immediate":
+	case "graceful":
+		graceful = true
+	default:
+		http.Error(w, fmt.Sprintf("bogus 'mode' parameter %q", mode), http.StatusBadRequest)
+		return
+	}
+	var timeout time.Duration
+	if v := r.FormValue("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			http.Error(w, "bogus 'timeout' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	execMu.Lock()
+	atomic.StoreInt32(&halting, 1)
+	execMu.Unlock()
+	if graceful {
+		// Keep waiting even if the client goes away; halting
+		// is already decided.
+		log.Printf("Halting once running commands finish (timeout %v).", timeout)
+		drained := waitForExecs(timeout)
+		if !drained {
+			log.Printf("Commands still running after %v; halting anyway.", timeout)
+		}
+		w.Header().Set(hdrHaltDrained, strconv.FormatBool(drained))
+	}
 
 	// Do the halt in 1 second, to give the HTTP response time to
 	// complete.
@@ -1218,6 +1538,22 @@ func handleHalt(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// waitForExecs waits for the running commands to finish, for up to
+// timeout if positive, and reports whether they did.
+func waitForExecs(timeout time.Duration) bool {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for atomic.LoadInt32(&activeExecs) > 0 {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
 func doHalt() {
 	log.Printf("Halting machine.")
 	// Backup mechanism, if exec hangs for any reason:
@@ -1342,7 +1678,16 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	status := buildlet.Status{
-		Version: buildletVersion,
+		Version:      buildletVersion,
+		ActiveExecs:  int(atomic.LoadInt32(&activeExecs)),
+		Started:      processStarted,
+		TarEncodings: tarEncodings,
+		UploadChunks: maxUploadChunks,
+		Halting:      atomic.LoadInt32(&halting) != 0,
+	}
+	if *workdirQuota > 0 {
+		status.WorkdirQuota = *workdirQuota
+		status.WorkdirUsage = atomic.LoadInt64(&workdirUsage)
 	}
 	b, err := json.Marshal(status)
 	if err != nil {
@@ -1353,6 +1698,37 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// handleFeatures lists the optional features the buildlet supports,
+// for clients to use them without breaking older buildlets.
+func handleFeatures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "requires GET method", http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(features())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+}
+
+// features returns the optional features the buildlet supports: those
+// of its version, plus those that depend on how it's run.
+func features() buildlet.Features {
+	f := buildlet.FeaturesOfVersion(buildletVersion)
+	if isolator != nil {
+		f[buildlet.FeatureExecIsolation] = true
+	}
+	if newCrashDumper != nil {
+		if _, err := newCrashDumper(); err == nil {
+			f[buildlet.FeatureCrashDumps] = true
+		}
+	}
+	return f
+}
+
 func handleLs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "requires GET method", http.StatusBadRequest)
@@ -1362,6 +1738,21 @@ func handleLs(w http.ResponseWriter, r *http.Request) {
 	recursive, _ := strconv.ParseBool(r.FormValue("recursive"))
 	digest, _ := strconv.ParseBool(r.FormValue("digest"))
 	skip := r.Form["skip"] // '/'-separated relative dirs
+	opts := buildlet.ListDirOpts{Glob: r.Form["glob"]}
+	for _, pat := range opts.Glob {
+		if _, err := path.Match(pat, ""); err != nil {
+			http.Error(w, fmt.Sprintf("bad 'glob' parameter %q: %v", pat, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bogus 'depth' parameter", http.StatusBadRequest)
+			return
+		}
+		opts.MaxDepth = n
+	}
 
 	if !mkdirAllWorkdirOr500(w) {
 		return
@@ -1370,7 +1761,7 @@ func handleLs(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bogus dir", http.StatusBadRequest)
 		return
 	}
-	base := filepath.Join(*workDir, filepath.FromSlash(dir))
+	base := longPath(filepath.Join(*workDir, filepath.FromSlash(dir)))
 	anyOutput := false
 	err := filepath.Walk(base, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
@@ -1387,6 +1778,13 @@ func handleLs(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
+		descend := recursive && (opts.MaxDepth == 0 || strings.Count(rel, "/")+1 < opts.MaxDepth)
+		if !opts.Match(rel) {
+			if fi.IsDir() && !descend {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		anyOutput = true
 		fmt.Fprintf(w, "%s\t%s", fi.Mode(), rel)
 		if fi.Mode().IsRegular() {
@@ -1402,7 +1800,7 @@ func handleLs(w http.ResponseWriter, r *http.Request) {
 			io.WriteString(w, "/")
 		}
 		io.WriteString(w, "\n")
-		if fi.IsDir() && !recursive {
+		if fi.IsDir() && !descend {
 			return filepath.SkipDir
 		}
 		return nil
@@ -1462,30 +1860,7 @@ func handleConnectSSH(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(time.Second)
 	}
 	defer sshConn.Close()
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		log.Printf("conn can't hijack for ssh proxy; HTTP/2 enabled by default?")
-		http.Error(w, "conn can't hijack", http.StatusInternalServerError)
-		return
-	}
-	conn, _, err := hj.Hijack()
-	if err != nil {
-		log.Printf("ssh hijack error: %v", err)
-		http.Error(w, "ssh hijack error: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer conn.Close()
-	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: ssh\r\nConnection: Upgrade\r\n\r\n")
-	errc := make(chan error, 1)
-	go func() {
-		_, err := io.Copy(sshConn, conn)
-		errc <- err
-	}()
-	go func() {
-		_, err := io.Copy(conn, sshConn)
-		errc <- err
-	}()
-	<-errc
+	proxyUpgrade(w, sshConn, "ssh")
 }
 
 // sshPort returns the port to use for the local SSH server.
@@ -1700,6 +2075,13 @@ func (pw *gcePlan9LogWriter) Write(p []byte) (n int, err error) {
 
 var killProcessTree = killProcessTreeUnix
 
+// longPath returns the absolute path p in a form that the platform's
+// file APIs accept however long it is, for walking, extracting into,
+// and removing deep trees such as modules' vendor directories. Only
+// Windows, whose APIs otherwise limit paths to MAX_PATH (260)
+// characters, needs another form, which commands shouldn't see.
+var longPath = func(p string) string { return p }
+
 func killProcessTreeUnix(p *os.Process) error {
 	return p.Kill()
 }
@@ -1926,6 +2308,7 @@ func removeAllAndMkdir(dir string) {
 // also try to change permissions to work around permission errors
 // when deleting.
 func removeAllIncludingReadonly(dir string) error {
+	dir = longPath(dir)
 	err := os.RemoveAll(dir)
 	if err == nil || !os.IsPermission(err) ||
 		runtime.GOOS == "windows" { // different filesystem permission model; also our windows builders are ephemeral single-use VMs anyway
@@ -2016,13 +2399,22 @@ func handleHealthz(w http.ResponseWriter, _ *http.Request) {
 	w.Write([]byte("ok"))
 }
 
-// serveReverseHealth serves /healthz requests on healthAddr for
-// reverse buildlets.
+// serveReverseHealth serves /healthz and /status requests on
+// healthAddr for reverse buildlets.
 //
 // This can be used to monitor the health of guest buildlets, such as
-// the Windows ARM64 qemu guest buildlet.
+// the Windows ARM64 qemu guest buildlet, and to tell whether they are
+// running a build.
 func serveReverseHealth() error {
+	return http.ListenAndServe(*healthAddr, reverseHealthHandler(reverseKey))
+}
+
+// reverseHealthHandler returns the handler for healthAddr. Unlike
+// /healthz, /status reveals what the buildlet is running, so it
+// requires the builder key as the basic auth password.
+func reverseHealthHandler(key string) http.Handler {
 	m := &http.ServeMux{}
 	m.HandleFunc("/healthz", handleHealthz)
-	return http.ListenAndServe(*healthAddr, m)
+	m.Handle("/status", requirePasswordHandler{http.HandlerFunc(handleStatus), key})
+	return m
 }
@@ -5,9 +5,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/build/buildlet"
 )
 
 func TestSetPathEnv(t *testing.T) {
@@ -59,3 +68,136 @@ func TestSetPathEnv(t *testing.T) {
 		}
 	}
 }
+
+// signalWriter closes started on its first write.
+type signalWriter struct {
+	once    bool
+	started chan struct{}
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	if !w.once {
+		w.once = true
+		close(w.started)
+	}
+	return len(p), nil
+}
+
+func TestExecCancel(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("requires a Bourne shell")
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	old := *workDir
+	*workDir = t.TempDir()
+	defer func() { *workDir = old }()
+	ts := httptest.NewServer(http.HandlerFunc(handleExec))
+	defer ts.Close()
+	bc := buildlet.NewClient(strings.TrimPrefix(ts.URL, "http://"), buildlet.NoKeyPair)
+	defer bc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &signalWriter{started: make(chan struct{})}
+	go func() {
+		<-out.started
+		cancel()
+	}()
+	t0 := time.Now()
+	_, execErr := bc.Exec(ctx, sh, buildlet.ExecOpts{
+		SystemLevel: true,
+		Args:        []string{"-c", "echo started; exec sleep 30"},
+		Output:      out,
+	})
+	if execErr != context.Canceled {
+		t.Errorf("Exec() = _, %v; want %v", execErr, context.Canceled)
+	}
+	if d := time.Since(t0); d > 10*time.Second {
+		t.Errorf("Exec() took %v to return after being canceled", d)
+	}
+	if !bc.IsBroken() {
+		t.Errorf("client not marked broken after canceling Exec")
+	}
+	// The buildlet notices the client is gone and kills the command.
+	for deadline := time.Now().Add(10 * time.Second); atomic.LoadInt32(&activeExecs) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("command still running after canceling Exec")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWaitForExecs(t *testing.T) {
+	atomic.AddInt32(&activeExecs, 1)
+	if waitForExecs(200 * time.Millisecond) {
+		t.Errorf("waitForExecs with a command running = true; want false after the timeout")
+	}
+	time.AfterFunc(100*time.Millisecond, func() { atomic.AddInt32(&activeExecs, -1) })
+	if !waitForExecs(10 * time.Second) {
+		t.Errorf("waitForExecs = false; want true once the command finishes")
+	}
+}
+
+func TestExecWhileHalting(t *testing.T) {
+	atomic.StoreInt32(&halting, 1)
+	defer atomic.StoreInt32(&halting, 0)
+	w := httptest.NewRecorder()
+	handleExec(w, httptest.NewRequest("POST", "/exec", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("exec while halting: got status %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if n := atomic.LoadInt32(&activeExecs); n != 0 {
+		t.Errorf("activeExecs = %d after a refused exec; want 0", n)
+	}
+}
+
+func TestExecCountedUntilReturn(t *testing.T) {
+	// A command is counted from before it starts, so that a
+	// graceful halt waits for it, and uncounted however the
+	// handler returns.
+	if !beginExec() {
+		t.Fatal("beginExec() = false; want true when not halting")
+	}
+	if n := atomic.LoadInt32(&activeExecs); n != 1 {
+		t.Errorf("activeExecs = %d after beginExec; want 1", n)
+	}
+	atomic.AddInt32(&activeExecs, -1)
+
+	req := httptest.NewRequest("POST", "/exec", nil)
+	req.ProtoMajor, req.ProtoMinor = 1, 0
+	w := httptest.NewRecorder()
+	handleExec(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("HTTP/1.0 exec: got status %d; want %d", w.Code, http.StatusBadRequest)
+	}
+	if n := atomic.LoadInt32(&activeExecs); n != 0 {
+		t.Errorf("activeExecs = %d after a failed exec; want 0", n)
+	}
+}
+
+func TestReverseHealthHandler(t *testing.T) {
+	h := reverseHealthHandler("secret")
+	tests := []struct {
+		path     string
+		password string
+		want     int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/status", "", http.StatusForbidden},
+		{"/status", "wrong", http.StatusForbidden},
+		{"/status", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.password != "" {
+			req.SetBasicAuth("", tt.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("GET %s with password %q: got status %d; want %d", tt.path, tt.password, w.Code, tt.want)
+		}
+	}
+}
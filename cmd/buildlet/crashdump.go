@@ -0,0 +1,226 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// Crash dump collection.
+//
+// An /exec request with crashDumps=1 asks the buildlet to collect
+// the dumps that the command's processes leave when they crash: core
+// files on Linux, and minidumps written by Windows Error Reporting on
+// Windows. Go programs are run with GOTRACEBACK=crash (or wer) so
+// that they leave one too. Collected dumps are moved to
+// crashDumpsDir, named in the hdrCrashDumps trailer, and served by
+// /debug/crashdumps. The buildlet keeps the maxCrashDumps newest ones.
+
+// hdrCrashDumps is the HTTP trailer of an /exec response listing the
+// comma-separated names of the crash dumps collected from the
+// command.
+const hdrCrashDumps = "Process-Crash-Dumps"
+
+// maxCrashDumps is how many crash dumps the buildlet keeps.
+const maxCrashDumps = 20
+
+// crashDumpMu serializes changes to crashDumpsDir.
+var crashDumpMu sync.Mutex
+
+// crashDumpsDir returns the directory holding collected crash dumps,
+// next to the work directory like snapshotsDir, so that cleaning the
+// work directory doesn't remove them.
+func crashDumpsDir() string {
+	return filepath.Clean(*workDir) + "-crashdumps"
+}
+
+// A crashDumper arranges for a command's crashing processes to leave
+// dumps, and finds them.
+type crashDumper interface {
+	// prepare configures the command before it is started.
+	prepare(cmd *exec.Cmd) error
+	// started is called once the command has started.
+	started(cmd *exec.Cmd) error
+	// dumps returns the paths of the dumps that the command's
+	// processes left since t0.
+	dumps(cmd *exec.Cmd, t0 time.Time) ([]string, error)
+}
+
+// newCrashDumper, if non-nil, returns a crashDumper. It is set by
+// platforms supporting crash dump collection.
+var newCrashDumper func() (crashDumper, error)
+
+// setTraceback sets GOTRACEBACK in cmd's environment to level, unless
+// the request already set it.
+func setTraceback(cmd *exec.Cmd, level string) {
+	if getEnv(cmd.Env, "GOTRACEBACK") == "" {
+		cmd.Env = append(cmd.Env, "GOTRACEBACK="+level)
+	}
+}
+
+// collectCrashDumps moves the dumps at paths to crashDumpsDir,
+// removing the oldest dumps beyond maxCrashDumps, and returns their
+// names. Dumps larger than -crash-dump-max-size are discarded.
+func collectCrashDumps(paths []string) []string {
+	crashDumpMu.Lock()
+	defer crashDumpMu.Unlock()
+	if len(paths) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(crashDumpsDir(), 0755); err != nil {
+		log.Printf("Collecting crash dumps: %v", err)
+		return nil
+	}
+	var names []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			log.Printf("Collecting crash dump: %v", err)
+			continue
+		}
+		if fi.Size() > *crashDumpMaxSize {
+			log.Printf("Discarding crash dump %s: %d bytes is over -crash-dump-max-size", p, fi.Size())
+			os.Remove(p)
+			continue
+		}
+		name := crashDumpName(fi.ModTime(), filepath.Base(p))
+		dst := filepath.Join(crashDumpsDir(), name)
+		if err := os.Rename(p, dst); err != nil {
+			// The dump may be on another file system, such
+			// as a tmpfs work directory.
+			if err := copyFile(p, dst, 0644); err != nil {
+				log.Printf("Collecting crash dump %s: %v", p, err)
+				os.Remove(dst)
+				continue
+			}
+			os.Remove(p)
+		}
+		log.Printf("Collected crash dump %s (%d bytes) as %s", p, fi.Size(), name)
+		names = append(names, name)
+	}
+	if err := pruneCrashDumps(); err != nil {
+		log.Printf("Removing old crash dumps: %v", err)
+	}
+	return names
+}
+
+// crashDumpName returns the name to store a dump with the given file
+// name and time under. Names are valid snapshot names.
+func crashDumpName(t time.Time, file string) string {
+	name := t.UTC().Format("20060102T150405.000000000") + "-"
+	for _, r := range file {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.') {
+			r = '_'
+		}
+		name += string(r)
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// listCrashDumps returns the collected crash dumps, oldest first.
+func listCrashDumps() ([]buildlet.CrashDump, error) {
+	fis, err := ioutil.ReadDir(crashDumpsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dumps []buildlet.CrashDump
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !validSnapshotName(fi.Name()) {
+			continue
+		}
+		dumps = append(dumps, buildlet.CrashDump{Name: fi.Name(), Size: fi.Size(), Time: fi.ModTime()})
+	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].Name < dumps[j].Name })
+	return dumps, nil
+}
+
+// pruneCrashDumps removes the oldest crash dumps beyond
+// maxCrashDumps. The caller must hold crashDumpMu.
+func pruneCrashDumps() error {
+	dumps, err := listCrashDumps()
+	if err != nil {
+		return err
+	}
+	for len(dumps) > maxCrashDumps {
+		if err := os.Remove(filepath.Join(crashDumpsDir(), dumps[0].Name)); err != nil {
+			return err
+		}
+		dumps = dumps[1:]
+	}
+	return nil
+}
+
+// handleCrashDumps lists the collected crash dumps (GET), serves one
+// (GET with name), or deletes one (DELETE with name).
+func handleCrashDumps(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name != "" && !validSnapshotName(name) {
+		http.Error(w, "bogus crash dump name", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == "GET" && name == "":
+		dumps, err := listCrashDumps()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dumps == nil {
+			dumps = []buildlet.CrashDump{}
+		}
+		writeJSON(w, dumps)
+	case r.Method == "GET":
+		f, err := os.Open(filepath.Join(crashDumpsDir(), name))
+		if os.IsNotExist(err) {
+			http.Error(w, "no such crash dump", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+	case r.Method == "DELETE" && name != "":
+		crashDumpMu.Lock()
+		defer crashDumpMu.Unlock()
+		err := os.Remove(filepath.Join(crashDumpsDir(), name))
+		if os.IsNotExist(err) {
+			http.Error(w, "no such crash dump", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted crash dump %q", name)
+	case r.Method == "DELETE":
+		http.Error(w, "requires 'name' parameter", http.StatusBadRequest)
+	default:
+		http.Error(w, "requires GET or DELETE method", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	newCrashDumper = newCoreDumper
+}
+
+// A coreDumper collects the core files that the kernel writes as
+// kernel.core_pattern says. Core files piped to a helper, as by
+// systemd-coredump or apport, can't be collected.
+type coreDumper struct {
+	// dir is the directory the kernel writes core files to. If it
+	// isn't absolute, it's relative to the crashing process's
+	// working directory, which is taken to be under the command's.
+	dir string
+	// glob matches the names of core files.
+	glob string
+}
+
+func newCoreDumper() (crashDumper, error) {
+	var lim rlimit64
+	if err := prlimit(0, syscall.RLIMIT_CORE, nil, &lim); err != nil {
+		return nil, err
+	}
+	if lim.max == 0 {
+		return nil, fmt.Errorf("core files are disabled by the buildlet's RLIMIT_CORE hard limit")
+	}
+	pattern, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return nil, err
+	}
+	usesPID, _ := ioutil.ReadFile("/proc/sys/kernel/core_uses_pid")
+	return parseCorePattern(strings.TrimSpace(string(pattern)), strings.TrimSpace(string(usesPID)) == "1")
+}
+
+// parseCorePattern returns the coreDumper for the kernel.core_pattern
+// and kernel.core_uses_pid settings.
+func parseCorePattern(pattern string, usesPID bool) (*coreDumper, error) {
+	if strings.HasPrefix(pattern, "|") {
+		return nil, fmt.Errorf("kernel.core_pattern pipes core files to %s", strings.TrimSpace(pattern[1:]))
+	}
+	if pattern == "" {
+		pattern = "core"
+	}
+	d := new(coreDumper)
+	file := pattern
+	if i := strings.LastIndex(pattern, "/"); i >= 0 {
+		d.dir, file = pattern[:i], pattern[i+1:]
+		if d.dir == "" {
+			d.dir = "/"
+		}
+		if strings.Contains(d.dir, "%") {
+			return nil, fmt.Errorf("kernel.core_pattern %q has specifiers in its directory", pattern)
+		}
+	}
+	var glob strings.Builder
+	hasPID := false
+	for i := 0; i < len(file); i++ {
+		c := file[i]
+		if c == '%' && i+1 < len(file) {
+			i++
+			switch file[i] {
+			case '%':
+				glob.WriteByte('%')
+			case 'p', 'P':
+				hasPID = true
+				glob.WriteByte('*')
+			default:
+				glob.WriteByte('*')
+			}
+			continue
+		}
+		if strings.IndexByte(`*?[\`, c) >= 0 {
+			glob.WriteByte('\\')
+		}
+		glob.WriteByte(c)
+	}
+	if usesPID && !hasPID {
+		glob.WriteString(".*")
+	}
+	d.glob = glob.String()
+	return d, nil
+}
+
+func (d *coreDumper) prepare(cmd *exec.Cmd) error {
+	setTraceback(cmd, "crash")
+	return nil
+}
+
+// started raises the command's soft RLIMIT_CORE to
+// -crash-dump-max-size, which processes it starts inherit. Isolated
+// commands' container processes don't.
+func (d *coreDumper) started(cmd *exec.Cmd) error {
+	pid := cmd.Process.Pid
+	var lim rlimit64
+	if err := prlimit(pid, syscall.RLIMIT_CORE, nil, &lim); err != nil {
+		return err
+	}
+	lim.cur = uint64(*crashDumpMaxSize)
+	if lim.cur > lim.max {
+		lim.cur = lim.max
+	}
+	return prlimit(pid, syscall.RLIMIT_CORE, &lim, nil)
+}
+
+func (d *coreDumper) dumps(cmd *exec.Cmd, t0 time.Time) ([]string, error) {
+	var paths []string
+	check := func(p string, fi os.FileInfo) {
+		if !fi.Mode().IsRegular() || fi.ModTime().Before(t0) {
+			return
+		}
+		if ok, _ := path.Match(d.glob, fi.Name()); ok && isCoreFile(p) {
+			paths = append(paths, p)
+		}
+	}
+	if filepath.IsAbs(d.dir) {
+		fis, err := ioutil.ReadDir(d.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			check(filepath.Join(d.dir, fi.Name()), fi)
+		}
+		return paths, nil
+	}
+	err := filepath.Walk(cmd.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Skip what the command left unreadable.
+			return nil
+		}
+		check(p, fi)
+		return nil
+	})
+	return paths, err
+}
+
+// isCoreFile reports whether the file at p is an ELF core file.
+func isCoreFile(p string) bool {
+	f, err := elf.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Type == elf.ET_CORE
+}
+
+// rlimit64 is the struct rlimit64 of prlimit64.
+type rlimit64 struct {
+	cur, max uint64
+}
+
+// prlimit gets or sets a resource limit of the process pid, or of the
+// buildlet if pid is 0.
+func prlimit(pid int, resource int, newLimit, oldLimit *rlimit64) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(newLimit)), uintptr(unsafe.Pointer(oldLimit)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
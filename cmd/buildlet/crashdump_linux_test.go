@@ -0,0 +1,45 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+func TestParseCorePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		usesPID  bool
+		wantDir  string
+		match    string
+		notMatch string
+	}{
+		{pattern: "core", match: "core", notMatch: "core.1"},
+		{pattern: "core", usesPID: true, match: "core.123", notMatch: "core"},
+		{pattern: "/var/crash/core.%e.%p", wantDir: "/var/crash", match: "core.go.test.123", notMatch: "core"},
+		{pattern: "/var/crash/core.%p", usesPID: true, wantDir: "/var/crash", match: "core.123", notMatch: "dump.123"},
+		{pattern: "cores/%%core[%p]", wantDir: "cores", match: "%core[1]", notMatch: "core1"},
+	}
+	for _, tt := range tests {
+		d, err := parseCorePattern(tt.pattern, tt.usesPID)
+		if err != nil {
+			t.Errorf("parseCorePattern(%q, %t) = %v", tt.pattern, tt.usesPID, err)
+			continue
+		}
+		if d.dir != tt.wantDir {
+			t.Errorf("parseCorePattern(%q, %t) dir = %q, wanted %q", tt.pattern, tt.usesPID, d.dir, tt.wantDir)
+		}
+		if ok, _ := path.Match(d.glob, tt.match); !ok {
+			t.Errorf("parseCorePattern(%q, %t) glob %q doesn't match %q", tt.pattern, tt.usesPID, d.glob, tt.match)
+		}
+		if ok, _ := path.Match(d.glob, tt.notMatch); ok {
+			t.Errorf("parseCorePattern(%q, %t) glob %q matches %q", tt.pattern, tt.usesPID, d.glob, tt.notMatch)
+		}
+	}
+	if _, err := parseCorePattern("|/usr/lib/systemd/systemd-coredump %P %u", false); err == nil {
+		t.Error("parseCorePattern of a pipe succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCrashDumps(t *testing.T) {
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w })
+	ctx := context.Background()
+	oldMax := *crashDumpMaxSize
+	*crashDumpMaxSize = 10
+	defer func() { *crashDumpMaxSize = oldMax }()
+
+	dir := t.TempDir()
+	small := filepath.Join(dir, "core.123")
+	big := filepath.Join(dir, "go.test.exe.456.dmp")
+	if err := ioutil.WriteFile(small, []byte("core"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(big, []byte(strings.Repeat("x", 11)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names := collectCrashDumps([]string{small, big})
+	if len(names) != 1 || !strings.HasSuffix(names[0], "-core.123") {
+		t.Fatalf("collectCrashDumps = %q, wanted only core.123", names)
+	}
+
+	dumps, err := c.CrashDumps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) != 1 || dumps[0].Name != names[0] || dumps[0].Size != 4 {
+		t.Fatalf("CrashDumps = %+v, wanted %s of 4 bytes", dumps, names[0])
+	}
+	rc, err := c.GetCrashDump(ctx, names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "core" {
+		t.Errorf("GetCrashDump = %q, wanted %q", b, "core")
+	}
+
+	if err := c.DeleteCrashDump(ctx, names[0]); err != nil {
+		t.Fatal(err)
+	}
+	if dumps, err := c.CrashDumps(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(dumps) != 0 {
+		t.Errorf("CrashDumps after DeleteCrashDump = %+v, wanted none", dumps)
+	}
+	if _, err := c.GetCrashDump(ctx, names[0]); err == nil {
+		t.Error("GetCrashDump of a deleted dump succeeded")
+	}
+}
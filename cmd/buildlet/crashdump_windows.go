@@ -0,0 +1,102 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	newCrashDumper = newWERDumper
+}
+
+// werLocalDumpsKey is the registry key under HKEY_LOCAL_MACHINE that
+// has Windows Error Reporting keep minidumps of crashing programs.
+// The settings apply to every program on the host, not only the
+// buildlet's commands.
+const werLocalDumpsKey = `SOFTWARE\Microsoft\Windows\Windows Error Reporting\LocalDumps`
+
+var (
+	werOnce sync.Once
+	werErr  error
+)
+
+// werDumpsDir returns the directory Windows Error Reporting writes
+// minidumps to, from which they're collected.
+func werDumpsDir() string {
+	return filepath.Join(crashDumpsDir(), "wer")
+}
+
+// initWER configures Windows Error Reporting to write minidumps to
+// werDumpsDir.
+func initWER() error {
+	if err := os.MkdirAll(werDumpsDir(), 0755); err != nil {
+		return err
+	}
+	var key syscall.Handle
+	var disposition uint32
+	r, _, _ := procRegCreateKeyExW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(werLocalDumpsKey))),
+		0, 0, 0, syscall.KEY_WRITE, 0,
+		uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(&disposition)))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+
+	dir := syscall.StringToUTF16(werDumpsDir())
+	if err := regSetValue(key, "DumpFolder", syscall.REG_EXPAND_SZ, unsafe.Pointer(&dir[0]), uintptr(len(dir)*2)); err != nil {
+		return err
+	}
+	count := uint32(maxCrashDumps)
+	if err := regSetValue(key, "DumpCount", syscall.REG_DWORD, unsafe.Pointer(&count), unsafe.Sizeof(count)); err != nil {
+		return err
+	}
+	typ := uint32(1) // minidump
+	return regSetValue(key, "DumpType", syscall.REG_DWORD, unsafe.Pointer(&typ), unsafe.Sizeof(typ))
+}
+
+// A werDumper collects the minidumps that Windows Error Reporting
+// writes of crashing programs.
+type werDumper struct{}
+
+func newWERDumper() (crashDumper, error) {
+	werOnce.Do(func() { werErr = initWER() })
+	if werErr != nil {
+		return nil, werErr
+	}
+	return werDumper{}, nil
+}
+
+func (werDumper) prepare(cmd *exec.Cmd) error {
+	setTraceback(cmd, "wer")
+	return nil
+}
+
+func (werDumper) started(cmd *exec.Cmd) error { return nil }
+
+// dumps returns the minidumps written since t0. A crashing process
+// only exits once its dump is written, so they're complete. Dumps of
+// other programs crashing meanwhile are included too.
+func (werDumper) dumps(cmd *exec.Cmd, t0 time.Time) ([]string, error) {
+	fis, err := ioutil.ReadDir(werDumpsDir())
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".dmp") && !fi.ModTime().Before(t0) {
+			paths = append(paths, filepath.Join(werDumpsDir(), fi.Name()))
+		}
+	}
+	return paths, nil
+}
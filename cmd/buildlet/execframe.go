@@ -0,0 +1,73 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Framed exec output.
+//
+// If the /exec request has the form value framed=1, the buildlet
+// sets the hdrExecFramed response header, and sends the command's
+// standard output and standard error in frames rather than
+// interleaved: each is a byte naming the stream, frameStdout or
+// frameStderr, a 4-byte big-endian payload length, and the payload.
+
+const (
+	// hdrExecFramed is the HTTP header of an /exec response whose
+	// body is framed.
+	hdrExecFramed = "X-Exec-Framed"
+	// hdrExitCode, hdrExitSignal, and hdrExecDuration are HTTP
+	// trailers of /exec responses with the command's exit code, or
+	// -1 if it did not exit normally, the signal that terminated
+	// it, if any, and how long it ran, as a Go duration.
+	hdrExitCode     = "Process-Exit-Code"
+	hdrExitSignal   = "Process-Signal"
+	hdrExecDuration = "Process-Duration"
+)
+
+// Stream IDs of frames.
+const (
+	frameStdout = 1
+	frameStderr = 2
+)
+
+// frameWriter writes frames to w. It is safe for concurrent use by the
+// streams of a command.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// stream returns an io.Writer writing each call as a frame of stream
+// id.
+func (fw *frameWriter) stream(id byte) io.Writer {
+	return frameStream{fw, id}
+}
+
+type frameStream struct {
+	fw *frameWriter
+	id byte
+}
+
+func (s frameStream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var hdr [5]byte
+	hdr[0] = s.id
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(p)))
+	s.fw.mu.Lock()
+	defer s.fw.mu.Unlock()
+	// The frame is written in one call so that a flushing w sends
+	// it whole.
+	if _, err := s.fw.w.Write(append(hdr[:], p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/build/buildlet"
+)
+
+func TestExecFramed(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("requires a Bourne shell")
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	old := *workDir
+	*workDir = t.TempDir()
+	defer func() { *workDir = old }()
+	ts := httptest.NewServer(http.HandlerFunc(handleExec))
+	defer ts.Close()
+	bc := buildlet.NewClient(strings.TrimPrefix(ts.URL, "http://"), buildlet.NoKeyPair)
+	defer bc.Close()
+
+	cases := []struct {
+		desc       string
+		script     string
+		separate   bool
+		wantOut    string
+		wantErr    string
+		wantStatus buildlet.ExitStatus
+	}{
+		{
+			desc:       "separate",
+			script:     "echo out; echo err >&2; exit 3",
+			separate:   true,
+			wantOut:    "out\n",
+			wantErr:    "err\n",
+			wantStatus: buildlet.ExitStatus{Code: 3},
+		},
+		{
+			desc:       "interleaved",
+			script:     "echo out; echo err >&2",
+			wantOut:    "out\nerr\n",
+			wantStatus: buildlet.ExitStatus{Code: 0},
+		},
+		{
+			desc:       "signal",
+			script:     "kill -KILL $$",
+			separate:   true,
+			wantStatus: buildlet.ExitStatus{Code: -1, Signal: "killed"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			var got buildlet.ExitStatus
+			opts := buildlet.ExecOpts{
+				SystemLevel: true,
+				Args:        []string{"-c", c.script},
+				Output:      &stdout,
+				OnExit:      func(es buildlet.ExitStatus) { got = es },
+			}
+			if c.separate {
+				opts.Stderr = &stderr
+			}
+			remoteErr, execErr := bc.Exec(context.Background(), sh, opts)
+			if execErr != nil {
+				t.Fatalf("Exec() = _, %v", execErr)
+			}
+			if stdout.String() != c.wantOut || stderr.String() != c.wantErr {
+				t.Errorf("Exec() wrote %q to stdout and %q to stderr, wanted %q and %q", stdout.String(), stderr.String(), c.wantOut, c.wantErr)
+			}
+			if got.Duration <= 0 {
+				t.Errorf("Exec() exit duration = %v, wanted a positive one", got.Duration)
+			}
+			got.Duration = 0
+			if !reflect.DeepEqual(got, c.wantStatus) {
+				t.Errorf("Exec() exit status = %+v, wanted %+v", got, c.wantStatus)
+			}
+			var ee *buildlet.ExitError
+			if (remoteErr != nil) != (c.wantStatus.Code != 0) {
+				t.Errorf("Exec() = %v, _, wanted an error: %t", remoteErr, remoteErr == nil)
+			} else if remoteErr != nil && (!errors.As(remoteErr, &ee) || ee.Code != c.wantStatus.Code) {
+				t.Errorf("Exec() = %#v, _, wanted an *ExitError with code %d", remoteErr, c.wantStatus.Code)
+			}
+		})
+	}
+}
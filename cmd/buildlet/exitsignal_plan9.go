@@ -0,0 +1,13 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "os"
+
+// exitSignal returns the empty string: Plan 9 processes are
+// terminated by notes, which are reported in their exit status.
+func exitSignal(ps *os.ProcessState) string {
+	return ""
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Isolated exec.
+//
+// With -exec-isolation, the buildlet runs each /exec command isolated
+// from its host instead of directly on it, so that builds can't
+// depend on or damage host state. The /exec API is unchanged: the
+// work directory is at the same path in the isolated environment, so
+// commands, their directories, and their output are where the client
+// expects. The -exec-isolation value names a backend and its argument:
+//
+//	docker:IMAGE  run in a new container of IMAGE with docker
+//	podman:IMAGE  run in a new container of IMAGE with podman
+//	chroot:DIR    run chrooted to DIR, in new UTS and IPC namespaces (Linux only)
+
+// An execIsolator runs commands isolated from the host.
+type execIsolator interface {
+	// prepare rewrites cmd, before it is started, to run isolated.
+	// If kill is non-nil, it is used instead of killProcessTree to
+	// kill the started command.
+	prepare(cmd *exec.Cmd, limits execLimits) (kill func(*os.Process) error, err error)
+	// enforcesLimits reports whether the isolator confines
+	// commands to their CPU and memory limits itself, without a
+	// procLimiter.
+	enforcesLimits() bool
+}
+
+// execIsolators maps the backend names of -exec-isolation to their
+// constructors, which are passed the rest of the value.
+var execIsolators = map[string]func(arg string) (execIsolator, error){
+	"docker": newContainerIsolator("docker"),
+	"podman": newContainerIsolator("podman"),
+}
+
+// isolator, if non-nil, is the -exec-isolation backend.
+var isolator execIsolator
+
+// parseExecIsolation returns the backend named by an -exec-isolation
+// value of the form "backend:arg".
+func parseExecIsolation(v string) (execIsolator, error) {
+	i := strings.Index(v, ":")
+	if i < 0 || i == len(v)-1 {
+		return nil, fmt.Errorf("invalid -exec-isolation value %q; want backend:arg", v)
+	}
+	newIsolator, ok := execIsolators[v[:i]]
+	if !ok {
+		var names []string
+		for name := range execIsolators {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown -exec-isolation backend %q; supported: %s", v[:i], strings.Join(names, ", "))
+	}
+	return newIsolator(v[i+1:])
+}
+
+// containerIsolator runs each command in a new container, with a
+// docker-compatible container runtime.
+type containerIsolator struct {
+	runtime string // path of the runtime's command
+	image   string
+}
+
+var containerSeq int64
+
+func newContainerIsolator(name string) func(image string) (execIsolator, error) {
+	return func(image string) (execIsolator, error) {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return nil, err
+		}
+		return &containerIsolator{runtime: path, image: image}, nil
+	}
+}
+
+func (c *containerIsolator) enforcesLimits() bool { return true }
+
+func (c *containerIsolator) prepare(cmd *exec.Cmd, limits execLimits) (kill func(*os.Process) error, err error) {
+	name := fmt.Sprintf("buildlet-exec-%d-%d", os.Getpid(), atomic.AddInt64(&containerSeq, 1))
+	args := []string{
+		c.runtime, "run", "--rm", "--init",
+		"--name", name,
+		"--network", "host",
+		"--volume", *workDir + ":" + *workDir,
+		"--workdir", cmd.Dir,
+	}
+	if uid := os.Getuid(); uid >= 0 {
+		// Run as the buildlet's user, so the command's files
+		// in the work directory are the buildlet's to remove.
+		args = append(args, "--user", fmt.Sprintf("%d:%d", uid, os.Getgid()))
+	}
+	for _, kv := range cmd.Env {
+		args = append(args, "--env", kv)
+	}
+	if limits.cpus > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(limits.cpus, 'f', -1, 64))
+	}
+	if limits.memory > 0 {
+		// Setting --memory-swap to the same value disallows swap.
+		m := strconv.FormatInt(limits.memory, 10)
+		args = append(args, "--memory", m, "--memory-swap", m)
+	}
+	args = append(args, c.image, cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+
+	// The runtime's command runs on the host with the buildlet's
+	// environment; the command's environment is passed in args.
+	cmd.Path = c.runtime
+	cmd.Args = args
+	cmd.Env = nil
+
+	// Killing the runtime's command doesn't stop the container.
+	kill = func(p *os.Process) error {
+		err := exec.Command(c.runtime, "kill", name).Run()
+		p.Kill()
+		return err
+	}
+	return kill, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	execIsolators["chroot"] = newChrootIsolator
+}
+
+// chrootIsolator runs each command chrooted to a root filesystem,
+// such as an unpacked container image, in new UTS and IPC namespaces.
+type chrootIsolator struct {
+	root string
+}
+
+// newChrootIsolator bind mounts the work directory, /dev, /proc, and
+// /sys at the same paths under root. The mounts outlive the buildlet,
+// so ones already there from a previous run are reused.
+func newChrootIsolator(root string) (execIsolator, error) {
+	if !filepath.IsAbs(root) {
+		return nil, fmt.Errorf("chroot directory %q is not absolute", root)
+	}
+	if fi, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("chroot directory %q is not a directory", root)
+	}
+	mounted, err := mountPoints()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{"/dev", "/proc", "/sys", *workDir} {
+		target := filepath.Join(root, dir)
+		if mounted[target] {
+			continue
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return nil, err
+		}
+		if err := syscall.Mount(dir, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return nil, fmt.Errorf("bind mounting %s at %s: %v", dir, target, err)
+		}
+	}
+	return &chrootIsolator{root: root}, nil
+}
+
+// mountPoints returns the set of the process's mount points.
+func mountPoints() (map[string]bool, error) {
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		// The fifth field is the mount point, with spaces and
+		// such octal escaped.
+		if f := strings.Fields(line); len(f) >= 5 {
+			m[unescapeMountPath(f[4])] = true
+		}
+	}
+	return m, nil
+}
+
+// unescapeMountPath undoes the octal escaping of whitespace and
+// backslashes in /proc/self/mountinfo paths.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (c *chrootIsolator) enforcesLimits() bool { return false }
+
+func (c *chrootIsolator) prepare(cmd *exec.Cmd, limits execLimits) (kill func(*os.Process) error, err error) {
+	// The command's path and directory are resolved in the new
+	// root; the work directory is at the same path there.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Chroot = c.root
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	return nil, nil
+}
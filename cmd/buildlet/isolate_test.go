@@ -0,0 +1,55 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExecIsolation(t *testing.T) {
+	for _, v := range []string{"docker", "docker:", "bogus:image"} {
+		if _, err := parseExecIsolation(v); err == nil {
+			t.Errorf("parseExecIsolation(%q) succeeded; want error", v)
+		}
+	}
+}
+
+func TestContainerIsolatorPrepare(t *testing.T) {
+	defer func(old string) { *workDir = old }(*workDir)
+	*workDir = "/workdir"
+
+	c := &containerIsolator{runtime: "/usr/bin/docker", image: "golang:buster"}
+	cmd := exec.Command("/workdir/go/src/make.bash", "-v")
+	cmd.Dir = "/workdir/go/src"
+	cmd.Env = []string{"GOOS=linux", "GOARCH=amd64"}
+	kill, err := c.prepare(cmd, execLimits{cpus: 1.5, memory: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kill == nil {
+		t.Error("prepare returned no kill func")
+	}
+	if cmd.Path != c.runtime || cmd.Env != nil {
+		t.Errorf("cmd.Path, cmd.Env = %q, %q; want %q, nil", cmd.Path, cmd.Env, c.runtime)
+	}
+	args := strings.Join(cmd.Args, " ")
+	for _, want := range []string{
+		"--volume /workdir:/workdir",
+		"--workdir /workdir/go/src",
+		"--env GOOS=linux --env GOARCH=amd64",
+		"--cpus 1.5",
+		"--memory 1073741824 --memory-swap 1073741824",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args %q don't contain %q", args, want)
+		}
+	}
+	if got, want := cmd.Args[len(cmd.Args)-3:], []string{"golang:buster", "/workdir/go/src/make.bash", "-v"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("args end with %q; want %q", got, want)
+	}
+}
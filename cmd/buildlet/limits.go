@@ -0,0 +1,80 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Per-command resource limits.
+//
+// An /exec request may limit the command's CPU use (form value
+// cpuLimit, in CPUs), memory use (memLimit, in bytes), and run time
+// (timeLimit, a Go duration). The run time limit is enforced
+// everywhere by killing the command; CPU and memory limits need a
+// platform procLimiter. A command stopped for exceeding a limit has
+// the hdrExitLimit trailer naming it.
+
+// hdrExitLimit is the HTTP trailer of an /exec response naming the
+// limit the command was stopped for exceeding, if any.
+const hdrExitLimit = "Process-Limit"
+
+// Names of limits in hdrExitLimit.
+const (
+	limitTime   = "time"
+	limitMemory = "memory"
+)
+
+// execLimits are the resource limits of a command. Zero values mean
+// no limit.
+type execLimits struct {
+	cpus    float64
+	memory  int64
+	timeout time.Duration
+}
+
+// parseExecLimits returns the limits requested by an /exec request.
+func parseExecLimits(r *http.Request) (execLimits, error) {
+	var l execLimits
+	var err error
+	if v := r.FormValue("cpuLimit"); v != "" {
+		if l.cpus, err = strconv.ParseFloat(v, 64); err != nil || l.cpus <= 0 {
+			return l, fmt.Errorf("bogus 'cpuLimit' parameter %q", v)
+		}
+	}
+	if v := r.FormValue("memLimit"); v != "" {
+		if l.memory, err = strconv.ParseInt(v, 10, 64); err != nil || l.memory <= 0 {
+			return l, fmt.Errorf("bogus 'memLimit' parameter %q", v)
+		}
+	}
+	if v := r.FormValue("timeLimit"); v != "" {
+		if l.timeout, err = time.ParseDuration(v); err != nil || l.timeout <= 0 {
+			return l, fmt.Errorf("bogus 'timeLimit' parameter %q", v)
+		}
+	}
+	return l, nil
+}
+
+// A procLimiter confines a command to its CPU and memory limits.
+type procLimiter interface {
+	// prepare configures the command before it is started.
+	prepare(cmd *exec.Cmd) error
+	// started confines the started command.
+	started(cmd *exec.Cmd) error
+	// exceeded returns the name of the limit the command was
+	// stopped for exceeding, or "" if none or unknown.
+	exceeded() string
+	// close kills any processes the command left behind, and
+	// releases the limiter's resources.
+	close() error
+}
+
+// newProcLimiter, if non-nil, returns a procLimiter for limits. It is
+// set by platforms supporting CPU and memory limits.
+var newProcLimiter func(limits execLimits) (procLimiter, error)
@@ -0,0 +1,164 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func init() {
+	newProcLimiter = newCgroupLimiter
+}
+
+var (
+	cgroupOnce sync.Once
+	cgroupDir  string // directory under which commands' cgroups are created
+	cgroupErr  error
+	cgroupSeq  int64
+)
+
+// initCgroups prepares the buildlet's cgroup v2 cgroup to hold a
+// cgroup per limited command. Since a cgroup holding processes can't
+// delegate controllers to children, the buildlet first moves itself
+// to a child, "buildlet".
+func initCgroups() {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		cgroupErr = err
+		return
+	}
+	var self string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			self = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if self == "" {
+		cgroupErr = errors.New("cgroup v2 is not in use")
+		return
+	}
+	dir := filepath.Join("/sys/fs/cgroup", filepath.FromSlash(self))
+	leaf := filepath.Join(dir, "buildlet")
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		cgroupErr = err
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		cgroupErr = err
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644); err != nil {
+		cgroupErr = fmt.Errorf("enabling cpu and memory controllers: %v", err)
+		return
+	}
+	cgroupDir = dir
+}
+
+// cgroupLimiter confines a command to a cgroup.
+type cgroupLimiter struct {
+	dir string
+	f   *os.File // dir, to start the command in
+}
+
+func newCgroupLimiter(limits execLimits) (procLimiter, error) {
+	cgroupOnce.Do(initCgroups)
+	if cgroupErr != nil {
+		return nil, fmt.Errorf("setting up cgroups: %v", cgroupErr)
+	}
+	cl := &cgroupLimiter{dir: filepath.Join(cgroupDir, fmt.Sprintf("exec-%d", atomic.AddInt64(&cgroupSeq, 1)))}
+	if err := os.Mkdir(cl.dir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if limits.memory > 0 {
+		err = cl.write("memory.max", strconv.FormatInt(limits.memory, 10))
+		// Don't let the command swap instead. Swap accounting
+		// may be disabled, so ignore errors.
+		cl.write("memory.swap.max", "0")
+	}
+	if limits.cpus > 0 && err == nil {
+		const period = 100000 // microseconds, the kernel's default
+		err = cl.write("cpu.max", fmt.Sprintf("%d %d", int64(limits.cpus*period), period))
+	}
+	if err == nil {
+		cl.f, err = os.Open(cl.dir)
+	}
+	if err != nil {
+		cl.close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (cl *cgroupLimiter) write(file, value string) error {
+	return ioutil.WriteFile(filepath.Join(cl.dir, file), []byte(value), 0644)
+}
+
+func (cl *cgroupLimiter) prepare(cmd *exec.Cmd) error {
+	// Start the command in the cgroup, so that no child it forks
+	// escapes it.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cl.f.Fd())
+	return nil
+}
+
+func (cl *cgroupLimiter) started(cmd *exec.Cmd) error { return nil }
+
+func (cl *cgroupLimiter) exceeded() string {
+	b, err := ioutil.ReadFile(filepath.Join(cl.dir, "memory.events"))
+	if err != nil {
+		return ""
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 2 && f[0] == "oom_kill" && f[1] != "0" {
+			return limitMemory
+		}
+	}
+	return ""
+}
+
+func (cl *cgroupLimiter) close() error {
+	if cl.f != nil {
+		cl.f.Close()
+	}
+	if err := cl.write("cgroup.kill", "1"); err != nil {
+		// Kernels before 5.14 lack cgroup.kill.
+		if b, err := ioutil.ReadFile(filepath.Join(cl.dir, "cgroup.procs")); err == nil {
+			for _, f := range strings.Fields(string(b)) {
+				if pid, err := strconv.Atoi(f); err == nil {
+					syscall.Kill(pid, syscall.SIGKILL)
+				}
+			}
+		}
+	}
+	// The cgroup can only be removed once the killed processes
+	// are gone.
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(cl.dir); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+func TestParseExecLimits(t *testing.T) {
+	for _, tt := range []struct {
+		form    string
+		want    execLimits
+		wantErr bool
+	}{
+		{"", execLimits{}, false},
+		{"cpuLimit=1.5&memLimit=1073741824&timeLimit=10m", execLimits{cpus: 1.5, memory: 1 << 30, timeout: 10 * time.Minute}, false},
+		{"cpuLimit=0", execLimits{}, true},
+		{"memLimit=1G", execLimits{}, true},
+		{"timeLimit=-1s", execLimits{}, true},
+	} {
+		r := httptest.NewRequest("POST", "/exec", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		got, err := parseExecLimits(r)
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("parseExecLimits(%q) = %+v, %v, wanted %+v, error: %t", tt.form, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExecTimeLimit(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("requires a Bourne shell")
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	old := *workDir
+	*workDir = t.TempDir()
+	defer func() { *workDir = old }()
+	ts := httptest.NewServer(http.HandlerFunc(handleExec))
+	defer ts.Close()
+	bc := buildlet.NewClient(strings.TrimPrefix(ts.URL, "http://"), buildlet.NoKeyPair)
+	defer bc.Close()
+
+	var got buildlet.ExitStatus
+	remoteErr, execErr := bc.Exec(context.Background(), sh, buildlet.ExecOpts{
+		SystemLevel: true,
+		Args:        []string{"-c", "exec sleep 30"},
+		Limits:      buildlet.ExecLimits{Timeout: 100 * time.Millisecond},
+		OnExit:      func(es buildlet.ExitStatus) { got = es },
+	})
+	if execErr != nil {
+		t.Fatalf("Exec() = _, %v", execErr)
+	}
+	if remoteErr == nil || !strings.Contains(remoteErr.Error(), "exceeded time limit") {
+		t.Errorf("Exec() = %v, _, wanted an error about the time limit", remoteErr)
+	}
+	if got.Limit != buildlet.LimitTime || got.Duration > 10*time.Second {
+		t.Errorf("Exec() exit status = %+v, wanted the time limit exceeded", got)
+	}
+}
+
+func TestExecBogusLimit(t *testing.T) {
+	old := *workDir
+	*workDir = t.TempDir()
+	defer func() { *workDir = old }()
+	ts := httptest.NewServer(http.HandlerFunc(handleExec))
+	defer ts.Close()
+	res, err := http.PostForm(ts.URL, url.Values{"cmd": {"true"}, "mode": {"sys"}, "memLimit": {"lots"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /exec with a bogus limit = %v, wanted %d", res.Status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// The job object functions are called through syscall rather than
+// golang.org/x/sys/windows, which doesn't yet build for windows/arm64.
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCreateJobObjectW         = modkernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = modkernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = modkernel32.NewProc("AssignProcessToJobObject")
+)
+
+const (
+	jobObjectExtendedLimitInformation  = 9
+	jobObjectCPURateControlInformation = 15
+
+	jobObjectLimitJobMemory        = 0x200
+	jobObjectLimitKillOnJobClose   = 0x2000
+	jobObjectCPURateControlEnable  = 0x1
+	jobObjectCPURateControlHardCap = 0x4
+
+	processSetQuota  = 0x100
+	processTerminate = 0x1
+)
+
+// jobExtendedLimitInformation is JOBOBJECT_EXTENDED_LIMIT_INFORMATION.
+type jobExtendedLimitInformation struct {
+	// JOBOBJECT_BASIC_LIMIT_INFORMATION:
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+	// C aligns the following IO_COUNTERS to 8 bytes, which Go
+	// doesn't do on 32-bit systems.
+	_ [8 - unsafe.Sizeof(uintptr(0))]byte
+
+	IoInfo                [6]uint64 // IO_COUNTERS
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// jobCPURateControl is JOBOBJECT_CPU_RATE_CONTROL_INFORMATION, with
+// the CpuRate member of its union.
+type jobCPURateControl struct {
+	ControlFlags uint32
+	CPURate      uint32 // in hundredths of a percent of all CPUs
+}
+
+func init() {
+	newProcLimiter = newJobLimiter
+}
+
+// jobLimiter confines a command to a job object.
+//
+// Unlike with cgroups, the command can only be assigned to the job
+// once it has started, so processes it creates right away may escape
+// the job. Windows also gives no reliable sign that the memory limit
+// was hit: allocations beyond it simply fail, so exceeded only
+// reports nothing.
+type jobLimiter struct {
+	job syscall.Handle
+}
+
+func newJobLimiter(limits execLimits) (procLimiter, error) {
+	r, _, err := procCreateJobObjectW.Call(0, 0)
+	if r == 0 {
+		return nil, err
+	}
+	jl := &jobLimiter{job: syscall.Handle(r)}
+	var info jobExtendedLimitInformation
+	info.LimitFlags = jobObjectLimitKillOnJobClose
+	if limits.memory > 0 {
+		info.LimitFlags |= jobObjectLimitJobMemory
+		info.JobMemoryLimit = uintptr(limits.memory)
+	}
+	if err := jl.setInformation(jobObjectExtendedLimitInformation, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil {
+		jl.close()
+		return nil, err
+	}
+	if limits.cpus > 0 {
+		rate := int(limits.cpus / float64(runtime.NumCPU()) * 10000)
+		if rate < 1 {
+			rate = 1
+		} else if rate > 10000 {
+			rate = 10000
+		}
+		cpu := jobCPURateControl{
+			ControlFlags: jobObjectCPURateControlEnable | jobObjectCPURateControlHardCap,
+			CPURate:      uint32(rate),
+		}
+		if err := jl.setInformation(jobObjectCPURateControlInformation, unsafe.Pointer(&cpu), unsafe.Sizeof(cpu)); err != nil {
+			jl.close()
+			return nil, err
+		}
+	}
+	return jl, nil
+}
+
+func (jl *jobLimiter) setInformation(class uint32, info unsafe.Pointer, size uintptr) error {
+	r, _, err := procSetInformationJobObject.Call(uintptr(jl.job), uintptr(class), uintptr(info), size)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (jl *jobLimiter) prepare(cmd *exec.Cmd) error { return nil }
+
+func (jl *jobLimiter) started(cmd *exec.Cmd) error {
+	h, err := syscall.OpenProcess(processSetQuota|processTerminate, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+	r, _, err := procAssignProcessToJobObject.Call(uintptr(jl.job), uintptr(h))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (jl *jobLimiter) exceeded() string { return "" }
+
+func (jl *jobLimiter) close() error {
+	// jobObjectLimitKillOnJobClose kills what's left.
+	return syscall.CloseHandle(jl.job)
+}
@@ -0,0 +1,30 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	longPath = longPathWindows
+}
+
+// longPathWindows returns the absolute path p with the \\?\ prefix,
+// which lifts the MAX_PATH limit, and UNC paths (\\server\share\...)
+// as \\?\UNC\server\share\.... Windows doesn't normalize prefixed
+// paths, so p is cleaned first. Relative paths and paths already
+// using a device prefix are returned unchanged.
+func longPathWindows(p string) string {
+	if !filepath.IsAbs(p) || strings.HasPrefix(p, `\\?\`) || strings.HasPrefix(p, `\\.\`) {
+		return p
+	}
+	p = filepath.Clean(p)
+	if strings.HasPrefix(p, `\\`) {
+		return `\\?\UNC\` + p[len(`\\`):]
+	}
+	return `\\?\` + p
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLongPathWindows(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{`C:\workdir\go`, `\\?\C:\workdir\go`},
+		{`C:/workdir/x/../go`, `\\?\C:\workdir\go`},
+		{`\\server\share\workdir`, `\\?\UNC\server\share\workdir`},
+		{`\\?\C:\workdir`, `\\?\C:\workdir`},
+		{`\\.\pipe\x`, `\\.\pipe\x`},
+		{`workdir\go`, `workdir\go`},
+	} {
+		if got := longPathWindows(tt.in); got != tt.want {
+			t.Errorf("longPathWindows(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveAllLongPath(t *testing.T) {
+	dir := t.TempDir()
+	deep := dir
+	for len(deep) < 400 {
+		deep = filepath.Join(deep, strings.Repeat("d", 50))
+	}
+	if err := os.MkdirAll(longPath(deep), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(longPath(filepath.Join(deep, "f")), []byte("x"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeAllIncludingReadonly(filepath.Join(dir, strings.Repeat("d", 50))); err != nil {
+		t.Fatalf("removeAllIncludingReadonly: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/build/buildlet"
+)
+
+func TestListDirGlob(t *testing.T) {
+	old := *workDir
+	*workDir = t.TempDir()
+	defer func() { *workDir = old }()
+	for _, name := range []string{"a.log", "b.txt", "x/c.log", "x/y/d.log"} {
+		p := filepath.Join(*workDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handleLs))
+	defer ts.Close()
+	bc := buildlet.NewClient(strings.TrimPrefix(ts.URL, "http://"), buildlet.NoKeyPair)
+	defer bc.Close()
+
+	for _, tt := range []struct {
+		opts buildlet.ListDirOpts
+		want []string
+	}{
+		{buildlet.ListDirOpts{Recursive: true, Glob: []string{"*.log"}}, []string{"a.log", "x/c.log", "x/y/d.log"}},
+		{buildlet.ListDirOpts{Recursive: true, MaxDepth: 2}, []string{"a.log", "b.txt", "x/", "x/c.log", "x/y/"}},
+		{buildlet.ListDirOpts{Recursive: true, Glob: []string{"x/*"}}, []string{"x/c.log", "x/y/"}},
+		{buildlet.ListDirOpts{Glob: []string{"*.txt"}}, []string{"b.txt"}},
+	} {
+		var got []string
+		err := bc.ListDir(context.Background(), ".", tt.opts, func(de buildlet.DirEntry) {
+			got = append(got, de.Name())
+			if !de.IsDir() && de.Size() != int64(len(de.Name())) {
+				t.Errorf("%s: Size() = %d, wanted %d", de.Name(), de.Size(), len(de.Name()))
+			}
+			if !de.IsDir() && de.ModTime().IsZero() {
+				t.Errorf("%s: ModTime() is zero", de.Name())
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ListDir(%+v) = %q, wanted %q", tt.opts, got, tt.want)
+		}
+	}
+}
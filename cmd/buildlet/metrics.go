@@ -0,0 +1,146 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// heartbeatInterval is how often a reverse buildlet sends the
+// coordinator its host metrics.
+var heartbeatInterval = 30 * time.Second
+
+// Host metrics sources, set non-nil by platforms that can measure
+// them.
+var (
+	// loadAverage returns the 1, 5, and 15 minute load average.
+	loadAverage func() ([3]float64, error)
+	// diskSpace returns the bytes available and in total on the
+	// filesystem holding dir.
+	diskSpace func(dir string) (free, total int64, err error)
+	// hostTemperature returns the highest temperature of the
+	// host's thermal sensors, in degrees Celsius.
+	hostTemperature func() (float64, error)
+	// cpuThrottleCount returns how many times the CPUs have been
+	// throttled since boot.
+	cpuThrottleCount func() (int64, error)
+)
+
+// lastThrottleCount is the cpuThrottleCount of the previous
+// collectHostMetrics, or -1.
+var lastThrottleCount int64 = -1
+
+// collectHostMetrics measures what it can of the host's health.
+// It's only called by one goroutine at a time.
+func collectHostMetrics() buildlet.HostMetrics {
+	m := buildlet.HostMetrics{
+		Time:   time.Now(),
+		NumCPU: runtime.NumCPU(),
+	}
+	if loadAverage != nil {
+		if v, err := loadAverage(); err == nil {
+			m.LoadAvg = v
+		}
+	}
+	if diskSpace != nil {
+		if free, total, err := diskSpace(*workDir); err == nil {
+			m.DiskFree, m.DiskTotal = free, total
+		}
+	}
+	if hostTemperature != nil {
+		if v, err := hostTemperature(); err == nil {
+			m.Temperature = v
+		}
+	}
+	if cpuThrottleCount != nil {
+		if n, err := cpuThrottleCount(); err == nil {
+			m.Throttled = lastThrottleCount >= 0 && n > lastThrottleCount
+			lastThrottleCount = n
+		}
+	}
+	return m
+}
+
+// sendHeartbeats sends the coordinator at addr the host metrics
+// every heartbeatInterval, forever.
+func sendHeartbeats(addr string) {
+	c := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialCoordinatorTCP(ctx, addr)
+			},
+			TLSClientConfig: &tls.Config{
+				ServerName:         strings.TrimSuffix(addr, ":443"),
+				InsecureSkipVerify: isDevReverseMode(),
+			},
+		},
+	}
+	for {
+		if err := sendHeartbeat(c, "https://"+addr+"/reverse/heartbeat"); err != nil {
+			log.Printf("Sending heartbeat to coordinator: %v", err)
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+func sendHeartbeat(c *http.Client, url string) error {
+	body, err := json.Marshal(collectHostMetrics())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Go-Host-Type", *reverseType)
+	req.Header.Set("X-Go-Builder-Key", reverseKey)
+	req.Header.Set("X-Go-Builder-Hostname", *hostname)
+	req.Header.Set("X-Go-Builder-Session", reverseSession)
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// A coordinator predating heartbeats says 404, as does one we
+	// aren't registered with (yet); neither is worth logging.
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// parseLoadAvg parses the first three fields of /proc/loadavg and
+// similar formats.
+func parseLoadAvg(s string) ([3]float64, error) {
+	var v [3]float64
+	f := strings.Fields(s)
+	if len(f) < 3 {
+		return v, fmt.Errorf("malformed load average %q", s)
+	}
+	for i := range v {
+		var err error
+		if v[i], err = strconv.ParseFloat(f[i], 64); err != nil {
+			return v, fmt.Errorf("malformed load average %q", s)
+		}
+	}
+	return v, nil
+}
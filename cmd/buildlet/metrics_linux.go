@@ -0,0 +1,87 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	loadAverage = loadAverageLinux
+	diskSpace = diskSpaceLinux
+	hostTemperature = hostTemperatureLinux
+	cpuThrottleCount = cpuThrottleCountLinux
+}
+
+func loadAverageLinux() ([3]float64, error) {
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return [3]float64{}, err
+	}
+	return parseLoadAvg(string(b))
+}
+
+func diskSpaceLinux(dir string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
+
+// hostTemperatureLinux reads the thermal zones, in millidegrees
+// Celsius.
+func hostTemperatureLinux() (float64, error) {
+	files, _ := filepath.Glob("/sys/class/thermal/thermal_zone*/temp")
+	if len(files) == 0 {
+		return 0, errors.New("no thermal zones")
+	}
+	var max int64
+	var found bool
+	for _, f := range files {
+		n, err := readInt(f)
+		if err != nil {
+			continue
+		}
+		if !found || n > max {
+			max, found = n, true
+		}
+	}
+	if !found {
+		return 0, errors.New("no readable thermal zones")
+	}
+	return float64(max) / 1000, nil
+}
+
+// cpuThrottleCountLinux sums the x86 per-CPU thermal throttling
+// counts.
+func cpuThrottleCountLinux() (int64, error) {
+	files, _ := filepath.Glob("/sys/devices/system/cpu/cpu*/thermal_throttle/core_throttle_count")
+	if len(files) == 0 {
+		return 0, errors.New("no CPU throttle counts")
+	}
+	var sum int64
+	for _, f := range files {
+		n, err := readInt(f)
+		if err != nil {
+			return 0, err
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+func readInt(file string) (int64, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
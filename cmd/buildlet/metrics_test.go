@@ -0,0 +1,63 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"golang.org/x/build/buildlet"
+)
+
+func TestParseLoadAvg(t *testing.T) {
+	got, err := parseLoadAvg("0.52 1.25 2.00 3/512 12345\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [3]float64{0.52, 1.25, 2}; got != want {
+		t.Errorf("parseLoadAvg = %v; want %v", got, want)
+	}
+	for _, bad := range []string{"", "1 2", "1 x 3"} {
+		if _, err := parseLoadAvg(bad); err == nil {
+			t.Errorf("parseLoadAvg(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	defer func(old string) { *workDir = old }(*workDir)
+	*workDir = t.TempDir()
+	defer func(old string) { reverseKey = old }(reverseKey)
+	reverseKey = "secret"
+
+	var got buildlet.HostMetrics
+	var key, session string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = r.Header.Get("X-Go-Builder-Key")
+		session = r.Header.Get("X-Go-Builder-Session")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	if err := sendHeartbeat(ts.Client(), ts.URL+"/reverse/heartbeat"); err != nil {
+		t.Fatal(err)
+	}
+	if key != "secret" || session != reverseSession {
+		t.Errorf("heartbeat key, session = %q, %q; want %q, %q", key, session, "secret", reverseSession)
+	}
+	if got.NumCPU != runtime.NumCPU() || got.Time.IsZero() {
+		t.Errorf("heartbeat metrics = %+v; want NumCPU %d and a time", got, runtime.NumCPU())
+	}
+	if runtime.GOOS == "linux" && got.DiskTotal == 0 {
+		t.Errorf("heartbeat metrics = %+v; want the workdir's disk space", got)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Workdir quota.
+//
+// With -workdir-quota, the buildlet periodically measures its work
+// directory and, when it's larger than the quota, removes the least
+// recently modified top-level directories ("build roots", like the
+// go directory of one build) until it fits again. Roots that a
+// running command is using or that were modified recently are never
+// removed, so a single build bigger than the quota keeps running;
+// the buildlet only logs that it's still over.
+
+var (
+	// workdirGCInterval is how often the work directory is
+	// measured.
+	workdirGCInterval = time.Minute
+	// workdirGCMinAge is how long a build root must go without
+	// changes before it may be removed.
+	workdirGCMinAge = 30 * time.Minute
+)
+
+// workdirUsage is the size of the work directory in bytes, as last
+// measured by gcWorkdir.
+var workdirUsage int64
+
+// workdirRootsMu guards workdirRootsInUse.
+var workdirRootsMu sync.Mutex
+
+// workdirRootsInUse counts the running commands in each build root,
+// by name.
+var workdirRootsInUse = map[string]int{}
+
+// workdirRoot returns the build root containing the absolute path
+// p, or "" if p isn't within a build root of the work directory.
+func workdirRoot(p string) string {
+	rel, err := filepath.Rel(*workDir, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+}
+
+// useWorkdirRoot marks the build root containing dir as in use by a
+// command, until the returned func is called.
+func useWorkdirRoot(dir string) (done func()) {
+	root := workdirRoot(dir)
+	if root == "" {
+		return func() {}
+	}
+	workdirRootsMu.Lock()
+	workdirRootsInUse[root]++
+	workdirRootsMu.Unlock()
+	return func() {
+		workdirRootsMu.Lock()
+		defer workdirRootsMu.Unlock()
+		if workdirRootsInUse[root]--; workdirRootsInUse[root] == 0 {
+			delete(workdirRootsInUse, root)
+		}
+	}
+}
+
+func workdirRootInUse(root string) bool {
+	workdirRootsMu.Lock()
+	defer workdirRootsMu.Unlock()
+	return workdirRootsInUse[root] > 0
+}
+
+// buildRoot is a top-level entry of the work directory.
+type buildRoot struct {
+	name    string
+	size    int64
+	modTime time.Time // of the most recently modified file within
+}
+
+// measureWorkdir returns the build roots of the work directory.
+func measureWorkdir() ([]buildRoot, error) {
+	fis, err := ioutil.ReadDir(*workDir)
+	if err != nil {
+		return nil, err
+	}
+	var roots []buildRoot
+	for _, fi := range fis {
+		br := buildRoot{name: fi.Name()}
+		filepath.Walk(longPath(filepath.Join(*workDir, fi.Name())), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				// Removed while we walk, or unreadable;
+				// either way, not something we can measure.
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				br.size += fi.Size()
+			}
+			if fi.ModTime().After(br.modTime) {
+				br.modTime = fi.ModTime()
+			}
+			return nil
+		})
+		roots = append(roots, br)
+	}
+	return roots, nil
+}
+
+// gcWorkdir measures the work directory and, if it's larger than
+// quota bytes, removes the oldest build roots that may be removed
+// until it isn't. It returns the resulting size of the work
+// directory.
+func gcWorkdir(quota int64) (int64, error) {
+	roots, err := measureWorkdir()
+	if err != nil {
+		return 0, err
+	}
+	var usage int64
+	for _, br := range roots {
+		usage += br.size
+	}
+	if usage <= quota {
+		return usage, nil
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].modTime.Before(roots[j].modTime) })
+	minAge := time.Now().Add(-workdirGCMinAge)
+	for _, br := range roots {
+		if usage <= quota {
+			break
+		}
+		if br.modTime.After(minAge) || workdirRootInUse(br.name) {
+			continue
+		}
+		log.Printf("workdir is %d bytes, over its quota of %d; removing %s (%d bytes, last modified %v)",
+			usage, quota, br.name, br.size, br.modTime.Format(time.RFC3339))
+		if err := removeAllIncludingReadonly(filepath.Join(*workDir, br.name)); err != nil {
+			log.Printf("removing %s: %v", br.name, err)
+			continue
+		}
+		usage -= br.size
+	}
+	if usage > quota {
+		log.Printf("workdir is %d bytes, still over its quota of %d, with no build roots left to remove", usage, quota)
+	}
+	return usage, nil
+}
+
+// enforceWorkdirQuota runs gcWorkdir every workdirGCInterval,
+// forever.
+func enforceWorkdirQuota(quota int64) {
+	for {
+		usage, err := gcWorkdir(quota)
+		if err != nil {
+			log.Printf("measuring workdir: %v", err)
+		} else {
+			atomic.StoreInt64(&workdirUsage, usage)
+		}
+		time.Sleep(workdirGCInterval)
+	}
+}
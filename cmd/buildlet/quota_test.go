@@ -0,0 +1,106 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestGCWorkdir(t *testing.T) {
+	defer func(old string) { *workDir = old }(*workDir)
+	*workDir = t.TempDir()
+
+	now := time.Now()
+	for _, root := range []struct {
+		name string
+		age  time.Duration
+	}{
+		{"oldest", 3 * time.Hour},
+		{"busy", 2 * time.Hour},
+		{"old", time.Hour},
+		{"new", time.Minute},
+	} {
+		dir := filepath.Join(*workDir, root.name, "src")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, "data")
+		if err := ioutil.WriteFile(file, make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-root.age)
+		for _, p := range []string{file, dir, filepath.Dir(dir)} {
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	done := useWorkdirRoot(filepath.Join(*workDir, "busy", "src"))
+
+	// Over a quota of 2500 bytes, "oldest" goes first, "busy" is
+	// in use, and removing "old" then fits.
+	usage, err := gcWorkdir(2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != 2000 {
+		t.Errorf("usage = %d; want 2000", usage)
+	}
+	if got, want := workdirEntries(t), []string{"busy", "new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after GC, workdir has %q; want %q", got, want)
+	}
+
+	// Recently modified roots stay even if still over quota.
+	done()
+	usage, err = gcWorkdir(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != 1000 {
+		t.Errorf("usage = %d; want 1000", usage)
+	}
+	if got, want := workdirEntries(t), []string{"new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after second GC, workdir has %q; want %q", got, want)
+	}
+}
+
+func workdirEntries(t *testing.T) []string {
+	t.Helper()
+	f, err := os.Open(*workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWorkdirRoot(t *testing.T) {
+	defer func(old string) { *workDir = old }(*workDir)
+	*workDir = filepath.FromSlash("/workdir")
+	for p, want := range map[string]string{
+		"/workdir":              "",
+		"/workdir/go":           "go",
+		"/workdir/go/src/cmd":   "go",
+		"/workdir/../tmp":       "",
+		"/tmp":                  "",
+		"/workdir-snapshots/x":  "",
+		"/workdir/gocache/ab/c": "gocache",
+	} {
+		if got := workdirRoot(filepath.FromSlash(p)); got != want {
+			t.Errorf("workdirRoot(%q) = %q; want %q", p, got, want)
+		}
+	}
+}
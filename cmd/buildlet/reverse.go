@@ -9,6 +9,7 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -22,8 +23,10 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/build/buildlet"
 	"golang.org/x/build/revdial/v2"
 )
 
@@ -40,6 +43,15 @@ func keyForMode(mode string) (string, error) {
 		}
 		return key, nil
 	}
+	if os.Getenv("GO_BUILDER_ENV") == "qemu_vm" {
+		// runqemubuildlet passes the key as a fw_cfg blob, which
+		// Linux guests can read from sysfs. Other guests fall back
+		// to a key file, copied by a startup script from the
+		// provisioning ISO.
+		if key, err := ioutil.ReadFile(qemuFwCfgPath("key-" + mode)); err == nil {
+			return strings.TrimSpace(string(key)), nil
+		}
+	}
 	keyPath := filepath.Join(homedir(), ".gobuildkey-"+mode)
 	if v := os.Getenv("GO_BUILD_KEY_PATH"); v != "" {
 		keyPath = v
@@ -56,6 +68,12 @@ func keyForMode(mode string) (string, error) {
 	return strings.TrimSpace(string(key)), nil
 }
 
+// qemuFwCfgPath returns the sysfs path of the QEMU fw_cfg blob
+// provisioned by runqemubuildlet with the given name.
+func qemuFwCfgPath(name string) string {
+	return "/sys/firmware/qemu_fw_cfg/by_name/opt/org.golang.build/" + name + "/raw"
+}
+
 func isDevReverseMode() bool {
 	return !strings.HasPrefix(*coordinator, "farmer.golang.org")
 }
@@ -73,15 +91,9 @@ func dialCoordinator() error {
 		}
 	}
 
-	key, err := keyForMode(*reverseType)
-	if err != nil {
-		log.Fatalf("failed to find key for %s: %v", *reverseType, err)
-	}
+	loadReverseKey()
 
-	addr := *coordinator
-	if addr == "farmer.golang.org" {
-		addr = "farmer.golang.org:443"
-	}
+	addr := coordinatorAddr()
 
 	dial := func(ctx context.Context) (net.Conn, error) {
 		log.Printf("Dialing coordinator %s ...", addr)
@@ -120,10 +132,17 @@ func dialCoordinator() error {
 		log.Fatal(err)
 	}
 	req.Header.Set("X-Go-Host-Type", *reverseType)
-	req.Header.Set("X-Go-Builder-Key", key)
+	req.Header.Set("X-Go-Builder-Key", reverseKey)
 	req.Header.Set("X-Go-Builder-Hostname", *hostname)
 	req.Header.Set("X-Go-Builder-Version", strconv.Itoa(buildletVersion))
 	req.Header.Set("X-Revdial-Version", "2")
+	req.Header.Set("X-Go-Builder-Session", reverseSession)
+	if labels, _ := buildlet.ParseLabels(*reverseLabels); len(labels) > 0 {
+		req.Header.Set("X-Go-Builder-Labels", buildlet.FormatLabels(labels))
+	}
+	if *reverseMaxSessions > 0 {
+		req.Header.Set("X-Go-Builder-Max-Sessions", strconv.Itoa(*reverseMaxSessions))
+	}
 	if err := req.Write(bufw); err != nil {
 		return fmt.Errorf("coordinator /reverse request failed: %v", err)
 	}
@@ -140,15 +159,86 @@ func dialCoordinator() error {
 	}
 
 	log.Printf("Connected to coordinator; reverse dialing active")
+	lastReverseContact = time.Now()
+	startHeartbeats.Do(func() { go sendHeartbeats(addr) })
 	srv := &http.Server{}
+	configureHTTP2(srv)
 	ln := revdial.NewListener(conn, dial)
 	err = srv.Serve(ln)
+	lastReverseContact = time.Now()
 	if ln.Closed() { // TODO: this actually wants to know whether an error-free Close was called
 		return nil
 	}
 	return fmt.Errorf("http.Serve on reverse connection complete: %v", err)
 }
 
+// reverseKey is the build key the buildlet registers with. It's only
+// read once, since keyForMode may delete it.
+var reverseKey string
+
+// loadReverseKey sets reverseKey, unless it's already set.
+func loadReverseKey() {
+	if reverseKey != "" {
+		return
+	}
+	key, err := keyForMode(*reverseType)
+	if err != nil {
+		log.Fatalf("failed to find key for %s: %v", *reverseType, err)
+	}
+	reverseKey = key
+}
+
+// startHeartbeats starts sendHeartbeats once registered.
+var startHeartbeats sync.Once
+
+// coordinatorAddr returns the host:port of the coordinator.
+func coordinatorAddr() string {
+	if *coordinator == "farmer.golang.org" {
+		return "farmer.golang.org:443"
+	}
+	return *coordinator
+}
+
+// reverseSession identifies this buildlet process to the coordinator,
+// so that the coordinator can tell a buildlet reconnecting after a
+// dropped connection from a new one.
+var reverseSession = newReverseSession()
+
+func newReverseSession() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatal(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// lastReverseContact is when the buildlet last registered with the
+// coordinator, or lost its connection to it.
+var lastReverseContact time.Time
+
+// reverseRedialDelay is how long to wait before redialing the
+// coordinator after losing the connection to it.
+const reverseRedialDelay = 2 * time.Second
+
+// serveReverse serves the coordinator over reverse connections. If
+// the connection to the coordinator drops, it redials for up to
+// *reverseResume, registering with the same session so that the
+// coordinator keeps using this buildlet. Commands that are running
+// keep running: they are served over their own connections.
+//
+// Once registered, the buildlet also sends the coordinator its host
+// metrics every heartbeatInterval.
+func serveReverse() error {
+	for {
+		err := dialCoordinator()
+		if err == nil || lastReverseContact.IsZero() || time.Since(lastReverseContact) > *reverseResume {
+			return err
+		}
+		log.Printf("Lost the coordinator connection: %v; redialing to resume session %s", err, reverseSession)
+		time.Sleep(reverseRedialDelay)
+	}
+}
+
 var coordDialer = &net.Dialer{
 	Timeout:   10 * time.Second,
 	KeepAlive: 15 * time.Second,
@@ -0,0 +1,392 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The service functions are called through syscall rather than
+// golang.org/x/sys/windows/svc, which doesn't yet build for
+// windows/arm64, the buildlet run in the qemu guests.
+var (
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManagerW                = modadvapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW                = modadvapi32.NewProc("CreateServiceW")
+	procOpenServiceW                  = modadvapi32.NewProc("OpenServiceW")
+	procStartServiceW                 = modadvapi32.NewProc("StartServiceW")
+	procControlService                = modadvapi32.NewProc("ControlService")
+	procDeleteService                 = modadvapi32.NewProc("DeleteService")
+	procCloseServiceHandle            = modadvapi32.NewProc("CloseServiceHandle")
+	procChangeServiceConfig2W         = modadvapi32.NewProc("ChangeServiceConfig2W")
+	procStartServiceCtrlDispatcherW   = modadvapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = modadvapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = modadvapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW          = modadvapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                  = modadvapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW               = modadvapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW                = modadvapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW                 = modadvapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	scManagerAllAccess = 0xf003f
+	serviceAllAccess   = 0xf01ff
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceConfigDescription    = 1
+	serviceConfigFailureActions = 2
+	scActionRestart             = 1
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceAcceptStop         = 0x1
+	serviceAcceptShutdown     = 0x4
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	errorCallNotImplemented = syscall.Errno(120)
+	errorServiceNotActive   = syscall.Errno(1062)
+	errorServiceExists      = syscall.Errno(1073)
+
+	eventlogInformationType = 4
+)
+
+const (
+	serviceName        = "buildlet"
+	serviceDisplayName = "Go buildlet"
+	serviceDescription = "Runs builds and tests for the Go build system (golang.org/x/build/cmd/buildlet)."
+
+	// eventSourceKey registers serviceName as an event log source.
+	eventSourceKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + serviceName
+	// eventMessageFile has a message for event IDs 1 to 1000 that
+	// only repeats the logged string, saving us shipping our own
+	// message resources.
+	eventMessageFile = `%SystemRoot%\System32\EventCreate.exe`
+	eventID          = 1
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+// serviceFailureActions is SERVICE_FAILURE_ACTIONSW.
+type serviceFailureActions struct {
+	ResetPeriod  uint32
+	RebootMsg    *uint16
+	Command      *uint16
+	ActionsCount uint32
+	Actions      *scAction
+}
+
+// scAction is SC_ACTION.
+type scAction struct {
+	Type  uint32
+	Delay uint32 // in milliseconds
+}
+
+func init() {
+	serviceCommand = serviceCommandWindows
+}
+
+// serviceCommandWindows implements the -service flag.
+func serviceCommandWindows(mode string) {
+	switch mode {
+	case "install":
+		if err := installService(); err != nil {
+			log.Fatalf("installing %s service: %v", serviceName, err)
+		}
+		log.Printf("installed and started %s service.", serviceName)
+		os.Exit(0)
+	case "uninstall":
+		if err := uninstallService(); err != nil {
+			log.Fatalf("uninstalling %s service: %v", serviceName, err)
+		}
+		log.Printf("uninstalled %s service.", serviceName)
+		os.Exit(0)
+	case "run":
+		if err := runService(); err != nil {
+			log.Fatalf("running as %s service: %v", serviceName, err)
+		}
+	default:
+		log.Fatalf(`unknown -service value %q; want "install", "uninstall", or "run"`, mode)
+	}
+}
+
+// serviceArgs returns the command line that the service control
+// manager runs: this executable, with the flags set on our own
+// command line but with -service=run.
+func serviceArgs() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	args := []string{syscall.EscapeArg(exe)}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "service" {
+			args = append(args, syscall.EscapeArg("-"+f.Name+"="+f.Value.String()))
+		}
+	})
+	args = append(args, "-service=run")
+	return strings.Join(args, " "), nil
+}
+
+// installService registers the buildlet as a service that starts
+// with the system as LocalSystem, and starts it.
+//
+// The service is restarted whenever the buildlet exits without
+// being stopped, as it does after a build in reverse mode when -halt
+// is false, similar to how stage0 runs the buildlet in a loop.
+func installService() error {
+	cmdLine, err := serviceArgs()
+	if err != nil {
+		return err
+	}
+	m, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(m)
+
+	name := syscall.StringToUTF16Ptr(serviceName)
+	displayName := syscall.StringToUTF16Ptr(serviceDisplayName)
+	binaryPath := syscall.StringToUTF16Ptr(cmdLine)
+	r, _, err := procCreateServiceW.Call(m,
+		uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(displayName)),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(binaryPath)),
+		0, 0, 0, 0, 0) // no load order group, tag, dependencies, or account (LocalSystem)
+	if r == 0 {
+		if err == errorServiceExists {
+			return errors.New("service already exists; use -service=uninstall first")
+		}
+		return fmt.Errorf("CreateService: %v", err)
+	}
+	s := r
+	defer closeServiceHandle(s)
+
+	desc := syscall.StringToUTF16Ptr(serviceDescription)
+	if r, _, err := procChangeServiceConfig2W.Call(s, serviceConfigDescription, uintptr(unsafe.Pointer(&desc))); r == 0 {
+		return fmt.Errorf("setting service description: %v", err)
+	}
+	restart := scAction{Type: scActionRestart, Delay: 5000}
+	actions := serviceFailureActions{
+		ResetPeriod:  24 * 60 * 60,
+		ActionsCount: 1,
+		Actions:      &restart,
+	}
+	if r, _, err := procChangeServiceConfig2W.Call(s, serviceConfigFailureActions, uintptr(unsafe.Pointer(&actions))); r == 0 {
+		return fmt.Errorf("setting service recovery actions: %v", err)
+	}
+	if err := installEventSource(); err != nil {
+		return fmt.Errorf("registering event log source: %v", err)
+	}
+	if r, _, err := procStartServiceW.Call(s, 0, 0); r == 0 {
+		return fmt.Errorf("StartService: %v", err)
+	}
+	return nil
+}
+
+// uninstallService stops the buildlet service, if it's running,
+// and removes it.
+func uninstallService() error {
+	m, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(m)
+
+	r, _, err := procOpenServiceW.Call(m, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(serviceName))), serviceAllAccess)
+	if r == 0 {
+		return fmt.Errorf("OpenService: %v", err)
+	}
+	s := r
+	defer closeServiceHandle(s)
+
+	var st serviceStatus
+	if r, _, err := procControlService.Call(s, serviceControlStop, uintptr(unsafe.Pointer(&st))); r == 0 && err != errorServiceNotActive {
+		return fmt.Errorf("stopping service: %v", err)
+	}
+	if r, _, err := procDeleteService.Call(s); r == 0 {
+		return fmt.Errorf("DeleteService: %v", err)
+	}
+	key := syscall.StringToUTF16Ptr(eventSourceKey)
+	if r, _, _ := procRegDeleteKeyW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(key))); r != 0 {
+		log.Printf("removing event log source: %v", syscall.Errno(r))
+	}
+	return nil
+}
+
+func openSCManager() (uintptr, error) {
+	r, _, err := procOpenSCManagerW.Call(0, 0, scManagerAllAccess)
+	if r == 0 {
+		return 0, fmt.Errorf("OpenSCManager: %v", err)
+	}
+	return r, nil
+}
+
+func closeServiceHandle(h uintptr) {
+	procCloseServiceHandle.Call(h)
+}
+
+// installEventSource registers serviceName as an event log source,
+// so the event viewer shows what the buildlet logs.
+func installEventSource() error {
+	var key syscall.Handle
+	var disposition uint32
+	r, _, _ := procRegCreateKeyExW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(eventSourceKey))),
+		0, 0, 0, syscall.KEY_WRITE, 0,
+		uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(&disposition)))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+
+	file := syscall.StringToUTF16(eventMessageFile)
+	if err := regSetValue(key, "EventMessageFile", syscall.REG_EXPAND_SZ, unsafe.Pointer(&file[0]), uintptr(len(file)*2)); err != nil {
+		return err
+	}
+	types := uint32(7) // error, warning, and information
+	return regSetValue(key, "TypesSupported", syscall.REG_DWORD, unsafe.Pointer(&types), unsafe.Sizeof(types))
+}
+
+func regSetValue(key syscall.Handle, name string, typ uint32, data unsafe.Pointer, size uintptr) error {
+	r, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))), 0, uintptr(typ), uintptr(data), size)
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+var (
+	// serviceStatusHandle is the SERVICE_STATUS_HANDLE of the
+	// running service.
+	serviceStatusHandle uintptr
+	// serviceStarted receives the result of the service
+	// starting.
+	serviceStarted = make(chan error, 1)
+)
+
+// runService connects to the service control manager and reports the
+// buildlet as running, sending what it logs to the event log. It
+// returns once the service has started, leaving main to run the
+// buildlet as usual.
+func runService() error {
+	h, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(serviceName))))
+	if h == 0 {
+		return fmt.Errorf("RegisterEventSource: %v", err)
+	}
+	log.SetOutput(io.MultiWriter(log.Writer(), eventLogWriter{h}))
+
+	go func() {
+		// StartServiceCtrlDispatcher only returns once the
+		// service has stopped, which the buildlet doesn't wait
+		// for: it exits as soon as it has reported stopping.
+		runtime.LockOSThread()
+		table := []serviceTableEntry{
+			{ServiceName: syscall.StringToUTF16Ptr(serviceName), ServiceProc: syscall.NewCallback(serviceMain)},
+			{},
+		}
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			serviceStarted <- fmt.Errorf("StartServiceCtrlDispatcher: %v", err)
+		}
+	}()
+	return <-serviceStarted
+}
+
+// serviceMain is the ServiceMain function of the buildlet service,
+// called by the service control manager on a thread of its own.
+func serviceMain(argc, argv uintptr) uintptr {
+	h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(serviceName))), syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		serviceStarted <- fmt.Errorf("RegisterServiceCtrlHandlerEx: %v", err)
+		return 0
+	}
+	serviceStatusHandle = h
+	setServiceState(serviceRunning)
+	serviceStarted <- nil
+	select {} // until the buildlet exits
+}
+
+// serviceHandler is the HandlerEx function of the buildlet service.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceState(serviceStopPending)
+		log.Printf("stopping %s service.", serviceName)
+		// Report stopped before exiting so the service control
+		// manager doesn't take this as a failure and restart
+		// us.
+		setServiceState(serviceStopped)
+		os.Exit(0)
+	case serviceControlInterrogate:
+		setServiceState(serviceRunning)
+	default:
+		return uintptr(errorCallNotImplemented)
+	}
+	return 0
+}
+
+func setServiceState(state uint32) {
+	st := serviceStatus{
+		ServiceType:  serviceWin32OwnProcess,
+		CurrentState: state,
+	}
+	if state == serviceRunning {
+		st.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	if r, _, err := procSetServiceStatus.Call(serviceStatusHandle, uintptr(unsafe.Pointer(&st))); r == 0 {
+		log.Printf("SetServiceStatus: %v", err)
+	}
+}
+
+// eventLogWriter writes each log line as an event in the Application
+// event log.
+type eventLogWriter struct {
+	h uintptr // from RegisterEventSource
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(strings.Replace(string(p), "\x00", `\x00`, -1), "\n")
+	s, err := syscall.UTF16PtrFromString(msg)
+	if err != nil {
+		return 0, err
+	}
+	r, _, err := procReportEventW.Call(w.h, eventlogInformationType, 0, eventID, 0, 1, 0, uintptr(unsafe.Pointer(&s)), 0)
+	if r == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,444 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/build/buildlet"
+)
+
+// snapshotMu serializes changes to the snapshot store.
+var snapshotMu sync.Mutex
+
+// snapshotsDir returns the directory holding snapshot manifests and
+// the copies of the files they refer to, next to the work directory
+// like uploadsDir.
+func snapshotsDir() string {
+	return filepath.Clean(*workDir) + "-snapshots"
+}
+
+// snapshotObject returns the path of the stored copy of the file with
+// the given SHA-256 digest.
+func snapshotObject(sum string) string {
+	return filepath.Join(snapshotsDir(), "objects", sum)
+}
+
+func validSnapshotName(name string) bool {
+	if name == "" || len(name) > 64 || name[0] == '.' {
+		return false
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// buildManifest returns the manifest of dir, relative to the work
+// directory. If keep is non-nil, it is called for each regular file
+// with its path and digest.
+func buildManifest(dir string, keep func(path, sum string) error) (buildlet.Manifest, error) {
+	m := buildlet.Manifest{Dir: dir}
+	base := longPath(filepath.Join(*workDir, filepath.FromSlash(dir)))
+	err := filepath.Walk(base, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(path, base)), "/")
+		if rel == "" {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			return nil
+		}
+		e := buildlet.ManifestEntry{Path: rel, Mode: fi.Mode()}
+		switch {
+		case fi.IsDir():
+			e.Path += "/"
+		case fi.Mode().IsRegular():
+			sum, err := fileSHA256(path)
+			if err != nil {
+				return err
+			}
+			if keep != nil {
+				if err := keep(path, sum); err != nil {
+					return err
+				}
+			}
+			e.Size, e.SHA256 = fi.Size(), sum
+		case fi.Mode()&os.ModeSymlink != 0:
+			if e.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	return m, err
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// keepSnapshotObject stores a copy of the file at path, whose digest
+// is sum, unless the snapshot store already has one.
+func keepSnapshotObject(path, sum string) error {
+	dst := snapshotObject(sum)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != sum {
+		return fmt.Errorf("%s changed while taking the snapshot", path)
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func readSnapshot(name string) (buildlet.Manifest, error) {
+	var m buildlet.Manifest
+	b, err := ioutil.ReadFile(filepath.Join(snapshotsDir(), name+".json"))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// currentManifest is like buildManifest(dir, nil), but treats a
+// missing dir as empty.
+func currentManifest(dir string) (buildlet.Manifest, error) {
+	m, err := buildManifest(dir, nil)
+	if os.IsNotExist(err) {
+		if _, serr := os.Stat(filepath.Join(*workDir, filepath.FromSlash(dir))); os.IsNotExist(serr) {
+			return buildlet.Manifest{Dir: dir}, nil
+		}
+	}
+	return m, err
+}
+
+// removeUnusedSnapshotObjects removes the stored files no snapshot
+// refers to.
+func removeUnusedSnapshotObjects() error {
+	names, err := filepath.Glob(filepath.Join(snapshotsDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, name := range names {
+		m, err := readSnapshot(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			return err
+		}
+		for _, e := range m.Entries {
+			if e.SHA256 != "" {
+				used[e.SHA256] = true
+			}
+		}
+	}
+	fis, err := ioutil.ReadDir(filepath.Join(snapshotsDir(), "objects"))
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !used[fi.Name()] {
+			os.Remove(filepath.Join(snapshotsDir(), "objects", fi.Name()))
+		}
+	}
+	return nil
+}
+
+func handleManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "requires GET method", http.StatusBadRequest)
+		return
+	}
+	dir := r.FormValue("dir")
+	if !mkdirAllWorkdirOr500(w) {
+		return
+	}
+	if !validRelativeDir(dir) {
+		http.Error(w, "bogus dir", http.StatusBadRequest)
+		return
+	}
+	m, err := buildManifest(dir, nil)
+	if os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// handleSnapshot takes a snapshot of a directory (POST), reports the
+// changes to it since (GET), or deletes it (DELETE).
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if !validSnapshotName(name) {
+		http.Error(w, "bogus snapshot name", http.StatusBadRequest)
+		return
+	}
+	if !mkdirAllWorkdirOr500(w) {
+		return
+	}
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	switch r.Method {
+	case "POST":
+		dir := r.FormValue("dir")
+		if !validRelativeDir(dir) {
+			http.Error(w, "bogus dir", http.StatusBadRequest)
+			return
+		}
+		if err := os.MkdirAll(filepath.Join(snapshotsDir(), "objects"), 0755); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m, err := buildManifest(dir, keepSnapshotObject)
+		if os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			var b []byte
+			b, err = json.Marshal(m)
+			if err == nil {
+				err = writeFileAtomic(filepath.Join(snapshotsDir(), name+".json"), b)
+			}
+		}
+		if err == nil {
+			err = removeUnusedSnapshotObjects()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Took snapshot %q of %q: %d entries", name, m.Dir, len(m.Entries))
+		writeJSON(w, m)
+	case "GET":
+		snap, err := readSnapshot(name)
+		if os.IsNotExist(err) {
+			http.Error(w, "no such snapshot", http.StatusNotFound)
+			return
+		}
+		var cur buildlet.Manifest
+		if err == nil {
+			cur, err = currentManifest(snap.Dir)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, snap.Diff(cur))
+	case "DELETE":
+		err := os.Remove(filepath.Join(snapshotsDir(), name+".json"))
+		if os.IsNotExist(err) {
+			http.Error(w, "no such snapshot", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = removeUnusedSnapshotObjects()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted snapshot %q", name)
+	default:
+		http.Error(w, "requires GET, POST, or DELETE method", http.StatusBadRequest)
+	}
+}
+
+// handleSnapshotRestore returns the directory of a snapshot to its
+// state when the snapshot was taken, and reports what it changed.
+func handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "requires POST method", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if !validSnapshotName(name) {
+		http.Error(w, "bogus snapshot name", http.StatusBadRequest)
+		return
+	}
+	if !mkdirAllWorkdirOr500(w) {
+		return
+	}
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	snap, err := readSnapshot(name)
+	if os.IsNotExist(err) {
+		http.Error(w, "no such snapshot", http.StatusNotFound)
+		return
+	}
+	var d buildlet.ManifestDiff
+	if err == nil {
+		d, err = restoreSnapshot(snap)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Restored snapshot %q of %q: %v", name, snap.Dir, d)
+	writeJSON(w, d)
+}
+
+func restoreSnapshot(snap buildlet.Manifest) (buildlet.ManifestDiff, error) {
+	base := longPath(filepath.Join(*workDir, filepath.FromSlash(snap.Dir)))
+	cur, err := currentManifest(snap.Dir)
+	if err != nil {
+		return buildlet.ManifestDiff{}, err
+	}
+	d := snap.Diff(cur)
+	for _, p := range d.Added {
+		if err := removeAllIncludingReadonly(filepath.Join(base, filepath.FromSlash(p))); err != nil {
+			return d, err
+		}
+	}
+	restore := make(map[string]bool)
+	for _, p := range d.Removed {
+		restore[p] = true
+	}
+	for _, p := range d.Modified {
+		restore[p] = true
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return d, err
+	}
+	// Directory modes are set last, so that read-only directories
+	// can be filled first.
+	var dirs []buildlet.ManifestEntry
+	for _, e := range snap.Entries {
+		if !restore[e.Path] {
+			continue
+		}
+		path := filepath.Join(base, filepath.FromSlash(e.Path))
+		if e.Mode.IsDir() {
+			if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+				if err := removeAllIncludingReadonly(path); err != nil {
+					return d, err
+				}
+			}
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return d, err
+			}
+			dirs = append(dirs, e)
+			continue
+		}
+		if err := removeAllIncludingReadonly(path); err != nil {
+			return d, err
+		}
+		switch {
+		case e.Mode&os.ModeSymlink != 0:
+			err = os.Symlink(e.Link, path)
+		case e.Mode.IsRegular():
+			err = copyFile(snapshotObject(e.SHA256), path, e.Mode.Perm())
+		default:
+			err = fmt.Errorf("can't restore %s of mode %v", e.Path, e.Mode)
+		}
+		if err != nil {
+			return d, err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		e := dirs[i]
+		if err := os.Chmod(filepath.Join(base, filepath.FromSlash(e.Path)), e.Mode.Perm()); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	// Chmod in case the umask dropped some bits.
+	return os.Chmod(dst, perm)
+}
+
+// writeFileAtomic writes b to name through a temporary file, so that
+// readers never see a partial file.
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/build/buildlet"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	files := testFiles()
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w })
+	ctx := context.Background()
+	if err := c.PutTar(ctx, bytes.NewReader(makeTGZ(t, files)), "src"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Snapshot(ctx, "warm", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Manifest(ctx, "src"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, m) {
+		t.Errorf("Manifest = %+v, wanted the snapshot's %+v", got, m)
+	}
+
+	src := filepath.Join(*workDir, "src")
+	if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(src, "dir", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "extra"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "extra", "new.txt"), []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := buildlet.ManifestDiff{
+		Added:    []string{"extra/", "extra/new.txt"},
+		Removed:  []string{"dir/b.txt"},
+		Modified: []string{"a.txt"},
+	}
+	if d, err := c.SnapshotDiff(ctx, "warm"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(d, want) {
+		t.Errorf("SnapshotDiff = %+v, wanted %+v", d, want)
+	}
+
+	if d, err := c.RestoreSnapshot(ctx, "warm"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(d, want) {
+		t.Errorf("RestoreSnapshot = %+v, wanted %+v", d, want)
+	}
+	checkFiles(t, src, files)
+	if _, err := os.Stat(filepath.Join(src, "extra")); !os.IsNotExist(err) {
+		t.Errorf("added directory survived the restore: %v", err)
+	}
+	if d, err := c.SnapshotDiff(ctx, "warm"); err != nil {
+		t.Fatal(err)
+	} else if !d.Empty() {
+		t.Errorf("SnapshotDiff after restore = %v, wanted no differences", d)
+	}
+
+	if err := c.DeleteSnapshot(ctx, "warm"); err != nil {
+		t.Fatal(err)
+	}
+	if objs, err := ioutil.ReadDir(filepath.Join(snapshotsDir(), "objects")); err != nil {
+		t.Fatal(err)
+	} else if len(objs) != 0 {
+		t.Errorf("%d stored files remain after deleting the only snapshot", len(objs))
+	}
+	if _, err := c.SnapshotDiff(ctx, "warm"); err == nil {
+		t.Errorf("SnapshotDiff of a deleted snapshot succeeded")
+	}
+}
+
+func TestValidSnapshotName(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"warm", true},
+		{"go1.17-linux_amd64", true},
+		{"", false},
+		{".hidden", false},
+		{"a/b", false},
+		{"../x", false},
+	} {
+		if got := validSnapshotName(tt.name); got != tt.want {
+			t.Errorf("validSnapshotName(%q) = %v, wanted %v", tt.name, got, tt.want)
+		}
+	}
+}
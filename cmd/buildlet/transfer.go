@@ -0,0 +1,447 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Resumable uploads.
+//
+// A client uploads a tar.gz file in one or more PUT requests to
+// /upload, each appending to a staged copy of the file named by its
+// SHA-256 digest, starting where the previous one left off. A HEAD
+// request reports how much of the file the buildlet already has, so
+// that an interrupted upload can be continued from there. Once the
+// whole file is staged, a POST to /writetgz with the digest as its
+// "upload" parameter verifies and extracts it.
+//
+// Large uploads may instead be sent in chunks, in parallel: each is a
+// PUT to /upload with an "at" parameter giving its offset, written
+// into a separate staged file. A POST to /upload with the total
+// "size" then makes that file the staged upload, once all of it has
+// arrived.
+//
+// Resumable downloads re-request /tgz with an "offset" parameter. The
+// buildlet generates the same deterministic tar.gz stream again and
+// skips that many bytes of it, and reports the SHA-256 digest of the
+// whole stream in a trailer so that the client can check that the
+// parts it received belong together.
+//
+// Single files are downloaded from /file, which serves byte ranges,
+// so that clients can fetch large ones in chunks, in parallel, and
+// resume where an interrupted download stopped.
+
+const (
+	// hdrUploadOffset is the HTTP header reporting the size of a
+	// staged upload, and in /tgz responses, the offset the response
+	// body starts at.
+	hdrUploadOffset = "X-Upload-Offset"
+	// hdrTarSHA256 is the HTTP trailer of a resumable /tgz response
+	// with the hex SHA-256 digest of the whole tar.gz stream.
+	hdrTarSHA256 = "X-Tar-Sha256"
+	// hdrTarEncoding is the HTTP header of a /writetgz request or
+	// /tgz response with the compression of its tar body, one of
+	// tarEncodings. It is not Content-Encoding, which would have
+	// HTTP clients decompress the body themselves.
+	hdrTarEncoding = "X-Tar-Encoding"
+	// hdrTarFiltered is the HTTP header of a /tgz response whose
+	// entries were filtered by its "include" and "exclude"
+	// parameters, for clients to tell that from older buildlets,
+	// which ignore them.
+	hdrTarFiltered = "X-Tar-Filtered"
+)
+
+// Encodings of tar files sent to and from the buildlet.
+const (
+	tarEncodingGzip     = "gzip"
+	tarEncodingIdentity = "identity" // uncompressed
+)
+
+// tarEncodings are the supported encodings, listed in /status.
+var tarEncodings = []string{tarEncodingGzip, tarEncodingIdentity}
+
+func validTarEncoding(e string) bool {
+	for _, v := range tarEncodings {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// staleUploadAge is how long an upload that was never completed is
+// kept.
+const staleUploadAge = 24 * time.Hour
+
+// uploadsDir returns the directory holding staged uploads, next to
+// the work directory so that cleaning the work directory leaves them
+// alone.
+func uploadsDir() string {
+	return filepath.Clean(*workDir) + "-uploads"
+}
+
+// maxUploadChunks is how many chunks of an upload the buildlet is
+// willing to receive in parallel, listed in /status.
+const maxUploadChunks = 8
+
+// chunksPath returns the path of the file holding the chunks of the
+// upload id received so far.
+func chunksPath(id string) string {
+	return filepath.Join(uploadsDir(), id+".chunks")
+}
+
+// validUploadID reports whether id is a hex SHA-256 digest.
+func validUploadID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == sha256.Size
+}
+
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if !validUploadID(id) {
+		http.Error(w, "bogus upload id", http.StatusBadRequest)
+		return
+	}
+	if err := os.MkdirAll(uploadsDir(), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := filepath.Join(uploadsDir(), id)
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		size = fi.Size()
+	}
+	switch r.Method {
+	case "HEAD":
+		w.Header().Set(hdrUploadOffset, fmt.Sprint(size))
+	case "PUT":
+		if at := r.FormValue("at"); at != "" {
+			putUploadChunk(w, r, id, at)
+			return
+		}
+		offset, err := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "bogus offset", http.StatusBadRequest)
+			return
+		}
+		if offset != size {
+			w.Header().Set(hdrUploadOffset, fmt.Sprint(size))
+			http.Error(w, fmt.Sprintf("upload offset %d, but have %d bytes", offset, size), http.StatusConflict)
+			return
+		}
+		if offset == 0 {
+			removeStaleUploads()
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Keep whatever arrives, even if the body is cut short, so
+		// that the client can continue from there.
+		n, err := io.Copy(f, r.Body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		w.Header().Set(hdrUploadOffset, fmt.Sprint(size+n))
+		if err != nil {
+			log.Printf("upload %s: interrupted after %d bytes at offset %d: %v", id, n, size, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "OK")
+	case "POST":
+		completeChunkedUpload(w, r, id, path)
+	default:
+		http.Error(w, "requires HEAD, PUT, or POST method", http.StatusBadRequest)
+	}
+}
+
+// putUploadChunk writes the chunk of the upload id in the body of r
+// at the offset at.
+func putUploadChunk(w http.ResponseWriter, r *http.Request, id, at string) {
+	offset, err := strconv.ParseInt(at, 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "bogus chunk offset", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "requires Content-Length", http.StatusLengthRequired)
+		return
+	}
+	if offset == 0 {
+		removeStaleUploads()
+	}
+	f, err := os.OpenFile(chunksPath(id), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(&atWriter{f, offset}, r.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != r.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// The client sends the whole chunk again.
+		log.Printf("upload %s: chunk at offset %d interrupted after %d bytes: %v", id, offset, n, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, "OK")
+}
+
+// completeChunkedUpload makes the chunks received of the upload id
+// the staged upload at path, if they add up to the total size given
+// by r. openUpload checks that none are missing.
+func completeChunkedUpload(w http.ResponseWriter, r *http.Request, id, path string) {
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil {
+		http.Error(w, "bogus size", http.StatusBadRequest)
+		return
+	}
+	fi, err := os.Stat(chunksPath(id))
+	if os.IsNotExist(err) {
+		http.Error(w, "no chunks of upload "+id, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fi.Size() != size {
+		http.Error(w, fmt.Sprintf("upload %s has %d bytes of chunks, wanted %d", id, fi.Size(), size), http.StatusConflict)
+		return
+	}
+	if err := os.Rename(chunksPath(id), path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(hdrUploadOffset, fmt.Sprint(size))
+	io.WriteString(w, "OK")
+}
+
+// atWriter is an io.Writer writing to w from offset off on.
+type atWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (a *atWriter) Write(p []byte) (int, error) {
+	n, err := a.w.WriteAt(p, a.off)
+	a.off += int64(n)
+	return n, err
+}
+
+// openUpload returns the staged upload id, after checking that it is
+// complete.
+func openUpload(id string) (*os.File, error) {
+	if !validUploadID(id) {
+		return nil, badRequest("bogus upload id")
+	}
+	path := filepath.Join(uploadsDir(), id)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, httpError{http.StatusNotFound, "no upload " + id}
+	} else if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != id {
+		f.Close()
+		// Start over rather than extend a corrupt file.
+		os.Remove(path)
+		return nil, badRequest(fmt.Sprintf("upload %s has SHA-256 %s; incomplete or corrupt", id, got))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeStaleUploads removes staged uploads that were last written to
+// more than staleUploadAge ago.
+func removeStaleUploads() {
+	fis, err := ioutil.ReadDir(uploadsDir())
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if time.Since(fi.ModTime()) > staleUploadAge {
+			log.Printf("removing stale upload %s", fi.Name())
+			os.Remove(filepath.Join(uploadsDir(), fi.Name()))
+		}
+	}
+}
+
+// offsetWriter is an io.Writer that hashes everything written to it,
+// but only passes it on to w after the first skip bytes.
+type offsetWriter struct {
+	w    io.Writer
+	skip int64
+	h    hash.Hash
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	o.h.Write(p)
+	n := len(p)
+	if o.skip >= int64(n) {
+		o.skip -= int64(n)
+		return n, nil
+	}
+	p = p[o.skip:]
+	o.skip = 0
+	if _, err := o.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Parallel fetches of large tar.gz files from URLs served with
+// support for ranges, for /writetgz POSTs.
+var (
+	// fetchChunkSize is the size of the ranges fetched.
+	fetchChunkSize int64 = 16 << 20
+	// fetchParallelism is how many ranges are fetched at once.
+	fetchParallelism = 4
+)
+
+// fetchParallel finishes fetching the file at urlStr, whose GET
+// response is res, by fetching its remaining ranges in parallel into a
+// temporary file. It returns a nil file if res is small or its server
+// doesn't support ranges, so that res is better read directly.
+func fetchParallel(ctx context.Context, res *http.Response, urlStr string) (*os.File, error) {
+	size := res.ContentLength
+	if res.Header.Get("Accept-Ranges") != "bytes" || size < 2*fetchChunkSize {
+		return nil, nil
+	}
+	if err := os.MkdirAll(uploadsDir(), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(uploadsDir(), "fetch-")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	// Keep the start of the response already on its way.
+	if _, err := io.CopyN(f, res.Body, fetchChunkSize); err != nil {
+		return fail(err)
+	}
+	res.Body.Close()
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan bool, fetchParallelism)
+	for off := fetchChunkSize; off < size; off += fetchChunkSize {
+		off, n := off, fetchChunkSize
+		if off+n > size {
+			n = size - off
+		}
+		sem <- true
+		g.Go(func() error {
+			defer func() { <-sem }()
+			return fetchRange(ctx, urlStr, f, off, n)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return f, nil
+}
+
+// fetchRange writes the n bytes at offset off of the file at urlStr
+// to the same offset of f.
+func fetchRange(ctx context.Context, urlStr string, f *os.File, off, n int64) error {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("fetching bytes %d-%d of %s: %v", off, off+n-1, urlStr, res.Status)
+	}
+	if got, err := io.Copy(&atWriter{f, off}, io.LimitReader(res.Body, n)); err != nil {
+		return err
+	} else if got != n {
+		return fmt.Errorf("fetching bytes %d-%d of %s: got %d bytes", off, off+n-1, urlStr, got)
+	}
+	return nil
+}
+
+// handleGetFile serves the regular file at the "path" parameter,
+// relative to the workdir. It supports HEAD requests and byte ranges,
+// conditional on the file's modification time with If-Range, so that
+// clients can fetch large files in parallel chunks and resume
+// interrupted downloads.
+func handleGetFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "requires GET or HEAD method", http.StatusBadRequest)
+		return
+	}
+	p := r.FormValue("path")
+	if !validRelPath(p) || !validRelativeDir(p) {
+		http.Error(w, "bogus path", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(longPath(filepath.Join(*workDir, filepath.FromSlash(p))))
+	if os.IsNotExist(err) {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		http.Error(w, "not a regular file; use /tgz for directories", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
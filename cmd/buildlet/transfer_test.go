@@ -0,0 +1,481 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// testFiles are the contents of the files transferred by the tests,
+// by slash-separated name. big is large enough for transfers to be
+// interrupted in its middle.
+func testFiles() map[string][]byte {
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	return map[string][]byte{
+		"a.txt":     []byte("hello\n"),
+		"dir/b.txt": []byte("world\n"),
+		"dir/big":   big,
+	}
+}
+
+// makeTGZ returns a tar.gz file of files.
+func makeTGZ(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// checkFiles checks that dir contains files.
+func checkFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes, wanted %d bytes of content written", name, len(got), len(want))
+		}
+	}
+}
+
+// errReader returns the first n bytes of r, and then an error.
+type errReader struct {
+	r io.Reader
+	n int
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= n
+	return n, err
+}
+
+// abortWriter aborts the handler after n bytes are written to it.
+type abortWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (a *abortWriter) Write(p []byte) (int, error) {
+	if len(p) > a.n {
+		a.ResponseWriter.Write(p[:a.n])
+		panic(http.ErrAbortHandler)
+	}
+	a.n -= len(p)
+	return a.ResponseWriter.Write(p)
+}
+
+// newTransferServer returns a client of a buildlet serving the
+// transfer endpoints in a temporary work directory, and calls
+// interrupt with each request before it is handled.
+func newTransferServer(t *testing.T, interrupt func(w http.ResponseWriter, r *http.Request) http.ResponseWriter) *buildlet.Client {
+	old := *workDir
+	*workDir = filepath.Join(t.TempDir(), "workdir")
+	t.Cleanup(func() { *workDir = old })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/writetgz", handleWriteTGZ)
+	mux.HandleFunc("/upload", handleUpload)
+	mux.HandleFunc("/tgz", handleGetTGZ)
+	mux.HandleFunc("/file", handleGetFile)
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/manifest", handleManifest)
+	mux.HandleFunc("/snapshot", handleSnapshot)
+	mux.HandleFunc("/snapshot/restore", handleSnapshotRestore)
+	mux.HandleFunc("/debug/crashdumps", handleCrashDumps)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(interrupt(w, r), r)
+	}))
+	t.Cleanup(ts.Close)
+	c := buildlet.NewClient(strings.TrimPrefix(ts.URL, "http://"), buildlet.NoKeyPair)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestPutTarResumable(t *testing.T) {
+	files := testFiles()
+	tgz := makeTGZ(t, files)
+	puts := 0
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+		if r.Method == "PUT" && r.URL.Path == "/upload" {
+			puts++
+			if puts == 1 {
+				r.Body = ioutil.NopCloser(&errReader{r: r.Body, n: len(tgz) / 2})
+			}
+		}
+		return w
+	})
+	if err := c.PutTarResumable(context.Background(), bytes.NewReader(tgz), "src"); err != nil {
+		t.Fatalf("PutTarResumable() = %v", err)
+	}
+	if puts != 2 {
+		t.Errorf("PutTarResumable() made %d PUT requests, wanted 2", puts)
+	}
+	checkFiles(t, filepath.Join(*workDir, "src"), files)
+	if fis, err := ioutil.ReadDir(uploadsDir()); err != nil || len(fis) != 0 {
+		t.Errorf("uploads left after extracting: %d, %v", len(fis), err)
+	}
+}
+
+func TestPutTarResumableCorrupt(t *testing.T) {
+	files := testFiles()
+	tgz := makeTGZ(t, files)
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w })
+	// Stage a corrupt first half of the upload, which the client
+	// completes, and the buildlet then rejects and removes.
+	sum := sha256.Sum256(tgz)
+	if err := os.MkdirAll(uploadsDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(uploadsDir(), hex.EncodeToString(sum[:])), make([]byte, len(tgz)/2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutTarResumable(context.Background(), bytes.NewReader(tgz), "src"); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("PutTarResumable() onto a corrupt upload = %v, wanted a corrupt upload error", err)
+	}
+	if err := c.PutTarResumable(context.Background(), bytes.NewReader(tgz), "src"); err != nil {
+		t.Fatalf("PutTarResumable() after a corrupt upload = %v", err)
+	}
+	checkFiles(t, filepath.Join(*workDir, "src"), files)
+}
+
+func TestGetTarResumable(t *testing.T) {
+	files := testFiles()
+	gets := 0
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+		if r.URL.Path == "/tgz" {
+			gets++
+			if gets == 1 {
+				return &abortWriter{ResponseWriter: w, n: 300 << 10}
+			}
+		}
+		return w
+	})
+	for name, data := range files {
+		p := filepath.Join(*workDir, "out", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := c.GetTarResumable(context.Background(), "out", &buf); err != nil {
+		t.Fatalf("GetTarResumable() = %v", err)
+	}
+	if gets != 2 {
+		t.Errorf("GetTarResumable() made %d requests, wanted 2", gets)
+	}
+	dir := t.TempDir()
+	if err := untar(&buf, dir, tarEncodingGzip); err != nil {
+		t.Fatalf("untar() = %v", err)
+	}
+	checkFiles(t, dir, files)
+}
+
+func TestGetTarResumableContinue(t *testing.T) {
+	files := testFiles()
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w })
+	ctx := context.Background()
+	if err := c.PutTar(ctx, bytes.NewReader(makeTGZ(t, files)), "out"); err != nil {
+		t.Fatal(err)
+	}
+	opts := buildlet.TarOpts{Exclude: []string{"a.txt"}}
+	var whole bytes.Buffer
+	if err := c.GetTarResumableOpts(ctx, "out", opts, nil, &whole); err != nil {
+		t.Fatalf("GetTarResumableOpts() = %v", err)
+	}
+
+	// Continue a download that stopped halfway.
+	have := whole.Bytes()[:whole.Len()/2]
+	rest := new(bytes.Buffer)
+	if err := c.GetTarResumableOpts(ctx, "out", opts, bytes.NewReader(have), rest); err != nil {
+		t.Fatalf("GetTarResumableOpts(have) = %v", err)
+	}
+	if got := append(have[:len(have):len(have)], rest.Bytes()...); !bytes.Equal(got, whole.Bytes()) {
+		t.Errorf("continued download differs from the whole one")
+	}
+
+	// The start of another stream doesn't fit.
+	if err := c.GetTarResumableOpts(ctx, "out", opts, bytes.NewReader(bytes.Repeat([]byte{'x'}, len(have))), ioutil.Discard); !errors.Is(err, buildlet.ErrChanged) {
+		t.Errorf("GetTarResumableOpts(bad have) = %v, wanted ErrChanged", err)
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	big := make([]byte, 20<<20)
+	rand.New(rand.NewSource(3)).Read(big)
+	var mu sync.Mutex
+	chunks, failed := 0, false
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+		if r.Method == "GET" && r.URL.Path == "/file" {
+			mu.Lock()
+			defer mu.Unlock()
+			chunks++
+			if !failed && r.Header.Get("Range") != "bytes=0-8388607" {
+				// Interrupt one chunk once, partway.
+				failed = true
+				return &abortWriter{ResponseWriter: w, n: 1 << 20}
+			}
+		}
+		return w
+	})
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*workDir, "big"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var last int64
+	progress := func(have, size int64) {
+		if have < last || size != int64(len(big)) {
+			t.Errorf("progress(%d, %d) after %d", have, size, last)
+		}
+		last = have
+	}
+	size, err := c.GetFile(ctx, "big", f, buildlet.GetFileOpts{Parallel: 2, Progress: progress})
+	if err != nil {
+		t.Fatalf("GetFile() = %v", err)
+	}
+	if size != int64(len(big)) || last != size {
+		t.Errorf("GetFile() = %d, with progress up to %d; wanted %d", size, last, len(big))
+	}
+	if want := 3 + 1; chunks != want {
+		t.Errorf("fetched %d chunks, wanted %d", chunks, want)
+	}
+	checkFiles(t, filepath.Dir(f.Name()), map[string][]byte{"big": big})
+
+	// Continue a download that stopped partway.
+	f2, err := os.Create(filepath.Join(t.TempDir(), "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	const offset = 10<<20 + 5
+	if _, err := f2.Write(big[:offset]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetFile(ctx, "big", f2, buildlet.GetFileOpts{Offset: offset}); err != nil {
+		t.Fatalf("GetFile(offset) = %v", err)
+	}
+	checkFiles(t, filepath.Dir(f2.Name()), map[string][]byte{"big": big})
+
+	// A file changing during the download is caught.
+	chunks = 0
+	c2 := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+		if r.Method == "GET" && r.URL.Path == "/file" {
+			mu.Lock()
+			defer mu.Unlock()
+			if chunks++; chunks == 2 {
+				os.Chtimes(filepath.Join(*workDir, "big"), time.Now(), time.Now().Add(time.Hour))
+			}
+		}
+		return w
+	})
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*workDir, "big"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.GetFile(ctx, "big", f2, buildlet.GetFileOpts{}); !errors.Is(err, buildlet.ErrChanged) {
+		t.Errorf("GetFile(changing file) = %v, wanted ErrChanged", err)
+	}
+
+	for _, p := range []string{"missing", ".", "../big"} {
+		if _, err := c.GetFile(ctx, p, f2, buildlet.GetFileOpts{}); err == nil {
+			t.Errorf("GetFile(%q) = nil, wanted error", p)
+		}
+	}
+}
+
+func TestTarEncodings(t *testing.T) {
+	files := testFiles()
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w })
+	ctx := context.Background()
+
+	enc, err := c.NegotiateTarEncoding(ctx, "zstd", buildlet.TarEncodingIdentity)
+	if err != nil || enc != buildlet.TarEncodingIdentity {
+		t.Fatalf("NegotiateTarEncoding() = %q, %v, wanted %q", enc, err, buildlet.TarEncodingIdentity)
+	}
+
+	// An uncompressed tarball is makeTGZ's output, decompressed.
+	zr, err := gzip.NewReader(bytes.NewReader(makeTGZ(t, files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutTarOpts(ctx, bytes.NewReader(tarball), "plain", buildlet.TarOpts{Encoding: buildlet.TarEncodingIdentity}); err != nil {
+		t.Fatalf("PutTarOpts(identity) = %v", err)
+	}
+	checkFiles(t, filepath.Join(*workDir, "plain"), files)
+	if err := c.PutTarOpts(ctx, bytes.NewReader(tarball), "plain", buildlet.TarOpts{Encoding: "zstd"}); err == nil {
+		t.Error("PutTarOpts(zstd) = nil, wanted error")
+	}
+
+	for _, opts := range []buildlet.TarOpts{
+		{Encoding: buildlet.TarEncodingIdentity},
+		{GzipLevel: gzip.BestCompression},
+		{GzipLevel: gzip.BestSpeed},
+	} {
+		rc, err := c.GetTarOpts(ctx, "plain", opts)
+		if err != nil {
+			t.Errorf("GetTarOpts(%+v) = %v", opts, err)
+			continue
+		}
+		enc := tarEncodingGzip
+		if opts.Encoding != "" {
+			enc = opts.Encoding
+		}
+		dir := t.TempDir()
+		err = untar(rc, dir, enc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("GetTarOpts(%+v): untar() = %v", opts, err)
+			continue
+		}
+		checkFiles(t, dir, files)
+	}
+}
+
+func TestGetTarFilter(t *testing.T) {
+	files := testFiles()
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w })
+	ctx := context.Background()
+	if err := c.PutTar(ctx, bytes.NewReader(makeTGZ(t, files)), "src"); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := c.GetTarOpts(ctx, "src", buildlet.TarOpts{Include: []string{"*.txt"}, Exclude: []string{"a.txt"}})
+	if err != nil {
+		t.Fatalf("GetTarOpts = %v", err)
+	}
+	dir := t.TempDir()
+	err = untar(rc, dir, tarEncodingGzip)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string][]byte{"dir/b.txt": files["dir/b.txt"]})
+	for _, name := range []string{"a.txt", "dir/big"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s was fetched despite the filter", name)
+		}
+	}
+
+	if _, err := c.GetTarOpts(ctx, "src", buildlet.TarOpts{Include: []string{"["}}); err == nil {
+		t.Error("GetTarOpts with a malformed pattern = nil, wanted error")
+	}
+}
+
+func TestPutTarChunked(t *testing.T) {
+	big := make([]byte, 36<<20)
+	rand.New(rand.NewSource(2)).Read(big)
+	files := map[string][]byte{"a.txt": []byte("hello\n"), "big": big}
+	tgz := makeTGZ(t, files)
+	var mu sync.Mutex
+	chunks, failed := 0, false
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+		if r.Method == "PUT" && r.URL.Path == "/upload" {
+			if r.FormValue("at") == "" {
+				t.Errorf("got an unchunked upload")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			chunks++
+			if !failed && r.FormValue("at") != "0" {
+				// Interrupt one chunk once.
+				failed = true
+				return &abortWriter{ResponseWriter: w}
+			}
+		}
+		return w
+	})
+	if err := c.PutTar(context.Background(), bytes.NewReader(tgz), "src"); err != nil {
+		t.Fatalf("PutTar: %v", err)
+	}
+	checkFiles(t, filepath.Join(*workDir, "src"), files)
+	if want := len(tgz)/(8<<20) + 2; chunks != want {
+		t.Errorf("uploaded %d chunks, wanted %d", chunks, want)
+	}
+}
+
+func TestPutTarFromURLParallel(t *testing.T) {
+	old := fetchChunkSize
+	fetchChunkSize = 64 << 10
+	defer func() { fetchChunkSize = old }()
+	files := testFiles()
+	tgz := makeTGZ(t, files)
+	var mu sync.Mutex
+	ranges := 0
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			mu.Lock()
+			ranges++
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "src.tar.gz", time.Time{}, bytes.NewReader(tgz))
+	}))
+	defer src.Close()
+	c := newTransferServer(t, func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w })
+	if err := c.PutTarFromURL(context.Background(), src.URL, "src"); err != nil {
+		t.Fatalf("PutTarFromURL: %v", err)
+	}
+	checkFiles(t, filepath.Join(*workDir, "src"), files)
+	if want := (len(tgz)+64<<10-1)/(64<<10) - 1; ranges != want {
+		t.Errorf("fetched %d ranges, wanted %d", ranges, want)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// handleConnectTCP proxies a connection to a TCP port on the
+// buildlet's host, such as one a test server listens on, over the
+// client's HTTP connection.
+func handleConnectTCP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "requires POST method", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength != 0 {
+		http.Error(w, "requires zero Content-Length", http.StatusBadRequest)
+		return
+	}
+	port, err := strconv.Atoi(r.FormValue("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		http.Error(w, "bogus 'port' parameter", http.StatusBadRequest)
+		return
+	}
+	c, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer c.Close()
+	log.Printf("Proxying a connection to port %d for %s", port, r.RemoteAddr)
+	proxyUpgrade(w, c, "tcp")
+}
+
+// pendingTCPTimeout is how long a connection accepted for a
+// /listen-tcp client waits for the client to claim it with /accept-tcp.
+const pendingTCPTimeout = 30 * time.Second
+
+// pendingTCP holds the connections accepted for /listen-tcp clients
+// until they claim them with /accept-tcp, by ID.
+var pendingTCP struct {
+	sync.Mutex
+	next  int
+	conns map[string]net.Conn
+}
+
+// addPendingTCP holds c until it is claimed with takePendingTCP or
+// pendingTCPTimeout elapses, and returns its ID.
+func addPendingTCP(c net.Conn) string {
+	pendingTCP.Lock()
+	defer pendingTCP.Unlock()
+	if pendingTCP.conns == nil {
+		pendingTCP.conns = make(map[string]net.Conn)
+	}
+	pendingTCP.next++
+	id := strconv.Itoa(pendingTCP.next)
+	pendingTCP.conns[id] = c
+	time.AfterFunc(pendingTCPTimeout, func() {
+		if c := takePendingTCP(id); c != nil {
+			c.Close()
+		}
+	})
+	return id
+}
+
+// takePendingTCP returns the pending connection with the given ID, or
+// nil if there is none, and forgets it.
+func takePendingTCP(id string) net.Conn {
+	pendingTCP.Lock()
+	defer pendingTCP.Unlock()
+	c := pendingTCP.conns[id]
+	delete(pendingTCP.conns, id)
+	return c
+}
+
+// handleListenTCP listens on a TCP port of the buildlet's host's
+// localhost for as long as the client's connection, upgraded to a
+// stream of lines, stays open. It sends the client the ID of each
+// connection it accepts, which the client claims with /accept-tcp.
+func handleListenTCP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "requires POST method", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength != 0 {
+		http.Error(w, "requires zero Content-Length", http.StatusBadRequest)
+		return
+	}
+	port, err := strconv.Atoi(r.FormValue("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		http.Error(w, "bogus 'port' parameter", http.StatusBadRequest)
+		return
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer ln.Close()
+	conn, ok := hijackUpgrade(w, "tcp-listen")
+	if !ok {
+		return
+	}
+	defer conn.Close()
+	log.Printf("Listening on port %d for %s", port, r.RemoteAddr)
+	go func() {
+		// The client sends nothing; it closes its connection to
+		// stop listening.
+		io.Copy(ioutil.Discard, conn)
+		ln.Close()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Printf("Stopped listening on port %d for %s: %v", port, r.RemoteAddr, err)
+			return
+		}
+		if _, err := fmt.Fprintf(conn, "%s\n", addPendingTCP(c)); err != nil {
+			return
+		}
+	}
+}
+
+// handleAcceptTCP proxies a connection accepted for a /listen-tcp
+// client, by the ID it was sent, over the client's HTTP connection.
+func handleAcceptTCP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "requires POST method", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength != 0 {
+		http.Error(w, "requires zero Content-Length", http.StatusBadRequest)
+		return
+	}
+	c := takePendingTCP(r.FormValue("id"))
+	if c == nil {
+		http.Error(w, "no pending connection with that 'id'", http.StatusNotFound)
+		return
+	}
+	defer c.Close()
+	proxyUpgrade(w, c, "tcp")
+}
+
+// hijackUpgrade hijacks the connection of w and tells the client it
+// was upgraded to protocol. If it fails, it replies with an error and
+// returns false.
+func hijackUpgrade(w http.ResponseWriter, protocol string) (net.Conn, bool) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("conn can't hijack for %s proxy; HTTP/2 enabled by default?", protocol)
+		http.Error(w, "conn can't hijack", http.StatusInternalServerError)
+		return nil, false
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Printf("%s hijack error: %v", protocol, err)
+		http.Error(w, protocol+" hijack error: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", protocol)
+	return conn, true
+}
+
+// proxyUpgrade hijacks the connection of w, tells the client it was
+// upgraded to protocol, and copies data between it and backend until
+// either side is done.
+func proxyUpgrade(w http.ResponseWriter, backend net.Conn, protocol string) {
+	conn, ok := hijackUpgrade(w, protocol)
+	if !ok {
+		return
+	}
+	defer conn.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(backend, conn)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backend)
+		errc <- err
+	}()
+	<-errc
+}
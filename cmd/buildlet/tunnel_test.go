@@ -0,0 +1,145 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/build/buildlet"
+)
+
+func TestConnectTCP(t *testing.T) {
+	// A server that greets before echoing, to check that data the
+	// buildlet sends right after upgrading isn't lost.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, "hello\n")
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	ts := httptest.NewServer(http.HandlerFunc(handleConnectTCP))
+	defer ts.Close()
+	bc := buildlet.NewClient(strings.TrimPrefix(ts.URL, "http://"), buildlet.NoKeyPair)
+	defer bc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	check := func(c net.Conn) {
+		t.Helper()
+		defer c.Close()
+		br := bufio.NewReader(c)
+		fmt.Fprintf(c, "ping\n")
+		for _, want := range []string{"hello\n", "ping\n"} {
+			if got, err := br.ReadString('\n'); err != nil || got != want {
+				t.Errorf("read %q, %v, wanted %q", got, err, want)
+			}
+		}
+	}
+	c, err := bc.DialPort(ctx, port)
+	if err != nil {
+		t.Fatalf("DialPort: %v", err)
+	}
+	check(c)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go bc.ForwardPort(ctx, local, port)
+	c, err = net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	if _, err := bc.DialPort(ctx, 0); err == nil {
+		t.Errorf("DialPort(0) succeeded")
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	// Find a free port for the buildlet to listen on.
+	free, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/listen-tcp":
+			handleListenTCP(w, r)
+		case "/accept-tcp":
+			handleAcceptTCP(w, r)
+		}
+	}))
+	defer ts.Close()
+	bc := buildlet.NewClient(strings.TrimPrefix(ts.URL, "http://"), buildlet.NoKeyPair)
+	defer bc.Close()
+	ctx := context.Background()
+
+	ln, err := bc.ListenPort(ctx, port)
+	if err != nil {
+		t.Fatalf("ListenPort: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, "hello\n")
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", net.JoinHostPort("localhost", fmt.Sprint(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(c)
+		fmt.Fprintf(c, "ping\n")
+		for _, want := range []string{"hello\n", "ping\n"} {
+			if got, err := br.ReadString('\n'); err != nil || got != want {
+				t.Errorf("read %q, %v, wanted %q", got, err, want)
+			}
+		}
+		c.Close()
+	}
+
+	if _, err := bc.AcceptPort(ctx, "bogus"); err == nil {
+		t.Errorf("AcceptPort(%q) succeeded", "bogus")
+	}
+	if _, err := bc.ListenPort(ctx, 0); err == nil {
+		t.Errorf("ListenPort(0) succeeded")
+	}
+}
@@ -57,6 +57,9 @@ var (
 const (
 	remoteBuildletIdleTimeout   = 30 * time.Minute
 	remoteBuildletCleanInterval = time.Minute
+	// remoteBuildletMaxExtension is the most a gomote user can
+	// extend their buildlet's expiration by at once.
+	remoteBuildletMaxExtension = 8 * time.Hour
 )
 
 func init() {
@@ -85,11 +88,20 @@ func (rb *remoteBuildlet) renew(ctx context.Context) {
 	default:
 	}
 	if got := remoteBuildlets.m[rb.Name]; got == rb {
-		rb.Expires = time.Now().Add(remoteBuildletIdleTimeout)
+		rb.expireAfter(remoteBuildletIdleTimeout)
 		time.AfterFunc(time.Minute, func() { rb.renew(ctx) })
 	}
 }
 
+// expireAfter makes rb expire d from now, unless it's already set to
+// expire later, as by an extension. The caller must hold
+// remoteBuildlets' lock.
+func (rb *remoteBuildlet) expireAfter(d time.Duration) {
+	if e := timeNow().Add(d); e.After(rb.Expires) {
+		rb.Expires = e
+	}
+}
+
 func addRemoteBuildlet(rb *remoteBuildlet) (name string) {
 	remoteBuildlets.Lock()
 	defer remoteBuildlets.Unlock()
@@ -332,6 +344,32 @@ func remoteBuildletStatus() string {
 	return buf.String()
 }
 
+// handleBuildletKeepAlive extends the expiration of the remote
+// buildlet rb by the "duration" form value, or by
+// remoteBuildletIdleTimeout if empty, and replies with rb as JSON.
+func handleBuildletKeepAlive(w http.ResponseWriter, r *http.Request, rb *remoteBuildlet) {
+	d := remoteBuildletIdleTimeout
+	if v := r.FormValue("duration"); v != "" {
+		var err error
+		d, err = time.ParseDuration(v)
+		if err != nil || d <= 0 || d > remoteBuildletMaxExtension {
+			http.Error(w, fmt.Sprintf("bogus duration %q; must be positive and at most %v", v, remoteBuildletMaxExtension), http.StatusBadRequest)
+			return
+		}
+	}
+	remoteBuildlets.Lock()
+	rb.expireAfter(d)
+	jenc, err := json.Marshal(rb)
+	remoteBuildlets.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jenc = append(jenc, '\n')
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(jenc)
+}
+
 func proxyBuildletHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.TLS == nil {
 		http.Error(w, "https required", http.StatusBadRequest)
@@ -345,7 +383,7 @@ func proxyBuildletHTTP(w http.ResponseWriter, r *http.Request) {
 	remoteBuildlets.Lock()
 	rb, ok := remoteBuildlets.m[buildletName]
 	if ok {
-		rb.Expires = time.Now().Add(remoteBuildletIdleTimeout)
+		rb.expireAfter(remoteBuildletIdleTimeout)
 	}
 	remoteBuildlets.Unlock()
 	if !ok {
@@ -375,6 +413,11 @@ func proxyBuildletHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == "POST" && r.URL.Path == "/keepalive" {
+		handleBuildletKeepAlive(w, r, rb)
+		return
+	}
+
 	outReq, err := http.NewRequest(r.Method, rb.buildlet.URL()+r.URL.Path+"?"+r.URL.RawQuery, r.Body)
 	if err != nil {
 		log.Printf("bad proxy request: %v", err)
@@ -613,8 +656,11 @@ func (ah *sshHandlers) handleIncomingSSHPostAuth(s ssh.Session) {
 	}
 
 	ptyReq, winCh, isPty := s.Pty()
-	if !isPty {
-		fmt.Fprintf(s, "scp etc not yet supported; https://golang.org/issue/21140\n")
+	sessCmd := s.Command()
+	isTunnel := !isPty && len(sessCmd) == 2 && (sessCmd[0] == "tcp" || sessCmd[0] == "tcp-listen" || sessCmd[0] == "tcp-accept")
+	isSFTP := !isPty && len(sessCmd) == 1 && sessCmd[0] == "sftp"
+	if !isPty && !isTunnel && !isSFTP {
+		fmt.Fprintf(s, "scp etc not supported over gomote ssh; use gomote sftp instead\n")
 		return
 	}
 
@@ -630,6 +676,21 @@ func (ah *sshHandlers) handleIncomingSSHPostAuth(s ssh.Session) {
 		fmt.Fprintf(s, "unknown instance %q", inst)
 		return
 	}
+	if isTunnel {
+		switch sessCmd[0] {
+		case "tcp":
+			proxySSHTunnel(s, rb, sessCmd[1])
+		case "tcp-listen":
+			proxySSHListen(s, rb, sessCmd[1])
+		case "tcp-accept":
+			proxySSHAccept(s, rb, sessCmd[1])
+		}
+		return
+	}
+	if isSFTP {
+		ah.proxySFTP(s, rb, requestedMutable)
+		return
+	}
 
 	hostType := rb.HostType
 	hostConf, ok := dashboard.Hosts[hostType]
@@ -671,7 +732,7 @@ func (ah *sshHandlers) handleIncomingSSHPostAuth(s ssh.Session) {
 
 	var localProxyPort int
 	if useLocalSSHProxy {
-		sshConn, err := rb.buildlet.ConnectSSH(sshUser, ah.gomotePublicKey)
+		sshConn, err := rb.buildlet.ConnectSSHContext(ctx, sshUser, ah.gomotePublicKey)
 		log.Printf("buildlet(%q).ConnectSSH = %T, %v", inst, sshConn, err)
 		if err != nil {
 			fmt.Fprintf(s, "failed to connect to ssh on %s: %v\n", inst, err)
@@ -681,37 +742,14 @@ func (ah *sshHandlers) handleIncomingSSHPostAuth(s ssh.Session) {
 
 		// Now listen on some localhost port that we'll proxy to sshConn.
 		// The openssh ssh command line tool will connect to this IP.
-		ln, err := net.Listen("tcp", "localhost:0")
+		var lnClose func()
+		localProxyPort, lnClose, err = localSSHProxy(sshConn)
 		if err != nil {
 			fmt.Fprintf(s, "local listen error: %v\n", err)
 			return
 		}
-		localProxyPort = ln.Addr().(*net.TCPAddr).Port
 		log.Printf("ssh local proxy port for %s: %v", inst, localProxyPort)
-		var lnCloseOnce sync.Once
-		lnClose := func() { lnCloseOnce.Do(func() { ln.Close() }) }
 		defer lnClose()
-
-		// Accept at most one connection from localProxyPort and proxy
-		// it to sshConn.
-		go func() {
-			c, err := ln.Accept()
-			lnClose()
-			if err != nil {
-				return
-			}
-			defer c.Close()
-			errc := make(chan error, 1)
-			go func() {
-				_, err := io.Copy(c, sshConn)
-				errc <- err
-			}()
-			go func() {
-				_, err := io.Copy(sshConn, c)
-				errc <- err
-			}()
-			err = <-errc
-		}()
 	}
 	workDir, err := rb.buildlet.WorkDir(ctx)
 	if err != nil {
@@ -766,6 +804,216 @@ func (ah *sshHandlers) handleIncomingSSHPostAuth(s ssh.Session) {
 	cmd.Wait()
 }
 
+// localSSHProxy listens on a localhost port for the openssh ssh command
+// line tool to connect to, and proxies the first connection to it to
+// sshConn. It returns the port and a function to stop listening.
+func localSSHProxy(sshConn net.Conn) (port int, closeFn func(), err error) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, nil, err
+	}
+	var lnCloseOnce sync.Once
+	lnClose := func() { lnCloseOnce.Do(func() { ln.Close() }) }
+
+	// Accept at most one connection and proxy it to sshConn.
+	go func() {
+		c, err := ln.Accept()
+		lnClose()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(c, sshConn)
+			errc <- err
+		}()
+		go func() {
+			_, err := io.Copy(sshConn, c)
+			errc <- err
+		}()
+		<-errc
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, lnClose, nil
+}
+
+// proxySFTP proxies the input and output of the session s, run by
+// gomote sftp as "sftp", to the sftp subsystem of the SSH server on
+// the instance. Since the output is the SFTP protocol, problems are
+// reported on the session's stderr.
+func (ah *sshHandlers) proxySFTP(s ssh.Session, rb *remoteBuildlet, mutable bool) {
+	fail := func(format string, args ...interface{}) {
+		fmt.Fprintf(s.Stderr(), format+"\n", args...)
+		s.Exit(1)
+	}
+	hostConf, ok := dashboard.Hosts[rb.HostType]
+	if !ok {
+		fail("instance %q has unknown host type %q", rb.Name, rb.HostType)
+		return
+	}
+	sshUser := hostConf.SSHUsername
+	if sshUser == "" {
+		fail("instance %q host type %q does not have SSH configured", rb.Name, rb.HostType)
+		return
+	}
+	if !hostConf.IsHermetic() && !mutable {
+		fail("instance %q host type %q is not configured to have a hermetic filesystem per boot;\n"+
+			"run gomote sftp --i-will-not-break-the-host %s if you won't modify machine state\n"+
+			"that will affect future builds", rb.Name, rb.HostType, rb.Name)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.Context())
+	defer cancel()
+	go rb.renew(ctx)
+
+	sshConn, err := rb.buildlet.ConnectSSHContext(ctx, sshUser, ah.gomotePublicKey)
+	if err != nil {
+		fail("failed to connect to ssh on %s: %v", rb.Name, err)
+		return
+	}
+	defer sshConn.Close()
+	port, lnClose, err := localSSHProxy(sshConn)
+	if err != nil {
+		fail("local listen error: %v", err)
+		return
+	}
+	defer lnClose()
+
+	log.Printf("sftp to %s: starting ssh -p %d -s for %s@localhost", rb.Name, port, sshUser)
+	cmd := exec.Command("ssh",
+		"-p", strconv.Itoa(port),
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "LogLevel=ERROR",
+		"-i", sshPrivateKeyFile,
+		"-s", sshUser+"@localhost", "sftp")
+	cmd.Stdout = s
+	cmd.Stderr = s.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		fail("running ssh client to %s: %v", rb.Name, err)
+		return
+	}
+	go func() {
+		io.Copy(stdin, s)
+		stdin.Close()
+	}()
+	if err := cmd.Wait(); err != nil {
+		log.Printf("sftp to %s: %v", rb.Name, err)
+		s.Exit(1)
+		return
+	}
+	s.Exit(0)
+}
+
+// proxySSHTunnel proxies the input and output of the session s, run
+// by gomote ssh as "tcp PORT" to forward a port, to the TCP port on
+// the instance's localhost.
+func proxySSHTunnel(s ssh.Session, rb *remoteBuildlet, portStr string) {
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		fmt.Fprintf(s.Stderr(), "bogus port %q\n", portStr)
+		s.Exit(1)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.Context())
+	defer cancel()
+	go rb.renew(ctx)
+
+	c, err := rb.buildlet.DialPort(ctx, port)
+	if err != nil {
+		fmt.Fprintf(s.Stderr(), "connecting to port %d on %s: %v\n", port, rb.Name, err)
+		s.Exit(1)
+		return
+	}
+	defer c.Close()
+	log.Printf("ssh: forwarding a connection to port %d on %s", port, rb.Name)
+	proxySSHConn(s, c)
+}
+
+// proxySSHListen has the instance listen on the TCP port on its
+// localhost for as long as the session s, run by gomote ssh as
+// "tcp-listen PORT" for remote port forwarding, and writes the ID of
+// each connection the instance accepts to s, for gomote to claim in a
+// "tcp-accept ID" session.
+func proxySSHListen(s ssh.Session, rb *remoteBuildlet, portStr string) {
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		fmt.Fprintf(s.Stderr(), "bogus port %q\n", portStr)
+		s.Exit(1)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.Context())
+	defer cancel()
+	go rb.renew(ctx)
+
+	ln, err := rb.buildlet.ListenPort(ctx, port)
+	if err != nil {
+		fmt.Fprintf(s.Stderr(), "listening on port %d on %s: %v\n", port, rb.Name, err)
+		s.Exit(1)
+		return
+	}
+	defer ln.Close()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	log.Printf("ssh: listening on port %d on %s", port, rb.Name)
+	for {
+		id, err := ln.Next()
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(s.Stderr(), "listening on port %d on %s: %v\n", port, rb.Name, err)
+			}
+			s.Exit(1)
+			return
+		}
+		if _, err := fmt.Fprintf(s, "%s\n", id); err != nil {
+			return
+		}
+	}
+}
+
+// proxySSHAccept proxies the input and output of the session s, run
+// by gomote ssh as "tcp-accept ID", to the connection with that ID
+// accepted for a "tcp-listen PORT" session.
+func proxySSHAccept(s ssh.Session, rb *remoteBuildlet, id string) {
+	ctx, cancel := context.WithCancel(s.Context())
+	defer cancel()
+	go rb.renew(ctx)
+
+	c, err := rb.buildlet.AcceptPort(ctx, id)
+	if err != nil {
+		fmt.Fprintf(s.Stderr(), "accepting connection %s on %s: %v\n", id, rb.Name, err)
+		s.Exit(1)
+		return
+	}
+	defer c.Close()
+	log.Printf("ssh: forwarding a connection accepted on %s", rb.Name)
+	proxySSHConn(s, c)
+}
+
+// proxySSHConn copies between the session s and c until either side is
+// done, and then ends s.
+func proxySSHConn(s ssh.Session, c net.Conn) {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c, s)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(s, c)
+		errc <- err
+	}()
+	<-errc
+	s.Exit(0)
+}
+
 func setWinsize(f *os.File, w, h int) {
 	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
 		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
@@ -177,3 +177,37 @@ func TestHandleBuildletCreate_Stream(t *testing.T) {
 		t.Errorf("unexpected output.\n got: %s\nwant: %s\n", got, want)
 	}
 }
+
+func TestHandleBuildletKeepAlive(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Unix(123, 0).In(time.UTC)
+	timeNow = func() time.Time { return now }
+	rb := &remoteBuildlet{Name: "gopher-linux-amd64-test-0", Expires: now.Add(time.Minute)}
+	for _, tt := range []struct {
+		duration string
+		code     int
+		expires  time.Time
+	}{
+		{"", 200, now.Add(remoteBuildletIdleTimeout)},
+		{"2h", 200, now.Add(2 * time.Hour)},
+		{"1h", 200, now.Add(2 * time.Hour)}, // doesn't shorten the previous extension
+		{"-1h", 400, now.Add(2 * time.Hour)},
+		{"9h", 400, now.Add(2 * time.Hour)},
+		{"bogus", 400, now.Add(2 * time.Hour)},
+	} {
+		data := url.Values{}
+		if tt.duration != "" {
+			data.Set("duration", tt.duration)
+		}
+		req := httptest.NewRequest("POST", "/keepalive", strings.NewReader(data.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleBuildletKeepAlive(w, req, rb)
+		if w.Code != tt.code {
+			t.Errorf("duration %q: code = %d, want %d; body: %s", tt.duration, w.Code, tt.code, w.Body.String())
+		}
+		if !rb.Expires.Equal(tt.expires) {
+			t.Errorf("duration %q: Expires = %v, want %v", tt.duration, rb.Expires, tt.expires)
+		}
+	}
+}
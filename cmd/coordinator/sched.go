@@ -10,8 +10,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"sort"
 	"sync"
 	"time"
@@ -270,6 +272,15 @@ func (s *Scheduler) state() (st schedulerState) {
 	return st
 }
 
+// handleSchedulerStatusJSON serves the scheduler's state, the
+// buildlet requests waiting for each host type, as JSON. gomote uses
+// it to show how busy each builder type is.
+func handleSchedulerStatusJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	j, _ := json.MarshalIndent(sched.state(), "", "\t")
+	w.Write(j)
+}
+
 // waiterState returns tells waiter how many callers are on the line
 // in front of them.
 func (s *Scheduler) waiterState(waiter *SchedItem) (ws types.BuildletWaitStatus) {
@@ -10,7 +10,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http/httptest"
 	"runtime"
 	"testing"
 	"time"
@@ -319,3 +321,41 @@ func TestScheduler(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleSchedulerStatusJSON(t *testing.T) {
+	old := sched
+	defer func() { sched = old }()
+	sched = NewScheduler()
+	now := time.Now()
+	// Add the waiters directly, without scheduling them.
+	sched.waiting = map[string]map[*SchedItem]bool{
+		"host-a": {
+			{HostType: "host-a", IsGomote: true, requestTime: now}: true,
+			{HostType: "host-a", IsTry: true, requestTime: now}:    true,
+		},
+		"host-b": {
+			{HostType: "host-b", requestTime: now}: true,
+		},
+	}
+
+	w := httptest.NewRecorder()
+	handleSchedulerStatusJSON(w, httptest.NewRequest("GET", "/status/scheduler.json", nil))
+	var got struct {
+		HostTypes []struct {
+			HostType      string
+			Total, Gomote struct{ Count int }
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body.Bytes(), err)
+	}
+	if len(got.HostTypes) != 2 {
+		t.Fatalf("got %d host types; want 2: %s", len(got.HostTypes), w.Body.Bytes())
+	}
+	if h := got.HostTypes[0]; h.HostType != "host-a" || h.Total.Count != 2 || h.Gomote.Count != 1 {
+		t.Errorf("host-a state = %+v; want 2 waiting, 1 gomote", h)
+	}
+	if h := got.HostTypes[1]; h.HostType != "host-b" || h.Total.Count != 1 || h.Gomote.Count != 0 {
+		t.Errorf("host-b state = %+v; want 1 waiting, no gomotes", h)
+	}
+}
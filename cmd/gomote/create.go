@@ -13,18 +13,24 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"golang.org/x/build/buildlet"
+	"golang.org/x/build/dashboard"
 	"golang.org/x/build/types"
 )
 
 type builderType struct {
 	Name      string
+	HostType  string
 	IsReverse bool
 	ExpectNum int
 }
 
+func (bt builderType) GOOS() string   { return (&dashboard.BuildConfig{Name: bt.Name}).GOOS() }
+func (bt builderType) GOARCH() string { return (&dashboard.BuildConfig{Name: bt.Name}).GOARCH() }
+
 func builders() (bt []builderType) {
 	type builderInfo struct {
 		HostType string
@@ -64,6 +70,7 @@ func builders() (bt []builderType) {
 		}
 		bt = append(bt, builderType{
 			Name:      b,
+			HostType:  bi.HostType,
 			IsReverse: hi.IsReverse,
 			ExpectNum: hi.ExpectNum,
 		})
@@ -74,11 +81,188 @@ func builders() (bt []builderType) {
 	return
 }
 
+// hostAvailability is how obtainable buildlets of a host type are,
+// from the coordinator's status.
+type hostAvailability struct {
+	Connected, Idle int // reverse buildlets connected, and idle of those
+	Waiting         int // requests waiting for a buildlet
+	GomotesWaiting  int // gomote requests of those, which go first
+}
+
+// availability returns the availability of the host types that
+// have connected reverse buildlets or waiting requests.
+func availability() (map[string]*hostAvailability, error) {
+	var reverse struct {
+		HostTypes map[string]struct {
+			Connected, Idle int
+		}
+	}
+	if err := getFarmerJSON("/status/reverse.json", &reverse); err != nil {
+		return nil, err
+	}
+	var sched struct {
+		HostTypes []struct {
+			HostType      string
+			Total, Gomote struct{ Count int }
+		}
+	}
+	if err := getFarmerJSON("/status/scheduler.json", &sched); err != nil {
+		return nil, err
+	}
+	avail := make(map[string]*hostAvailability)
+	host := func(hostType string) *hostAvailability {
+		if avail[hostType] == nil {
+			avail[hostType] = new(hostAvailability)
+		}
+		return avail[hostType]
+	}
+	for hostType, hs := range reverse.HostTypes {
+		host(hostType).Connected = hs.Connected
+		host(hostType).Idle = hs.Idle
+	}
+	for _, hs := range sched.HostTypes {
+		host(hs.HostType).Waiting = hs.Total.Count
+		host(hs.HostType).GomotesWaiting = hs.Gomote.Count
+	}
+	return avail, nil
+}
+
+func getFarmerJSON(path string, v interface{}) error {
+	res, err := http.Get("https://farmer.golang.org" + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("fetching %s: %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return nil
+}
+
+// fuzzyMatch reports whether the letters of query appear in name in
+// order, ignoring case, and how loosely: 0 for a substring, and more
+// the more letters lie between them.
+func fuzzyMatch(query, name string) (score int, ok bool) {
+	query, name = strings.ToLower(query), strings.ToLower(name)
+	if strings.Contains(name, query) {
+		return 0, true
+	}
+	start, i := -1, 0
+	for j := 0; j < len(name) && i < len(query); j++ {
+		if name[j] == query[i] {
+			if start < 0 {
+				start = j
+			}
+			if i++; i == len(query) {
+				return 1 + (j + 1 - start - len(query)), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// builderTypeJSON describes a builder type, as create -list -json
+// prints it.
+type builderTypeJSON struct {
+	Name     string `json:"name"`
+	HostType string `json:"hostType"`
+	GOOS     string `json:"goos"`
+	GOARCH   string `json:"goarch"`
+	Reverse  bool   `json:"reverse"`
+	// For reverse builders, Expected, Connected and Idle count
+	// their machines.
+	Expected       int `json:"expected,omitempty"`
+	Connected      int `json:"connected,omitempty"`
+	Idle           int `json:"idle,omitempty"`
+	Waiting        int `json:"waiting"`
+	GomotesWaiting int `json:"gomotesWaiting"`
+}
+
+// listFlags are the filters of create -list.
+type listFlags struct {
+	goos, goarch, host string
+	available          bool
+}
+
+// listBuilderTypes prints the builder types matching query and lf,
+// with how obtainable they are, closest matches first.
+func listBuilderTypes(query string, lf listFlags, jsonOut bool) error {
+	avail, err := availability()
+	if err != nil {
+		return err
+	}
+	type match struct {
+		bt    builderType
+		av    hostAvailability
+		score int
+	}
+	var matches []match
+	for _, bt := range builders() {
+		score, ok := fuzzyMatch(query, bt.Name)
+		if !ok ||
+			lf.goos != "" && bt.GOOS() != lf.goos ||
+			lf.goarch != "" && bt.GOARCH() != lf.goarch ||
+			!strings.Contains(bt.HostType, lf.host) {
+			continue
+		}
+		var av hostAvailability
+		if a := avail[bt.HostType]; a != nil {
+			av = *a
+		}
+		if lf.available && bt.IsReverse && av.Idle == 0 {
+			continue
+		}
+		matches = append(matches, match{bt, av, score})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score < matches[j].score })
+
+	if jsonOut {
+		bts := []builderTypeJSON{}
+		for _, m := range matches {
+			bt := builderTypeJSON{
+				Name:           m.bt.Name,
+				HostType:       m.bt.HostType,
+				GOOS:           m.bt.GOOS(),
+				GOARCH:         m.bt.GOARCH(),
+				Reverse:        m.bt.IsReverse,
+				Waiting:        m.av.Waiting,
+				GomotesWaiting: m.av.GomotesWaiting,
+			}
+			if m.bt.IsReverse {
+				bt.Expected, bt.Connected, bt.Idle = m.bt.ExpectNum, m.av.Connected, m.av.Idle
+			}
+			bts = append(bts, bt)
+		}
+		return writeJSON(os.Stdout, bts)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tHOST TYPE\tAVAILABILITY\tWAITING")
+	for _, m := range matches {
+		availStr := "on demand"
+		if m.bt.IsReverse {
+			availStr = fmt.Sprintf("%d idle of %d connected", m.av.Idle, m.av.Connected)
+			if m.bt.ExpectNum > 0 {
+				availStr += fmt.Sprintf(" (of %d)", m.bt.ExpectNum)
+			}
+		}
+		waiting := "-"
+		if m.av.Waiting > 0 {
+			waiting = fmt.Sprintf("%d (%d gomotes)", m.av.Waiting, m.av.GomotesWaiting)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.bt.Name, m.bt.HostType, availStr, waiting)
+	}
+	return tw.Flush()
+}
+
 func create(args []string) error {
 	fs := flag.NewFlagSet("create", flag.ContinueOnError)
 
 	fs.Usage = func() {
 		fmt.Fprintln(os.Stderr, "create usage: gomote create [create-opts] <type>")
+		fmt.Fprintln(os.Stderr, "              gomote create -list [list-opts] [query]")
 		fs.PrintDefaults()
 		fmt.Fprintln(os.Stderr, "\nValid types:")
 		for _, bt := range builders() {
@@ -96,6 +280,15 @@ func create(args []string) error {
 	}
 	var status bool
 	fs.BoolVar(&status, "status", true, "print regular status updates while waiting")
+	var jsonOut bool
+	fs.BoolVar(&jsonOut, "json", false, "print the instance as a JSON object with its name, builder type, host type, and creation and expiration times, instead of just its name; with -list, print the builder types as a JSON list")
+	var listTypes bool
+	fs.BoolVar(&listTypes, "list", false, "instead of creating an instance, list the builder types whose names fuzzily match the optional query, with how many of their machines are idle and how many requests are waiting for them")
+	var lf listFlags
+	fs.StringVar(&lf.goos, "goos", "", "with -list, only list builder types for this GOOS")
+	fs.StringVar(&lf.goarch, "goarch", "", "with -list, only list builder types for this GOARCH")
+	fs.StringVar(&lf.host, "host", "", "with -list, only list builder types whose host type contains this string, such as \"arm64\" or \"packet\"")
+	fs.BoolVar(&lf.available, "available", false, "with -list, only list builder types that can be obtained right now: those with idle machines, or created on demand")
 
 	// TODO(bradfitz): restore this option, and send it to the coordinator:
 	// For now, comment it out so it's not misleading.
@@ -103,6 +296,12 @@ func create(args []string) error {
 	// fs.DurationVar(&timeout, "timeout", 60*time.Minute, "how long the VM will live before being deleted.")
 
 	fs.Parse(args)
+	if listTypes {
+		if fs.NArg() > 1 {
+			fs.Usage()
+		}
+		return listBuilderTypes(fs.Arg(0), lf, jsonOut)
+	}
 	if fs.NArg() != 1 {
 		fs.Usage()
 	}
@@ -125,6 +324,19 @@ func create(args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to create buildlet: %v", err)
 	}
+	if jsonOut {
+		inst := instanceJSON{Name: client.RemoteName(), BuilderType: builderType}
+		rbs, err := cc.RemoteBuildlets()
+		if err != nil {
+			return fmt.Errorf("failed to look up new buildlet: %v", err)
+		}
+		for _, rb := range rbs {
+			if rb.Name == inst.Name {
+				inst = newInstanceJSON(rb)
+			}
+		}
+		return writeJSON(os.Stdout, inst)
+	}
 	fmt.Println(client.RemoteName())
 	return nil
 }
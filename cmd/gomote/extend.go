@@ -0,0 +1,85 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// keepAliveInterval is how often -keep-alive extends an instance's
+// lease, well within the coordinator's idle timeout.
+const keepAliveInterval = 5 * time.Minute
+
+func extend(args []string) error {
+	fs := flag.NewFlagSet("extend", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "extend usage: gomote extend [extend-opts] <instance>...")
+		fmt.Fprintln(os.Stderr, "\nInstances otherwise expire once idle for 30 minutes.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var d time.Duration
+	fs.DurationVar(&d, "duration", 0, "how long to keep the instances from now, up to 8h; defaults to the coordinator's idle timeout")
+	var keepAlive bool
+	fs.BoolVar(&keepAlive, "keep-alive", false, "keep extending the instances until interrupted, such as for the length of a debugging session")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+	}
+
+	var bcs []*buildlet.Client
+	for _, name := range fs.Args() {
+		bc, err := remoteClient(name)
+		if err != nil {
+			return err
+		}
+		if bc.RemoteName() == "" {
+			return fmt.Errorf("%s isn't a gomote-created instance; it doesn't expire", name)
+		}
+		bcs = append(bcs, bc)
+	}
+	ctx := context.Background()
+	for {
+		for _, bc := range bcs {
+			expires, err := bc.Extend(ctx, d)
+			if err != nil {
+				return fmt.Errorf("extending %s: %v", bc.RemoteName(), err)
+			}
+			fmt.Printf("%s\texpires in %v\n", bc.RemoteName(), time.Until(expires).Round(time.Second))
+		}
+		if !keepAlive {
+			return nil
+		}
+		time.Sleep(keepAliveInterval)
+	}
+}
+
+// keepAlive extends bc's lease every keepAliveInterval until ctx is
+// done. Buildlets not created by the coordinator don't expire, so
+// it's a no-op for them.
+func keepAlive(ctx context.Context, bc *buildlet.Client) {
+	if bc.RemoteName() == "" {
+		return
+	}
+	t := time.NewTicker(keepAliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := bc.Extend(ctx, 0); err != nil && ctx.Err() == nil {
+				log.Printf("Extending %s: %v", bc.RemoteName(), err)
+			}
+		}
+	}
+}
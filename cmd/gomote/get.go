@@ -6,10 +6,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/build/buildlet"
 )
 
 // get a .tar.gz
@@ -22,22 +29,307 @@ func getTar(args []string) error {
 	}
 	var dir string
 	fs.StringVar(&dir, "dir", "", "relative directory from buildlet's work dir to tar up")
+	var include, exclude patternList
+	fs.Var(&include, "include", "if set, only tar up files matching this path.Match pattern, or in directories matching it; patterns with a slash match paths relative to -dir, others base names. May be repeated.")
+	fs.Var(&exclude, "exclude", "leave out files and directories matching this pattern, as for -include. May be repeated.")
+	var out string
+	fs.StringVar(&out, "o", "", "write the tar.gz to this file instead of stdout")
+	var cont bool
+	fs.BoolVar(&cont, "c", false, "continue the download of the partial file named by -o, which must be of the same directory and patterns")
+	var progress bool
+	fs.BoolVar(&progress, "progress", isTerminal(os.Stderr), "report the progress of the download on stderr; defaults to whether stderr is a terminal")
 
 	fs.Parse(args)
+	noteInstanceArg(fs, args)
 	if fs.NArg() != 1 {
 		fs.Usage()
 	}
+	if cont && out == "" {
+		return errors.New("-c requires -o")
+	}
 
 	name := fs.Arg(0)
 	bc, err := remoteClient(name)
 	if err != nil {
 		return err
 	}
-	tgz, err := bc.GetTar(context.Background(), dir)
+	ctx := context.Background()
+	features, err := bc.Features(ctx)
+	if err != nil {
+		return err
+	}
+	if !features.Has(buildlet.FeatureResumableTransfers) {
+		if cont {
+			return fmt.Errorf("%s's buildlet is too old to continue downloads", name)
+		}
+		return getTarOnce(ctx, bc, dir, buildlet.TarOpts{Include: include, Exclude: exclude}, out)
+	}
+
+	var w io.Writer = os.Stdout
+	var have io.Reader
+	var written int64
+	if out != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if cont {
+			flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(out, flags, 0666)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if cont {
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			have, written = f, fi.Size()
+		}
+		w = f
+	}
+	var p *progressReporter
+	if progress {
+		p = newProgressReporter(dir+".tar.gz", written)
+		w = io.MultiWriter(w, p)
+	}
+	err = bc.GetTarResumableOpts(ctx, dir, buildlet.TarOpts{Include: include, Exclude: exclude}, have, w)
+	if p != nil {
+		p.done()
+	}
+	if errors.Is(err, buildlet.ErrChanged) {
+		return fmt.Errorf("%v; download it again, without -c", err)
+	}
+	if err != nil && out != "" {
+		return fmt.Errorf("%v; continue with gomote gettar -c", err)
+	}
+	return err
+}
+
+// getTarOnce downloads the tar.gz of dir from a buildlet too old to
+// resume downloads, to out, or stdout if out is empty.
+func getTarOnce(ctx context.Context, bc *buildlet.Client, dir string, opts buildlet.TarOpts, out string) error {
+	tgz, err := bc.GetTarOpts(ctx, dir, opts)
 	if err != nil {
 		return err
 	}
 	defer tgz.Close()
-	_, err = io.Copy(os.Stdout, tgz)
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, tgz)
 	return err
 }
+
+// getFile downloads a single file from a buildlet, in chunks, which
+// are resumed if interrupted.
+func getFile(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "get usage: gomote get [get-opts] <instance> <remote-file> [local-file]")
+		fmt.Fprintln(os.Stderr, "\nThe remote file is relative to the work directory. The local file defaults to its base name, or is stdout if '-'.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var parallel int
+	fs.IntVar(&parallel, "parallel", 4, "how many chunks of the file to download at once, up to 8")
+	var cont bool
+	fs.BoolVar(&cont, "c", false, "continue the download of a partial local file of the same remote file, rather than start over")
+	var progress bool
+	fs.BoolVar(&progress, "progress", isTerminal(os.Stderr), "report the progress of the download on stderr; defaults to whether stderr is a terminal")
+	fs.Parse(args)
+	noteInstanceArg(fs, args)
+	if n := fs.NArg(); n < 2 || n > 3 {
+		fs.Usage()
+	}
+	name, remote, local := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	if local == "" {
+		local = path.Base(remote)
+	}
+
+	bc, err := remoteClient(name)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	features, err := bc.Features(ctx)
+	if err != nil {
+		return err
+	}
+	if !features.Has(buildlet.FeatureFileDownload) {
+		return fmt.Errorf("%s's buildlet is too old to download single files; use gomote gettar", name)
+	}
+
+	opts := buildlet.GetFileOpts{Parallel: parallel}
+	if progress {
+		p := newProgressReporter(remote, 0)
+		defer p.done()
+		opts.Progress = p.update
+	}
+	if local == "-" {
+		if cont {
+			return errors.New("can't continue a download to stdout")
+		}
+		// Stdout can't be written at offsets, so go through a
+		// temporary file.
+		tmp, err := ioutil.TempFile("", "gomote-get-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := bc.GetFile(ctx, remote, tmp, opts); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, tmp)
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if !cont {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(local, flags, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if cont {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		opts.Offset = fi.Size()
+	}
+	size, err := bc.GetFile(ctx, remote, f, opts)
+	if errors.Is(err, buildlet.ErrChanged) {
+		return fmt.Errorf("%s: %v; download it again, without -c", remote, err)
+	}
+	if err != nil {
+		if fi, serr := f.Stat(); serr == nil && fi.Size() == 0 {
+			// Nothing was downloaded.
+			f.Close()
+			os.Remove(local)
+			return err
+		}
+		return fmt.Errorf("%v; continue with gomote get -c", err)
+	}
+	// A partial local file may have been longer than the remote one.
+	return f.Truncate(size)
+}
+
+// isTerminal reports whether f is a terminal, or at least a character
+// device.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progressInterval is how often a progressReporter updates its
+// report.
+const progressInterval = 250 * time.Millisecond
+
+// A progressReporter keeps a line on stderr up to date with the
+// progress of a download: how many bytes it has, out of how many if
+// known, and its rate.
+type progressReporter struct {
+	name  string
+	start time.Time
+	base  int64 // bytes had before the download started
+
+	mu    sync.Mutex
+	have  int64
+	size  int64 // or -1 if unknown
+	shown time.Time
+}
+
+func newProgressReporter(name string, have int64) *progressReporter {
+	return &progressReporter{name: name, start: time.Now(), base: have, have: have, size: -1}
+}
+
+// Write counts p as downloaded, for downloads of unknown size.
+func (p *progressReporter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.have += int64(len(b))
+	p.showLocked(false)
+	return len(b), nil
+}
+
+// update records that have bytes of size are downloaded.
+func (p *progressReporter) update(have, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.size < 0 {
+		// The offset the download started from.
+		p.base = have
+	}
+	p.have, p.size = have, size
+	p.showLocked(false)
+}
+
+// done shows the final progress, and ends its line.
+func (p *progressReporter) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.showLocked(true)
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progressReporter) showLocked(force bool) {
+	now := time.Now()
+	if !force && now.Sub(p.shown) < progressInterval {
+		return
+	}
+	p.shown = now
+	var rate float64
+	if d := now.Sub(p.start).Seconds(); d > 0 {
+		rate = float64(p.have-p.base) / d
+	}
+	msg := fmt.Sprintf("%s: %s", p.name, formatBytes(float64(p.have)))
+	if p.size >= 0 {
+		pct := 100.0
+		if p.size > 0 {
+			pct = 100 * float64(p.have) / float64(p.size)
+		}
+		msg += fmt.Sprintf(" of %s (%.0f%%)", formatBytes(float64(p.size)), pct)
+	}
+	msg += fmt.Sprintf(", %s/s", formatBytes(rate))
+	// Clear the rest of the line, in case it got shorter.
+	fmt.Fprintf(os.Stderr, "\r%s\x1b[K", msg)
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n float64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, units[i])
+}
+
+// patternList is a flag.Value of a repeated flag's patterns.
+type patternList []string
+
+func (*patternList) String() string { return "" } // default value
+
+func (pl *patternList) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return fmt.Errorf("bad pattern %q: %v", v, err)
+	}
+	*pl = append(*pl, v)
+	return nil
+}
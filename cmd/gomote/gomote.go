@@ -25,7 +25,10 @@ To list the subcommands, run "gomote" without arguments:
 
     create     create a buildlet; with no args, list types of buildlets
     destroy    destroy a buildlet
+    extend     extend the lease of buildlets before they expire
+    get        download a file from a buildlet
     gettar     extract a tar.gz from a buildlet
+    group      operate on a named group of buildlets at once
     list       list active buildlets
     ls         list the contents of a directory on a buildlet
     ping       test whether a buildlet is alive and reachable
@@ -34,8 +37,11 @@ To list the subcommands, run "gomote" without arguments:
     put14      put Go 1.4 in place
     puttar     extract a tar.gz to a buildlet
     rm         delete files or directories
+    rsync      sync a local directory to a buildlet, sending only changed files
     rdp        RDP (Remote Desktop Protocol) to a Windows buildlet
     run        run a command on a buildlet
+    script     record the commands run on a buildlet, and replay them
+    sftp       sftp to a buildlet's files
     ssh        ssh to a buildlet
 
 To list all the builder types available, run "create" with no arguments:
@@ -43,6 +49,13 @@ To list all the builder types available, run "create" with no arguments:
   $ gomote create
   (list tons of buildlet types)
 
+To find the types worth asking for, list those matching a fuzzy query,
+filtered by GOOS, GOARCH, or host type, with how many of their machines
+are idle and how many requests are waiting for them:
+
+  $ gomote create -list -goarch arm64 -available
+  $ gomote create -list la64
+
 The "gomote run" command has many of its own flags:
 
   $ gomote run -h
@@ -61,6 +74,13 @@ The "gomote run" command has many of its own flags:
     -e value
           Environment variable KEY=value. The -e flag may be repeated
           multiple times to add multiple things to the environment.
+    -json
+          instead of the command's output, print a JSON object with its
+          stdout, stderr, exit code, and duration once it's done
+    -keep-alive
+          keep extending the instance's lease while the command runs, so
+          that it doesn't expire during commands running longer than the
+          idle timeout
     -path string
           Comma-separated list of ExecOpts.Path elements. The special
           string 'EMPTY' means to run without any $PATH. The empty
@@ -70,6 +90,51 @@ The "gomote run" command has many of its own flags:
           expands to the buildlet's temp workdir.
     -system
           run inside the system, and not inside the workdir; this is implicit if cmd starts with '/'
+    -timeout duration
+          if non-zero, how long the command may run before the buildlet kills it
+
+To work with several builders at once, put their instances in a group,
+and operate on all of them in parallel, with each line of output
+prefixed by the instance it came from:
+
+  $ gomote group create mygroup linux-amd64 windows-amd64-2016 darwin-amd64-11_0
+  $ gomote group put mygroup testdata.txt
+  $ gomote group run mygroup go/src/make.bash
+  $ gomote group destroy mygroup
+
+To reach a server or debugger listening on the instance's localhost,
+forward a local port to it with ssh's -L flag, or run a SOCKS5 proxy
+with -D, through the coordinator's SSH gateway. -R forwards a port on
+the instance's localhost to a local server the other way:
+
+  $ gomote ssh -N -L 8080:localhost:8080 -D 1080 user-username-linux-amd64-0
+  $ gomote ssh -N -R 9000:localhost:9000 user-username-linux-amd64-0
+
+Instances expire once idle for 30 minutes. To keep one for longer,
+such as for a long debugging session, extend its lease, or keep
+extending it until interrupted:
+
+  $ gomote extend -duration 4h user-username-linux-amd64-0
+  $ gomote extend -keep-alive user-username-linux-amd64-0
+
+To reproduce a failure on a fresh instance, record the commands that
+lead to it, and replay them on another instance of the same type:
+
+  $ gomote script record repro.json user-username-linux-amd64-0
+  $ gomote push user-username-linux-amd64-0
+  $ gomote run user-username-linux-amd64-0 go/src/make.bash
+  $ gomote script stop
+  $ gomote script replay repro.json user-username-linux-amd64-1
+
+To fetch large test artifacts, such as from faraway reverse builders,
+download single files in parallel chunks, or a tar.gz of a directory to
+a file, showing progress, and continue downloads that failed partway
+with -c:
+
+  $ gomote get user-username-linux-amd64-0 go/pkg/testdata.bin
+  $ gomote get -c user-username-linux-amd64-0 go/pkg/testdata.bin
+  $ gomote gettar -dir go/pkg -o pkg.tar.gz user-username-linux-amd64-0
+  $ gomote gettar -c -dir go/pkg -o pkg.tar.gz user-username-linux-amd64-0
 
 Debugging buildlets directly
 
@@ -142,7 +207,10 @@ func registerCommand(name, des string, run func([]string) error) {
 func registerCommands() {
 	registerCommand("create", "create a buildlet; with no args, list types of buildlets", create)
 	registerCommand("destroy", "destroy a buildlet", destroy)
+	registerCommand("extend", "extend the lease of buildlets before they expire", extend)
+	registerCommand("get", "download a file from a buildlet", getFile)
 	registerCommand("gettar", "extract a tar.gz from a buildlet", getTar)
+	registerCommand("group", "operate on a named group of buildlets at once", groupCmd)
 	registerCommand("ls", "list the contents of a directory on a buildlet", ls)
 	registerCommand("list", "list active buildlets", list)
 	registerCommand("ping", "test whether a buildlet is alive and reachable ", ping)
@@ -152,7 +220,10 @@ func registerCommands() {
 	registerCommand("puttar", "extract a tar.gz to a buildlet", putTar)
 	registerCommand("rdp", "RDP (Remote Desktop Protocol) to a Windows buildlet", rdp)
 	registerCommand("rm", "delete files or directories", rm)
+	registerCommand("rsync", "sync a local directory to a buildlet, sending only changed files", rsync)
 	registerCommand("run", "run a command on a buildlet", run)
+	registerCommand("script", "record the commands run on a buildlet, and replay them", script)
+	registerCommand("sftp", "sftp to a buildlet's files", sftp)
 	registerCommand("ssh", "ssh to a buildlet", ssh)
 }
 
@@ -173,6 +244,9 @@ func main() {
 		usage()
 	}
 	err := cmd.run(args[1:])
+	if rerr := recordStep(cmdName, args[1:], err); rerr != nil {
+		fmt.Fprintf(os.Stderr, "Error recording %s: %v\n", cmdName, rerr)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error running %s: %v\n", cmdName, err)
 		os.Exit(1)
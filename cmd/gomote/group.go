@@ -0,0 +1,409 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/build/buildlet"
+	"golang.org/x/build/types"
+)
+
+// A group is a named set of instances that the group command
+// operates on at once. Groups are kept in the gomote config
+// directory.
+type group struct {
+	Instances []string `json:"instances"`
+}
+
+func groupFile(name string) string {
+	return filepath.Join(buildlet.ConfigDir(), "groups", name+".json")
+}
+
+func validGroupName(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// loadGroup returns the named group, which must exist.
+func loadGroup(name string) (*group, error) {
+	if !validGroupName(name) {
+		return nil, fmt.Errorf("invalid group name %q", name)
+	}
+	b, err := ioutil.ReadFile(groupFile(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no group %q; create it with \"gomote group create\"", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	g := new(group)
+	if err := json.Unmarshal(b, g); err != nil {
+		return nil, fmt.Errorf("reading group %q: %v", name, err)
+	}
+	return g, nil
+}
+
+func saveGroup(name string, g *group) error {
+	b, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(groupFile(name)), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(groupFile(name), b, 0600)
+}
+
+var groupOps = map[string]func(args []string) error{
+	"create":  groupCreate,
+	"destroy": groupDestroy,
+	"list":    groupList,
+	"put":     groupPut,
+	"run":     groupRun,
+}
+
+func groupCmd(args []string) error {
+	if len(args) == 0 || groupOps[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, `group usage: gomote group <op> [op-opts] <group> [args...]
+
+Ops:
+
+  create   create instances of the given builder types and add them to the group
+  destroy  destroy the group's instances and forget the group
+  list     list groups, or the instances of a group
+  put      put a file on each instance
+  run      run a command on each instance
+
+Ops apply to the group's instances in parallel, prefixing each line of
+output with the name of the instance it came from.`)
+		os.Exit(1)
+	}
+	return groupOps[args[0]](args[1:])
+}
+
+// forEachInstance calls f for each of the group's instances in
+// parallel, with writers of its stdout and stderr that prefix each
+// line with the instance's name. It reports each failure on stderr,
+// and returns an error if any.
+func forEachInstance(g *group, f func(inst string, stdout, stderr io.Writer) error) error {
+	var outMu sync.Mutex // serializes lines of output
+	var wg sync.WaitGroup
+	errs := make([]error, len(g.Instances))
+	for i, inst := range g.Instances {
+		wg.Add(1)
+		go func(i int, inst string) {
+			defer wg.Done()
+			stdout := &prefixWriter{mu: &outMu, w: os.Stdout, prefix: inst + ": "}
+			stderr := &prefixWriter{mu: &outMu, w: os.Stderr, prefix: inst + ": "}
+			errs[i] = f(inst, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+		}(i, inst)
+	}
+	wg.Wait()
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", g.Instances[i], err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d of %d instances", failed, len(g.Instances))
+	}
+	return nil
+}
+
+// A prefixWriter writes whole lines to w, each prefixed with prefix.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte // incomplete last line
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	i := bytes.LastIndexByte(pw.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := pw.buf[:i+1]
+	var out bytes.Buffer
+	for len(lines) > 0 {
+		j := bytes.IndexByte(lines, '\n')
+		out.WriteString(pw.prefix)
+		out.Write(lines[:j+1])
+		lines = lines[j+1:]
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[i+1:]...)
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if _, err := pw.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes any incomplete last line.
+func (pw *prefixWriter) Flush() {
+	if len(pw.buf) > 0 {
+		pw.Write([]byte("\n"))
+	}
+}
+
+func groupCreate(args []string) error {
+	fs := flag.NewFlagSet("group create", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group create usage: gomote group create [create-opts] <group> <type>...")
+		fmt.Fprintln(os.Stderr, "\nIf the group exists, the new instances are added to it. Run \"gomote create\" for the valid types.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var status bool
+	fs.BoolVar(&status, "status", true, "print regular status updates while waiting")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+	}
+	name, builderTypes := fs.Arg(0), fs.Args()[1:]
+	if !validGroupName(name) {
+		return fmt.Errorf("invalid group name %q", name)
+	}
+	g := new(group)
+	if _, err := os.Stat(groupFile(name)); err == nil {
+		if g, err = loadGroup(name); err != nil {
+			return err
+		}
+	}
+
+	cc, err := buildlet.NewCoordinatorClientFromFlags()
+	if err != nil {
+		return fmt.Errorf("failed to create coordinator client: %v", err)
+	}
+	// Create the instances as if they were already in a group
+	// named after their types, for forEachInstance's output.
+	var (
+		mu      sync.Mutex
+		created []string
+	)
+	err = forEachInstance(&group{Instances: builderTypes}, func(builderType string, stdout, stderr io.Writer) error {
+		t := time.Now()
+		client, err := cc.CreateBuildletWithStatus(builderType, func(st types.BuildletWaitStatus) {
+			if status {
+				if st.Message != "" {
+					fmt.Fprintf(stderr, "# %s\n", st.Message)
+					return
+				}
+				fmt.Fprintf(stderr, "# still creating %s after %v; %d requests ahead of you\n", builderType, time.Since(t).Round(time.Second), st.Ahead)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create buildlet: %v", err)
+		}
+		fmt.Fprintln(stdout, client.RemoteName())
+		mu.Lock()
+		created = append(created, client.RemoteName())
+		mu.Unlock()
+		return nil
+	})
+	if len(created) > 0 {
+		sort.Strings(created)
+		g.Instances = append(g.Instances, created...)
+		if err := saveGroup(name, g); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func groupDestroy(args []string) error {
+	fs := flag.NewFlagSet("group destroy", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group destroy usage: gomote group destroy <group>")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	name := fs.Arg(0)
+	g, err := loadGroup(name)
+	if err != nil {
+		return err
+	}
+	var (
+		mu   sync.Mutex
+		left []string // instances that failed to be destroyed
+	)
+	err = forEachInstance(g, func(inst string, stdout, stderr io.Writer) error {
+		bc, err := remoteClient(inst)
+		if err == nil {
+			err = bc.Close()
+		}
+		if err != nil {
+			mu.Lock()
+			left = append(left, inst)
+			mu.Unlock()
+		}
+		return err
+	})
+	if len(left) > 0 {
+		// Keep them, so that destroy can be retried.
+		sort.Strings(left)
+		g.Instances = left
+		if err := saveGroup(name, g); err != nil {
+			return err
+		}
+		return err
+	}
+	return os.Remove(groupFile(name))
+}
+
+func groupList(args []string) error {
+	fs := flag.NewFlagSet("group list", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group list usage: gomote group list [group]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+		files, err := filepath.Glob(groupFile("*"))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			fmt.Println(strings.TrimSuffix(filepath.Base(f), ".json"))
+		}
+	case 1:
+		g, err := loadGroup(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		for _, inst := range g.Instances {
+			fmt.Println(inst)
+		}
+	default:
+		fs.Usage()
+	}
+	return nil
+}
+
+func groupRun(args []string) error {
+	fs := flag.NewFlagSet("group run", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group run usage: gomote group run [run-opts] <group> <cmd> [args...]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var rf runFlags
+	rf.register(fs)
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+	}
+	g, err := loadGroup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cmd, cmdArgs := fs.Arg(1), fs.Args()[2:]
+	var jsonMu sync.Mutex
+	return forEachInstance(g, func(inst string, stdout, stderr io.Writer) error {
+		if rf.json {
+			// Each result is a line of JSON naming its
+			// instance, so don't prefix it.
+			stdout = &prefixWriter{mu: &jsonMu, w: os.Stdout}
+		}
+		return rf.exec(inst, cmd, cmdArgs, stdout)
+	})
+}
+
+func groupPut(args []string) error {
+	fs := flag.NewFlagSet("group put", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "group put usage: gomote group put [put-opts] <group> <source or '-' for stdin> [destination]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	modeStr := fs.String("mode", "", "Unix file mode (octal); default to source file mode")
+	fs.Parse(args)
+	if n := fs.NArg(); n < 2 || n > 3 {
+		fs.Usage()
+	}
+	g, err := loadGroup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Read the source once, as each instance gets a copy.
+	var data []byte
+	var mode os.FileMode = 0666
+	src := fs.Arg(1)
+	if src == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(src)
+		if err == nil && *modeStr == "" {
+			var fi os.FileInfo
+			if fi, err = os.Stat(src); err == nil {
+				mode = fi.Mode()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if *modeStr != "" {
+		modeInt, err := strconv.ParseInt(*modeStr, 8, 64)
+		if err != nil {
+			return err
+		}
+		mode = os.FileMode(modeInt)
+		if !mode.IsRegular() {
+			return fmt.Errorf("bad mode: %v", mode)
+		}
+	}
+	dest := fs.Arg(2)
+	if dest == "" {
+		if src == "-" {
+			return errors.New("must specify destination file name when source is standard input")
+		}
+		dest = filepath.Base(src)
+	}
+
+	ctx := context.Background()
+	return forEachInstance(g, func(inst string, stdout, stderr io.Writer) error {
+		bc, err := remoteClient(inst)
+		if err != nil {
+			return err
+		}
+		return bc.Put(ctx, bytes.NewReader(data), dest, mode)
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// The -json flags of create, list, and run make them print these
+// instead of their usual output, each as one line of JSON, so that
+// scripts can drive gomotes.
+
+// instanceJSON describes an instance, as create -json and list -json
+// print it.
+type instanceJSON struct {
+	Name        string    `json:"name"`
+	BuilderType string    `json:"builderType"`
+	HostType    string    `json:"hostType,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+func newInstanceJSON(rb buildlet.RemoteBuildlet) instanceJSON {
+	return instanceJSON{
+		Name:        rb.Name,
+		BuilderType: rb.BuilderType,
+		HostType:    rb.HostType,
+		Created:     rb.Created,
+		Expires:     rb.Expires,
+	}
+}
+
+// runJSON is the result of a command, as run -json prints it.
+type runJSON struct {
+	Instance string   `json:"instance"`
+	Cmd      string   `json:"cmd"`
+	Args     []string `json:"args"`
+	// ExitCode is the command's exit code, or -1 if it did not
+	// exit normally.
+	ExitCode int    `json:"exitCode"`
+	Signal   string `json:"signal,omitempty"`
+	// Duration is how long the command ran, in seconds.
+	Duration float64 `json:"duration"`
+	// Limit names the limit the command was killed for exceeding,
+	// such as "time" for -timeout.
+	Limit string `json:"limit,omitempty"`
+	// Error describes why the command failed or couldn't be run,
+	// if it did.
+	Error  string `json:"error,omitempty"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+// writeJSON writes v to w as a line of JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -19,10 +19,12 @@ import (
 func list(args []string) error {
 	fs := flag.NewFlagSet("list", flag.ContinueOnError)
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "list usage: gomote list")
+		fmt.Fprintln(os.Stderr, "list usage: gomote list [list-opts]")
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
+	var jsonOut bool
+	fs.BoolVar(&jsonOut, "json", false, "print the instances as a JSON list of objects with their name, builder type, host type, and creation and expiration times")
 	fs.Parse(args)
 	if fs.NArg() != 0 {
 		fs.Usage()
@@ -36,6 +38,13 @@ func list(args []string) error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if jsonOut {
+		insts := []instanceJSON{}
+		for _, rb := range rbs {
+			insts = append(insts, newInstanceJSON(rb))
+		}
+		return writeJSON(os.Stdout, insts)
+	}
 	for _, rb := range rbs {
 		fmt.Printf("%s\t%s\t%s\texpires in %v\n", rb.Name, rb.BuilderType, rb.HostType, rb.Expires.Sub(time.Now()))
 	}
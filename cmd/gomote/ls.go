@@ -27,6 +27,10 @@ func ls(args []string) error {
 	fs.BoolVar(&digest, "d", false, "get file digests")
 	var skip string
 	fs.StringVar(&skip, "skip", "", "comma-separated list of relative directories to skip (use forward slashes)")
+	var glob string
+	fs.StringVar(&glob, "glob", "", "comma-separated list of patterns to list only matching files, such as '*.log' or 'bin/*'")
+	var depth int
+	fs.IntVar(&depth, "depth", 0, "with -R, maximum depth to list; 0 means no limit")
 	fs.Parse(args)
 
 	dir := "."
@@ -44,6 +48,10 @@ func ls(args []string) error {
 		Recursive: recursive,
 		Digest:    digest,
 		Skip:      strings.Split(skip, ","),
+		MaxDepth:  depth,
+	}
+	if glob != "" {
+		opts.Glob = strings.Split(glob, ",")
 	}
 	return bc.ListDir(context.Background(), dir, opts, func(bi buildlet.DirEntry) {
 		fmt.Fprintf(os.Stdout, "%s\n", bi)
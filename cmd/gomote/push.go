@@ -35,6 +35,7 @@ func push(args []string) error {
 		os.Exit(1)
 	}
 	fs.Parse(args)
+	noteInstanceArg(fs, args)
 
 	goroot := os.Getenv("GOROOT")
 	if goroot == "" {
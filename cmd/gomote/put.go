@@ -35,6 +35,7 @@ func putTar(args []string) error {
 	fs.StringVar(&tarURL, "url", "", "URL of tarball, instead of provided file.")
 
 	fs.Parse(args)
+	noteInstanceArg(fs, args)
 	if fs.NArg() < 1 || fs.NArg() > 2 {
 		fs.Usage()
 	}
@@ -98,6 +99,7 @@ func put14(args []string) error {
 		os.Exit(1)
 	}
 	fs.Parse(args)
+	noteInstanceArg(fs, args)
 	if fs.NArg() != 1 {
 		fs.Usage()
 	}
@@ -125,6 +127,7 @@ func put(args []string) error {
 	}
 	modeStr := fs.String("mode", "", "Unix file mode (octal); default to source file mode")
 	fs.Parse(args)
+	noteInstanceArg(fs, args)
 	if n := fs.NArg(); n < 2 || n > 3 {
 		fs.Usage()
 	}
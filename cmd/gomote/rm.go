@@ -20,6 +20,7 @@ func rm(args []string) error {
 		os.Exit(1)
 	}
 	fs.Parse(args)
+	noteInstanceArg(fs, args)
 
 	if fs.NArg() < 2 {
 		fs.Usage()
@@ -0,0 +1,311 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"golang.org/x/build/buildlet"
+)
+
+// rsync syncs a local directory to an instance like push syncs
+// GOROOT, comparing the SHA-256 digests of the local files with the
+// instance's manifest of its copy and sending only what differs.
+func rsync(args []string) error {
+	fs := flag.NewFlagSet("rsync", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "rsync usage: gomote rsync [rsync-opts] <instance> <local-dir> [remote-dir]")
+		fmt.Fprintln(os.Stderr, "\nThe remote directory is relative to the work directory, and defaults to the base name of the local one.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var dryRun bool
+	fs.BoolVar(&dryRun, "dry-run", false, "print what would be done only")
+	var del bool
+	fs.BoolVar(&del, "delete", false, "delete remote files and directories that don't exist locally")
+	var exclude patternList
+	fs.Var(&exclude, "exclude", "neither send nor delete files and directories matching this path.Match pattern; patterns with a slash match paths relative to the directories, others base names. May be repeated.")
+	fs.Parse(args)
+	noteInstanceArg(fs, args)
+	if n := fs.NArg(); n < 2 || n > 3 {
+		fs.Usage()
+	}
+	name, localDir, remoteDir := fs.Arg(0), filepath.Clean(fs.Arg(1)), fs.Arg(2)
+	if remoteDir == "" {
+		remoteDir = filepath.Base(localDir)
+	}
+
+	bc, err := remoteClient(name)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	features, err := bc.Features(ctx)
+	if err != nil {
+		return err
+	}
+	if !features.Has(buildlet.FeatureManifests) {
+		return fmt.Errorf("%s's buildlet is too old to list file digests; use gomote push or puttar", name)
+	}
+
+	local, err := localManifest(localDir, exclude)
+	if err != nil {
+		return fmt.Errorf("error enumerating local files: %v", err)
+	}
+	remote, err := bc.Manifest(ctx, remoteDir)
+	// A missing remote directory is just empty.
+	if err != nil && !strings.HasPrefix(err.Error(), "404 ") {
+		return fmt.Errorf("error listing buildlet's existing files: %v", err)
+	}
+	// Leave excluded remote files alone.
+	var kept []buildlet.ManifestEntry
+	for _, e := range remote.Entries {
+		if !excluded(exclude, strings.TrimSuffix(e.Path, "/")) {
+			kept = append(kept, e)
+		}
+	}
+	remote.Entries = kept
+
+	localEntries := make(map[string]buildlet.ManifestEntry)
+	for _, e := range local.Entries {
+		localEntries[e.Path] = e
+	}
+	remoteEntries := make(map[string]buildlet.ManifestEntry)
+	var removed []string // sorted, as remote.Entries are
+	for _, e := range remote.Entries {
+		remoteEntries[e.Path] = e
+		if _, ok := localEntries[e.Path]; !ok {
+			removed = append(removed, e.Path)
+		}
+	}
+	var toSend, toDel []string
+	for _, e := range local.Entries {
+		r, ok := remoteEntries[e.Path]
+		if ok && sameEntry(e, r) {
+			continue
+		}
+		if ok && r.Mode.Type() != e.Mode.Type() {
+			// Replace a remote symlink by a file or the other
+			// way around.
+			toDel = append(toDel, e.Path)
+		}
+		toSend = append(toSend, e.Path)
+	}
+	for _, p := range removed {
+		p = strings.TrimSuffix(p, "/")
+		_, file := localEntries[p]
+		_, dir := localEntries[p+"/"]
+		switch {
+		case file || dir:
+			// Replaced locally by a directory or a file.
+			toDel = append(toDel, p)
+		case del && !parentListed(removed, p):
+			toDel = append(toDel, p)
+		}
+	}
+
+	if len(toDel) > 0 {
+		sort.Strings(toDel)
+		remotePaths := make([]string, len(toDel))
+		for i, p := range toDel {
+			remotePaths[i] = path.Join(remoteDir, p)
+		}
+		if dryRun {
+			log.Printf("(Dry-run) Would have deleted remote files: %q", remotePaths)
+		} else {
+			log.Printf("Deleting remote files: %q", remotePaths)
+			if err := bc.RemoveAll(ctx, remotePaths...); err != nil {
+				return fmt.Errorf("Deleting remote unwanted files: %v", err)
+			}
+		}
+	}
+	if len(toSend) == 0 {
+		if len(toDel) == 0 {
+			log.Printf("%s is up to date", remoteDir)
+		}
+		return nil
+	}
+	sort.Strings(toSend)
+	var size int64
+	for _, p := range toSend {
+		size += localEntries[p].Size
+	}
+	if dryRun {
+		log.Printf("(Dry-run) Would have sent %d new/changed files and directories (%d bytes): %q", len(toSend), size, toSend)
+		return nil
+	}
+	log.Printf("Sending %d new/changed files and directories (%d bytes)", len(toSend), size)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeEntriesTgz(pw, localDir, toSend))
+	}()
+	defer pr.Close()
+	if err := bc.PutTar(ctx, pr, remoteDir); err != nil {
+		return fmt.Errorf("writing tarball to buildlet: %v", err)
+	}
+	return nil
+}
+
+// localManifest returns the manifest of dir, as a buildlet would
+// list it, leaving out what exclude matches.
+func localManifest(dir string, exclude []string) (buildlet.Manifest, error) {
+	m := buildlet.Manifest{Dir: dir}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(p, dir)), "/")
+		if rel == "" {
+			return nil
+		}
+		if isEditorBackup(p) || excluded(exclude, rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := buildlet.ManifestEntry{Path: rel, Mode: fi.Mode()}
+		switch {
+		case fi.IsDir():
+			e.Path += "/"
+		case fi.Mode().IsRegular():
+			e.Size = fi.Size()
+			if e.SHA256, err = fileSHA256(p); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			if e.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Ignoring local non-regular file %s: %v", rel, fi.Mode())
+			return nil
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	return m, err
+}
+
+// sameEntry reports whether the local manifest entry l matches the
+// remote one r. Only the executable bits of file modes count, and not
+// at all from Windows, which has none.
+func sameEntry(l, r buildlet.ManifestEntry) bool {
+	switch {
+	case l.Mode.Type() != r.Mode.Type():
+		return false
+	case l.Mode.IsRegular():
+		return l.SHA256 == r.SHA256 && (runtime.GOOS == "windows" || l.Mode&0111 == r.Mode&0111)
+	case l.Mode&os.ModeSymlink != 0:
+		return l.Link == r.Link
+	}
+	return true
+}
+
+// excluded reports whether any of pats matches rel or one of its
+// parent directories, as tarutil.Filter patterns do.
+func excluded(pats []string, rel string) bool {
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pat := range pats {
+			target := p
+			if !strings.Contains(pat, "/") {
+				target = path.Base(p)
+			}
+			if ok, _ := path.Match(pat, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parentListed reports whether a parent directory of p is in the
+// sorted manifest paths, so that removing it removes p too.
+func parentListed(paths []string, p string) bool {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		i := sort.SearchStrings(paths, dir+"/")
+		if i < len(paths) && paths[i] == dir+"/" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEntriesTgz writes a tar.gz of the entries of dir with the
+// given manifest paths to w.
+func writeEntriesTgz(w io.Writer, dir string, paths []string) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, p := range paths {
+		if err := writeEntry(tw, dir, p); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeEntry(tw *tar.Writer, dir, p string) error {
+	name := filepath.Join(dir, filepath.FromSlash(strings.TrimSuffix(p, "/")))
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(name); err != nil {
+			return err
+		}
+	}
+	h, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	h.Name = p // forward slash, with a trailing one for directories
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(tw, f, h.Size); err != nil {
+		return fmt.Errorf("error copying contents of %s: %v", p, err)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := sha256.New()
+	if _, err := io.Copy(s, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", s.Sum(nil)), nil
+}
@@ -5,11 +5,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/build/buildlet"
 	"golang.org/x/build/dashboard"
@@ -23,64 +26,125 @@ func run(args []string) error {
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
-	var sys bool
-	fs.BoolVar(&sys, "system", false, "run inside the system, and not inside the workdir; this is implicit if cmd starts with '/'")
-	var debug bool
-	fs.BoolVar(&debug, "debug", false, "write debug info about the command's execution before it begins")
-	var env stringSlice
-	fs.Var(&env, "e", "Environment variable KEY=value. The -e flag may be repeated multiple times to add multiple things to the environment.")
-	var firewall bool
-	fs.BoolVar(&firewall, "firewall", false, "Enable outbound firewall on machine. This is on by default on many builders (where supported) but disabled by default on gomote for ease of debugging. Once any command has been run with the -firewall flag on, it's on for the lifetime of that gomote instance.")
-	var path string
-	fs.StringVar(&path, "path", "", "Comma-separated list of ExecOpts.Path elements. The special string 'EMPTY' means to run without any $PATH. The empty string (default) does not modify the $PATH. Otherwise, the following expansions apply: the string '$PATH' expands to the current PATH element(s), the substring '$WORKDIR' expands to the buildlet's temp workdir.")
-
-	var dir string
-	fs.StringVar(&dir, "dir", "", "Directory to run from. Defaults to the directory of the command, or the work directory if -system is true.")
-	var builderEnv string
-	fs.StringVar(&builderEnv, "builderenv", "", "Optional alternate builder to act like. Must share the same underlying buildlet host type, or it's an error. For instance, linux-amd64-race or linux-386-387 are compatible with linux-amd64, but openbsd-amd64 and openbsd-386 are different hosts.")
+	var rf runFlags
+	rf.register(fs)
 
 	fs.Parse(args)
+	noteInstanceArg(fs, args)
 	if fs.NArg() < 2 {
 		fs.Usage()
 	}
-	name, cmd := fs.Arg(0), fs.Arg(1)
+	return rf.exec(fs.Arg(0), fs.Arg(1), fs.Args()[2:], os.Stdout)
+}
+
+// runFlags are the options of the run command, shared with group run.
+type runFlags struct {
+	sys        bool
+	debug      bool
+	env        stringSlice
+	firewall   bool
+	path       string
+	dir        string
+	builderEnv string
+	json       bool
+	keepAlive  bool
+	timeout    time.Duration
+}
 
-	var conf *dashboard.BuildConfig
+func (rf *runFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&rf.sys, "system", false, "run inside the system, and not inside the workdir; this is implicit if cmd starts with '/'")
+	fs.BoolVar(&rf.debug, "debug", false, "write debug info about the command's execution before it begins")
+	fs.Var(&rf.env, "e", "Environment variable KEY=value. The -e flag may be repeated multiple times to add multiple things to the environment.")
+	fs.BoolVar(&rf.firewall, "firewall", false, "Enable outbound firewall on machine. This is on by default on many builders (where supported) but disabled by default on gomote for ease of debugging. Once any command has been run with the -firewall flag on, it's on for the lifetime of that gomote instance.")
+	fs.StringVar(&rf.path, "path", "", "Comma-separated list of ExecOpts.Path elements. The special string 'EMPTY' means to run without any $PATH. The empty string (default) does not modify the $PATH. Otherwise, the following expansions apply: the string '$PATH' expands to the current PATH element(s), the substring '$WORKDIR' expands to the buildlet's temp workdir.")
 
+	fs.StringVar(&rf.dir, "dir", "", "Directory to run from. Defaults to the directory of the command, or the work directory if -system is true.")
+	fs.StringVar(&rf.builderEnv, "builderenv", "", "Optional alternate builder to act like. Must share the same underlying buildlet host type, or it's an error. For instance, linux-amd64-race or linux-386-387 are compatible with linux-amd64, but openbsd-amd64 and openbsd-386 are different hosts.")
+	fs.BoolVar(&rf.json, "json", false, "instead of the command's output, print a JSON object with its stdout, stderr, exit code, and duration once it's done")
+	fs.DurationVar(&rf.timeout, "timeout", 0, "if non-zero, how long the command may run before the buildlet kills it")
+	fs.BoolVar(&rf.keepAlive, "keep-alive", false, "keep extending the instance's lease while the command runs, so that it doesn't expire during commands running longer than the idle timeout")
+}
+
+// exec runs cmd with args on the named instance, writing its output,
+// or its runJSON with -json, to w.
+func (rf *runFlags) exec(name, cmd string, args []string, w io.Writer) error {
 	bc, conf, err := clientAndConf(name)
 	if err != nil {
 		return err
 	}
 
-	if builderEnv != "" {
-		altConf, ok := dashboard.Builders[builderEnv]
+	if rf.builderEnv != "" {
+		altConf, ok := dashboard.Builders[rf.builderEnv]
 		if !ok {
-			return fmt.Errorf("unknown --builderenv=%q builder value", builderEnv)
+			return fmt.Errorf("unknown --builderenv=%q builder value", rf.builderEnv)
 		}
 		if altConf.HostType != conf.HostType {
 			return fmt.Errorf("--builderEnv=%q has host type %q, which is not compatible with the named buildlet's host type %q",
-				builderEnv, altConf.HostType, conf.HostType)
+				rf.builderEnv, altConf.HostType, conf.HostType)
 		}
 		conf = altConf
 	}
 
 	var pathOpt []string
-	if path == "EMPTY" {
+	if rf.path == "EMPTY" {
 		pathOpt = []string{} // non-nil
-	} else if path != "" {
-		pathOpt = strings.Split(path, ",")
+	} else if rf.path != "" {
+		pathOpt = strings.Split(rf.path, ",")
 	}
-	env = append(env, "GO_DISABLE_OUTBOUND_NETWORK="+fmt.Sprint(firewall))
+	// Don't append to rf.env in place: group run calls exec concurrently.
+	env := append(rf.env[:len(rf.env):len(rf.env)], "GO_DISABLE_OUTBOUND_NETWORK="+fmt.Sprint(rf.firewall))
 
-	remoteErr, execErr := bc.Exec(context.Background(), cmd, buildlet.ExecOpts{
-		Dir:         dir,
-		SystemLevel: sys || strings.HasPrefix(cmd, "/"),
-		Output:      os.Stdout,
-		Args:        fs.Args()[2:],
+	opts := buildlet.ExecOpts{
+		Dir:         rf.dir,
+		SystemLevel: rf.sys || strings.HasPrefix(cmd, "/"),
+		Output:      w,
+		Args:        args,
 		ExtraEnv:    envutil.Dedup(conf.GOOS() == "windows", append(conf.Env(), []string(env)...)),
-		Debug:       debug,
+		Debug:       rf.debug,
 		Path:        pathOpt,
-	})
+		Limits:      buildlet.ExecLimits{Timeout: rf.timeout},
+	}
+	res := runJSON{Instance: name, Cmd: cmd, Args: args, ExitCode: -1}
+	var stdout, stderr bytes.Buffer
+	if rf.json {
+		opts.Output = &stdout
+		opts.Stderr = &stderr
+		opts.OnExit = func(es buildlet.ExitStatus) {
+			res.ExitCode = es.Code
+			res.Signal = es.Signal
+			res.Duration = es.Duration.Seconds()
+			res.Limit = es.Limit
+		}
+	}
+	ctx := context.Background()
+	if rf.keepAlive {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go keepAlive(ctx, bc)
+	}
+	if rf.timeout > 0 {
+		// Buildlets older than version 33 ignore opts.Limits, so
+		// give up on the command a little later in any case.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rf.timeout+10*time.Second)
+		defer cancel()
+	}
+	remoteErr, execErr := bc.Exec(ctx, cmd, opts)
+	if ee, ok := remoteErr.(*buildlet.ExitError); (ok && ee.Limit == buildlet.LimitTime) || execErr == buildlet.ErrTimeout {
+		remoteErr, execErr = fmt.Errorf("%s timed out after %v", cmd, rf.timeout), nil
+	}
+	if rf.json {
+		res.Stdout, res.Stderr = stdout.String(), stderr.String()
+		if execErr != nil {
+			res.Error = execErr.Error()
+		} else if remoteErr != nil {
+			res.Error = remoteErr.Error()
+		}
+		if err := writeJSON(w, res); err != nil {
+			return err
+		}
+	}
 	if execErr != nil {
 		return fmt.Errorf("Error trying to execute %s: %v", cmd, execErr)
 	}
@@ -0,0 +1,308 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/build/buildlet"
+)
+
+// Scripts.
+//
+// While recording, gomote appends each command operating on the
+// recorded instance to the script, as a line of JSON. Replaying the
+// script runs them again, in the same directories, on another
+// instance, such as a fresh one of the same builder type.
+
+// scriptInstance stands for the instance in a script's commands.
+const scriptInstance = "$INSTANCE"
+
+// recordedCommands are the commands that recording captures.
+var recordedCommands = map[string]bool{
+	"get":    true,
+	"gettar": true,
+	"push":   true,
+	"put":    true,
+	"put14":  true,
+	"puttar": true,
+	"rm":     true,
+	"rsync":  true,
+	"run":    true,
+}
+
+// A scriptStep is a command of a script.
+type scriptStep struct {
+	// Dir is the directory gomote ran in, which relative local
+	// paths in Args are relative to.
+	Dir string `json:"dir"`
+	// Args are the command and its arguments, with scriptInstance
+	// in place of the instance.
+	Args []string `json:"args"`
+	// Error is how the command failed when recorded, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// A recording is the state of an ongoing recording, kept in the gomote
+// config directory.
+type recording struct {
+	Script   string `json:"script"` // absolute path
+	Instance string `json:"instance"`
+}
+
+func recordingFile() string {
+	return filepath.Join(buildlet.ConfigDir(), "recording.json")
+}
+
+// loadRecording returns the ongoing recording, or nil if there's none.
+func loadRecording() (*recording, error) {
+	b, err := ioutil.ReadFile(recordingFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := new(recording)
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", recordingFile(), err)
+	}
+	return rec, nil
+}
+
+// instanceArg is the index of the instance in the arguments of the
+// command being run, or -1 if it didn't get that far.
+var instanceArg = -1
+
+// noteInstanceArg records, for recordStep, that the instance is the
+// first argument remaining after fs parsed the flags in args.
+func noteInstanceArg(fs *flag.FlagSet, args []string) {
+	if fs.NArg() > 0 {
+		instanceArg = len(args) - fs.NArg()
+	}
+}
+
+// recordStep appends the command cmdName with args, which failed with
+// err if non-nil, to the script being recorded, if it's recordable and
+// operates on the recorded instance.
+//
+// Only the instance argument is replaced with scriptInstance, so that
+// other arguments that happen to equal the instance name, such as a
+// file named after it, are recorded as they are.
+func recordStep(cmdName string, args []string, err error) error {
+	if !recordedCommands[cmdName] {
+		return nil
+	}
+	rec, lerr := loadRecording()
+	if lerr != nil || rec == nil {
+		return lerr
+	}
+	if instanceArg < 0 || instanceArg >= len(args) || args[instanceArg] != rec.Instance {
+		return nil
+	}
+	step := scriptStep{Args: append([]string{cmdName}, args...)}
+	step.Args[1+instanceArg] = scriptInstance
+	if step.Dir, lerr = os.Getwd(); lerr != nil {
+		return lerr
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	b, lerr := json.Marshal(step)
+	if lerr != nil {
+		return lerr
+	}
+	f, lerr := os.OpenFile(rec.Script, os.O_WRONLY|os.O_APPEND, 0)
+	if lerr != nil {
+		return lerr
+	}
+	if _, lerr := f.Write(append(b, '\n')); lerr != nil {
+		f.Close()
+		return lerr
+	}
+	return f.Close()
+}
+
+var scriptOps = map[string]func(args []string) error{
+	"record": scriptRecord,
+	"replay": scriptReplay,
+	"stop":   scriptStop,
+}
+
+func script(args []string) error {
+	if len(args) == 0 || scriptOps[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, `script usage: gomote script <op> [op-opts] [args...]
+
+Ops:
+
+  record   record the commands run on an instance to a script
+  replay   run the commands of a script on an instance
+  stop     stop recording
+
+Recorded commands are get, gettar, push, put, put14, puttar, rm, rsync,
+and run, whether they succeed or not. Replaying runs them in the
+directories they were recorded in, so local files they use should still
+be there.`)
+		os.Exit(1)
+	}
+	return scriptOps[args[0]](args[1:])
+}
+
+func scriptRecord(args []string) error {
+	fs := flag.NewFlagSet("script record", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "script record usage: gomote script record <script> <instance>")
+		fmt.Fprintln(os.Stderr, "\nThe script is overwritten. Run \"gomote script stop\" when done.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+	}
+	rec, err := loadRecording()
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		return fmt.Errorf("already recording %s to %s; run \"gomote script stop\" first", rec.Instance, rec.Script)
+	}
+	script, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	rec = &recording{Script: script, Instance: fs.Arg(1)}
+	if _, err := remoteClient(rec.Instance); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(script, nil, 0644); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(recordingFile()), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(recordingFile(), b, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "# recording commands on %s to %s\n", rec.Instance, script)
+	return nil
+}
+
+func scriptStop(args []string) error {
+	fs := flag.NewFlagSet("script stop", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "script stop usage: gomote script stop")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+	}
+	rec, err := loadRecording()
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return errors.New("not recording")
+	}
+	if err := os.Remove(recordingFile()); err != nil {
+		return err
+	}
+	steps, err := readScript(rec.Script)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "# recorded %d commands to %s\n", len(steps), rec.Script)
+	return nil
+}
+
+func readScript(file string) ([]scriptStep, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var steps []scriptStep
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var step scriptStep
+		if err := json.Unmarshal(sc.Bytes(), &step); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		if len(step.Args) == 0 || !recordedCommands[step.Args[0]] {
+			return nil, fmt.Errorf("%s:%d: not a recordable command", file, line)
+		}
+		steps = append(steps, step)
+	}
+	return steps, sc.Err()
+}
+
+func scriptReplay(args []string) error {
+	fs := flag.NewFlagSet("script replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "script replay usage: gomote script replay [replay-opts] <script> <instance>")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var keepGoing bool
+	fs.BoolVar(&keepGoing, "k", false, "keep going after a command fails, as commands failing is often what's being reproduced")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+	}
+	steps, err := readScript(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	inst := fs.Arg(1)
+	if _, err := remoteClient(inst); err != nil {
+		return err
+	}
+	failed := 0
+	for i, step := range steps {
+		args := make([]string, len(step.Args))
+		for j, arg := range step.Args {
+			if arg == scriptInstance {
+				arg = inst
+			}
+			args[j] = arg
+		}
+		fmt.Fprintf(os.Stderr, "# %d/%d: (cd %s && gomote %s)\n", i+1, len(steps), step.Dir, strings.Join(args, " "))
+		if step.Error != "" {
+			fmt.Fprintf(os.Stderr, "# when recorded, it failed: %s\n", step.Error)
+		}
+		if err := os.Chdir(step.Dir); err != nil {
+			return err
+		}
+		if err := commands[args[0]].run(args[1:]); err != nil {
+			if !keepGoing {
+				return fmt.Errorf("%s failed: %v", args[0], err)
+			}
+			fmt.Fprintf(os.Stderr, "# %s failed: %v\n", args[0], err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", failed, len(steps))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func sftp(args []string) error {
+	fs := flag.NewFlagSet("sftp", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "sftp usage: gomote sftp [sftp-opts] <instance>")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Runs sftp on the buildlet's files, served by the sftp subsystem of")
+		fmt.Fprintln(os.Stderr, "the SSH server on the instance through the coordinator's SSH gateway,")
+		fmt.Fprintln(os.Stderr, "like gomote ssh. With --stdio, speaks the SFTP protocol on stdin and")
+		fmt.Fprintln(os.Stderr, "stdout instead, for other tools that can run an SFTP server command,")
+		fmt.Fprintln(os.Stderr, "like sftp -D.")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	var stdio bool
+	fs.BoolVar(&stdio, "stdio", false, "speak SFTP on stdin and stdout instead of running sftp")
+	var mutable bool
+	fs.BoolVar(&mutable, "i-will-not-break-the-host", false, "required for older host configs with reused filesystems; using this says that you are aware that your changes to the machine's root filesystem affect future builds. This is a no-op for the newer, safe host configs.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	name := fs.Arg(0)
+	bc, err := remoteClient(name)
+	if err != nil {
+		return err
+	}
+
+	sshUser := name
+	if mutable {
+		sshUser = "mutable-" + sshUser
+	}
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return fmt.Errorf("no 'ssh' binary found in path: %v", err)
+	}
+	// The coordinator serves sessions running "sftp" with the
+	// instance's sftp subsystem.
+	server := []string{ssh, "-p", "2222", sshUser + "@farmer.golang.org", "sftp"}
+
+	if stdio {
+		cmd := exec.Command(server[0], server[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	sftp, err := exec.LookPath("sftp")
+	if err != nil {
+		return fmt.Errorf("no 'sftp' binary found in path: %v", err)
+	}
+	// sftp starts in the SSH user's home directory.
+	if workDir, err := bc.WorkDir(context.Background()); err == nil {
+		fmt.Fprintf(os.Stderr, "# The buildlet's work directory is %s\n", workDir)
+	}
+	for i, arg := range server {
+		server[i] = sftpQuote(arg)
+	}
+	cmd := exec.Command(sftp, "-D", strings.Join(server, " "))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// sftpQuote quotes s, if needed, for the command line of sftp -D,
+// which sftp splits into arguments at unquoted spaces.
+func sftpQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t'\"\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
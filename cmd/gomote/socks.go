@@ -0,0 +1,114 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SOCKS5 (RFC 1928) constants.
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomainName   = 3
+	socksIPv6         = 4
+	socksSucceeded    = 0
+	socksNotAllowed   = 2
+	socksCmdNotSupp   = 7
+	socksAddrNotSupp  = 8
+)
+
+// socksHandshake serves the SOCKS5 handshake of the client c, which
+// must ask without authentication to connect to the instance's
+// localhost, and returns the port it asks for. It replies that the
+// connection succeeded before it's made, so a failure to make it
+// shows as the connection closing.
+func socksHandshake(c net.Conn) (port int, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return 0, err
+	}
+	if hdr[0] != socksVersion {
+		return 0, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return 0, err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return 0, err
+	}
+	if method == socksNoAcceptable {
+		return 0, errors.New("client requires authentication")
+	}
+
+	var req [4]byte // version, command, reserved, address type
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return 0, err
+	}
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return 0, err
+		}
+		host = ip.String()
+	case socksDomainName:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return 0, err
+		}
+		host = string(name)
+	default:
+		socksReply(c, socksAddrNotSupp)
+		return 0, fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(c, p[:]); err != nil {
+		return 0, err
+	}
+	port = int(binary.BigEndian.Uint16(p[:]))
+	switch {
+	case req[0] != socksVersion:
+		return 0, fmt.Errorf("unsupported SOCKS version %d", req[0])
+	case req[1] != socksConnect:
+		socksReply(c, socksCmdNotSupp)
+		return 0, fmt.Errorf("unsupported command %d", req[1])
+	case !isLocalhost(host):
+		socksReply(c, socksNotAllowed)
+		return 0, fmt.Errorf("refusing to connect to %s; only the instance's localhost is reachable", net.JoinHostPort(host, fmt.Sprint(port)))
+	case port == 0:
+		socksReply(c, socksNotAllowed)
+		return 0, errors.New("refusing to connect to port 0")
+	}
+	return port, socksReply(c, socksSucceeded)
+}
+
+// socksReply writes a reply with the given code and no bound address.
+func socksReply(c net.Conn, code byte) error {
+	_, err := c.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -5,11 +5,16 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -19,18 +24,35 @@ import (
 func ssh(args []string) error {
 	fs := flag.NewFlagSet("ssh", flag.ContinueOnError)
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "ssh usage: gomote ssh <instance>")
+		fmt.Fprintln(os.Stderr, "ssh usage: gomote ssh [ssh-opts] <instance>")
+		fmt.Fprintln(os.Stderr, "\nForwarded connections go through the coordinator's SSH gateway, each")
+		fmt.Fprintln(os.Stderr, "with its own ssh session, so ssh must be able to authenticate without")
+		fmt.Fprintln(os.Stderr, "prompting, such as with ssh-agent. They reach ports on the instance's")
+		fmt.Fprintln(os.Stderr, "localhost only, and -R forwards ports that the instance listens on")
+		fmt.Fprintln(os.Stderr, "on its localhost only.")
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
 	var mutable bool
 	fs.BoolVar(&mutable, "i-will-not-break-the-host", false, "required for older host configs with reused filesystems; using this says that you are aware that your changes to the machine's root filesystem affect future builds. This is a no-op for the newer, safe host configs.")
+	var forwards forwardList
+	fs.Var(&forwards, "L", "forward connections to the local [bind_address:]port to the instance's hostport, as `[bind_address:]port:[localhost:]hostport`. May be repeated.")
+	fs.Var((*socksList)(&forwards), "D", "run a SOCKS5 proxy on the local `[bind_address:]port` for connections to ports on the instance's localhost. May be repeated.")
+	var remotes remoteForwardList
+	fs.Var(&remotes, "R", "forward connections to the instance's localhost port to host:hostport, dialed locally, as `[localhost:]port:host:hostport`. May be repeated.")
+	var noShell bool
+	fs.BoolVar(&noShell, "N", false, "only forward ports, without starting a remote shell")
+	var keepAliveFlag bool
+	fs.BoolVar(&keepAliveFlag, "keep-alive", false, "keep extending the instance's lease until ssh exits, even while idle")
 	fs.Parse(args)
 	if fs.NArg() != 1 {
 		fs.Usage()
 	}
+	if noShell && len(forwards) == 0 && len(remotes) == 0 {
+		return fmt.Errorf("-N requires -L, -D, or -R")
+	}
 	name := fs.Arg(0)
-	_, err := remoteClient(name)
+	bc, err := remoteClient(name)
 	if err != nil {
 		return err
 	}
@@ -49,7 +71,235 @@ func ssh(args []string) error {
 	}
 	fmt.Printf("$ ssh -p 2222 %s@farmer.golang.org # auth using https://github.com/%s.keys\n", sshUser, githubUser)
 
-	// Best effort, where supported:
-	syscall.Exec(ssh, []string{"ssh", "-p", "2222", sshUser + "@farmer.golang.org"}, os.Environ())
+	if len(forwards) == 0 && len(remotes) == 0 && !keepAliveFlag {
+		// Best effort, where supported:
+		syscall.Exec(ssh, []string{"ssh", "-p", "2222", sshUser + "@farmer.golang.org"}, os.Environ())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fw := range forwards {
+		ln, err := net.Listen("tcp", fw.bind)
+		if err != nil {
+			return err
+		}
+		if fw.socks {
+			log.Printf("Running a SOCKS5 proxy to %s's localhost on %s", name, ln.Addr())
+		} else {
+			log.Printf("Forwarding %s to port %d on %s", ln.Addr(), fw.port, name)
+		}
+		go serveForward(ln, fw, ssh, sshUser)
+	}
+	for _, rf := range remotes {
+		log.Printf("Forwarding port %d on %s to %s", rf.port, name, rf.dest)
+		go serveRemoteForward(rf, ssh, sshUser)
+	}
+	if keepAliveFlag {
+		go keepAlive(context.Background(), bc)
+	}
+	if noShell {
+		select {} // until interrupted
+	}
+	// Keep running for the forwarded connections and keep-alives,
+	// rather than exec'ing ssh.
+	cmd := exec.Command(ssh, "-p", "2222", sshUser+"@farmer.golang.org")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// A forward is a local address whose connections are forwarded to a
+// port on the instance.
+type forward struct {
+	bind  string // local address to listen on
+	port  int    // port on the instance; 0 for SOCKS
+	socks bool   // whether clients choose the port with SOCKS5
+}
+
+// forwardList is a flag.Value of the repeated -L flag's forwards.
+type forwardList []forward
+
+func (*forwardList) String() string { return "" } // default value
+
+// Set parses an OpenSSH style local forward, whose host must be the
+// instance's localhost as the buildlet only dials that.
+func (fl *forwardList) Set(v string) error {
+	f := strings.Split(v, ":")
+	var bind, host, port, hostport string
+	switch len(f) {
+	case 2:
+		port, hostport = f[0], f[1]
+	case 3:
+		port, host, hostport = f[0], f[1], f[2]
+	case 4:
+		bind, port, host, hostport = f[0], f[1], f[2], f[3]
+	default:
+		return fmt.Errorf("bad forward %q; want [bind_address:]port:[localhost:]hostport", v)
+	}
+	if host != "" && !isLocalhost(host) {
+		return fmt.Errorf("bad forward %q: can only forward to the instance's localhost", v)
+	}
+	p, err := strconv.Atoi(hostport)
+	if err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("bad forward %q: bogus port %q", v, hostport)
+	}
+	*fl = append(*fl, forward{bind: bindAddr(bind, port), port: p})
+	return nil
+}
+
+// A remoteForward is a port on the instance's localhost whose
+// connections are forwarded to a local address.
+type remoteForward struct {
+	port int    // port on the instance
+	dest string // local address to dial
+}
+
+// remoteForwardList is a flag.Value of the repeated -R flag's forwards.
+type remoteForwardList []remoteForward
+
+func (*remoteForwardList) String() string { return "" } // default value
+
+// Set parses an OpenSSH style remote forward, whose bind address must
+// be the instance's localhost as the buildlet only listens there.
+func (rl *remoteForwardList) Set(v string) error {
+	f := strings.Split(v, ":")
+	var bind, port, host, hostport string
+	switch len(f) {
+	case 3:
+		port, host, hostport = f[0], f[1], f[2]
+	case 4:
+		bind, port, host, hostport = f[0], f[1], f[2], f[3]
+	default:
+		return fmt.Errorf("bad forward %q; want [localhost:]port:host:hostport", v)
+	}
+	if bind != "" && !isLocalhost(bind) {
+		return fmt.Errorf("bad forward %q: can only listen on the instance's localhost", v)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("bad forward %q: bogus port %q", v, port)
+	}
+	*rl = append(*rl, remoteForward{port: p, dest: net.JoinHostPort(strings.Trim(host, "[]"), hostport)})
+	return nil
+}
+
+// socksList is a flag.Value adding the repeated -D flag's SOCKS
+// proxies to a forwardList.
+type socksList forwardList
+
+func (*socksList) String() string { return "" } // default value
+
+func (sl *socksList) Set(v string) error {
+	bind, port := "", v
+	if i := strings.LastIndex(v, ":"); i >= 0 {
+		bind, port = v[:i], v[i+1:]
+	}
+	*sl = append(*sl, forward{bind: bindAddr(bind, port), socks: true})
 	return nil
 }
+
+// bindAddr returns the local address to listen on for an OpenSSH
+// style bind address and port, which default to localhost.
+func bindAddr(bind, port string) string {
+	switch bind {
+	case "":
+		bind = "localhost"
+	case "*":
+		bind = ""
+	}
+	return net.JoinHostPort(strings.Trim(bind, "[]"), port)
+}
+
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveForward forwards the connections accepted on ln as fw says,
+// each through a session of the coordinator's SSH gateway, which
+// connects the session to the port on the instance's localhost.
+func serveForward(ln net.Listener, fw forward, ssh, sshUser string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Printf("Forwarding from %s: %v", ln.Addr(), err)
+			return
+		}
+		go func() {
+			defer c.Close()
+			port := fw.port
+			if fw.socks {
+				var err error
+				if port, err = socksHandshake(c); err != nil {
+					log.Printf("SOCKS5 proxy on %s: %v", ln.Addr(), err)
+					return
+				}
+			}
+			if err := forwardConn(c, ssh, sshUser, "tcp", strconv.Itoa(port)); err != nil {
+				log.Printf("Forwarding %s to port %d: %v", ln.Addr(), port, err)
+			}
+		}()
+	}
+}
+
+// serveRemoteForward has the instance listen on rf's port through a
+// "tcp-listen PORT" session of the coordinator's SSH gateway, and
+// forwards each connection it accepts to rf's local address through a
+// "tcp-accept ID" session, until the listening session ends.
+func serveRemoteForward(rf remoteForward, ssh, sshUser string) {
+	cmd := exec.Command(ssh, "-p", "2222", "-o", "BatchMode=yes", sshUser+"@farmer.golang.org", "tcp-listen", strconv.Itoa(rf.port))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("Forwarding port %d: %v", rf.port, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Forwarding port %d: %v", rf.port, err)
+		return
+	}
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		id := sc.Text()
+		go func() {
+			c, err := net.Dial("tcp", rf.dest)
+			if err != nil {
+				log.Printf("Forwarding port %d to %s: %v", rf.port, rf.dest, err)
+				return
+			}
+			defer c.Close()
+			if err := forwardConn(c, ssh, sshUser, "tcp-accept", id); err != nil {
+				log.Printf("Forwarding port %d to %s: %v", rf.port, rf.dest, err)
+			}
+		}()
+	}
+	err = cmd.Wait()
+	log.Printf("Stopped forwarding port %d: %v", rf.port, err)
+}
+
+// forwardConn copies between c and the connection on the instance
+// that the gateway session running command connects to, such as
+// "tcp PORT" for a port on the instance's localhost, until either side
+// is done.
+func forwardConn(c net.Conn, ssh, sshUser string, command ...string) error {
+	cmd := exec.Command(ssh, append([]string{"-p", "2222", "-o", "BatchMode=yes", sshUser + "@farmer.golang.org"}, command...)...)
+	cmd.Stdout = c
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Don't wait for c to be read from once ssh exits, as Wait would
+	// with c as cmd.Stdin.
+	go func() {
+		io.Copy(stdin, c)
+		stdin.Close()
+	}()
+	return cmd.Wait()
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// accelAuto is an accelerator name in vmConfig.Accel that is replaced
+// with the hardware accelerator available on the host, if any.
+const accelAuto = "auto"
+
+// hostAccel returns the name of the hardware accelerator available
+// on the host, or the empty string if there is none. It is a variable
+// for testing.
+var hostAccel = func() string {
+	hostAccelOnce.Do(func() {
+		hostAccelName = detectHostAccel()
+	})
+	return hostAccelName
+}
+
+var (
+	hostAccelOnce sync.Once
+	hostAccelName string
+)
+
+// detectHostAccel returns the hardware accelerator supported by QEMU
+// on this host: hvf on macOS if the Hypervisor framework is available,
+// kvm on Linux if /dev/kvm is usable, and on Windows, whpx if the
+// Windows Hypervisor Platform is enabled, or hax if Intel HAXM is
+// installed.
+func detectHostAccel() string {
+	switch runtime.GOOS {
+	case "darwin":
+		if !hostHVFSupported() {
+			return ""
+		}
+		return "hvf"
+	case "linux":
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+		if err != nil {
+			return ""
+		}
+		f.Close()
+		return "kvm"
+	case "windows":
+		switch {
+		case hostWHPXSupported():
+			return "whpx"
+		case hostHAXMSupported():
+			return "hax"
+		}
+	}
+	return ""
+}
+
+// expandAccel returns accels with accelAuto replaced by host, or
+// removed if host is empty. QEMU tries each accelerator in order, so
+// a trailing tcg entry serves as a fallback.
+func expandAccel(accels []string, host string) []string {
+	var out []string
+	for _, a := range accels {
+		if a == accelAuto {
+			if host == "" {
+				continue
+			}
+			a = host
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// accelFlags are the accelerators set by repeated -accel flags.
+type accelFlags []string
+
+func (f *accelFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *accelFlags) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !windows
+// +build go1.21,!windows
+
+package main
+
+// hostWHPXSupported reports whether the Windows Hypervisor Platform is
+// enabled. It never is outside Windows.
+func hostWHPXSupported() bool { return false }
+
+// hostHAXMSupported reports whether the Intel HAXM driver is
+// installed. Only Windows hosts are supported.
+func hostHAXMSupported() bool { return false }
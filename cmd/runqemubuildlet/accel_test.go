@@ -0,0 +1,49 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExpandAccel(t *testing.T) {
+	cases := []struct {
+		desc   string
+		accels []string
+		host   string
+		want   []string
+	}{
+		{
+			desc:   "kvm",
+			accels: []string{"auto", "tcg"},
+			host:   "kvm",
+			want:   []string{"kvm", "tcg"},
+		},
+		{
+			desc:   "no hardware accelerator",
+			accels: []string{"auto", "tcg"},
+			host:   "",
+			want:   []string{"tcg"},
+		},
+		{
+			desc:   "explicit",
+			accels: []string{"hvf", "tcg"},
+			host:   "kvm",
+			want:   []string{"hvf", "tcg"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			if diff := cmp.Diff(c.want, expandAccel(c.accels, c.host)); diff != "" {
+				t.Errorf("expandAccel(%q, %q) mismatch (-want +got):\n%s", c.accels, c.host, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && windows
+// +build go1.21,windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// The probes call Windows through syscall rather than
+// golang.org/x/sys/windows, which doesn't yet build for windows/arm64.
+var (
+	modWinHvPlatform = syscall.NewLazyDLL("WinHvPlatform.dll")
+
+	procWHvGetCapability = modWinHvPlatform.NewProc("WHvGetCapability")
+)
+
+// whvCapabilityCodeHypervisorPresent is the WHV_CAPABILITY_CODE of
+// whether the Windows hypervisor is running.
+const whvCapabilityCodeHypervisorPresent = 0
+
+// hostWHPXSupported reports whether the Windows Hypervisor Platform,
+// used by QEMU's whpx accelerator, is enabled and running.
+func hostWHPXSupported() bool {
+	if procWHvGetCapability.Find() != nil {
+		// The Windows Hypervisor Platform feature is not installed.
+		return false
+	}
+	var present, written uint32
+	hr, _, _ := procWHvGetCapability.Call(whvCapabilityCodeHypervisorPresent, uintptr(unsafe.Pointer(&present)), unsafe.Sizeof(present), uintptr(unsafe.Pointer(&written)))
+	return hr == 0 && present != 0
+}
+
+// hostHAXMSupported reports whether the Intel HAXM driver, used by
+// QEMU's hax accelerator, is installed.
+func hostHAXMSupported() bool {
+	name, err := syscall.UTF16PtrFromString(`\\.\HAX`)
+	if err != nil {
+		return false
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return false
+	}
+	syscall.CloseHandle(h)
+	return true
+}
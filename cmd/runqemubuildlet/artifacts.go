@@ -0,0 +1,216 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// maxStderrTail is the amount of QEMU's stderr kept for the artifacts
+// of a run.
+const maxStderrTail = 1 << 20
+
+// tailBuffer is an io.Writer that keeps the last max bytes written to
+// it. It is safe for concurrent use.
+type tailBuffer struct {
+	max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.max; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the bytes kept by b.
+func (b *tailBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf...)
+}
+
+// runState is runqemubuildlet's view of a finished VM run, included in
+// its artifacts as state.json.
+type runState struct {
+	Host    string         `json:"host"`
+	Reason  string         `json:"reason"`
+	Error   string         `json:"error,omitempty"`
+	Command []string       `json:"command"`
+	Status  instanceStatus `json:"status"`
+}
+
+// writeArtifacts writes a gzip-compressed tarball to w holding the
+// local files at paths, under their base names, followed by the files
+// in extra, sorted by name. Empty paths are skipped.
+func writeArtifacts(w io.Writer, paths []string, extra map[string][]byte) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if err := addFileToTar(tw, p); err != nil {
+			return err
+		}
+	}
+	var names []string
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(extra[name])),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(extra[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addFileToTar adds the regular file at p to tw under its base name.
+func addFileToTar(tw *tar.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.Base(p)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// Copy only the size in the header, in case the file is still
+	// being appended to.
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// uploadArtifacts bundles the files at paths and in extra with
+// writeArtifacts and uploads the tarball to the object named name
+// under the gs://bucket/prefix URL dst.
+func uploadArtifacts(ctx context.Context, dst, name string, paths []string, extra map[string][]byte) error {
+	f, err := ioutil.TempFile("", "runqemubuildlet-artifacts-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeArtifacts(f, paths, extra); err != nil {
+		f.Close()
+		return fmt.Errorf("writing artifacts: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return uploadToGCS(ctx, dst, name, f.Name())
+}
+
+// uploadRunArtifacts uploads the artifacts of a run of inst, which
+// ran cmd and ended for reason with runErr, to dst under the host
+// name. The artifacts are the local files, QEMU's stderr, and a
+// runState. It then removes this host's artifacts older than
+// retention, if positive.
+func uploadRunArtifacts(ctx context.Context, dst string, inst *instance, lg *runLogger, cmd []string, reason string, runErr error, stderr []byte, files []string, retention time.Duration) error {
+	host, _ := os.Hostname()
+	st := runState{
+		Host:    host,
+		Reason:  reason,
+		Command: cmd,
+		Status:  inst.status(),
+	}
+	if runErr != nil {
+		st.Error = runErr.Error()
+	}
+	state, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+	extra := map[string][]byte{
+		"qemu-stderr.log": stderr,
+		"state.json":      state,
+	}
+	name := fmt.Sprintf("%s/%s-%s.tar.gz", host, inst.name, lg.id)
+	if err := uploadArtifacts(ctx, dst, name, files, extra); err != nil {
+		return err
+	}
+	lg.Info("Uploaded run artifacts", "dst", dst, "name", name)
+	if retention > 0 {
+		if err := pruneGCS(ctx, dst, host, time.Now().Add(-retention)); err != nil {
+			return fmt.Errorf("pruning old artifacts: %w", err)
+		}
+	}
+	return nil
+}
+
+// pruneGCS deletes the objects in directory dir under the
+// gs://bucket/prefix URL dst that were created before t.
+func pruneGCS(ctx context.Context, dst, dir string, t time.Time) error {
+	bucket, base, err := parseGCSURL(dst)
+	if err != nil {
+		return err
+	}
+	sc, err := getStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %w", err)
+	}
+	b := sc.Bucket(bucket)
+	it := b.Objects(ctx, &storage.Query{Prefix: path.Join(base, dir) + "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if attrs.Created.Before(t) {
+			if err := b.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+				return err
+			}
+		}
+	}
+}
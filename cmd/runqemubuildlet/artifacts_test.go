@@ -0,0 +1,83 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{max: 5}
+	for _, s := range []string{"abc", "def", "g"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v, wanted %d, nil", s, n, err, len(s))
+		}
+	}
+	if got, want := string(b.Bytes()), "cdefg"; got != want {
+		t.Errorf("Bytes() = %q, wanted %q", got, want)
+	}
+}
+
+func TestWriteArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	serial := filepath.Join(dir, "vm0-serial-20210601T000000Z.log")
+	if err := ioutil.WriteFile(serial, []byte("boot\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	extra := map[string][]byte{
+		"state.json":      []byte("{}"),
+		"qemu-stderr.log": []byte("oops\n"),
+	}
+	if err := writeArtifacts(&buf, []string{serial, ""}, extra); err != nil {
+		t.Fatalf("writeArtifacts() = %v, wanted no error", err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	got := make(map[string]string)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		got[hdr.Name] = string(b)
+	}
+	wantNames := []string{"vm0-serial-20210601T000000Z.log", "qemu-stderr.log", "state.json"}
+	if diff := cmp.Diff(wantNames, names); diff != "" {
+		t.Errorf("tarball entries mismatch (-want +got):\n%s", diff)
+	}
+	want := map[string]string{
+		"vm0-serial-20210601T000000Z.log": "boot\n",
+		"qemu-stderr.log":                 "oops\n",
+		"state.json":                      "{}",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tarball contents mismatch (-want +got):\n%s", diff)
+	}
+}
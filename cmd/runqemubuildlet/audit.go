@@ -0,0 +1,119 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// audit, if set, records operator actions to -audit-log.
+var audit *auditLog
+
+// auditRecord is an operator action, such as a drain request, written
+// as a line of JSON to the audit log.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	// Action is what was done, such as "drain".
+	Action string `json:"action"`
+	// Source is how it was requested: "http", "signal", or
+	// "process" for the command line runqemubuildlet was started
+	// with.
+	Source string `json:"source"`
+	// Requester identifies who requested it, as far as is known.
+	Requester string            `json:"requester,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// auditLog appends auditRecords to a local file, so that actions taken
+// on a host by several operators can be traced.
+type auditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	host string
+}
+
+// openAuditLog opens the audit log at path for appending, creating it
+// if needed.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &auditLog{f: f, host: host}, nil
+}
+
+// record appends a record of action, requested from source by
+// requester, with details given as alternating keys and values. It
+// does nothing if a is nil. Failures are logged, since an action is
+// not undone for want of a record of it.
+func (a *auditLog) record(action, source, requester string, details ...string) {
+	if a == nil {
+		return
+	}
+	r := auditRecord{
+		Time:      time.Now().UTC(),
+		Host:      a.host,
+		Action:    action,
+		Source:    source,
+		Requester: requester,
+	}
+	for i := 0; i+1 < len(details); i += 2 {
+		if r.Details == nil {
+			r.Details = make(map[string]string)
+		}
+		r.Details[details[i]] = details[i+1]
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		slog.Warn("Encoding audit record failed", "action", action, "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// A single write of a whole line keeps records intact even if
+	// other processes append to the same file.
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		slog.Warn("Writing audit record failed", "action", action, "err", err)
+	}
+}
+
+// httpRequester identifies the requester of r: the user it
+// authenticated as, if any, and its remote address, preceded by the
+// addresses of the clients proxies forwarded it for.
+func httpRequester(r *http.Request) string {
+	addr := r.RemoteAddr
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		addr = strings.Join(strings.Fields(strings.ReplaceAll(fwd, ",", " ")), ",") + "," + addr
+	}
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		return u + "@" + addr
+	}
+	return addr
+}
+
+// processRequester identifies who started this process: the user who
+// ran sudo, if it did, or the user it runs as.
+func processRequester() string {
+	if u := os.Getenv("SUDO_USER"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid %d", os.Getuid())
+}
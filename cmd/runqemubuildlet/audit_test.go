@@ -0,0 +1,83 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		// Reopening appends to the existing log.
+		a, err := openAuditLog(path)
+		if err != nil {
+			t.Fatalf("openAuditLog(%q) = _, %v", path, err)
+		}
+		a.record("drain", "http", "alice@10.0.0.1:1234")
+		a.record("drain", "signal", "", "signal", "user defined signal 1")
+		a.f.Close()
+	}
+	var nilLog *auditLog
+	nilLog.record("drain", "http", "") // Does nothing.
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []auditRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("json.Unmarshal(%q) = %v", s.Bytes(), err)
+		}
+		got = append(got, r)
+	}
+	host, _ := os.Hostname()
+	drain := auditRecord{Host: host, Action: "drain", Source: "http", Requester: "alice@10.0.0.1:1234"}
+	signal := auditRecord{Host: host, Action: "drain", Source: "signal", Details: map[string]string{"signal": "user defined signal 1"}}
+	want := []auditRecord{drain, signal, drain, signal}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(auditRecord{}, "Time")); diff != "" {
+		t.Errorf("audit log mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestHTTPRequester(t *testing.T) {
+	cases := []struct {
+		desc      string
+		user      string
+		forwarded string
+		want      string
+	}{
+		{desc: "direct", want: "192.0.2.1:1234"},
+		{desc: "authenticated", user: "alice", want: "alice@192.0.2.1:1234"},
+		{desc: "proxied", forwarded: "203.0.113.7, 198.51.100.2", want: "203.0.113.7,198.51.100.2,192.0.2.1:1234"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/drain", nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, "secret")
+		}
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := httpRequester(r); got != c.want {
+			t.Errorf("%s: httpRequester() = %q, wanted %q", c.desc, got, c.want)
+		}
+	}
+}
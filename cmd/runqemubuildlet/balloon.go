@@ -0,0 +1,148 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// balloonInterval is how often the memory of a guest with a
+	// balloon is adjusted.
+	balloonInterval = 30 * time.Second
+	// defaultHostReserveMB is the default balloonConfig.HostReserveMB.
+	defaultHostReserveMB = 2048
+)
+
+// balloonConfig describes a virtio-balloon device used to shrink idle
+// guests when the host is short of memory, such as when it runs
+// several VMs, and to grow them back for builds.
+//
+// The guest's MemoryMB is the ceiling it grows to.
+type balloonConfig struct {
+	// MinMB is the floor the guest's memory is shrunk to.
+	MinMB int `yaml:"min_mb"`
+	// HostReserveMB is the memory the host should keep available.
+	// Idle guests are shrunk while less is available. It defaults
+	// to 2048.
+	HostReserveMB int `yaml:"host_reserve_mb"`
+}
+
+func (b *balloonConfig) validate(memoryMB int) error {
+	if memoryMB <= 0 {
+		return errors.New("balloon requires memory_mb to be set")
+	}
+	if b.MinMB <= 0 || b.MinMB > memoryMB {
+		return fmt.Errorf("balloon min_mb = %d, must be positive and at most memory_mb = %d", b.MinMB, memoryMB)
+	}
+	if b.HostReserveMB < 0 {
+		return fmt.Errorf("balloon host_reserve_mb = %d, must not be negative", b.HostReserveMB)
+	}
+	return nil
+}
+
+// hostReserveMB returns b.HostReserveMB, or its default.
+func (b *balloonConfig) hostReserveMB() int {
+	if b.HostReserveMB == 0 {
+		return defaultHostReserveMB
+	}
+	return b.HostReserveMB
+}
+
+// balloonTarget returns the memory a guest with balloon b, ceiling
+// ceilingMB, and currently currentMB of memory should have, given
+// whether its buildlet is busy and the host's available memory.
+//
+// A busy guest always grows to the ceiling. An idle guest shrinks to
+// the floor while the host has less than its reserve available, and
+// grows back once it can do so without taking the host below the
+// reserve, so that it does not oscillate.
+func balloonTarget(b *balloonConfig, ceilingMB, currentMB int, busy bool, availMB int) int {
+	reserve := b.hostReserveMB()
+	switch {
+	case busy:
+		return ceilingMB
+	case availMB < reserve:
+		return b.MinMB
+	case availMB-(ceilingMB-currentMB) >= reserve:
+		return ceilingMB
+	}
+	return currentMB
+}
+
+// runBalloon adjusts the memory of the guest of a run with config c,
+// controlled over QMP at qmpPath, every balloonInterval until ctx is
+// done.
+func (in *instance) runBalloon(ctx context.Context, lg *runLogger, c *vmConfig, qmpPath string) {
+	statusURL, err := in.statusURL()
+	if err != nil {
+		lg.Warn("Finding buildlet status URL failed; not adjusting guest memory", "err", err)
+		return
+	}
+	current := c.MemoryMB
+	t := time.NewTicker(balloonInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// An unreachable buildlet is treated as idle, as when
+		// draining.
+		busy, _ := buildletBusy(ctx, statusURL)
+		avail, err := hostAvailableMemoryMB()
+		if err != nil && !busy {
+			continue
+		}
+		target := balloonTarget(c.Balloon, c.MemoryMB, current, busy, avail)
+		if target == current {
+			continue
+		}
+		lg.Info("Adjusting guest memory", "from_mb", current, "to_mb", target, "busy", busy, "host_available_mb", avail)
+		if err := setBalloon(ctx, qmpPath, target); err != nil {
+			lg.Warn("Adjusting guest memory failed", "err", err)
+			continue
+		}
+		current = target
+	}
+}
+
+// setBalloon asks the guest controlled over QMP at path to use
+// targetMB of memory.
+func setBalloon(ctx context.Context, path string, targetMB int) error {
+	ctx, cancel := context.WithTimeout(ctx, qmpTimeout)
+	defer cancel()
+	q, err := dialQMP(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	return q.execute(ctx, "balloon", map[string]int64{"value": int64(targetMB) << 20}, nil)
+}
+
+// parseMemAvailable returns the MemAvailable value of the
+// /proc/meminfo contents b, in MiB.
+func parseMemAvailable(b []byte) (int, error) {
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 3 && f[0] == "MemAvailable:" && f[2] == "kB" {
+			kb, err := strconv.Atoi(f[1])
+			if err != nil {
+				return 0, err
+			}
+			return kb >> 10, nil
+		}
+	}
+	return 0, errors.New("no MemAvailable in /proc/meminfo")
+}
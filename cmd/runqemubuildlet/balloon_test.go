@@ -0,0 +1,62 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import "testing"
+
+func TestBalloonTarget(t *testing.T) {
+	b := &balloonConfig{MinMB: 4096, HostReserveMB: 2048}
+	const ceiling = 12288
+	cases := []struct {
+		desc    string
+		current int
+		busy    bool
+		avail   int
+		want    int
+	}{
+		{desc: "busy under pressure", current: 4096, busy: true, avail: 100, want: ceiling},
+		{desc: "idle under pressure", current: ceiling, avail: 1000, want: 4096},
+		{desc: "idle with room", current: ceiling, avail: 8192, want: ceiling},
+		{desc: "shrunk, growing would cause pressure", current: 4096, avail: 9000, want: 4096},
+		{desc: "shrunk, room to grow", current: 4096, avail: 10240, want: ceiling},
+	}
+	for _, c := range cases {
+		if got := balloonTarget(b, ceiling, c.current, c.busy, c.avail); got != c.want {
+			t.Errorf("%s: balloonTarget(_, %d, %d, %t, %d) = %d, wanted %d", c.desc, ceiling, c.current, c.busy, c.avail, got, c.want)
+		}
+	}
+}
+
+func TestParseMemAvailable(t *testing.T) {
+	meminfo := "MemTotal:       16310784 kB\nMemFree:         1254560 kB\nMemAvailable:    8388608 kB\n"
+	got, err := parseMemAvailable([]byte(meminfo))
+	if err != nil || got != 8192 {
+		t.Errorf("parseMemAvailable(%q) = %d, %v, wanted 8192, nil", meminfo, got, err)
+	}
+	if _, err := parseMemAvailable([]byte("MemTotal: 1 kB\n")); err == nil {
+		t.Errorf("parseMemAvailable() without MemAvailable = nil error, wanted error")
+	}
+}
+
+func TestBalloonValidate(t *testing.T) {
+	cases := []struct {
+		b        balloonConfig
+		memoryMB int
+		wantErr  bool
+	}{
+		{b: balloonConfig{MinMB: 2048}, memoryMB: 8192},
+		{b: balloonConfig{MinMB: 2048}, memoryMB: 0, wantErr: true},
+		{b: balloonConfig{}, memoryMB: 8192, wantErr: true},
+		{b: balloonConfig{MinMB: 16384}, memoryMB: 8192, wantErr: true},
+	}
+	for _, c := range cases {
+		if err := c.b.validate(c.memoryMB); (err != nil) != c.wantErr {
+			t.Errorf("%+v.validate(%d) = %v, wantErr: %t", c.b, c.memoryMB, err, c.wantErr)
+		}
+	}
+}
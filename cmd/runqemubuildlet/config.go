@@ -0,0 +1,619 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// vmConfig describes a virtual machine run by runqemubuildlet, with
+// QEMU unless Backend says otherwise.
+//
+// Relative paths are resolved against Base.
+type vmConfig struct {
+	// Name is passed to QEMU as -name.
+	Name string `yaml:"name"`
+	// Base is the directory relative paths are resolved against. If
+	// empty in a config file, the directory containing the config
+	// file is used.
+	Base string `yaml:"base"`
+	// Backend is "qemu", the default, or "vz" to run the VM with
+	// Apple's Virtualization framework as described by VZ.
+	Backend string `yaml:"backend"`
+	// VZ configures the vz backend.
+	VZ *vzConfig `yaml:"vz"`
+	// QEMU is the path to the qemu-system binary, or "auto" to find
+	// qemu-system-<Arch> in -qemu-search-path, Homebrew, or $PATH.
+	QEMU string `yaml:"qemu"`
+	// Arch is the QEMU name of the guest architecture, such as
+	// aarch64 or x86_64, used to find the binary when QEMU is auto.
+	// It defaults to the host's.
+	Arch string `yaml:"arch"`
+	// DataDir is passed to QEMU as -L, if set.
+	DataDir string `yaml:"data_dir"`
+	// LibraryPath, if set, is added to the QEMU environment as
+	// DYLD_LIBRARY_PATH.
+	LibraryPath string `yaml:"library_path"`
+
+	CPU  string `yaml:"cpu"`
+	CPUs int    `yaml:"cpus"`
+	// Sockets, Cores, and Threads describe the CPU topology. If unset,
+	// the CPUs are arranged as a single socket with one thread per
+	// core.
+	Sockets  int `yaml:"sockets"`
+	Cores    int `yaml:"cores"`
+	Threads  int `yaml:"threads"`
+	MemoryMB int `yaml:"memory_mb"`
+	// Balloon, if set, attaches a virtio-balloon device, and shrinks
+	// and grows the guest's memory below MemoryMB as needed.
+	Balloon *balloonConfig `yaml:"balloon"`
+	Machine string         `yaml:"machine"`
+	// Accel are passed to QEMU as -accel, in order of preference.
+	// "auto" selects the host's hardware accelerator, if any: hvf on
+	// macOS, kvm on Linux, or whpx or hax on Windows.
+	Accel []string `yaml:"accel"`
+	Boot  string   `yaml:"boot"`
+	BIOS  string   `yaml:"bios"`
+	// Firmware, if set, is loaded as UEFI flash images instead of
+	// BIOS. This is required for secure boot.
+	Firmware *firmwareConfig `yaml:"firmware"`
+	// TPM, if set, attaches an emulated TPM 2.0 device.
+	TPM *tpmConfig `yaml:"tpm"`
+	// CloudInit, if set, attaches a cloud-init seed ISO generated for
+	// each run.
+	CloudInit *cloudInitConfig `yaml:"cloud_init"`
+	// Provision, if set, injects the builder key and host metadata
+	// into the guest for each run.
+	Provision *provisionConfig `yaml:"provision"`
+
+	// Devices are passed to QEMU as -device, in order.
+	Devices []string      `yaml:"devices"`
+	Network networkConfig `yaml:"network"`
+	Drives  []driveConfig `yaml:"drives"`
+
+	// Shares are host directories exported into the guest.
+	Shares []shareConfig `yaml:"shares"`
+	// RNG attaches a virtio-rng device backed by the host's random
+	// number generator, so that the guest does not run short of
+	// entropy. Windows guests need the viorng driver.
+	RNG bool `yaml:"rng"`
+
+	// Snapshot runs QEMU with -snapshot, discarding all disk writes
+	// when the VM exits.
+	Snapshot bool `yaml:"snapshot"`
+	// RTC is passed to QEMU as -rtc, if set, such as
+	// "base=utc,clock=host,driftfix=slew".
+	RTC string `yaml:"rtc"`
+	// Serial is passed to QEMU as -serial, if set, such as
+	// "file:serial.log".
+	Serial string `yaml:"serial"`
+	// VNC is passed to QEMU as -vnc, if set.
+	VNC string `yaml:"vnc"`
+	// HealthChecks must all pass for the guest to be healthy. If
+	// empty, the buildlet healthz URL is checked.
+	HealthChecks []healthCheckConfig `yaml:"health_checks"`
+	// Heartbeat sets how often the health checks run, and how long
+	// they may fail.
+	Heartbeat heartbeatConfig `yaml:"heartbeat"`
+	// FatalPatterns are watched for in the guest's serial console
+	// and QEMU's output with -fatal-patterns, in addition to the
+	// built-in ones.
+	FatalPatterns []fatalPattern `yaml:"fatal_patterns"`
+	// Notifiers tell operators about events that need their
+	// attention, such as a VM crash-looping.
+	Notifiers []notifierConfig `yaml:"notifiers"`
+	// GuestAgent attaches a virtio-serial channel for
+	// qemu-guest-agent, which must be installed in the guest, and
+	// requires it to respond to health checks.
+	GuestAgent bool `yaml:"guest_agent"`
+	// GuestAgentSocket is the path of the host side of the
+	// qemu-guest-agent channel. If empty, a socket in a temporary
+	// directory is used for each run.
+	GuestAgentSocket string `yaml:"guest_agent_socket"`
+	// QMPSocket is the path of the QMP control socket. If empty, a
+	// socket in a temporary directory is used for each run.
+	QMPSocket string `yaml:"qmp_socket"`
+	// ExtraArgs are appended to the QEMU command line.
+	ExtraArgs []string `yaml:"extra_args"`
+}
+
+// firmwareConfig describes UEFI firmware loaded as pflash images.
+type firmwareConfig struct {
+	// Code is the read-only firmware code image, such as
+	// edk2-aarch64-secure-code.fd.
+	Code string `yaml:"code"`
+	// Vars is the writable UEFI variable store, such as efi_vars.fd.
+	// It must be the same size as Code.
+	Vars string `yaml:"vars"`
+}
+
+// networkConfig describes the guest network device and its host
+// backend.
+type networkConfig struct {
+	// Device is the guest network device, such as virtio-net-pci.
+	Device string `yaml:"device"`
+	// Backend is the host network backend: "user", the default, for
+	// QEMU's user-mode networking, or one of the macOS vmnet
+	// backends. See netBackends.
+	Backend string `yaml:"backend"`
+	// Interface is the host interface the guest is bridged to with
+	// the vmnet-bridged backend, such as en0.
+	Interface string `yaml:"interface"`
+	// MAC is the guest's MAC address. If empty, each run gets a
+	// different address derived from the host, instance, and run. A
+	// fixed address is only allowed for a single instance.
+	MAC string `yaml:"mac"`
+	// PortForwards are host ports forwarded into the guest. They are
+	// only supported by the user backend.
+	PortForwards []portForward `yaml:"port_forwards"`
+}
+
+// netBackends are the supported networkConfig backends.
+//
+// The vmnet backends, available in QEMU 7.1 and later on macOS 11 and
+// later, use the vmnet framework instead of user-mode networking,
+// which has higher throughput and lets the guest accept inbound
+// connections. The guest gets its own address, by DHCP from the host
+// for vmnet-shared and vmnet-host, or from the bridged network for
+// vmnet-bridged, so -buildlet-healthz-url must point at it. The
+// vmnet framework requires QEMU to either run as root or be signed
+// with the com.apple.vm.networking entitlement, which Apple only
+// grants on request, so runqemubuildlet generally must run as root.
+var netBackends = map[string]bool{
+	"user":          true,
+	"vmnet-shared":  true, // NAT, like user but with a guest address reachable from the host
+	"vmnet-host":    true, // host-only: reachable from the host, but not beyond
+	"vmnet-bridged": true, // bridged to Interface
+}
+
+// isVMNet reports whether backend uses the macOS vmnet framework.
+func isVMNet(backend string) bool {
+	return strings.HasPrefix(backend, "vmnet-")
+}
+
+// portForward forwards HostPort on the host to GuestPort in the
+// guest.
+type portForward struct {
+	// Protocol is "tcp" or "udp". It defaults to "tcp".
+	Protocol  string `yaml:"protocol" json:"protocol,omitempty"`
+	HostPort  int    `yaml:"host_port" json:"host_port"`
+	GuestPort int    `yaml:"guest_port" json:"guest_port"`
+}
+
+// network returns pf.Protocol, or its default.
+func (pf portForward) network() string {
+	if pf.Protocol == "" {
+		return "tcp"
+	}
+	return pf.Protocol
+}
+
+// isRDP reports whether pf forwards to the guest's Remote Desktop port.
+func (pf portForward) isRDP() bool {
+	return pf.network() == "tcp" && pf.GuestPort == rdpGuestPort
+}
+
+// driveConfig describes a disk or cdrom image attached to the guest.
+type driveConfig struct {
+	ID string `yaml:"id"`
+	// File is the path to the image.
+	File string `yaml:"file"`
+	// Media is "disk" or "cdrom".
+	Media string `yaml:"media"`
+	// Format is the image format, such as qcow2 or raw. If empty,
+	// QEMU probes the format.
+	Format string `yaml:"format"`
+	// Cache is the host cache mode, such as writeback, none, or
+	// unsafe. If "auto", the mode, and AIO mode unless set, are chosen
+	// for the host file system containing the image and whether
+	// writes are discarded after the run. If empty, QEMU's default,
+	// writeback, is used.
+	Cache string `yaml:"cache"`
+	// AIO is the host AIO mode: threads, native, or io_uring.
+	AIO string `yaml:"aio"`
+	// Discard is whether guest discard requests are passed to the
+	// image: ignore or unmap.
+	Discard string `yaml:"discard"`
+	// DetectZeroes is whether writes of zeroes are detected and
+	// turned into efficient zero writes: off, on, or unmap, which
+	// discards them and requires discard unmap.
+	DetectZeroes string `yaml:"detect_zeroes"`
+	ReadOnly     bool   `yaml:"read_only"`
+	// Device is the guest device the drive is attached to, such as
+	// nvme or usb-storage.
+	Device string `yaml:"device"`
+	// DeviceOptions are appended to the -device argument, such as
+	// "bootindex=0".
+	DeviceOptions string `yaml:"device_options"`
+}
+
+// loadConfig reads a YAML VM definition from path.
+func loadConfig(path string) (*vmConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(vmConfig)
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if c.Base == "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		c.Base = filepath.Dir(abs)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// validate reports whether c describes a runnable VM.
+func (c *vmConfig) validate() error {
+	switch c.Backend {
+	case "", backendQEMU:
+		if c.QEMU == "" {
+			return errors.New("qemu binary must be set")
+		}
+		if c.VZ != nil {
+			return errors.New("vz requires backend vz")
+		}
+		if c.Arch != "" && !archRE.MatchString(c.Arch) {
+			return fmt.Errorf("arch %q, wanted a QEMU architecture name such as aarch64 or x86_64", c.Arch)
+		}
+	case backendVZ:
+		if err := c.validateVZ(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("backend %q, wanted qemu or vz", c.Backend)
+	}
+	if c.CPUs < 0 {
+		return fmt.Errorf("cpus = %d, must not be negative", c.CPUs)
+	}
+	if err := c.validateTopology(); err != nil {
+		return err
+	}
+	if c.MemoryMB < 0 {
+		return fmt.Errorf("memory_mb = %d, must not be negative", c.MemoryMB)
+	}
+	for _, hc := range c.HealthChecks {
+		if err := hc.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Heartbeat.validate(); err != nil {
+		return err
+	}
+	for _, p := range c.FatalPatterns {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	for _, nc := range c.Notifiers {
+		if err := nc.validate(); err != nil {
+			return err
+		}
+	}
+	tags := make(map[string]bool)
+	for _, sh := range c.Shares {
+		if err := sh.validate(); err != nil {
+			return err
+		}
+		if tags[sh.Tag] {
+			return fmt.Errorf("duplicate share tag %q", sh.Tag)
+		}
+		tags[sh.Tag] = true
+		if sh.Type == shareVirtiofs && c.MemoryMB <= 0 {
+			return fmt.Errorf("virtiofs share %s requires memory_mb to be set", sh.Tag)
+		}
+	}
+	if b := c.Network.Backend; b != "" && !netBackends[b] {
+		return fmt.Errorf("network backend %q, wanted user, vmnet-shared, vmnet-host, or vmnet-bridged", b)
+	}
+	if isVMNet(c.Network.Backend) && len(c.Network.PortForwards) > 0 {
+		return fmt.Errorf("network backend %s does not support port forwards", c.Network.Backend)
+	}
+	if c.Network.MAC != "" {
+		if _, err := net.ParseMAC(c.Network.MAC); err != nil {
+			return fmt.Errorf("network mac: %w", err)
+		}
+	}
+	if (c.Network.Backend == "vmnet-bridged") != (c.Network.Interface != "") {
+		return errors.New("network interface must be set with, and only with, backend vmnet-bridged")
+	}
+	for _, pf := range c.Network.PortForwards {
+		switch pf.Protocol {
+		case "", "tcp", "udp":
+		default:
+			return fmt.Errorf("port forward protocol %q, wanted tcp or udp", pf.Protocol)
+		}
+		if pf.HostPort <= 0 || pf.GuestPort <= 0 {
+			return fmt.Errorf("port forward %d->%d must use positive ports", pf.HostPort, pf.GuestPort)
+		}
+	}
+	for _, d := range c.Drives {
+		if d.ID == "" || d.File == "" {
+			return fmt.Errorf("drive %+v must have an id and file", d)
+		}
+		if c.Backend != backendVZ && d.Device == "" {
+			return fmt.Errorf("drive %s must have a device", d.ID)
+		}
+		if err := d.validateIO(); err != nil {
+			return err
+		}
+	}
+	if c.BIOS != "" && c.Firmware != nil {
+		return errors.New("bios and firmware are mutually exclusive")
+	}
+	if c.Firmware != nil && (c.Firmware.Code == "" || c.Firmware.Vars == "") {
+		return errors.New("firmware must set both code and vars")
+	}
+	if c.TPM != nil && c.TPM.StateDir == "" {
+		return errors.New("tpm must set state_dir")
+	}
+	if c.Balloon != nil {
+		if err := c.Balloon.validate(c.MemoryMB); err != nil {
+			return err
+		}
+	}
+	if c.Provision != nil {
+		if err := c.Provision.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of c.
+func (c *vmConfig) clone() *vmConfig {
+	n := *c
+	n.Accel = append([]string(nil), c.Accel...)
+	n.Devices = append([]string(nil), c.Devices...)
+	n.Network.PortForwards = append([]portForward(nil), c.Network.PortForwards...)
+	n.Drives = append([]driveConfig(nil), c.Drives...)
+	n.ExtraArgs = append([]string(nil), c.ExtraArgs...)
+	n.Shares = append([]shareConfig(nil), c.Shares...)
+	n.FatalPatterns = append([]fatalPattern(nil), c.FatalPatterns...)
+	n.Notifiers = nil
+	for _, nc := range c.Notifiers {
+		nc.Command = append([]string(nil), nc.Command...)
+		nc.Events = append([]string(nil), nc.Events...)
+		n.Notifiers = append(n.Notifiers, nc)
+	}
+	n.HealthChecks = nil
+	for _, hc := range c.HealthChecks {
+		hc.Command = append([]string(nil), hc.Command...)
+		n.HealthChecks = append(n.HealthChecks, hc)
+	}
+	if c.Firmware != nil {
+		f := *c.Firmware
+		n.Firmware = &f
+	}
+	if c.TPM != nil {
+		t := *c.TPM
+		n.TPM = &t
+	}
+	if c.Balloon != nil {
+		b := *c.Balloon
+		n.Balloon = &b
+	}
+	if c.VZ != nil {
+		v := *c.VZ
+		n.VZ = &v
+	}
+	if c.Provision != nil {
+		p := *c.Provision
+		if c.Provision.Metadata != nil {
+			p.Metadata = make(map[string]string)
+			for k, v := range c.Provision.Metadata {
+				p.Metadata[k] = v
+			}
+		}
+		n.Provision = &p
+	}
+	if c.CloudInit != nil {
+		ci := *c.CloudInit
+		ci.Files = append([]string(nil), c.CloudInit.Files...)
+		n.CloudInit = &ci
+	}
+	return &n
+}
+
+// path resolves p relative to c.Base.
+func (c *vmConfig) path(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.Base, p)
+}
+
+// qemuEscape escapes the commas in s, for use as the value of a QEMU
+// option, which commas otherwise separate.
+func qemuEscape(s string) string {
+	return strings.ReplaceAll(s, ",", ",,")
+}
+
+// args returns the QEMU command line arguments described by c.
+func (c *vmConfig) args() []string {
+	var args []string
+	add := func(a ...string) { args = append(args, a...) }
+	if c.DataDir != "" {
+		add("-L", c.path(c.DataDir))
+	}
+	if c.CPU != "" {
+		add("-cpu", c.CPU)
+	}
+	if c.CPUs > 0 {
+		add("-smp", c.smp())
+	}
+	if c.Machine != "" {
+		add("-machine", c.Machine)
+	}
+	for _, a := range expandAccel(c.Accel, hostAccel()) {
+		add("-accel", a)
+	}
+	if c.Boot != "" {
+		add("-boot", c.Boot)
+	}
+	if c.MemoryMB > 0 {
+		add("-m", fmt.Sprint(c.MemoryMB))
+	}
+	if c.Name != "" {
+		add("-name", c.Name)
+	}
+	for _, d := range c.Devices {
+		add("-device", d)
+	}
+	if c.Network.Device != "" {
+		dev := c.Network.Device + ",netdev=net0"
+		if c.Network.MAC != "" {
+			dev += ",mac=" + c.Network.MAC
+		}
+		add("-device", dev)
+		add("-netdev", c.netdev())
+	}
+	if c.BIOS != "" {
+		add("-bios", c.path(c.BIOS))
+	}
+	if c.Firmware != nil {
+		add("-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,readonly=on,file=%s", qemuEscape(c.path(c.Firmware.Code))))
+		add("-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", qemuEscape(c.path(c.Firmware.Vars))))
+	}
+	if c.TPM != nil {
+		add("-chardev", fmt.Sprintf("socket,id=chrtpm,path=%s", qemuEscape(c.tpmSocket())))
+		add("-tpmdev", "emulator,id=tpm0,chardev=chrtpm")
+		add("-device", "tpm-tis-device,tpmdev=tpm0")
+	}
+	if c.Balloon != nil {
+		add("-device", "virtio-balloon-pci,id=balloon0,deflate-on-oom=on,free-page-reporting=on")
+	}
+	if c.RNG {
+		add("-object", "rng-builtin,id=rng0")
+		add("-device", "virtio-rng-pci,rng=rng0")
+	}
+	add(c.shareArgs()...)
+	for _, d := range c.Drives {
+		dev := fmt.Sprintf("%s,drive=%s", d.Device, d.ID)
+		if d.DeviceOptions != "" {
+			dev += "," + d.DeviceOptions
+		}
+		drive := fmt.Sprintf("if=none,media=%s,id=%s,file=%s", d.Media, d.ID, qemuEscape(c.path(d.File)))
+		if d.Format != "" {
+			drive += ",format=" + d.Format
+		}
+		cache, aio := c.ioOptions(d)
+		if cache != "" {
+			drive += ",cache=" + cache
+		}
+		if aio != "" {
+			drive += ",aio=" + aio
+		}
+		if d.Discard != "" {
+			drive += ",discard=" + d.Discard
+		}
+		if d.DetectZeroes != "" {
+			drive += ",detect-zeroes=" + d.DetectZeroes
+		}
+		if d.ReadOnly {
+			drive += ",readonly=on"
+		}
+		add("-device", dev, "-drive", drive)
+	}
+	if c.Snapshot {
+		add("-snapshot")
+	}
+	if c.RTC != "" {
+		add("-rtc", c.RTC)
+	}
+	if c.Serial != "" {
+		add("-serial", c.Serial)
+	}
+	if c.VNC != "" {
+		add("-vnc", c.VNC)
+	}
+	if c.GuestAgent && c.GuestAgentSocket != "" {
+		add("-chardev", fmt.Sprintf("socket,id=qga0,path=%s,server=on,wait=off", qemuEscape(c.path(c.GuestAgentSocket))))
+		add("-device", "virtio-serial")
+		add("-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0")
+	}
+	if c.QMPSocket != "" {
+		add("-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", qemuEscape(c.path(c.QMPSocket))))
+	}
+	add(c.ExtraArgs...)
+	return args
+}
+
+// applyNetworkBackend applies a -network-backend flag value to c. The
+// vmnet-bridged backend takes the interface to bridge to, as in
+// "vmnet-bridged=en0". Port forwards are dropped for vmnet backends,
+// whose guests are reached at their own address.
+func applyNetworkBackend(c *vmConfig, flagValue string) error {
+	backend, iface := flagValue, ""
+	if i := strings.Index(flagValue, "="); i >= 0 {
+		backend, iface = flagValue[:i], flagValue[i+1:]
+	}
+	c.Network.Backend = backend
+	c.Network.Interface = iface
+	if isVMNet(backend) {
+		c.Network.PortForwards = nil
+	}
+	return c.validate()
+}
+
+// netdev returns the -netdev argument for the guest network.
+func (c *vmConfig) netdev() string {
+	switch b := c.Network.Backend; {
+	case b == "vmnet-bridged":
+		return fmt.Sprintf("%s,id=net0,ifname=%s", b, c.Network.Interface)
+	case isVMNet(b):
+		return b + ",id=net0"
+	}
+	s := []string{"user", "id=net0"}
+	for _, pf := range c.Network.PortForwards {
+		s = append(s, fmt.Sprintf("hostfwd=%s::%d-:%d", pf.network(), pf.HostPort, pf.GuestPort))
+	}
+	return strings.Join(s, ",")
+}
+
+// command returns a QEMU, or for the vz backend vfkit, command for
+// running the VM, ready to be started.
+func (c *vmConfig) command() *exec.Cmd {
+	if c.isVZ() {
+		cmd := exec.Command(c.vzBinary(), c.vzArgs()...)
+		cmd.Env = os.Environ()
+		return cmd
+	}
+	cmd := exec.Command(c.path(c.QEMU), c.args()...)
+	cmd.Env = c.env()
+	return cmd
+}
+
+// env returns the environment for QEMU and its tools.
+func (c *vmConfig) env() []string {
+	return append(os.Environ(), c.extraEnv()...)
+}
+
+// extraEnv returns the variables c adds to the environment of QEMU.
+func (c *vmConfig) extraEnv() []string {
+	var env []string
+	if c.LibraryPath != "" {
+		env = append(env, fmt.Sprintf("DYLD_LIBRARY_PATH=%s", c.path(c.LibraryPath)))
+	}
+	return env
+}
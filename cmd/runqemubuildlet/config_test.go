@@ -0,0 +1,302 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWindows10ConfigArgs(t *testing.T) {
+	defer func(f func() string) { hostAccel = f }(hostAccel)
+	hostAccel = func() string { return "hvf" }
+
+	base := "/base"
+	want := []string{
+		"-L", "/base/UTM.app/Contents/Resources/qemu",
+		"-cpu", "max",
+		"-smp", "cpus=8,sockets=1,cores=8,threads=1",
+		"-machine", "virt,highmem=off",
+		"-accel", "hvf",
+		"-accel", "tcg,tb-size=1536",
+		"-boot", "menu=on",
+		"-m", "12288",
+		"-name", "Virtual Machine",
+		"-device", "qemu-xhci,id=usb-bus",
+		"-device", "ramfb",
+		"-device", "usb-tablet,bus=usb-bus.0",
+		"-device", "usb-mouse,bus=usb-bus.0",
+		"-device", "usb-kbd,bus=usb-bus.0",
+		"-device", "virtio-net-pci,netdev=net0",
+		"-netdev", "user,id=net0,hostfwd=tcp::8080-:8080",
+		"-bios", "/base/Images/QEMU_EFI.fd",
+		"-object", "rng-builtin,id=rng0",
+		"-device", "virtio-rng-pci,rng=rng0",
+		"-device", "nvme,drive=drive0,serial=drive0,bootindex=0",
+		"-drive", "if=none,media=disk,id=drive0,file=/base/Images/win10.qcow2,cache=unsafe",
+		"-device", "usb-storage,drive=drive2,removable=true,bootindex=1",
+		"-drive", "if=none,media=cdrom,id=drive2,file=/base/Images/virtio.iso,cache=unsafe",
+		"-snapshot",
+		"-vnc", ":3",
+	}
+	if diff := cmp.Diff(want, windows10Config(base).args()); diff != "" {
+		t.Errorf("windows10Config(%q).args() mismatch (-want +got):\n%s", base, diff)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runqemubuildlet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		desc    string
+		config  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			desc: "minimal",
+			config: `
+qemu: bin/qemu-system-aarch64
+cpus: 4
+memory_mb: 4096
+network:
+  device: virtio-net-pci
+  port_forwards:
+  - host_port: 9090
+    guest_port: 8080
+drives:
+- id: drive0
+  file: disk.qcow2
+  media: disk
+  device: virtio-blk-pci
+snapshot: true
+`,
+			want: []string{
+				"-smp", "cpus=4,sockets=1,cores=4,threads=1",
+				"-m", "4096",
+				"-device", "virtio-net-pci,netdev=net0",
+				"-netdev", "user,id=net0,hostfwd=tcp::9090-:8080",
+				"-device", "virtio-blk-pci,drive=drive0",
+				"-drive", "if=none,media=disk,id=drive0,file=" + filepath.Join(dir, "disk.qcow2"),
+				"-snapshot",
+			},
+		},
+		{
+			desc:    "missing qemu",
+			config:  "cpus: 4\n",
+			wantErr: true,
+		},
+		{
+			desc: "drive without device",
+			config: `
+qemu: qemu
+drives:
+- id: drive0
+  file: disk.qcow2
+  media: disk
+`,
+			wantErr: true,
+		},
+		{
+			desc: "comma in drive file",
+			config: `
+qemu: qemu
+drives:
+- id: drive0
+  file: /images/a,b.qcow2
+  media: disk
+  device: nvme
+`,
+			want: []string{
+				"-device", "nvme,drive=drive0",
+				"-drive", "if=none,media=disk,id=drive0,file=/images/a,,b.qcow2",
+			},
+		},
+		{
+			desc: "commas in firmware and socket paths",
+			config: `
+qemu: qemu
+firmware:
+  code: /fw/a,b-code.fd
+  vars: /fw/a,b-vars.fd
+tpm:
+  state_dir: /tpm/a,b
+guest_agent: true
+guest_agent_socket: /run/qga,id=x.sock
+qmp_socket: /run/qmp,server=off.sock
+`,
+			want: []string{
+				"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=/fw/a,,b-code.fd",
+				"-drive", "if=pflash,format=raw,unit=1,file=/fw/a,,b-vars.fd",
+				"-chardev", "socket,id=chrtpm,path=/tpm/a,,b/swtpm-sock",
+				"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+				"-device", "tpm-tis-device,tpmdev=tpm0",
+				"-chardev", "socket,id=qga0,path=/run/qga,,id=x.sock,server=on,wait=off",
+				"-device", "virtio-serial",
+				"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+				"-qmp", "unix:/run/qmp,,server=off.sock,server=on,wait=off",
+			},
+		},
+		{
+			desc:    "unknown field",
+			config:  "qemu: qemu\nfloppy: a.img\n",
+			wantErr: true,
+		},
+		{
+			desc: "bad protocol",
+			config: `
+qemu: qemu
+network:
+  port_forwards:
+  - protocol: sctp
+    host_port: 1
+    guest_port: 1
+`,
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			path := filepath.Join(dir, "vm.yaml")
+			if err := ioutil.WriteFile(path, []byte(c.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfig(path)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("loadConfig(%q) = %v, wantErr: %t", path, err, c.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.Base != dir {
+				t.Errorf("cfg.Base = %q, wanted %q", cfg.Base, dir)
+			}
+			if diff := cmp.Diff(c.want, cfg.args()); diff != "" {
+				t.Errorf("cfg.args() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWindows11ConfigArgs(t *testing.T) {
+	c := windows11Config("/base")
+	if err := c.validate(); err != nil {
+		t.Fatalf("windows11Config().validate() = %v, wanted no error", err)
+	}
+	args := strings.Join(c.args(), " ")
+	for _, want := range []string{
+		"-drive if=pflash,format=raw,unit=0,readonly=on,file=/base/UTM.app/Contents/Resources/qemu/edk2-aarch64-secure-code.fd",
+		"-drive if=pflash,format=raw,unit=1,file=/base/Images/efi_vars.fd",
+		"-chardev socket,id=chrtpm,path=/base/tpm/swtpm-sock",
+		"-tpmdev emulator,id=tpm0,chardev=chrtpm",
+		"-device tpm-tis-device,tpmdev=tpm0",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("windows11Config().args() = %q, wanted it to contain %q", args, want)
+		}
+	}
+	if strings.Contains(args, "-bios") {
+		t.Errorf("windows11Config().args() = %q, wanted no -bios", args)
+	}
+}
+
+func TestGuestAgentArgs(t *testing.T) {
+	c := &vmConfig{Base: "/base", GuestAgent: true, GuestAgentSocket: "qga.sock"}
+	want := []string{
+		"-chardev", "socket,id=qga0,path=/base/qga.sock,server=on,wait=off",
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+	}
+	got := c.args()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("args() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestShareArgs(t *testing.T) {
+	c := &vmConfig{
+		Base:     "/base",
+		MemoryMB: 4096,
+		Shares: []shareConfig{
+			{Tag: "cache", Path: "go,cache", ReadOnly: true},
+			{Tag: "out", Path: "/srv/out", Type: shareVirtiofs, Socket: "/tmp/vfs,out.sock"},
+		},
+	}
+	want := []string{
+		"-m", "4096",
+		"-fsdev", "local,id=fs0,path=/base/go,,cache,security_model=mapped-xattr,readonly=on",
+		"-device", "virtio-9p-pci,fsdev=fs0,mount_tag=cache",
+		"-chardev", "socket,id=vfs1,path=/tmp/vfs,,out.sock",
+		"-device", "vhost-user-fs-pci,chardev=vfs1,tag=out",
+		"-object", "memory-backend-memfd,id=mem,size=4096M,share=on",
+		"-numa", "node,memdev=mem",
+	}
+	got := c.args()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("args() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateShares(t *testing.T) {
+	cases := []struct {
+		desc    string
+		shares  []shareConfig
+		wantErr bool
+	}{
+		{desc: "9p", shares: []shareConfig{{Tag: "a", Path: "/a"}}},
+		{desc: "no path", shares: []shareConfig{{Tag: "a"}}, wantErr: true},
+		{desc: "duplicate tag", shares: []shareConfig{{Tag: "a", Path: "/a"}, {Tag: "a", Path: "/b"}}, wantErr: true},
+		{desc: "unknown type", shares: []shareConfig{{Tag: "a", Path: "/a", Type: "smb"}}, wantErr: true},
+		{desc: "virtiofs without memory", shares: []shareConfig{{Tag: "a", Path: "/a", Type: shareVirtiofs}}, wantErr: true},
+	}
+	for _, c := range cases {
+		cfg := &vmConfig{QEMU: "qemu", Shares: c.shares}
+		if err := cfg.validate(); (err != nil) != c.wantErr {
+			t.Errorf("%s: validate() = %v, wantErr: %t", c.desc, err, c.wantErr)
+		}
+	}
+}
+
+func TestApplyNetworkBackend(t *testing.T) {
+	cases := []struct {
+		flag       string
+		wantNetdev string
+		wantErr    bool
+	}{
+		{flag: "user", wantNetdev: "user,id=net0,hostfwd=tcp::8080-:8080"},
+		{flag: "vmnet-shared", wantNetdev: "vmnet-shared,id=net0"},
+		{flag: "vmnet-host", wantNetdev: "vmnet-host,id=net0"},
+		{flag: "vmnet-bridged=en0", wantNetdev: "vmnet-bridged,id=net0,ifname=en0"},
+		{flag: "vmnet-bridged", wantErr: true},
+		{flag: "vmnet-shared=en0", wantErr: true},
+		{flag: "tap", wantErr: true},
+	}
+	for _, c := range cases {
+		cfg := windows10Config("/base")
+		err := applyNetworkBackend(cfg, c.flag)
+		if (err != nil) != c.wantErr {
+			t.Errorf("applyNetworkBackend(_, %q) = %v, wantErr: %t", c.flag, err, c.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := cfg.netdev(); got != c.wantNetdev {
+			t.Errorf("after applyNetworkBackend(_, %q), netdev() = %q, wanted %q", c.flag, got, c.wantNetdev)
+		}
+	}
+}
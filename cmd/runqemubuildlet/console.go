@@ -0,0 +1,201 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// consoleDialTimeout is how long connecting to a VM's VNC server may
+// take.
+const consoleDialTimeout = 10 * time.Second
+
+// consolePassword returns the web console password read from path.
+func consolePassword(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	pw := strings.TrimSpace(string(b))
+	if pw == "" {
+		return "", fmt.Errorf("console password in %s is empty", path)
+	}
+	return pw, nil
+}
+
+// vncAddr returns the TCP address of the VNC server of the instance's
+// VM, if it has one.
+func (in *instance) vncAddr() (string, error) {
+	vnc := in.config().VNC
+	if vnc == "" {
+		return "", errors.New("no VNC display")
+	}
+	host, d, _, err := splitVNC(vnc)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(vncBasePort+d)), nil
+}
+
+// registerConsole adds a web console for the displays of insts to
+// mux, under /console/, requiring HTTP basic authentication with
+// password and any user name.
+//
+// /console/NAME serves a page showing the display of the instance
+// named NAME with noVNC, which is served from novncDir at
+// /console/novnc/, and /console/NAME/websockify proxies a WebSocket to
+// its VNC server, for that page or any other noVNC client.
+func registerConsole(mux *http.ServeMux, insts []*instance, password, novncDir string) {
+	byName := make(map[string]*instance)
+	var names []string
+	for _, in := range insts {
+		byName[in.name] = in
+		if in.cfg.VNC != "" {
+			names = append(names, in.name)
+		}
+	}
+	mux.Handle("/console/", requireConsoleAuth(password, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/console/")
+		if rest == "" {
+			consoleIndex.Execute(w, names)
+			return
+		}
+		if strings.HasPrefix(rest, "novnc/") {
+			if novncDir == "" {
+				http.Error(w, "noVNC is not installed; set -novnc-dir", http.StatusNotFound)
+				return
+			}
+			http.StripPrefix("/console/novnc/", http.FileServer(http.Dir(novncDir))).ServeHTTP(w, r)
+			return
+		}
+		name, ws := rest, false
+		if strings.HasSuffix(rest, "/websockify") {
+			name, ws = strings.TrimSuffix(rest, "/websockify"), true
+		}
+		in, ok := byName[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		addr, err := in.vncAddr()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusNotFound)
+			return
+		}
+		if !ws {
+			consolePage.Execute(w, struct {
+				Name, Path, Password string
+			}{in.name, r.URL.Path + "/websockify", in.vncPassword})
+			return
+		}
+		websocket.Server{
+			Handshake: consoleHandshake,
+			Handler: func(conn *websocket.Conn) {
+				in.logger.Info("Web console connected", "remote_addr", r.RemoteAddr)
+				audit.record("console", "http", httpRequester(r), "vm", in.name)
+				err := proxyVNC(conn, addr)
+				in.logger.Info("Web console disconnected", "remote_addr", r.RemoteAddr, "err", err)
+			},
+		}.ServeHTTP(w, r)
+	})))
+}
+
+// requireConsoleAuth returns a handler requiring HTTP basic
+// authentication with password before calling h.
+func requireConsoleAuth(password string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pw, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(pw), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="runqemubuildlet console"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// consoleHandshake accepts WebSocket connections from pages served by
+// this host only, since browsers send basic authentication credentials
+// along with WebSockets opened by any site, and selects noVNC's binary
+// subprotocol if it is offered.
+func consoleHandshake(c *websocket.Config, r *http.Request) error {
+	if o := r.Header.Get("Origin"); o != "" {
+		u, err := url.Parse(o)
+		if err != nil || u.Host != r.Host {
+			return fmt.Errorf("origin %q does not match host %q", o, r.Host)
+		}
+	}
+	offered := c.Protocol
+	c.Protocol = nil
+	for _, p := range offered {
+		if p == "binary" {
+			c.Protocol = []string{p}
+		}
+	}
+	return nil
+}
+
+// proxyVNC copies data between ws and the VNC server at addr until
+// either closes the connection.
+func proxyVNC(ws *websocket.Conn, addr string) error {
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+	c, err := net.DialTimeout("tcp", addr, consoleDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(c, ws)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(ws, c)
+		errc <- err
+	}()
+	return <-errc
+}
+
+var consoleIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<title>runqemubuildlet consoles</title>
+<ul>
+{{range .}}<li><a href="/console/{{.}}">{{.}}</a>
+{{end}}</ul>
+`))
+
+var consolePage = template.Must(template.New("console").Parse(`<!DOCTYPE html>
+<title>{{.Name}} console</title>
+<style>body { margin: 0; background: #000; } #screen { width: 100vw; height: 100vh; }</style>
+<div id="screen"></div>
+<script type="module">
+import RFB from "/console/novnc/core/rfb.js";
+const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+const rfb = new RFB(document.getElementById("screen"), scheme + "//" + location.host + {{.Path}}, {
+	credentials: {password: {{.Password}}},
+});
+rfb.scaleViewport = true;
+rfb.addEventListener("disconnect", () => { document.title = {{.Name}} + " console (disconnected)"; });
+</script>
+`))
@@ -0,0 +1,107 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestConsole(t *testing.T) {
+	// A fake VNC server that echoes what it receives.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	cfg := windows10Config("/base")
+	cfg.VNC = fmt.Sprintf("127.0.0.1:%d", port-vncBasePort)
+	in := newInstance("vm", cfg, "http://localhost:8080/healthz")
+	mux := http.NewServeMux()
+	registerConsole(mux, []*instance{in}, "secret", "")
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	cases := []struct {
+		path     string
+		password string
+		want     int
+	}{
+		{"/console/", "", http.StatusUnauthorized},
+		{"/console/", "wrong", http.StatusUnauthorized},
+		{"/console/", "secret", http.StatusOK},
+		{"/console/vm", "secret", http.StatusOK},
+		{"/console/vm1", "secret", http.StatusNotFound},
+		{"/console/novnc/core/rfb.js", "secret", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", s.URL+c.path, nil)
+		if c.password != "" {
+			req.SetBasicAuth("", c.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", c.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("GET %s with password %q status = %d, wanted %d", c.path, c.password, resp.StatusCode, c.want)
+		}
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/console/vm/websockify"
+	wcfg, err := websocket.NewConfig(wsURL, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wcfg.Protocol = []string{"binary"}
+	wcfg.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":secret")))
+	ws, err := websocket.DialConfig(wcfg)
+	if err != nil {
+		t.Fatalf("DialConfig(%q) = %v", wsURL, err)
+	}
+	defer ws.Close()
+	if err := websocket.Message.Send(ws, []byte("RFB 003.008\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	var got []byte
+	if err := websocket.Message.Receive(ws, &got); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if string(got) != "RFB 003.008\n" {
+		t.Errorf("Receive() = %q, wanted echo of %q", got, "RFB 003.008\n")
+	}
+
+	wcfg.Origin, _ = wcfg.Origin.Parse("http://evil.example")
+	if ws, err := websocket.DialConfig(wcfg); err == nil {
+		ws.Close()
+		t.Errorf("DialConfig() from another origin succeeded, wanted error")
+	}
+}
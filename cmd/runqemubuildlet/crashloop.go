@@ -0,0 +1,48 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// crashLoopTimeout is the maximum time the -crash-loop-exec command
+// may run.
+const crashLoopTimeout = time.Minute
+
+// escalateCrashLoop is called when the VM logged to by lg is
+// crash-looping, with the error from its most recent run.
+//
+// It runs the -crash-loop-exec command, if any, with
+// RUNQEMUBUILDLET_VM and RUNQEMUBUILDLET_ERROR set in its environment.
+// If -crash-loop-exit is set, it then exits the process with a
+// non-zero status so that the init system notices.
+func escalateCrashLoop(lg *slog.Logger, name string, err error) {
+	lg.Error("VM is crash-looping", "failures", *crashLoopMax, "window", *crashLoopWindow, "err", err)
+	if *crashLoopExec != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), crashLoopTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", *crashLoopExec)
+		cmd.Env = append(os.Environ(),
+			"RUNQEMUBUILDLET_VM="+name,
+			fmt.Sprintf("RUNQEMUBUILDLET_ERROR=%v", err),
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			lg.Error("Crash loop hook failed", "cmd", *crashLoopExec, "err", err, "output", string(out))
+		}
+	}
+	if *crashLoopExit {
+		lg.Error("Exiting due to crash loop")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// drainPollInterval is how often a draining instance checks whether
+// its buildlet is still running a command.
+const drainPollInterval = 30 * time.Second
+
+// drainer records whether runqemubuildlet has been asked to drain:
+// to let each VM finish its in-flight build, then exit rather than
+// restart it.
+type drainer struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{c: make(chan struct{})}
+}
+
+// drain requests draining. It may be called more than once.
+func (d *drainer) drain() {
+	d.once.Do(func() { close(d.c) })
+}
+
+// done returns a channel that is closed once draining is requested.
+func (d *drainer) done() <-chan struct{} {
+	return d.c
+}
+
+// draining reports whether draining has been requested.
+func (d *drainer) draining() bool {
+	select {
+	case <-d.c:
+		return true
+	default:
+		return false
+	}
+}
+
+// statusURL returns the URL of the buildlet's /status endpoint,
+// served alongside its /healthz endpoint.
+func (in *instance) statusURL() (string, error) {
+	u, err := url.Parse(in.healthzURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(path.Dir(u.Path), "status")
+	return u.String(), nil
+}
+
+// buildletKey is the builder key of the guest buildlets, which they
+// require as the basic auth password of /status, or empty.
+var buildletKey string
+
+// loadBuildletKey returns the builder key in -buildlet-key-file or, if
+// that's empty, in the key file c provisions the guest with.
+func loadBuildletKey(c *vmConfig) (string, error) {
+	var p string
+	switch {
+	case *buildletKeyFile != "":
+		p = *buildletKeyFile
+	case c.Provision != nil && c.Provision.KeyFile != "":
+		p = c.path(c.Provision.KeyFile)
+	case c.CloudInit != nil && c.CloudInit.KeyFile != "":
+		p = c.path(c.CloudInit.KeyFile)
+	default:
+		return "", nil
+	}
+	key, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+// buildletAuthorization returns the Authorization header value for
+// requests to the buildlet's /status, or empty if there's no
+// buildletKey.
+func buildletAuthorization() string {
+	if buildletKey == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(":"+buildletKey))
+}
+
+// buildletBusy reports whether the buildlet serving /status at
+// statusURL is running a command.
+func buildletBusy(ctx context.Context, statusURL string) (bool, error) {
+	s, err := buildletStatus(ctx, statusURL)
+	if err != nil {
+		return false, err
+	}
+	return s.ActiveExecs > 0, nil
+}
+
+// buildletStatus returns the status of the buildlet serving /status
+// at statusURL.
+func buildletStatus(ctx context.Context, statusURL string) (buildlet.Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var s buildlet.Status
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, statusURL, nil)
+	if err != nil {
+		return s, err
+	}
+	if a := buildletAuthorization(); a != "" {
+		req.Header.Set("Authorization", a)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("GET %s: %v", statusURL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return s, fmt.Errorf("decoding %s: %w", statusURL, err)
+	}
+	return s, nil
+}
+
+// stopRequest is the cause of stopping a VM on purpose, such as to
+// drain or recycle it.
+type stopRequest struct {
+	reason string // such as "drain" or "max_uptime"
+}
+
+func (r *stopRequest) Error() string {
+	return "VM stopped for " + r.reason
+}
+
+// stopWhenDrained calls stopWhenIdle once draining is requested. It
+// returns early if ctx is done.
+func (in *instance) stopWhenDrained(ctx context.Context, stop context.CancelCauseFunc) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-in.drain.done():
+	}
+	in.stopWhenIdle(ctx, "drain", *drainTimeout, stop)
+}
+
+// stopWhenIdle calls stop with a *stopRequest for reason once the
+// instance's buildlet is not running a command, or after timeout, if
+// positive. It returns early if ctx is done.
+//
+// A buildlet that cannot be reached is considered idle: it cannot be
+// running a build for the coordinator either.
+func (in *instance) stopWhenIdle(ctx context.Context, reason string, timeout time.Duration, stop context.CancelCauseFunc) {
+	statusURL, err := in.statusURL()
+	if err != nil {
+		in.logger.Warn("Finding buildlet status URL failed; stopping VM", "err", err)
+		stop(&stopRequest{reason: reason})
+		return
+	}
+	in.logger.Info("Waiting for the buildlet to finish its build before stopping VM", "reason", reason, "status_url", statusURL, "timeout", timeout)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	tick := time.NewTicker(drainPollInterval)
+	defer tick.Stop()
+	for {
+		busy, err := buildletBusy(ctx, statusURL)
+		if err != nil {
+			in.logger.Warn("Checking buildlet status failed; assuming idle", "err", err)
+		}
+		if !busy {
+			in.logger.Info("Buildlet idle; stopping VM")
+			stop(&stopRequest{reason: reason})
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-expired:
+			in.logger.Warn("Buildlet still busy after timeout; stopping VM", "reason", reason, "timeout", timeout)
+			stop(&stopRequest{reason: reason})
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && (windows || plan9)
+// +build go1.21
+// +build windows plan9
+
+package main
+
+// notifyDrain does nothing, as there is no SIGUSR1 on this platform.
+// Use POST /drain instead.
+func notifyDrain(d *drainer) {}
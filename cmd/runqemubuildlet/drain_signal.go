@@ -0,0 +1,26 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !windows && !plan9
+// +build go1.21,!windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDrain requests draining from d when runqemubuildlet receives
+// SIGUSR1.
+func notifyDrain(d *drainer) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		sig := <-c
+		audit.record("drain", "signal", "", "signal", sig.String())
+		d.drain()
+	}()
+}
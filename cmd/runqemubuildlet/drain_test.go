@@ -0,0 +1,120 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildletBusy(t *testing.T) {
+	cases := []struct {
+		body    string
+		want    bool
+		wantErr bool
+	}{
+		{body: `{"Version": 26, "ActiveExecs": 2}`, want: true},
+		{body: `{"Version": 26}`, want: false},
+		{body: `{"Version": 25}`, want: false},
+		{body: `not json`, wantErr: true},
+	}
+	for _, c := range cases {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, c.body)
+		}))
+		got, err := buildletBusy(context.Background(), s.URL+"/status")
+		s.Close()
+		if got != c.want || (err != nil) != c.wantErr {
+			t.Errorf("buildletBusy() with body %q = %t, %v, wanted %t, wantErr: %t", c.body, got, err, c.want, c.wantErr)
+		}
+	}
+}
+
+func TestStatusURL(t *testing.T) {
+	in := newInstance("vm", windows10Config("/base"), "http://localhost:8090/healthz")
+	got, err := in.statusURL()
+	if want := "http://localhost:8090/status"; got != want || err != nil {
+		t.Errorf("statusURL() = %q, %v, wanted %q", got, err, want)
+	}
+}
+
+func TestDrainer(t *testing.T) {
+	d := newDrainer()
+	if d.draining() {
+		t.Errorf("newDrainer().draining() = true, wanted false")
+	}
+	d.drain()
+	d.drain()
+	if !d.draining() {
+		t.Errorf("draining() after drain() = false, wanted true")
+	}
+}
+
+func TestStopWhenIdle(t *testing.T) {
+	cases := []struct {
+		desc    string
+		body    string
+		timeout time.Duration
+	}{
+		{desc: "idle", body: `{"Version": 26}`},
+		{desc: "busy until timeout", body: `{"Version": 26, "ActiveExecs": 1}`, timeout: 50 * time.Millisecond},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, c.body)
+			}))
+			defer s.Close()
+			in := newInstance("vm", windows10Config("/base"), s.URL+"/healthz")
+			ctx, stop := context.WithCancelCause(context.Background())
+			in.stopWhenIdle(ctx, "max_uptime", c.timeout, stop)
+			var sr *stopRequest
+			if !errors.As(context.Cause(ctx), &sr) || sr.reason != "max_uptime" {
+				t.Errorf("stopWhenIdle() stopped with cause %v, wanted a stopRequest for max_uptime", context.Cause(ctx))
+			}
+		})
+	}
+}
+
+func TestBuildletBusyKey(t *testing.T) {
+	defer func(old string) { buildletKey = old }(buildletKey)
+	buildletKey = "secret"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pass, _ := r.BasicAuth(); pass != "secret" {
+			http.Error(w, "invalid password", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"Version": 52, "ActiveExecs": 1}`)
+	}))
+	defer s.Close()
+	if got, err := buildletBusy(context.Background(), s.URL+"/status"); !got || err != nil {
+		t.Errorf("buildletBusy() = %t, %v, wanted true, <nil>", got, err)
+	}
+}
+
+func TestLoadBuildletKey(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "gobuildkey"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &vmConfig{Base: dir}
+	if got, err := loadBuildletKey(c); got != "" || err != nil {
+		t.Errorf("loadBuildletKey() without a key file = %q, %v, wanted empty", got, err)
+	}
+	c.Provision = &provisionConfig{KeyFile: "gobuildkey"}
+	if got, err := loadBuildletKey(c); got != "secret" || err != nil {
+		t.Errorf("loadBuildletKey() with provision key_file = %q, %v, wanted %q", got, err, "secret")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// cacheAuto is a driveConfig.Cache mode that is replaced with the
+// cache and AIO modes that perform best for the drive's image on this
+// host.
+const cacheAuto = "auto"
+
+var (
+	cacheModes        = map[string]bool{"": true, cacheAuto: true, "writeback": true, "writethrough": true, "none": true, "directsync": true, "unsafe": true}
+	aioModes          = map[string]bool{"": true, "threads": true, "native": true, "io_uring": true}
+	discardModes      = map[string]bool{"": true, "ignore": true, "unmap": true}
+	detectZeroesModes = map[string]bool{"": true, "off": true, "on": true, "unmap": true}
+)
+
+// hostFileSystem returns the type of the file system containing path,
+// such as "apfs" or "ext4", or the empty string if it is unknown. It
+// is a variable for testing.
+var hostFileSystem = fileSystemType
+
+func (d driveConfig) validateIO() error {
+	if !cacheModes[d.Cache] {
+		return fmt.Errorf("drive %s cache %q, wanted auto, writeback, writethrough, none, directsync, or unsafe", d.ID, d.Cache)
+	}
+	if !aioModes[d.AIO] {
+		return fmt.Errorf("drive %s aio %q, wanted threads, native, or io_uring", d.ID, d.AIO)
+	}
+	if d.AIO == "native" && d.Cache != cacheAuto && d.Cache != "none" && d.Cache != "directsync" {
+		return fmt.Errorf("drive %s aio native requires cache none or directsync", d.ID)
+	}
+	if !discardModes[d.Discard] {
+		return fmt.Errorf("drive %s discard %q, wanted ignore or unmap", d.ID, d.Discard)
+	}
+	if !detectZeroesModes[d.DetectZeroes] {
+		return fmt.Errorf("drive %s detect_zeroes %q, wanted off, on, or unmap", d.ID, d.DetectZeroes)
+	}
+	if d.DetectZeroes == "unmap" && d.Discard != "unmap" {
+		return fmt.Errorf("drive %s detect_zeroes unmap requires discard unmap", d.ID)
+	}
+	return nil
+}
+
+// ioOptions returns the cache and AIO modes of d, a drive of c, with
+// cacheAuto resolved.
+func (c *vmConfig) ioOptions(d driveConfig) (cache, aio string) {
+	if d.Cache != cacheAuto {
+		return d.Cache, d.AIO
+	}
+	cache, aio = autoDriveIO(hostFileSystem(filepath.Dir(c.path(d.File))), c.Snapshot)
+	if d.AIO != "" {
+		aio = d.AIO
+	}
+	if aio == "native" && cache != "none" && cache != "directsync" {
+		// Only possible with O_DIRECT.
+		aio = ""
+	}
+	return cache, aio
+}
+
+// autoDriveIO returns the cache and AIO modes for a drive whose image
+// is in a file system of type fs, of a VM run with -snapshot if
+// snapshot is set. An empty aio keeps QEMU's default, a thread pool.
+func autoDriveIO(fs string, snapshot bool) (cache, aio string) {
+	switch {
+	case snapshot:
+		// Writes go to a temporary overlay that is discarded after
+		// the run, so flushing them buys nothing.
+		return "unsafe", ""
+	case fs == "ext4", fs == "xfs":
+		// Bypass the host page cache, which would only duplicate
+		// the guest's.
+		return "none", "native"
+	}
+	// On APFS, flushes are F_FULLFSYNCs, which wait for the disk's
+	// own cache, so writethrough, which flushes every write, is very
+	// slow. Leave flushing to the guest. Other file systems, such as
+	// tmpfs or ZFS, may not support O_DIRECT.
+	return "writeback", ""
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import "testing"
+
+func TestIOOptions(t *testing.T) {
+	defer func(f func(string) string) { hostFileSystem = f }(hostFileSystem)
+	cases := []struct {
+		desc      string
+		fs        string
+		snapshot  bool
+		d         driveConfig
+		wantCache string
+		wantAIO   string
+	}{
+		{desc: "explicit", fs: "apfs", d: driveConfig{Cache: "writethrough"}, wantCache: "writethrough"},
+		{desc: "explicit with aio", fs: "ext4", d: driveConfig{Cache: "none", AIO: "io_uring"}, wantCache: "none", wantAIO: "io_uring"},
+		{desc: "unset", fs: "ext4", wantCache: ""},
+		{desc: "apfs", fs: "apfs", d: driveConfig{Cache: cacheAuto}, wantCache: "writeback"},
+		{desc: "ext4", fs: "ext4", d: driveConfig{Cache: cacheAuto}, wantCache: "none", wantAIO: "native"},
+		{desc: "xfs with io_uring", fs: "xfs", d: driveConfig{Cache: cacheAuto, AIO: "io_uring"}, wantCache: "none", wantAIO: "io_uring"},
+		{desc: "tmpfs", fs: "tmpfs", d: driveConfig{Cache: cacheAuto}, wantCache: "writeback"},
+		{desc: "unknown", fs: "", d: driveConfig{Cache: cacheAuto}, wantCache: "writeback"},
+		{desc: "snapshot", fs: "ext4", snapshot: true, d: driveConfig{Cache: cacheAuto}, wantCache: "unsafe"},
+		{desc: "snapshot with native", fs: "ext4", snapshot: true, d: driveConfig{Cache: cacheAuto, AIO: "native"}, wantCache: "unsafe"},
+	}
+	for _, c := range cases {
+		hostFileSystem = func(string) string { return c.fs }
+		cfg := &vmConfig{Base: "/base", Snapshot: c.snapshot}
+		c.d.File = "disk.qcow2"
+		cache, aio := cfg.ioOptions(c.d)
+		if cache != c.wantCache || aio != c.wantAIO {
+			t.Errorf("%s: ioOptions(%+v) = %q, %q, wanted %q, %q", c.desc, c.d, cache, aio, c.wantCache, c.wantAIO)
+		}
+	}
+}
+
+func TestValidateIO(t *testing.T) {
+	cases := []struct {
+		d       driveConfig
+		wantErr bool
+	}{
+		{d: driveConfig{}},
+		{d: driveConfig{Cache: cacheAuto, AIO: "native"}},
+		{d: driveConfig{Cache: "none", AIO: "native", Discard: "unmap", DetectZeroes: "unmap"}},
+		{d: driveConfig{Cache: "writeback", AIO: "threads", DetectZeroes: "on"}},
+		{d: driveConfig{Cache: "fast"}, wantErr: true},
+		{d: driveConfig{AIO: "posix"}, wantErr: true},
+		{d: driveConfig{Cache: "writeback", AIO: "native"}, wantErr: true},
+		{d: driveConfig{Discard: "on"}, wantErr: true},
+		{d: driveConfig{DetectZeroes: "yes"}, wantErr: true},
+		{d: driveConfig{DetectZeroes: "unmap"}, wantErr: true},
+	}
+	for _, c := range cases {
+		c.d.ID = "drive0"
+		if err := c.d.validateIO(); (err != nil) != c.wantErr {
+			t.Errorf("%+v.validateIO() = %v, wantErr: %t", c.d, err, c.wantErr)
+		}
+	}
+}
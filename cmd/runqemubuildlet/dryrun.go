@@ -0,0 +1,81 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// printCommands writes the environment and QEMU, or vfkit, command
+// line of each of insts to w as a shell script.
+//
+// Per-run files, such as control sockets, are shown in a placeholder
+// temporary directory, since each run creates a new one, and the VM
+// name and MAC address are those of the first run. Drives and
+// arguments that are only added at run time, such as the cloud-init
+// seed image and the serial log, are not shown.
+func printCommands(w io.Writer, insts []*instance) error {
+	for i, in := range insts {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		cfg := in.runConfig(filepath.Join(os.TempDir(), "runqemubuildlet-"+in.name), 1)
+		fmt.Fprintf(w, "# %s\n", in.name)
+		var words []string
+		for _, e := range cfg.extraEnv() {
+			words = append(words, shellQuote(e))
+		}
+		cmd := applyQoS(cfg.command(), currentQoS())
+		words = append(words, shellQuote(cmd.Args[0]))
+		args := cmd.Args[1:]
+		for j := 0; j < len(args); j++ {
+			// Keep each flag on a line with its value.
+			a := shellQuote(args[j])
+			if strings.HasPrefix(args[j], "-") && j+1 < len(args) && !strings.HasPrefix(args[j+1], "-") {
+				j++
+				a += " " + shellQuote(args[j])
+			}
+			words = append(words, a)
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(words, " \\\n\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printConfigs writes the effective config of each of insts to w as
+// a stream of YAML documents.
+func printConfigs(w io.Writer, insts []*instance) error {
+	for _, in := range insts {
+		b, err := yaml.Marshal(in.cfg)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "--- # %s\n%s", in.name, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"-m", "-m"},
+		{"virt,highmem=off", "virt,highmem=off"},
+		{"Virtual Machine", "'Virtual Machine'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"", "''"},
+	}
+	for _, c := range cases {
+		if got := shellQuote(c.in); got != c.want {
+			t.Errorf("shellQuote(%q) = %q, wanted %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestPrintCommands(t *testing.T) {
+	in := newInstance("vm", &vmConfig{
+		Base:        "/base",
+		QEMU:        "bin/qemu",
+		LibraryPath: "lib",
+		MemoryMB:    1024,
+		Name:        "Test VM",
+	}, "http://localhost:8080/healthz")
+	var buf bytes.Buffer
+	if err := printCommands(&buf, []*instance{in}); err != nil {
+		t.Fatalf("printCommands() = %v, wanted no error", err)
+	}
+	for _, want := range []string{
+		"# vm\n",
+		"DYLD_LIBRARY_PATH=/base/lib \\\n\t/base/bin/qemu \\\n",
+		"\t-m 1024 \\\n",
+		"\t-name " + shellQuote(runName("vm", 1)) + " \\\n",
+		"qmp.sock,server=on,wait=off\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("printCommands() = %q, wanted it to contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestPrintConfigs(t *testing.T) {
+	cfg := windows10Config("/base")
+	in := newInstance("vm", cfg, "http://localhost:8080/healthz")
+	var buf bytes.Buffer
+	if err := printConfigs(&buf, []*instance{in}); err != nil {
+		t.Fatalf("printConfigs() = %v, wanted no error", err)
+	}
+	got := new(vmConfig)
+	if err := yaml.UnmarshalStrict(buf.Bytes(), got); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict(printConfigs()) = %v, wanted no error", err)
+	}
+	if got.MemoryMB != cfg.MemoryMB || got.QEMU != cfg.QEMU {
+		t.Errorf("printConfigs() round trip = %+v, wanted %+v", got, cfg)
+	}
+}
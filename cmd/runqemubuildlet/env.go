@@ -0,0 +1,55 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables setting flags.
+const envPrefix = "RUNQEMUBUILDLET_"
+
+// envName returns the environment variable that sets the flag named
+// name, such as RUNQEMUBUILDLET_BUILDLET_HEALTHZ_URL for
+// -buildlet-healthz-url.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setFlagsFromEnv sets each flag in fs for which lookup finds a
+// variable named by envName. It must be called before fs.Parse, so
+// that flags on the command line take precedence.
+//
+// Each line of the value of a repeatable flag, such as -health-check,
+// is set separately.
+func setFlagsFromEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		v, ok := lookup(envName(f.Name))
+		if !ok {
+			return
+		}
+		values := []string{v}
+		switch f.Value.(type) {
+		case *accelFlags, *healthCheckFlags, *overrideFlags, *shareFlags:
+			values = strings.Split(strings.TrimSpace(v), "\n")
+		}
+		for _, v := range values {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("%s=%q: %w", envName(f.Name), v, serr)
+				return
+			}
+		}
+	})
+	return err
+}
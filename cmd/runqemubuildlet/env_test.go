@@ -0,0 +1,66 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	url := fs.String("buildlet-healthz-url", "http://localhost:8080/healthz", "")
+	instances := fs.Int("instances", 1, "")
+	delay := fs.Duration("kill-delay", time.Minute, "")
+	var shares shareFlags
+	fs.Var(&shares, "share", "")
+	var accels accelFlags
+	fs.Var(&accels, "accel", "")
+	env := map[string]string{
+		"RUNQEMUBUILDLET_BUILDLET_HEALTHZ_URL": "http://localhost:8090/healthz",
+		"RUNQEMUBUILDLET_INSTANCES":            "2",
+		"RUNQEMUBUILDLET_SHARE":                "a=/a\nb=/b\n",
+		"RUNQEMUBUILDLET_ACCEL":                "whpx,kernel-irqchip=off\ntcg",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+	if err := setFlagsFromEnv(fs, lookup); err != nil {
+		t.Fatalf("setFlagsFromEnv() = %v, wanted no error", err)
+	}
+	if err := fs.Parse([]string{"-instances=3"}); err != nil {
+		t.Fatal(err)
+	}
+	if *url != "http://localhost:8090/healthz" {
+		t.Errorf("-buildlet-healthz-url = %q, wanted value from environment", *url)
+	}
+	if *instances != 3 {
+		t.Errorf("-instances = %d, wanted 3 from the command line", *instances)
+	}
+	if *delay != time.Minute {
+		t.Errorf("-kill-delay = %v, wanted default %v", *delay, time.Minute)
+	}
+	want := shareFlags{{Tag: "a", Path: "/a"}, {Tag: "b", Path: "/b"}}
+	if diff := cmp.Diff(want, shares); diff != "" {
+		t.Errorf("-share mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(accelFlags{"whpx,kernel-irqchip=off", "tcg"}, accels); diff != "" {
+		t.Errorf("-accel mismatch (-want +got):\n%s", diff)
+	}
+
+	env = map[string]string{"RUNQEMUBUILDLET_INSTANCES": "two"}
+	if err := setFlagsFromEnv(fs, lookup); err == nil {
+		t.Errorf("setFlagsFromEnv() with RUNQEMUBUILDLET_INSTANCES=two = nil, wanted error")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// eventQueueSize is the number of events buffered for reporting.
+	// Events are dropped rather than blocking VM runs once it is full.
+	eventQueueSize = 100
+	// eventAttempts is the number of times posting an event is tried.
+	eventAttempts = 3
+	// eventTimeout is the maximum time each attempt may take.
+	eventTimeout = 10 * time.Second
+)
+
+// event is a VM lifecycle event, such as a VM starting or its buildlet
+// becoming healthy, reported as JSON to -event-url.
+type event struct {
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host"`
+	VM    string    `json:"vm"`
+	Guest string    `json:"guest"`
+	RunID string    `json:"run_id"`
+	// Phase is the phase the run entered, such as "healthy".
+	Phase   string `json:"phase"`
+	Message string `json:"message"`
+	// Reason and Error describe why a VM exited or was stopped.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Attrs are any other attributes logged with the event.
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// newEvent returns the event for run lg of the instance entering
+// phase, logged as msg with args.
+func (in *instance) newEvent(lg *runLogger, phase, msg string, args []interface{}) event {
+	host, _ := os.Hostname()
+	e := event{
+		Time:    time.Now(),
+		Host:    host,
+		VM:      in.name,
+		Guest:   in.config().Name,
+		RunID:   lg.id,
+		Phase:   phase,
+		Message: msg,
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		k, v := fmt.Sprint(args[i]), args[i+1]
+		switch {
+		case v == nil:
+		case k == "reason":
+			e.Reason = fmt.Sprint(v)
+		case k == "err":
+			e.Error = fmt.Sprint(v)
+		default:
+			if e.Attrs == nil {
+				e.Attrs = make(map[string]string)
+			}
+			e.Attrs[k] = fmt.Sprint(v)
+		}
+	}
+	return e
+}
+
+// eventReporter posts events to a URL in the background.
+type eventReporter struct {
+	url    string
+	client *http.Client
+	c      chan event
+	done   chan struct{} // closed once run returns
+}
+
+func newEventReporter(url string) *eventReporter {
+	return &eventReporter{
+		url:    url,
+		client: http.DefaultClient,
+		c:      make(chan event, eventQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// report queues e for reporting. It does nothing if r is nil, and
+// drops e if the queue is full. It must not be called after close.
+func (r *eventReporter) report(e event) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.c <- e:
+	default:
+		slog.Warn("Event queue full; dropping event", "vm", e.VM, "run_id", e.RunID, "phase", e.Phase)
+	}
+}
+
+// run posts queued events until r is closed.
+func (r *eventReporter) run() {
+	defer close(r.done)
+	for e := range r.c {
+		if err := r.post(context.Background(), e); err != nil {
+			slog.Warn("Reporting event failed", "url", r.url, "vm", e.VM, "run_id", e.RunID, "phase", e.Phase, "err", err)
+		}
+	}
+}
+
+// close stops r once the events already queued have been posted, or
+// timeout has passed. It does nothing if r is nil.
+func (r *eventReporter) close(timeout time.Duration) {
+	if r == nil {
+		return
+	}
+	close(r.c)
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+		slog.Warn("Timed out reporting remaining events", "url", r.url)
+	}
+}
+
+// post posts e, retrying failed attempts with exponential backoff.
+func (r *eventReporter) post(ctx context.Context, e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err = r.postOnce(ctx, body)
+		if err == nil || attempt == eventAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (r *eventReporter) postOnce(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %v", r.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestEventReporter(t *testing.T) {
+	var mu sync.Mutex
+	var got []event
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		got = append(got, e)
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	in := newInstance("vm0", &vmConfig{Name: "guest"}, "http://localhost:8080/healthz")
+	lg := newRunLogger(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	r := newEventReporter(s.URL)
+	lg.onPhase = func(phase, msg string, args []interface{}) {
+		r.report(in.newEvent(lg, phase, msg, args))
+	}
+	go r.run()
+	lg.setPhase(phaseBooting, "VM started", "pid", 42)
+	lg.setPhase(phaseKilled, "VM stopped", "reason", exitHeartbeat, "err", errors.New("boom"))
+	lg.setPhase(phaseExited, "VM exited", "reason", exitClean, "err", nil)
+	r.close(10 * time.Second)
+
+	want := []event{
+		{VM: "vm0", Guest: "guest", RunID: lg.id, Phase: phaseBooting, Message: "VM started", Attrs: map[string]string{"pid": "42"}},
+		{VM: "vm0", Guest: "guest", RunID: lg.id, Phase: phaseKilled, Message: "VM stopped", Reason: exitHeartbeat, Error: "boom"},
+		{VM: "vm0", Guest: "guest", RunID: lg.id, Phase: phaseExited, Message: "VM exited", Reason: exitClean},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(event{}, "Time", "Host")); diff != "" {
+		t.Errorf("reported events mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxWatchedLine is the length after which a line of guest or
+	// QEMU output is matched without waiting for its end, such as
+	// for a serial console that never prints a newline.
+	maxWatchedLine = 4096
+	// serialTailInterval is how often a serial console log file is
+	// checked for new output.
+	serialTailInterval = time.Second
+)
+
+// fatalPattern describes output of a guest's serial console or of
+// QEMU that means the guest will not recover by itself, so that its VM
+// is restarted right away instead of once its heartbeat times out.
+type fatalPattern struct {
+	// Name identifies the pattern in logs.
+	Name string `yaml:"name"`
+	// Regexp is matched against each line of output.
+	Regexp string `yaml:"regexp"`
+	// Count is how many lines must match during a run, such as for
+	// a message printed on every attempt of a boot loop. It
+	// defaults to 1.
+	Count int `yaml:"count"`
+}
+
+func (p fatalPattern) validate() error {
+	if p.Name == "" {
+		return errors.New("fatal pattern name must be set")
+	}
+	if _, err := regexp.Compile(p.Regexp); err != nil {
+		return fmt.Errorf("fatal pattern %s: %v", p.Name, err)
+	}
+	if p.Count < 0 {
+		return fmt.Errorf("fatal pattern %s count = %d, must not be negative", p.Name, p.Count)
+	}
+	return nil
+}
+
+// defaultFatalPatterns are watched for in every run with
+// -fatal-patterns, in addition to those of the config.
+var defaultFatalPatterns = []fatalPattern{
+	// OVMF tries each boot option in turn, and starts over once all
+	// have failed.
+	{Name: "efi_boot_loop", Regexp: `BdsDxe: failed to load Boot[0-9A-F]{4}`, Count: 5},
+	{Name: "efi_no_boot_device", Regexp: `No bootable option or device was found`},
+	// Windows prints bug checks to the serial console with EMS
+	// enabled.
+	{Name: "bsod", Regexp: `STOP: 0x[0-9A-Fa-f]{8}`},
+	{Name: "kernel_panic", Regexp: `Kernel panic - not syncing`},
+	{Name: "no_display", Regexp: `Guest has not initialized the display`},
+}
+
+// fatalOutputError is the cause of stopping a VM whose output matched
+// a fatal pattern.
+type fatalOutputError struct {
+	pattern string
+	line    string
+}
+
+func (e *fatalOutputError) Error() string {
+	return fmt.Sprintf("output matched fatal pattern %s: %q", e.pattern, e.line)
+}
+
+// outputWatcher matches lines of output against fatal patterns, and
+// reports the first line to complete a match.
+type outputWatcher struct {
+	patterns []fatalPattern
+	res      []*regexp.Regexp
+	fatal    func(*fatalOutputError)
+
+	mu     sync.Mutex
+	counts []int
+	fired  bool
+}
+
+// newOutputWatcher returns a watcher for patterns that calls fatal
+// once, when output first matches one of them.
+func newOutputWatcher(patterns []fatalPattern, fatal func(*fatalOutputError)) (*outputWatcher, error) {
+	w := &outputWatcher{patterns: patterns, fatal: fatal, counts: make([]int, len(patterns))}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("fatal pattern %s: %v", p.Name, err)
+		}
+		w.res = append(w.res, re)
+	}
+	return w, nil
+}
+
+// match checks a line of output.
+func (w *outputWatcher) match(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fired {
+		return
+	}
+	for i, re := range w.res {
+		if !re.MatchString(line) {
+			continue
+		}
+		w.counts[i]++
+		if w.counts[i] >= w.patterns[i].Count {
+			w.fired = true
+			w.fatal(&fatalOutputError{pattern: w.patterns[i].Name, line: strings.TrimSpace(line)})
+			return
+		}
+	}
+}
+
+// writer returns an io.Writer splitting output from a single source
+// into lines for w.
+func (w *outputWatcher) writer() io.Writer {
+	return &lineWriter{w: w}
+}
+
+// lineWriter passes complete lines written to it to an outputWatcher.
+type lineWriter struct {
+	w   *outputWatcher
+	buf []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.w.match(string(bytes.TrimSuffix(lw.buf[:i], []byte("\r"))))
+		lw.buf = lw.buf[i+1:]
+	}
+	if len(lw.buf) > maxWatchedLine {
+		lw.w.match(string(lw.buf))
+		lw.buf = nil
+	}
+	return len(p), nil
+}
+
+// serialLogPath returns the path of the file the guest's serial
+// console is written to, if it is written to one.
+func (c *vmConfig) serialLogPath() string {
+	if !strings.HasPrefix(c.Serial, "file:") {
+		return ""
+	}
+	p := strings.TrimPrefix(c.Serial, "file:")
+	if c.isVZ() {
+		// vzArgs resolves it relative to the image directory,
+		// while QEMU opens it relative to its working directory.
+		return c.path(p)
+	}
+	return p
+}
+
+// tailFile writes what is appended to the file at path to w until ctx
+// is done, checking every interval. The file need not exist yet.
+func tailFile(ctx context.Context, path string, w io.Writer, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		if f == nil {
+			f, _ = os.Open(path)
+		}
+		if f != nil {
+			io.Copy(w, f)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
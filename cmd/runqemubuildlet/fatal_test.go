@@ -0,0 +1,110 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputWatcher(t *testing.T) {
+	cases := []struct {
+		desc   string
+		output string
+		want   string // name of the pattern matched, if any
+	}{
+		{desc: "healthy boot", output: "BdsDxe: loading Boot0001 \"UEFI Misc Device\"\r\nBdsDxe: starting Boot0001\r\n"},
+		{desc: "boot loop", output: strings.Repeat("BdsDxe: failed to load Boot0001 \"UEFI Misc Device\": Not Found\r\n", 5), want: "efi_boot_loop"},
+		{desc: "one failed boot option", output: "BdsDxe: failed to load Boot0001 \"UEFI PXEv4\": Not Found\r\nBdsDxe: starting Boot0002\r\n"},
+		{desc: "no boot device", output: "No bootable option or device was found.\n", want: "efi_no_boot_device"},
+		{desc: "bug check", output: "*** STOP: 0x0000007B (0xFFFFF880009A97E8,0xFFFFFFFFC0000034,0x0000000000000000,0x0000000000000000)\r\n", want: "bsod"},
+		{desc: "kernel panic", output: "[    2.123] Kernel panic - not syncing: VFS: Unable to mount root fs\n", want: "kernel_panic"},
+		{desc: "split line", output: "Kernel pan", want: ""},
+		{desc: "custom", output: "buildlet: fatal: no such host\n", want: "buildlet_dns"},
+	}
+	patterns := append(append([]fatalPattern(nil), defaultFatalPatterns...), fatalPattern{Name: "buildlet_dns", Regexp: `buildlet: fatal: .*no such host`})
+	for _, c := range cases {
+		var got []*fatalOutputError
+		w, err := newOutputWatcher(patterns, func(e *fatalOutputError) { got = append(got, e) })
+		if err != nil {
+			t.Fatalf("newOutputWatcher() = %v", err)
+		}
+		lw := w.writer()
+		// Write the output in small pieces, as a serial console
+		// would.
+		for i := 0; i < len(c.output); i += 7 {
+			end := i + 7
+			if end > len(c.output) {
+				end = len(c.output)
+			}
+			lw.Write([]byte(c.output[i:end]))
+		}
+		lw.Write([]byte(c.output)) // Matches only fire once.
+		switch {
+		case c.want == "" && len(got) != 0:
+			t.Errorf("%s: matched %v, wanted no match", c.desc, got)
+		case c.want != "" && len(got) != 1:
+			t.Errorf("%s: matched %v, wanted one match of %s", c.desc, got, c.want)
+		case c.want != "" && got[0].pattern != c.want:
+			t.Errorf("%s: matched pattern %s, wanted %s", c.desc, got[0].pattern, c.want)
+		}
+	}
+}
+
+func TestFatalPatternValidate(t *testing.T) {
+	for _, p := range defaultFatalPatterns {
+		if err := p.validate(); err != nil {
+			t.Errorf("%s: validate() = %v, wanted no error", p.Name, err)
+		}
+	}
+	for _, p := range []fatalPattern{
+		{Regexp: "panic"},
+		{Name: "bad", Regexp: "("},
+		{Name: "negative", Regexp: "panic", Count: -1},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("%+v.validate() = nil, wanted error", p)
+		}
+	}
+}
+
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial.log")
+	matched := make(chan *fatalOutputError, 1)
+	w, err := newOutputWatcher(defaultFatalPatterns, func(e *fatalOutputError) { matched <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tailFile(ctx, path, w.writer(), 10*time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+	if err := ioutil.WriteFile(path, []byte("booting\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("Kernel panic - not syncing: Attempted to kill init!\n")
+	select {
+	case e := <-matched:
+		if e.pattern != "kernel_panic" {
+			t.Errorf("matched pattern %s, wanted kernel_panic", e.pattern)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("tailFile() did not pass on appended output")
+	}
+}
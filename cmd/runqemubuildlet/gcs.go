@@ -0,0 +1,72 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+var (
+	storageClientOnce sync.Once
+	storageClient     *storage.Client
+	storageClientErr  error
+)
+
+// getStorageClient returns a shared GCS client, created on first use.
+func getStorageClient(ctx context.Context) (*storage.Client, error) {
+	storageClientOnce.Do(func() {
+		storageClient, storageClientErr = storage.NewClient(ctx)
+	})
+	return storageClient, storageClientErr
+}
+
+// parseGCSURL splits a URL of the form gs://bucket/prefix into its
+// bucket and object prefix.
+func parseGCSURL(s string) (bucket, prefix string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "gs" || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not a gs://bucket/prefix URL", s)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// uploadToGCS uploads the local file src to the object named name
+// under the gs://bucket/prefix URL dst.
+func uploadToGCS(ctx context.Context, dst, name, src string) error {
+	bucket, prefix, err := parseGCSURL(dst)
+	if err != nil {
+		return err
+	}
+	sc, err := getStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %w", err)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := sc.Bucket(bucket).Object(path.Join(prefix, name)).NewWriter(ctx)
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
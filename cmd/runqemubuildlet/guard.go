@@ -0,0 +1,152 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// guardInterval is how often host resources are checked during runs,
+// and while waiting to start a VM.
+const guardInterval = time.Minute
+
+// hostUsage is a snapshot of host resources checked by the
+// guardrails. Negative values are unknown, and not checked.
+type hostUsage struct {
+	freeDiskMB int     // in the scratch directory
+	availMemMB int     // available without swapping
+	loadPerCPU float64 // 1-minute load average per CPU
+}
+
+// hostLimits are the thresholds of the guardrails. Zero values are not
+// checked.
+type hostLimits struct {
+	minFreeDiskMB int
+	minAvailMemMB int
+	maxLoadPerCPU float64
+}
+
+// currentHostLimits returns the limits set by flags.
+func currentHostLimits() hostLimits {
+	return hostLimits{
+		minFreeDiskMB: *minFreeDiskMB,
+		minAvailMemMB: *minAvailableMemoryMB,
+		maxLoadPerCPU: *maxLoadPerCPU,
+	}
+}
+
+// currentHostUsage returns the current usage of this host, with
+// scratchDir the directory QEMU writes snapshots or overlays to.
+func currentHostUsage(scratchDir string) hostUsage {
+	u := hostUsage{freeDiskMB: -1, availMemMB: -1, loadPerCPU: -1}
+	if mb, err := hostFreeDiskMB(scratchDir); err == nil {
+		u.freeDiskMB = mb
+	}
+	if mb, err := hostAvailableMemoryMB(); err == nil {
+		u.availMemMB = mb
+	}
+	if l, err := hostLoadAverage(); err == nil {
+		u.loadPerCPU = l / float64(runtime.NumCPU())
+	}
+	return u
+}
+
+// check returns an error describing each limit of l exceeded by u,
+// after setting aside needMemMB of memory, such as for a VM about to
+// start.
+func (l hostLimits) check(u hostUsage, needMemMB int) error {
+	var problems []string
+	if l.minFreeDiskMB > 0 && u.freeDiskMB >= 0 && u.freeDiskMB < l.minFreeDiskMB {
+		problems = append(problems, fmt.Sprintf("%d MiB of disk free, wanted at least %d MiB", u.freeDiskMB, l.minFreeDiskMB))
+	}
+	if l.minAvailMemMB > 0 && u.availMemMB >= 0 && u.availMemMB-needMemMB < l.minAvailMemMB {
+		problems = append(problems, fmt.Sprintf("%d MiB of memory available, wanted at least %d MiB in addition to %d MiB needed", u.availMemMB, l.minAvailMemMB, needMemMB))
+	}
+	if l.maxLoadPerCPU > 0 && u.loadPerCPU >= 0 && u.loadPerCPU > l.maxLoadPerCPU {
+		problems = append(problems, fmt.Sprintf("load average %.2f per CPU, wanted at most %.2f", u.loadPerCPU, l.maxLoadPerCPU))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("host resources low: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// scratchDir returns the directory QEMU writes snapshots or overlays
+// to.
+func scratchDir() string {
+	if *overlayDir != "" {
+		return *overlayDir
+	}
+	return os.TempDir()
+}
+
+// waitForHostResources waits until the host has the resources to
+// start the instance's VM, checking every guardInterval. It returns
+// early if ctx is done or draining is requested.
+func (in *instance) waitForHostResources(ctx context.Context) {
+	t := time.NewTicker(guardInterval)
+	defer t.Stop()
+	for {
+		err := currentHostLimits().check(currentHostUsage(scratchDir()), in.config().MemoryMB)
+		if err == nil {
+			return
+		}
+		in.logger.Warn("Not starting VM", "err", err, "retry", guardInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-in.drain.done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// guardDrain is held by the instance draining because of low host
+// resources, so that instances are drained one at a time rather than
+// all at once.
+var guardDrain = make(chan struct{}, 1)
+
+// drainOnLowResources checks host resources every guardInterval, and
+// once they are low, calls recycle to drain the instance's VM, unless
+// another instance is already being drained for the same reason. It
+// returns early if ctx is done.
+//
+// The restarted VM then waits in waitForHostResources until the host
+// has recovered.
+func (in *instance) drainOnLowResources(ctx context.Context, recycle func(reason string)) {
+	t := time.NewTicker(guardInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		err := currentHostLimits().check(currentHostUsage(scratchDir()), 0)
+		if err == nil {
+			continue
+		}
+		select {
+		case guardDrain <- struct{}{}:
+		default:
+			// Another instance is already draining.
+			continue
+		}
+		in.logger.Warn("Draining VM", "err", err)
+		recycle("host_resources")
+		<-ctx.Done()
+		<-guardDrain
+		return
+	}
+}
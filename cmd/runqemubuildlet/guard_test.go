@@ -0,0 +1,54 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostLimitsCheck(t *testing.T) {
+	l := hostLimits{minFreeDiskMB: 10240, minAvailMemMB: 512, maxLoadPerCPU: 2}
+	ok := hostUsage{freeDiskMB: 20000, availMemMB: 8192, loadPerCPU: 0.5}
+	cases := []struct {
+		desc    string
+		u       hostUsage
+		needMem int
+		limits  hostLimits
+		want    []string // substrings of the error; none if nil
+	}{
+		{desc: "ok", u: ok, needMem: 4096, limits: l},
+		{desc: "unknown", u: hostUsage{freeDiskMB: -1, availMemMB: -1, loadPerCPU: -1}, needMem: 4096, limits: l},
+		{desc: "disabled", u: hostUsage{}, needMem: 4096},
+		{desc: "no room for VM", u: ok, needMem: 8000, limits: l, want: []string{"8192 MiB of memory available"}},
+		{
+			desc:   "everything",
+			u:      hostUsage{freeDiskMB: 100, availMemMB: 100, loadPerCPU: 3},
+			limits: l,
+			want:   []string{"100 MiB of disk free", "100 MiB of memory available", "load average 3.00 per CPU"},
+		},
+	}
+	for _, c := range cases {
+		err := c.limits.check(c.u, c.needMem)
+		if len(c.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: check() = %v, wanted no error", c.desc, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: check() = nil, wanted error containing %q", c.desc, c.want)
+			continue
+		}
+		for _, w := range c.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%s: check() = %v, wanted error containing %q", c.desc, err, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// healthChecker checks one aspect of the health of a VM's guest.
+type healthChecker interface {
+	// check returns an error if the guest is unhealthy.
+	check(ctx context.Context) error
+	// String describes the check, for logs.
+	String() string
+}
+
+// healthCheckConfig configures a healthChecker.
+//
+// Targets default to the instance's buildlet healthz URL, so that
+// they follow the per-instance port offsets.
+type healthCheckConfig struct {
+	// Type is one of "http", "tcp", "exec", or "buildlet".
+	Type string `yaml:"type"`
+	// URL is the URL for "http" and "buildlet" checks. It defaults to
+	// the buildlet healthz URL, and for "buildlet" checks, the
+	// /status endpoint next to it.
+	URL string `yaml:"url"`
+	// Addr is the host:port for "tcp" checks. It defaults to that of
+	// the buildlet healthz URL.
+	Addr string `yaml:"addr"`
+	// Command is the command line of "exec" checks, which pass if it
+	// exits successfully. It runs with RUNQEMUBUILDLET_VM and
+	// RUNQEMUBUILDLET_HEALTHZ_URL set.
+	Command []string `yaml:"command"`
+
+	// The remaining fields apply to "http" and "buildlet" checks.
+
+	// CACert is a PEM file of the CA certificates to trust for https
+	// URLs, instead of the host's.
+	CACert string `yaml:"ca_cert"`
+	// Authorization is the Authorization header to send, such as
+	// "Bearer ${HEALTHZ_TOKEN}". Environment variables in it are
+	// expanded, so that secrets can be kept out of the config.
+	Authorization string `yaml:"authorization"`
+	// Body is a regular expression the response body of "http"
+	// checks must match.
+	Body string `yaml:"body"`
+	// MaxLatency, if positive, is the longest a response may take,
+	// including its body. Slower responses fail the check.
+	MaxLatency time.Duration `yaml:"max_latency"`
+}
+
+// parseHealthCheckFlag parses a -health-check flag value, which is a
+// check type optionally followed by "=" and its target: a URL, a
+// host:port, or a space-separated command line.
+func parseHealthCheckFlag(s string) (healthCheckConfig, error) {
+	typ, target, _ := strings.Cut(s, "=")
+	hc := healthCheckConfig{Type: typ}
+	switch typ {
+	case "http", "buildlet":
+		hc.URL = target
+	case "tcp":
+		hc.Addr = target
+	case "exec":
+		hc.Command = strings.Fields(target)
+	}
+	return hc, hc.validate()
+}
+
+// healthCheckFlags implements flag.Value for repeated -health-check
+// flags.
+type healthCheckFlags []healthCheckConfig
+
+func (f *healthCheckFlags) String() string {
+	var s []string
+	for _, hc := range *f {
+		s = append(s, hc.Type)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *healthCheckFlags) Set(s string) error {
+	hc, err := parseHealthCheckFlag(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, hc)
+	return nil
+}
+
+func (hc healthCheckConfig) validate() error {
+	switch hc.Type {
+	case "http", "buildlet":
+		if hc.Body != "" {
+			if hc.Type != "http" {
+				return fmt.Errorf("%s health check cannot match a body", hc.Type)
+			}
+			if _, err := regexp.Compile(hc.Body); err != nil {
+				return fmt.Errorf("http health check body: %w", err)
+			}
+		}
+		if hc.MaxLatency < 0 {
+			return fmt.Errorf("%s health check max_latency %v must not be negative", hc.Type, hc.MaxLatency)
+		}
+		return nil
+	}
+	if hc.CACert != "" || hc.Authorization != "" || hc.Body != "" || hc.MaxLatency != 0 {
+		return fmt.Errorf("%s health check cannot have ca_cert, authorization, body, or max_latency", hc.Type)
+	}
+	switch hc.Type {
+	case "tcp":
+		return nil
+	case "exec":
+		if len(hc.Command) == 0 {
+			return fmt.Errorf("exec health check has no command")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown health check type %q, wanted http, tcp, exec, or buildlet", hc.Type)
+}
+
+// healthCheckers returns the health checks for a run of the instance
+// with config c. They are the checks configured in c, or an HTTP check
+// of the buildlet healthz URL if there are none, followed by a guest
+// agent check if c enables the guest agent.
+func (in *instance) healthCheckers(c *vmConfig) ([]healthChecker, error) {
+	cfgs := c.HealthChecks
+	if len(cfgs) == 0 {
+		cfgs = []healthCheckConfig{{Type: "http"}}
+	}
+	var hcs []healthChecker
+	for _, hc := range cfgs {
+		switch hc.Type {
+		case "http":
+			u := hc.URL
+			if u == "" {
+				u = in.healthzURL
+			}
+			o, err := c.httpOptions(hc)
+			if err != nil {
+				return nil, err
+			}
+			var body *regexp.Regexp
+			if hc.Body != "" {
+				if body, err = regexp.Compile(hc.Body); err != nil {
+					return nil, err
+				}
+			}
+			hcs = append(hcs, httpChecker{url: u, httpOptions: o, body: body})
+		case "buildlet":
+			u := hc.URL
+			if u == "" {
+				var err error
+				if u, err = in.statusURL(); err != nil {
+					return nil, err
+				}
+			}
+			o, err := c.httpOptions(hc)
+			if err != nil {
+				return nil, err
+			}
+			if o.authorization == "" {
+				o.authorization = buildletAuthorization()
+			}
+			hcs = append(hcs, buildletChecker{url: u, httpOptions: o})
+		case "tcp":
+			addr := hc.Addr
+			if addr == "" {
+				u, err := url.Parse(in.healthzURL)
+				if err != nil {
+					return nil, err
+				}
+				addr = u.Host
+			}
+			hcs = append(hcs, tcpChecker(addr))
+		case "exec":
+			hcs = append(hcs, &execChecker{
+				argv: hc.Command,
+				env:  []string{"RUNQEMUBUILDLET_VM=" + in.name, "RUNQEMUBUILDLET_HEALTHZ_URL=" + in.healthzURL},
+			})
+		default:
+			return nil, hc.validate()
+		}
+	}
+	if c.GuestAgent {
+		hcs = append(hcs, guestAgentChecker(c.path(c.GuestAgentSocket)))
+	}
+	return hcs, nil
+}
+
+// checkAll runs hcs in order, each with timeout, and returns the error
+// of the first one that fails.
+func checkAll(ctx context.Context, hcs []healthChecker, timeout time.Duration) error {
+	for _, hc := range hcs {
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		err := hc.check(cctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%v: %w", hc, err)
+		}
+	}
+	return nil
+}
+
+// maxHealthBody is the most of a response body an "http" check
+// matches.
+const maxHealthBody = 1 << 20
+
+// httpOptions are the options of "http" and "buildlet" checks.
+type httpOptions struct {
+	client        *http.Client // or nil, for http.DefaultClient
+	authorization string
+	maxLatency    time.Duration
+}
+
+// httpOptions returns the options of hc, an "http" or "buildlet" check
+// of c.
+func (c *vmConfig) httpOptions(hc healthCheckConfig) (httpOptions, error) {
+	o := httpOptions{
+		authorization: os.ExpandEnv(hc.Authorization),
+		maxLatency:    hc.MaxLatency,
+	}
+	if hc.CACert != "" {
+		pem, err := os.ReadFile(c.path(hc.CACert))
+		if err != nil {
+			return o, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return o, fmt.Errorf("%s: no PEM certificates", c.path(hc.CACert))
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+		o.client = &http.Client{Transport: t}
+	}
+	return o, nil
+}
+
+// get performs a GET request against url and, if its response has
+// status http.StatusOK, passes its body to read. It returns an error
+// if this takes longer than o.maxLatency.
+func (o httpOptions) get(ctx context.Context, url string, read func(body io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if o.authorization != "" {
+		req.Header.Set("Authorization", o.authorization)
+	}
+	client := o.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("resp.StatusCode = %d, wanted %d", resp.StatusCode, http.StatusOK)
+	}
+	if err := read(resp.Body); err != nil {
+		return err
+	}
+	if d := time.Since(start); o.maxLatency > 0 && d > o.maxLatency {
+		return fmt.Errorf("response took %v, longer than the maximum latency %v", d.Round(time.Millisecond), o.maxLatency)
+	}
+	return nil
+}
+
+// httpChecker passes if a GET request of its URL succeeds, and its
+// response body matches body, if set.
+type httpChecker struct {
+	url string
+	httpOptions
+	body *regexp.Regexp
+}
+
+func (c httpChecker) check(ctx context.Context) error {
+	return c.get(ctx, c.url, func(r io.Reader) error {
+		if c.body == nil {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		b, err := io.ReadAll(io.LimitReader(r, maxHealthBody))
+		if err != nil {
+			return err
+		}
+		if !c.body.Match(b) {
+			return fmt.Errorf("response body does not match %q", c.body)
+		}
+		return nil
+	})
+}
+
+func (c httpChecker) String() string { return "http " + c.url }
+
+// tcpChecker passes if a TCP connection to its address succeeds.
+type tcpChecker string
+
+func (c tcpChecker) check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", string(c))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c tcpChecker) String() string { return "tcp " + string(c) }
+
+// execChecker passes if its command exits successfully.
+type execChecker struct {
+	argv []string
+	env  []string // added to the environment
+}
+
+func (c *execChecker) check(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, c.argv[0], c.argv[1:]...)
+	cmd.Env = append(os.Environ(), c.env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (c *execChecker) String() string { return "exec " + strings.Join(c.argv, " ") }
+
+// buildletChecker passes if the buildlet /status endpoint at its URL
+// reports a valid buildlet version, as the coordinator requires.
+type buildletChecker struct {
+	url string
+	httpOptions
+}
+
+func (c buildletChecker) check(ctx context.Context) error {
+	return c.get(ctx, c.url, func(r io.Reader) error {
+		var s buildlet.Status
+		if err := json.NewDecoder(r).Decode(&s); err != nil {
+			return err
+		}
+		if s.Version < 1 {
+			return fmt.Errorf("buildlet version = %d, wanted at least 1", s.Version)
+		}
+		return nil
+	})
+}
+
+func (c buildletChecker) String() string { return "buildlet " + c.url }
+
+// guestAgentChecker passes if qemu-guest-agent responds on the unix
+// socket at its path.
+type guestAgentChecker string
+
+func (c guestAgentChecker) check(ctx context.Context) error {
+	_, err := checkGuestAgent(ctx, string(c))
+	return err
+}
+
+func (c guestAgentChecker) String() string { return "guest-agent " + string(c) }
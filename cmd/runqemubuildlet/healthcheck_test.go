@@ -0,0 +1,218 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseHealthCheckFlag(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    healthCheckConfig
+		wantErr bool
+	}{
+		{in: "http", want: healthCheckConfig{Type: "http"}},
+		{in: "http=http://localhost:9000/ok", want: healthCheckConfig{Type: "http", URL: "http://localhost:9000/ok"}},
+		{in: "tcp=localhost:22", want: healthCheckConfig{Type: "tcp", Addr: "localhost:22"}},
+		{in: "exec=/bin/check -v", want: healthCheckConfig{Type: "exec", Command: []string{"/bin/check", "-v"}}},
+		{in: "exec", wantErr: true},
+		{in: "ping", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseHealthCheckFlag(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("parseHealthCheckFlag(%q) = _, %v, wantErr: %t", c.in, err, c.wantErr)
+			continue
+		}
+		if err == nil {
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("parseHealthCheckFlag(%q) mismatch (-want +got):\n%s", c.in, diff)
+			}
+		}
+	}
+}
+
+func TestHealthCheckers(t *testing.T) {
+	in := newInstance("vm1", &vmConfig{}, "http://localhost:8090/healthz")
+	c := &vmConfig{
+		Base: "/tmp",
+		HealthChecks: []healthCheckConfig{
+			{Type: "http"},
+			{Type: "tcp"},
+			{Type: "buildlet"},
+			{Type: "exec", Command: []string{"true"}},
+		},
+		GuestAgent:       true,
+		GuestAgentSocket: "qga.sock",
+	}
+	hcs, err := in.healthCheckers(c)
+	if err != nil {
+		t.Fatalf("healthCheckers() = _, %v, wanted no error", err)
+	}
+	var got []string
+	for _, hc := range hcs {
+		got = append(got, hc.String())
+	}
+	want := []string{
+		"http http://localhost:8090/healthz",
+		"tcp localhost:8090",
+		"buildlet http://localhost:8090/status",
+		"exec true",
+		"guest-agent /tmp/qga.sock",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("healthCheckers() mismatch (-want +got):\n%s", diff)
+	}
+
+	hcs, err = in.healthCheckers(&vmConfig{})
+	if err != nil || len(hcs) != 1 || hcs[0].String() != "http http://localhost:8090/healthz" {
+		t.Errorf("healthCheckers() with no checks = %v, %v, wanted the buildlet healthz URL", hcs, err)
+	}
+}
+
+func TestCheckers(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			fmt.Fprint(w, `{"Version": 26}`)
+		case "/oldstatus":
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	}))
+	defer s.Close()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	cases := []struct {
+		hc      healthChecker
+		wantErr bool
+	}{
+		{hc: httpChecker{url: s.URL + "/healthz"}},
+		{hc: buildletChecker{url: s.URL + "/status"}},
+		{hc: buildletChecker{url: s.URL + "/oldstatus"}, wantErr: true},
+		{hc: tcpChecker(strings.TrimPrefix(s.URL, "http://"))},
+		{hc: tcpChecker(closedAddr), wantErr: true},
+		{hc: &execChecker{argv: []string{"true"}}},
+		{hc: &execChecker{argv: []string{"false"}}, wantErr: true},
+	}
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := c.hc.check(ctx)
+		cancel()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%v: check() = %v, wantErr: %t", c.hc, err, c.wantErr)
+		}
+	}
+	if err := checkAll(context.Background(), []healthChecker{cases[0].hc, cases[2].hc}, 5*time.Second); err == nil || !strings.Contains(err.Error(), "oldstatus") {
+		t.Errorf("checkAll() = %v, wanted error from the failing buildlet check", err)
+	}
+}
+
+func TestHTTPCheckOptions(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprintln(w, "status: ok")
+	}))
+	defer s.Close()
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HEALTHZ_TOKEN", "s3cret")
+
+	in := newInstance("vm1", &vmConfig{}, s.URL+"/healthz")
+	cases := []struct {
+		desc    string
+		hc      healthCheckConfig
+		wantErr bool
+	}{
+		{
+			desc: "ok",
+			hc:   healthCheckConfig{Type: "http", CACert: "ca.pem", Authorization: "Bearer ${HEALTHZ_TOKEN}", Body: "status: ok"},
+		},
+		{
+			desc:    "untrusted",
+			hc:      healthCheckConfig{Type: "http", Authorization: "Bearer ${HEALTHZ_TOKEN}"},
+			wantErr: true,
+		},
+		{
+			desc:    "unauthorized",
+			hc:      healthCheckConfig{Type: "http", CACert: "ca.pem"},
+			wantErr: true,
+		},
+		{
+			desc:    "body mismatch",
+			hc:      healthCheckConfig{Type: "http", CACert: "ca.pem", Authorization: "Bearer ${HEALTHZ_TOKEN}", Body: "^ready"},
+			wantErr: true,
+		},
+		{
+			desc:    "slow",
+			hc:      healthCheckConfig{Type: "http", URL: s.URL + "/slow", CACert: "ca.pem", Authorization: "Bearer ${HEALTHZ_TOKEN}", MaxLatency: time.Millisecond},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			if err := c.hc.validate(); err != nil {
+				t.Fatalf("validate() = %v, wanted no error", err)
+			}
+			hcs, err := in.healthCheckers(&vmConfig{Base: dir, HealthChecks: []healthCheckConfig{c.hc}})
+			if err != nil {
+				t.Fatalf("healthCheckers() = _, %v, wanted no error", err)
+			}
+			if err := hcs[0].check(context.Background()); (err != nil) != c.wantErr {
+				t.Errorf("check() = %v, wantErr: %t", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestHealthCheckConfigValidate(t *testing.T) {
+	cases := []struct {
+		hc      healthCheckConfig
+		wantErr bool
+	}{
+		{hc: healthCheckConfig{Type: "http", Body: "ok", MaxLatency: time.Second}},
+		{hc: healthCheckConfig{Type: "buildlet", CACert: "ca.pem", Authorization: "Bearer x"}},
+		{hc: healthCheckConfig{Type: "http", Body: "("}, wantErr: true},
+		{hc: healthCheckConfig{Type: "http", MaxLatency: -time.Second}, wantErr: true},
+		{hc: healthCheckConfig{Type: "buildlet", Body: "ok"}, wantErr: true},
+		{hc: healthCheckConfig{Type: "tcp", Authorization: "Bearer x"}, wantErr: true},
+	}
+	for _, c := range cases {
+		if err := c.hc.validate(); (err != nil) != c.wantErr {
+			t.Errorf("%+v.validate() = %v, wantErr: %t", c.hc, err, c.wantErr)
+		}
+	}
+}
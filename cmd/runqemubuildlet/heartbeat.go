@@ -2,69 +2,88 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build go1.16
-// +build go1.16
+//go:build go1.21
+// +build go1.21
 
 package main
 
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"time"
-
-	"golang.org/x/build/internal"
 )
 
-// buildletHealthTimeout is the maximum time to wait for a
-// checkBuildletHealth request to complete.
+// buildletHealthTimeout is the default maximum time to wait for a
+// health check to complete.
 const buildletHealthTimeout = 10 * time.Second
 
-// checkBuildletHealth performs a GET request against URL, and returns
-// an error if an http.StatusOK isn't returned before
-// buildletHealthTimeout has elapsed.
-func checkBuildletHealth(ctx context.Context, url string) error {
-	ctx, cancel := context.WithTimeout(ctx, buildletHealthTimeout)
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return err
+const (
+	// defaultHeartbeatInterval is the default time between health
+	// checks.
+	defaultHeartbeatInterval = 30 * time.Second
+	// defaultHeartbeatTimeout is the default time health checks must
+	// fail for before a VM is stopped.
+	defaultHeartbeatTimeout = 10 * time.Minute
+)
+
+// heartbeatConfig sets how often the health of a guest is checked, and
+// how long its checks may fail before its VM is stopped. Slow hosts,
+// such as those falling back to TCG, need more tolerance, while fast
+// ones can detect failed guests sooner.
+type heartbeatConfig struct {
+	// Interval is the time between health checks. It defaults to
+	// 30s.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is how long health checks must fail for, in addition
+	// to -heartbeat-failures consecutive checks, before the VM is
+	// stopped. It defaults to 10m.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// interval returns h.Interval, or its default.
+func (h heartbeatConfig) interval() time.Duration {
+	if h.Interval == 0 {
+		return defaultHeartbeatInterval
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	return h.Interval
+}
+
+// timeout returns h.Timeout, or its default.
+func (h heartbeatConfig) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return defaultHeartbeatTimeout
 	}
-	defer resp.Body.Close()
-	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
-		return err
+	return h.Timeout
+}
+
+func (h heartbeatConfig) validate() error {
+	if h.Interval < 0 || h.Timeout < 0 {
+		return fmt.Errorf("heartbeat interval %v and timeout %v must not be negative", h.Interval, h.Timeout)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("resp.StatusCode = %d, wanted %d", resp.StatusCode, http.StatusOK)
+	if h.timeout() < 2*h.interval() {
+		return fmt.Errorf("heartbeat timeout %v must be at least twice the interval %v, so that more than one check fails before a VM is stopped", h.timeout(), h.interval())
 	}
 	return nil
 }
 
-// heartbeatContext calls f every period. If f consistently returns an
-// error for longer than the provided timeout duration, the context
-// returned by heartbeatContext will be cancelled, and
-// heartbeatContext will stop sending requests.
-//
-// A single call to f that does not return an error will reset the
-// timeout window, unless heartbeatContext has already timed out.
-func heartbeatContext(ctx context.Context, period time.Duration, timeout time.Duration, f func(context.Context) error) (context.Context, func()) {
-	ctx, cancel := context.WithCancel(ctx)
-
-	lastSuccess := time.Now()
-	go internal.PeriodicallyDo(ctx, period, func(ctx context.Context, t time.Time) {
-		err := f(ctx)
-		if err != nil && t.Sub(lastSuccess) > timeout {
-			cancel()
-		}
-		if err == nil {
-			lastSuccess = t
-		}
-	})
+// applyHeartbeatFlags applies -heartbeat-interval and
+// -heartbeat-timeout to c, and checks that each health check times
+// out before the next one is due.
+func applyHeartbeatFlags(c *vmConfig) error {
+	if *heartbeatInterval > 0 {
+		c.Heartbeat.Interval = *heartbeatInterval
+	}
+	if *heartbeatTimeout > 0 {
+		c.Heartbeat.Timeout = *heartbeatTimeout
+	}
+	if *probeTimeout > c.Heartbeat.interval() {
+		return fmt.Errorf("probe timeout %v exceeds the heartbeat interval %v", *probeTimeout, c.Heartbeat.interval())
+	}
+	return c.validate()
+}
 
-	return ctx, cancel
+// checkBuildletHealth performs a GET request against URL, and returns
+// an error if an http.StatusOK isn't returned before ctx is done.
+func checkBuildletHealth(ctx context.Context, url string) error {
+	return httpChecker{url: url}.check(ctx)
 }
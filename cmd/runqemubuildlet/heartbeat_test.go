@@ -2,14 +2,13 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build go1.16
-// +build go1.16
+//go:build go1.21
+// +build go1.21
 
 package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -39,7 +38,7 @@ func TestCheckBuildletHealth(t *testing.T) {
 			m := http.NewServeMux()
 			m.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 				w.WriteHeader(c.respCode)
-				fmt.Sprintln(w, "ok")
+				fmt.Fprintln(w, "ok")
 			})
 			s := httptest.NewServer(m)
 			defer s.Close()
@@ -56,39 +55,32 @@ func TestCheckBuildletHealth(t *testing.T) {
 	}
 }
 
-func TestHeartbeatContext(t *testing.T) {
-	ctx := context.Background()
-
-	didWork := make(chan interface{}, 2)
-	done := make(chan interface{})
-	ctx, cancel := heartbeatContext(ctx, time.Millisecond, 100*time.Millisecond, func(context.Context) error {
-		select {
-		case <-done:
-			return errors.New("heartbeat stopped")
-		case didWork <- nil:
-		default:
-		}
-		return nil
-	})
-	defer cancel()
-
-	select {
-	case <-time.After(5 * time.Second):
-		t.Errorf("heatbeatContext() never called f, wanted at least one call")
-	case <-didWork:
-	}
-
-	select {
-	case <-done:
-		t.Errorf("heartbeatContext() finished early, wanted it to still be testing")
-	case <-didWork:
-		close(done)
+func TestHeartbeatConfig(t *testing.T) {
+	cases := []struct {
+		h                         heartbeatConfig
+		wantInterval, wantTimeout time.Duration
+		wantErr                   bool
+	}{
+		{h: heartbeatConfig{}, wantInterval: 30 * time.Second, wantTimeout: 10 * time.Minute},
+		{h: heartbeatConfig{Interval: 5 * time.Second, Timeout: time.Minute}, wantInterval: 5 * time.Second, wantTimeout: time.Minute},
+		{h: heartbeatConfig{Timeout: 30 * time.Minute}, wantInterval: 30 * time.Second, wantTimeout: 30 * time.Minute},
+		{h: heartbeatConfig{Interval: 10 * time.Minute}, wantErr: true},
+		{h: heartbeatConfig{Interval: time.Minute, Timeout: time.Minute}, wantErr: true},
+		{h: heartbeatConfig{Interval: -time.Second}, wantErr: true},
 	}
-
-	select {
-	case <-time.After(5 * time.Second):
-		t.Errorf("heartbeatContext() did not timeout, wanted timeout after failing over %v", time.Second)
-	case <-ctx.Done():
-		// heartbeatContext() successfully timed out after failing
+	for _, c := range cases {
+		err := c.h.validate()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%+v.validate() = %v, wantErr: %t", c.h, err, c.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if got := c.h.interval(); got != c.wantInterval {
+			t.Errorf("%+v.interval() = %v, wanted %v", c.h, got, c.wantInterval)
+		}
+		if got := c.h.timeout(); got != c.wantTimeout {
+			t.Errorf("%+v.timeout() = %v, wanted %v", c.h, got, c.wantTimeout)
+		}
 	}
 }
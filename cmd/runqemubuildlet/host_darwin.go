@@ -0,0 +1,97 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && darwin
+// +build go1.21,darwin
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostMemoryMB returns the total physical memory of the host, in MiB.
+func hostMemoryMB() (int, error) {
+	b, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0, err
+	}
+	return int(b >> 20), nil
+}
+
+// hostFreeDiskMB returns the disk space available to unprivileged
+// users in the file system containing path, in MiB.
+func hostFreeDiskMB(path string) (int, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int(st.Bavail * uint64(st.Bsize) >> 20), nil
+}
+
+// hostHVFSupported reports whether the Hypervisor framework is
+// available, which is not the case in most macOS VMs.
+func hostHVFSupported() bool {
+	v, err := unix.SysctlUint32("kern.hv_support")
+	return err == nil && v == 1
+}
+
+// hostAvailableMemoryMB returns the memory available to new processes
+// without swapping, in MiB, as estimated by the kernel's memory
+// pressure level.
+func hostAvailableMemoryMB() (int, error) {
+	total, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0, err
+	}
+	level, err := unix.SysctlUint32("kern.memorystatus_level")
+	if err != nil {
+		return 0, err
+	}
+	return int(total * uint64(level) / 100 >> 20), nil
+}
+
+// hostLoadAverage returns the host's 1-minute load average.
+func hostLoadAverage() (float64, error) {
+	b, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil {
+		return 0, err
+	}
+	// struct loadavg { fixpt_t ldavg[3]; long fscale; }, with fixpt_t
+	// a uint32, padded before the 64-bit fscale.
+	if len(b) < 24 {
+		return 0, fmt.Errorf("vm.loadavg is %d bytes, wanted 24", len(b))
+	}
+	ld := binary.LittleEndian.Uint32(b[0:4])
+	scale := binary.LittleEndian.Uint64(b[16:24])
+	if scale == 0 {
+		return 0, errors.New("vm.loadavg has zero fscale")
+	}
+	return float64(ld) / float64(scale), nil
+}
+
+// cloneFile creates dst as an APFS clone of src, which shares its
+// blocks until either is modified, or as a copy if the file system
+// does not support clones.
+func cloneFile(dst, src string) error {
+	err := unix.Clonefile(src, dst, 0)
+	if err == unix.ENOTSUP || err == unix.EXDEV {
+		return copyFile(dst, src, 0644)
+	}
+	return err
+}
+
+// fileSystemType returns the type of the file system containing path,
+// such as "apfs", or the empty string if it cannot be determined.
+func fileSystemType(path string) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(st.Fstypename[:])
+}
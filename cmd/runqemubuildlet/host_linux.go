@@ -0,0 +1,84 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && linux
+// +build go1.21,linux
+
+package main
+
+import (
+	"io/ioutil"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostMemoryMB returns the total physical memory of the host, in MiB.
+func hostMemoryMB() (int, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+	return int(uint64(info.Totalram) * uint64(info.Unit) >> 20), nil
+}
+
+// hostFreeDiskMB returns the disk space available to unprivileged
+// users in the file system containing path, in MiB.
+func hostFreeDiskMB(path string) (int, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int(st.Bavail * uint64(st.Bsize) >> 20), nil
+}
+
+// hostHVFSupported reports whether the Hypervisor framework is
+// available. It never is on Linux.
+func hostHVFSupported() bool { return false }
+
+// hostAvailableMemoryMB returns the memory available to new processes
+// without swapping, in MiB, as reported by MemAvailable in
+// /proc/meminfo.
+func hostAvailableMemoryMB() (int, error) {
+	b, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	return parseMemAvailable(b)
+}
+
+// hostLoadAverage returns the host's 1-minute load average.
+func hostLoadAverage() (float64, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+	// Loads are fixed-point with 16 bits of fraction.
+	return float64(info.Loads[0]) / (1 << 16), nil
+}
+
+// cloneFile creates dst as a copy of src.
+func cloneFile(dst, src string) error {
+	return copyFile(dst, src, 0644)
+}
+
+// fileSystemType returns the type of the file system containing path,
+// such as "ext4", or the empty string if it cannot be determined or is
+// not one runqemubuildlet distinguishes.
+func fileSystemType(path string) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return ""
+	}
+	switch st.Type {
+	case unix.EXT4_SUPER_MAGIC: // Also ext2 and ext3.
+		return "ext4"
+	case unix.XFS_SUPER_MAGIC:
+		return "xfs"
+	case unix.BTRFS_SUPER_MAGIC:
+		return "btrfs"
+	case unix.TMPFS_MAGIC:
+		return "tmpfs"
+	}
+	return ""
+}
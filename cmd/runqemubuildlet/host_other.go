@@ -0,0 +1,48 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !darwin && !linux
+// +build go1.21,!darwin,!linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// hostMemoryMB returns the total physical memory of the host, in MiB.
+func hostMemoryMB() (int, error) {
+	return 0, fmt.Errorf("host memory detection is not supported on %s", runtime.GOOS)
+}
+
+// hostFreeDiskMB returns the disk space available in the file system
+// containing path, in MiB.
+func hostFreeDiskMB(path string) (int, error) {
+	return 0, fmt.Errorf("free disk space detection is not supported on %s", runtime.GOOS)
+}
+
+// hostHVFSupported reports whether the Hypervisor framework is
+// available. It never is outside macOS.
+func hostHVFSupported() bool { return false }
+
+// hostAvailableMemoryMB returns the memory available to new processes
+// without swapping, in MiB.
+func hostAvailableMemoryMB() (int, error) {
+	return 0, fmt.Errorf("available memory detection is not supported on %s", runtime.GOOS)
+}
+
+// hostLoadAverage returns the host's 1-minute load average.
+func hostLoadAverage() (float64, error) {
+	return 0, fmt.Errorf("load average detection is not supported on %s", runtime.GOOS)
+}
+
+// cloneFile creates dst as a copy of src.
+func cloneFile(dst, src string) error {
+	return copyFile(dst, src, 0644)
+}
+
+// fileSystemType returns the type of the file system containing path.
+// It is never known outside macOS and Linux.
+func fileSystemType(path string) string { return "" }
@@ -0,0 +1,83 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cleanShutdownMarker is the file in the base directory recording that
+// runqemubuildlet last stopped for a host shutdown, with every guest
+// shut down cleanly.
+const cleanShutdownMarker = ".clean-shutdown"
+
+// hostShutdown reports whether cause, why runqemubuildlet is stopping,
+// is a shutdown of the host: a SIGTERM from launchd or systemd rather
+// than an interrupt from an operator.
+func hostShutdown(cause error) bool {
+	var se *signalError
+	if !errors.As(cause, &se) {
+		return false
+	}
+	for _, sig := range hostShutdownSignals {
+		if se.sig == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdownGraceFor returns how long to give a guest to shut down once
+// its VM is stopped for cause: -host-shutdown-grace if the host is
+// shutting down, as the init system will not wait long, or else
+// -shutdown-grace.
+func shutdownGraceFor(cause error) time.Duration {
+	if hostShutdown(cause) && *hostShutdownGrace < *shutdownGrace {
+		return *hostShutdownGrace
+	}
+	return *shutdownGrace
+}
+
+// recordHostShutdown writes the clean shutdown marker to dir if the
+// guests of insts all shut down cleanly when they were last stopped.
+func recordHostShutdown(dir string, insts []*instance) {
+	for _, in := range insts {
+		if !in.guestShutDown() {
+			slog.Warn("Host shutting down, but not all guests shut down cleanly; images will be checked on the next start", "vm", in.name)
+			return
+		}
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := os.WriteFile(filepath.Join(dir, cleanShutdownMarker), []byte(now+"\n"), 0644); err != nil {
+		slog.Warn("Recording clean host shutdown failed", "err", err)
+		return
+	}
+	slog.Info("Host shutting down; all guests shut down cleanly")
+}
+
+// consumeCleanShutdownMarker reports whether dir has the clean shutdown
+// marker, and when it was written, and removes it, so that it only
+// applies to the start right after the shutdown.
+func consumeCleanShutdownMarker(dir string) (at string, ok bool, err error) {
+	path := filepath.Join(dir, cleanShutdownMarker)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(string(b)), true, nil
+}
@@ -0,0 +1,14 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && plan9
+// +build go1.21,plan9
+
+package main
+
+import "os"
+
+// hostShutdownSignals is empty, as there is no SIGTERM on this
+// platform.
+var hostShutdownSignals []os.Signal
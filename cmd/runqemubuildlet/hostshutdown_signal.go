@@ -0,0 +1,18 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !plan9
+// +build go1.21,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// hostShutdownSignals are the signals init systems send services when
+// the host shuts down. On Windows, console close and shutdown events
+// are delivered as SIGTERM.
+var hostShutdownSignals = []os.Signal{syscall.SIGTERM}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !plan9
+// +build go1.21,!plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownGraceFor(t *testing.T) {
+	cases := []struct {
+		cause error
+		want  time.Duration
+	}{
+		{cause: &signalError{sig: syscall.SIGTERM}, want: *hostShutdownGrace},
+		{cause: fmt.Errorf("stopping: %w", &signalError{sig: syscall.SIGTERM}), want: *hostShutdownGrace},
+		{cause: &signalError{sig: os.Interrupt}, want: *shutdownGrace},
+		{cause: errors.New("heartbeat timed out"), want: *shutdownGrace},
+		{cause: nil, want: *shutdownGrace},
+	}
+	for _, c := range cases {
+		if got := shutdownGraceFor(c.cause); got != c.want {
+			t.Errorf("shutdownGraceFor(%v) = %v, wanted %v", c.cause, got, c.want)
+		}
+	}
+}
+
+func TestCleanShutdownMarker(t *testing.T) {
+	dir := t.TempDir()
+	a := newInstance("vm0", &vmConfig{}, "http://localhost:8080/healthz")
+	b := newInstance("vm1", &vmConfig{}, "http://localhost:8081/healthz")
+	a.setGuestShutDown(true)
+
+	recordHostShutdown(dir, []*instance{a, b})
+	if _, ok, err := consumeCleanShutdownMarker(dir); ok || err != nil {
+		t.Errorf("consumeCleanShutdownMarker() after a guest was stopped = _, %t, %v, wanted false, nil", ok, err)
+	}
+
+	b.setGuestShutDown(true)
+	recordHostShutdown(dir, []*instance{a, b})
+	at, ok, err := consumeCleanShutdownMarker(dir)
+	if !ok || err != nil {
+		t.Fatalf("consumeCleanShutdownMarker() = _, %t, %v, wanted true, nil", ok, err)
+	}
+	if _, err := time.Parse(time.RFC3339, at); err != nil {
+		t.Errorf("consumeCleanShutdownMarker() = %q, wanted a time: %v", at, err)
+	}
+	// The marker only applies to the next start.
+	if _, ok, err := consumeCleanShutdownMarker(dir); ok || err != nil {
+		t.Errorf("second consumeCleanShutdownMarker() = _, %t, %v, wanted false, nil", ok, err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/build/internal/httpdl"
+)
+
+// imageManifest lists the files making up a guest image, such as the
+// disk image, firmware, and driver ISO, along with their checksums.
+//
+// It is published as manifest.json alongside the files it lists.
+type imageManifest struct {
+	// Version identifies the image, such as "win10-2021-06-01".
+	Version string      `json:"version"`
+	Files   []imageFile `json:"files"`
+}
+
+// imageFile is a single file in an imageManifest.
+type imageFile struct {
+	// Name is the slash-separated path of the file, relative to both
+	// the manifest URL and the local image directory.
+	Name string `json:"name"`
+	// SHA256 is the hex-encoded SHA-256 checksum of the file.
+	SHA256 string `json:"sha256"`
+}
+
+// fetchManifest fetches and parses the manifest.json at baseURL.
+func fetchManifest(ctx context.Context, baseURL string) (*imageManifest, error) {
+	u := strings.TrimSuffix(baseURL, "/") + "/manifest.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %v", u, resp.Status)
+	}
+	m := new(imageManifest)
+	if err := json.NewDecoder(resp.Body).Decode(m); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", u, err)
+	}
+	if m.Version == "" {
+		return nil, fmt.Errorf("manifest %s has no version", u)
+	}
+	for _, f := range m.Files {
+		if f.Name == "" || path.IsAbs(f.Name) || strings.Contains(f.Name, "..") {
+			return nil, fmt.Errorf("manifest %s has invalid file name %q", u, f.Name)
+		}
+		if len(f.SHA256) != sha256.Size*2 {
+			return nil, fmt.Errorf("manifest %s has invalid checksum %q for %s", u, f.SHA256, f.Name)
+		}
+	}
+	return m, nil
+}
+
+// syncImage downloads any files listed in the manifest at baseURL
+// that are missing or out of date in dir, and verifies the checksums
+// of all files. It returns an error if any file does not match the
+// manifest, in which case the image must not be booted.
+func syncImage(ctx context.Context, baseURL, dir string) (*imageManifest, error) {
+	m, err := fetchManifest(ctx, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range m.Files {
+		local := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return nil, err
+		}
+		u := strings.TrimSuffix(baseURL, "/") + "/" + f.Name
+		if err := httpdl.Download(local, u); err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", u, err)
+		}
+		if err := verifySHA256(local, f.SHA256); err != nil {
+			// Remove the file so that the next attempt downloads it
+			// again, rather than trusting its size and modtime.
+			os.Remove(local)
+			return nil, err
+		}
+	}
+	slog.Info("Verified image", "version", m.Version, "dir", dir)
+	return m, nil
+}
+
+// verifySHA256 returns an error if the SHA-256 checksum of the file
+// at path is not the hex-encoded want.
+func verifySHA256(path, want string) error {
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, want) {
+		return &checksumError{path: path, got: got, want: want}
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 checksum of the file at
+// path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumError is returned when a file does not match its expected
+// checksum.
+type checksumError struct {
+	path      string
+	got, want string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("%s: sha256 = %s, wanted %s", e.path, e.got, e.want)
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncImage(t *testing.T) {
+	remote, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remote)
+	local, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+
+	contents := []byte("qcow2 image")
+	if err := os.MkdirAll(filepath.Join(remote, "Images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "Images", "win10.qcow2"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(contents)
+	writeManifest := func(checksum string) {
+		m := imageManifest{
+			Version: "test-1",
+			Files:   []imageFile{{Name: "Images/win10.qcow2", SHA256: checksum}},
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(remote, "manifest.json"), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := httptest.NewServer(http.FileServer(http.Dir(remote)))
+	defer s.Close()
+
+	writeManifest(hex.EncodeToString(sum[:]))
+	m, err := syncImage(context.Background(), s.URL, local)
+	if err != nil {
+		t.Fatalf("syncImage() = _, %v, wanted no error", err)
+	}
+	if m.Version != "test-1" {
+		t.Errorf("syncImage() version = %q, wanted %q", m.Version, "test-1")
+	}
+	got, err := ioutil.ReadFile(filepath.Join(local, "Images", "win10.qcow2"))
+	if err != nil || string(got) != string(contents) {
+		t.Errorf("downloaded image = %q, %v, wanted %q", got, err, contents)
+	}
+
+	bad := sha256.Sum256([]byte("something else"))
+	writeManifest(hex.EncodeToString(bad[:]))
+	if _, err := syncImage(context.Background(), s.URL, local); err == nil {
+		t.Errorf("syncImage() with mismatched checksum = nil, wanted error")
+	}
+	if _, err := os.Stat(filepath.Join(local, "Images", "win10.qcow2")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat() of corrupt image = %v, wanted it removed", err)
+	}
+}
+
+func TestImageUpdater(t *testing.T) {
+	remote, local := t.TempDir(), t.TempDir()
+	write := func(dir, name, contents string) string {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(contents))
+		return hex.EncodeToString(sum[:])
+	}
+	publish := func(version string, files map[string]string) *imageManifest {
+		m := &imageManifest{Version: version}
+		for name, contents := range files {
+			m.Files = append(m.Files, imageFile{Name: name, SHA256: write(remote, name, contents)})
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(remote, "manifest.json", string(b))
+		return m
+	}
+	s := httptest.NewServer(http.FileServer(http.Dir(remote)))
+	defer s.Close()
+
+	v1 := publish("v1", map[string]string{"Images/win10.qcow2": "disk v1", "Images/QEMU_EFI.fd": "firmware"})
+	for _, f := range []string{"Images/win10.qcow2", "Images/QEMU_EFI.fd"} {
+		b, _ := ioutil.ReadFile(filepath.Join(remote, filepath.FromSlash(f)))
+		write(local, f, string(b))
+	}
+	u := newImageUpdater(s.URL, local, v1)
+	ctx := context.Background()
+	if err := u.check(ctx); err != nil {
+		t.Fatalf("check() = %v, wanted no error", err)
+	}
+	if got := u.latest(); got != "v1" {
+		t.Errorf("latest() with nothing new = %q, wanted %q", got, "v1")
+	}
+
+	publish("v2", map[string]string{"Images/win10.qcow2": "disk v2", "Images/QEMU_EFI.fd": "firmware"})
+	if err := u.check(ctx); err != nil {
+		t.Fatalf("check() = %v, wanted no error", err)
+	}
+	if got := u.latest(); got != "v2" {
+		t.Errorf("latest() after staging = %q, wanted %q", got, "v2")
+	}
+	if _, err := os.Stat(filepath.Join(local, imageStagingDir, "v2", "Images", "QEMU_EFI.fd")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat() of unchanged staged file = %v, wanted it not downloaded", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(local, "Images", "win10.qcow2")); string(b) != "disk v1" {
+		t.Errorf("installed image before install() = %q, wanted %q", b, "disk v1")
+	}
+
+	v, err := u.install(slog.Default())
+	if err != nil || v != "v2" {
+		t.Fatalf("install() = %q, %v, wanted %q, no error", v, err, "v2")
+	}
+	for name, want := range map[string]string{"Images/win10.qcow2": "disk v2", "Images/QEMU_EFI.fd": "firmware"} {
+		if b, err := ioutil.ReadFile(filepath.Join(local, filepath.FromSlash(name))); err != nil || string(b) != want {
+			t.Errorf("installed %s = %q, %v, wanted %q", name, b, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(local, imageStagingDir)); !os.IsNotExist(err) {
+		t.Errorf("os.Stat() of staging directory after install() = %v, wanted it removed", err)
+	}
+	if v, err := u.install(slog.Default()); err != nil || v != "v2" {
+		t.Errorf("install() with nothing staged = %q, %v, wanted %q, no error", v, err, "v2")
+	}
+
+	publish("v3", map[string]string{"Images/win10.qcow2": "disk v3"})
+	m, _ := fetchManifest(ctx, s.URL)
+	m.Files[0].SHA256 = v1.Files[0].SHA256
+	b, _ := json.Marshal(m)
+	write(remote, "manifest.json", string(b))
+	if err := u.check(ctx); err == nil {
+		t.Errorf("check() with mismatched checksum = nil, wanted error")
+	}
+	if got := u.latest(); got != "v2" {
+		t.Errorf("latest() after failed staging = %q, wanted %q", got, "v2")
+	}
+}
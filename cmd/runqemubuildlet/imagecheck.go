@@ -0,0 +1,98 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Exit codes of qemu-img check.
+const (
+	qemuImgCheckCorrupt     = 2  // The image is corrupted.
+	qemuImgCheckLeaked      = 3  // The image only has leaked clusters, which are harmless.
+	qemuImgCheckUnsupported = 63 // The image format does not support checks, such as raw.
+)
+
+// imageCorruptError is returned by checkImages for corrupted disk
+// images.
+type imageCorruptError struct {
+	paths []string
+}
+
+func (e *imageCorruptError) Error() string {
+	return fmt.Sprintf("corrupted disk images: %s", strings.Join(e.paths, ", "))
+}
+
+// checkImages runs qemu-img check on each disk image of c, and returns
+// an *imageCorruptError listing those found corrupted.
+func checkImages(ctx context.Context, c *vmConfig) error {
+	if c.isVZ() {
+		// The vz backend uses raw images, which qemu-img
+		// cannot check, and may run without QEMU installed.
+		return nil
+	}
+	var corrupt []string
+	for _, d := range c.Drives {
+		if d.Media != "disk" {
+			continue
+		}
+		p := c.path(d.File)
+		args := []string{"check"}
+		if d.Format != "" {
+			args = append(args, "-f", d.Format)
+		}
+		cmd := c.qemuImgCommand(ctx, append(args, p)...)
+		out, err := cmd.CombinedOutput()
+		var ee *exec.ExitError
+		if err != nil && errors.As(err, &ee) {
+			switch ee.ExitCode() {
+			case qemuImgCheckCorrupt:
+				slog.Error("Disk image is corrupted", "path", p, "output", string(out))
+				corrupt = append(corrupt, p)
+				continue
+			case qemuImgCheckLeaked, qemuImgCheckUnsupported:
+				err = nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%v = %w: %s", cmd, err, out)
+		}
+	}
+	if len(corrupt) > 0 {
+		return &imageCorruptError{paths: corrupt}
+	}
+	return nil
+}
+
+// checkAndRepairImages checks the disk images of c with checkImages.
+// If repair is set and imageURL is not empty, corrupted images are
+// removed and downloaded again from imageURL with syncImage, and
+// checked once more.
+func checkAndRepairImages(ctx context.Context, c *vmConfig, imageURL string, repair bool) error {
+	err := checkImages(ctx, c)
+	var ce *imageCorruptError
+	if !repair || imageURL == "" || !errors.As(err, &ce) {
+		return err
+	}
+	slog.Warn("Downloading corrupted disk images again", "paths", ce.paths, "image_url", imageURL)
+	for _, p := range ce.paths {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	if _, err := syncImage(ctx, imageURL, c.Base); err != nil {
+		return fmt.Errorf("syncImage(_, %q, %q) = %w", imageURL, c.Base, err)
+	}
+	return checkImages(ctx, c)
+}
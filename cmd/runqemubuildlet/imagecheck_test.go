@@ -0,0 +1,81 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckImages(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake qemu-img requires a shell")
+	}
+	dir := t.TempDir()
+	// The fake qemu-img exits as qemu-img check does for images
+	// named after the result.
+	script := `#!/bin/sh
+for last; do :; done
+case "$last" in
+*corrupt*) echo "ERROR cluster 1 refcount=0 reference=1"; exit 2;;
+*leaked*) exit 3;;
+*raw*) exit 63;;
+*broken*) echo "Could not open"; exit 1;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	drives := func(files ...string) []driveConfig {
+		var ds []driveConfig
+		for _, f := range files {
+			ds = append(ds, driveConfig{ID: f, File: f, Media: "disk"})
+		}
+		return ds
+	}
+
+	cases := []struct {
+		desc        string
+		drives      []driveConfig
+		wantCorrupt []string
+		wantErr     bool
+	}{
+		{desc: "ok", drives: drives("ok.qcow2", "leaked.qcow2", "disk.raw")},
+		{desc: "cdrom skipped", drives: []driveConfig{{ID: "cd", File: "corrupt.iso", Media: "cdrom"}}},
+		{
+			desc:        "corrupt",
+			drives:      drives("ok.qcow2", "corrupt1.qcow2", "corrupt2.qcow2"),
+			wantCorrupt: []string{filepath.Join(dir, "corrupt1.qcow2"), filepath.Join(dir, "corrupt2.qcow2")},
+			wantErr:     true,
+		},
+		{desc: "check failed", drives: drives("broken.qcow2"), wantErr: true},
+	}
+	for _, c := range cases {
+		cfg := &vmConfig{Base: dir, QEMU: "qemu-system-aarch64", Drives: c.drives}
+		err := checkImages(context.Background(), cfg)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: checkImages() = %v, wantErr: %t", c.desc, err, c.wantErr)
+			continue
+		}
+		var ce *imageCorruptError
+		errors.As(err, &ce)
+		var gotCorrupt []string
+		if ce != nil {
+			gotCorrupt = ce.paths
+		}
+		if diff := cmp.Diff(c.wantCorrupt, gotCorrupt); diff != "" {
+			t.Errorf("%s: checkImages() corrupted images mismatch (-want +got):\n%s", c.desc, diff)
+		}
+	}
+}
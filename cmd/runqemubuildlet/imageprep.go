@@ -0,0 +1,333 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/build/internal"
+)
+
+// prepISOLabel is the volume label of the image preparation media,
+// which the guest finds its files by.
+const prepISOLabel = "GOPREP"
+
+// imagePrep describes how a Windows golden image is prepared. Its
+// fields are used by the templates of the preparation media.
+type imagePrep struct {
+	// User is the local administrator created and logged on
+	// automatically, who runs the buildlet.
+	User string
+	// Arch is the Windows processor architecture, such as arm64 or
+	// amd64.
+	Arch string
+	// TaskCommand is run by a scheduled task whenever User logs on,
+	// such as the buildlet stage0 installed by the bootstrap script.
+	TaskCommand string
+	// Label is the volume label of the preparation media.
+	Label string
+}
+
+// TaskDir returns the Windows directory containing p.TaskCommand, which
+// it is run from.
+func (p *imagePrep) TaskDir() string {
+	if i := strings.LastIndex(p.TaskCommand, `\`); i >= 0 {
+		return p.TaskCommand[:i]
+	}
+	return `C:\`
+}
+
+var prepFuncs = template.FuncMap{"xml": xmlEscape}
+
+// defaultUnattend skips OOBE, creates and logs on the builder user, and
+// runs prep.ps1 from the preparation media at its first logon.
+var defaultUnattend = template.Must(template.New("Autounattend.xml").Funcs(prepFuncs).Parse(`<?xml version="1.0" encoding="utf-8"?>
+<unattend xmlns="urn:schemas-microsoft-com:unattend" xmlns:wcm="http://schemas.microsoft.com/WMIConfig/2002/State">
+  <settings pass="oobeSystem">
+    <component name="Microsoft-Windows-Shell-Setup" processorArchitecture="{{xml .Arch}}" publicKeyToken="31bf3856ad364e35" language="neutral" versionScope="nonSxS">
+      <OOBE>
+        <HideEULAPage>true</HideEULAPage>
+        <HideOnlineAccountScreens>true</HideOnlineAccountScreens>
+        <HideWirelessSetupInOOBE>true</HideWirelessSetupInOOBE>
+        <ProtectYourPC>3</ProtectYourPC>
+      </OOBE>
+      <UserAccounts>
+        <LocalAccounts>
+          <LocalAccount wcm:action="add">
+            <Name>{{xml .User}}</Name>
+            <Group>Administrators</Group>
+            <Password><Value></Value><PlainText>true</PlainText></Password>
+          </LocalAccount>
+        </LocalAccounts>
+      </UserAccounts>
+      <AutoLogon>
+        <Enabled>true</Enabled>
+        <Username>{{xml .User}}</Username>
+        <Password><Value></Value><PlainText>true</PlainText></Password>
+      </AutoLogon>
+      <FirstLogonCommands>
+        <SynchronousCommand wcm:action="add">
+          <Order>1</Order>
+          <CommandLine>powershell -NoProfile -ExecutionPolicy Bypass -Command "&amp; ((Get-Volume -FileSystemLabel {{xml .Label}}).DriveLetter + ':\prep.ps1')"</CommandLine>
+        </SynchronousCommand>
+      </FirstLogonCommands>
+    </component>
+  </settings>
+</unattend>
+`))
+
+// prepScript runs the bootstrap script, registers the buildlet task
+// and a startup task formatting the scratch disk attached by
+// -scratch-disk-gb, if any, as D:, and shuts the guest down, which
+// ends the preparation. Any error leaves the guest running until the
+// preparation times out.
+var prepScript = template.Must(template.New("prep.ps1").Parse(`$ErrorActionPreference = 'Stop'
+$media = (Get-Volume -FileSystemLabel {{.Label}}).DriveLetter + ':'
+& "$media\bootstrap.ps1"
+Register-ScheduledTask -TaskName 'Buildlet' -Xml (Get-Content -Raw "$media\buildlet-task.xml") -Force
+$scratch = New-ScheduledTaskAction -Execute 'powershell.exe' -Argument '-NoProfile -Command "Get-Disk | Where-Object PartitionStyle -eq RAW | Initialize-Disk -PartitionStyle GPT -PassThru | New-Partition -DriveLetter D -UseMaximumSize | Format-Volume -FileSystem NTFS -NewFileSystemLabel SCRATCH -Confirm:$false"'
+Register-ScheduledTask -TaskName 'ScratchDisk' -Action $scratch -Trigger (New-ScheduledTaskTrigger -AtStartup) -User SYSTEM -RunLevel Highest -Force
+Stop-Computer -Force
+`))
+
+// buildletTask is a Task Scheduler definition running TaskCommand with
+// the highest privileges whenever User logs on, restarting it if it
+// fails.
+var buildletTask = template.Must(template.New("buildlet-task.xml").Funcs(prepFuncs).Parse(`<Task version="1.2" xmlns="http://schemas.microsoft.com/windows/2004/02/mit/task">
+  <Triggers>
+    <LogonTrigger>
+      <Enabled>true</Enabled>
+      <UserId>{{xml .User}}</UserId>
+    </LogonTrigger>
+  </Triggers>
+  <Principals>
+    <Principal id="Author">
+      <UserId>{{xml .User}}</UserId>
+      <LogonType>InteractiveToken</LogonType>
+      <RunLevel>HighestAvailable</RunLevel>
+    </Principal>
+  </Principals>
+  <Settings>
+    <DisallowStartIfOnBatteries>false</DisallowStartIfOnBatteries>
+    <StopIfGoingOnBatteries>false</StopIfGoingOnBatteries>
+    <ExecutionTimeLimit>PT0S</ExecutionTimeLimit>
+    <RestartOnFailure>
+      <Interval>PT1M</Interval>
+      <Count>999</Count>
+    </RestartOnFailure>
+  </Settings>
+  <Actions Context="Author">
+    <Exec>
+      <Command>{{xml .TaskCommand}}</Command>
+      <WorkingDirectory>{{xml .TaskDir}}</WorkingDirectory>
+    </Exec>
+  </Actions>
+</Task>
+`))
+
+// imageMain implements the image subcommand.
+func imageMain(ctx context.Context, cfg *vmConfig, args []string) error {
+	if len(args) == 0 || args[0] != "prep" {
+		return errors.New("usage: runqemubuildlet [flags] image prep [prep flags]")
+	}
+	return imagePrepMain(ctx, cfg, args[1:])
+}
+
+// imagePrepMain implements the image prep subcommand, which boots a
+// copy of the disk image of cfg with preparation media holding an
+// unattend.xml, the buildlet bootstrap script, and its scheduled task,
+// waits for the guest to apply them and shut down, and writes the
+// result as a new golden qcow2 image.
+func imagePrepMain(ctx context.Context, cfg *vmConfig, args []string) error {
+	fs := flag.NewFlagSet("image prep", flag.ContinueOnError)
+	base := fs.String("base", "", "Disk image to prepare, which must be generalized with sysprep, or be ready for OOBE. Defaults to the first disk of the guest profile or config.")
+	out := fs.String("out", "", "Path to write the prepared qcow2 image to. Required.")
+	unattend := fs.String("unattend", "", "Path to an Autounattend.xml to use instead of the default, which creates and logs on -user, and runs prep.ps1 from the preparation media.")
+	bootstrap := fs.String("bootstrap", "", "Path to the bootstrap PowerShell script installing the buildlet, such as env/windows-arm64/startup.ps1. Required.")
+	p := &imagePrep{Label: prepISOLabel}
+	fs.StringVar(&p.User, "user", "gopher", "Local administrator that runs the buildlet.")
+	fs.StringVar(&p.Arch, "arch", "arm64", "Windows processor architecture of the image: arm64 or amd64.")
+	fs.StringVar(&p.TaskCommand, "task-command", `C:\golang\bootstrap.exe`, "Command the scheduled task runs whenever -user logs on.")
+	timeout := fs.Duration("timeout", 2*time.Hour, "Maximum time for the guest to prepare itself and shut down.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	if *out == "" || *bootstrap == "" {
+		return errors.New("-out and -bootstrap are required")
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(*out), "image-prep")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "prep")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	if err := writePrepDir(dir, p, *unattend, *bootstrap); err != nil {
+		return fmt.Errorf("writePrepDir() = %w", err)
+	}
+	iso := filepath.Join(tmp, "prep.iso")
+	cmd := isoCommand(dir, iso, prepISOLabel)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v = %w: %s", cmd, err, out)
+	}
+
+	// Boot a copy of the base image, so that a failed preparation
+	// leaves neither it nor a previous output behind.
+	c, err := prepConfig(cfg, filepath.Join(tmp, "disk.qcow2"), iso)
+	if err != nil {
+		return err
+	}
+	if *base == "" {
+		*base = cfg.path(cfg.Drives[firstDisk(cfg)].File)
+	}
+	if err := convertImage(ctx, c, *base, filepath.Join(tmp, "disk.qcow2")); err != nil {
+		return err
+	}
+	if err := bootPrep(ctx, c, *timeout); err != nil {
+		return err
+	}
+	// Converting again drops the clusters freed while preparing, so
+	// that the same inputs produce an image of the same size.
+	if err := convertImage(ctx, c, filepath.Join(tmp, "disk.qcow2"), *out); err != nil {
+		return err
+	}
+	sum, err := fileSHA256(*out)
+	if err != nil {
+		return err
+	}
+	slog.Info("Prepared image", "path", *out, "sha256", sum)
+	fmt.Printf("%s  %s\n", sum, *out)
+	return nil
+}
+
+// writePrepDir populates dir with the contents of the preparation
+// media for p: Autounattend.xml, read from unattendPath if set,
+// bootstrap.ps1 copied from bootstrapPath, prep.ps1, and
+// buildlet-task.xml.
+func writePrepDir(dir string, p *imagePrep, unattendPath, bootstrapPath string) error {
+	files := map[string]*template.Template{
+		"Autounattend.xml":  defaultUnattend,
+		"prep.ps1":          prepScript,
+		"buildlet-task.xml": buildletTask,
+	}
+	if unattendPath != "" {
+		delete(files, "Autounattend.xml")
+		if err := copyFile(filepath.Join(dir, "Autounattend.xml"), unattendPath, 0644); err != nil {
+			return err
+		}
+	}
+	for name, t := range files {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, p); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return copyFile(filepath.Join(dir, "bootstrap.ps1"), bootstrapPath, 0644)
+}
+
+// firstDisk returns the index of the first disk drive of c, or -1.
+func firstDisk(c *vmConfig) int {
+	for i, d := range c.Drives {
+		if d.Media == "disk" {
+			return i
+		}
+	}
+	return -1
+}
+
+// prepConfig returns a copy of cfg that boots the disk image at disk,
+// writing to it, with the preparation media at iso attached. Builder
+// credentials are not provisioned into the image.
+func prepConfig(cfg *vmConfig, disk, iso string) (*vmConfig, error) {
+	c := cfg.clone()
+	i := firstDisk(c)
+	if i < 0 {
+		return nil, errors.New("config has no disk drive to prepare")
+	}
+	c.Drives[i].File = disk
+	c.Drives[i].Format = "qcow2"
+	c.Drives = append(c.Drives, driveConfig{
+		ID:            "prep",
+		File:          iso,
+		Media:         "cdrom",
+		Format:        "raw",
+		ReadOnly:      true,
+		Device:        "usb-storage",
+		DeviceOptions: "removable=true",
+	})
+	c.Snapshot = false
+	c.CloudInit = nil
+	c.Provision = nil
+	c.Balloon = nil
+	return c, nil
+}
+
+// convertImage writes the disk image at src to dst as a standalone
+// qcow2 image, using the qemu-img of c.
+func convertImage(ctx context.Context, c *vmConfig, src, dst string) error {
+	cmd := c.qemuImgCommand(ctx, "convert", "-O", "qcow2", src, dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v = %w: %s", cmd, err, out)
+	}
+	return nil
+}
+
+// bootPrep boots the VM of c, and waits up to timeout for the guest to
+// shut down by itself once it has prepared itself.
+func bootPrep(ctx context.Context, c *vmConfig, timeout time.Duration) error {
+	if c.TPM != nil {
+		tpm, err := startTPM(ctx, c)
+		if err != nil {
+			return fmt.Errorf("startTPM() = %w", err)
+		}
+		defer func() {
+			tpm.Process.Kill()
+			tpm.Wait()
+		}()
+	}
+	cmd := c.command()
+	if *stopProcessGroup {
+		internal.SetProcessGroup(cmd)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	slog.Info("Booting VM to prepare image", "cmd", cmd.String(), "timeout", timeout, "vnc", c.VNC)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cmd.Start() = %w", err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := internal.WaitOrStopPolicy(tctx, cmd, stopPolicy())
+	if tctx.Err() != nil {
+		return fmt.Errorf("guest did not shut down within %v: %w", timeout, err)
+	}
+	if err != nil {
+		return fmt.Errorf("QEMU failed: %w", err)
+	}
+	return nil
+}
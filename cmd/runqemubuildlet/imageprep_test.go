@@ -0,0 +1,85 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWritePrepDir(t *testing.T) {
+	dir := t.TempDir()
+	bootstrap := filepath.Join(t.TempDir(), "startup.ps1")
+	if err := ioutil.WriteFile(bootstrap, []byte("Write-Host bootstrap\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &imagePrep{User: "gopher", Arch: "arm64", TaskCommand: `C:\golang\bootstrap.exe`, Label: prepISOLabel}
+	if err := writePrepDir(dir, p, "", bootstrap); err != nil {
+		t.Fatalf("writePrepDir() = %v, wanted no error", err)
+	}
+	for _, name := range []string{"Autounattend.xml", "buildlet-task.xml"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct{}
+		if err := xml.Unmarshal(b, &v); err != nil {
+			t.Errorf("%s is not valid XML: %v\n%s", name, err, b)
+		}
+	}
+	task, err := ioutil.ReadFile(filepath.Join(dir, "buildlet-task.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<WorkingDirectory>C:\golang</WorkingDirectory>`; !strings.Contains(string(task), want) {
+		t.Errorf("buildlet-task.xml does not contain %q:\n%s", want, task)
+	}
+	prep, err := ioutil.ReadFile(filepath.Join(dir, "prep.ps1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-FileSystemLabel GOPREP"; !strings.Contains(string(prep), want) {
+		t.Errorf("prep.ps1 does not contain %q:\n%s", want, prep)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "bootstrap.ps1"))
+	if err != nil || string(b) != "Write-Host bootstrap\n" {
+		t.Errorf("bootstrap.ps1 = %q, %v, wanted copy of %s", b, err, bootstrap)
+	}
+}
+
+func TestPrepConfig(t *testing.T) {
+	cfg := windows10Config("/base")
+	c, err := prepConfig(cfg, "/tmp/disk.qcow2", "/tmp/prep.iso")
+	if err != nil {
+		t.Fatalf("prepConfig() = _, %v, wanted no error", err)
+	}
+	if c.Snapshot {
+		t.Errorf("prepConfig().Snapshot = true, wanted writes to the disk kept")
+	}
+	want := []driveConfig{
+		{ID: "drive0", File: "/tmp/disk.qcow2", Media: "disk", Format: "qcow2", Cache: cacheAuto, Device: "nvme", DeviceOptions: "serial=drive0,bootindex=0"},
+		cfg.Drives[1],
+		{ID: "prep", File: "/tmp/prep.iso", Media: "cdrom", Format: "raw", ReadOnly: true, Device: "usb-storage", DeviceOptions: "removable=true"},
+	}
+	if diff := cmp.Diff(want, c.Drives); diff != "" {
+		t.Errorf("prepConfig().Drives mismatch (-want +got):\n%s", diff)
+	}
+	if cfg.Drives[0].File != "Images/win10.qcow2" || !cfg.Snapshot {
+		t.Errorf("prepConfig() modified its argument")
+	}
+
+	cfg.Drives = nil
+	if _, err := prepConfig(cfg, "/tmp/disk.qcow2", "/tmp/prep.iso"); err == nil {
+		t.Errorf("prepConfig() without disks = _, nil, wanted error")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/build/internal/httpdl"
+)
+
+// imageStagingDir is the directory, relative to the image directory,
+// that new image versions are downloaded into before being installed.
+const imageStagingDir = ".staging"
+
+// imageUpdates, if set, prefetches new image versions published at
+// -image-url.
+var imageUpdates *imageUpdater
+
+// imageUpdater downloads and verifies new versions of the image
+// published at url into a staging directory while VMs keep running
+// the installed version in dir, and installs them between runs.
+type imageUpdater struct {
+	url, dir string
+	// notifiers, if set, returns the notifiers to tell of images
+	// failing verification.
+	notifiers func() []notifierConfig
+
+	mu        sync.Mutex
+	installed *imageManifest
+	staged    *imageManifest // verified and ready to install, if any
+}
+
+func newImageUpdater(url, dir string, installed *imageManifest) *imageUpdater {
+	return &imageUpdater{url: url, dir: dir, installed: installed}
+}
+
+// latest returns the version of the staged image, or of the
+// installed one if none is staged.
+func (u *imageUpdater) latest() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.staged != nil {
+		return u.staged.Version
+	}
+	return u.installed.Version
+}
+
+// poll checks for a new image version every interval until ctx is
+// done, and stages it.
+func (u *imageUpdater) poll(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := u.check(ctx); err != nil {
+			slog.Warn("Prefetching image failed", "url", u.url, "err", err)
+			var ce *checksumError
+			if errors.As(err, &ce) && u.notifiers != nil {
+				notifyAll(u.notifiers(), notification{Event: notifyImageVerification, Message: "Prefetched image failed verification", Err: err})
+			}
+		}
+	}
+}
+
+// check stages the image version published at u.url, unless it is
+// already installed or staged.
+func (u *imageUpdater) check(ctx context.Context) error {
+	m, err := fetchManifest(ctx, u.url)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	installed := u.installed
+	skip := m.Version == installed.Version || (u.staged != nil && m.Version == u.staged.Version)
+	u.mu.Unlock()
+	if skip {
+		return nil
+	}
+	slog.Info("Prefetching image", "version", m.Version, "installed_version", installed.Version)
+	if err := u.stage(ctx, m, installed); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.staged = m
+	u.mu.Unlock()
+	slog.Info("Staged image; VMs will switch to it as they are recycled", "version", m.Version)
+	return nil
+}
+
+// stage downloads the files of m that differ from those of installed
+// into the staging directory, and verifies their checksums. Staged
+// files of other versions are removed.
+func (u *imageUpdater) stage(ctx context.Context, m, installed *imageManifest) error {
+	root := filepath.Join(u.dir, imageStagingDir)
+	if err := os.RemoveAll(root); err != nil {
+		return err
+	}
+	have := make(map[string]string)
+	for _, f := range installed.Files {
+		have[f.Name] = f.SHA256
+	}
+	dir := u.stagingDir(m)
+	for _, f := range m.Files {
+		if strings.EqualFold(have[f.Name], f.SHA256) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		local := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return err
+		}
+		src := strings.TrimSuffix(u.url, "/") + "/" + f.Name
+		if err := httpdl.Download(local, src); err != nil {
+			return fmt.Errorf("downloading %s: %w", src, err)
+		}
+		if err := verifySHA256(local, f.SHA256); err != nil {
+			os.RemoveAll(root)
+			return err
+		}
+	}
+	return nil
+}
+
+// stagingDir returns the directory m is staged in.
+func (u *imageUpdater) stagingDir(m *imageManifest) string {
+	return filepath.Join(u.dir, imageStagingDir, m.Version)
+}
+
+// install moves the files of the staged image, if any, into place,
+// and returns the installed version. VMs that are still running keep
+// using the files they opened. If installing fails, the staged image
+// is discarded, to be staged again by the next check.
+func (u *imageUpdater) install(lg *slog.Logger) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	m := u.staged
+	if m == nil {
+		return u.installed.Version, nil
+	}
+	u.staged = nil
+	defer os.RemoveAll(filepath.Join(u.dir, imageStagingDir))
+	dir := u.stagingDir(m)
+	for _, f := range m.Files {
+		staged := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if _, err := os.Stat(staged); os.IsNotExist(err) {
+			// Unchanged from the installed version.
+			continue
+		}
+		local := filepath.Join(u.dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return u.installed.Version, err
+		}
+		if err := os.Rename(staged, local); err != nil {
+			return u.installed.Version, err
+		}
+	}
+	lg.Info("Installed image", "version", m.Version, "previous_version", u.installed.Version)
+	u.installed = m
+	return m.Version, nil
+}
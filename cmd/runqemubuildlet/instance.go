@@ -0,0 +1,330 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/build/internal/supervise"
+)
+
+// instance is a single VM supervised by runqemubuildlet.
+//
+// When running multiple VMs on one host, each instance has its own
+// host ports, VNC display, and buildlet health endpoint, and is
+// restarted independently of the others.
+type instance struct {
+	// name identifies the instance in logs.
+	name string
+	// cfg is the config of the instance's next run. It is replaced
+	// when the config is reloaded, and read with config once the
+	// instance is running.
+	cfg        *vmConfig
+	healthzURL string
+	logger     *slog.Logger
+	// drain is shared by all instances, and requests that they exit
+	// once their buildlets are idle.
+	drain *drainer
+	// vncPassword, if set, is the password of the VM's VNC server.
+	vncPassword string
+
+	// mu guards the fields below, which describe the current or most
+	// recent run for /status.
+	mu        sync.Mutex
+	lg        *runLogger    // nil before the first run
+	started   time.Time     // start of the run logged by lg
+	runs      int           // number of runs started
+	bootTime  time.Duration // until the run's buildlet was healthy, if it has been
+	lastErr   error         // error of the most recent failed run
+	lastErrAt time.Time
+	exit      string        // exit reason of the most recent run to exit
+	exitCode  int           // QEMU's exit status for exitCrash
+	probes    *probeHistory // most recent heartbeat probes, across runs
+	// shutDown is whether the guest of the most recent run to exit
+	// shut down by itself, rather than QEMU being stopped.
+	shutDown bool
+}
+
+// newInstances returns n instances derived from cfg and healthzURL.
+//
+// Instance i has its forwarded host ports, and the port of
+// healthzURL, offset by i*portStride, and its VNC display offset by
+// i. Each instance keeps its TPM state, if any, in a subdirectory of
+// the configured state directory. A single instance uses cfg
+// unmodified.
+func newInstances(cfg *vmConfig, healthzURL string, n, portStride int) ([]*instance, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("instance count %d, wanted at least 1", n)
+	}
+	if n == 1 {
+		return []*instance{newInstance("vm", cfg, healthzURL)}, nil
+	}
+	if cfg.Network.MAC != "" {
+		return nil, fmt.Errorf("network mac %s cannot be shared by %d instances", cfg.Network.MAC, n)
+	}
+	if portStride < 1 {
+		return nil, fmt.Errorf("port stride %d, wanted at least 1", portStride)
+	}
+	var insts []*instance
+	for i := 0; i < n; i++ {
+		c := cfg.clone()
+		offset := i * portStride
+		for j := range c.Network.PortForwards {
+			c.Network.PortForwards[j].HostPort += offset
+		}
+		if c.VNC != "" {
+			vnc, err := offsetVNCDisplay(c.VNC, i)
+			if err != nil {
+				return nil, err
+			}
+			c.VNC = vnc
+		}
+		name := fmt.Sprintf("vm%d", i)
+		if c.TPM != nil {
+			c.TPM.StateDir = filepath.Join(c.TPM.StateDir, name)
+		}
+		if c.Name != "" {
+			c.Name = fmt.Sprintf("%s %d", c.Name, i)
+		}
+		u, err := offsetURLPort(healthzURL, offset)
+		if err != nil {
+			return nil, err
+		}
+		insts = append(insts, newInstance(name, c, u))
+	}
+	return insts, nil
+}
+
+// config returns the config of the instance's next run.
+func (in *instance) config() *vmConfig {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.cfg
+}
+
+// setConfig replaces the config of the instance's next run with c.
+func (in *instance) setConfig(c *vmConfig) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.cfg = c
+}
+
+func newInstance(name string, cfg *vmConfig, healthzURL string) *instance {
+	return &instance{
+		name:       name,
+		cfg:        cfg,
+		healthzURL: healthzURL,
+		logger:     slog.Default().With("vm", name, "guest", cfg.Name),
+		drain:      newDrainer(),
+		probes:     newProbeHistory(*probeHistorySize),
+	}
+}
+
+// run runs the instance's VM in a loop until ctx is done, or the
+// instance has drained.
+//
+// Failed runs are retried with exponential backoff. A run that lasted
+// longer than the maximum backoff resets the delay, as it is unlikely
+// to be part of a crash loop.
+func (in *instance) run(ctx context.Context) {
+	opts := supervise.Options{
+		Restart:         supervise.Always,
+		MinBackoff:      *retryMin,
+		MaxBackoff:      *retryMax,
+		CrashLoopMax:    *crashLoopMax,
+		CrashLoopWindow: *crashLoopWindow,
+		OnRestart: func(err error, d time.Duration) {
+			in.logger.Warn("VM run failed, retrying", "err", err, "delay", d)
+		},
+		OnCrashLoop: func(err error) {
+			in.notify(notifyCrashLoop, "VM is crash-looping", err)
+			escalateCrashLoop(in.logger, in.name, err)
+		},
+	}
+	if *mode == modeMaintenance {
+		opts.Restart = supervise.Never
+	}
+	err := supervise.Run(ctx, opts, in.runOnce)
+	if *mode == modeMaintenance {
+		in.logger.Info("Maintenance VM stopped; not restarting", "err", err)
+	}
+}
+
+// runOnce runs the instance's VM once, unless it is drained. It
+// returns an error wrapping supervise.ErrStop once it is drained, and
+// nil if the VM was recycled.
+func (in *instance) runOnce(ctx context.Context) error {
+	if in.drain.draining() {
+		in.logger.Info("Drained; not restarting VM")
+		return supervise.ErrStop
+	}
+	in.waitForHostResources(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var imageVersion string
+	if imageUpdates != nil {
+		v, err := imageUpdates.install(in.logger)
+		if err != nil {
+			in.logger.Error("Installing staged image failed; booting the installed one", "err", err)
+		}
+		imageVersion = v
+	}
+	start := time.Now()
+	rctx, stop := context.WithCancelCause(ctx)
+	go in.stopWhenDrained(rctx, stop)
+	// recycle stops the VM once idle, or after timeout, to be
+	// restarted right away.
+	var recycleOnce sync.Once
+	recycled := make(chan struct{})
+	recycle := func(reason string, timeout time.Duration) {
+		recycleOnce.Do(func() { close(recycled) })
+		in.stopWhenIdle(rctx, reason, timeout, stop)
+	}
+	cfg := in.config()
+	go func() {
+		if reason := in.waitRecycle(rctx, start, imageVersion, cfg); reason != "" {
+			recycle(reason, *recycleTimeout)
+		}
+	}()
+	if *mode != modeMaintenance {
+		go in.drainOnLowResources(rctx, func(reason string) {
+			recycle(reason, *drainTimeout)
+		})
+	}
+	err := runVM(rctx, in)
+	stop(nil)
+	select {
+	case <-recycled:
+		if ctx.Err() == nil {
+			// The VM was stopped on purpose.
+			in.logger.Info("Recycled VM", "uptime", time.Since(start).Round(time.Second))
+			err = nil
+		}
+	default:
+	}
+	in.finishRun(err)
+	if in.drain.draining() && *mode != modeMaintenance {
+		in.logger.Info("Drained; not restarting VM")
+		return supervise.ErrStop
+	}
+	return err
+}
+
+// startRun records that a new run, logging to lg, has started, and
+// returns its number, starting at 1.
+func (in *instance) startRun(lg *runLogger) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.lg = lg
+	in.started = time.Now()
+	in.runs++
+	in.bootTime = 0
+	return in.runs
+}
+
+// setBootDuration records that the current run's buildlet became
+// healthy d after it started.
+func (in *instance) setBootDuration(d time.Duration) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.bootTime = d
+}
+
+// setExit records that the current run exited for reason, with QEMU's
+// exit status code if it crashed.
+func (in *instance) setExit(reason string, code int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.exit = reason
+	in.exitCode = code
+}
+
+// setGuestShutDown records whether the guest of the current run shut
+// down by itself.
+func (in *instance) setGuestShutDown(ok bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.shutDown = ok
+}
+
+// guestShutDown reports whether the guest of the most recent run to
+// exit shut down by itself.
+func (in *instance) guestShutDown() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.shutDown
+}
+
+// finishRun records the result of the run started by the last call
+// to startRun.
+func (in *instance) finishRun(err error) {
+	if err == nil {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.lastErr = err
+	in.lastErrAt = time.Now()
+}
+
+// offsetVNCDisplay returns the QEMU -vnc argument vnc with its display
+// number increased by n. Options following the display are preserved.
+func offsetVNCDisplay(vnc string, n int) (string, error) {
+	host, d, opts, err := splitVNC(vnc)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d%s", host, d+n, opts), nil
+}
+
+// splitVNC splits the QEMU -vnc argument vnc, such as
+// "127.0.0.1:3,password=on", into its host, display number, and
+// options, including the leading comma.
+func splitVNC(vnc string) (host string, display int, opts string, err error) {
+	i := strings.LastIndex(vnc, ":")
+	if i < 0 {
+		return "", 0, "", fmt.Errorf("vnc %q has no display number", vnc)
+	}
+	host, rest := vnc[:i], vnc[i+1:]
+	ds := rest
+	if j := strings.Index(rest, ","); j >= 0 {
+		ds, opts = rest[:j], rest[j:]
+	}
+	display, err = strconv.Atoi(ds)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("vnc %q has invalid display number: %w", vnc, err)
+	}
+	return host, display, opts, nil
+}
+
+// offsetURLPort returns rawURL with its port increased by offset.
+func offsetURLPort(rawURL string, offset int) (string, error) {
+	if offset == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return "", fmt.Errorf("url %q must have an explicit port: %w", rawURL, err)
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port+offset))
+	return u.String(), nil
+}
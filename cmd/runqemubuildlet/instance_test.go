@@ -0,0 +1,94 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewInstances(t *testing.T) {
+	cfg := windows10Config("/base")
+	insts, err := newInstances(cfg, "http://localhost:8080/healthz", 2, 10)
+	if err != nil {
+		t.Fatalf("newInstances() = _, %v, wanted no error", err)
+	}
+	if len(insts) != 2 {
+		t.Fatalf("len(newInstances()) = %d, wanted 2", len(insts))
+	}
+	cases := []struct {
+		hostPort   int
+		vnc        string
+		healthzURL string
+	}{
+		{8080, ":3", "http://localhost:8080/healthz"},
+		{8090, ":4", "http://localhost:8090/healthz"},
+	}
+	for i, c := range cases {
+		in := insts[i]
+		if got := in.cfg.Network.PortForwards[0].HostPort; got != c.hostPort {
+			t.Errorf("insts[%d] host port = %d, wanted %d", i, got, c.hostPort)
+		}
+		if in.cfg.VNC != c.vnc {
+			t.Errorf("insts[%d].cfg.VNC = %q, wanted %q", i, in.cfg.VNC, c.vnc)
+		}
+		if in.healthzURL != c.healthzURL {
+			t.Errorf("insts[%d].healthzURL = %q, wanted %q", i, in.healthzURL, c.healthzURL)
+		}
+	}
+	if got := cfg.Network.PortForwards[0].HostPort; got != 8080 {
+		t.Errorf("newInstances() modified cfg host port to %d, wanted 8080", got)
+	}
+}
+
+func TestOffsetVNCDisplay(t *testing.T) {
+	cases := []struct {
+		vnc     string
+		n       int
+		want    string
+		wantErr bool
+	}{
+		{vnc: ":3", n: 2, want: ":5"},
+		{vnc: "127.0.0.1:0,password=on", n: 1, want: "127.0.0.1:1,password=on"},
+		{vnc: "none", n: 1, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := offsetVNCDisplay(c.vnc, c.n)
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("offsetVNCDisplay(%q, %d) = %q, %v, wanted %q, wantErr: %t", c.vnc, c.n, got, err, c.want, c.wantErr)
+		}
+	}
+}
+
+func TestRunConfig(t *testing.T) {
+	in := newInstance("vm0", windows10Config("/base"), "http://localhost:8080/healthz")
+	first, second := in.runConfig("/tmp/1", 1), in.runConfig("/tmp/2", 2)
+	if first.Name == second.Name {
+		t.Errorf("runConfig() name = %q for runs 1 and 2, wanted different names", first.Name)
+	}
+	if first.Network.MAC == second.Network.MAC {
+		t.Errorf("runConfig() mac = %q for runs 1 and 2, wanted different addresses", first.Network.MAC)
+	}
+	for _, c := range []*vmConfig{first, second} {
+		mac, err := net.ParseMAC(c.Network.MAC)
+		if err != nil {
+			t.Fatalf("runConfig() mac = %q: %v", c.Network.MAC, err)
+		}
+		if mac[0]&0x03 != 0x02 {
+			t.Errorf("runConfig() mac = %v, wanted a locally administered unicast address", mac)
+		}
+	}
+	if in.cfg.Network.MAC != "" {
+		t.Errorf("runConfig() modified instance mac to %q, wanted empty", in.cfg.Network.MAC)
+	}
+
+	in.cfg.Network.MAC = "52:54:00:12:34:56"
+	if got := in.runConfig("/tmp/3", 3).Network.MAC; got != in.cfg.Network.MAC {
+		t.Errorf("runConfig() with configured mac = %q, wanted %q", got, in.cfg.Network.MAC)
+	}
+}
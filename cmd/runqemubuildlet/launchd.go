@@ -0,0 +1,108 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// launchdJob describes a launchd job running runqemubuildlet.
+type launchdJob struct {
+	Label   string
+	Program string
+	Args    []string // flags passed to Program
+	LogPath string
+}
+
+// xmlEscape returns s escaped for use as XML text. It is the "xml"
+// function of XML templates.
+func xmlEscape(s string) (string, error) {
+	var b bytes.Buffer
+	err := xml.EscapeText(&b, []byte(s))
+	return b.String(), err
+}
+
+var launchdPlistTmpl = template.Must(template.New("plist").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{xml .Program}}</string>
+{{- range .Args}}
+		<string>{{xml .}}</string>
+{{- end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>ThrottleInterval</key>
+	<integer>30</integer>
+	<key>ExitTimeOut</key>
+	<integer>300</integer>
+	<key>ProcessType</key>
+	<string>Interactive</string>
+	<key>StandardOutPath</key>
+	<string>{{xml .LogPath}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .LogPath}}</string>
+</dict>
+</plist>
+`))
+
+// writeLaunchdPlist writes a launchd property list for j to w.
+//
+// launchd has no watchdog, so the job relies on KeepAlive to restart
+// runqemubuildlet when it exits, including when -self-watchdog finds
+// it wedged. ExitTimeOut gives VMs time to shut down when the job is
+// stopped.
+func writeLaunchdPlist(w io.Writer, j *launchdJob) error {
+	return launchdPlistTmpl.Execute(w, j)
+}
+
+// launchdPlistMain implements the launchd-plist subcommand, which
+// prints a launchd property list running runqemubuildlet with flags,
+// the flags passed before the subcommand.
+func launchdPlistMain(args, flags []string) error {
+	fs := flag.NewFlagSet("launchd-plist", flag.ContinueOnError)
+	label := fs.String("label", "org.golang.build.runqemubuildlet", "Label of the launchd job.")
+	logPath := fs.String("log", "", "Path to write runqemubuildlet's output to. Defaults to ~/Library/Logs/<label>.log.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	prog, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if *logPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		*logPath = filepath.Join(home, "Library", "Logs", *label+".log")
+	}
+	return writeLaunchdPlist(os.Stdout, &launchdJob{
+		Label:   *label,
+		Program: prog,
+		Args:    flags,
+		LogPath: *logPath,
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestWriteLaunchdPlist(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeLaunchdPlist(&buf, &launchdJob{
+		Label:   "org.golang.build.runqemubuildlet",
+		Program: "/usr/local/bin/runqemubuildlet",
+		Args:    []string{"-guest=windows-arm64-11", "-crash-loop-exec=echo <&>"},
+		LogPath: "/tmp/runqemubuildlet.log",
+	})
+	if err != nil {
+		t.Fatalf("writeLaunchdPlist() = %v, wanted no error", err)
+	}
+	// The plist must be well-formed XML, with arguments escaped.
+	d := xml.NewDecoder(bytes.NewReader(buf.Bytes()))
+	var strs []string
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		if cd, ok := tok.(xml.CharData); ok && strings.TrimSpace(string(cd)) != "" {
+			strs = append(strs, string(cd))
+		}
+	}
+	want := "-crash-loop-exec=echo <&>"
+	var found bool
+	for _, s := range strs {
+		if s == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("writeLaunchdPlist() = %s, wanted it to contain argument %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// errLeaseLost is the cause VMs are stopped with once this host is no
+// longer the leader.
+var errLeaseLost = errors.New("leader lease lost")
+
+// leaseReleaseTimeout is the maximum time releasing the leader lease
+// may take on shutdown.
+const leaseReleaseTimeout = 10 * time.Second
+
+// leaseStore holds a lease that at most one holder has at a time.
+type leaseStore interface {
+	// acquire takes or renews the lease for holder until ttl from
+	// now, if it is free, expired, or already held by holder, and
+	// reports whether it did.
+	acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// release frees the lease, if holder has it.
+	release(ctx context.Context, holder string) error
+	// String describes the store, for logs.
+	String() string
+}
+
+// leader runs VMs on at most one of several redundant hosts at a time:
+// the one holding a shared lease, while the others stand by to take
+// over once it expires.
+type leader struct {
+	store  leaseStore
+	holder string        // identifies this host
+	ttl    time.Duration // how long the lease lasts without renewal
+}
+
+// newLeader returns the leader for the lease at URL u, held as id, or
+// the host name if id is empty, for ttl.
+func newLeader(u, id string, ttl time.Duration) (*leader, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lease duration %v, wanted a positive one", ttl)
+	}
+	store, err := newGCSLease(u)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		if id, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return &leader{store: store, holder: id, ttl: ttl}, nil
+}
+
+// run calls f with a context derived from ctx each time l acquires the
+// lease, until ctx is done or drained is closed. The context passed to
+// f is done, with a cause wrapping errLeaseLost, once the lease may
+// have passed to another host.
+//
+// Once ctx is done, or f returns by itself, such as after draining,
+// the lease is released, so that a standby takes over right away.
+func (l *leader) run(ctx context.Context, drained <-chan struct{}, f func(context.Context)) {
+	for {
+		if !l.wait(ctx, drained) {
+			return
+		}
+		slog.Info("Acquired leader lease; starting VMs", "lease", l.store, "holder", l.holder)
+		lctx, cancel := context.WithCancelCause(ctx)
+		go l.renew(lctx, cancel)
+		f(lctx)
+		cancel(nil)
+		if errors.Is(context.Cause(lctx), errLeaseLost) && ctx.Err() == nil {
+			slog.Warn("Lost leader lease; standing by", "lease", l.store, "cause", context.Cause(lctx))
+			continue
+		}
+		rctx, rcancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+		if err := l.store.release(rctx, l.holder); err != nil {
+			slog.Warn("Releasing leader lease failed; the standby takes over once it expires", "lease", l.store, "err", err)
+		}
+		rcancel()
+		return
+	}
+}
+
+// wait waits until l acquires the lease, and reports whether it did
+// before ctx was done or drained was closed.
+func (l *leader) wait(ctx context.Context, drained <-chan struct{}) bool {
+	t := time.NewTicker(l.ttl / 4)
+	defer t.Stop()
+	standby := false
+	for {
+		ok, err := l.store.acquire(ctx, l.holder, l.ttl)
+		switch {
+		case ok:
+			return true
+		case err != nil:
+			slog.Warn("Acquiring leader lease failed", "lease", l.store, "err", err)
+		case !standby:
+			slog.Info("Another host holds the leader lease; standing by", "lease", l.store)
+			standby = true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-drained:
+			return false
+		case <-t.C:
+		}
+	}
+}
+
+// renew renews the lease every quarter of its ttl until ctx is done.
+// It cancels ctx if another host takes the lease, or the lease has not
+// been renewed for half its ttl, leaving time to stop the VMs before a
+// standby may take over.
+func (l *leader) renew(ctx context.Context, cancel context.CancelCauseFunc) {
+	t := time.NewTicker(l.ttl / 4)
+	defer t.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		start := time.Now()
+		ok, err := l.store.acquire(ctx, l.holder, l.ttl)
+		switch {
+		case ok:
+			renewed = start
+		case err == nil:
+			cancel(fmt.Errorf("%w: another host holds it", errLeaseLost))
+			return
+		case time.Since(renewed) > l.ttl/2:
+			cancel(fmt.Errorf("%w: not renewed since %v: %v", errLeaseLost, renewed.Format(time.RFC3339), err))
+			return
+		default:
+			slog.Warn("Renewing leader lease failed", "lease", l.store, "err", err)
+		}
+	}
+}
+
+// leaseRecord is the content of a lease object.
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// gcsLease is a leaseStore holding the lease in a GCS object, updated
+// with generation preconditions so that concurrent holders cannot both
+// acquire it. Expiry is judged by each host's clock, which must be
+// roughly in sync.
+type gcsLease struct {
+	bucket, object string
+}
+
+// newGCSLease returns the leaseStore for the GCS object at the
+// gs://bucket/object URL u.
+func newGCSLease(u string) (*gcsLease, error) {
+	bucket, object, err := parseGCSURL(u)
+	if err != nil {
+		return nil, err
+	}
+	if object == "" {
+		return nil, fmt.Errorf("%q names no object", u)
+	}
+	return &gcsLease{bucket: bucket, object: object}, nil
+}
+
+func (g *gcsLease) String() string { return "gs://" + path.Join(g.bucket, g.object) }
+
+// read returns the current lease record, if any, and the generation
+// of the object holding it, or zero if there is none.
+func (g *gcsLease) read(ctx context.Context, obj *storage.ObjectHandle) (*leaseRecord, int64, error) {
+	r, err := obj.NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	var rec leaseRecord
+	if err := json.NewDecoder(r).Decode(&rec); err != nil {
+		// Treat a garbled lease as free, rather than keeping every
+		// host standing by.
+		return nil, r.Attrs.Generation, nil
+	}
+	return &rec, r.Attrs.Generation, nil
+}
+
+func (g *gcsLease) acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	sc, err := getStorageClient(ctx)
+	if err != nil {
+		return false, fmt.Errorf("storage.NewClient: %w", err)
+	}
+	obj := sc.Bucket(g.bucket).Object(g.object)
+	rec, gen, err := g.read(ctx, obj)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if rec != nil && rec.Holder != holder && now.Before(rec.Expires) {
+		return false, nil
+	}
+	cond := storage.Conditions{DoesNotExist: true}
+	if gen != 0 {
+		cond = storage.Conditions{GenerationMatch: gen}
+	}
+	w := obj.If(cond).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if err := json.NewEncoder(w).Encode(leaseRecord{Holder: holder, Expires: now.Add(ttl)}); err != nil {
+		w.Close()
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			// Another host wrote the lease since it was read.
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (g *gcsLease) release(ctx context.Context, holder string) error {
+	sc, err := getStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %w", err)
+	}
+	obj := sc.Bucket(g.bucket).Object(g.object)
+	rec, gen, err := g.read(ctx, obj)
+	if err != nil || rec == nil || rec.Holder != holder {
+		return err
+	}
+	if err := obj.If(storage.Conditions{GenerationMatch: gen}).Delete(ctx); err != nil && !isPreconditionFailed(err) {
+		return err
+	}
+	return nil
+}
+
+// isPreconditionFailed reports whether err is a GCS precondition
+// failure.
+func isPreconditionFailed(err error) bool {
+	var ge *googleapi.Error
+	return errors.As(err, &ge) && ge.Code == http.StatusPreconditionFailed
+}
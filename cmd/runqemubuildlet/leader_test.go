@@ -0,0 +1,159 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memLease is a leaseStore in memory.
+type memLease struct {
+	mu      sync.Mutex
+	holder  string
+	expires time.Time
+	err     error // if set, returned by acquire
+}
+
+func (m *memLease) acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	if m.holder != "" && m.holder != holder && time.Now().Before(m.expires) {
+		return false, nil
+	}
+	m.holder, m.expires = holder, time.Now().Add(ttl)
+	return true, nil
+}
+
+func (m *memLease) release(ctx context.Context, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.holder == holder {
+		m.holder = ""
+	}
+	return nil
+}
+
+func (m *memLease) String() string { return "mem" }
+
+func (m *memLease) set(holder string, ttl time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.holder, m.expires, m.err = holder, time.Now().Add(ttl), err
+}
+
+func (m *memLease) get() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.holder
+}
+
+func TestLeaderHandover(t *testing.T) {
+	store := new(memLease)
+	a := &leader{store: store, holder: "a", ttl: time.Hour}
+	b := &leader{store: store, holder: "b", ttl: 40 * time.Millisecond}
+
+	actx, acancel := context.WithCancel(context.Background())
+	aRunning := make(chan struct{})
+	aDone := make(chan struct{})
+	go func() {
+		defer close(aDone)
+		a.run(actx, nil, func(ctx context.Context) {
+			close(aRunning)
+			<-ctx.Done()
+		})
+	}()
+	<-aRunning
+
+	bRunning := make(chan struct{})
+	bDone := make(chan struct{})
+	go func() {
+		defer close(bDone)
+		b.run(context.Background(), nil, func(ctx context.Context) {
+			close(bRunning)
+		})
+	}()
+	select {
+	case <-bRunning:
+		t.Fatal("standby ran while the leader held the lease")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	acancel()
+	<-aDone
+	select {
+	case <-bRunning:
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby did not take over after the leader released the lease")
+	}
+	<-bDone
+	if got := store.get(); got != "" {
+		t.Errorf("lease held by %q after the standby returned, wanted it released", got)
+	}
+}
+
+func TestLeaderLeaseLost(t *testing.T) {
+	cases := []struct {
+		desc string
+		lose func(m *memLease)
+	}{
+		{desc: "taken", lose: func(m *memLease) { m.set("other", 50*time.Millisecond, nil) }},
+		{desc: "not renewed", lose: func(m *memLease) { m.set("", 0, errors.New("unavailable")) }},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			store := new(memLease)
+			l := &leader{store: store, holder: "a", ttl: 40 * time.Millisecond}
+			var cause error
+			runs := 0
+			l.run(context.Background(), nil, func(ctx context.Context) {
+				runs++
+				if runs > 1 {
+					// Leading again after standing by; return as if
+					// drained.
+					return
+				}
+				c.lose(store)
+				<-ctx.Done()
+				cause = context.Cause(ctx)
+				store.set("", 0, nil)
+			})
+			if !errors.Is(cause, errLeaseLost) {
+				t.Errorf("first run stopped with cause %v, wanted errLeaseLost", cause)
+			}
+			if runs != 2 {
+				t.Errorf("ran %d times, wanted 2", runs)
+			}
+			if got := store.get(); got != "" {
+				t.Errorf("lease held by %q after returning, wanted it released", got)
+			}
+		})
+	}
+}
+
+func TestLeaderDrained(t *testing.T) {
+	store := new(memLease)
+	store.set("other", time.Hour, nil)
+	l := &leader{store: store, holder: "a", ttl: 40 * time.Millisecond}
+	drained := make(chan struct{})
+	close(drained)
+	ran := false
+	l.run(context.Background(), drained, func(context.Context) { ran = true })
+	if ran {
+		t.Error("a drained standby ran its VMs")
+	}
+	if got := store.get(); got != "other" {
+		t.Errorf("lease held by %q, wanted %q", got, "other")
+	}
+}
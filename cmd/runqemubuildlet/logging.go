@@ -0,0 +1,91 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Phases of a VM run, logged with each message about the run.
+const (
+	phaseStarting = "starting" // Preparing and starting QEMU.
+	phaseBooting  = "booting"  // QEMU started; the buildlet is not yet healthy.
+	phaseHealthy  = "healthy"  // The buildlet has passed a health check.
+	phaseDraining = "draining" // The guest has been asked to shut down.
+	phaseKilled   = "killed"   // QEMU was stopped by runqemubuildlet.
+	phaseExited   = "exited"   // QEMU exited by itself.
+)
+
+// newLogHandler returns a slog.Handler writing to w in format, which
+// is "json" or "text".
+func newLogHandler(format string, w io.Writer) (slog.Handler, error) {
+	switch format {
+	case "json":
+		return slog.NewJSONHandler(w, nil), nil
+	case "text":
+		return slog.NewTextHandler(w, nil), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, wanted json or text", format)
+}
+
+// runLogger logs messages about a single run of a VM, tagged with a
+// unique run ID and the current phase of the run.
+type runLogger struct {
+	*slog.Logger
+	id string
+
+	// onPhase, if set, is called by setPhase with its arguments.
+	onPhase func(phase, msg string, args []interface{})
+
+	mu    sync.Mutex
+	phase string
+}
+
+// newRunLogger returns a runLogger for a new run, derived from l.
+func newRunLogger(l *slog.Logger) *runLogger {
+	id := uuid.New().String()
+	return &runLogger{Logger: l.With("run_id", id), id: id, phase: phaseStarting}
+}
+
+// setPhase records that the run has entered phase, and logs msg.
+func (l *runLogger) setPhase(phase, msg string, args ...interface{}) {
+	l.mu.Lock()
+	l.phase = phase
+	l.mu.Unlock()
+	l.Logger.Info(msg, append([]interface{}{"phase", phase}, args...)...)
+	if l.onPhase != nil {
+		l.onPhase(phase, msg, args)
+	}
+}
+
+// currentPhase returns the current phase of the run.
+func (l *runLogger) currentPhase() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.phase
+}
+
+// Info logs msg at slog.LevelInfo, tagged with the current phase.
+func (l *runLogger) Info(msg string, args ...interface{}) {
+	l.Logger.Info(msg, append([]interface{}{"phase", l.currentPhase()}, args...)...)
+}
+
+// Warn logs msg at slog.LevelWarn, tagged with the current phase.
+func (l *runLogger) Warn(msg string, args ...interface{}) {
+	l.Logger.Warn(msg, append([]interface{}{"phase", l.currentPhase()}, args...)...)
+}
+
+// Error logs msg at slog.LevelError, tagged with the current phase.
+func (l *runLogger) Error(msg string, args ...interface{}) {
+	l.Logger.Error(msg, append([]interface{}{"phase", l.currentPhase()}, args...)...)
+}
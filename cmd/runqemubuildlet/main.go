@@ -2,62 +2,404 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build go1.16
-// +build go1.16
+//go:build go1.21
+// +build go1.21
 
-// Binary runqemubuildlet runs a single VM-based buildlet in a loop.
+// Binary runqemubuildlet runs VM-based buildlets in a loop.
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/build/internal"
 )
 
 var (
-	windows10Path = flag.String("windows-10-path", defaultWindowsDir(), "Path to Windows image and QEMU dependencies.")
-	healthzURL    = flag.String("buildlet-healthz-url", "http://localhost:8080/healthz", "URL to buildlet /healthz endpoint.")
+	windows10Path        = flag.String("windows-10-path", defaultWindowsDir(), "Path to Windows image and QEMU dependencies.")
+	windows11Path        = flag.String("windows-11-path", defaultWindowsDir(), "Path to Windows 11 image and QEMU dependencies.")
+	linuxPath            = flag.String("linux-path", defaultLinuxDir(), "Path to Linux image, buildlet, and QEMU dependencies.")
+	swtpmPath            = flag.String("swtpm", "swtpm", "Path to the swtpm binary, used by guests with a TPM.")
+	healthzURL           = flag.String("buildlet-healthz-url", "http://localhost:8080/healthz", "URL to buildlet /healthz endpoint.")
+	buildletKeyFile      = flag.String("buildlet-key-file", "", "Path to the guest buildlet's builder key, which its /status endpoint next to -buildlet-healthz-url requires. Defaults to the key_file of the config's provision or cloud_init section.")
+	guest                = flag.String("guest", "windows-arm64-10", "Built-in guest profile to run: windows-arm64-10, windows-arm64-11, or linux-arm64. See -list-guests. Ignored if -config is set.")
+	listGuestsFlag       = flag.Bool("list-guests", false, "List the built-in guest profiles and exit.")
+	linuxReverseType     = flag.String("linux-reverse-type", "", "Reverse buildlet host type the linux-arm64 guest registers as. Required by -guest=linux-arm64.")
+	configPath           = flag.String("config", "", "Path to a YAML VM definition. If set, it is used instead of the -guest profile.")
+	numInstances         = flag.Int("instances", 1, "Number of VMs to run concurrently.")
+	httpAddr             = flag.String("http-addr", "", "If set, address to serve /healthz, /status, /drain, /metrics, and /debug/pprof/ on, such as localhost:9090.")
+	checkImagesFlag      = flag.Bool("check-images", true, "Run qemu-img check on the guest's disk images before booting, and refuse to boot if any is corrupted.")
+	repairImages         = flag.Bool("repair-images", false, "With -image-url, download corrupted disk images found by -check-images again instead of refusing to boot.")
+	imageURL             = flag.String("image-url", "", "If set, URL of a directory (such as a GCS bucket path) containing a manifest.json of guest image files to download into the image directory and verify before booting.")
+	imagePollInterval    = flag.Duration("image-poll-interval", 0, "With -image-url, how often to check for a new image version to download and verify in the background, and switch VMs to as they are recycled. Zero disables.")
+	serialLogDir         = flag.String("serial-log-dir", "", "If set, directory to write each VM run's guest serial console log to.")
+	serialLogKeep        = flag.Int("serial-log-keep", 20, "Number of serial console logs, and of screenshots, to keep per VM in -serial-log-dir and -screenshot-dir.")
+	serialLogUpload      = flag.String("serial-log-upload", "", "Deprecated: use -artifact-upload.")
+	artifactUpload       = flag.String("artifact-upload", "", "If set, a gs://bucket/prefix URL to upload a tarball of the serial console log, QEMU stderr, screenshot, and state of each VM run that ends abnormally to.")
+	artifactRetention    = flag.Duration("artifact-retention", 30*24*time.Hour, "Age after which this host's tarballs under -artifact-upload are deleted. Zero keeps them indefinitely.")
+	screenshotDir        = flag.String("screenshot-dir", "", "If set, directory to save a screenshot of the guest display to, taken over QMP when a VM fails its heartbeat.")
+	retryMin             = flag.Duration("retry-min", 10*time.Second, "Minimum delay before restarting a VM that failed.")
+	retryMax             = flag.Duration("retry-max", 10*time.Minute, "Maximum delay before restarting a VM that failed. The delay doubles with each consecutive failure.")
+	crashLoopMax         = flag.Int("crash-loop-max", 5, "Number of VM failures within -crash-loop-window after which the VM is considered crash-looping. Zero disables crash loop detection.")
+	crashLoopWindow      = flag.Duration("crash-loop-window", 30*time.Minute, "Window for -crash-loop-max.")
+	crashLoopExec        = flag.String("crash-loop-exec", "", "If set, a shell command to run when a VM is crash-looping, such as a notification script.")
+	crashLoopExit        = flag.Bool("crash-loop-exit", true, "Exit with a non-zero status when a VM is crash-looping.")
+	overlayDir           = flag.String("overlay-dir", "", "If set, run each VM with fresh qcow2 overlays in this directory, backed by its disk images, instead of with -snapshot.")
+	persist              = flag.Bool("persist", false, "With -overlay-dir, commit changes in the overlays back to the disk images when the VM shuts down cleanly. For maintenance.")
+	keepOverlays         = flag.Bool("keep-failed-overlays", false, "With -overlay-dir, keep the overlays of VM runs that end abnormally for inspection.")
+	logFormat            = flag.String("log-format", "json", "Log output format: json or text.")
+	guestCPUs            = flag.Int("guest-cpus", 0, "If positive, the number of guest CPUs, overriding the guest profile or config.")
+	guestMemoryMB        = flag.Int("guest-memory-mb", 0, "If positive, the guest memory in MiB, overriding the guest profile or config.")
+	guestSockets         = flag.Int("guest-sockets", 0, "If positive, the number of guest CPU sockets.")
+	guestCores           = flag.Int("guest-cores", 0, "If positive, the number of guest CPU cores per socket.")
+	guestThreads         = flag.Int("guest-threads", 0, "If positive, the number of guest CPU threads per core.")
+	guestBalloonMinMB    = flag.Int("guest-balloon-min-mb", 0, "If positive, attach a memory balloon, and shrink idle guests down to this many MiB while the host is short of memory.")
+	guestAutoSize        = flag.Bool("guest-auto-size", false, "Size guest CPUs and memory as an equal share of the host's resources among -instances VMs. Explicit -guest-* flags take precedence.")
+	guestAgent           = flag.Bool("guest-agent", false, "Require qemu-guest-agent in the guest to respond to health checks, in addition to the buildlet.")
+	shutdownGrace        = flag.Duration("shutdown-grace", 2*time.Minute, "Time to wait for the guest to shut down after an ACPI powerdown request before interrupting QEMU. Zero interrupts QEMU immediately.")
+	hostShutdownGrace    = flag.Duration("host-shutdown-grace", 20*time.Second, "Time to wait for the guest to shut down, instead of -shutdown-grace, when runqemubuildlet receives SIGTERM because the host is shutting down.")
+	killDelay            = flag.Duration("kill-delay", time.Minute, "Time to wait for QEMU to exit after interrupting it before killing it.")
+	stopProcessGroup     = flag.Bool("stop-process-group", true, "Run QEMU in a process group of its own, and signal the whole group to stop it, so that helper processes it started are stopped with it.")
+	autoPorts            = flag.Bool("auto-ports", false, "Allocate free host ports for port forwards and VNC displays, searching upwards from the configured ones. The chosen ports are logged and served at /status.")
+	drainTimeout         = flag.Duration("drain-timeout", 2*time.Hour, "When draining, the maximum time to wait for a buildlet to finish its build before stopping its VM. Zero waits indefinitely.")
+	qemuSearchPath       = flag.String("qemu-search-path", "", "List of directories, separated by the OS path list separator, to search first for qemu-system-<arch> when the config's qemu is auto. Relative directories, such as a sysroot's bin, are resolved against the config's base.")
+	minQEMUVersionFlag   = flag.String("min-qemu-version", "6.0", "Minimum supported QEMU version. Pre-flight checks fail with an older qemu-system binary. Empty disables the check.")
+	skipPreflight        = flag.Bool("skip-preflight", false, "Skip checking that QEMU, firmware, and disk images exist, and that the host has the accelerator, memory, and disk space the VMs need, before starting them.")
+	leaderLock           = flag.String("leader-lock", "", "If set, a gs://bucket/object lease that redundant hosts share: only the host holding it runs VMs, and the others stand by to take over once it stops renewing it.")
+	leaderID             = flag.String("leader-id", "", "The holder name of this host in -leader-lock. Defaults to the host name.")
+	leaderLease          = flag.Duration("leader-lease", 5*time.Minute, "How long the -leader-lock lease lasts without renewal, and so how long a standby waits to take over from a leader that went silent.")
+	minFreeDiskMB        = flag.Int("min-free-disk-mb", 10240, "Minimum free disk space, in MiB, in -overlay-dir or the temporary directory. VMs are not started with less, and are drained if it runs lower.")
+	minAvailableMemoryMB = flag.Int("min-available-memory-mb", 512, "Minimum host memory, in MiB, to keep available. VMs are not started unless this much remains after their memory, and are drained if less is available. Zero disables the check.")
+	maxLoadPerCPU        = flag.Float64("max-load-per-cpu", 0, "If positive, the maximum host 1-minute load average per CPU. VMs are not started above it, and are drained if it is exceeded.")
+	mode                 = flag.String("mode", modeProduction, "Mode to run in: production, or maintenance, which boots a single VM with writable disk images, no heartbeat, and a VNC password, and exits once it shuts down.")
+	vncPasswordFile      = flag.String("vnc-password-file", "", "In maintenance mode, file containing the VNC password, of at most 8 characters. If empty, a random password is generated and shown on the controlling terminal, but not logged.")
+	dryRun               = flag.Bool("dry-run", false, "Print the environment and QEMU command line of each VM, and exit without running them.")
+	printConfig          = flag.Bool("print-config", false, "Print the effective configuration of each VM as YAML, after applying flags, and exit without running them.")
+	selfWatchdog         = flag.Duration("self-watchdog", 5*time.Minute, "Exit if runqemubuildlet appears wedged for this long, so that launchd or another init system without a watchdog restarts it. Zero disables it. Under systemd with WatchdogSec, systemd's watchdog is used instead.")
+	updateURL            = flag.String("update-url", "", "If set, URL of the latest runqemubuildlet binary for this host, such as https://storage.googleapis.com/bucket/runqemubuildlet.darwin-arm64, signed by -update-key in a .sig file alongside it. New binaries are installed, and run once VMs have drained.")
+	updateKey            = flag.String("update-key", "", "Base64-encoded Ed25519 public key that -update-url binaries must be signed with.")
+	updateInterval       = flag.Duration("update-interval", time.Hour, "How often to check -update-url for a new binary.")
+	heartbeatFailures    = flag.Int("heartbeat-failures", 3, "Number of consecutive failed health checks, in addition to -heartbeat-timeout without a successful one, after which a VM is stopped.")
+	fatalPatterns        = flag.Bool("fatal-patterns", true, "Stop a VM right away, instead of once its heartbeat times out, when its serial console or QEMU output matches a known fatal error, such as a boot loop or bug check, or one of the fatal_patterns of the config.")
+	heartbeatInterval    = flag.Duration("heartbeat-interval", 0, "If positive, the time between health checks, overriding the config. Defaults to 30s.")
+	heartbeatTimeout     = flag.Duration("heartbeat-timeout", 0, "If positive, how long health checks must fail for before a VM is stopped, overriding the config. Must be at least twice -heartbeat-interval. Defaults to 10m.")
+	probeHistorySize     = flag.Int("probe-history", 50, "Number of recent heartbeat probe results of each VM, across runs, to report at /status.")
+	probeTimeout         = flag.Duration("probe-timeout", buildletHealthTimeout, "Maximum time each health check may take before it counts as failed.")
+	bootTimeout          = flag.Duration("boot-timeout", 15*time.Minute, "Maximum time from starting a VM until its health checks first pass, after which it is stopped and restarted. Zero disables the timeout.")
+	maxVMUptime          = flag.Duration("max-vm-uptime", 0, "If positive, drain and restart each VM once it has run this long, even if healthy.")
+	recycleTimeout       = flag.Duration("recycle-timeout", 2*time.Hour, "When recycling a VM on schedule, for an image update, or after a config change, the maximum time to wait for its buildlet to finish the command it is running before stopping the VM. Zero waits indefinitely.")
+	recycleOnReload      = flag.Bool("recycle-on-reload", false, "Recycle each VM once its config is reloaded with changes, rather than applying them from its next run.")
+	maxSessions          = flag.Int("max-sessions", 0, "If positive, drain and restart each VM once its buildlet has completed this many sessions with the coordinator, counted from restarts of the buildlet process in the guest, for guests that degrade over many builds even with -snapshot. Requires buildlet version 28 or later.")
+	recycleWindowList    = flag.String("recycle-windows", "", "Comma-separated daily windows of local time, such as 02:00-04:00, during which each VM started before the window opened is drained and restarted.")
+	auditLogPath         = flag.String("audit-log", "", "If set, file to append a JSON record to for each operator action, such as starting runqemubuildlet, a maintenance-mode boot, a drain request, or a web console connection, with the requester's identity.")
+	eventURL             = flag.String("event-url", "", "If set, URL to POST a JSON event to whenever a VM run changes phase, such as when it starts, becomes healthy, drains, or is stopped.")
+	networkBackend       = flag.String("network-backend", "", "If set, the host network backend, overriding the guest profile or config: user, or on macOS, vmnet-shared, vmnet-host, or vmnet-bridged=INTERFACE. vmnet backends drop port forwards; point -buildlet-healthz-url at the guest's address instead.")
+	scratchDiskGB        = flag.Int("scratch-disk-gb", 0, "If positive, attach an empty, sparse scratch disk of this many GiB to each VM run, for build trees and caches, which is deleted after the run. Windows guests prepared by the image subcommand mount it as D:, and Linux guests using the default cloud-init user data at /scratch.")
+	maxClockSkew         = flag.Duration("max-clock-skew", 0, "If positive, set the guest clock to the host's over the guest agent once it responds, and again whenever it drifts further than this. Requires -guest-agent or guest_agent in the config.")
+	niceLevel            = flag.Int("nice", 0, "If non-zero, the nice level to run QEMU at, from -20 to 19. Negative levels require root. Not supported on Windows.")
+	qosClass             = flag.String("qos-class", "", "On macOS, a QoS class to clamp QEMU to with taskpolicy: utility, background, or maintenance, which runs it on efficiency cores only.")
+	cpuAffinity          = flag.String("cpu-affinity", "", "On Linux, a list of host CPUs to pin QEMU to with taskset, such as 0-7 for the performance cores of a hybrid CPU.")
+	consolePasswordFile  = flag.String("console-password-file", "", "If set with -http-addr, file containing the password, with any user name, for the web console showing the VMs' VNC displays at /console/. The console is disabled otherwise.")
+	novncDir             = flag.String("novnc-dir", "", "Directory containing noVNC, served at /console/novnc/ for the web console's pages.")
+	forwardRDP           = flag.Bool("forward-rdp", false, "Forward a free host TCP port, at or above 13389, to the Remote Desktop port of Windows guests. The chosen ports are logged and served at /status.")
+	portStride           = flag.Int("port-stride", 10, "When running multiple VMs, the offset between each VM's forwarded host ports and healthz URL port.")
 )
 
+var healthChecks healthCheckFlags
+
+var shares shareFlags
+
+// overrides are the -set flags.
+var overrides overrideFlags
+
+// events reports VM lifecycle events to -event-url, if set.
+var events *eventReporter
+
+// accels are the -accel flags.
+var accels accelFlags
+
+// recycleWindows are the parsed -recycle-windows.
+var recycleWindows []recycleWindow
+
+func init() {
+	flag.Var(&accels, "accel", "QEMU accelerator, such as auto or tcg,tb-size=1536, overriding those of the guest profile or config. May be repeated, in order of preference. auto selects the host's hardware accelerator, if any: hvf on macOS, kvm on Linux, or whpx or hax on Windows.")
+	flag.Var(&healthChecks, "health-check", "Health check the guest must pass, in addition to those in -config. May be repeated. One of http[=URL], tcp[=HOST:PORT], exec=COMMAND, or buildlet[=STATUS-URL]; targets default to -buildlet-healthz-url.")
+	flag.Var(&overrides, "set", "Override a field of the guest profile or config, as PATH=VALUE, where PATH is a dotted path of YAML field names and list indexes, such as memory_mb, network.device, or drives.0.file, and VALUE is YAML, such as 8192 or [hvf, tcg]. May be repeated. Applied before other flags.")
+	flag.Var(&stopSignals, "stop-signals", "Signals to send QEMU, in order, to stop it once the guest has not shut down, as a comma-separated list of SIGNAL[=WAIT], such as INT=1m,TERM=30s,KILL, where WAIT is how long to wait for QEMU to exit before sending the next signal. SIGNAL is INT, TERM, QUIT, or KILL. Defaults to INT=-kill-delay,KILL.")
+	flag.Var(&shares, "share", "Host directory to export into the guest over 9p, as TAG=PATH, in addition to those in -config. May be repeated.")
+}
+
 func main() {
+	if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatalf("setFlagsFromEnv() = %v", err)
+	}
 	flag.Parse()
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	if flag.Arg(0) == "launchd-plist" {
+		if err := launchdPlistMain(flag.Args()[1:], os.Args[1:len(os.Args)-flag.NArg()]); err != nil {
+			log.Fatalf("launchd-plist: %v", err)
+		}
+		return
+	}
+
+	if *listGuestsFlag {
+		if err := listGuests(os.Stdout); err != nil {
+			log.Fatalf("listGuests() = %v", err)
+		}
+		return
+	}
+
+	h, err := newLogHandler(*logFormat, os.Stderr)
+	if err != nil {
+		log.Fatalf("newLogHandler() = _, %v", err)
+	}
+	slog.SetDefault(slog.New(h))
+
+	recycleWindows, err = parseRecycleWindows(*recycleWindowList)
+	if err != nil {
+		log.Fatalf("parseRecycleWindows(%q) = _, %v", *recycleWindowList, err)
+	}
+	if *artifactUpload == "" {
+		*artifactUpload = *serialLogUpload
+	}
+	if *imagePollInterval > 0 && *imageURL == "" {
+		log.Fatal("-image-poll-interval requires -image-url")
+	}
+	if *imagePollInterval > 0 && *persist {
+		log.Fatal("-image-poll-interval cannot be used with -persist, which writes to the disk images")
+	}
+	if err := currentQoS().validate(runtime.GOOS); err != nil {
+		log.Fatalf("QoS flags: %v", err)
+	}
+	cfg, err := vmConfigFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flag.Arg(0) == "image" {
+		ctx, stop := notifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := imageMain(ctx, cfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("image: %v", err)
+		}
+		return
+	}
+	if buildletKey, err = loadBuildletKey(cfg); err != nil {
+		log.Fatalf("loadBuildletKey() = _, %v", err)
+	}
+
+	insts, err := newInstances(cfg, *healthzURL, *numInstances, *portStride)
+	if err != nil {
+		log.Fatalf("newInstances() = %v", err)
+	}
+	if *printConfig || *dryRun {
+		if *printConfig {
+			if err := printConfigs(os.Stdout, insts); err != nil {
+				log.Fatalf("printConfigs() = %v", err)
+			}
+		}
+		if *dryRun {
+			if err := printCommands(os.Stdout, insts); err != nil {
+				log.Fatalf("printCommands() = %v", err)
+			}
+		}
+		return
+	}
+	if flag.Arg(0) == "smoketest" {
+		ctx, stop := notifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := smoketestSetup(ctx, cfg, insts[:1]); err != nil {
+			log.Fatalf("smoketest: %v", err)
+		}
+		if err := smoketestMain(ctx, insts[0], flag.Args()[1:]); err != nil {
+			log.Fatalf("smoketest: %v", err)
+		}
+		return
+	}
+	if *auditLogPath != "" {
+		audit, err = openAuditLog(*auditLogPath)
+		if err != nil {
+			log.Fatalf("openAuditLog(%q) = _, %v", *auditLogPath, err)
+		}
+	}
+	audit.record("start", "process", processRequester(), "mode", *mode, "guest", cfg.Name, "args", strings.Join(os.Args[1:], " "))
+	if *mode == modeMaintenance {
+		audit.record("maintenance_boot", "process", processRequester(), "vnc", cfg.VNC)
+		pw, err := vncPassword(*vncPasswordFile)
+		if err != nil {
+			log.Fatalf("vncPassword(%q) = _, %v", *vncPasswordFile, err)
+		}
+		if *vncPasswordFile == "" {
+			if err := showVNCPassword(cfg.VNC, pw); err != nil {
+				log.Fatal(err)
+			}
+		}
+		insts[0].vncPassword = pw
+	}
+	if *autoPorts {
+		if err := allocatePorts(insts, portFree); err != nil {
+			log.Fatalf("allocatePorts() = %v", err)
+		}
+	} else if *forwardRDP {
+		if err := allocateRDPPorts(insts, portFree); err != nil {
+			log.Fatalf("allocateRDPPorts() = %v", err)
+		}
+	}
+
+	ctx, stop := notifyContext(context.Background(), append([]os.Signal{os.Interrupt}, hostShutdownSignals...)...)
 	defer stop()
+	go func() {
+		<-ctx.Done()
+		var se *signalError
+		if errors.As(context.Cause(ctx), &se) {
+			audit.record("stop", "signal", "", "signal", se.sig.String())
+		}
+	}()
+
+	d := newDrainer()
+	for _, in := range insts {
+		in.drain = d
+	}
+	notifyDrain(d)
+	reloadOnSignal(insts)
+	go func() {
+		<-d.done()
+		slog.Info("Draining: VMs will exit once their buildlets are idle")
+	}()
 
-	for ctx.Err() == nil {
-		if err := runWindows10(ctx); err != nil {
-			log.Printf("runWindows10() = %v. Retrying in 10 seconds.", err)
-			time.Sleep(10 * time.Second)
-			continue
+	if *httpAddr != "" {
+		mh, err := newMetricsHandler()
+		if err != nil {
+			log.Fatalf("newMetricsHandler() = _, %v", err)
+		}
+		mux := newStatusMux(insts, d)
+		mux.Handle("/metrics", mh)
+		if *consolePasswordFile != "" {
+			pw, err := consolePassword(*consolePasswordFile)
+			if err != nil {
+				log.Fatalf("consolePassword(%q) = _, %v", *consolePasswordFile, err)
+			}
+			registerConsole(mux, insts, pw, *novncDir)
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, mux))
+		}()
+	}
+
+	if *imageURL != "" {
+		m, err := syncImage(ctx, *imageURL, cfg.Base)
+		var ce *checksumError
+		if errors.As(err, &ce) {
+			notifyAll(cfg.Notifiers, notification{Event: notifyImageVerification, Message: "Image failed verification; refusing to boot", Err: err})
+		}
+		if err != nil {
+			log.Fatalf("syncImage(_, %q, %q) = %v; refusing to boot", *imageURL, cfg.Base, err)
+		}
+		if *imagePollInterval > 0 {
+			imageUpdates = newImageUpdater(*imageURL, cfg.Base, m)
+			imageUpdates.notifiers = func() []notifierConfig { return insts[0].config().Notifiers }
+			go imageUpdates.poll(ctx, *imagePollInterval)
 		}
 	}
-}
 
-func runWindows10(ctx context.Context) error {
-	cmd := windows10Cmd(*windows10Path)
-	log.Printf("Starting VM: %s", cmd.String())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("cmd.Start() = %w", err)
-	}
-	ctx, cancel := heartbeatContext(ctx, 30*time.Second, 10*time.Minute, func(ctx context.Context) error {
-		return checkBuildletHealth(ctx, *healthzURL)
-	})
-	defer cancel()
-	if err := internal.WaitOrStop(ctx, cmd, os.Interrupt, time.Minute); err != nil {
-		return fmt.Errorf("WaitOrStop(_, %v, %v, %v) = %w", cmd, os.Interrupt, time.Minute, err)
-	}
-	return nil
+	if err := runPreflight(cfg, *numInstances); err != nil {
+		log.Fatal(err)
+	}
+
+	cleanStart := false
+	if at, ok, err := consumeCleanShutdownMarker(cfg.Base); err != nil {
+		slog.Warn("Reading clean host shutdown marker failed", "err", err)
+	} else if ok {
+		slog.Info("Host shut down cleanly; skipping image checks", "shutdown", at)
+		cleanStart = true
+	}
+	if *checkImagesFlag && !cleanStart {
+		if err := checkAndRepairImages(ctx, cfg, *imageURL, *repairImages); err != nil {
+			var ce *imageCorruptError
+			if errors.As(err, &ce) {
+				notifyAll(cfg.Notifiers, notification{Event: notifyImageVerification, Message: "Disk images are corrupted; refusing to boot", Err: err})
+			}
+			log.Fatalf("checkAndRepairImages() = %v; refusing to boot", err)
+		}
+	}
+
+	go runWatchdog(ctx, insts, *selfWatchdog)
+	if *eventURL != "" {
+		events = newEventReporter(*eventURL)
+		go events.run()
+	}
+
+	updated := make(chan struct{})
+	var upd *updater
+	if *updateURL != "" {
+		key, err := parseUpdateKey(*updateKey)
+		if err != nil {
+			log.Fatalf("parseUpdateKey(%q) = _, %v", *updateKey, err)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("os.Executable() = _, %v", err)
+		}
+		upd = &updater{url: *updateURL, key: key, exe: exe}
+		go func() {
+			upd.run(ctx, *updateInterval, updated)
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-updated:
+				d.drain()
+			}
+		}()
+	}
+
+	runAll := func(ctx context.Context) {
+		var wg sync.WaitGroup
+		for _, inst := range insts {
+			inst := inst
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				inst.run(ctx)
+			}()
+		}
+		wg.Wait()
+	}
+	if *leaderLock != "" {
+		l, err := newLeader(*leaderLock, *leaderID, *leaderLease)
+		if err != nil {
+			log.Fatalf("newLeader(%q) = _, %v", *leaderLock, err)
+		}
+		l.run(ctx, d.done(), runAll)
+	} else {
+		runAll(ctx)
+	}
+	if hostShutdown(context.Cause(ctx)) {
+		recordHostShutdown(cfg.Base, insts)
+	}
+	events.close(eventTimeout)
+
+	select {
+	case <-updated:
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Info("Restarting into updated binary", "path", upd.exe)
+		if err := reexec(upd.exe); err != nil {
+			log.Fatalf("reexec(%q) = %v", upd.exe, err)
+		}
+	default:
+	}
 }
 
 // defaultWindowsDir returns a default path for a Windows VM.
@@ -73,36 +415,118 @@ func defaultWindowsDir() string {
 	return filepath.Join(home, "macmini-windows")
 }
 
-// windows10Cmd returns a qemu command for running a Windows VM, ready
-// to be started.
-func windows10Cmd(base string) *exec.Cmd {
-	c := exec.Command(filepath.Join(base, "sysroot-macos-arm64/bin/qemu-system-aarch64"),
-		"-L", filepath.Join(base, "UTM.app/Contents/Resources/qemu"),
-		"-cpu", "max",
-		"-smp", "cpus=8,sockets=1,cores=8,threads=1", // This works well with M1 Mac Minis.
-		"-machine", "virt,highmem=off",
-		"-accel", "hvf",
-		"-accel", "tcg,tb-size=1536",
-		"-boot", "menu=on",
-		"-m", "12288",
-		"-name", "Virtual Machine",
-		"-device", "qemu-xhci,id=usb-bus",
-		"-device", "ramfb",
-		"-device", "usb-tablet,bus=usb-bus.0",
-		"-device", "usb-mouse,bus=usb-bus.0",
-		"-device", "usb-kbd,bus=usb-bus.0",
-		"-device", "virtio-net-pci,netdev=net0",
-		"-netdev", "user,id=net0,hostfwd=tcp::8080-:8080",
-		"-bios", filepath.Join(base, "Images/QEMU_EFI.fd"),
-		"-device", "nvme,drive=drive0,serial=drive0,bootindex=0",
-		"-drive", fmt.Sprintf("if=none,media=disk,id=drive0,file=%s,cache=writethrough", filepath.Join(base, "Images/win10.qcow2")),
-		"-device", "usb-storage,drive=drive2,removable=true,bootindex=1",
-		"-drive", fmt.Sprintf("if=none,media=cdrom,id=drive2,file=%s,cache=writethrough", filepath.Join(base, "Images/virtio.iso")),
-		"-snapshot", // critical to avoid saving state between runs.
-		"-vnc", ":3",
-	)
-	c.Env = append(os.Environ(),
-		fmt.Sprintf("DYLD_LIBRARY_PATH=%s", filepath.Join(base, "sysroot-macos-arm64/lib")),
-	)
-	return c
+// defaultLinuxDir returns a default path for a Linux VM.
+func defaultLinuxDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Printf("os.UserHomeDir() = %q, %v", home, err)
+		return ""
+	}
+	return filepath.Join(home, "macmini-linux")
+}
+
+// vmConfigFromFlags returns the VM config selected by -config or
+// -guest, with the other flags applied. It is called again to reload
+// the config.
+func vmConfigFromFlags() (*vmConfig, error) {
+	var cfg *vmConfig
+	var err error
+	if *configPath != "" {
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("loadConfig(%q) = %w", *configPath, err)
+		}
+	} else {
+		cfg, err = guestProfile(*guest)
+		if err != nil {
+			return nil, fmt.Errorf("guestProfile(%q) = %w", *guest, err)
+		}
+	}
+	cfg, err = applyOverrides(cfg, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("applyOverrides() = _, %w", err)
+	}
+	if err := resolveQEMU(cfg, filepath.SplitList(*qemuSearchPath), exec.LookPath); err != nil {
+		return nil, fmt.Errorf("resolveQEMU() = %w", err)
+	}
+	if *guestAgent {
+		cfg.GuestAgent = true
+	}
+	if len(accels) > 0 {
+		cfg.Accel = accels
+	}
+	cfg.HealthChecks = append(cfg.HealthChecks, healthChecks...)
+	cfg.Shares = append(cfg.Shares, shares...)
+	if *networkBackend != "" {
+		if err := applyNetworkBackend(cfg, *networkBackend); err != nil {
+			return nil, fmt.Errorf("applyNetworkBackend() = %w", err)
+		}
+	}
+	if cfg.isVZ() && *overlayDir != "" {
+		return nil, errors.New("-overlay-dir is not supported by backend vz; use snapshot instead")
+	}
+	if *forwardRDP {
+		if err := addRDPForward(cfg); err != nil {
+			return nil, fmt.Errorf("addRDPForward() = %w", err)
+		}
+	}
+	if *maxClockSkew > 0 && !cfg.GuestAgent {
+		return nil, errors.New("-max-clock-skew requires the guest agent; set -guest-agent")
+	}
+	if err := applyResourceFlags(cfg, *numInstances); err != nil {
+		return nil, fmt.Errorf("applyResourceFlags() = %w", err)
+	}
+	if err := applyHeartbeatFlags(cfg); err != nil {
+		return nil, fmt.Errorf("applyHeartbeatFlags() = %w", err)
+	}
+	if err := applyMode(cfg, *mode, *numInstances); err != nil {
+		return nil, fmt.Errorf("applyMode() = %w", err)
+	}
+	return cfg, nil
+}
+
+// signalError is the cause of the cancellation of a context returned
+// by notifyContext.
+type signalError struct {
+	sig os.Signal
+}
+
+func (e *signalError) Error() string {
+	return "received signal " + e.sig.String()
+}
+
+// runPreflight runs the preflight checks for n VMs described by cfg,
+// unless -skip-preflight is set.
+func runPreflight(cfg *vmConfig, n int) error {
+	if *skipPreflight {
+		return nil
+	}
+	var minQEMU qemuVersion
+	if *minQEMUVersionFlag != "" {
+		var err error
+		if minQEMU, err = parseQEMUVersion(*minQEMUVersionFlag); err != nil {
+			return fmt.Errorf("-min-qemu-version: %w", err)
+		}
+	}
+	return preflight(cfg, n, currentHost(), scratchDir(), *minFreeDiskMB, minQEMU)
+}
+
+// notifyContext is like signal.NotifyContext, but cancels the context
+// with a *signalError cause naming the signal received, so that runs
+// stopped by it can be told apart from other stops.
+func notifyContext(parent context.Context, sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		select {
+		case sig := <-c:
+			cancel(&signalError{sig: sig})
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(c)
+		cancel(nil)
+	}
 }
@@ -0,0 +1,148 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	kVM         = tag.MustNewKey("go-build/runqemubuildlet/vm")
+	kExitReason = tag.MustNewKey("go-build/runqemubuildlet/exit_reason")
+
+	mVMStarts          = stats.Int64("go-build/runqemubuildlet/vm_starts", "number of times a VM was started", stats.UnitDimensionless)
+	mVMExits           = stats.Int64("go-build/runqemubuildlet/vm_exits", "number of times a VM exited", stats.UnitDimensionless)
+	mBootDuration      = stats.Float64("go-build/runqemubuildlet/boot_duration", "time from starting a VM until its buildlet is healthy", stats.UnitSeconds)
+	mHeartbeatFailures = stats.Int64("go-build/runqemubuildlet/heartbeat_failures", "number of failed buildlet health checks", stats.UnitDimensionless)
+	mUptime            = stats.Float64("go-build/runqemubuildlet/uptime", "time since the current VM was started", stats.UnitSeconds)
+)
+
+// views should contain all measurements. All *view.View added to this
+// slice will be registered and exported to the metric service.
+var views = []*view.View{
+	{
+		Name:        "go-build/runqemubuildlet/vm_starts",
+		Description: "Number of times a VM was started",
+		Measure:     mVMStarts,
+		TagKeys:     []tag.Key{kVM},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "go-build/runqemubuildlet/vm_exits",
+		Description: "Number of times a VM exited, by reason",
+		Measure:     mVMExits,
+		TagKeys:     []tag.Key{kVM, kExitReason},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "go-build/runqemubuildlet/boot_duration",
+		Description: "Time from starting a VM until its buildlet is healthy",
+		Measure:     mBootDuration,
+		TagKeys:     []tag.Key{kVM},
+		Aggregation: view.Distribution(10, 30, 60, 120, 180, 300, 600, 900),
+	},
+	{
+		Name:        "go-build/runqemubuildlet/heartbeat_failures",
+		Description: "Number of failed buildlet health checks",
+		Measure:     mHeartbeatFailures,
+		TagKeys:     []tag.Key{kVM},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "go-build/runqemubuildlet/uptime",
+		Description: "Time since the current VM was started",
+		Measure:     mUptime,
+		TagKeys:     []tag.Key{kVM},
+		Aggregation: view.LastValue(),
+	},
+}
+
+// Reasons a VM exited, reported with mVMExits.
+const (
+	exitClean       = "clean"        // QEMU exited by itself without error.
+	exitHeartbeat   = "heartbeat"    // The buildlet failed its heartbeat.
+	exitBootTimeout = "boot_timeout" // The buildlet did not become healthy in time.
+	exitFatalOutput = "fatal_output" // The guest or QEMU printed a fatal error.
+	exitSignal      = "signal"       // runqemubuildlet was asked to stop.
+	exitStopped     = "stopped"      // runqemubuildlet drained or recycled the VM.
+	exitLeaseLost   = "lease_lost"   // This host lost the leader lease.
+	exitCrash       = "crash"        // QEMU exited with a non-zero status.
+	exitError       = "error"        // QEMU failed to start, or could not be waited for.
+)
+
+// abnormalExit reports whether reason is a failure of the VM, as
+// opposed to a clean shutdown or one requested by runqemubuildlet.
+func abnormalExit(reason string) bool {
+	switch reason {
+	case exitHeartbeat, exitBootTimeout, exitFatalOutput, exitCrash, exitError:
+		return true
+	}
+	return false
+}
+
+// newMetricsHandler registers views and returns an http.Handler
+// serving them in the Prometheus exposition format.
+func newMetricsHandler() (http.Handler, error) {
+	if err := view.Register(views...); err != nil {
+		return nil, err
+	}
+	pe, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("prometheus.NewExporter: %w", err)
+	}
+	return pe, nil
+}
+
+// vmMetrics records metrics for a single run of a VM.
+type vmMetrics struct {
+	name    string
+	started time.Time
+	booted  bool
+}
+
+// startVMMetrics records the start of a run of the VM named name.
+func startVMMetrics(name string) *vmMetrics {
+	m := &vmMetrics{name: name, started: time.Now()}
+	m.record(mVMStarts.M(1))
+	return m
+}
+
+// probe records the result of a buildlet health check. The first
+// successful check records the boot duration.
+//
+// probe must not be called concurrently.
+func (m *vmMetrics) probe(t time.Time, err error) {
+	m.record(mUptime.M(t.Sub(m.started).Seconds()))
+	if err != nil {
+		m.record(mHeartbeatFailures.M(1))
+		return
+	}
+	if !m.booted {
+		m.booted = true
+		m.record(mBootDuration.M(t.Sub(m.started).Seconds()))
+	}
+}
+
+// exit records that the VM exited for reason.
+func (m *vmMetrics) exit(reason string) {
+	stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(kVM, m.name), tag.Upsert(kExitReason, reason)},
+		mVMExits.M(1))
+}
+
+func (m *vmMetrics) record(ms ...stats.Measurement) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(kVM, m.name)}, ms...)
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Modes for -mode.
+const (
+	// modeProduction runs disposable VMs for the coordinator.
+	modeProduction = "production"
+	// modeMaintenance boots the disk images writable for applying
+	// updates by hand over VNC.
+	modeMaintenance = "maintenance"
+)
+
+// maxVNCPasswordLen is the longest password VNC authentication
+// supports.
+const maxVNCPasswordLen = 8
+
+// applyMode adjusts c for running n VMs in mode.
+//
+// In maintenance mode, a single VM boots its disk images writable,
+// and its VNC server requires a password.
+func applyMode(c *vmConfig, mode string, n int) error {
+	switch mode {
+	case modeProduction:
+		return nil
+	case modeMaintenance:
+	default:
+		return fmt.Errorf("unknown mode %q, wanted %s or %s", mode, modeProduction, modeMaintenance)
+	}
+	if n != 1 {
+		return fmt.Errorf("%s mode runs a single VM, not %d", mode, n)
+	}
+	if *overlayDir != "" {
+		return fmt.Errorf("%s mode writes to the disk images directly; use -persist to commit overlays instead", mode)
+	}
+	if c.VNC == "" {
+		return fmt.Errorf("%s mode requires a VNC display", mode)
+	}
+	c.Snapshot = false
+	if !strings.Contains(c.VNC, ",password") {
+		c.VNC += ",password=on"
+	}
+	return nil
+}
+
+// vncPassword returns the VNC password read from path, or a random
+// one if path is empty.
+func vncPassword(path string) (string, error) {
+	if path == "" {
+		const chars = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+		b := make([]byte, maxVNCPasswordLen)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i := range b {
+			b[i] = chars[int(b[i])%len(chars)]
+		}
+		return string(b), nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	pw := strings.TrimSpace(string(b))
+	if pw == "" || len(pw) > maxVNCPasswordLen {
+		return "", fmt.Errorf("VNC password in %s must be 1 to %d characters", path, maxVNCPasswordLen)
+	}
+	return pw, nil
+}
+
+// showVNCPassword shows a generated VNC password on the controlling
+// terminal, and not in the logs, which are collected. It fails if
+// there is no terminal to show it on.
+func showVNCPassword(vnc, password string) error {
+	tty := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		tty = "CONOUT$"
+	}
+	f, err := os.OpenFile(tty, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("no terminal to show the generated VNC password on; set -vnc-password-file: %w", err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "VNC password for maintenance of %s: %s\n", vnc, password)
+	return err
+}
+
+// setVNCPassword sets the password of the VNC server of the VM
+// controlled by the QMP socket at path, waiting up to qmpTimeout for
+// QEMU to create the socket.
+func setVNCPassword(ctx context.Context, path, password string) error {
+	ctx, cancel := context.WithTimeout(ctx, qmpTimeout)
+	defer cancel()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		q, err := dialQMP(ctx, path)
+		if err == nil {
+			defer q.Close()
+			return q.execute(ctx, "change-vnc-password", map[string]string{"password": password}, nil)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("connecting to QMP: %w", err)
+		case <-t.C:
+		}
+	}
+}
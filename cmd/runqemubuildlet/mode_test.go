@@ -0,0 +1,77 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyMode(t *testing.T) {
+	cases := []struct {
+		mode     string
+		n        int
+		vnc      string
+		wantVNC  string
+		wantSnap bool
+		wantErr  bool
+	}{
+		{mode: modeProduction, n: 2, vnc: ":3", wantVNC: ":3", wantSnap: true},
+		{mode: modeMaintenance, n: 1, vnc: ":3", wantVNC: ":3,password=on"},
+		{mode: modeMaintenance, n: 1, vnc: ":3,password=on", wantVNC: ":3,password=on"},
+		{mode: modeMaintenance, n: 2, vnc: ":3", wantErr: true},
+		{mode: modeMaintenance, n: 1, wantErr: true},
+		{mode: "bogus", n: 1, vnc: ":3", wantErr: true},
+	}
+	for _, c := range cases {
+		cfg := &vmConfig{VNC: c.vnc, Snapshot: true}
+		err := applyMode(cfg, c.mode, c.n)
+		if (err != nil) != c.wantErr {
+			t.Errorf("applyMode(_, %q, %d) = %v, wantErr: %t", c.mode, c.n, err, c.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cfg.VNC != c.wantVNC || cfg.Snapshot != c.wantSnap {
+			t.Errorf("applyMode(_, %q, %d) set VNC = %q, Snapshot = %t, wanted %q, %t", c.mode, c.n, cfg.VNC, cfg.Snapshot, c.wantVNC, c.wantSnap)
+		}
+	}
+}
+
+func TestVNCPassword(t *testing.T) {
+	pw, err := vncPassword("")
+	if err != nil || len(pw) != maxVNCPasswordLen {
+		t.Errorf("vncPassword(%q) = %q, %v, wanted a random %d character password", "", pw, err, maxVNCPasswordLen)
+	}
+
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good")
+	long := filepath.Join(dir, "long")
+	ioutil.WriteFile(good, []byte("s3cret\n"), 0600)
+	ioutil.WriteFile(long, []byte("much too long\n"), 0600)
+	if pw, err := vncPassword(good); pw != "s3cret" || err != nil {
+		t.Errorf("vncPassword(%q) = %q, %v, wanted %q", good, pw, err, "s3cret")
+	}
+	if _, err := vncPassword(long); err == nil {
+		t.Errorf("vncPassword(%q) = _, nil, wanted error", long)
+	}
+}
+
+func TestSetVNCPassword(t *testing.T) {
+	f := newFakeQMP(t, nil)
+	if err := setVNCPassword(context.Background(), f.path, "s3cret"); err != nil {
+		t.Fatalf("setVNCPassword() = %v, wanted no error", err)
+	}
+	<-f.cmds
+	if got := <-f.cmds; got != "change-vnc-password" {
+		t.Errorf("command = %q, wanted change-vnc-password", got)
+	}
+}
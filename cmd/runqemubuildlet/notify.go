@@ -0,0 +1,268 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification events.
+const (
+	// notifyCrashLoop is sent when a VM is crash-looping.
+	notifyCrashLoop = "crash_loop"
+	// notifyImageVerification is sent when a disk image fails its
+	// checksum or qemu-img check.
+	notifyImageVerification = "image_verification_failed"
+	// notifyUnhealthy is sent when a VM has failed its heartbeat,
+	// having been unhealthy for the heartbeat timeout.
+	notifyUnhealthy = "unhealthy"
+)
+
+var notifyEvents = map[string]bool{notifyCrashLoop: true, notifyImageVerification: true, notifyUnhealthy: true}
+
+const (
+	// notifyTimeout is the maximum time each notifier may take.
+	notifyTimeout = 30 * time.Second
+	// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint.
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+// notifierConfig configures a notifier, which tells operators about
+// events that need their attention.
+type notifierConfig struct {
+	// Type is one of "slack", "pagerduty", or "exec".
+	Type string `yaml:"type"`
+	// URL is the incoming webhook URL of "slack" notifiers, and for
+	// "pagerduty" notifiers, the Events API v2 endpoint, which
+	// defaults to PagerDuty's. Environment variables in it are
+	// expanded.
+	URL string `yaml:"url"`
+	// RoutingKey is the integration key of "pagerduty" notifiers.
+	// Environment variables in it are expanded.
+	RoutingKey string `yaml:"routing_key"`
+	// Command is the command line of "exec" notifiers. It runs with
+	// RUNQEMUBUILDLET_EVENT, RUNQEMUBUILDLET_VM,
+	// RUNQEMUBUILDLET_MESSAGE, and RUNQEMUBUILDLET_ERROR set.
+	Command []string `yaml:"command"`
+	// Events, if set, are the events to notify of, such as
+	// crash_loop. By default, all are.
+	Events []string `yaml:"events"`
+}
+
+func (nc notifierConfig) validate() error {
+	switch nc.Type {
+	case "slack":
+		if nc.URL == "" {
+			return fmt.Errorf("slack notifier has no url")
+		}
+	case "pagerduty":
+		if nc.RoutingKey == "" {
+			return fmt.Errorf("pagerduty notifier has no routing_key")
+		}
+	case "exec":
+		if len(nc.Command) == 0 {
+			return fmt.Errorf("exec notifier has no command")
+		}
+	default:
+		return fmt.Errorf("unknown notifier type %q, wanted slack, pagerduty, or exec", nc.Type)
+	}
+	for _, e := range nc.Events {
+		if !notifyEvents[e] {
+			return fmt.Errorf("%s notifier event %q, wanted %s, %s, or %s", nc.Type, e, notifyCrashLoop, notifyImageVerification, notifyUnhealthy)
+		}
+	}
+	return nil
+}
+
+// wants reports whether nc notifies of event.
+func (nc notifierConfig) wants(event string) bool {
+	if len(nc.Events) == 0 {
+		return true
+	}
+	for _, e := range nc.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notifier returns the notifier nc configures.
+func (nc notifierConfig) notifier() notifier {
+	switch nc.Type {
+	case "slack":
+		return slackNotifier(os.ExpandEnv(nc.URL))
+	case "pagerduty":
+		u := pagerDutyEventsURL
+		if nc.URL != "" {
+			u = os.ExpandEnv(nc.URL)
+		}
+		return &pagerDutyNotifier{url: u, routingKey: os.ExpandEnv(nc.RoutingKey)}
+	case "exec":
+		return execNotifier(nc.Command)
+	}
+	return nil
+}
+
+// notification is an event operators are notified of.
+type notification struct {
+	Event string
+	Host  string
+	// VM is the instance concerned, if any.
+	VM      string
+	Message string
+	Err     error
+}
+
+// summary describes n in a line.
+func (n notification) summary() string {
+	s := n.Host
+	if n.VM != "" {
+		s += " " + n.VM
+	}
+	s += ": " + n.Message
+	if n.Err != nil {
+		s += ": " + n.Err.Error()
+	}
+	return s
+}
+
+// notifier sends notifications to operators.
+type notifier interface {
+	notify(ctx context.Context, n notification) error
+	// String describes the notifier, for logs.
+	String() string
+}
+
+// notifyAll sends n with each of cfgs that wants its event, in
+// parallel, and waits for them. Failures are logged.
+func notifyAll(cfgs []notifierConfig, n notification) {
+	if n.Host == "" {
+		n.Host, _ = os.Hostname()
+	}
+	var wg sync.WaitGroup
+	for _, nc := range cfgs {
+		if !nc.wants(n.Event) {
+			continue
+		}
+		nt := nc.notifier()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := nt.notify(ctx, n); err != nil {
+				slog.Warn("Notification failed", "notifier", nt, "event", n.Event, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// notify sends a notification of event concerning the instance with
+// the notifiers of its config.
+func (in *instance) notify(event, msg string, err error) {
+	notifyAll(in.config().Notifiers, notification{Event: event, VM: in.name, Message: msg, Err: err})
+}
+
+// slackNotifier posts notifications to a Slack incoming webhook URL.
+type slackNotifier string
+
+func (s slackNotifier) notify(ctx context.Context, n notification) error {
+	return postJSON(ctx, string(s), map[string]string{"text": n.summary()})
+}
+
+// String omits the URL, which is a secret.
+func (s slackNotifier) String() string { return "slack" }
+
+// pagerDutyNotifier triggers PagerDuty incidents.
+type pagerDutyNotifier struct {
+	url        string
+	routingKey string
+}
+
+func (p *pagerDutyNotifier) notify(ctx context.Context, n notification) error {
+	details := map[string]string{"event": n.Event}
+	if n.VM != "" {
+		details["vm"] = n.VM
+	}
+	if n.Err != nil {
+		details["error"] = n.Err.Error()
+	}
+	return postJSON(ctx, p.url, map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": "trigger",
+		// Repeated notifications of the same problem update a
+		// single incident.
+		"dedup_key": strings.Join([]string{"runqemubuildlet", n.Host, n.VM, n.Event}, "/"),
+		"payload": map[string]interface{}{
+			"summary":        n.summary(),
+			"source":         n.Host,
+			"severity":       "error",
+			"component":      "runqemubuildlet",
+			"custom_details": details,
+		},
+	})
+}
+
+func (p *pagerDutyNotifier) String() string { return "pagerduty" }
+
+// execNotifier runs its command line for each notification.
+type execNotifier []string
+
+func (e execNotifier) notify(ctx context.Context, n notification) error {
+	cmd := exec.CommandContext(ctx, e[0], e[1:]...)
+	var errStr string
+	if n.Err != nil {
+		errStr = n.Err.Error()
+	}
+	cmd.Env = append(os.Environ(),
+		"RUNQEMUBUILDLET_EVENT="+n.Event,
+		"RUNQEMUBUILDLET_VM="+n.VM,
+		"RUNQEMUBUILDLET_MESSAGE="+n.Message,
+		"RUNQEMUBUILDLET_ERROR="+errStr,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (e execNotifier) String() string { return "exec " + strings.Join(e, " ") }
+
+// postJSON posts v as JSON to url.
+func postJSON(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST: %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNotifierConfigValidate(t *testing.T) {
+	cases := []struct {
+		nc      notifierConfig
+		wantErr bool
+	}{
+		{nc: notifierConfig{Type: "slack", URL: "https://hooks.slack.com/services/x"}},
+		{nc: notifierConfig{Type: "pagerduty", RoutingKey: "${PD_KEY}", Events: []string{"crash_loop", "unhealthy"}}},
+		{nc: notifierConfig{Type: "exec", Command: []string{"notify-oncall"}}},
+		{nc: notifierConfig{Type: "slack"}, wantErr: true},
+		{nc: notifierConfig{Type: "pagerduty"}, wantErr: true},
+		{nc: notifierConfig{Type: "exec"}, wantErr: true},
+		{nc: notifierConfig{Type: "email"}, wantErr: true},
+		{nc: notifierConfig{Type: "exec", Command: []string{"x"}, Events: []string{"booted"}}, wantErr: true},
+	}
+	for _, c := range cases {
+		if err := c.nc.validate(); (err != nil) != c.wantErr {
+			t.Errorf("%+v.validate() = %v, wantErr: %t", c.nc, err, c.wantErr)
+		}
+	}
+}
+
+func TestNotifyAll(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string]map[string]interface{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies[r.URL.Path] = body
+		mu.Unlock()
+	}))
+	defer s.Close()
+	t.Setenv("PD_KEY", "k3y")
+	cfgs := []notifierConfig{
+		{Type: "slack", URL: s.URL + "/slack"},
+		{Type: "pagerduty", URL: s.URL + "/pagerduty", RoutingKey: "${PD_KEY}"},
+		{Type: "slack", URL: s.URL + "/unwanted", Events: []string{notifyImageVerification}},
+	}
+	var envFile string
+	if runtime.GOOS != "windows" {
+		envFile = filepath.Join(t.TempDir(), "env")
+		cfgs = append(cfgs, notifierConfig{Type: "exec", Command: []string{"sh", "-c", "echo $RUNQEMUBUILDLET_EVENT $RUNQEMUBUILDLET_VM > " + envFile}})
+	}
+
+	notifyAll(cfgs, notification{Event: notifyCrashLoop, Host: "mac-mini-3", VM: "vm0", Message: "VM is crash-looping", Err: errors.New("boom")})
+
+	want := "mac-mini-3 vm0: VM is crash-looping: boom"
+	if got := bodies["/slack"]["text"]; got != want {
+		t.Errorf("slack text = %q, wanted %q", got, want)
+	}
+	pd := bodies["/pagerduty"]
+	if pd["routing_key"] != "k3y" || pd["event_action"] != "trigger" || pd["dedup_key"] != "runqemubuildlet/mac-mini-3/vm0/crash_loop" {
+		t.Errorf("pagerduty event = %v, wanted a trigger with routing_key k3y and a dedup_key for the VM and event", pd)
+	}
+	if payload, _ := pd["payload"].(map[string]interface{}); payload["summary"] != want {
+		t.Errorf("pagerduty payload = %v, wanted summary %q", pd["payload"], want)
+	}
+	if _, ok := bodies["/unwanted"]; ok {
+		t.Errorf("notifier of %s events notified of %s", notifyImageVerification, notifyCrashLoop)
+	}
+	if envFile != "" {
+		b, err := os.ReadFile(envFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(b)); got != "crash_loop vm0" {
+			t.Errorf("exec notifier environment = %q, wanted %q", got, "crash_loop vm0")
+		}
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.21
+// +build !go1.21
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runqemubuildlet logs with log/slog, which needs Go 1.21. Older
+// toolchains still build this stand-in, so that the rest of the
+// module builds with them as before.
+func main() {
+	fmt.Fprintln(os.Stderr, "runqemubuildlet requires Go 1.21 or later")
+	os.Exit(2)
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// overlay is a qcow2 overlay disk created for a single VM run, backed
+// by a golden image that is never written to directly.
+type overlay struct {
+	// path is the path of the overlay.
+	path string
+	// backing is the path of the golden image.
+	backing string
+}
+
+// createOverlays replaces each writable disk drive of c, other than
+// the scratch disk, with a new qcow2 overlay in dir, backed by the
+// drive's image. Overlay names
+// include id, so that overlays of previous runs are never reused.
+//
+// Since writes go to the overlays, c no longer needs to run with
+// -snapshot.
+func createOverlays(ctx context.Context, c *vmConfig, dir, id string) ([]overlay, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var ovs []overlay
+	for i, d := range c.Drives {
+		if d.Media != "disk" || d.ReadOnly || d.ID == scratchDriveID {
+			continue
+		}
+		ov := overlay{
+			path:    filepath.Join(dir, fmt.Sprintf("%s-%s.qcow2", id, d.ID)),
+			backing: c.path(d.File),
+		}
+		format := d.Format
+		if format == "" {
+			format = "qcow2"
+		}
+		cmd := c.qemuImgCommand(ctx, "create", "-f", "qcow2", "-b", ov.backing, "-F", format, ov.path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			removeOverlays(ovs)
+			return nil, fmt.Errorf("%v = %w: %s", cmd, err, out)
+		}
+		ovs = append(ovs, ov)
+		c.Drives[i].File = ov.path
+		c.Drives[i].Format = "qcow2"
+	}
+	c.Snapshot = false
+	return ovs, nil
+}
+
+// commitOverlays writes the changes in each overlay back to its golden
+// image.
+func commitOverlays(ctx context.Context, c *vmConfig, ovs []overlay) error {
+	for _, ov := range ovs {
+		cmd := c.qemuImgCommand(ctx, "commit", ov.path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v = %w: %s", cmd, err, out)
+		}
+	}
+	return nil
+}
+
+// removeOverlays deletes ovs.
+func removeOverlays(ovs []overlay) {
+	for _, ov := range ovs {
+		os.Remove(ov.path)
+	}
+}
+
+// qemuImgCommand returns a qemu-img command with args.
+//
+// qemu-img is expected to be installed alongside the QEMU binary.
+func (c *vmConfig) qemuImgCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, filepath.Join(filepath.Dir(c.path(c.QEMU)), "qemu-img"), args...)
+	cmd.Env = c.env()
+	return cmd
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeQEMUImg writes a qemu-img script to dir that logs its arguments
+// to dir/qemu-img.log and creates its last argument, returning the
+// path to the log.
+func fakeQEMUImg(t *testing.T, dir string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake qemu-img requires a shell")
+	}
+	logPath := filepath.Join(dir, "qemu-img.log")
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\nfor last; do :; done\ntouch \"$last\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return logPath
+}
+
+func TestCreateOverlays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := fakeQEMUImg(t, dir)
+
+	c := windows10Config(dir)
+	c.QEMU = "qemu-system-aarch64"
+	ovDir := filepath.Join(dir, "overlays")
+	ovs, err := createOverlays(context.Background(), c, ovDir, "run1")
+	if err != nil {
+		t.Fatalf("createOverlays() = _, %v, wanted no error", err)
+	}
+	if len(ovs) != 1 {
+		t.Fatalf("createOverlays() = %d overlays, wanted 1 (the cdrom should be skipped)", len(ovs))
+	}
+	wantOverlay := filepath.Join(ovDir, "run1-drive0.qcow2")
+	if ovs[0].path != wantOverlay {
+		t.Errorf("overlay path = %q, wanted %q", ovs[0].path, wantOverlay)
+	}
+	if c.Snapshot {
+		t.Errorf("c.Snapshot = true after createOverlays(), wanted false")
+	}
+	if c.Drives[0].File != wantOverlay {
+		t.Errorf("c.Drives[0].File = %q, wanted %q", c.Drives[0].File, wantOverlay)
+	}
+
+	if err := commitOverlays(context.Background(), c, ovs); err != nil {
+		t.Fatalf("commitOverlays() = %v, wanted no error", err)
+	}
+	b, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"create -f qcow2 -b " + filepath.Join(dir, "Images/win10.qcow2") + " -F qcow2 " + wantOverlay,
+		"commit " + wantOverlay,
+	}
+	if got := strings.Split(strings.TrimSpace(string(b)), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("qemu-img calls = %q, wanted %q", got, want)
+	}
+
+	removeOverlays(ovs)
+	if _, err := os.Stat(wantOverlay); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%q) = %v after removeOverlays(), wanted not exist", wantOverlay, err)
+	}
+}
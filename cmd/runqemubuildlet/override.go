@@ -0,0 +1,116 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// fieldOverride sets the field of a vmConfig at path, a dotted path of
+// YAML field names and list indexes such as "network.device" or
+// "drives.0.file", to value, in YAML.
+type fieldOverride struct {
+	path  string
+	value string
+}
+
+// overrideFlags implements flag.Value for repeated -set flags.
+type overrideFlags []fieldOverride
+
+func (f *overrideFlags) String() string {
+	var s []string
+	for _, o := range *f {
+		s = append(s, o.path+"="+o.value)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *overrideFlags) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("-set %q, wanted PATH=VALUE", s)
+	}
+	*f = append(*f, fieldOverride{path: s[:i], value: s[i+1:]})
+	return nil
+}
+
+// applyOverrides returns a copy of c with the fields named by overrides
+// set, in order. The result is validated.
+func applyOverrides(c *vmConfig, overrides []fieldOverride) (*vmConfig, error) {
+	if len(overrides) == 0 {
+		return c, nil
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(o.value), &v); err != nil {
+			return nil, fmt.Errorf("-set %s: %w", o.path, err)
+		}
+		if doc, err = setPath(doc, strings.Split(o.path, "."), v); err != nil {
+			return nil, fmt.Errorf("-set %s: %w", o.path, err)
+		}
+	}
+	if b, err = yaml.Marshal(doc); err != nil {
+		return nil, err
+	}
+	n := new(vmConfig)
+	if err := yaml.UnmarshalStrict(b, n); err != nil {
+		return nil, fmt.Errorf("-set: %w", err)
+	}
+	if err := n.validate(); err != nil {
+		return nil, fmt.Errorf("-set: %w", err)
+	}
+	return n, nil
+}
+
+// setPath returns node, a YAML document decoded into an interface{},
+// with the value at path replaced by v. Missing maps are created.
+func setPath(node interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	key := path[0]
+	switch n := node.(type) {
+	case nil:
+		child, err := setPath(nil, path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		return map[interface{}]interface{}{key: child}, nil
+	case map[interface{}]interface{}:
+		child, err := setPath(n[key], path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		n[key] = child
+		return n, nil
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, fmt.Errorf("index %q out of range for list of %d", key, len(n))
+		}
+		child, err := setPath(n[i], path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = child
+		return n, nil
+	}
+	return nil, fmt.Errorf("%q is not a map or list", key)
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	var f overrideFlags
+	for _, s := range []string{
+		"memory_mb=4096",
+		"accel=[hvf]",
+		"network.mac=52:54:00:12:34:56",
+		"drives.0.file=Images/other.qcow2",
+		"balloon.min_mb=2048",
+		"heartbeat.timeout=20m",
+	} {
+		if err := f.Set(s); err != nil {
+			t.Fatalf("Set(%q) = %v", s, err)
+		}
+	}
+	base := windows10Config("/base")
+	got, err := applyOverrides(base, f)
+	if err != nil {
+		t.Fatalf("applyOverrides() = _, %v, wanted no error", err)
+	}
+	want := windows10Config("/base")
+	want.MemoryMB = 4096
+	want.Accel = []string{"hvf"}
+	want.Network.MAC = "52:54:00:12:34:56"
+	want.Drives[0].File = "Images/other.qcow2"
+	want.Balloon = &balloonConfig{MinMB: 2048}
+	want.Heartbeat.Timeout = 20 * time.Minute
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("applyOverrides() mismatch (-want +got):\n%s", diff)
+	}
+	if base.MemoryMB == 4096 {
+		t.Errorf("applyOverrides() modified its argument")
+	}
+
+	for _, s := range []string{
+		"memroy_mb=4096",     // unknown field
+		"drives.5.file=x",    // out of range
+		"cpus=-1",            // invalid
+		"memory_mb.size=1",   // not a map
+		"network.mac=[1, 2]", // wrong type
+	} {
+		var f overrideFlags
+		f.Set(s)
+		if _, err := applyOverrides(windows10Config("/base"), f); err == nil {
+			t.Errorf("applyOverrides(%q) = _, nil, wanted error", s)
+		}
+	}
+	if err := f.Set("memory_mb"); err == nil {
+		t.Errorf("Set(%q) = nil, wanted error", "memory_mb")
+	}
+}
+
+func TestListGuests(t *testing.T) {
+	var buf bytes.Buffer
+	if err := listGuests(&buf); err != nil {
+		t.Fatalf("listGuests() = %v", err)
+	}
+	for _, name := range []string{"windows-arm64-10", "windows-arm64-11", "linux-arm64"} {
+		if !strings.Contains(buf.String(), name) {
+			t.Errorf("listGuests() = %q, wanted it to list %s", buf.String(), name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// vncBasePort is the TCP port of VNC display 0.
+	vncBasePort = 5900
+
+	// rdpGuestPort is the TCP port of Remote Desktop in Windows
+	// guests.
+	rdpGuestPort = 3389
+	// rdpHostPort is the first host port -forward-rdp tries.
+	rdpHostPort = 13389
+
+	// maxPortSearch is the number of ports after a configured port
+	// that allocatePorts tries before giving up.
+	maxPortSearch = 1000
+)
+
+// portFree reports whether addr can be listened on with network,
+// which is "tcp" or "udp".
+func portFree(network, addr string) bool {
+	if network == "udp" {
+		c, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// portAllocator finds free host ports, as reported by isFree, that
+// it has not already handed out.
+type portAllocator struct {
+	isFree  func(network, addr string) bool
+	claimed map[string]bool
+}
+
+func newPortAllocator(isFree func(network, addr string) bool) *portAllocator {
+	return &portAllocator{isFree: isFree, claimed: make(map[string]bool)}
+}
+
+// claim marks port on host as handed out.
+func (a *portAllocator) claim(network, host string, port int) {
+	a.claimed[network+" "+net.JoinHostPort(host, strconv.Itoa(port))] = true
+}
+
+// find returns the first free port on host at or above start, and
+// claims it.
+func (a *portAllocator) find(network, host string, start int) (int, error) {
+	for p := start; p < start+maxPortSearch && p <= 65535; p++ {
+		addr := net.JoinHostPort(host, strconv.Itoa(p))
+		if a.claimed[network+" "+addr] || !a.isFree(network, addr) {
+			continue
+		}
+		a.claimed[network+" "+addr] = true
+		return p, nil
+	}
+	return 0, fmt.Errorf("no free %s port on %q at or above %d", network, host, start)
+}
+
+// allocatePorts replaces the forwarded host ports and VNC displays of
+// insts with free ones, as reported by isFree, so that instances do
+// not collide with each other or with other processes on the host.
+//
+// Each port is searched for upwards from its configured value, so
+// that allocations are stable across restarts of an otherwise idle
+// host. An instance's healthz URL follows its forwarded port if the
+// two matched.
+func allocatePorts(insts []*instance, isFree func(network, addr string) bool) error {
+	a := newPortAllocator(isFree)
+	for _, in := range insts {
+		c := in.cfg
+		for i, pf := range c.Network.PortForwards {
+			network := pf.network()
+			p, err := a.find(network, "", pf.HostPort)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.name, err)
+			}
+			c.Network.PortForwards[i].HostPort = p
+			if network == "tcp" {
+				u, err := replaceURLPort(in.healthzURL, pf.HostPort, p)
+				if err != nil {
+					return fmt.Errorf("%s: %w", in.name, err)
+				}
+				in.healthzURL = u
+			}
+		}
+		if c.VNC != "" {
+			host, d, opts, err := splitVNC(c.VNC)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.name, err)
+			}
+			p, err := a.find("tcp", host, vncBasePort+d)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.name, err)
+			}
+			c.VNC = fmt.Sprintf("%s:%d%s", host, p-vncBasePort, opts)
+		}
+		in.logger.Info("Allocated ports", "port_forwards", c.Network.PortForwards, "vnc", c.VNC, "healthz_url", in.healthzURL, "rdp_port", rdpPort(c))
+	}
+	return nil
+}
+
+// addRDPForward adds a forward from rdpHostPort to the guest's RDP
+// port to c, unless it already forwards a host port there.
+func addRDPForward(c *vmConfig) error {
+	if c.isVZ() {
+		return fmt.Errorf("backend vz does not support port forwards; connect to the guest's RDP port %d directly", rdpGuestPort)
+	}
+	if isVMNet(c.Network.Backend) {
+		return fmt.Errorf("network backend %s does not support port forwards; connect to the guest's RDP port %d directly", c.Network.Backend, rdpGuestPort)
+	}
+	if rdpPort(c) != 0 {
+		return nil
+	}
+	c.Network.PortForwards = append(c.Network.PortForwards, portForward{Protocol: "tcp", HostPort: rdpHostPort, GuestPort: rdpGuestPort})
+	return nil
+}
+
+// allocateRDPPorts replaces the host ports forwarded to the RDP port of
+// insts with free ones, as reported by isFree, leaving their other
+// forwarded ports as configured.
+func allocateRDPPorts(insts []*instance, isFree func(network, addr string) bool) error {
+	a := newPortAllocator(isFree)
+	for _, in := range insts {
+		for _, pf := range in.cfg.Network.PortForwards {
+			if !pf.isRDP() {
+				a.claim(pf.network(), "", pf.HostPort)
+			}
+		}
+	}
+	for _, in := range insts {
+		for i, pf := range in.cfg.Network.PortForwards {
+			if !pf.isRDP() {
+				continue
+			}
+			p, err := a.find("tcp", "", pf.HostPort)
+			if err != nil {
+				return fmt.Errorf("%s: %w", in.name, err)
+			}
+			in.cfg.Network.PortForwards[i].HostPort = p
+			in.logger.Info("Forwarding RDP", "rdp_port", p)
+		}
+	}
+	return nil
+}
+
+// rdpPort returns the host port c forwards to the guest's RDP port, or
+// 0 if there is none.
+func rdpPort(c *vmConfig) int {
+	for _, pf := range c.Network.PortForwards {
+		if pf.isRDP() {
+			return pf.HostPort
+		}
+	}
+	return 0
+}
+
+// replaceURLPort returns rawURL with its port replaced by to, if it
+// is from. URLs with other ports are returned unmodified.
+func replaceURLPort(rawURL string, from, to int) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() != strconv.Itoa(from) {
+		return rawURL, nil
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(to))
+	return u.String(), nil
+}
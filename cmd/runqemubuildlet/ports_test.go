@@ -0,0 +1,103 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"testing"
+)
+
+func TestAllocatePorts(t *testing.T) {
+	// Port 8080 and VNC display 3 are taken by another process.
+	busy := map[string]bool{
+		"tcp :8080": true,
+		"tcp :5903": true,
+	}
+	isFree := func(network, addr string) bool { return !busy[network+" "+addr] }
+
+	cfg := windows10Config("/base")
+	insts, err := newInstances(cfg, "http://localhost:8080/healthz", 2, 1)
+	if err != nil {
+		t.Fatalf("newInstances() = _, %v, wanted no error", err)
+	}
+	if err := allocatePorts(insts, isFree); err != nil {
+		t.Fatalf("allocatePorts() = %v, wanted no error", err)
+	}
+	cases := []struct {
+		hostPort   int
+		vnc        string
+		healthzURL string
+	}{
+		{8081, ":4", "http://localhost:8081/healthz"},
+		// Instance 1 starts at port 8081 and display 4, which
+		// instance 0 has claimed.
+		{8082, ":5", "http://localhost:8082/healthz"},
+	}
+	for i, c := range cases {
+		in := insts[i]
+		if got := in.cfg.Network.PortForwards[0].HostPort; got != c.hostPort {
+			t.Errorf("insts[%d] host port = %d, wanted %d", i, got, c.hostPort)
+		}
+		if in.cfg.VNC != c.vnc {
+			t.Errorf("insts[%d].cfg.VNC = %q, wanted %q", i, in.cfg.VNC, c.vnc)
+		}
+		if in.healthzURL != c.healthzURL {
+			t.Errorf("insts[%d].healthzURL = %q, wanted %q", i, in.healthzURL, c.healthzURL)
+		}
+	}
+}
+
+func TestAllocateRDPPorts(t *testing.T) {
+	// Port 13389 is taken by another process, and the instances
+	// forward ports 13390 and 13391 to SSH.
+	busy := map[string]bool{"tcp :13389": true}
+	isFree := func(network, addr string) bool { return !busy[network+" "+addr] }
+
+	cfg := windows10Config("/base")
+	cfg.Network.PortForwards = append(cfg.Network.PortForwards, portForward{HostPort: 13390, GuestPort: 22})
+	if err := addRDPForward(cfg); err != nil {
+		t.Fatalf("addRDPForward() = %v, wanted no error", err)
+	}
+	insts, err := newInstances(cfg, "http://localhost:8080/healthz", 2, 1)
+	if err != nil {
+		t.Fatalf("newInstances() = _, %v, wanted no error", err)
+	}
+	if err := allocateRDPPorts(insts, isFree); err != nil {
+		t.Fatalf("allocateRDPPorts() = %v, wanted no error", err)
+	}
+	for i, want := range []int{13392, 13393} {
+		if got := rdpPort(insts[i].cfg); got != want {
+			t.Errorf("rdpPort(insts[%d].cfg) = %d, wanted %d", i, got, want)
+		}
+		if got := insts[i].cfg.Network.PortForwards[0].HostPort; got != 8080+i {
+			t.Errorf("insts[%d] host port = %d, wanted %d", i, got, 8080+i)
+		}
+	}
+
+	cfg.Network.Backend = "vmnet-shared"
+	if err := addRDPForward(cfg); err == nil {
+		t.Errorf("addRDPForward() with vmnet = nil, wanted error")
+	}
+}
+
+func TestReplaceURLPort(t *testing.T) {
+	cases := []struct {
+		url      string
+		from, to int
+		want     string
+	}{
+		{"http://localhost:8080/healthz", 8080, 8081, "http://localhost:8081/healthz"},
+		{"http://localhost:9000/healthz", 8080, 8081, "http://localhost:9000/healthz"},
+		{"http://[::1]:8080/", 8080, 8085, "http://[::1]:8085/"},
+	}
+	for _, c := range cases {
+		got, err := replaceURLPort(c.url, c.from, c.to)
+		if err != nil || got != c.want {
+			t.Errorf("replaceURLPort(%q, %d, %d) = %q, %v, wanted %q", c.url, c.from, c.to, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// hostFacts describes the host for preflight checks.
+type hostFacts struct {
+	accel      string // as returned by hostAccel
+	memoryMB   int    // zero if unknown
+	freeDiskMB func(path string) (int, error)
+	vmnet      bool // whether QEMU's vmnet network backends are available
+	vz         bool // whether the Virtualization framework is available
+	// qemuVersion returns the version of the QEMU binary of a
+	// config. If nil, the version is not checked.
+	qemuVersion func(c *vmConfig) (qemuVersion, error)
+}
+
+// currentHost returns the hostFacts of this host.
+func currentHost() hostFacts {
+	mem, _ := hostMemoryMB()
+	return hostFacts{accel: hostAccel(), memoryMB: mem, freeDiskMB: hostFreeDiskMB, vmnet: runtime.GOOS == "darwin", vz: runtime.GOOS == "darwin", qemuVersion: installedQEMUVersion}
+}
+
+// preflight checks that n VMs described by c can be started on host:
+// that QEMU and its libraries, or vfkit, firmware, and disk images
+// exist, that a hardware accelerator required by c is available, and
+// that there is enough memory and free disk space in scratchDir, where
+// QEMU writes snapshots or overlays. The QEMU binary must be at least
+// version minQEMU, and 7.1 for the vmnet network backends.
+//
+// It returns an error listing every problem found, so that they can
+// be fixed at once rather than surfacing one at a time as QEMU exits.
+func preflight(c *vmConfig, n int, host hostFacts, scratchDir string, minFreeDiskMB int, minQEMU qemuVersion) error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	exists := func(what, p string) {
+		if p == "" {
+			return
+		}
+		if _, err := os.Stat(c.path(p)); err != nil {
+			addf("%s: %v", what, err)
+		}
+	}
+
+	if c.isVZ() {
+		if !host.vz {
+			addf("backend: vz is only available on macOS")
+		}
+		if _, err := exec.LookPath(c.vzBinary()); err != nil {
+			addf("vfkit: %v", err)
+		}
+		exists("vz kernel", c.VZ.Kernel)
+		exists("vz initrd", c.VZ.Initrd)
+	} else if _, err := exec.LookPath(c.path(c.QEMU)); err != nil {
+		addf("qemu: %v", err)
+	} else if host.qemuVersion != nil {
+		switch v, err := host.qemuVersion(c); {
+		case err != nil:
+			addf("qemu: %v", err)
+		case v.less(minQEMU):
+			addf("qemu: version %v is older than the minimum supported version %v", v, minQEMU)
+		case isVMNet(c.Network.Backend) && v.less(vmnetQEMUVersion):
+			addf("qemu: version %v does not support network backend %s, which requires %v", v, c.Network.Backend, vmnetQEMUVersion)
+		default:
+			slog.Info("Found QEMU", "path", c.path(c.QEMU), "version", v)
+		}
+	}
+	exists("qemu data dir", c.DataDir)
+	exists("library path", c.LibraryPath)
+	exists("bios", c.BIOS)
+	if c.Firmware != nil {
+		exists("firmware code", c.Firmware.Code)
+		exists("firmware vars", c.Firmware.Vars)
+	}
+	for _, d := range c.Drives {
+		exists(fmt.Sprintf("drive %s", d.ID), d.File)
+	}
+	if c.TPM != nil {
+		bin := c.TPM.Binary
+		if bin == "" {
+			bin = "swtpm"
+		}
+		if _, err := exec.LookPath(bin); err != nil {
+			addf("tpm: %v", err)
+		}
+	}
+	for _, sh := range c.Shares {
+		exists(fmt.Sprintf("share %s", sh.Tag), sh.Path)
+		if sh.Type == shareVirtiofs && !c.isVZ() {
+			if _, err := exec.LookPath(sh.virtiofsd()); err != nil {
+				addf("share %s: %v", sh.Tag, err)
+			}
+		}
+	}
+	if c.Provision != nil {
+		exists("provision key file", c.Provision.KeyFile)
+	}
+	if c.CloudInit != nil {
+		exists("cloud-init buildlet", c.CloudInit.Buildlet)
+		exists("cloud-init key file", c.CloudInit.KeyFile)
+	}
+
+	if isVMNet(c.Network.Backend) && !c.isVZ() {
+		switch {
+		case !host.vmnet:
+			addf("network: backend %s is only available on macOS", c.Network.Backend)
+		case os.Geteuid() != 0:
+			// QEMU may instead be signed with the
+			// com.apple.vm.networking entitlement, so this is
+			// not fatal.
+			slog.Warn("vmnet network backends require root unless QEMU is entitled", "backend", c.Network.Backend)
+		}
+	}
+	if err := checkAccel(c.Accel, host.accel); err != nil {
+		addf("accel: %v", err)
+	}
+
+	if host.memoryMB > 0 && c.MemoryMB > 0 {
+		if need := c.MemoryMB * n; need > host.memoryMB-reservedMemoryMB {
+			addf("memory: %d VMs * %d MiB = %d MiB exceeds host memory of %d MiB less %d MiB reserved for the host",
+				n, c.MemoryMB, need, host.memoryMB, reservedMemoryMB)
+		}
+	}
+	if minFreeDiskMB > 0 && host.freeDiskMB != nil {
+		// Failing to determine free space is not fatal: the host
+		// may simply not support it.
+		if free, err := host.freeDiskMB(scratchDir); err == nil && free < minFreeDiskMB {
+			addf("disk: %d MiB free in %s, wanted at least %d MiB", free, scratchDir, minFreeDiskMB)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("pre-flight checks failed:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// checkAccel returns an error if none of the accelerators in accels is
+// usable on a host whose hardware accelerator is host. tcg, and
+// accelAuto on a host without hardware acceleration, are always
+// usable, since accelAuto is then dropped and QEMU defaults to tcg.
+func checkAccel(accels []string, host string) error {
+	if len(accels) == 0 {
+		return nil
+	}
+	var missing []string
+	for _, a := range accels {
+		name := a
+		if i := strings.Index(a, ","); i >= 0 {
+			name = a[:i]
+		}
+		switch {
+		case name == accelAuto, name == "tcg", name == host:
+			return nil
+		}
+		missing = append(missing, name)
+	}
+	if host == "" {
+		return fmt.Errorf("%s not available: host has no hardware acceleration", strings.Join(missing, ", "))
+	}
+	return fmt.Errorf("%s not available: host supports %s", strings.Join(missing, ", "), host)
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"qemu", "disk.qcow2"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	good := func() *vmConfig {
+		return &vmConfig{
+			Base:     dir,
+			QEMU:     "qemu",
+			MemoryMB: 4096,
+			Accel:    []string{"hvf"},
+			Drives:   []driveConfig{{ID: "hd0", File: "disk.qcow2"}},
+		}
+	}
+	host := hostFacts{
+		accel:      "hvf",
+		memoryMB:   16384,
+		freeDiskMB: func(string) (int, error) { return 20000, nil },
+	}
+
+	cases := []struct {
+		desc   string
+		modify func(c *vmConfig, h *hostFacts)
+		n      int
+		want   []string // substrings of the error; none if nil
+	}{
+		{desc: "ok", n: 2},
+		{
+			desc:   "missing files",
+			modify: func(c *vmConfig, h *hostFacts) { c.QEMU = "nope"; c.Drives[0].File = "missing.qcow2" },
+			n:      1,
+			want:   []string{"qemu:", "drive hd0:"},
+		},
+		{
+			desc:   "no hvf",
+			modify: func(c *vmConfig, h *hostFacts) { h.accel = "" },
+			n:      1,
+			want:   []string{"hvf not available"},
+		},
+		{
+			desc:   "tcg fallback",
+			modify: func(c *vmConfig, h *hostFacts) { h.accel = ""; c.Accel = []string{"hvf", "tcg,tb-size=1536"} },
+			n:      1,
+		},
+		{
+			desc:   "vmnet",
+			modify: func(c *vmConfig, h *hostFacts) { c.Network.Backend = "vmnet-shared" },
+			n:      1,
+			want:   []string{"network: backend vmnet-shared is only available on macOS"},
+		},
+		{desc: "memory", n: 4, want: []string{"memory: 4 VMs"}},
+		{
+			desc:   "old qemu",
+			modify: func(c *vmConfig, h *hostFacts) { h.qemuVersion = fixedQEMUVersion(5, 2, 0) },
+			n:      1,
+			want:   []string{"qemu: version 5.2.0 is older than the minimum supported version 6.0.0"},
+		},
+		{
+			desc: "vmnet old qemu",
+			modify: func(c *vmConfig, h *hostFacts) {
+				h.vmnet = true
+				h.qemuVersion = fixedQEMUVersion(7, 0, 0)
+				c.Network.Backend = "vmnet-shared"
+			},
+			n:    1,
+			want: []string{"requires 7.1.0"},
+		},
+		{
+			desc:   "disk",
+			modify: func(c *vmConfig, h *hostFacts) { h.freeDiskMB = func(string) (int, error) { return 100, nil } },
+			n:      1,
+			want:   []string{"disk: 100 MiB free"},
+		},
+	}
+	for _, c := range cases {
+		cfg, h := good(), host
+		if c.modify != nil {
+			c.modify(cfg, &h)
+		}
+		err := preflight(cfg, c.n, h, os.TempDir(), 10240, qemuVersion{6, 0, 0})
+		if len(c.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: preflight() = %v, wanted no error", c.desc, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: preflight() = nil, wanted error containing %q", c.desc, c.want)
+			continue
+		}
+		for _, w := range c.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%s: preflight() = %v, wanted error containing %q", c.desc, err, w)
+			}
+		}
+	}
+}
+
+// fixedQEMUVersion returns a hostFacts.qemuVersion reporting
+// major.minor.micro.
+func fixedQEMUVersion(major, minor, micro int) func(*vmConfig) (qemuVersion, error) {
+	return func(*vmConfig) (qemuVersion, error) {
+		return qemuVersion{major, minor, micro}, nil
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import "time"
+
+// probeResult is the result of a heartbeat probe of a VM's health
+// checks, as reported in /status.
+type probeResult struct {
+	Time time.Time `json:"time"`
+	// RunID is the run of the VM probed, so that results from before
+	// a recycle can be told apart.
+	RunID   string `json:"run_id"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// probeHistory is a ring buffer of the most recent probe results.
+type probeHistory struct {
+	buf  []probeResult
+	next int  // index in buf of the next result to add
+	full bool // whether buf has wrapped around
+}
+
+// newProbeHistory returns a probeHistory keeping the last n results.
+// It keeps none if n is not positive.
+func newProbeHistory(n int) *probeHistory {
+	if n < 0 {
+		n = 0
+	}
+	return &probeHistory{buf: make([]probeResult, n)}
+}
+
+// add records r, replacing the oldest result if the history is full.
+func (h *probeHistory) add(r probeResult) {
+	if len(h.buf) == 0 {
+		return
+	}
+	h.buf[h.next] = r
+	h.next++
+	if h.next == len(h.buf) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// results returns a copy of the results, oldest first.
+func (h *probeHistory) results() []probeResult {
+	if !h.full {
+		return append([]probeResult(nil), h.buf[:h.next]...)
+	}
+	return append(append([]probeResult(nil), h.buf[h.next:]...), h.buf[:h.next]...)
+}
+
+// recordProbe records the result of a probe of the run logged by lg
+// at t, which took d and returned err.
+func (in *instance) recordProbe(lg *runLogger, t time.Time, d time.Duration, err error) {
+	r := probeResult{Time: t, RunID: lg.id, Latency: d.Round(time.Millisecond).String()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.probes.add(r)
+}
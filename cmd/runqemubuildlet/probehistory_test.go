@@ -0,0 +1,42 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProbeHistory(t *testing.T) {
+	cases := []struct {
+		size int
+		adds int
+		want []string
+	}{
+		{size: 3, adds: 0, want: nil},
+		{size: 3, adds: 2, want: []string{"0", "1"}},
+		{size: 3, adds: 3, want: []string{"0", "1", "2"}},
+		{size: 3, adds: 7, want: []string{"4", "5", "6"}},
+		{size: 0, adds: 2, want: nil},
+	}
+	for _, c := range cases {
+		h := newProbeHistory(c.size)
+		for i := 0; i < c.adds; i++ {
+			h.add(probeResult{RunID: strconv.Itoa(i)})
+		}
+		var got []string
+		for _, r := range h.results() {
+			got = append(got, r.RunID)
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("newProbeHistory(%d) after %d adds: results() mismatch (-want +got):\n%s", c.size, c.adds, diff)
+		}
+	}
+}
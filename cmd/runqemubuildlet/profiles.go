@@ -0,0 +1,213 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// guestPreset is a built-in VM definition.
+type guestPreset struct {
+	// desc describes the guest, for -list-guests.
+	desc string
+	// config returns the VM definition, rooted at the directory set
+	// by the guest's path flag.
+	config func() *vmConfig
+}
+
+// guestProfiles are the built-in VM definitions selectable with
+// -guest.
+var guestProfiles = map[string]guestPreset{
+	"windows-arm64-10": {
+		desc:   "Windows 10 on ARM with UTM's QEMU, in -windows-10-path",
+		config: func() *vmConfig { return windows10Config(*windows10Path) },
+	},
+	"windows-arm64-11": {
+		desc:   "Windows 11 on ARM with UEFI secure boot and a TPM, in -windows-11-path",
+		config: func() *vmConfig { return windows11Config(*windows11Path) },
+	},
+	"linux-arm64": {
+		desc:   "Linux cloud image provisioned with cloud-init, in -linux-path",
+		config: func() *vmConfig { return linuxARM64Config(*linuxPath) },
+	},
+}
+
+// guestNames returns the names of guestProfiles, sorted.
+func guestNames() []string {
+	var names []string
+	for n := range guestProfiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// guestProfile returns the built-in VM definition named name.
+func guestProfile(name string) (*vmConfig, error) {
+	p, ok := guestProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown guest %q, wanted one of: %s", name, strings.Join(guestNames(), ", "))
+	}
+	return p.config(), nil
+}
+
+// listGuests writes a table of guestProfiles to w.
+func listGuests(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCPUS\tMEMORY\tDESCRIPTION")
+	for _, name := range guestNames() {
+		p := guestProfiles[name]
+		c := p.config()
+		fmt.Fprintf(tw, "%s\t%d\t%d MiB\t%s\n", name, c.CPUs, c.MemoryMB, p.desc)
+	}
+	return tw.Flush()
+}
+
+// windows10Config returns the built-in configuration for running a
+// Windows 10 VM on an M1 Mac mini, rooted at base.
+//
+// base should contain the Windows VM image, and UTM components
+// (UTM.app and sysroot-macos-arm64).
+func windows10Config(base string) *vmConfig {
+	return &vmConfig{
+		Name:        "Virtual Machine",
+		Base:        base,
+		QEMU:        "sysroot-macos-arm64/bin/qemu-system-aarch64",
+		DataDir:     "UTM.app/Contents/Resources/qemu",
+		LibraryPath: "sysroot-macos-arm64/lib",
+		CPU:         "max",
+		CPUs:        8, // This works well with M1 Mac Minis.
+		MemoryMB:    12288,
+		Machine:     "virt,highmem=off",
+		Accel:       []string{accelAuto, "tcg,tb-size=1536"},
+		Boot:        "menu=on",
+		BIOS:        "Images/QEMU_EFI.fd",
+		Devices: []string{
+			"qemu-xhci,id=usb-bus",
+			"ramfb",
+			"usb-tablet,bus=usb-bus.0",
+			"usb-mouse,bus=usb-bus.0",
+			"usb-kbd,bus=usb-bus.0",
+		},
+		Network: networkConfig{
+			Device:       "virtio-net-pci",
+			PortForwards: []portForward{{Protocol: "tcp", HostPort: 8080, GuestPort: 8080}},
+		},
+		Drives: []driveConfig{
+			{
+				ID:            "drive0",
+				File:          "Images/win10.qcow2",
+				Media:         "disk",
+				Cache:         cacheAuto,
+				Device:        "nvme",
+				DeviceOptions: "serial=drive0,bootindex=0",
+			},
+			{
+				ID:            "drive2",
+				File:          "Images/virtio.iso",
+				Media:         "cdrom",
+				Cache:         cacheAuto,
+				Device:        "usb-storage",
+				DeviceOptions: "removable=true,bootindex=1",
+			},
+		},
+		RNG:      true,
+		Snapshot: true, // critical to avoid saving state between runs.
+		VNC:      ":3",
+	}
+}
+
+// windows11Config returns the built-in configuration for running a
+// Windows 11 VM on an M1 Mac mini, rooted at base.
+//
+// Windows 11 refuses to install or boot without a TPM 2.0 and secure
+// boot capable firmware, so in addition to the components needed by
+// windows10Config, swtpm must be installed, and base must contain a
+// UEFI variable store (Images/efi_vars.fd) the same size as UTM's
+// edk2-aarch64-secure-code.fd.
+func windows11Config(base string) *vmConfig {
+	c := windows10Config(base)
+	c.BIOS = ""
+	c.Firmware = &firmwareConfig{
+		Code: "UTM.app/Contents/Resources/qemu/edk2-aarch64-secure-code.fd",
+		Vars: "Images/efi_vars.fd",
+	}
+	c.TPM = &tpmConfig{
+		Binary:   *swtpmPath,
+		StateDir: "tpm",
+	}
+	// Windows 11 does not need a USB mouse alongside the tablet, and
+	// the virtio driver ISO is only needed during installation.
+	c.Devices = []string{
+		"qemu-xhci,id=usb-bus",
+		"ramfb",
+		"usb-tablet,bus=usb-bus.0",
+		"usb-kbd,bus=usb-bus.0",
+	}
+	c.Drives = []driveConfig{
+		{
+			ID:            "drive0",
+			File:          "Images/win11.qcow2",
+			Media:         "disk",
+			Cache:         cacheAuto,
+			Device:        "nvme",
+			DeviceOptions: "serial=drive0,bootindex=0",
+		},
+	}
+	return c
+}
+
+// linuxARM64Config returns the built-in configuration for running a
+// headless Linux VM on an M1 Mac mini, rooted at base.
+//
+// base should contain a cloud image with cloud-init installed
+// (Images/linux-arm64.qcow2), a linux-arm64 buildlet binary and its
+// builder key, and the same UTM components as windows10Config. The
+// buildlet and key are injected into the guest with a cloud-init seed
+// ISO generated for each run.
+func linuxARM64Config(base string) *vmConfig {
+	return &vmConfig{
+		Name:        "linux-arm64",
+		Base:        base,
+		QEMU:        "sysroot-macos-arm64/bin/qemu-system-aarch64",
+		DataDir:     "UTM.app/Contents/Resources/qemu",
+		LibraryPath: "sysroot-macos-arm64/lib",
+		CPU:         "max",
+		CPUs:        4,
+		MemoryMB:    8192,
+		Machine:     "virt,highmem=off",
+		Accel:       []string{accelAuto, "tcg,tb-size=1536"},
+		BIOS:        "Images/QEMU_EFI.fd",
+		Network: networkConfig{
+			Device:       "virtio-net-pci",
+			PortForwards: []portForward{{Protocol: "tcp", HostPort: 8080, GuestPort: 8080}},
+		},
+		Drives: []driveConfig{
+			{
+				ID:     "drive0",
+				File:   "Images/linux-arm64.qcow2",
+				Media:  "disk",
+				Format: "qcow2",
+				Cache:  cacheAuto,
+				Device: "virtio-blk-pci",
+			},
+		},
+		CloudInit: &cloudInitConfig{
+			Buildlet:    "buildlet.linux-arm64",
+			KeyFile:     "gobuildkey",
+			ReverseType: *linuxReverseType,
+		},
+		RNG:       true,
+		Snapshot:  true,
+		ExtraArgs: []string{"-nographic"},
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Methods of provisionConfig.
+const (
+	provisionFwCfg = "fw_cfg"
+	provisionISO   = "iso"
+)
+
+// fwCfgPrefix is the prefix of the fw_cfg names provisioned files are
+// passed as. QEMU reserves names outside of "opt/" for itself.
+const fwCfgPrefix = "opt/org.golang.build/"
+
+// provisionISOLabel is the volume label of the provisioning ISO.
+const provisionISOLabel = "GOBUILD"
+
+// provisionConfig describes credentials and metadata injected into the
+// guest at boot, so that a single golden image can be used on many
+// hosts without baking in a builder key.
+//
+// Each entry is a small file: key-REVERSE_TYPE holding the builder
+// key, reverse-type, coordinator, hostname holding the name of the
+// run, and one per Metadata key.
+type provisionConfig struct {
+	// Method is how the files are passed to the guest: "fw_cfg", the
+	// default, as QEMU firmware configuration blobs named
+	// opt/org.golang.build/NAME, or "iso", as files on an ISO
+	// labelled GOBUILD.
+	Method string `yaml:"method"`
+	// ReverseType is the reverse buildlet host type the guest
+	// registers as.
+	ReverseType string `yaml:"reverse_type"`
+	// KeyFile is the path to the builder key for ReverseType.
+	KeyFile string `yaml:"key_file"`
+	// Coordinator is the coordinator address the buildlet dials, such
+	// as farmer.golang.org:443.
+	Coordinator string `yaml:"coordinator"`
+	// Metadata are additional host-specific files, by name.
+	Metadata map[string]string `yaml:"metadata"`
+	// Device is the guest device the ISO is attached to. It defaults
+	// to usb-storage, which Windows supports without drivers, but
+	// requires a USB controller such as qemu-xhci.
+	Device string `yaml:"device"`
+}
+
+func (p *provisionConfig) validate() error {
+	switch p.Method {
+	case "", provisionFwCfg, provisionISO:
+	default:
+		return fmt.Errorf("provision method %q, wanted fw_cfg or iso", p.Method)
+	}
+	if p.KeyFile != "" && p.ReverseType == "" {
+		return errors.New("provision key_file requires reverse_type")
+	}
+	for name := range p.Metadata {
+		if name == "" || strings.ContainsAny(name, "/\\,") {
+			return fmt.Errorf("provision metadata name %q must not be empty or contain slashes or commas", name)
+		}
+	}
+	return nil
+}
+
+// provisionFiles returns the contents of the files provisioned into
+// the run named runName, by name.
+func provisionFiles(c *vmConfig, runName string) (map[string][]byte, error) {
+	p := c.Provision
+	files := map[string][]byte{"hostname": []byte(runName)}
+	for k, v := range p.Metadata {
+		files[k] = []byte(v)
+	}
+	if p.ReverseType != "" {
+		files["reverse-type"] = []byte(p.ReverseType)
+	}
+	if p.Coordinator != "" {
+		files["coordinator"] = []byte(p.Coordinator)
+	}
+	if p.KeyFile != "" {
+		key, err := ioutil.ReadFile(c.path(p.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		files["key-"+p.ReverseType] = key
+	}
+	return files, nil
+}
+
+// provision writes the files provisioned into the run of c named
+// runName to a new directory in tmp, and adds them to c according to
+// its provisioning method: as fw_cfg blobs, or on an ISO drive.
+//
+// The files are always passed by path, so that the key does not
+// appear on QEMU's command line.
+func provision(c *vmConfig, runName, tmp string) error {
+	files, err := provisionFiles(c, runName)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(tmp, "provision")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	var names []string
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if c.Provision.Method == provisionISO {
+		iso := filepath.Join(tmp, "provision.iso")
+		cmd := isoCommand(dir, iso, provisionISOLabel)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v = %w: %s", cmd, err, out)
+		}
+		dev := c.Provision.Device
+		if dev == "" {
+			dev = "usb-storage"
+		}
+		c.Drives = append(c.Drives, driveConfig{
+			ID:       "provision",
+			File:     iso,
+			Media:    "cdrom",
+			Format:   "raw",
+			ReadOnly: true,
+			Device:   dev,
+		})
+		return nil
+	}
+	for _, name := range names {
+		c.ExtraArgs = append(c.ExtraArgs, "-fw_cfg", fmt.Sprintf("name=%s%s,file=%s", fwCfgPrefix, name, qemuEscape(filepath.Join(dir, name))))
+	}
+	return nil
+}
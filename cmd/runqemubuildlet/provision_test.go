@@ -0,0 +1,86 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProvisionFwCfg(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "key"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &vmConfig{
+		Base: dir,
+		Provision: &provisionConfig{
+			ReverseType: "host-windows11-arm64",
+			KeyFile:     "key",
+			Coordinator: "farmer.golang.org:443",
+			Metadata:    map[string]string{"site": "nyc"},
+		},
+	}
+	// The run directory's comma must not end the fw_cfg file path.
+	tmp := filepath.Join(t.TempDir(), "run,1")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := provision(c, "host1-vm0-1", tmp); err != nil {
+		t.Fatalf("provision() = %v, wanted no error", err)
+	}
+	pdir := filepath.Join(tmp, "provision")
+	var want []string
+	for _, name := range []string{"coordinator", "hostname", "key-host-windows11-arm64", "reverse-type", "site"} {
+		want = append(want, "-fw_cfg", "name=opt/org.golang.build/"+name+",file="+strings.ReplaceAll(filepath.Join(pdir, name), ",", ",,"))
+	}
+	if diff := cmp.Diff(want, c.ExtraArgs); diff != "" {
+		t.Errorf("provision() args mismatch (-want +got):\n%s", diff)
+	}
+	if strings.Contains(strings.Join(c.args(), " "), "secret") {
+		t.Errorf("args() = %q, wanted the key to be passed by file", c.args())
+	}
+	for name, want := range map[string]string{
+		"key-host-windows11-arm64": "secret\n",
+		"hostname":                 "host1-vm0-1",
+		"site":                     "nyc",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(pdir, name))
+		if err != nil {
+			t.Errorf("reading provisioned %s: %v", name, err)
+			continue
+		}
+		if string(b) != want {
+			t.Errorf("provisioned %s = %q, wanted %q", name, b, want)
+		}
+	}
+}
+
+func TestProvisionValidate(t *testing.T) {
+	cases := []struct {
+		desc    string
+		p       provisionConfig
+		wantErr bool
+	}{
+		{desc: "empty", p: provisionConfig{}},
+		{desc: "iso", p: provisionConfig{Method: provisionISO, ReverseType: "t", KeyFile: "k"}},
+		{desc: "unknown method", p: provisionConfig{Method: "smbios"}, wantErr: true},
+		{desc: "key without type", p: provisionConfig{KeyFile: "k"}, wantErr: true},
+		{desc: "bad metadata name", p: provisionConfig{Metadata: map[string]string{"a/b": "c"}}, wantErr: true},
+	}
+	for _, c := range cases {
+		if err := c.p.validate(); (err != nil) != c.wantErr {
+			t.Errorf("%s: validate() = %v, wantErr: %t", c.desc, err, c.wantErr)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// qemuAuto is a vmConfig.QEMU value that is replaced with the first
+// qemu-system binary for the config's Arch found in -qemu-search-path,
+// the Homebrew prefixes, or $PATH.
+const qemuAuto = "auto"
+
+// homebrewBinDirs are where Homebrew installs QEMU on Apple silicon
+// and Intel Macs, searched after -qemu-search-path.
+var homebrewBinDirs = []string{"/opt/homebrew/bin", "/usr/local/bin"}
+
+// qemuArches maps GOARCH values to the QEMU names of those
+// architectures, where they differ.
+var qemuArches = map[string]string{
+	"arm64":   "aarch64",
+	"amd64":   "x86_64",
+	"386":     "i386",
+	"ppc64le": "ppc64",
+}
+
+var archRE = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// qemuArch returns the QEMU name of the guest architecture of c: its
+// Arch, or the host's.
+func (c *vmConfig) qemuArch() string {
+	if c.Arch != "" {
+		return c.Arch
+	}
+	if a, ok := qemuArches[runtime.GOARCH]; ok {
+		return a
+	}
+	return runtime.GOARCH
+}
+
+// resolveQEMU replaces a QEMU of qemuAuto in c with the path of the
+// first qemu-system binary for its architecture found in dirs, which
+// may be relative to c.Base, the Homebrew prefixes, or $PATH, in that
+// order, using lookPath to check each candidate.
+func resolveQEMU(c *vmConfig, dirs []string, lookPath func(string) (string, error)) error {
+	if c.isVZ() || c.QEMU != qemuAuto {
+		return nil
+	}
+	bin := "qemu-system-" + c.qemuArch()
+	var candidates []string
+	for _, d := range dirs {
+		candidates = append(candidates, filepath.Join(c.path(d), bin))
+	}
+	for _, d := range homebrewBinDirs {
+		candidates = append(candidates, filepath.Join(d, bin))
+	}
+	candidates = append(candidates, bin)
+	for _, p := range candidates {
+		if found, err := lookPath(p); err == nil {
+			c.QEMU = found
+			return nil
+		}
+	}
+	return fmt.Errorf("qemu auto: %s not found in %s, or $PATH", bin, strings.Join(append(dirs, homebrewBinDirs...), ", "))
+}
+
+// qemuVersion is a QEMU release, such as 8.2.1.
+type qemuVersion struct {
+	major, minor, micro int
+}
+
+// vmnetQEMUVersion is the first QEMU release with the vmnet network
+// backends.
+var vmnetQEMUVersion = qemuVersion{7, 1, 0}
+
+func (v qemuVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.micro)
+}
+
+// less reports whether v is an earlier release than w.
+func (v qemuVersion) less(w qemuVersion) bool {
+	if v.major != w.major {
+		return v.major < w.major
+	}
+	if v.minor != w.minor {
+		return v.minor < w.minor
+	}
+	return v.micro < w.micro
+}
+
+var qemuVersionRE = regexp.MustCompile(`(?:^|version )(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// parseQEMUVersion parses a version of the form major.minor[.micro],
+// or the first line of the output of qemu-system --version, such as
+// "QEMU emulator version 8.2.0 (Debian 1:8.2.0+ds-1)".
+func parseQEMUVersion(s string) (qemuVersion, error) {
+	m := qemuVersionRE.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return qemuVersion{}, fmt.Errorf("no QEMU version in %q", s)
+	}
+	var v qemuVersion
+	v.major, _ = strconv.Atoi(m[1])
+	v.minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v.micro, _ = strconv.Atoi(m[3])
+	}
+	return v, nil
+}
+
+// installedQEMUVersion returns the version of the QEMU binary of c,
+// as reported by its --version flag.
+func installedQEMUVersion(c *vmConfig) (qemuVersion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.path(c.QEMU), "--version")
+	cmd.Env = c.env()
+	out, err := cmd.Output()
+	if err != nil {
+		return qemuVersion{}, fmt.Errorf("%v: %w", cmd, err)
+	}
+	return parseQEMUVersion(string(out))
+}
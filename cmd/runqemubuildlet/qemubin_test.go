@@ -0,0 +1,117 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseQEMUVersion(t *testing.T) {
+	cases := []struct {
+		s       string
+		want    qemuVersion
+		wantErr bool
+	}{
+		{s: "7.1", want: qemuVersion{7, 1, 0}},
+		{s: "8.2.1", want: qemuVersion{8, 2, 1}},
+		{s: "QEMU emulator version 8.2.0 (Debian 1:8.2.0+ds-1)\nCopyright (c) 2003-2023 Fabrice Bellard\n", want: qemuVersion{8, 2, 0}},
+		{s: "QEMU emulator version 7.2.5 (v7.2.5)", want: qemuVersion{7, 2, 5}},
+		{s: "qemu", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseQEMUVersion(c.s)
+		if got != c.want || (err != nil) != c.wantErr {
+			t.Errorf("parseQEMUVersion(%q) = %v, %v, wanted %v, wantErr: %t", c.s, got, err, c.want, c.wantErr)
+		}
+	}
+}
+
+func TestQEMUVersionLess(t *testing.T) {
+	cases := []struct {
+		v, w qemuVersion
+		want bool
+	}{
+		{v: qemuVersion{6, 2, 0}, w: qemuVersion{7, 1, 0}, want: true},
+		{v: qemuVersion{7, 0, 9}, w: qemuVersion{7, 1, 0}, want: true},
+		{v: qemuVersion{7, 1, 0}, w: qemuVersion{7, 1, 0}, want: false},
+		{v: qemuVersion{8, 0, 0}, w: qemuVersion{7, 1, 0}, want: false},
+	}
+	for _, c := range cases {
+		if got := c.v.less(c.w); got != c.want {
+			t.Errorf("%v.less(%v) = %t, wanted %t", c.v, c.w, got, c.want)
+		}
+	}
+}
+
+func TestResolveQEMU(t *testing.T) {
+	installed := func(paths ...string) func(string) (string, error) {
+		return func(p string) (string, error) {
+			for _, q := range paths {
+				if p == q {
+					return p, nil
+				}
+			}
+			return "", exec.ErrNotFound
+		}
+	}
+	base := filepath.FromSlash("/base")
+	cases := []struct {
+		desc     string
+		qemu     string
+		arch     string
+		dirs     []string
+		lookPath func(string) (string, error)
+		want     string
+		wantErr  bool
+	}{
+		{
+			desc:     "explicit",
+			qemu:     "sysroot-macos-arm64/bin/qemu-system-aarch64",
+			lookPath: installed(),
+			want:     "sysroot-macos-arm64/bin/qemu-system-aarch64",
+		},
+		{
+			desc:     "sysroot first",
+			qemu:     qemuAuto,
+			arch:     "x86_64",
+			dirs:     []string{"sysroot-macos-x86_64/bin"},
+			lookPath: installed(filepath.Join(base, "sysroot-macos-x86_64/bin/qemu-system-x86_64"), filepath.Join("/opt/homebrew/bin", "qemu-system-x86_64")),
+			want:     filepath.Join(base, "sysroot-macos-x86_64/bin/qemu-system-x86_64"),
+		},
+		{
+			desc:     "homebrew",
+			qemu:     qemuAuto,
+			arch:     "aarch64",
+			lookPath: installed(filepath.Join("/usr/local/bin", "qemu-system-aarch64"), "qemu-system-aarch64"),
+			want:     filepath.Join("/usr/local/bin", "qemu-system-aarch64"),
+		},
+		{
+			desc:     "path",
+			qemu:     qemuAuto,
+			arch:     "riscv64",
+			lookPath: installed("qemu-system-riscv64"),
+			want:     "qemu-system-riscv64",
+		},
+		{
+			desc:     "missing",
+			qemu:     qemuAuto,
+			arch:     "aarch64",
+			lookPath: installed(),
+			wantErr:  true,
+		},
+	}
+	for _, c := range cases {
+		cfg := &vmConfig{Base: base, QEMU: c.qemu, Arch: c.arch}
+		err := resolveQEMU(cfg, c.dirs, c.lookPath)
+		if (err != nil) != c.wantErr || (!c.wantErr && cfg.QEMU != c.want) {
+			t.Errorf("%s: resolveQEMU() = %v, QEMU %q, wanted %q, wantErr: %t", c.desc, err, cfg.QEMU, c.want, c.wantErr)
+		}
+	}
+}
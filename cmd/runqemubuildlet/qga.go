@@ -0,0 +1,97 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// guestAgentTimeout is the maximum time to wait for a qemu-guest-agent
+// health check to complete.
+const guestAgentTimeout = 10 * time.Second
+
+// qgaInfo is the result of the guest-info command.
+type qgaInfo struct {
+	Version string `json:"version"`
+}
+
+// dialQGA connects to the qemu-guest-agent unix socket at path.
+//
+// The guest agent speaks the same JSON protocol as QMP, without a
+// greeting or capabilities negotiation. Since a previous client may
+// have left unread responses in the channel, dialQGA synchronizes the
+// connection with guest-sync before returning.
+func dialQGA(ctx context.Context, path string) (*qmpClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	q := &qmpClient{conn: conn, dec: json.NewDecoder(bufio.NewReader(conn))}
+	if err := q.guestSync(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// guestSync sends guest-sync with a random ID, and discards responses
+// until the agent echoes it back.
+func (q *qmpClient) guestSync(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		q.conn.SetDeadline(deadline)
+		defer q.conn.SetDeadline(time.Time{})
+	}
+	id := rand.Int63n(1 << 31)
+	req := map[string]interface{}{
+		"execute":   "guest-sync",
+		"arguments": map[string]int64{"id": id},
+	}
+	if err := json.NewEncoder(q.conn).Encode(req); err != nil {
+		return err
+	}
+	for {
+		var m qmpMessage
+		if err := q.dec.Decode(&m); err != nil {
+			return fmt.Errorf("guest-sync: %w", err)
+		}
+		var got int64
+		if m.Return != nil && json.Unmarshal(m.Return, &got) == nil && got == id {
+			return nil
+		}
+	}
+}
+
+// checkGuestAgent pings the qemu-guest-agent listening on the unix
+// socket at path, and returns its version. It returns an error if the
+// agent does not respond before guestAgentTimeout has elapsed.
+func checkGuestAgent(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, guestAgentTimeout)
+	defer cancel()
+	q, err := dialQGA(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer q.Close()
+	if err := q.execute(ctx, "guest-ping", nil, nil); err != nil {
+		return "", err
+	}
+	var info qgaInfo
+	if err := q.execute(ctx, "guest-info", nil, &info); err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
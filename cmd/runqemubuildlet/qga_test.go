@@ -0,0 +1,98 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveFakeQGA serves the qemu-guest-agent protocol on a unix socket
+// and returns its path. Like a real agent, it leaves a stale response
+// from a previous client in the channel before the first command. Its
+// clock is an hour behind the host's.
+func serveFakeQGA(t *testing.T, version string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "qga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "qga.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"return": 12345}`)
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			var req struct {
+				Execute   string          `json:"execute"`
+				Arguments json.RawMessage `json:"arguments"`
+			}
+			if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+				return
+			}
+			switch req.Execute {
+			case "guest-sync":
+				var args struct {
+					ID int64 `json:"id"`
+				}
+				json.Unmarshal(req.Arguments, &args)
+				fmt.Fprintf(conn, "{\"return\": %d}\n", args.ID)
+			case "guest-ping":
+				fmt.Fprintln(conn, `{"return": {}}`)
+			case "guest-get-time":
+				fmt.Fprintf(conn, "{\"return\": %d}\n", time.Now().Add(-time.Hour).UnixNano())
+			case "guest-set-time":
+				fmt.Fprintln(conn, `{"return": {}}`)
+			case "guest-info":
+				fmt.Fprintf(conn, "{\"return\": {\"version\": %q, \"supported_commands\": []}}\n", version)
+			default:
+				fmt.Fprintln(conn, `{"error": {"class": "CommandNotFound", "desc": "unknown"}}`)
+			}
+		}
+	}()
+	return path
+}
+
+func TestCheckGuestAgent(t *testing.T) {
+	path := serveFakeQGA(t, "5.2.0")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got, err := checkGuestAgent(ctx, path)
+	if err != nil {
+		t.Fatalf("checkGuestAgent(_, %q) = _, %v, wanted no error", path, err)
+	}
+	if got != "5.2.0" {
+		t.Errorf("checkGuestAgent(_, %q) = %q, wanted %q", path, got, "5.2.0")
+	}
+}
+
+func TestCheckGuestAgentNotListening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qga.sock")
+	if _, err := checkGuestAgent(context.Background(), path); err == nil {
+		t.Errorf("checkGuestAgent(_, %q) = _, nil, wanted error", path)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// qmpTimeout is the maximum time to wait for a QMP command to
+// complete.
+const qmpTimeout = 10 * time.Second
+
+// qmpClient is a minimal client for the QEMU Machine Protocol.
+//
+// See https://qemu.readthedocs.io/en/latest/interop/qmp-spec.html.
+type qmpClient struct {
+	mu   sync.Mutex // serializes commands
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// qmpMessage is a message received from QEMU. Exactly one of Greeting,
+// Return, Error, or Event is set.
+type qmpMessage struct {
+	Greeting json.RawMessage `json:"QMP"`
+	Return   json.RawMessage `json:"return"`
+	Error    *qmpError       `json:"error"`
+	Event    string          `json:"event"`
+}
+
+// qmpError is an error returned by QEMU in response to a command.
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+// qmpStatus is the result of the query-status command.
+type qmpStatus struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// dialQMP connects to the QMP unix socket at path, and negotiates
+// capabilities so that the connection is ready for commands.
+func dialQMP(ctx context.Context, path string) (*qmpClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	q := &qmpClient{conn: conn, dec: json.NewDecoder(bufio.NewReader(conn))}
+	if err := q.handshake(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *qmpClient) handshake(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		q.conn.SetDeadline(deadline)
+		defer q.conn.SetDeadline(time.Time{})
+	}
+	var greeting qmpMessage
+	if err := q.dec.Decode(&greeting); err != nil {
+		return fmt.Errorf("reading QMP greeting: %w", err)
+	}
+	if greeting.Greeting == nil {
+		return errors.New("qmp: server did not send a greeting")
+	}
+	return q.execute(ctx, "qmp_capabilities", nil, nil)
+}
+
+// Close closes the connection to QEMU.
+func (q *qmpClient) Close() error {
+	return q.conn.Close()
+}
+
+// execute runs the QMP command cmd with args, and decodes its return
+// value into result, if non-nil. Asynchronous events received while
+// waiting for the response are discarded.
+func (q *qmpClient) execute(ctx context.Context, cmd string, args interface{}, result interface{}) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		q.conn.SetDeadline(deadline)
+		defer q.conn.SetDeadline(time.Time{})
+	}
+	req := struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+	}{cmd, args}
+	if err := json.NewEncoder(q.conn).Encode(req); err != nil {
+		return err
+	}
+	for {
+		var m qmpMessage
+		if err := q.dec.Decode(&m); err != nil {
+			return err
+		}
+		switch {
+		case m.Event != "":
+			continue
+		case m.Error != nil:
+			return m.Error
+		case m.Return != nil:
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(m.Return, result)
+		}
+	}
+}
+
+// queryStatus returns the run state of the VM.
+func (q *qmpClient) queryStatus(ctx context.Context) (qmpStatus, error) {
+	var s qmpStatus
+	err := q.execute(ctx, "query-status", nil, &s)
+	return s, err
+}
+
+// systemPowerdown requests an ACPI shutdown of the guest. The guest
+// may take some time to shut down, or ignore the request entirely.
+func (q *qmpClient) systemPowerdown(ctx context.Context) error {
+	return q.execute(ctx, "system_powerdown", nil, nil)
+}
+
+// screendump saves a screenshot of the VM's display to filename on
+// the host, in format, which is "png" or "ppm". QEMU versions before
+// 7.1 only support "ppm".
+func (q *qmpClient) screendump(ctx context.Context, filename, format string) error {
+	args := map[string]string{"filename": filename}
+	if format != "ppm" {
+		args["format"] = format
+	}
+	return q.execute(ctx, "screendump", args, nil)
+}
+
+// powerdownGuest logs the status of the VM controlled by the QMP
+// socket at path to lg, and requests an ACPI shutdown of the guest. It
+// returns once ctx is done, or grace has elapsed.
+//
+// If the powerdown cannot be requested, powerdownGuest returns
+// immediately, so that the caller can fall back to stopping QEMU.
+func powerdownGuest(ctx context.Context, lg *runLogger, path string, grace time.Duration) {
+	if grace <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+
+	dctx, dcancel := context.WithTimeout(ctx, qmpTimeout)
+	defer dcancel()
+	q, err := dialQMP(dctx, path)
+	if err != nil {
+		lg.Warn("Connecting to QMP failed", "path", path, "err", err)
+		return
+	}
+	defer q.Close()
+	s, err := q.queryStatus(dctx)
+	if err != nil {
+		lg.Warn("Querying VM status failed", "err", err)
+	} else {
+		lg.Info("VM status before powerdown", "status", s.Status, "running", s.Running)
+	}
+	if err := q.systemPowerdown(dctx); err != nil {
+		lg.Warn("Requesting guest powerdown failed", "err", err)
+		return
+	}
+	lg.Info("Requested guest powerdown", "grace", grace)
+	<-ctx.Done()
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeQMP serves the QMP protocol on a unix socket, responding to
+// commands with the results in responses. Commands without a response
+// return an empty object. Each command received is sent to cmds.
+type fakeQMP struct {
+	path      string
+	ln        net.Listener
+	responses map[string]string
+	cmds      chan string
+}
+
+func newFakeQMP(t *testing.T, responses map[string]string) *fakeQMP {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "qmp.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeQMP{path: path, ln: ln, responses: responses, cmds: make(chan string, 10)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeQMP) serve() {
+	conn, err := f.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		var req struct {
+			Execute string `json:"execute"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			return
+		}
+		f.cmds <- req.Execute
+		// Interleave an event to ensure clients skip it.
+		fmt.Fprintln(conn, `{"event": "RESET", "data": {}}`)
+		if resp, ok := f.responses[req.Execute]; ok {
+			fmt.Fprintln(conn, resp)
+		} else {
+			fmt.Fprintln(conn, `{"return": {}}`)
+		}
+	}
+}
+
+func TestQMPClient(t *testing.T) {
+	f := newFakeQMP(t, map[string]string{
+		"query-status": `{"return": {"running": true, "status": "running"}}`,
+		"quit":         `{"error": {"class": "GenericError", "desc": "nope"}}`,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q, err := dialQMP(ctx, f.path)
+	if err != nil {
+		t.Fatalf("dialQMP() = _, %v, wanted no error", err)
+	}
+	defer q.Close()
+	if got := <-f.cmds; got != "qmp_capabilities" {
+		t.Errorf("first command = %q, wanted qmp_capabilities", got)
+	}
+
+	s, err := q.queryStatus(ctx)
+	if err != nil {
+		t.Fatalf("queryStatus() = _, %v, wanted no error", err)
+	}
+	if want := (qmpStatus{Running: true, Status: "running"}); s != want {
+		t.Errorf("queryStatus() = %+v, wanted %+v", s, want)
+	}
+	<-f.cmds
+
+	if err := q.systemPowerdown(ctx); err != nil {
+		t.Errorf("systemPowerdown() = %v, wanted no error", err)
+	}
+	if got := <-f.cmds; got != "system_powerdown" {
+		t.Errorf("command = %q, wanted system_powerdown", got)
+	}
+
+	if err := q.execute(ctx, "quit", nil, nil); err == nil {
+		t.Errorf("execute(_, %q) = nil, wanted error", "quit")
+	}
+}
+
+func TestPowerdownGuest(t *testing.T) {
+	f := newFakeQMP(t, nil)
+	lg := newRunLogger(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	start := time.Now()
+	powerdownGuest(context.Background(), lg, f.path, 100*time.Millisecond)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("powerdownGuest() returned after %v, wanted at least the grace period", d)
+	}
+	var got []string
+	for len(f.cmds) > 0 {
+		got = append(got, <-f.cmds)
+	}
+	want := []string{"qmp_capabilities", "query-status", "system_powerdown"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("powerdownGuest() commands mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPowerdownGuestNoQMP(t *testing.T) {
+	lg := newRunLogger(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+
+	start := time.Now()
+	powerdownGuest(context.Background(), lg, path, time.Minute)
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("powerdownGuest() without QMP returned after %v, wanted it to return immediately", d)
+	}
+}
+
+func TestCaptureScreen(t *testing.T) {
+	f := newFakeQMP(t, nil)
+	dir := filepath.Join(t.TempDir(), "screens")
+	path, err := captureScreen(context.Background(), f.path, "vm0", dir, 5)
+	if err != nil {
+		t.Fatalf("captureScreen() = _, %v, wanted no error", err)
+	}
+	if filepath.Dir(path) != dir || filepath.Ext(path) != ".png" {
+		t.Errorf("captureScreen() = %q, wanted a .png file in %q", path, dir)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("captureScreen() did not create %q: %v", dir, err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// qosOptions describe how VM processes are scheduled relative to other
+// processes on the host.
+type qosOptions struct {
+	nice     int    // niceness, from -20 to 19
+	class    string // macOS QoS clamp; see qosClasses
+	affinity string // Linux CPU list, such as 0-3,8
+}
+
+// qosClasses are the QoS clamps taskpolicy can apply on macOS.
+var qosClasses = map[string]bool{
+	"utility":     true,
+	"background":  true,
+	"maintenance": true,
+}
+
+// currentQoS returns the QoS options set by flags.
+func currentQoS() qosOptions {
+	return qosOptions{nice: *niceLevel, class: *qosClass, affinity: *cpuAffinity}
+}
+
+// validate reports whether q can be applied on goos.
+func (q qosOptions) validate(goos string) error {
+	if q.nice < -20 || q.nice > 19 {
+		return fmt.Errorf("nice level %d, wanted -20 to 19", q.nice)
+	}
+	if q.nice != 0 && goos == "windows" {
+		return fmt.Errorf("nice levels are not supported on %s", goos)
+	}
+	if q.class != "" {
+		if goos != "darwin" {
+			return fmt.Errorf("QoS classes are only supported on macOS, not %s", goos)
+		}
+		if !qosClasses[q.class] {
+			return fmt.Errorf("QoS class %q, wanted utility, background, or maintenance", q.class)
+		}
+	}
+	if q.affinity != "" {
+		if goos != "linux" {
+			return fmt.Errorf("CPU affinity is only supported on Linux, not %s", goos)
+		}
+		if strings.Trim(q.affinity, "0123456789,-") != "" {
+			return fmt.Errorf("CPU list %q, wanted CPU numbers and ranges such as 0-3,8", q.affinity)
+		}
+	}
+	return nil
+}
+
+// wrap returns args prefixed with the commands applying q. Each of
+// them execs the rest of its arguments, so that the VM keeps the
+// process ID of the returned command, and signals sent to it reach the
+// VM.
+func (q qosOptions) wrap(args []string) []string {
+	var prefix []string
+	if q.nice != 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(q.nice))
+	}
+	if q.class != "" {
+		prefix = append(prefix, "taskpolicy", "-c", q.class)
+	}
+	if q.affinity != "" {
+		prefix = append(prefix, "taskset", "-c", q.affinity)
+	}
+	return append(prefix, args...)
+}
+
+// applyQoS returns cmd, wrapped to run according to q.
+func applyQoS(cmd *exec.Cmd, q qosOptions) *exec.Cmd {
+	args := q.wrap(cmd.Args)
+	if len(args) == len(cmd.Args) {
+		return cmd
+	}
+	n := exec.Command(args[0], args[1:]...)
+	n.Env, n.Dir = cmd.Env, cmd.Dir
+	return n
+}
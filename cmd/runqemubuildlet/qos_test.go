@@ -0,0 +1,56 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQoSValidate(t *testing.T) {
+	cases := []struct {
+		q       qosOptions
+		goos    string
+		wantErr bool
+	}{
+		{qosOptions{}, "windows", false},
+		{qosOptions{nice: 10}, "linux", false},
+		{qosOptions{nice: 20}, "linux", true},
+		{qosOptions{nice: 5}, "windows", true},
+		{qosOptions{class: "utility"}, "darwin", false},
+		{qosOptions{class: "utility"}, "linux", true},
+		{qosOptions{class: "interactive"}, "darwin", true},
+		{qosOptions{affinity: "0-3,8"}, "linux", false},
+		{qosOptions{affinity: "0-3,8"}, "darwin", true},
+		{qosOptions{affinity: "all"}, "linux", true},
+	}
+	for _, c := range cases {
+		if err := c.q.validate(c.goos); (err != nil) != c.wantErr {
+			t.Errorf("%+v.validate(%q) = %v, wantErr: %t", c.q, c.goos, err, c.wantErr)
+		}
+	}
+}
+
+func TestApplyQoS(t *testing.T) {
+	cmd := exec.Command("/qemu/bin/qemu-system-aarch64", "-m", "4096")
+	cmd.Env = []string{"DYLD_LIBRARY_PATH=/qemu/lib"}
+	if got := applyQoS(cmd, qosOptions{}); got != cmd {
+		t.Errorf("applyQoS() with no options = %v, wanted cmd unchanged", got)
+	}
+
+	got := applyQoS(cmd, qosOptions{nice: 5, class: "utility"})
+	want := []string{"nice", "-n", "5", "taskpolicy", "-c", "utility", "/qemu/bin/qemu-system-aarch64", "-m", "4096"}
+	if diff := cmp.Diff(want, got.Args); diff != "" {
+		t.Errorf("applyQoS() args mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(cmd.Env, got.Env); diff != "" {
+		t.Errorf("applyQoS() env mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// recycleCheckInterval is how often a run is checked against
+// -max-vm-uptime, -recycle-windows, -max-sessions, and
+// -recycle-on-reload.
+const recycleCheckInterval = time.Minute
+
+// recycleWindow is a daily window of local time. A VM whose run
+// started before the window opened is recycled while it is open, so
+// that each VM is recycled at most once per window.
+type recycleWindow struct {
+	start, end int // minutes since midnight
+}
+
+// parseRecycleWindows parses a comma-separated list of daily windows
+// of the form HH:MM-HH:MM, such as "02:00-04:00,14:00-14:30". A
+// window ending before it starts spans midnight.
+func parseRecycleWindows(s string) ([]recycleWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ws []recycleWindow
+	for _, f := range strings.Split(s, ",") {
+		i := strings.Index(f, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("recycle window %q, wanted HH:MM-HH:MM", f)
+		}
+		start, err := parseClock(f[:i])
+		if err != nil {
+			return nil, fmt.Errorf("recycle window %q: %w", f, err)
+		}
+		end, err := parseClock(f[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("recycle window %q: %w", f, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("recycle window %q is empty", f)
+		}
+		ws = append(ws, recycleWindow{start: start, end: end})
+	}
+	return ws, nil
+}
+
+// parseClock parses a time of day of the form HH:MM into minutes
+// since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// opened returns when the window containing now opened, and whether
+// now is in the window at all.
+func (w recycleWindow) opened(now time.Time) (time.Time, bool) {
+	y, m, d := now.Date()
+	at := func(day, min int) time.Time {
+		return time.Date(y, m, day, 0, min, 0, 0, now.Location())
+	}
+	open, close := at(d, w.start), at(d, w.end)
+	if w.end < w.start {
+		// The window spans midnight.
+		if now.Before(close) {
+			open = at(d-1, w.start)
+		} else {
+			close = at(d+1, w.end)
+		}
+	}
+	return open, !now.Before(open) && now.Before(close)
+}
+
+// recycleDue returns why a run started at started should be recycled
+// at now, given the maximum uptime, if positive, and windows, or ""
+// if it should not be.
+func recycleDue(started, now time.Time, maxUptime time.Duration, windows []recycleWindow) string {
+	if maxUptime > 0 && now.Sub(started) >= maxUptime {
+		return "max_uptime"
+	}
+	for _, w := range windows {
+		if open, in := w.opened(now); in && started.Before(open) {
+			return "recycle_window"
+		}
+	}
+	return ""
+}
+
+// sessionCounter counts the completed sessions of a guest's buildlet
+// with the coordinator, from the start times of the buildlet processes
+// reported by its /status. A reverse buildlet exits after each
+// session, and is restarted by the guest.
+type sessionCounter struct {
+	last      time.Time // start time of the current buildlet process
+	completed int
+}
+
+// observe records that the buildlet process started at started, and
+// returns the number of completed sessions.
+func (c *sessionCounter) observe(started time.Time) int {
+	if !started.IsZero() && !started.Equal(c.last) {
+		if !c.last.IsZero() {
+			c.completed++
+		}
+		c.last = started
+	}
+	return c.completed
+}
+
+// waitRecycle waits until the run started at started, booted from
+// image version imageVersion with config cfg, is due to be recycled
+// according to -max-vm-uptime, -recycle-windows, and -max-sessions,
+// because a newer image version is staged, or, with
+// -recycle-on-reload, because its config was reloaded with changes,
+// and returns why, or returns "" once ctx is done. VMs are not
+// recycled in maintenance mode.
+func (in *instance) waitRecycle(ctx context.Context, started time.Time, imageVersion string, cfg *vmConfig) string {
+	if *mode == modeMaintenance || (*maxVMUptime <= 0 && len(recycleWindows) == 0 && *maxSessions <= 0 && imageUpdates == nil && !*recycleOnReload) {
+		<-ctx.Done()
+		return ""
+	}
+	var statusURL string
+	if *maxSessions > 0 {
+		u, err := in.statusURL()
+		if err != nil {
+			in.logger.Warn("Finding buildlet status URL failed; not counting sessions", "err", err)
+		}
+		statusURL = u
+	}
+	var sessions sessionCounter
+	t := time.NewTicker(recycleCheckInterval)
+	defer t.Stop()
+	for {
+		if reason := recycleDue(started, time.Now(), *maxVMUptime, recycleWindows); reason != "" {
+			return reason
+		}
+		if imageUpdates != nil && imageUpdates.latest() != imageVersion {
+			return "image_update"
+		}
+		if *recycleOnReload && in.config() != cfg {
+			// reloadConfigs only replaces the config if it changed.
+			return "config_change"
+		}
+		if statusURL != "" {
+			// An unreachable buildlet, such as one restarting
+			// between sessions, is checked again later.
+			if s, err := buildletStatus(ctx, statusURL); err == nil {
+				if n := sessions.observe(s.Started); n >= *maxSessions {
+					in.logger.Info("Buildlet completed maximum sessions", "sessions", n)
+					return "max_sessions"
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-t.C:
+		}
+	}
+}
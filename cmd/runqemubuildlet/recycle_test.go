@@ -0,0 +1,107 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRecycleWindows(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    []recycleWindow
+		wantErr bool
+	}{
+		{in: ""},
+		{in: "02:00-04:30", want: []recycleWindow{{start: 120, end: 270}}},
+		{in: "23:00-01:00,12:00-12:15", want: []recycleWindow{{start: 1380, end: 60}, {start: 720, end: 735}}},
+		{in: "02:00", wantErr: true},
+		{in: "2am-4am", wantErr: true},
+		{in: "02:00-02:00", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseRecycleWindows(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("parseRecycleWindows(%q) = _, %v, wantErr: %t", c.in, err, c.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(c.want, got, cmp.AllowUnexported(recycleWindow{})); diff != "" {
+			t.Errorf("parseRecycleWindows(%q) mismatch (-want +got):\n%s", c.in, diff)
+		}
+	}
+}
+
+func TestRecycleDue(t *testing.T) {
+	day := func(h, m int) time.Time { return time.Date(2021, 6, 1, h, m, 0, 0, time.UTC) }
+	night := []recycleWindow{{start: 23 * 60, end: 60}}    // 23:00-01:00
+	early := []recycleWindow{{start: 2 * 60, end: 4 * 60}} // 02:00-04:00
+	cases := []struct {
+		desc         string
+		started, now time.Time
+		maxUptime    time.Duration
+		windows      []recycleWindow
+		want         string
+	}{
+		{desc: "nothing configured", started: day(0, 0), now: day(12, 0)},
+		{desc: "young", started: day(0, 0), now: day(12, 0), maxUptime: 24 * time.Hour},
+		{desc: "old", started: day(0, 0), now: day(12, 0), maxUptime: 12 * time.Hour, want: "max_uptime"},
+		{desc: "before window", started: day(0, 0), now: day(1, 59), windows: early},
+		{desc: "in window", started: day(0, 0), now: day(2, 0), windows: early, want: "recycle_window"},
+		{desc: "started in window", started: day(2, 30), now: day(3, 0), windows: early},
+		{desc: "after window", started: day(0, 0), now: day(4, 0), windows: early},
+		{desc: "before midnight", started: day(12, 0), now: day(23, 30), windows: night, want: "recycle_window"},
+		{desc: "after midnight", started: day(12, 0).AddDate(0, 0, -1), now: day(0, 30), windows: night, want: "recycle_window"},
+		{desc: "after midnight, started in window", started: day(23, 30).AddDate(0, 0, -1), now: day(0, 30), windows: night},
+	}
+	for _, c := range cases {
+		if got := recycleDue(c.started, c.now, c.maxUptime, c.windows); got != c.want {
+			t.Errorf("%s: recycleDue(%v, %v, %v, %v) = %q, wanted %q", c.desc, c.started, c.now, c.maxUptime, c.windows, got, c.want)
+		}
+	}
+}
+
+func TestSessionCounter(t *testing.T) {
+	t0 := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	var c sessionCounter
+	for i, s := range []struct {
+		started time.Time
+		want    int
+	}{
+		{time.Time{}, 0}, // buildlet older than version 28
+		{t0, 0},
+		{t0, 0},
+		{t0.Add(time.Hour), 1},
+		{t0.Add(time.Hour), 1},
+		{time.Time{}, 1},
+		{t0.Add(3 * time.Hour), 2},
+	} {
+		if got := c.observe(s.started); got != s.want {
+			t.Errorf("observation %d: observe(%v) = %d, wanted %d", i, s.started, got, s.want)
+		}
+	}
+}
+
+func TestWaitRecycleConfigChange(t *testing.T) {
+	defer func(v bool) { *recycleOnReload = v }(*recycleOnReload)
+	*recycleOnReload = true
+	in := newInstance("vm", windows10Config("/base"), "http://localhost:8090/healthz")
+	cfg := in.config()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := in.waitRecycle(ctx, time.Now(), "", cfg); got != "" {
+		t.Errorf("waitRecycle() with an unchanged config = %q, wanted none", got)
+	}
+	in.setConfig(cfg.clone())
+	if got, want := in.waitRecycle(context.Background(), time.Now(), "", cfg), "config_change"; got != want {
+		t.Errorf("waitRecycle() after a reload = %q, wanted %q", got, want)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && (windows || plan9)
+// +build go1.21
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// reexec returns an error, as exec is not supported on this platform.
+// runqemubuildlet then exits, and its service manager must restart it.
+func reexec(exe string) error {
+	return fmt.Errorf("re-exec is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !windows && !plan9
+// +build go1.21,!windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reexec replaces the running process with the binary at exe, with
+// the same arguments and environment. It only returns on error.
+func reexec(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
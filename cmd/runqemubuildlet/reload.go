@@ -0,0 +1,158 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// reloadConfigs loads the VM config again, as on startup, and gives
+// each of insts its new config from its next run on, logging the
+// fields that changed. Running VMs are left alone.
+//
+// The host ports and VNC display of each instance are kept, since its
+// running VM holds them, and the health of its buildlet is checked on
+// the same port. Changing the image directory or backend requires a
+// restart.
+func reloadConfigs(insts []*instance) error {
+	cfg, err := vmConfigFromFlags()
+	if err != nil {
+		return err
+	}
+	next, err := newInstances(cfg, *healthzURL, len(insts), *portStride)
+	if err != nil {
+		return fmt.Errorf("newInstances() = %w", err)
+	}
+	for i, in := range insts {
+		old, c := in.config(), next[i].cfg
+		if c.Base != old.Base || c.Backend != old.Backend {
+			return fmt.Errorf("%s: changing base or backend requires a restart", in.name)
+		}
+		if !reflect.DeepEqual(c.Network.PortForwards, old.Network.PortForwards) || c.VNC != old.VNC {
+			in.logger.Warn("Port forwards and VNC display changes require a restart; keeping the current ones")
+		}
+		c.Network.PortForwards = old.Network.PortForwards
+		c.VNC = old.VNC
+	}
+	for i, in := range insts {
+		old, c := in.config(), next[i].cfg
+		changes, err := configDiff(old, c)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			in.logger.Info("Reloaded config; nothing changed")
+			continue
+		}
+		in.setConfig(c)
+		if *recycleOnReload {
+			in.logger.Info("Reloaded config; recycling VM once its buildlet is idle", "changes", changes)
+			continue
+		}
+		in.logger.Info("Reloaded config; changes apply from the next run", "changes", changes)
+	}
+	return nil
+}
+
+// configDiff returns the fields that differ between old and new, as
+// "path: old -> new", with paths as accepted by -set, in order.
+func configDiff(old, new *vmConfig) ([]string, error) {
+	a, err := flattenConfig(old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := flattenConfig(new)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for p := range a {
+		paths = append(paths, p)
+	}
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	var diff []string
+	for _, p := range paths {
+		if a[p] != b[p] {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", p, orNone(a[p]), orNone(b[p])))
+		}
+	}
+	return diff, nil
+}
+
+// flattenConfig returns the fields of c set to non-empty values, in
+// YAML, keyed by their -set path.
+func flattenConfig(c *vmConfig) (map[string]string, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		join := func(k string) string {
+			if prefix == "" {
+				return k
+			}
+			return prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			for k, e := range v {
+				walk(join(fmt.Sprint(k)), e)
+			}
+		case []interface{}:
+			for i, e := range v {
+				walk(join(strconv.Itoa(i)), e)
+			}
+		case nil:
+		default:
+			if s := fmt.Sprint(v); s != "" && s != "0" && s != "false" {
+				m[prefix] = s
+			}
+		}
+	}
+	walk("", doc)
+	return m, nil
+}
+
+// orNone returns s, or "(none)" if it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// reloadOnSignal calls reloadConfigs for insts each time
+// runqemubuildlet receives SIGHUP, on systems that have it.
+func reloadOnSignal(insts []*instance) {
+	notifyReload(func(sig string) {
+		slog.Info("Reloading config", "signal", sig)
+		if err := reloadConfigs(insts); err != nil {
+			slog.Error("Reloading config failed; keeping the current one", "err", err)
+			audit.record("reload", "signal", "", "signal", sig, "error", err.Error())
+			return
+		}
+		audit.record("reload", "signal", "", "signal", sig)
+	})
+}
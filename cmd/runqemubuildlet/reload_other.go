@@ -0,0 +1,12 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && (windows || plan9)
+// +build go1.21
+// +build windows plan9
+
+package main
+
+// notifyReload does nothing, as there is no SIGHUP on this platform.
+func notifyReload(reload func(sig string)) {}
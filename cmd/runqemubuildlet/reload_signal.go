@@ -0,0 +1,26 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !windows && !plan9
+// +build go1.21,!windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload calls reload, with the name of the signal, each time
+// runqemubuildlet receives SIGHUP.
+func notifyReload(reload func(sig string)) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for sig := range c {
+			reload(sig.String())
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConfigDiff(t *testing.T) {
+	old := windows10Config("/base")
+	n := old.clone()
+	n.CPUs = 4
+	n.Drives[0].Cache = "none"
+	n.Drives = n.Drives[:1]
+	n.Serial = "file:serial.log"
+	got, err := configDiff(old, n)
+	if err != nil {
+		t.Fatalf("configDiff() = _, %v", err)
+	}
+	want := []string{
+		"cpus: 8 -> 4",
+		"drives.0.cache: auto -> none",
+		"drives.1.cache: auto -> (none)",
+		"drives.1.device: usb-storage -> (none)",
+		"drives.1.device_options: removable=true,bootindex=1 -> (none)",
+		"drives.1.file: Images/virtio.iso -> (none)",
+		"drives.1.id: drive2 -> (none)",
+		"drives.1.media: cdrom -> (none)",
+		"serial: (none) -> file:serial.log",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("configDiff() mismatch (-want +got):\n%s", diff)
+	}
+	if got, err := configDiff(old, old.clone()); err != nil || len(got) != 0 {
+		t.Errorf("configDiff() of a clone = %q, %v, wanted no changes", got, err)
+	}
+}
+
+func TestReloadConfigs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vm.yaml")
+	defer func(p string, n int) { *configPath, *numInstances = p, n }(*configPath, *numInstances)
+	*configPath, *numInstances = path, 2
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+qemu: bin/qemu-system-aarch64
+cpus: 4
+network:
+  device: virtio-net-pci
+  port_forwards:
+  - {host_port: 9090, guest_port: 8080}
+vnc: ":3"
+`)
+	cfg, err := vmConfigFromFlags()
+	if err != nil {
+		t.Fatalf("vmConfigFromFlags() = _, %v", err)
+	}
+	insts, err := newInstances(cfg, "http://localhost:9090/healthz", 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts[1].cfg.Network.PortForwards[0].HostPort = 9999 // as allocated by -auto-ports
+
+	write(`
+qemu: bin/qemu-system-aarch64
+cpus: 8
+network:
+  device: virtio-net-pci
+  port_forwards:
+  - {host_port: 7070, guest_port: 8080}
+vnc: ":7"
+`)
+	if err := reloadConfigs(insts); err != nil {
+		t.Fatalf("reloadConfigs() = %v", err)
+	}
+	for i, wantPort := range []int{9090, 9999} {
+		c := insts[i].config()
+		if c.CPUs != 8 {
+			t.Errorf("%s: cpus = %d after reload, wanted 8", insts[i].name, c.CPUs)
+		}
+		if got := c.Network.PortForwards[0].HostPort; got != wantPort {
+			t.Errorf("%s: host port = %d after reload, wanted %d kept", insts[i].name, got, wantPort)
+		}
+		if want := []string{":3", ":4"}[i]; c.VNC != want {
+			t.Errorf("%s: vnc = %q after reload, wanted %q kept", insts[i].name, c.VNC, want)
+		}
+	}
+
+	write("qemu: bin/qemu-system-aarch64\ncpus: 2\nbase: /elsewhere\n")
+	if err := reloadConfigs(insts); err == nil {
+		t.Errorf("reloadConfigs() changing base = nil, wanted error")
+	}
+	write("qemu: bin/qemu-system-aarch64\ncpus: -1\n")
+	if err := reloadConfigs(insts); err == nil {
+		t.Errorf("reloadConfigs() with an invalid config = nil, wanted error")
+	}
+	if got := insts[0].config().CPUs; got != 8 {
+		t.Errorf("cpus = %d after failed reloads, wanted 8 kept", got)
+	}
+}
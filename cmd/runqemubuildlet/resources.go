@@ -0,0 +1,127 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const (
+	// reservedCPUs is the number of host CPUs left for the host when
+	// auto-sizing VMs.
+	reservedCPUs = 2
+	// reservedMemoryMB is the host memory left for the host when
+	// auto-sizing VMs.
+	reservedMemoryMB = 4096
+	// minAutoMemoryMB is the least memory given to an auto-sized VM.
+	minAutoMemoryMB = 2048
+)
+
+// autoSize sets the CPU count and memory of c to an equal share of
+// the host's CPUs and memory among n VMs, after reserving some for the
+// host itself. Any topology in c is reset, since it may not match the
+// new CPU count.
+func autoSize(c *vmConfig, n, hostCPUs, hostMemMB int) {
+	cpus := (hostCPUs - reservedCPUs) / n
+	if cpus < 1 {
+		cpus = 1
+	}
+	mem := (hostMemMB - reservedMemoryMB) / n
+	mem -= mem % 256
+	if mem < minAutoMemoryMB {
+		mem = minAutoMemoryMB
+	}
+	c.CPUs = cpus
+	c.Sockets, c.Cores, c.Threads = 0, 0, 0
+	c.MemoryMB = mem
+}
+
+// applyResourceFlags applies the -guest-* resource flags to c, for a
+// host running n VMs.
+func applyResourceFlags(c *vmConfig, n int) error {
+	if *guestAutoSize {
+		mem, err := hostMemoryMB()
+		if err != nil {
+			return fmt.Errorf("hostMemoryMB() = %w", err)
+		}
+		autoSize(c, n, runtime.NumCPU(), mem)
+	}
+	if *guestCPUs > 0 {
+		c.CPUs = *guestCPUs
+	}
+	if *guestMemoryMB > 0 {
+		c.MemoryMB = *guestMemoryMB
+	}
+	if *guestSockets > 0 {
+		c.Sockets = *guestSockets
+	}
+	if *guestCores > 0 {
+		c.Cores = *guestCores
+	}
+	if *guestThreads > 0 {
+		c.Threads = *guestThreads
+	}
+	if *guestBalloonMinMB > 0 {
+		if c.Balloon == nil {
+			c.Balloon = new(balloonConfig)
+		}
+		c.Balloon.MinMB = *guestBalloonMinMB
+	}
+	return c.validate()
+}
+
+// smp returns the -smp argument for c.
+//
+// Unset topology fields default to a single socket with one thread
+// per core.
+func (c *vmConfig) smp() string {
+	sockets, threads := c.Sockets, c.Threads
+	if sockets == 0 {
+		sockets = 1
+	}
+	if threads == 0 {
+		threads = 1
+	}
+	cores := c.Cores
+	if cores == 0 {
+		cores = c.CPUs / (sockets * threads)
+	}
+	return fmt.Sprintf("cpus=%d,sockets=%d,cores=%d,threads=%d", c.CPUs, sockets, cores, threads)
+}
+
+// validateTopology returns an error if the CPU topology of c does not
+// add up to its CPU count.
+func (c *vmConfig) validateTopology() error {
+	if c.Sockets < 0 || c.Cores < 0 || c.Threads < 0 {
+		return fmt.Errorf("negative cpu topology %d sockets, %d cores, %d threads", c.Sockets, c.Cores, c.Threads)
+	}
+	if c.CPUs == 0 {
+		if c.Sockets != 0 || c.Cores != 0 || c.Threads != 0 {
+			return fmt.Errorf("cpu topology set without cpus")
+		}
+		return nil
+	}
+	sockets, threads := c.Sockets, c.Threads
+	if sockets == 0 {
+		sockets = 1
+	}
+	if threads == 0 {
+		threads = 1
+	}
+	if c.Cores == 0 {
+		if c.CPUs%(sockets*threads) != 0 {
+			return fmt.Errorf("cpus = %d is not a multiple of %d sockets * %d threads", c.CPUs, sockets, threads)
+		}
+		return nil
+	}
+	if n := sockets * c.Cores * threads; n != c.CPUs {
+		return fmt.Errorf("cpu topology %d sockets * %d cores * %d threads = %d, wanted cpus = %d", sockets, c.Cores, threads, n, c.CPUs)
+	}
+	return nil
+}
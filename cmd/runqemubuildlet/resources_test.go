@@ -0,0 +1,63 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"testing"
+)
+
+func TestAutoSize(t *testing.T) {
+	cases := []struct {
+		desc              string
+		n, cpus, memMB    int
+		wantCPUs, wantMem int
+	}{
+		{desc: "M1 mini, one VM", n: 1, cpus: 8, memMB: 16384, wantCPUs: 6, wantMem: 12288},
+		{desc: "M1 Pro, two VMs", n: 2, cpus: 10, memMB: 32768, wantCPUs: 4, wantMem: 14336},
+		{desc: "tiny host", n: 4, cpus: 2, memMB: 4096, wantCPUs: 1, wantMem: minAutoMemoryMB},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			cfg := windows10Config("/base")
+			cfg.Cores = 8
+			autoSize(cfg, c.n, c.cpus, c.memMB)
+			if cfg.CPUs != c.wantCPUs || cfg.MemoryMB != c.wantMem {
+				t.Errorf("autoSize() = %d CPUs, %d MiB, wanted %d CPUs, %d MiB", cfg.CPUs, cfg.MemoryMB, c.wantCPUs, c.wantMem)
+			}
+			if err := cfg.validate(); err != nil {
+				t.Errorf("validate() after autoSize() = %v, wanted no error", err)
+			}
+		})
+	}
+}
+
+func TestSMP(t *testing.T) {
+	cases := []struct {
+		desc    string
+		c       vmConfig
+		want    string
+		wantErr bool
+	}{
+		{desc: "default", c: vmConfig{CPUs: 8}, want: "cpus=8,sockets=1,cores=8,threads=1"},
+		{desc: "threads", c: vmConfig{CPUs: 8, Threads: 2}, want: "cpus=8,sockets=1,cores=4,threads=2"},
+		{desc: "full", c: vmConfig{CPUs: 8, Sockets: 2, Cores: 2, Threads: 2}, want: "cpus=8,sockets=2,cores=2,threads=2"},
+		{desc: "mismatch", c: vmConfig{CPUs: 8, Sockets: 2, Cores: 3}, wantErr: true},
+		{desc: "indivisible", c: vmConfig{CPUs: 7, Threads: 2}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			err := c.c.validateTopology()
+			if (err != nil) != c.wantErr {
+				t.Fatalf("validateTopology() = %v, wantErr: %t", err, c.wantErr)
+			}
+			if err == nil && c.c.smp() != c.want {
+				t.Errorf("smp() = %q, wanted %q", c.c.smp(), c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// scratchDriveID is the ID of the per-run scratch disk, which is also
+// its serial number, so that Linux guests find it at
+// /dev/disk/by-id/virtio-scratch.
+const scratchDriveID = "scratch"
+
+// createScratchDisk creates an empty scratch disk image of sizeGB GiB
+// in dir for a run of c, and returns the drive attaching it. The
+// image is sparse, so it only takes up the space the guest writes.
+func createScratchDisk(ctx context.Context, c *vmConfig, dir string, sizeGB int) (driveConfig, error) {
+	d := driveConfig{
+		ID:    scratchDriveID,
+		Media: "disk",
+		// The contents are discarded after the run, so there is
+		// no point in flushing them to the host's disk.
+		Cache:         "unsafe",
+		Device:        "virtio-blk-pci",
+		DeviceOptions: "serial=" + scratchDriveID,
+	}
+	if c.isVZ() {
+		// The Virtualization framework only supports raw images.
+		d.File, d.Format = filepath.Join(dir, "scratch.img"), "raw"
+		f, err := os.Create(d.File)
+		if err != nil {
+			return driveConfig{}, err
+		}
+		if err := f.Truncate(int64(sizeGB) << 30); err != nil {
+			f.Close()
+			return driveConfig{}, err
+		}
+		return d, f.Close()
+	}
+	d.File, d.Format = filepath.Join(dir, "scratch.qcow2"), "qcow2"
+	// Give space freed by the guest back to the host while the run
+	// lasts.
+	d.Discard, d.DetectZeroes = "unmap", "unmap"
+	cmd := c.qemuImgCommand(ctx, "create", "-f", "qcow2", d.File, fmt.Sprintf("%dG", sizeGB))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return driveConfig{}, fmt.Errorf("%v = %w: %s", cmd, err, out)
+	}
+	return d, nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateScratchDiskVZ(t *testing.T) {
+	dir := t.TempDir()
+	d, err := createScratchDisk(context.Background(), vzTestConfig(), dir, 2)
+	if err != nil {
+		t.Fatalf("createScratchDisk() = _, %v, wanted no error", err)
+	}
+	if want := filepath.Join(dir, "scratch.img"); d.File != want || d.Format != "raw" || d.ID != scratchDriveID {
+		t.Errorf("createScratchDisk() = %+v, wanted raw image %s with ID %s", d, want, scratchDriveID)
+	}
+	fi, err := os.Stat(d.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 2<<30 {
+		t.Errorf("scratch image size = %d, wanted %d", fi.Size(), 2<<30)
+	}
+}
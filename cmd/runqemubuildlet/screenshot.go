@@ -0,0 +1,61 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// screenshotFormats are the formats captureScreen tries, in order of
+// preference, and the runFiles their screenshots are kept in.
+func screenshotFormats(dir string, keep int) map[string]*runFiles {
+	return map[string]*runFiles{
+		"png": {dir: dir, kind: "screen", ext: ".png", keep: keep},
+		"ppm": {dir: dir, kind: "screen", ext: ".ppm", keep: keep},
+	}
+}
+
+// captureScreen saves a screenshot of the display of the VM named
+// name, controlled by the QMP socket at qmpPath, into dir, and returns
+// its path. It prefers PNG, but falls back to PPM on versions of QEMU
+// that do not support it. Older screenshots are pruned so that at most
+// keep of each format are retained.
+func captureScreen(ctx context.Context, qmpPath, name, dir string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, qmpTimeout)
+	defer cancel()
+	q, err := dialQMP(ctx, qmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer q.Close()
+
+	fs := screenshotFormats(dir, keep)
+	now := time.Now()
+	format := "png"
+	err = q.screendump(ctx, fs[format].path(name, now), format)
+	var qerr *qmpError
+	if errors.As(err, &qerr) {
+		format = "ppm"
+		err = q.screendump(ctx, fs[format].path(name, now), format)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, f := range fs {
+		if err := f.prune(name); err != nil {
+			return "", err
+		}
+	}
+	return fs[format].path(name, now), nil
+}
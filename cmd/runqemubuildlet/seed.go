@@ -0,0 +1,185 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"text/template"
+	"time"
+)
+
+// cloudInitConfig describes a cloud-init NoCloud seed ISO generated
+// for each run of a guest, used to inject the buildlet binary and its
+// key into a generic Linux image.
+type cloudInitConfig struct {
+	// Buildlet is the path to the guest's buildlet binary.
+	Buildlet string `yaml:"buildlet"`
+	// KeyFile is the path to the builder key for ReverseType.
+	KeyFile string `yaml:"key_file"`
+	// ReverseType is the reverse buildlet host type the guest
+	// registers as.
+	ReverseType string `yaml:"reverse_type"`
+	// UserData, if set, is the path to a cloud-init user-data file
+	// used instead of the default, which installs and runs the
+	// buildlet.
+	UserData string `yaml:"user_data"`
+	// Files are additional files copied to the root of the seed ISO.
+	Files []string `yaml:"files"`
+}
+
+// defaultUserData installs the buildlet and key from the seed ISO, and
+// runs the buildlet in reverse mode with /healthz served on port 8080,
+// and its work directory on the scratch disk, if any.
+var defaultUserData = template.Must(template.New("user-data").Parse(`#cloud-config
+runcmd:
+  - mkdir -p /mnt/seed
+  - mount -o ro /dev/disk/by-label/cidata /mnt/seed
+  - install -m 0755 /mnt/seed/buildlet /usr/local/bin/buildlet
+{{- if .KeyFile}}
+  - install -m 0600 /mnt/seed/gobuildkey /root/.gobuildkey-{{.ReverseType}}
+{{- end}}
+  - umount /mnt/seed
+{{- if .Scratch}}
+  - mkfs.ext4 -q -L scratch /dev/disk/by-id/virtio-scratch
+  - mkdir -p /scratch
+  - mount /dev/disk/by-id/virtio-scratch /scratch
+{{- end}}
+  - [/usr/local/bin/buildlet, -halt=false, -reverse-type={{.ReverseType}}, -coordinator=farmer.golang.org:443, -health-addr=0.0.0.0:8080{{if .Scratch}}, -workdir=/scratch/work{{end}}]
+`))
+
+// writeSeedDir populates dir with the contents of a NoCloud seed ISO
+// for the guest instance named name.
+func writeSeedDir(dir, name string, c *vmConfig) error {
+	ci := c.CloudInit
+	meta := fmt.Sprintf("instance-id: %s-%d\nlocal-hostname: %s\n", name, time.Now().Unix(), name)
+	if err := ioutil.WriteFile(filepath.Join(dir, "meta-data"), []byte(meta), 0644); err != nil {
+		return err
+	}
+	var userData []byte
+	if ci.UserData != "" {
+		b, err := ioutil.ReadFile(c.path(ci.UserData))
+		if err != nil {
+			return err
+		}
+		userData = b
+	} else {
+		if ci.Buildlet == "" || ci.ReverseType == "" {
+			return errors.New("cloud_init must set buildlet and reverse_type, or user_data")
+		}
+		var buf bytes.Buffer
+		data := struct {
+			*cloudInitConfig
+			Scratch bool
+		}{ci, false}
+		for _, d := range c.Drives {
+			if d.ID == scratchDriveID {
+				data.Scratch = true
+			}
+		}
+		if err := defaultUserData.Execute(&buf, data); err != nil {
+			return err
+		}
+		userData = buf.Bytes()
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "user-data"), userData, 0644); err != nil {
+		return err
+	}
+	if ci.Buildlet != "" {
+		if err := copyFile(filepath.Join(dir, "buildlet"), c.path(ci.Buildlet), 0755); err != nil {
+			return err
+		}
+	}
+	if ci.KeyFile != "" {
+		if err := copyFile(filepath.Join(dir, "gobuildkey"), c.path(ci.KeyFile), 0600); err != nil {
+			return err
+		}
+	}
+	for _, f := range ci.Files {
+		if err := copyFile(filepath.Join(dir, filepath.Base(f)), c.path(f), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeSeedISO generates a NoCloud seed ISO for the guest instance
+// named name in a new temporary directory. The caller must call the
+// returned cleanup function once the VM has exited.
+func makeSeedISO(name string, c *vmConfig) (iso string, cleanup func(), err error) {
+	tmp, err := ioutil.TempDir("", "runqemubuildlet-seed")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(tmp) }
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+	dir := filepath.Join(tmp, "cidata")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", nil, err
+	}
+	if err := writeSeedDir(dir, name, c); err != nil {
+		return "", nil, err
+	}
+	iso = filepath.Join(tmp, "seed.iso")
+	cmd := isoCommand(dir, iso, "cidata")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", nil, fmt.Errorf("%v = %w: %s", cmd, err, out)
+	}
+	return iso, cleanup, nil
+}
+
+// isoCommand returns a command creating an ISO 9660 image at out,
+// with volume label label, from the contents of dir.
+func isoCommand(dir, out, label string) *exec.Cmd {
+	if runtime.GOOS == "darwin" {
+		return exec.Command("hdiutil", "makehybrid", "-iso", "-joliet", "-default-volume-name", label, "-o", out, dir)
+	}
+	return exec.Command("genisoimage", "-output", out, "-volid", label, "-joliet", "-rock", dir)
+}
+
+// seedDrive returns the drive attaching the seed ISO at iso to the
+// guest.
+func seedDrive(iso string) driveConfig {
+	return driveConfig{
+		ID:       "seed",
+		File:     iso,
+		Media:    "disk",
+		Format:   "raw",
+		ReadOnly: true,
+		Device:   "virtio-blk-pci",
+	}
+}
+
+// copyFile copies src to dst, creating dst with mode perm.
+func copyFile(dst, src string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteSeedDir(t *testing.T) {
+	base, err := ioutil.TempDir("", "runqemubuildlet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	for name, contents := range map[string]string{
+		"buildlet.linux-arm64": "buildlet binary",
+		"gobuildkey":           "secret",
+		"extra.txt":            "extra",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(base, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &vmConfig{
+		Base: base,
+		CloudInit: &cloudInitConfig{
+			Buildlet:    "buildlet.linux-arm64",
+			KeyFile:     "gobuildkey",
+			ReverseType: "host-linux-arm64-test",
+			Files:       []string{"extra.txt"},
+		},
+	}
+	dir := filepath.Join(base, "cidata")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSeedDir(dir, "vm0", c); err != nil {
+		t.Fatalf("writeSeedDir() = %v, wanted no error", err)
+	}
+
+	want := map[string]string{
+		"buildlet":   "buildlet binary",
+		"gobuildkey": "secret",
+		"extra.txt":  "extra",
+	}
+	for name, contents := range want {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != contents {
+			t.Errorf("seed file %s = %q, %v, wanted %q", name, b, err, contents)
+		}
+	}
+	userData, err := ioutil.ReadFile(filepath.Join(dir, "user-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"#cloud-config", "/root/.gobuildkey-host-linux-arm64-test", "-reverse-type=host-linux-arm64-test"} {
+		if !strings.Contains(string(userData), s) {
+			t.Errorf("user-data = %q, wanted it to contain %q", userData, s)
+		}
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(dir, "meta-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(meta), "local-hostname: vm0") {
+		t.Errorf("meta-data = %q, wanted local-hostname vm0", meta)
+	}
+
+	c.Drives = []driveConfig{{ID: scratchDriveID, Media: "disk"}}
+	if err := writeSeedDir(dir, "vm0", c); err != nil {
+		t.Fatalf("writeSeedDir() with scratch disk = %v, wanted no error", err)
+	}
+	userData, err = ioutil.ReadFile(filepath.Join(dir, "user-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"mount /dev/disk/by-id/virtio-scratch /scratch", "-workdir=/scratch/work"} {
+		if !strings.Contains(string(userData), s) {
+			t.Errorf("user-data with scratch disk = %q, wanted it to contain %q", userData, s)
+		}
+	}
+
+	c.CloudInit.ReverseType = ""
+	if err := writeSeedDir(dir, "vm0", c); err == nil {
+		t.Errorf("writeSeedDir() with no reverse type = nil, wanted error")
+	}
+}
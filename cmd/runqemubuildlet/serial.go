@@ -0,0 +1,63 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// runFiles manages files of one kind written for individual VM runs,
+// such as guest serial console logs or screenshots.
+//
+// Each file is named after the VM, kind, and time it was written, and
+// has extension ext. Older files are removed so that at most keep
+// files of the kind are retained for each VM.
+type runFiles struct {
+	dir  string
+	kind string // such as "serial"
+	ext  string // such as ".log"
+	keep int
+}
+
+// serialLogs returns the runFiles for guest serial console logs.
+func serialLogs(dir string, keep int) *runFiles {
+	return &runFiles{dir: dir, kind: "serial", ext: ".log", keep: keep}
+}
+
+// path returns the path of the file for a run of the VM named name
+// written at t.
+func (s *runFiles) path(name string, t time.Time) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%s-%s%s", name, s.kind, t.UTC().Format("20060102T150405Z"), s.ext))
+}
+
+// prune removes all but the newest s.keep files for the VM named
+// name.
+func (s *runFiles) prune(name string) error {
+	if s.keep <= 0 {
+		return nil
+	}
+	logs, err := filepath.Glob(filepath.Join(s.dir, name+"-"+s.kind+"-*"+s.ext))
+	if err != nil {
+		return err
+	}
+	if len(logs) <= s.keep {
+		return nil
+	}
+	// Log names sort by their timestamp.
+	sort.Strings(logs)
+	for _, l := range logs[:len(logs)-s.keep] {
+		if err := os.Remove(l); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
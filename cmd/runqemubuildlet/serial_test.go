@@ -0,0 +1,78 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRunFilesPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := serialLogs(dir, 2)
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	var paths []string
+	for i := 0; i < 4; i++ {
+		p := s.path("vm0", start.Add(time.Duration(i)*time.Hour))
+		paths = append(paths, p)
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := s.path("vm1", start)
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	screen := (&runFiles{dir: dir, kind: "screen", ext: ".png"}).path("vm0", start)
+	if err := ioutil.WriteFile(screen, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.prune("vm0"); err != nil {
+		t.Fatalf("prune(%q) = %v, wanted no error", "vm0", err)
+	}
+	got, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{paths[2], paths[3], other}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("logs after prune mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(screen); err != nil {
+		t.Errorf("prune(%q) removed file of another kind: %v", "vm0", err)
+	}
+}
+
+func TestParseGCSURL(t *testing.T) {
+	cases := []struct {
+		url            string
+		bucket, prefix string
+		wantErr        bool
+	}{
+		{url: "gs://bucket/some/prefix/", bucket: "bucket", prefix: "some/prefix"},
+		{url: "gs://bucket", bucket: "bucket"},
+		{url: "https://bucket/prefix", wantErr: true},
+		{url: "gs:///prefix", wantErr: true},
+	}
+	for _, c := range cases {
+		bucket, prefix, err := parseGCSURL(c.url)
+		if (err != nil) != c.wantErr || bucket != c.bucket || prefix != c.prefix {
+			t.Errorf("parseGCSURL(%q) = %q, %q, %v, wanted %q, %q, wantErr: %t", c.url, bucket, prefix, err, c.bucket, c.prefix, c.wantErr)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Types of shareConfig.
+const (
+	share9P       = "9p"
+	shareVirtiofs = "virtiofs"
+)
+
+// shareConfig describes a host directory exported into the guest,
+// such as for staging buildlet binaries, caches, or collecting
+// artifacts.
+type shareConfig struct {
+	// Tag is the mount tag the guest mounts the share by, such as
+	// "cache" in "mount -t 9p -o trans=virtio cache /mnt/cache".
+	Tag string `yaml:"tag"`
+	// Path is the host directory to share.
+	Path string `yaml:"path"`
+	// Type is "9p", the default, or "virtiofs". virtiofs is faster
+	// but requires virtiofsd on a Linux host.
+	Type     string `yaml:"type"`
+	ReadOnly bool   `yaml:"read_only"`
+	// Virtiofsd is the path to virtiofsd, for virtiofs shares. It
+	// defaults to "virtiofsd" in $PATH.
+	Virtiofsd string `yaml:"virtiofsd"`
+	// Socket is the path of the virtiofsd socket. If empty, a socket
+	// in a temporary directory is used for each run.
+	Socket string `yaml:"socket"`
+}
+
+// parseShareFlag parses a -share flag of the form TAG=PATH into a 9p
+// share.
+func parseShareFlag(s string) (shareConfig, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return shareConfig{}, fmt.Errorf("-share %q, wanted TAG=PATH", s)
+	}
+	sh := shareConfig{Tag: s[:i], Path: s[i+1:]}
+	return sh, sh.validate()
+}
+
+// shareFlags implements flag.Value for repeated -share flags.
+type shareFlags []shareConfig
+
+func (f *shareFlags) String() string {
+	var s []string
+	for _, sh := range *f {
+		s = append(s, sh.Tag+"="+sh.Path)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *shareFlags) Set(s string) error {
+	sh, err := parseShareFlag(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, sh)
+	return nil
+}
+
+func (sh shareConfig) validate() error {
+	if sh.Tag == "" || sh.Path == "" {
+		return fmt.Errorf("share %+v must have a tag and path", sh)
+	}
+	switch sh.Type {
+	case "", share9P, shareVirtiofs:
+		return nil
+	}
+	return fmt.Errorf("share %s has type %q, wanted 9p or virtiofs", sh.Tag, sh.Type)
+}
+
+// virtiofsd returns the path to virtiofsd for the share.
+func (sh shareConfig) virtiofsd() string {
+	if sh.Virtiofsd == "" {
+		return "virtiofsd"
+	}
+	return sh.Virtiofsd
+}
+
+// shareArgs returns the QEMU arguments exporting the shares of c.
+func (c *vmConfig) shareArgs() []string {
+	var args []string
+	virtiofs := false
+	for i, sh := range c.Shares {
+		switch sh.Type {
+		case shareVirtiofs:
+			virtiofs = true
+			args = append(args,
+				"-chardev", fmt.Sprintf("socket,id=vfs%d,path=%s", i, qemuEscape(c.path(sh.Socket))),
+				"-device", fmt.Sprintf("vhost-user-fs-pci,chardev=vfs%d,tag=%s", i, sh.Tag))
+		default:
+			fsdev := fmt.Sprintf("local,id=fs%d,path=%s,security_model=mapped-xattr", i, qemuEscape(c.path(sh.Path)))
+			if sh.ReadOnly {
+				fsdev += ",readonly=on"
+			}
+			args = append(args,
+				"-fsdev", fsdev,
+				"-device", fmt.Sprintf("virtio-9p-pci,fsdev=fs%d,mount_tag=%s", i, sh.Tag))
+		}
+	}
+	if virtiofs {
+		// vhost-user devices require guest memory shared with
+		// virtiofsd.
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", c.MemoryMB),
+			"-numa", "node,memdev=mem")
+	}
+	return args
+}
+
+// startVirtiofsd starts virtiofsd for the virtiofs share sh of c, and
+// waits for its socket to be created.
+//
+// virtiofsd exits by itself once QEMU disconnects from the socket,
+// but the caller should still stop the returned command once the VM
+// has exited.
+func startVirtiofsd(ctx context.Context, c *vmConfig, sh shareConfig) (*exec.Cmd, error) {
+	sock := c.path(sh.Socket)
+	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	args := []string{"--socket-path=" + sock, "--shared-dir=" + c.path(sh.Path)}
+	if sh.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	cmd := exec.Command(sh.virtiofsd(), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cmd.Start() = %w", err)
+	}
+	if err := waitForFile(ctx, sock, virtiofsdSocketTimeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("virtiofsd socket %s not created: %w", sock, err)
+	}
+	return cmd, nil
+}
+
+// virtiofsdSocketTimeout is the maximum time to wait for virtiofsd to
+// create its socket.
+const virtiofsdSocketTimeout = 10 * time.Second
+
+// waitForFile waits up to timeout for a file to exist at path.
+func waitForFile(ctx context.Context, path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// smoketestPollInterval is how often the smoke test checks whether the
+// buildlet is healthy while the VM boots.
+const smoketestPollInterval = time.Second
+
+// smoketestResult is the outcome of a smoke test.
+type smoketestResult struct {
+	boot   time.Duration // from starting the VM until its buildlet was healthy
+	exec   time.Duration // running the command
+	total  time.Duration
+	output string // of the command
+	err    error  // the first step that failed, if any
+}
+
+// smoketestMain implements the smoketest subcommand, which boots the VM
+// of in, waits for its buildlet to become healthy, runs a command on it
+// over the buildlet API, and reports whether it passed, with timings.
+// It returns an error if the smoke test failed, so that it can gate
+// rollouts of new images.
+func smoketestMain(ctx context.Context, in *instance, args []string) error {
+	fs := flag.NewFlagSet("smoketest", flag.ContinueOnError)
+	command := fs.String("command", "cmd /c ver", "Command to run on the buildlet, and its arguments, separated by spaces. It is run outside of the buildlet's work directory, and must exit successfully.")
+	timeout := fs.Duration("timeout", 20*time.Minute, "Maximum time for booting the VM and running the command.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	f := strings.Fields(*command)
+	if len(f) == 0 {
+		return errors.New("empty -command")
+	}
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	r := runSmoketest(ctx, in, f[0], f[1:])
+	printSmoketest(os.Stdout, r)
+	return r.err
+}
+
+// smoketestSetup prepares insts for a smoke test of the image in
+// cfg.Base: it allocates their ports with -auto-ports, fetches
+// -image-url, and runs the preflight checks. Unlike a production start,
+// it neither records a start in the audit log, nor consumes the clean
+// host shutdown marker, nor repairs the disk images.
+func smoketestSetup(ctx context.Context, cfg *vmConfig, insts []*instance) error {
+	if *autoPorts {
+		if err := allocatePorts(insts, portFree); err != nil {
+			return fmt.Errorf("allocatePorts() = %w", err)
+		}
+	}
+	if *imageURL != "" {
+		if _, err := syncImage(ctx, *imageURL, cfg.Base); err != nil {
+			return fmt.Errorf("syncImage(_, %q, %q) = %w", *imageURL, cfg.Base, err)
+		}
+	}
+	return runPreflight(cfg, len(insts))
+}
+
+// runSmoketest boots the VM of in, and once its buildlet is healthy,
+// runs cmd with args on it. The VM is stopped before runSmoketest
+// returns.
+func runSmoketest(ctx context.Context, in *instance, cmd string, args []string) *smoketestResult {
+	r := new(smoketestResult)
+	start := time.Now()
+	vmctx, stopVM := context.WithCancelCause(ctx)
+	exited := make(chan struct{})
+	var runErr error // written before exited is closed
+	go func() {
+		defer close(exited)
+		runErr = runVM(vmctx, in)
+	}()
+	defer func() {
+		stopVM(&stopRequest{reason: "smoketest"})
+		<-exited
+	}()
+
+	if err := waitHealthy(ctx, in.healthzURL, exited); err != nil {
+		if err == errVMExited {
+			err = fmt.Errorf("%w: %v", err, runErr)
+		}
+		r.err = fmt.Errorf("waiting for buildlet: %w", err)
+		r.total = time.Since(start)
+		return r
+	}
+	r.boot = time.Since(start)
+
+	u, err := url.Parse(in.healthzURL)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	c := buildlet.NewClient(u.Host, buildlet.NoKeyPair)
+	defer c.Close()
+	var out bytes.Buffer
+	t := time.Now()
+	remoteErr, err := c.Exec(ctx, cmd, buildlet.ExecOpts{
+		Args:        args,
+		Output:      &out,
+		SystemLevel: true,
+	})
+	r.exec = time.Since(t)
+	r.total = time.Since(start)
+	r.output = out.String()
+	if err == nil {
+		err = remoteErr
+	}
+	if err != nil {
+		r.err = fmt.Errorf("running %q: %w", append([]string{cmd}, args...), err)
+	}
+	return r
+}
+
+// errVMExited is returned by waitHealthy if the VM exits first.
+var errVMExited = errors.New("VM exited")
+
+// waitHealthy polls healthzURL until it is healthy, returning an error
+// if ctx is done or exited is closed first.
+func waitHealthy(ctx context.Context, healthzURL string, exited <-chan struct{}) error {
+	t := time.NewTicker(smoketestPollInterval)
+	defer t.Stop()
+	for {
+		cctx, cancel := context.WithTimeout(ctx, buildletHealthTimeout)
+		err := checkBuildletHealth(cctx, healthzURL)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w; last health check: %v", ctx.Err(), err)
+		case <-exited:
+			return errVMExited
+		case <-t.C:
+		}
+	}
+}
+
+// printSmoketest writes a report of r to w.
+func printSmoketest(w io.Writer, r *smoketestResult) {
+	status := "PASS"
+	if r.err != nil {
+		status = "FAIL"
+	}
+	fmt.Fprintf(w, "%s\tboot %v\texec %v\ttotal %v\n", status, r.boot.Round(time.Millisecond), r.exec.Round(time.Millisecond), r.total.Round(time.Millisecond))
+	if r.err != nil {
+		fmt.Fprintf(w, "error: %v\n", r.err)
+	}
+	if r.output != "" {
+		fmt.Fprintf(w, "output:\n%s", r.output)
+		if !strings.HasSuffix(r.output, "\n") {
+			fmt.Fprintln(w)
+		}
+	}
+}
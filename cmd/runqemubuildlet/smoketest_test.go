@@ -0,0 +1,64 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitHealthy(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "booting", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := waitHealthy(ctx, srv.URL+"/healthz", nil); err != nil {
+		t.Errorf("waitHealthy() = %v, wanted no error", err)
+	}
+
+	exited := make(chan struct{})
+	close(exited)
+	if err := waitHealthy(ctx, srv.URL+"/status", exited); err != errVMExited {
+		t.Errorf("waitHealthy() after VM exited = %v, wanted %v", err, errVMExited)
+	}
+}
+
+func TestPrintSmoketest(t *testing.T) {
+	cases := []struct {
+		r    *smoketestResult
+		want string
+	}{
+		{
+			r:    &smoketestResult{boot: 90 * time.Second, exec: 1500 * time.Millisecond, total: 91500 * time.Millisecond, output: "Microsoft Windows [Version 10.0.19044.1288]"},
+			want: "PASS\tboot 1m30s\texec 1.5s\ttotal 1m31.5s\noutput:\nMicrosoft Windows [Version 10.0.19044.1288]\n",
+		},
+		{
+			r:    &smoketestResult{total: 20 * time.Minute, err: errors.New("waiting for buildlet: context deadline exceeded")},
+			want: "FAIL\tboot 0s\texec 0s\ttotal 20m0s\nerror: waiting for buildlet: context deadline exceeded\n",
+		},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		printSmoketest(&buf, c.r)
+		if got := buf.String(); got != c.want {
+			t.Errorf("printSmoketest(_, %+v) wrote %q, wanted %q", c.r, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// instanceStatus is the status of an instance, as served by /status.
+type instanceStatus struct {
+	Name         string        `json:"name"`
+	Guest        string        `json:"guest"`
+	HealthzURL   string        `json:"healthz_url"`
+	VNC          string        `json:"vnc,omitempty"`
+	PortForwards []portForward `json:"port_forwards,omitempty"`
+	// RDPPort is the host port forwarded to the guest's Remote
+	// Desktop port, if any.
+	RDPPort int `json:"rdp_port,omitempty"`
+
+	// RunID and Phase describe the current or most recent run.
+	RunID   string     `json:"run_id,omitempty"`
+	Phase   string     `json:"phase,omitempty"`
+	Started *time.Time `json:"started,omitempty"`
+	Uptime  string     `json:"uptime,omitempty"`
+	// BootDuration is the time from starting the current run until
+	// its buildlet was first healthy.
+	BootDuration string `json:"boot_duration,omitempty"`
+	Runs         int    `json:"runs"`
+
+	// LastExitReason is why the most recent run to exit ended, such as
+	// "heartbeat", and LastExitCode QEMU's exit status if it crashed.
+	LastExitReason string `json:"last_exit_reason,omitempty"`
+	LastExitCode   int    `json:"last_exit_code,omitempty"`
+
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+
+	// Probes are the results of the most recent heartbeat probes,
+	// oldest first, including those of earlier runs.
+	Probes []probeResult `json:"probes,omitempty"`
+}
+
+// status returns the current status of the instance.
+func (in *instance) status() instanceStatus {
+	cfg := in.config()
+	s := instanceStatus{
+		Name:         in.name,
+		Guest:        cfg.Name,
+		HealthzURL:   in.healthzURL,
+		VNC:          cfg.VNC,
+		PortForwards: cfg.Network.PortForwards,
+		RDPPort:      rdpPort(cfg),
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	s.Runs = in.runs
+	s.LastExitReason = in.exit
+	s.LastExitCode = in.exitCode
+	if in.lg != nil {
+		s.RunID = in.lg.id
+		s.Phase = in.lg.currentPhase()
+		t := in.started
+		s.Started = &t
+		if in.bootTime > 0 {
+			s.BootDuration = in.bootTime.Round(time.Second).String()
+		}
+		if s.Phase != phaseExited && s.Phase != phaseKilled {
+			s.Uptime = time.Since(in.started).Round(time.Second).String()
+		}
+	}
+	s.Probes = in.probes.results()
+	if in.lastErr != nil {
+		t := in.lastErrAt
+		s.LastError = in.lastErr.Error()
+		s.LastErrorTime = &t
+	}
+	return s
+}
+
+// statusHandler returns an http.Handler serving the status of insts,
+// and whether they are draining according to d, as JSON.
+func statusHandler(insts []*instance, d *drainer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ss []instanceStatus
+		for _, in := range insts {
+			ss = append(ss, in.status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Draining  bool             `json:"draining"`
+			Instances []instanceStatus `json:"instances"`
+		}{d.draining(), ss})
+	})
+}
+
+// newStatusMux returns an http.ServeMux serving /healthz, /status,
+// /drain, and /debug/pprof/ for the runqemubuildlet process and insts.
+//
+// /healthz reports the health of runqemubuildlet itself, so that
+// monitoring can distinguish a dead host process from an unhealthy
+// guest. A POST to /drain requests draining from d.
+func newStatusMux(insts []*instance, d *drainer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/status", statusHandler(insts, d))
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "requires POST method", http.StatusMethodNotAllowed)
+			return
+		}
+		slog.Info("Drain requested over HTTP", "remote_addr", r.RemoteAddr)
+		audit.record("drain", "http", httpRequester(r))
+		d.drain()
+		fmt.Fprintln(w, "draining")
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
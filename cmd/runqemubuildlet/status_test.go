@@ -0,0 +1,71 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatusMux(t *testing.T) {
+	in := newInstance("vm", windows10Config("/base"), "http://localhost:8080/healthz")
+	lg := newRunLogger(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	in.startRun(lg)
+	in.setBootDuration(90 * time.Second)
+	lg.setPhase(phaseHealthy, "Buildlet healthy")
+	in.recordProbe(lg, time.Now(), 250*time.Millisecond, errors.New("connection refused"))
+	in.finishRun(errors.New("boom"))
+	s := httptest.NewServer(newStatusMux([]*instance{in}, newDrainer()))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz status = %v, wanted %v", resp.StatusCode, http.StatusOK)
+	}
+
+	resp, err = http.Get(s.URL + "/status")
+	if err != nil {
+		t.Fatalf("GET /status: %v", err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Instances []instanceStatus `json:"instances"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding /status: %v", err)
+	}
+	if len(got.Instances) != 1 {
+		t.Fatalf("len(/status instances) = %d, wanted 1", len(got.Instances))
+	}
+	st := got.Instances[0]
+	if st.Name != "vm" || st.RunID != lg.id || st.Phase != phaseHealthy || st.Runs != 1 {
+		t.Errorf("/status = %+v, wanted name vm, run_id %s, phase %s, and 1 run", st, lg.id, phaseHealthy)
+	}
+	if st.LastError != "boom" || st.LastErrorTime == nil {
+		t.Errorf("/status last error = %q at %v, wanted %q with a time", st.LastError, st.LastErrorTime, "boom")
+	}
+	if st.Uptime == "" {
+		t.Errorf("/status uptime is empty, wanted uptime of a healthy VM")
+	}
+	if st.BootDuration != "1m30s" {
+		t.Errorf("/status boot_duration = %q, wanted %q", st.BootDuration, "1m30s")
+	}
+	if len(st.Probes) != 1 || st.Probes[0].RunID != lg.id || st.Probes[0].Latency != "250ms" || st.Probes[0].Error != "connection refused" {
+		t.Errorf("/status probes = %+v, wanted one failed probe of run %s taking 250ms", st.Probes, lg.id)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/build/internal"
+)
+
+// stopSignalsFlag is the -stop-signals flag: the signals sent to QEMU,
+// in order, to stop it, each followed by how long to wait for it to
+// exit before sending the next.
+type stopSignalsFlag []internal.StopStep
+
+func (f *stopSignalsFlag) String() string {
+	var steps []string
+	for _, s := range *f {
+		name := s.Signal.String()
+		for n, sig := range stopSignalNames {
+			if sig == s.Signal {
+				name = n
+			}
+		}
+		if s.Wait > 0 {
+			name += "=" + s.Wait.String()
+		}
+		steps = append(steps, name)
+	}
+	return strings.Join(steps, ",")
+}
+
+func (f *stopSignalsFlag) Set(s string) error {
+	var steps []internal.StopStep
+	for _, step := range strings.Split(s, ",") {
+		name, wait, hasWait := strings.Cut(step, "=")
+		name = strings.TrimSpace(name)
+		sig, ok := stopSignalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+		if !ok {
+			var names []string
+			for n := range stopSignalNames {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown signal %q, wanted one of %s", name, strings.Join(names, ", "))
+		}
+		st := internal.StopStep{Signal: sig}
+		if hasWait {
+			d, err := time.ParseDuration(strings.TrimSpace(wait))
+			if err != nil {
+				return err
+			}
+			if d <= 0 {
+				return fmt.Errorf("%s wait %v must be positive", name, d)
+			}
+			st.Wait = d
+		}
+		steps = append(steps, st)
+	}
+	for i, st := range steps[:len(steps)-1] {
+		if st.Wait == 0 {
+			return fmt.Errorf("signal %d of %d has no wait, so the rest would never be sent", i+1, len(steps))
+		}
+	}
+	*f = steps
+	return nil
+}
+
+// stopSignals is the -stop-signals flag.
+var stopSignals stopSignalsFlag
+
+// stopPolicy returns how to stop QEMU: with -stop-signals, or else by
+// interrupting it, and killing it after -kill-delay.
+func stopPolicy() internal.StopPolicy {
+	steps := []internal.StopStep(stopSignals)
+	if len(steps) == 0 {
+		steps = []internal.StopStep{{Signal: os.Interrupt, Wait: *killDelay}}
+		if *killDelay > 0 {
+			steps = append(steps, internal.StopStep{Signal: os.Kill})
+		}
+	}
+	return internal.StopPolicy{Steps: steps, Group: *stopProcessGroup}
+}
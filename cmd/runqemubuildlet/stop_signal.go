@@ -0,0 +1,21 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21 && !windows && !plan9
+// +build go1.21,!windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignalNames are the signals -stop-signals accepts.
+var stopSignalNames = map[string]os.Signal{
+	"INT":  os.Interrupt,
+	"TERM": syscall.SIGTERM,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": os.Kill,
+}
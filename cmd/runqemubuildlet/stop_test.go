@@ -0,0 +1,64 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/build/internal"
+)
+
+func TestStopSignalsFlag(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    []internal.StopStep
+		wantStr string
+		wantErr bool
+	}{
+		{
+			in:      "INT=1m,KILL",
+			want:    []internal.StopStep{{Signal: os.Interrupt, Wait: time.Minute}, {Signal: os.Kill}},
+			wantStr: "INT=1m0s,KILL",
+		},
+		{
+			in:      "sigint = 30s, SIGKILL",
+			want:    []internal.StopStep{{Signal: os.Interrupt, Wait: 30 * time.Second}, {Signal: os.Kill}},
+			wantStr: "INT=30s,KILL",
+		},
+		{
+			in:      "KILL",
+			want:    []internal.StopStep{{Signal: os.Kill}},
+			wantStr: "KILL",
+		},
+		{in: "USR1", wantErr: true},
+		{in: "INT=soon,KILL", wantErr: true},
+		{in: "INT=0s,KILL", wantErr: true},
+		// KILL would never be sent.
+		{in: "INT,KILL", wantErr: true},
+	}
+	for _, c := range cases {
+		var f stopSignalsFlag
+		err := f.Set(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Set(%q) = %v, wanted error %t", c.in, err, c.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if diff := cmp.Diff(c.want, []internal.StopStep(f)); diff != "" {
+			t.Errorf("Set(%q) mismatch (-want +got):\n%s", c.in, diff)
+		}
+		if got := f.String(); got != c.wantStr {
+			t.Errorf("Set(%q); String() = %q, wanted %q", c.in, got, c.wantStr)
+		}
+	}
+}
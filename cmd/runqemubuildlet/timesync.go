@@ -0,0 +1,94 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// timeSyncInterval is how often the guest clock is checked once
+	// it has been set.
+	timeSyncInterval = time.Minute
+	// timeSyncRetry is how often the guest agent is tried until the
+	// guest clock has first been set, such as while the guest boots.
+	timeSyncRetry = 10 * time.Second
+)
+
+// guestClockSkew returns how far the clock of the guest behind the
+// guest agent q is ahead of the host's, as returned by now, measured
+// against the midpoint of the request.
+func guestClockSkew(ctx context.Context, q *qmpClient, now func() time.Time) (time.Duration, error) {
+	start := now()
+	var ns int64
+	if err := q.execute(ctx, "guest-get-time", nil, &ns); err != nil {
+		return 0, err
+	}
+	end := now()
+	mid := start.Add(end.Sub(start) / 2)
+	return time.Unix(0, ns).Sub(mid), nil
+}
+
+// syncGuestClock measures the skew of the clock of the guest whose
+// agent listens on the unix socket at path, and if its magnitude
+// exceeds maxSkew, or force is set, sets the guest clock to the host's.
+func syncGuestClock(ctx context.Context, path string, maxSkew time.Duration, force bool) (skew time.Duration, set bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, guestAgentTimeout)
+	defer cancel()
+	q, err := dialQGA(ctx, path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer q.Close()
+	skew, err = guestClockSkew(ctx, q, time.Now)
+	if err != nil {
+		return 0, false, err
+	}
+	if !force && skew <= maxSkew && skew >= -maxSkew {
+		return skew, false, nil
+	}
+	args := map[string]int64{"time": time.Now().UnixNano()}
+	if err := q.execute(ctx, "guest-set-time", args, nil); err != nil {
+		return skew, false, err
+	}
+	return skew, true, nil
+}
+
+// runTimeSync keeps the clock of the guest whose agent listens on the
+// unix socket at path within maxSkew of the host's until ctx is done.
+// The guest clock is set as soon as the agent responds, since it starts
+// from the host's RTC at boot, and is then checked every
+// timeSyncInterval.
+func runTimeSync(ctx context.Context, lg *runLogger, path string, maxSkew time.Duration) {
+	synced := false
+	t := time.NewTimer(timeSyncRetry)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		skew, set, err := syncGuestClock(ctx, path, maxSkew, !synced)
+		switch {
+		case err != nil && !synced:
+			// The guest is likely still booting.
+			t.Reset(timeSyncRetry)
+			continue
+		case err != nil:
+			lg.Warn("Checking guest clock failed", "err", err)
+		case set && !synced:
+			lg.Info("Set guest clock", "skew", skew)
+		case set:
+			lg.Warn("Guest clock drifted; set it again", "skew", skew, "max_skew", maxSkew)
+		}
+		synced = synced || set
+		t.Reset(timeSyncInterval)
+	}
+}
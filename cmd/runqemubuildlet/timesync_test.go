@@ -0,0 +1,31 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSyncGuestClock(t *testing.T) {
+	path := serveFakeQGA(t, "5.2.0")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	skew, set, err := syncGuestClock(ctx, path, time.Minute, false)
+	if err != nil {
+		t.Fatalf("syncGuestClock() = _, _, %v, wanted no error", err)
+	}
+	if skew > -59*time.Minute || skew < -61*time.Minute {
+		t.Errorf("syncGuestClock() skew = %v, wanted about -1h", skew)
+	}
+	if !set {
+		t.Errorf("syncGuestClock() set = false, wanted the guest clock set")
+	}
+}
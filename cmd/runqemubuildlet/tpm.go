@@ -0,0 +1,74 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// tpmSocketTimeout is the maximum time to wait for swtpm to create its
+// control socket.
+const tpmSocketTimeout = 10 * time.Second
+
+// tpmConfig describes an emulated TPM 2.0 device backed by swtpm.
+type tpmConfig struct {
+	// Binary is the path to swtpm. It defaults to "swtpm" in $PATH.
+	Binary string `yaml:"binary"`
+	// StateDir holds the persistent TPM state and the swtpm control
+	// socket.
+	StateDir string `yaml:"state_dir"`
+}
+
+// tpmSocket returns the path to the swtpm control socket.
+func (c *vmConfig) tpmSocket() string {
+	return filepath.Join(c.path(c.TPM.StateDir), "swtpm-sock")
+}
+
+// startTPM starts swtpm for the TPM described by c, and waits for its
+// control socket to be created.
+//
+// swtpm exits by itself once QEMU disconnects from the socket, but
+// the caller should still stop the returned command once the VM has
+// exited.
+func startTPM(ctx context.Context, c *vmConfig) (*exec.Cmd, error) {
+	dir := c.path(c.TPM.StateDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	sock := c.tpmSocket()
+	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	bin := c.TPM.Binary
+	if bin == "" {
+		bin = "swtpm"
+	}
+	cmd := exec.Command(bin, "socket",
+		"--tpm2",
+		"--tpmstate", "dir="+dir,
+		"--ctrl", "type=unixio,path="+sock,
+		"--terminate",
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cmd.Start() = %w", err)
+	}
+
+	if err := waitForFile(ctx, sock, tpmSocketTimeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("swtpm socket %s not created: %w", sock, err)
+	}
+	return cmd, nil
+}
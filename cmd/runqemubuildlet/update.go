@@ -0,0 +1,151 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxBinarySize is the largest runqemubuildlet binary the updater
+// downloads.
+const maxBinarySize = 256 << 20
+
+// updater replaces the runqemubuildlet binary with a newer one
+// published at url, such as a GCS object's public URL.
+//
+// Each release is published alongside url+".sig", the base64-encoded
+// Ed25519 signature of the binary by the private key for key. A
+// binary is installed only if its signature verifies, and the
+// signature doubles as a version: the running binary is up to date if
+// the published signature verifies against it.
+type updater struct {
+	url string
+	key ed25519.PublicKey
+	exe string // path of the running binary
+}
+
+// parseUpdateKey parses a base64-encoded Ed25519 public key.
+func parseUpdateKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, wanted %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// check downloads and installs the published binary if it differs
+// from the running one, and reports whether it did.
+func (u *updater) check(ctx context.Context) (bool, error) {
+	sigText, err := fetch(ctx, u.url+".sig", 1<<10)
+	if err != nil {
+		return false, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil {
+		return false, fmt.Errorf("decoding %s.sig: %w", u.url, err)
+	}
+	cur, err := ioutil.ReadFile(u.exe)
+	if err != nil {
+		return false, err
+	}
+	if ed25519.Verify(u.key, cur, sig) {
+		return false, nil
+	}
+	bin, err := fetch(ctx, u.url, maxBinarySize)
+	if err != nil {
+		return false, err
+	}
+	if !ed25519.Verify(u.key, bin, sig) {
+		// Possibly a release in progress; try again later.
+		return false, fmt.Errorf("signature of %s does not verify", u.url)
+	}
+	return true, u.install(bin)
+}
+
+// install atomically replaces the running binary with bin.
+func (u *updater) install(bin []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(u.exe), filepath.Base(u.exe)+".new")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bin); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0755); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), u.exe)
+}
+
+// run checks for updates every interval until ctx is done or an
+// update is installed, in which case it closes installed.
+func (u *updater) run(ctx context.Context, interval time.Duration, installed chan<- struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ok, err := u.check(ctx)
+		switch {
+		case err != nil:
+			slog.Warn("Checking for update failed", "url", u.url, "err", err)
+		case ok:
+			slog.Info("Installed update; restarting once VMs are drained", "url", u.url, "path", u.exe)
+			close(installed)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// fetch returns the body of url, which must be at most max bytes.
+func fetch(ctx context.Context, url string, max int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %v", url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, errors.New("GET " + url + ": response too large")
+	}
+	return b, nil
+}
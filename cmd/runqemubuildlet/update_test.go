@@ -0,0 +1,88 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdaterCheck(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldBin, newBin := []byte("old binary"), []byte("new binary")
+
+	cases := []struct {
+		desc    string
+		bin     []byte
+		sig     []byte
+		want    bool
+		wantErr bool
+		wantExe []byte
+	}{
+		{desc: "up to date", bin: oldBin, sig: ed25519.Sign(priv, oldBin), wantExe: oldBin},
+		{desc: "update", bin: newBin, sig: ed25519.Sign(priv, newBin), want: true, wantExe: newBin},
+		{desc: "bad signature", bin: newBin, sig: ed25519.Sign(otherPriv, newBin), wantErr: true, wantExe: oldBin},
+	}
+	for _, c := range cases {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/runqemubuildlet":
+				w.Write(c.bin)
+			case "/runqemubuildlet.sig":
+				w.Write([]byte(base64.StdEncoding.EncodeToString(c.sig) + "\n"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		exe := filepath.Join(t.TempDir(), "runqemubuildlet")
+		if err := ioutil.WriteFile(exe, oldBin, 0755); err != nil {
+			t.Fatal(err)
+		}
+		u := &updater{url: s.URL + "/runqemubuildlet", key: pub, exe: exe}
+		got, err := u.check(context.Background())
+		s.Close()
+		if got != c.want || (err != nil) != c.wantErr {
+			t.Errorf("%s: check() = %t, %v, wanted %t, wantErr: %t", c.desc, got, err, c.want, c.wantErr)
+		}
+		b, err := ioutil.ReadFile(exe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, c.wantExe) {
+			t.Errorf("%s: binary after check() = %q, wanted %q", c.desc, b, c.wantExe)
+		}
+	}
+}
+
+func TestParseUpdateKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := base64.StdEncoding.EncodeToString(pub)
+	if got, err := parseUpdateKey(s + "\n"); err != nil || !bytes.Equal(got, pub) {
+		t.Errorf("parseUpdateKey(%q) = %x, %v, wanted %x", s, got, err, pub)
+	}
+	if _, err := parseUpdateKey("c2hvcnQ="); err == nil {
+		t.Errorf("parseUpdateKey(%q) = _, nil, wanted error", "c2hvcnQ=")
+	}
+}
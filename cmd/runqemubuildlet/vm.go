@@ -0,0 +1,410 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/build/internal"
+	"golang.org/x/build/internal/heartbeat"
+)
+
+// runVM runs a single instance of a VM until it exits, ctx is done, or
+// its buildlet fails its heartbeat.
+func runVM(ctx context.Context, inst *instance) error {
+	lg := newRunLogger(inst.logger)
+	lg.onPhase = func(phase, msg string, args []interface{}) {
+		events.report(inst.newEvent(lg, phase, msg, args))
+	}
+	run := inst.startRun(lg)
+
+	tmp, err := ioutil.TempDir("", "runqemubuildlet-"+inst.name)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg := inst.runConfig(tmp, run)
+	lg.Info("Configured run", "name", cfg.Name, "mac", cfg.Network.MAC)
+	if cfg.TPM != nil {
+		tpm, err := startTPM(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("startTPM() = %w", err)
+		}
+		defer func() {
+			tpm.Process.Kill()
+			tpm.Wait()
+		}()
+	}
+	for _, sh := range cfg.Shares {
+		if sh.Type != shareVirtiofs || cfg.isVZ() {
+			// The Virtualization framework serves virtiofs
+			// shares itself.
+			continue
+		}
+		vfsd, err := startVirtiofsd(ctx, cfg, sh)
+		if err != nil {
+			return fmt.Errorf("startVirtiofsd(%q) = %w", sh.Tag, err)
+		}
+		defer func() {
+			vfsd.Process.Kill()
+			vfsd.Wait()
+		}()
+	}
+	if cfg.isVZ() && cfg.Snapshot {
+		if err := snapshotVZDrives(cfg, tmp); err != nil {
+			return fmt.Errorf("snapshotVZDrives() = %w", err)
+		}
+	}
+	if *scratchDiskGB > 0 {
+		d, err := createScratchDisk(ctx, cfg, tmp, *scratchDiskGB)
+		if err != nil {
+			return fmt.Errorf("createScratchDisk() = %w", err)
+		}
+		cfg.Drives = append(cfg.Drives, d)
+	}
+	if cfg.CloudInit != nil {
+		iso, cleanup, err := makeSeedISO(inst.name, cfg)
+		if err != nil {
+			return fmt.Errorf("makeSeedISO() = %w", err)
+		}
+		defer cleanup()
+		cfg.Drives = append(cfg.Drives, seedDrive(iso))
+	}
+	if cfg.Provision != nil {
+		if err := provision(cfg, cfg.Name, tmp); err != nil {
+			return fmt.Errorf("provision() = %w", err)
+		}
+	}
+	// reason is why the VM exited, set once QEMU has exited.
+	reason := exitError
+	if *overlayDir != "" {
+		ovs, err := createOverlays(ctx, cfg, *overlayDir, lg.id)
+		if err != nil {
+			return fmt.Errorf("createOverlays() = %w", err)
+		}
+		defer func() {
+			finishOverlays(lg, cfg, ovs, reason)
+		}()
+	}
+	var serialLog string
+	if *serialLogDir != "" {
+		sl := serialLogs(*serialLogDir, *serialLogKeep)
+		if err := os.MkdirAll(sl.dir, 0755); err != nil {
+			return err
+		}
+		serialLog = sl.path(inst.name, time.Now())
+		cfg.Serial = "file:" + serialLog
+		defer func() {
+			if err := sl.prune(inst.name); err != nil {
+				lg.Warn("Pruning serial logs failed", "err", err)
+			}
+		}()
+	}
+	hcs, err := inst.healthCheckers(cfg)
+	if err != nil {
+		return fmt.Errorf("healthCheckers() = %w", err)
+	}
+	cmd := applyQoS(cfg.command(), currentQoS())
+	if *stopProcessGroup {
+		internal.SetProcessGroup(cmd)
+	}
+	lg.Info("Starting VM", "cmd", cmd.String())
+	cmd.Stdout = os.Stdout
+	stderr := &tailBuffer{max: maxStderrTail}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	// fatal receives the first fatal output of the run, if watched.
+	fatal := make(chan error, 1)
+	if *fatalPatterns && *mode != modeMaintenance {
+		ow, err := newOutputWatcher(append(append([]fatalPattern(nil), defaultFatalPatterns...), cfg.FatalPatterns...), func(e *fatalOutputError) {
+			fatal <- e
+		})
+		if err != nil {
+			return err
+		}
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, ow.writer())
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, ow.writer())
+		if p := cfg.serialLogPath(); p != "" {
+			os.Remove(p) // Don't match output of a previous run.
+			tctx, tcancel := context.WithCancel(ctx)
+			defer tcancel()
+			go tailFile(tctx, p, ow.writer(), serialTailInterval)
+		}
+	}
+	m := startVMMetrics(inst.name)
+	if err := cmd.Start(); err != nil {
+		inst.setExit(exitError, 0)
+		m.exit(exitError)
+		return fmt.Errorf("cmd.Start() = %w", err)
+	}
+	lg.setPhase(phaseBooting, "VM started", "pid", cmd.Process.Pid)
+	if inst.vncPassword != "" {
+		if err := setVNCPassword(ctx, cfg.path(cfg.QMPSocket), inst.vncPassword); err != nil {
+			lg.Warn("Setting VNC password failed; VNC logins will be refused", "err", err)
+		}
+	}
+	probe := func(ctx context.Context) error {
+		start := time.Now()
+		err := checkAll(ctx, hcs, *probeTimeout)
+		now := time.Now()
+		m.probe(now, err)
+		inst.recordProbe(lg, start, now.Sub(start), err)
+		switch {
+		case err != nil:
+			lg.Warn("Health check failed", "err", err)
+		case lg.currentPhase() == phaseBooting:
+			d := time.Since(m.started)
+			inst.setBootDuration(d)
+			lg.setPhase(phaseHealthy, "Buildlet healthy", "boot_duration", d)
+		}
+		return err
+	}
+	if cfg.Balloon != nil {
+		bctx, bcancel := context.WithCancel(ctx)
+		defer bcancel()
+		go inst.runBalloon(bctx, lg, cfg, cfg.path(cfg.QMPSocket))
+	}
+	if cfg.GuestAgent && *maxClockSkew > 0 {
+		tctx, tcancel := context.WithCancel(ctx)
+		defer tcancel()
+		go runTimeSync(tctx, lg, cfg.path(cfg.GuestAgentSocket), *maxClockSkew)
+	}
+	// hctx is done once the VM should be stopped, with a cause saying
+	// why.
+	var hctx context.Context
+	var cancel context.CancelCauseFunc
+	if *mode == modeMaintenance {
+		// Updates may keep the guest rebooting, or without a
+		// buildlet, for a long time. Leave it to the operator.
+		hctx, cancel = context.WithCancelCause(ctx)
+	} else {
+		hctx, cancel = heartbeat.Context(ctx, heartbeat.Options{
+			Interval: cfg.Heartbeat.interval(),
+			Timeout:  cfg.Heartbeat.timeout(),
+			Failures: *heartbeatFailures,
+			OnUnhealthy: func(cause error) {
+				go inst.notify(notifyUnhealthy, "VM failed its heartbeat", cause)
+			},
+		}, probe)
+	}
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-hctx.Done():
+		case err := <-fatal:
+			lg.Warn("VM output matched fatal pattern", "err", err)
+			cancel(err)
+		}
+	}()
+	if *bootTimeout > 0 && *mode != modeMaintenance {
+		t := time.AfterFunc(*bootTimeout, func() {
+			if lg.currentPhase() == phaseBooting {
+				lg.Warn("Buildlet not healthy before boot timeout", "timeout", *bootTimeout)
+				cancel(errBootTimeout)
+			}
+		})
+		defer t.Stop()
+	}
+
+	// Once the heartbeat fails, ask the guest to shut down cleanly
+	// before stopping QEMU. Killing QEMU outright risks corrupting
+	// writable disk images.
+	stopCtx, stop := context.WithCancelCause(context.Background())
+	defer stop(nil)
+	stopped := make(chan struct{})
+	var screenshot string // written before stopped is closed
+	go func() {
+		defer close(stopped)
+		select {
+		case <-stopCtx.Done():
+			return
+		case <-hctx.Done():
+		}
+		lg.setPhase(phaseDraining, "Stopping VM", "cause", context.Cause(hctx))
+		if ctx.Err() == nil && *screenshotDir != "" && !cfg.isVZ() {
+			// The heartbeat failed. Capture what the guest is
+			// showing, such as a crash or a stuck update, before
+			// shutting it down.
+			path, err := captureScreen(stopCtx, cfg.path(cfg.QMPSocket), inst.name, *screenshotDir, *serialLogKeep)
+			if err != nil {
+				lg.Warn("Capturing screenshot failed", "err", err)
+			} else {
+				lg.Info("Captured screenshot", "path", path)
+				screenshot = path
+			}
+		}
+		var fe *fatalOutputError
+		switch {
+		case errors.As(context.Cause(hctx), &fe):
+			// The guest cannot shut down cleanly.
+		case cfg.isVZ():
+			stopVZGuest(stopCtx, lg, cfg.path(cfg.VZ.Socket), shutdownGraceFor(context.Cause(hctx)))
+		default:
+			powerdownGuest(stopCtx, lg, cfg.path(cfg.QMPSocket), shutdownGraceFor(context.Cause(hctx)))
+		}
+		stop(context.Cause(hctx))
+	}()
+	policy := stopPolicy()
+	err = internal.WaitOrStopPolicy(stopCtx, cmd, policy)
+	stop(nil)
+	<-stopped
+	reason, code := exitReason(hctx, err)
+	inst.setExit(reason, code)
+	// Unless it was stopped, QEMU exited by itself after the guest
+	// shut down.
+	inst.setGuestShutDown(err == nil)
+	m.exit(reason)
+	switch {
+	case reason == exitCrash:
+		lg.setPhase(phaseExited, "VM crashed", "reason", reason, "exit_code", code, "err", err)
+	case reason == exitClean || reason == exitError:
+		lg.setPhase(phaseExited, "VM exited", "reason", reason, "err", err)
+	default:
+		lg.setPhase(phaseKilled, "VM stopped", "reason", reason, "cause", context.Cause(hctx), "err", err)
+	}
+	if *artifactUpload != "" && abnormalExit(reason) {
+		uctx, ucancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer ucancel()
+		if err := uploadRunArtifacts(uctx, *artifactUpload, inst, lg, cmd.Args, reason, err, stderr.Bytes(), []string{serialLog, screenshot}, *artifactRetention); err != nil {
+			lg.Warn("Uploading run artifacts failed", "err", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("WaitOrStopPolicy(_, %v, %v) = %w", cmd, (*stopSignalsFlag)(&policy.Steps), err)
+	}
+	if hctx.Err() != nil {
+		return fmt.Errorf("VM stopped: %w", context.Cause(hctx))
+	}
+	return nil
+}
+
+// runConfig returns a copy of the instance's config for its run
+// numbered run, with temporary directory tmp, which holds its control
+// sockets unless configured otherwise.
+//
+// The VM is named after the host, instance, and run, and unless the
+// config sets one, gets a MAC address derived from its name, so that
+// DHCP leases, ARP caches, and the coordinator's logs can tell
+// concurrent and successive runs apart.
+func (inst *instance) runConfig(tmp string, run int) *vmConfig {
+	cfg := inst.config().clone()
+	cfg.Name = runName(inst.name, run)
+	if cfg.Network.Device != "" && cfg.Network.MAC == "" {
+		cfg.Network.MAC = runMAC(cfg.Name)
+	}
+	switch {
+	case cfg.isVZ():
+		vzRunConfig(cfg, tmp)
+	case cfg.QMPSocket == "":
+		cfg.QMPSocket = filepath.Join(tmp, "qmp.sock")
+	}
+	if cfg.GuestAgent && cfg.GuestAgentSocket == "" {
+		cfg.GuestAgentSocket = filepath.Join(tmp, "qga.sock")
+	}
+	for i := range cfg.Shares {
+		if sh := &cfg.Shares[i]; sh.Type == shareVirtiofs && sh.Socket == "" {
+			sh.Socket = filepath.Join(tmp, fmt.Sprintf("virtiofs-%s.sock", sh.Tag))
+		}
+	}
+	return cfg
+}
+
+// runName returns the name of the run numbered run of the instance
+// named name on this host, such as "host1-vm0-3".
+func runName(name string, run int) string {
+	host, _ := os.Hostname()
+	if i := strings.Index(host, "."); i >= 0 {
+		host = host[:i]
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s-%s-%d", host, name, run)
+}
+
+// runMAC returns a locally administered unicast MAC address derived
+// from name.
+func runMAC(name string) string {
+	h := sha256.Sum256([]byte(name))
+	h[0] = h[0]&^0x01 | 0x02
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", h[0], h[1], h[2], h[3], h[4], h[5])
+}
+
+// errBootTimeout is the cause of stopping a VM whose buildlet did not
+// become healthy within -boot-timeout.
+var errBootTimeout = errors.New("buildlet not healthy before boot timeout")
+
+// exitReason classifies why a VM exited, given its heartbeat context,
+// whose cause says why runqemubuildlet stopped the VM if it did, and
+// the error returned while waiting for it. If QEMU crashed, it also
+// returns its exit status.
+func exitReason(hctx context.Context, err error) (reason string, code int) {
+	var sr *stopRequest
+	var fe *fatalOutputError
+	var ee *exec.ExitError
+	cause := context.Cause(hctx)
+	switch {
+	case errors.Is(cause, errBootTimeout):
+		return exitBootTimeout, 0
+	case errors.As(cause, &fe):
+		return exitFatalOutput, 0
+	case errors.Is(cause, heartbeat.ErrTimeout):
+		return exitHeartbeat, 0
+	case errors.As(cause, &sr):
+		return exitStopped, 0
+	case errors.Is(cause, errLeaseLost):
+		return exitLeaseLost, 0
+	case cause != nil:
+		// runqemubuildlet is shutting down, such as with a
+		// *signalError.
+		return exitSignal, 0
+	case errors.As(err, &ee):
+		return exitCrash, ee.ExitCode()
+	case err != nil:
+		return exitError, 0
+	}
+	return exitClean, 0
+}
+
+// finishOverlays commits or removes the overlays of a VM run that
+// exited for reason, according to -persist and -keep-failed-overlays.
+func finishOverlays(lg *runLogger, c *vmConfig, ovs []overlay, reason string) {
+	if *keepOverlays && abnormalExit(reason) {
+		for _, ov := range ovs {
+			lg.Info("Keeping overlay of failed run", "path", ov.path, "backing", ov.backing)
+		}
+		return
+	}
+	if *persist {
+		if reason != exitClean {
+			lg.Warn("Not committing overlays of VM that did not shut down cleanly", "reason", reason)
+			for _, ov := range ovs {
+				lg.Info("Keeping overlay", "path", ov.path, "backing", ov.backing)
+			}
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+		if err := commitOverlays(ctx, c, ovs); err != nil {
+			lg.Error("Committing overlays failed", "err", err)
+			return
+		}
+		lg.Info("Committed overlays to disk images")
+	}
+	removeOverlays(ovs)
+}
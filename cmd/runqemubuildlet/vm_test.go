@@ -0,0 +1,56 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"golang.org/x/build/internal/heartbeat"
+)
+
+func TestExitReason(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exiting with a status requires a shell")
+	}
+	crash := exec.Command("sh", "-c", "exit 3").Run()
+	cancelled := func(cause error) context.Context {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(cause)
+		return ctx
+	}
+	cases := []struct {
+		desc     string
+		hctx     context.Context
+		err      error
+		want     string
+		wantCode int
+	}{
+		{desc: "clean", hctx: context.Background(), want: exitClean},
+		{desc: "crash", hctx: context.Background(), err: crash, want: exitCrash, wantCode: 3},
+		{desc: "error", hctx: context.Background(), err: errors.New("wait failed"), want: exitError},
+		{desc: "heartbeat", hctx: cancelled(fmt.Errorf("%w: unhealthy", heartbeat.ErrTimeout)), want: exitHeartbeat},
+		{desc: "boot timeout", hctx: cancelled(errBootTimeout), err: errBootTimeout, want: exitBootTimeout},
+		{desc: "fatal output", hctx: cancelled(&fatalOutputError{pattern: "bsod", line: "STOP: 0x0000007B"}), want: exitFatalOutput},
+		{desc: "recycle", hctx: cancelled(&stopRequest{reason: "max_uptime"}), want: exitStopped},
+		{desc: "lease lost", hctx: cancelled(fmt.Errorf("%w: another host holds it", errLeaseLost)), want: exitLeaseLost},
+		{desc: "signal", hctx: cancelled(&signalError{sig: os.Interrupt}), err: crash, want: exitSignal},
+		{desc: "cancel", hctx: cancelled(nil), want: exitSignal},
+	}
+	for _, c := range cases {
+		got, code := exitReason(c.hctx, c.err)
+		if got != c.want || code != c.wantCode {
+			t.Errorf("%s: exitReason(_, %v) = %q, %d, wanted %q, %d", c.desc, c.err, got, code, c.want, c.wantCode)
+		}
+	}
+}
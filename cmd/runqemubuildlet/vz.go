@@ -0,0 +1,250 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VM backends of vmConfig.
+const (
+	backendQEMU = "qemu"
+	backendVZ   = "vz"
+)
+
+// vzConfig describes how a VM is run with Apple's Virtualization
+// framework, through vfkit (https://github.com/crc-org/vfkit), rather
+// than QEMU.
+//
+// Exactly one of EFIVars and Kernel must be set.
+type vzConfig struct {
+	// Binary is the path to vfkit. It defaults to "vfkit" in $PATH.
+	Binary string `yaml:"binary"`
+	// EFIVars is the UEFI variable store of the guest, created if
+	// it does not exist. macOS 13 and later can boot arm64 Linux
+	// and Windows guests with it.
+	EFIVars string `yaml:"efi_vars"`
+	// Kernel, Initrd, and Cmdline boot a Linux guest directly.
+	Kernel  string `yaml:"kernel"`
+	Initrd  string `yaml:"initrd"`
+	Cmdline string `yaml:"cmdline"`
+	// Socket is the path of vfkit's REST control socket. If empty, a
+	// socket in a temporary directory is used for each run.
+	Socket string `yaml:"socket"`
+}
+
+// vzStopTimeout is how long requesting a stop from vfkit may take.
+const vzStopTimeout = 5 * time.Second
+
+// isVZ reports whether c is run with the Virtualization framework.
+func (c *vmConfig) isVZ() bool {
+	return c.Backend == backendVZ
+}
+
+// validateVZ reports whether c, which uses the vz backend, only uses
+// features the Virtualization framework supports.
+func (c *vmConfig) validateVZ() error {
+	v := c.VZ
+	if v == nil {
+		return errors.New("backend vz requires a vz section")
+	}
+	if (v.EFIVars == "") == (v.Kernel == "") {
+		return errors.New("vz must set exactly one of efi_vars and kernel")
+	}
+	if v.Kernel == "" && (v.Initrd != "" || v.Cmdline != "") {
+		return errors.New("vz initrd and cmdline require kernel")
+	}
+	var unsupported []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qemu", c.QEMU != ""},
+		{"data_dir", c.DataDir != ""},
+		{"cpu", c.CPU != ""},
+		{"sockets, cores, and threads", c.Sockets+c.Cores+c.Threads > 0},
+		{"machine", c.Machine != ""},
+		{"accel", len(c.Accel) > 0},
+		{"boot", c.Boot != ""},
+		{"bios", c.BIOS != ""},
+		{"firmware", c.Firmware != nil},
+		{"tpm", c.TPM != nil},
+		{"balloon", c.Balloon != nil},
+		{"devices", len(c.Devices) > 0},
+		{"vnc", c.VNC != ""},
+		{"rtc", c.RTC != ""},
+		{"guest_agent", c.GuestAgent},
+		{"qmp_socket", c.QMPSocket != ""},
+		{"network port_forwards", len(c.Network.PortForwards) > 0},
+	} {
+		if f.set {
+			unsupported = append(unsupported, f.name)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("backend vz does not support %s", strings.Join(unsupported, ", "))
+	}
+	if b := c.Network.Backend; b != "" && b != "vmnet-shared" {
+		return fmt.Errorf("backend vz only supports NAT networking, like vmnet-shared, not network backend %s", b)
+	}
+	for _, d := range c.Drives {
+		if d.Media == "disk" && d.Format != "raw" {
+			return fmt.Errorf("drive %s: backend vz requires format raw", d.ID)
+		}
+		if d.AIO != "" || d.Discard != "" || d.DetectZeroes != "" {
+			return fmt.Errorf("drive %s: backend vz does not support aio, discard, or detect_zeroes", d.ID)
+		}
+	}
+	for _, sh := range c.Shares {
+		if sh.Type != shareVirtiofs {
+			return fmt.Errorf("share %s: backend vz only supports virtiofs shares", sh.Tag)
+		}
+	}
+	if c.Provision != nil && c.Provision.Method == provisionFwCfg {
+		return errors.New("backend vz does not support provisioning over fw_cfg")
+	}
+	return nil
+}
+
+// vzBinary returns the path to vfkit.
+func (c *vmConfig) vzBinary() string {
+	if c.VZ.Binary == "" {
+		return "vfkit"
+	}
+	return c.path(c.VZ.Binary)
+}
+
+// vzArgs returns the vfkit command line arguments described by c.
+func (c *vmConfig) vzArgs() []string {
+	var args []string
+	add := func(a ...string) { args = append(args, a...) }
+	if c.CPUs > 0 {
+		add("--cpus", fmt.Sprint(c.CPUs))
+	}
+	if c.MemoryMB > 0 {
+		add("--memory", fmt.Sprint(c.MemoryMB))
+	}
+	if v := c.VZ; v.Kernel != "" {
+		boot := "linux,kernel=" + c.path(v.Kernel)
+		if v.Initrd != "" {
+			boot += ",initrd=" + c.path(v.Initrd)
+		}
+		if v.Cmdline != "" {
+			boot += fmt.Sprintf(",cmdline=%q", v.Cmdline)
+		}
+		add("--bootloader", boot)
+	} else {
+		add("--bootloader", fmt.Sprintf("efi,variable-store=%s,create", c.path(v.EFIVars)))
+	}
+	for _, d := range c.Drives {
+		if d.Media == "cdrom" {
+			add("--device", fmt.Sprintf("usb-mass-storage,path=%s,readonly", c.path(d.File)))
+			continue
+		}
+		dev := "virtio-blk,path=" + c.path(d.File)
+		if d.ReadOnly {
+			dev += ",readonly"
+		}
+		add("--device", dev)
+	}
+	if c.Network.Device != "" {
+		dev := "virtio-net,nat"
+		if c.Network.MAC != "" {
+			dev += ",mac=" + c.Network.MAC
+		}
+		add("--device", dev)
+	}
+	if c.RNG {
+		add("--device", "virtio-rng")
+	}
+	for _, sh := range c.Shares {
+		add("--device", fmt.Sprintf("virtio-fs,sharedDir=%s,mountTag=%s", c.path(sh.Path), sh.Tag))
+	}
+	if strings.HasPrefix(c.Serial, "file:") {
+		add("--device", "virtio-serial,logFilePath="+c.path(strings.TrimPrefix(c.Serial, "file:")))
+	}
+	if c.VZ.Socket != "" {
+		add("--restful-uri", "unix://"+c.path(c.VZ.Socket))
+	}
+	add(c.ExtraArgs...)
+	return args
+}
+
+// snapshotVZDrives replaces the writable disk images of c with clones
+// in dir, so that the guest's writes are discarded with dir, like
+// QEMU's -snapshot. On APFS, the clones share unmodified blocks with
+// the images, and are created instantly.
+func snapshotVZDrives(c *vmConfig, dir string) error {
+	for i, d := range c.Drives {
+		if d.Media != "disk" || d.ReadOnly {
+			continue
+		}
+		dst := filepath.Join(dir, fmt.Sprintf("%s-%s", d.ID, filepath.Base(d.File)))
+		if err := cloneFile(dst, c.path(d.File)); err != nil {
+			return fmt.Errorf("cloning drive %s: %w", d.ID, err)
+		}
+		c.Drives[i].File = dst
+	}
+	return nil
+}
+
+// stopVZGuest requests that the guest of the vfkit process controlled
+// by the REST socket at path shut down, like powerdownGuest does for
+// QEMU. It returns once ctx is done, or grace has elapsed.
+func stopVZGuest(ctx context.Context, lg *runLogger, path string, grace time.Duration) {
+	if grace <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+
+	hc := &http.Client{
+		Timeout: vzStopTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://vfkit/vm/state", strings.NewReader(`{"state": "Stop"}`))
+	if err != nil {
+		lg.Warn("Requesting guest stop failed", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		lg.Warn("Requesting guest stop failed", "path", path, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		lg.Warn("Requesting guest stop failed", "path", path, "status", resp.Status)
+		return
+	}
+	lg.Info("Requested guest stop", "grace", grace)
+	<-ctx.Done()
+}
+
+// vzRunConfig sets the per-run paths of cfg, which uses the vz backend,
+// in the temporary directory tmp.
+func vzRunConfig(cfg *vmConfig, tmp string) {
+	v := *cfg.VZ
+	if v.Socket == "" {
+		v.Socket = filepath.Join(tmp, "vfkit.sock")
+	}
+	cfg.VZ = &v
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// vzTestConfig returns a vz config for a Linux guest booted by UEFI.
+func vzTestConfig() *vmConfig {
+	return &vmConfig{
+		Base:     "/base",
+		Backend:  backendVZ,
+		VZ:       &vzConfig{EFIVars: "efi.vars", Socket: "vfkit.sock"},
+		CPUs:     4,
+		MemoryMB: 4096,
+		Network:  networkConfig{Device: "virtio-net", MAC: "52:54:00:12:34:56"},
+		Drives: []driveConfig{
+			{ID: "hd0", File: "disk.img", Media: "disk", Format: "raw"},
+			{ID: "cd0", File: "install.iso", Media: "cdrom"},
+		},
+		Shares:   []shareConfig{{Tag: "cache", Path: "/cache", Type: shareVirtiofs}},
+		RNG:      true,
+		Snapshot: true,
+		Serial:   "file:serial.log",
+	}
+}
+
+func TestVZArgs(t *testing.T) {
+	cfg := vzTestConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() = %v, wanted no error", err)
+	}
+	want := []string{
+		"--cpus", "4",
+		"--memory", "4096",
+		"--bootloader", "efi,variable-store=/base/efi.vars,create",
+		"--device", "virtio-blk,path=/base/disk.img",
+		"--device", "usb-mass-storage,path=/base/install.iso,readonly",
+		"--device", "virtio-net,nat,mac=52:54:00:12:34:56",
+		"--device", "virtio-rng",
+		"--device", "virtio-fs,sharedDir=/cache,mountTag=cache",
+		"--device", "virtio-serial,logFilePath=/base/serial.log",
+		"--restful-uri", "unix:///base/vfkit.sock",
+	}
+	if diff := cmp.Diff(want, cfg.vzArgs()); diff != "" {
+		t.Errorf("vzArgs() mismatch (-want +got):\n%s", diff)
+	}
+
+	cfg.VZ = &vzConfig{Kernel: "vmlinuz", Initrd: "initrd", Cmdline: "console=hvc0 root=/dev/vda"}
+	got := cfg.vzArgs()[5]
+	if want := `linux,kernel=/base/vmlinuz,initrd=/base/initrd,cmdline="console=hvc0 root=/dev/vda"`; got != want {
+		t.Errorf("vzArgs() bootloader = %q, wanted %q", got, want)
+	}
+}
+
+func TestValidateVZ(t *testing.T) {
+	cases := []struct {
+		desc    string
+		modify  func(c *vmConfig)
+		wantErr bool
+	}{
+		{desc: "valid", modify: func(c *vmConfig) {}},
+		{desc: "no vz section", modify: func(c *vmConfig) { c.VZ = nil }, wantErr: true},
+		{desc: "no bootloader", modify: func(c *vmConfig) { c.VZ.EFIVars = "" }, wantErr: true},
+		{desc: "efi and kernel", modify: func(c *vmConfig) { c.VZ.Kernel = "vmlinuz" }, wantErr: true},
+		{desc: "qcow2", modify: func(c *vmConfig) { c.Drives[0].Format = "qcow2" }, wantErr: true},
+		{desc: "tpm", modify: func(c *vmConfig) { c.TPM = &tpmConfig{StateDir: "tpm"} }, wantErr: true},
+		{desc: "port forward", modify: func(c *vmConfig) {
+			c.Network.PortForwards = []portForward{{HostPort: 8080, GuestPort: 80}}
+		}, wantErr: true},
+		{desc: "vmnet-bridged", modify: func(c *vmConfig) {
+			c.Network.Backend, c.Network.Interface = "vmnet-bridged", "en0"
+		}, wantErr: true},
+		{desc: "9p share", modify: func(c *vmConfig) { c.Shares[0].Type = share9P }, wantErr: true},
+		{desc: "vz with qemu backend", modify: func(c *vmConfig) { c.Backend, c.QEMU = backendQEMU, "qemu" }, wantErr: true},
+		{desc: "unknown backend", modify: func(c *vmConfig) { c.Backend = "hyperkit" }, wantErr: true},
+	}
+	for _, c := range cases {
+		cfg := vzTestConfig()
+		c.modify(cfg)
+		if err := cfg.validate(); (err != nil) != c.wantErr {
+			t.Errorf("%s: validate() = %v, wantErr: %t", c.desc, err, c.wantErr)
+		}
+	}
+}
+
+func TestSnapshotVZDrives(t *testing.T) {
+	base, tmp := t.TempDir(), t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(base, "disk.img"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := vzTestConfig()
+	cfg.Base = base
+	if err := snapshotVZDrives(cfg, tmp); err != nil {
+		t.Fatalf("snapshotVZDrives() = %v, wanted no error", err)
+	}
+	want := filepath.Join(tmp, "hd0-disk.img")
+	if got := cfg.Drives[0].File; got != want {
+		t.Errorf("drive hd0 file = %q, wanted %q", got, want)
+	}
+	if b, err := ioutil.ReadFile(want); err != nil || string(b) != "image" {
+		t.Errorf("ReadFile(%q) = %q, %v, wanted %q", want, b, err, "image")
+	}
+	if got := cfg.Drives[1].File; got != "install.iso" {
+		t.Errorf("drive cd0 file = %q, wanted unchanged", got)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state, such as "READY=1", to the systemd service
+// manager over $NOTIFY_SOCKET. It returns false, and no error, if
+// runqemubuildlet was not started by systemd with notifications
+// enabled.
+//
+// See https://www.freedesktop.org/software/systemd/man/sd_notify.html.
+func sdNotify(state string) (bool, error) {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return false, nil
+	}
+	if sock[0] == '@' {
+		// Abstract socket.
+		sock = "\x00" + sock[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sdWatchdogInterval returns the interval at which systemd expects
+// watchdog notifications, or zero if the watchdog is not enabled for
+// this process.
+func sdWatchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", s)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// checkLive returns an error if the supervisor state of insts cannot
+// be read within timeout, which indicates a deadlock.
+func checkLive(insts []*instance, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, in := range insts {
+			in.status()
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timed out reading instance status")
+	}
+}
+
+// runWatchdog tells the init system that runqemubuildlet is ready, and
+// then periodically checks that it is not wedged until ctx is done.
+//
+// Under systemd with WatchdogSec set, a watchdog notification is sent
+// after each successful check, so that systemd restarts a wedged
+// process. Otherwise, if selfTimeout is positive, runqemubuildlet exits
+// once checks have failed for selfTimeout, so that an init system
+// without a watchdog, such as launchd with KeepAlive, restarts it.
+func runWatchdog(ctx context.Context, insts []*instance, selfTimeout time.Duration) {
+	if ok, err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Notifying systemd of readiness failed", "err", err)
+	} else if ok {
+		slog.Info("Notified systemd of readiness")
+	}
+	interval, err := sdWatchdogInterval()
+	if err != nil {
+		slog.Warn("Reading systemd watchdog interval failed", "err", err)
+	}
+	period := interval / 2
+	if period == 0 {
+		if selfTimeout <= 0 {
+			return
+		}
+		period = selfTimeout / 4
+	}
+	t := time.NewTicker(period)
+	defer t.Stop()
+	lastOK := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			sdNotify("STOPPING=1")
+			return
+		case <-t.C:
+		}
+		if err := checkLive(insts, period); err != nil {
+			slog.Error("Watchdog check failed", "err", err, "last_ok", lastOK)
+			if interval == 0 && selfTimeout > 0 && time.Since(lastOK) > selfTimeout {
+				slog.Error("Exiting wedged runqemubuildlet", "timeout", selfTimeout)
+				os.Exit(1)
+			}
+			continue
+		}
+		lastOK = time.Now()
+		if interval > 0 {
+			if _, err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Notifying systemd watchdog failed", "err", err)
+			}
+		}
+	}
+}
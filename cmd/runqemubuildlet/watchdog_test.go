@@ -0,0 +1,68 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSDNotify(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", sock)
+	if ok, err := sdNotify("READY=1"); !ok || err != nil {
+		t.Fatalf("sdNotify(%q) = %t, %v, wanted true, nil", "READY=1", ok, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "READY=1" {
+		t.Errorf("notification = %q, wanted %q", got, "READY=1")
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if ok, err := sdNotify("READY=1"); ok || err != nil {
+		t.Errorf("sdNotify(%q) without NOTIFY_SOCKET = %t, %v, wanted false, nil", "READY=1", ok, err)
+	}
+}
+
+func TestSDWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got, err := sdWatchdogInterval(); got != 30*time.Second || err != nil {
+		t.Errorf("sdWatchdogInterval() = %v, %v, wanted %v", got, err, 30*time.Second)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if got, err := sdWatchdogInterval(); got != 0 || err != nil {
+		t.Errorf("sdWatchdogInterval() for another PID = %v, %v, wanted 0", got, err)
+	}
+}
+
+func TestCheckLive(t *testing.T) {
+	in := newInstance("vm", windows10Config("/base"), "http://localhost:8080/healthz")
+	if err := checkLive([]*instance{in}, time.Second); err != nil {
+		t.Errorf("checkLive() = %v, wanted no error", err)
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if err := checkLive([]*instance{in}, 10*time.Millisecond); err == nil {
+		t.Errorf("checkLive() with a wedged instance = nil, wanted error")
+	}
+}
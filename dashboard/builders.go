@@ -749,6 +749,10 @@ type HostConfig struct {
 	// ReverseOptions:
 	ExpectNum       int  // expected number of reverse buildlets of this type
 	HermeticReverse bool // whether reverse buildlet has fresh env per conn
+	// ReverseLabels, if non-empty, are labels reverse buildlets
+	// must advertise (with buildlet -reverse-labels) to be used
+	// for this host type, such as a performance class.
+	ReverseLabels map[string]string
 
 	// Container image options, if ContainerImage != "":
 	NestedVirt    bool   // container requires VMX nested virtualization
@@ -43,5 +43,6 @@ require (
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.33.2
 	gopkg.in/inf.v0 v0.9.1
+	gopkg.in/yaml.v2 v2.3.0
 	grpc.go4.org v0.0.0-20170609214715-11d0a25b4919
 )
@@ -0,0 +1,16 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+package internal
+
+import "context"
+
+// ctxErr returns why ctx is done: the cause it was cancelled with, if
+// any, or ctx.Err().
+func ctxErr(ctx context.Context) error {
+	return context.Cause(ctx)
+}
@@ -0,0 +1,16 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.20
+// +build !go1.20
+
+package internal
+
+import "context"
+
+// ctxErr returns why ctx is done. Contexts have no cause before Go
+// 1.20, so this is ctx.Err().
+func ctxErr(ctx context.Context) error {
+	return ctx.Err()
+}
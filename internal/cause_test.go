@@ -0,0 +1,34 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestWaitOrStopCause(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skipf("exec.LookPath(%q) = _, %v", "sleep", err)
+	}
+	cmd := exec.Command(sleep, "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("cmd.Start() = %v", err)
+	}
+	cause := errors.New("stopped for testing")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cause)
+	if err := WaitOrStop(ctx, cmd, os.Interrupt, time.Second); err != cause {
+		t.Errorf("WaitOrStop() = %v, wanted %v", err, cause)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.13 && (linux || darwin)
+// +build go1.13
+// +build linux darwin
+
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/build/buildlet"
+)
+
+// Limits on the host metrics of reverse buildlets. Buildlets whose
+// hosts go beyond them are drained: they're not given new builds
+// until their metrics recover, to avoid flaky failures.
+const (
+	minHostDiskFree    = 2 << 30 // bytes
+	maxHostLoadPerCPU  = 4.0     // 1 minute load average per CPU
+	maxHostTemperature = 90.0    // degrees Celsius
+
+	// hostMetricsMaxAge is how long host metrics count for. A
+	// buildlet that stops sending them isn't drained forever.
+	hostMetricsMaxAge = 2 * time.Minute
+)
+
+// HandleReverseHeartbeat handles the host metrics that reverse
+// buildlets periodically send.
+func HandleReverseHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(w, "buildlet heartbeats require SSL", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "requires POST method", http.StatusBadRequest)
+		return
+	}
+	var (
+		hostType = r.Header.Get("X-Go-Host-Type")
+		buildKey = r.Header.Get("X-Go-Builder-Key")
+		hostname = r.Header.Get("X-Go-Builder-Hostname")
+		session  = r.Header.Get("X-Go-Builder-Session")
+	)
+	if hostType == "" || hostname == "" || session == "" {
+		http.Error(w, "missing X-Go-Host-Type, X-Go-Builder-Hostname, or X-Go-Builder-Session header", http.StatusBadRequest)
+		return
+	}
+	if buildKey != builderKey(hostType) {
+		http.Error(w, "invalid build key", http.StatusPreconditionFailed)
+		return
+	}
+	var m buildlet.HostMetrics
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&m); err != nil {
+		http.Error(w, "bad host metrics: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !reversePool.recordHostMetrics(hostType, hostname, session, m) {
+		http.Error(w, "no such reverse buildlet session", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordHostMetrics records the host metrics of the reverse buildlet
+// with the given host type, hostname, and session, and reports
+// whether there is such a buildlet.
+func (p *ReverseBuildletPool) recordHostMetrics(hostType, hostname, session string, m buildlet.HostMetrics) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.buildlets {
+		if b.hostType != hostType || b.hostname != hostname || b.sessRand != session {
+			continue
+		}
+		was := b.draining()
+		b.metrics = m
+		b.metricsTime = time.Now()
+		b.hostProblem = hostProblem(m)
+		if now := b.draining(); now != was {
+			if now != "" {
+				log.Printf("Draining reverse buildlet %s (%s): %s", hostname, hostType, now)
+			} else {
+				log.Printf("Reverse buildlet %s (%s) recovered; no longer draining", hostname, hostType)
+				go p.noteBuildletAvailable(hostType)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// hostProblem returns what's wrong with a host according to its
+// metrics, or "" if nothing is.
+func hostProblem(m buildlet.HostMetrics) string {
+	var problems []string
+	if m.DiskTotal > 0 && m.DiskFree < minHostDiskFree {
+		problems = append(problems, fmt.Sprintf("low disk space (%d MiB free)", m.DiskFree>>20))
+	}
+	if m.NumCPU > 0 && m.LoadAvg[0] > maxHostLoadPerCPU*float64(m.NumCPU) {
+		problems = append(problems, fmt.Sprintf("high load (%.1f on %d CPUs)", m.LoadAvg[0], m.NumCPU))
+	}
+	if m.Temperature >= maxHostTemperature {
+		problems = append(problems, fmt.Sprintf("overheating (%.0f°C)", m.Temperature))
+	}
+	if m.Throttled {
+		problems = append(problems, "CPU throttled")
+	}
+	return strings.Join(problems, ", ")
+}
+
+// draining returns why b's host is unhealthy according to its recent
+// metrics, or "" if it isn't. The caller must hold the pool's mutex.
+func (b *reverseBuildlet) draining() string {
+	if !b.hasRecentMetrics() {
+		return ""
+	}
+	return b.hostProblem
+}
+
+// hasRecentMetrics reports whether b sent host metrics recently.
+// The caller must hold the pool's mutex.
+func (b *reverseBuildlet) hasRecentMetrics() bool {
+	return time.Since(b.metricsTime) <= hostMetricsMaxAge
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.13 && (linux || darwin)
+// +build go1.13
+// +build linux darwin
+
+package pool
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/build/buildlet"
+)
+
+func TestHostProblem(t *testing.T) {
+	tests := []struct {
+		m    buildlet.HostMetrics
+		want string
+	}{
+		{buildlet.HostMetrics{}, ""},
+		{buildlet.HostMetrics{NumCPU: 4, LoadAvg: [3]float64{8, 8, 8}, DiskFree: 10 << 30, DiskTotal: 100 << 30, Temperature: 60}, ""},
+		{buildlet.HostMetrics{DiskFree: 1 << 30, DiskTotal: 100 << 30}, "low disk space (1024 MiB free)"},
+		{buildlet.HostMetrics{NumCPU: 2, LoadAvg: [3]float64{9.5, 3, 1}}, "high load (9.5 on 2 CPUs)"},
+		{buildlet.HostMetrics{Temperature: 95, Throttled: true}, "overheating (95°C), CPU throttled"},
+	}
+	for _, tt := range tests {
+		if got := hostProblem(tt.m); got != tt.want {
+			t.Errorf("hostProblem(%+v) = %q; want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestHandleReverseHeartbeat(t *testing.T) {
+	defer func(old *ReverseBuildletPool, oldKey []byte) {
+		reversePool, builderMasterKey = old, oldKey
+	}(reversePool, builderMasterKey)
+	SetBuilderMasterKey([]byte("test"))
+	client := buildlet.NewClient("host", buildlet.NoKeyPair)
+	reversePool = &ReverseBuildletPool{
+		buildlets: []*reverseBuildlet{{hostname: "host", hostType: "host-foo", sessRand: "s1", client: client}},
+	}
+
+	heartbeat := func(session, key, body string) int {
+		req := httptest.NewRequest("POST", "/reverse/heartbeat", strings.NewReader(body))
+		req.TLS = &tls.ConnectionState{}
+		req.Header.Set("X-Go-Host-Type", "host-foo")
+		req.Header.Set("X-Go-Builder-Key", key)
+		req.Header.Set("X-Go-Builder-Hostname", "host")
+		req.Header.Set("X-Go-Builder-Session", session)
+		rec := httptest.NewRecorder()
+		HandleReverseHeartbeat(rec, req)
+		return rec.Code
+	}
+	key := builderKey("host-foo")
+	if code := heartbeat("s1", "wrong", "{}"); code != http.StatusPreconditionFailed {
+		t.Errorf("heartbeat with a bad key: status %d; want %d", code, http.StatusPreconditionFailed)
+	}
+	if code := heartbeat("s2", key, "{}"); code != http.StatusNotFound {
+		t.Errorf("heartbeat from an unknown session: status %d; want %d", code, http.StatusNotFound)
+	}
+
+	if code := heartbeat("s1", key, `{"DiskFree": 1000, "DiskTotal": 1000000}`); code != http.StatusNoContent {
+		t.Fatalf("heartbeat: status %d; want %d", code, http.StatusNoContent)
+	}
+	if bc, _ := reversePool.tryToGrab("host-foo"); bc != nil {
+		t.Errorf("got a buildlet with low disk space; want it drained")
+	}
+	st := reversePool.BuildReverseStatusJSON()
+	if rb := st.HostTypes["host-foo"].Machines["host"]; rb.Draining == "" || rb.DiskFree != 1000 {
+		t.Errorf("status = %+v; want draining with 1000 bytes free", rb)
+	}
+
+	if code := heartbeat("s1", key, `{"DiskFree": 100000000000, "DiskTotal": 200000000000}`); code != http.StatusNoContent {
+		t.Fatalf("heartbeat: status %d; want %d", code, http.StatusNoContent)
+	}
+	if bc, _ := reversePool.tryToGrab("host-foo"); bc != client {
+		t.Errorf("tryToGrab = %v after the host recovered; want the buildlet", bc)
+	}
+}
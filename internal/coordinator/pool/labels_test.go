@@ -0,0 +1,50 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.13 && (linux || darwin)
+// +build go1.13
+// +build linux darwin
+
+package pool
+
+import (
+	"testing"
+
+	"golang.org/x/build/buildlet"
+	"golang.org/x/build/dashboard"
+)
+
+func TestReverseLabelsAndMaxSessions(t *testing.T) {
+	const hostType = "host-test-labels"
+	dashboard.Hosts[hostType] = &dashboard.HostConfig{HostType: hostType, IsReverse: true, ReverseLabels: map[string]string{"class": "fast"}}
+	defer delete(dashboard.Hosts, hostType)
+
+	slow := buildlet.NewClient("slow", buildlet.NoKeyPair)
+	fast1 := buildlet.NewClient("fast1", buildlet.NoKeyPair)
+	fast2 := buildlet.NewClient("fast2", buildlet.NoKeyPair)
+	p := &ReverseBuildletPool{
+		oldInUse: make(map[*buildlet.Client]bool),
+		buildlets: []*reverseBuildlet{
+			{hostname: "slow", hostType: hostType, client: slow, labels: map[string]string{"class": "slow"}},
+			{hostname: "fast", hostType: hostType, client: fast1, labels: map[string]string{"class": "fast", "rack": "b4"}, maxSessions: 1},
+			{hostname: "fast", hostType: hostType, client: fast2, labels: map[string]string{"class": "fast", "rack": "b4"}, maxSessions: 1},
+		},
+	}
+	if !p.CanBuild(hostType) {
+		t.Errorf("CanBuild = false; want true")
+	}
+	if bc, _ := p.tryToGrab(hostType); bc != fast1 {
+		t.Fatalf("tryToGrab = %v; want the first fast buildlet", bc)
+	}
+	// The fast host only has capacity for one session, and the
+	// slow one lacks the label.
+	if bc, busy := p.tryToGrab(hostType); bc != nil || busy != 1 {
+		t.Errorf("tryToGrab = %v, %d busy; want none, 1 busy", bc, busy)
+	}
+
+	p.buildlets = p.buildlets[:1]
+	if p.CanBuild(hostType) {
+		t.Errorf("CanBuild with only an unlabeled buildlet = true; want false")
+	}
+}
@@ -39,12 +39,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -153,6 +155,15 @@ func (p *ReverseBuildletPool) BuildReverseStatusJSON() *types.ReverseBuilderStat
 			HostType:     b.hostType,
 			ConnectedSec: time.Since(b.regTime).Seconds(),
 			Version:      b.version,
+			Draining:     b.draining(),
+			Labels:       b.labels,
+			MaxSessions:  b.maxSessions,
+		}
+		if b.hasRecentMetrics() {
+			bs.LoadAvg = b.metrics.LoadAvg[0]
+			bs.DiskFree = b.metrics.DiskFree
+			bs.Temperature = b.metrics.Temperature
+			bs.Throttled = b.metrics.Throttled
 		}
 		if b.inUse && !b.inHealthCheck {
 			hs.Busy++
@@ -194,6 +205,15 @@ func (p *ReverseBuildletPool) tryToGrab(hostType string) (bc *buildlet.Client, b
 		if b.isOldRevDial && len(p.oldInUse) >= maxOldRevdialUsers {
 			continue
 		}
+		if b.draining() != "" {
+			continue
+		}
+		if !b.hasLabelsFor(hostType) {
+			continue
+		}
+		if b.maxSessions > 0 && p.sessionsInUseLocked(b.hostname) >= b.maxSessions {
+			continue
+		}
 		// Found an unused match.
 		b.inUse = true
 		b.inUseTime = time.Now()
@@ -205,6 +225,26 @@ func (p *ReverseBuildletPool) tryToGrab(hostType string) (bc *buildlet.Client, b
 	return nil, busy
 }
 
+// hasLabelsFor reports whether b has the labels that hostType
+// requires of its reverse buildlets.
+func (b *reverseBuildlet) hasLabelsFor(hostType string) bool {
+	hc, ok := dashboard.Hosts[hostType]
+	return !ok || buildlet.HasLabels(b.labels, hc.ReverseLabels)
+}
+
+// sessionsInUseLocked returns how many buildlets with the given
+// hostname are in use, not counting health checks. The caller must
+// hold p.mu.
+func (p *ReverseBuildletPool) sessionsInUseLocked(hostname string) int {
+	n := 0
+	for _, b := range p.buildlets {
+		if b.hostname == hostname && b.inUse && !b.inHealthCheck {
+			n++
+		}
+	}
+	return n
+}
+
 func (p *ReverseBuildletPool) getWakeChan(hostType string) chan token {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -236,7 +276,7 @@ func (p *ReverseBuildletPool) nukeBuildlet(victim *buildlet.Client) {
 	delete(p.oldInUse, victim)
 	for i, rb := range p.buildlets {
 		if rb.client == victim {
-			defer rb.conn.Close()
+			defer rb.sess.Close()
 			p.buildlets = append(p.buildlets[:i], p.buildlets[i+1:]...)
 			return
 		}
@@ -266,6 +306,11 @@ func (p *ReverseBuildletPool) healthCheckBuildlet(b *reverseBuildlet) bool {
 	if b.client.IsBroken() {
 		return false
 	}
+	if b.sess.suspended() {
+		// Waiting for it to resume its session; HandleReverse
+		// removes it if it doesn't.
+		return true
+	}
 	p.mu.Lock()
 	if b.inHealthCheck { // sanity check
 		panic("previous health check still running")
@@ -392,12 +437,19 @@ func (p *ReverseBuildletPool) WriteHTMLStatus(w io.Writer) {
 		if b.inUse {
 			machStatus = "working"
 			numInUse++
+		} else if why := b.draining(); why != "" {
+			machStatus = "<i>draining</i> (" + html.EscapeString(why) + ")"
+		}
+		var labels string
+		if len(b.labels) > 0 {
+			labels = " [" + html.EscapeString(buildlet.FormatLabels(b.labels)) + "]"
 		}
-		fmt.Fprintf(&buf, "<li>%s (%s) version %s, %s: connected %s, %s for %s</li>\n",
+		fmt.Fprintf(&buf, "<li>%s (%s) version %s, %s%s: connected %s, %s for %s</li>\n",
 			b.hostname,
-			b.conn.RemoteAddr(),
+			b.sess.remoteAddr(),
 			b.version,
 			b.hostType,
+			labels,
 			friendlyDuration(time.Since(b.regTime)),
 			machStatus,
 			friendlyDuration(time.Since(b.inUseTime)))
@@ -494,7 +546,7 @@ func (p *ReverseBuildletPool) CanBuild(hostType string) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	for _, b := range p.buildlets {
-		if b.hostType == hostType {
+		if b.hostType == hostType && b.hasLabelsFor(hostType) {
 			return true
 		}
 	}
@@ -533,16 +585,33 @@ type reverseBuildlet struct {
 	isOldRevDial bool // version 22 or under: using the v1 revdial package (Issue 31639)
 
 	// sessRand is the unique random number for every unique buildlet session.
+	// It is empty for buildlets older than version 35, which can't
+	// resume their session.
 	sessRand string
 
 	client  *buildlet.Client
-	conn    net.Conn
+	sess    *sessionDialer
 	regTime time.Time // when it was first connected
 
 	// hostType is the configuration of this machine.
 	// It is the key into the dashboard.Hosts map.
 	hostType string
 
+	// labels describe the host, as advertised by the buildlet, for
+	// matching against its host type's ReverseLabels.
+	labels map[string]string
+	// maxSessions, if positive, is how many buildlets with this
+	// hostname the host has capacity for at once, as advertised
+	// by the buildlet.
+	maxSessions int
+
+	// metrics are the host metrics last sent by the buildlet, at
+	// metricsTime, and hostProblem is what they show is wrong with
+	// the host, if anything.
+	metrics     buildlet.HostMetrics
+	metricsTime time.Time
+	hostProblem string
+
 	// inUseAs signifies that the buildlet is in use.
 	// inUseTime is when it entered that state.
 	// inHealthCheck is whether it's inUse due to a health check.
@@ -564,7 +633,21 @@ func HandleReverse(w http.ResponseWriter, r *http.Request) {
 		buildKey        = r.Header.Get("X-Go-Builder-Key")
 		buildletVersion = r.Header.Get("X-Go-Builder-Version")
 		hostname        = r.Header.Get("X-Go-Builder-Hostname")
+		session         = r.Header.Get("X-Go-Builder-Session")
 	)
+	labels, err := buildlet.ParseLabels(r.Header.Get("X-Go-Builder-Labels"))
+	if err != nil {
+		http.Error(w, "bad X-Go-Builder-Labels: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var maxSessions int
+	if v := r.Header.Get("X-Go-Builder-Max-Sessions"); v != "" {
+		maxSessions, err = strconv.Atoi(v)
+		if err != nil || maxSessions < 0 {
+			http.Error(w, "bad X-Go-Builder-Max-Sessions", http.StatusBadRequest)
+			return
+		}
+	}
 
 	switch r.Header.Get("X-Revdial-Version") {
 	case "":
@@ -605,22 +688,25 @@ func HandleReverse(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	revDialer := revdial.NewDialer(conn, "/revdial")
+	if session != "" && reversePool.resumeSession(hostType, hostname, session, revDialer, conn) {
+		log.Printf("Reverse buildlet %q (%s) for host type %v resumed its session", hostname, r.RemoteAddr, hostType)
+		return
+	}
+
 	log.Printf("Registering reverse buildlet %q (%s) for host type %v; buildletVersion=%v",
 		hostname, r.RemoteAddr, hostType, buildletVersion)
 
-	revDialer := revdial.NewDialer(conn, "/revdial")
-	revDialerDone := revDialer.Done()
-	dialer := revDialer.Dial
-
+	sess := newSessionDialer(revDialer, conn)
 	client := buildlet.NewClient(hostname, buildlet.NoKeyPair)
 	client.SetHTTPClient(&http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return dialer(ctx)
+				return sess.Dial(ctx)
 			},
 		},
 	})
-	client.SetDialer(dialer)
+	client.SetDialer(sess.Dial)
 	client.SetDescription(fmt.Sprintf("reverse peer %s/%s for host type %v", hostname, r.RemoteAddr, hostType))
 
 	var isDead struct {
@@ -631,15 +717,30 @@ func HandleReverse(w http.ResponseWriter, r *http.Request) {
 		isDead.Lock()
 		isDead.v = true
 		isDead.Unlock()
-		conn.Close()
+		sess.Close()
 		reversePool.nukeBuildlet(client)
 	})
 
 	// If the reverse dialer (which is always reading from the
 	// conn) detects that the remote went away, close the buildlet
-	// client proactively show
+	// client proactively show, unless it resumes its session.
 	go func() {
-		<-revDialerDone
+		for {
+			d, resumed := sess.current()
+			<-d.Done()
+			if session == "" {
+				break
+			}
+			log.Printf("Reverse buildlet %q (host type %v) disconnected; waiting %v for it to resume its session", hostname, hostType, reverseResumeGrace)
+			t := time.NewTimer(reverseResumeGrace)
+			select {
+			case <-resumed:
+				t.Stop()
+				continue
+			case <-t.C:
+			}
+			break
+		}
 		isDead.Lock()
 		defer isDead.Unlock()
 		if !isDead.v {
@@ -651,30 +752,121 @@ func HandleReverse(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("Reverse connection %s/%s for %s did not answer status after %v: %v",
 			hostname, r.RemoteAddr, hostType, time.Since(tstatus), err)
-		conn.Close()
+		sess.Close()
 		return
 	}
 	if status.Version < minBuildletVersion {
 		log.Printf("Buildlet too old: %s, %+v", r.RemoteAddr, status)
-		conn.Close()
+		sess.Close()
 		return
 	}
 	log.Printf("Buildlet %s/%s: %+v for %s", hostname, r.RemoteAddr, status, hostType)
+	if features, err := client.Features(context.Background()); err != nil {
+		log.Printf("Reverse buildlet %s/%s for %s did not list its features: %v", hostname, r.RemoteAddr, hostType, err)
+	} else if features.Has(buildlet.FeatureHTTP2) {
+		// Multiplex requests over one reverse connection.
+		client.EnableHTTP2()
+	}
 
 	now := time.Now()
 	b := &reverseBuildlet{
 		hostname:     hostname,
 		version:      buildletVersion,
 		isOldRevDial: status.Version < 23,
+		sessRand:     session,
 		hostType:     hostType,
+		labels:       labels,
+		maxSessions:  maxSessions,
 		client:       client,
-		conn:         conn,
+		sess:         sess,
 		inUseTime:    now,
 		regTime:      now,
 	}
 	reversePool.addBuildlet(b)
 }
 
+// reverseResumeGrace is how long a reverse buildlet whose connection
+// dropped is kept, waiting for it to reconnect and resume its session.
+// It allows for buildlets' default -reverse-resume of one minute.
+const reverseResumeGrace = 90 * time.Second
+
+// resumeSession switches the reverse buildlet with the given host
+// type, hostname, and session to the new connection conn, and reports
+// whether there was such a buildlet. The host type must match, as the
+// build key it was checked against is only valid for that type.
+func (p *ReverseBuildletPool) resumeSession(hostType, hostname, session string, d *revdial.Dialer, conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.buildlets {
+		if b.hostType == hostType && b.hostname == hostname && b.sessRand == session {
+			b.sess.resume(d, conn)
+			return true
+		}
+	}
+	return false
+}
+
+// sessionDialer dials a reverse buildlet over its current revdial
+// connection, which is replaced when the buildlet resumes its session
+// after reconnecting.
+type sessionDialer struct {
+	mu      sync.Mutex
+	d       *revdial.Dialer
+	conn    net.Conn
+	resumed chan struct{} // closed when d is replaced
+}
+
+func newSessionDialer(d *revdial.Dialer, conn net.Conn) *sessionDialer {
+	return &sessionDialer{d: d, conn: conn, resumed: make(chan struct{})}
+}
+
+func (s *sessionDialer) Dial(ctx context.Context) (net.Conn, error) {
+	d, _ := s.current()
+	return d.Dial(ctx)
+}
+
+// current returns the current dialer, and a channel closed when it is
+// replaced.
+func (s *sessionDialer) current() (*revdial.Dialer, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.d, s.resumed
+}
+
+func (s *sessionDialer) resume(d *revdial.Dialer, conn net.Conn) {
+	s.mu.Lock()
+	old := s.conn
+	s.d, s.conn = d, conn
+	close(s.resumed)
+	s.resumed = make(chan struct{})
+	s.mu.Unlock()
+	old.Close()
+}
+
+// suspended reports whether the connection dropped, and the buildlet
+// hasn't resumed its session yet.
+func (s *sessionDialer) suspended() bool {
+	d, _ := s.current()
+	select {
+	case <-d.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *sessionDialer) remoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.RemoteAddr()
+}
+
+func (s *sessionDialer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Close()
+}
+
 type byTypeThenHostname []*reverseBuildlet
 
 func (s byTypeThenHostname) Len() int      { return len(s) }
@@ -0,0 +1,61 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.13 && (linux || darwin)
+// +build go1.13
+// +build linux darwin
+
+package pool
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/build/revdial/v2"
+)
+
+func TestResumeSession(t *testing.T) {
+	c1, peer1 := net.Pipe()
+	sess := newSessionDialer(revdial.NewDialer(c1, "/revdial"), c1)
+	p := &ReverseBuildletPool{buildlets: []*reverseBuildlet{{hostType: "host-linux", hostname: "host", sessRand: "s1", sess: sess}}}
+
+	if sess.suspended() {
+		t.Fatalf("suspended() = true before the connection dropped")
+	}
+	_, resumed := sess.current()
+	peer1.Close()
+	d, _ := sess.current()
+	select {
+	case <-d.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("dialer not done after its connection dropped")
+	}
+	if !sess.suspended() {
+		t.Errorf("suspended() = false after the connection dropped")
+	}
+
+	c2, peer2 := net.Pipe()
+	defer peer2.Close()
+	if p.resumeSession("host-linux", "host", "other", revdial.NewDialer(c2, "/revdial"), c2) {
+		t.Errorf("resumeSession with a different session succeeded")
+	}
+	if p.resumeSession("host-windows", "host", "s1", revdial.NewDialer(c2, "/revdial"), c2) {
+		t.Errorf("resumeSession with a different host type succeeded")
+	}
+	c3, peer3 := net.Pipe()
+	defer peer3.Close()
+	if !p.resumeSession("host-linux", "host", "s1", revdial.NewDialer(c3, "/revdial"), c3) {
+		t.Fatalf("resumeSession with the same session failed")
+	}
+	select {
+	case <-resumed:
+	default:
+		t.Errorf("resumeSession didn't signal the resumption")
+	}
+	if sess.suspended() {
+		t.Errorf("suspended() = true after resuming")
+	}
+	sess.Close()
+}
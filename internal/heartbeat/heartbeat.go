@@ -0,0 +1,147 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+// Package heartbeat cancels a context once periodic health probes have
+// failed for too long.
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ErrTimeout is wrapped by the cause of the cancellation of a context
+// returned by Context once its probes have failed for too long.
+var ErrTimeout = errors.New("heartbeat timed out")
+
+// Clock tells the time and waits for it to pass. Tests can replace
+// the system clock with a fake one.
+type Clock interface {
+	Now() time.Time
+	// After waits for d to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Options configures the probes of a heartbeat, and when it is
+// considered unhealthy.
+type Options struct {
+	// Interval is the time between probes. It must be positive.
+	// The first probe is made one interval after the heartbeat
+	// starts.
+	Interval time.Duration
+	// Jitter, if positive, is the fraction of Interval, at most 1,
+	// by which each interval is randomly lengthened or shortened,
+	// so that heartbeats started together do not probe together.
+	Jitter float64
+	// Timeout is how long probes must fail for, since the last
+	// successful one or since the heartbeat started, before the
+	// heartbeat is unhealthy.
+	Timeout time.Duration
+	// Failures is the number of consecutive probes that must fail,
+	// in addition to Timeout, before the heartbeat is unhealthy.
+	// It defaults to 1. Requiring several keeps a single failed
+	// probe after a long gap, such as when the host was asleep,
+	// from counting as a timeout.
+	Failures int
+	// ProbeTimeout, if positive, is the time each probe may take
+	// before its context is done.
+	ProbeTimeout time.Duration
+	// OnUnhealthy, if set, is called with the cause of the
+	// cancellation once the heartbeat becomes unhealthy, before its
+	// context is cancelled.
+	OnUnhealthy func(cause error)
+	// Clock, if set, is used instead of the system clock.
+	Clock Clock
+}
+
+// Context returns a context derived from ctx, and calls probe every
+// opts.Interval until it is done. If probe keeps returning an error
+// for longer than opts.Timeout, and for at least opts.Failures
+// consecutive calls, the context is cancelled with a cause wrapping
+// ErrTimeout and the last error, and probing stops.
+//
+// A single call to probe that does not return an error resets the
+// timeout window.
+func Context(ctx context.Context, opts Options, probe func(context.Context) error) (context.Context, context.CancelCauseFunc) {
+	if opts.Interval <= 0 {
+		panic("heartbeat.Context requires a positive Interval")
+	}
+	if opts.Jitter < 0 || opts.Jitter > 1 {
+		panic("heartbeat.Context requires a Jitter between 0 and 1")
+	}
+	if opts.Failures < 1 {
+		opts.Failures = 1
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	go run(ctx, cancel, opts, probe)
+	return ctx, cancel
+}
+
+// run probes according to opts until ctx is done or the heartbeat is
+// unhealthy.
+func run(ctx context.Context, cancel context.CancelCauseFunc, opts Options, probe func(context.Context) error) {
+	lastSuccess := opts.Clock.Now()
+	failures := 0
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-opts.Clock.After(opts.interval()):
+		}
+		if ctx.Err() != nil {
+			// Both were ready, and select chose the tick.
+			return
+		}
+		err := callProbe(ctx, opts.ProbeTimeout, probe)
+		if err == nil {
+			lastSuccess = now
+			failures = 0
+			continue
+		}
+		failures++
+		if failures >= opts.Failures && now.Sub(lastSuccess) > opts.Timeout {
+			cause := fmt.Errorf("%w after %d failures: %v", ErrTimeout, failures, err)
+			if opts.OnUnhealthy != nil {
+				opts.OnUnhealthy(cause)
+			}
+			cancel(cause)
+			return
+		}
+	}
+}
+
+// interval returns the time until the next probe.
+func (o Options) interval() time.Duration {
+	if o.Jitter == 0 {
+		return o.Interval
+	}
+	return o.Interval + time.Duration((2*rand.Float64()-1)*o.Jitter*float64(o.Interval))
+}
+
+// callProbe calls probe, with a context that is done after timeout if
+// it is positive.
+func callProbe(ctx context.Context, timeout time.Duration, probe func(context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return probe(ctx)
+}
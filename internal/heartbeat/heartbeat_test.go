@@ -0,0 +1,262 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only passes when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	// waits receives the duration passed to each call to After.
+	waits chan time.Duration
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), waits: make(chan time.Duration, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), c: ch})
+	c.mu.Unlock()
+	c.waits <- d
+	return ch
+}
+
+// advance moves the time forward by d, firing the timers that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// next waits until the heartbeat with context ctx waits for its next
+// probe, and returns how long it waits, or reports false if ctx is done
+// instead.
+func (c *fakeClock) next(t *testing.T, ctx context.Context) (time.Duration, bool) {
+	t.Helper()
+	select {
+	case d := <-c.waits:
+		return d, true
+	case <-ctx.Done():
+		return 0, false
+	case <-time.After(10 * time.Second):
+		t.Fatal("heartbeat neither waited for its next probe nor finished")
+		return 0, false
+	}
+}
+
+// script returns a probe that returns the errors in results in turn,
+// and nil once they run out.
+func script(results ...error) (probe func(context.Context) error, calls func() int) {
+	var mu sync.Mutex
+	n := 0
+	probe = func(context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		if n <= len(results) {
+			return results[n-1]
+		}
+		return nil
+	}
+	calls = func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+	return probe, calls
+}
+
+func TestContext(t *testing.T) {
+	errDown := errors.New("down")
+	cases := []struct {
+		desc       string
+		opts       Options
+		results    []error
+		steps      int // intervals to advance through
+		wantDone   bool
+		wantProbes int
+	}{
+		{
+			desc:       "healthy",
+			opts:       Options{Interval: time.Second, Timeout: 5 * time.Second},
+			steps:      10,
+			wantProbes: 10,
+		},
+		{
+			desc:       "failing within timeout",
+			opts:       Options{Interval: time.Second, Timeout: 5 * time.Second},
+			results:    []error{errDown, errDown, errDown, errDown, errDown},
+			steps:      5,
+			wantProbes: 5,
+		},
+		{
+			desc:       "failing past timeout",
+			opts:       Options{Interval: time.Second, Timeout: 5 * time.Second},
+			results:    []error{errDown, errDown, errDown, errDown, errDown, errDown, errDown},
+			steps:      10,
+			wantDone:   true,
+			wantProbes: 6,
+		},
+		{
+			desc:       "success resets timeout",
+			opts:       Options{Interval: time.Second, Timeout: 3 * time.Second},
+			results:    []error{errDown, errDown, errDown, nil, errDown, errDown, errDown},
+			steps:      7,
+			wantProbes: 7,
+		},
+		{
+			desc:       "failure threshold",
+			opts:       Options{Interval: time.Second, Failures: 4},
+			results:    []error{errDown, errDown, errDown, nil, errDown, errDown, errDown, errDown},
+			steps:      10,
+			wantDone:   true,
+			wantProbes: 8,
+		},
+		{
+			desc:       "single failure after long gap",
+			opts:       Options{Interval: time.Hour, Timeout: time.Minute, Failures: 2},
+			results:    []error{errDown, nil},
+			steps:      5,
+			wantProbes: 5,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			clock := newFakeClock()
+			c.opts.Clock = clock
+			probe, calls := script(c.results...)
+			var unhealthy []error
+			c.opts.OnUnhealthy = func(cause error) { unhealthy = append(unhealthy, cause) }
+			ctx, cancel := Context(context.Background(), c.opts, probe)
+			defer cancel(nil)
+
+			done := false
+			for i := 0; i < c.steps; i++ {
+				d, ok := clock.next(t, ctx)
+				if !ok {
+					done = true
+					break
+				}
+				clock.advance(d)
+			}
+			if !done {
+				// Wait for the last probe to be handled.
+				_, ok := clock.next(t, ctx)
+				done = !ok
+			}
+			if done != c.wantDone {
+				t.Errorf("context done = %t, wanted %t (cause %v)", done, c.wantDone, context.Cause(ctx))
+			}
+			if got := calls(); got != c.wantProbes {
+				t.Errorf("probed %d times, wanted %d", got, c.wantProbes)
+			}
+			if !c.wantDone {
+				if len(unhealthy) != 0 {
+					t.Errorf("OnUnhealthy called with %v, wanted no calls", unhealthy)
+				}
+				return
+			}
+			cause := context.Cause(ctx)
+			if !errors.Is(cause, ErrTimeout) {
+				t.Errorf("context.Cause() = %v, wanted it to wrap ErrTimeout", cause)
+			}
+			if len(unhealthy) != 1 || unhealthy[0] != cause {
+				t.Errorf("OnUnhealthy called with %v, wanted one call with %v", unhealthy, cause)
+			}
+		})
+	}
+}
+
+func TestContextJitter(t *testing.T) {
+	clock := newFakeClock()
+	probe, _ := script()
+	ctx, cancel := Context(context.Background(), Options{Interval: 10 * time.Second, Jitter: 0.2, Clock: clock}, probe)
+	defer cancel(nil)
+	varied := false
+	for i := 0; i < 50; i++ {
+		d, ok := clock.next(t, ctx)
+		if !ok {
+			t.Fatalf("context done: %v", context.Cause(ctx))
+		}
+		if d < 8*time.Second || d > 12*time.Second {
+			t.Errorf("interval %v, wanted within 20%% of 10s", d)
+		}
+		if d != 10*time.Second {
+			varied = true
+		}
+		clock.advance(d)
+	}
+	if !varied {
+		t.Errorf("50 intervals were all exactly 10s, wanted jitter")
+	}
+}
+
+func TestContextProbeTimeout(t *testing.T) {
+	deadlines := make(chan bool, 1)
+	probe := func(ctx context.Context) error {
+		_, ok := ctx.Deadline()
+		deadlines <- ok
+		return nil
+	}
+	for _, timeout := range []time.Duration{0, time.Second} {
+		clock := newFakeClock()
+		ctx, cancel := Context(context.Background(), Options{Interval: time.Second, ProbeTimeout: timeout, Clock: clock}, probe)
+		d, _ := clock.next(t, ctx)
+		clock.advance(d)
+		if got, want := <-deadlines, timeout > 0; got != want {
+			t.Errorf("ProbeTimeout %v: probe context has deadline = %t, wanted %t", timeout, got, want)
+		}
+		cancel(nil)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	clock := newFakeClock()
+	probe, calls := script()
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := Context(parent, Options{Interval: time.Second, Clock: clock}, probe)
+	defer cancel(nil)
+	clock.next(t, ctx)
+	cancelParent()
+	<-ctx.Done()
+	clock.advance(time.Minute)
+	if got := calls(); got != 0 {
+		t.Errorf("probed %d times after the parent context was cancelled, wanted 0", got)
+	}
+}
@@ -6,6 +6,7 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/exec"
 	"time"
@@ -31,12 +32,70 @@ func PeriodicallyDo(ctx context.Context, period time.Duration, f func(context.Co
 // If cmd does not return before ctx is done, WaitOrStop sends it the
 // given interrupt signal. If killDelay is positive, WaitOrStop waits
 // that additional period for Wait to return before sending os.Kill.
+//
+// If WaitOrStop interrupts cmd, it returns why ctx is done, which is
+// the cause ctx was cancelled with (see context.Cause) where
+// supported, rather than the error returned by Wait.
 func WaitOrStop(ctx context.Context, cmd *exec.Cmd, interrupt os.Signal, killDelay time.Duration) error {
+	if interrupt == nil {
+		panic("WaitOrStop requires a non-nil interrupt signal")
+	}
+	p := StopPolicy{Steps: []StopStep{{Signal: interrupt, Wait: killDelay}}}
+	if killDelay > 0 {
+		p.Steps = append(p.Steps, StopStep{Signal: os.Kill})
+	}
+	return WaitOrStopPolicy(ctx, cmd, p)
+}
+
+// A StopStep is a signal sent to stop a command, and how long to wait
+// for the command to exit before taking the next step.
+type StopStep struct {
+	Signal os.Signal
+	// Wait is how long to wait for the command to exit after sending
+	// Signal. If it is not positive, or the step is the last one,
+	// there is no next step and the command is waited for until it
+	// exits.
+	Wait time.Duration
+}
+
+// StopPolicy is how WaitOrStopPolicy stops a command.
+type StopPolicy struct {
+	// Steps are the signals to send, in order, such as os.Interrupt,
+	// then syscall.SIGTERM, then os.Kill.
+	Steps []StopStep
+	// Group is whether to signal the command's process group rather
+	// than just the command, so that processes it started are stopped
+	// along with it. The command must have been started in a process
+	// group of its own; see SetProcessGroup. On Windows, the whole
+	// process tree is stopped instead. Elsewhere, the command alone
+	// is signaled.
+	Group bool
+}
+
+// errProcessDone is returned when signaling a process that has
+// already exited.
+var errProcessDone = errors.New("os: process already finished")
+
+// WaitOrStopPolicy is like WaitOrStop, but if ctx is done before cmd
+// returns, it stops cmd by taking each step of p in turn until cmd
+// returns.
+//
+// Errors sending signals after the first are ignored, since the
+// process may exit between steps.
+func WaitOrStopPolicy(ctx context.Context, cmd *exec.Cmd, p StopPolicy) error {
 	if cmd.Process == nil {
 		panic("WaitOrStop called with a nil cmd.Process — missing Start call?")
 	}
-	if interrupt == nil {
-		panic("WaitOrStop requires a non-nil interrupt signal")
+	if len(p.Steps) == 0 {
+		panic("WaitOrStopPolicy requires at least one step")
+	}
+	for _, step := range p.Steps {
+		if step.Signal == nil {
+			panic("WaitOrStopPolicy requires non-nil signals")
+		}
+	}
+	signal := func(sig os.Signal) error {
+		return signalProcess(cmd.Process, sig, p.Group)
 	}
 
 	errc := make(chan error)
@@ -47,32 +106,34 @@ func WaitOrStop(ctx context.Context, cmd *exec.Cmd, interrupt os.Signal, killDel
 		case <-ctx.Done():
 		}
 
-		err := cmd.Process.Signal(interrupt)
+		err := signal(p.Steps[0].Signal)
 		if err == nil {
-			err = ctx.Err() // Report ctx.Err() as the reason we interrupted.
-		} else if err.Error() == "os: process already finished" {
+			err = ctxErr(ctx) // Report why ctx is done as the reason we interrupted.
+		} else if err.Error() == errProcessDone.Error() {
 			errc <- nil
 			return
 		}
 
-		if killDelay > 0 {
-			timer := time.NewTimer(killDelay)
+		for i, step := range p.Steps[:len(p.Steps)-1] {
+			if step.Wait <= 0 {
+				break
+			}
+			timer := time.NewTimer(step.Wait)
 			select {
-			// Report ctx.Err() as the reason we interrupted the process...
-			case errc <- ctx.Err():
+			// Report why ctx is done as the reason we interrupted the process...
+			case errc <- ctxErr(ctx):
 				timer.Stop()
 				return
-			// ...but after killDelay has elapsed, fall back to a stronger signal.
+			// ...but after Wait has elapsed, fall back to the next signal.
 			case <-timer.C:
 			}
 
 			// Wait still hasn't returned.
-			// Kill the process harder to make sure that it exits.
 			//
 			// Ignore any error: if cmd.Process has already terminated, we still
-			// want to send ctx.Err() (or the error from the Interrupt call)
+			// want to send ctxErr(ctx) (or the error from the first signal)
 			// to properly attribute the signal that may have terminated it.
-			_ = cmd.Process.Kill()
+			_ = signal(p.Steps[i+1].Signal)
 		}
 
 		errc <- err
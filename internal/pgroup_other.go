@@ -0,0 +1,21 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build plan9 || js || wasip1
+// +build plan9 js wasip1
+
+package internal
+
+import (
+	"os"
+	"os/exec"
+)
+
+// SetProcessGroup does nothing: process groups are not supported.
+func SetProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcess sends sig to p alone.
+func signalProcess(p *os.Process, sig os.Signal, group bool) error {
+	return p.Signal(sig)
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9 && !js && !wasip1
+// +build !windows,!plan9,!js,!wasip1
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWaitOrStopPolicy(t *testing.T) {
+	// The shell ignores SIGINT, so only SIGTERM stops it.
+	cmd := exec.Command("sh", "-c", `trap "" INT; echo ready; while :; do sleep 0.1; done`)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("cmd.StdoutPipe() = _, %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cmd.Start() = %v", err)
+	}
+	if _, err := bufio.NewReader(out).ReadString('\n'); err != nil {
+		t.Fatalf("waiting for trap: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := StopPolicy{Steps: []StopStep{
+		{Signal: os.Interrupt, Wait: 100 * time.Millisecond},
+		{Signal: syscall.SIGTERM, Wait: time.Minute},
+		{Signal: os.Kill},
+	}}
+	if err := WaitOrStopPolicy(ctx, cmd, p); err != context.Canceled {
+		t.Errorf("WaitOrStopPolicy() = %v, wanted %v", err, context.Canceled)
+	}
+	ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ws.Signaled() || ws.Signal() != syscall.SIGTERM {
+		t.Errorf("cmd exited with %v, wanted to be stopped by %v", cmd.ProcessState, syscall.SIGTERM)
+	}
+}
+
+func TestWaitOrStopPolicyGroup(t *testing.T) {
+	for _, group := range []bool{false, true} {
+		cmd := exec.Command("sh", "-c", `sleep 60 & echo $!; wait`)
+		SetProcessGroup(cmd)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatalf("cmd.StdoutPipe() = _, %v", err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Skipf("cmd.Start() = %v", err)
+		}
+		line, err := bufio.NewReader(out).ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading child pid: %v", err)
+		}
+		child, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil {
+			t.Fatalf("strconv.Atoi(%q) = _, %v", line, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		p := StopPolicy{Steps: []StopStep{{Signal: syscall.SIGTERM}}, Group: group}
+		WaitOrStopPolicy(ctx, cmd, p)
+
+		alive := syscall.Kill(child, 0) == nil
+		// Once stopped, the orphaned child is reaped by init,
+		// eventually.
+		for deadline := time.Now().Add(5 * time.Second); group && alive && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			alive = syscall.Kill(child, 0) == nil
+		}
+		if alive == group {
+			t.Errorf("with Group %v, child alive = %v, wanted %v", group, alive, !group)
+		}
+		if alive {
+			syscall.Kill(child, syscall.SIGKILL)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// GenerateConsoleCtrlEvent is called through syscall rather than
+// golang.org/x/sys/windows, which doesn't yet build for windows/arm64.
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procGenerateConsoleCtrlEvent = modkernel32.NewProc("GenerateConsoleCtrlEvent")
+)
+
+// ctrlBreakEvent is CTRL_BREAK_EVENT.
+const ctrlBreakEvent = 1
+
+// SetProcessGroup arranges for the not yet started cmd to run in a new
+// process group of its own, so that it can be interrupted with a
+// CTRL_BREAK console event, which Go programs and QEMU handle like
+// SIGINT.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// signalProcess sends sig to p, or if group is set, to p and the
+// processes it started.
+//
+// Windows has no signals. os.Interrupt is sent as a CTRL_BREAK event
+// to p's process group, if group is set, since console events can
+// only be sent to process groups. That fails if p does not share this
+// process's console, or was not started with SetProcessGroup, in
+// which case p is asked to close by taskkill, which GUI programs
+// heed. os.Kill terminates p, and with group set, the processes it
+// started, using taskkill /T.
+func signalProcess(p *os.Process, sig os.Signal, group bool) error {
+	switch sig {
+	case os.Interrupt:
+		if group {
+			if r, _, _ := procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(p.Pid)); r != 0 {
+				return nil
+			}
+		}
+		return taskkill(p.Pid, false, group)
+	case os.Kill:
+		if group {
+			return taskkill(p.Pid, true, true)
+		}
+	}
+	return p.Signal(sig)
+}
+
+// taskkillNotFound is the exit code of taskkill if there is no
+// process with the given ID.
+const taskkillNotFound = 128
+
+// taskkill runs taskkill on the process pid, forcibly if force is
+// set, and along with the processes it started if tree is set.
+func taskkill(pid int, force, tree bool) error {
+	args := []string{"/PID", strconv.Itoa(pid)}
+	if force {
+		args = append(args, "/F")
+	}
+	if tree {
+		args = append(args, "/T")
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("taskkill", args...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == taskkillNotFound {
+		return errProcessDone
+	}
+	return fmt.Errorf("%v: %v: %s", cmd, err, strings.TrimSpace(out.String()))
+}
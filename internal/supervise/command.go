@@ -0,0 +1,67 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+package supervise
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/build/internal"
+	"golang.org/x/build/internal/heartbeat"
+)
+
+// defaultKillDelay is how long a Command is given to exit after it is
+// interrupted, by default, before it is killed.
+const defaultKillDelay = 10 * time.Second
+
+// Command is a task that runs a command until it exits, its context is
+// done, or its health probes fail.
+type Command struct {
+	// New returns the command for each run, not yet started.
+	New func(ctx context.Context) (*exec.Cmd, error)
+	// Stop is how the command is stopped once its context is done or
+	// its probes have failed. It defaults to os.Interrupt, then
+	// os.Kill after 10s. If Stop.Group is set, the command is
+	// started in a process group of its own.
+	Stop internal.StopPolicy
+	// Probe, if set, checks the health of the command, as
+	// configured by Heartbeat. The command is stopped once its
+	// heartbeat fails, and its run returns an error wrapping
+	// heartbeat.ErrTimeout.
+	Probe     func(context.Context) error
+	Heartbeat heartbeat.Options
+}
+
+// Run starts the command and waits for it. It is a task for the Run
+// function.
+func (c *Command) Run(ctx context.Context) error {
+	cmd, err := c.New(ctx)
+	if err != nil {
+		return err
+	}
+	stop := c.Stop
+	if len(stop.Steps) == 0 {
+		stop.Steps = []internal.StopStep{{Signal: os.Interrupt, Wait: defaultKillDelay}, {Signal: os.Kill}}
+	}
+	if stop.Group {
+		internal.SetProcessGroup(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cmd.Start() = %w", err)
+	}
+	hctx := ctx
+	if c.Probe != nil {
+		var cancel context.CancelCauseFunc
+		hctx, cancel = heartbeat.Context(ctx, c.Heartbeat, c.Probe)
+		defer cancel(nil)
+	}
+	return internal.WaitOrStopPolicy(hctx, cmd, stop)
+}
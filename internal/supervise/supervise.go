@@ -0,0 +1,207 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+// Package supervise runs a task, such as a command, in a loop,
+// restarting it according to a policy.
+package supervise
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ErrStop, returned by a task, possibly wrapped, stops Run without
+// restarting the task, whatever the policy.
+var ErrStop = errors.New("supervise: stop")
+
+// ErrTooManyRestarts is wrapped by the error Run returns once a task
+// has failed more than Options.MaxRestarts times in a row.
+var ErrTooManyRestarts = errors.New("too many restarts")
+
+// Policy says which runs of a task are followed by a restart.
+type Policy int
+
+const (
+	// Always restarts the task after every run.
+	Always Policy = iota
+	// OnFailure restarts the task after runs that return an error.
+	OnFailure
+	// Never runs the task once.
+	Never
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Always:
+		return "always"
+	case OnFailure:
+		return "on-failure"
+	case Never:
+		return "never"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// Options configures when Run restarts a task, and the hooks it calls
+// as it does.
+type Options struct {
+	// Restart is which runs are followed by a restart.
+	Restart Policy
+	// MinBackoff is the delay before restarting a task after a
+	// failed run. It defaults to 1s. Successful runs are restarted
+	// right away.
+	MinBackoff time.Duration
+	// MaxBackoff is the most the delay grows to: it doubles with
+	// each consecutive failure, and is randomly reduced by up to
+	// half so that tasks failing together do not restart in
+	// lockstep. It defaults to 1m. A successful run, or one lasting
+	// longer than MaxBackoff, resets the delay to MinBackoff.
+	MaxBackoff time.Duration
+	// MaxRestarts, if positive, is how many times in a row a failed
+	// run is restarted. Once another run fails, Run gives up.
+	MaxRestarts int
+	// CrashLoopMax, if positive, is the number of failed runs
+	// within CrashLoopWindow at which the task is crash-looping.
+	CrashLoopMax    int
+	CrashLoopWindow time.Duration
+
+	// OnExit, if set, is called after each run with its number,
+	// starting at 1, how long it took, and its error.
+	OnExit func(run int, d time.Duration, err error)
+	// OnRestart, if set, is called with the error of a failed run
+	// before waiting delay to restart it.
+	OnRestart func(err error, delay time.Duration)
+	// OnCrashLoop, if set, is called with the error of the failed
+	// run at which the task is crash-looping, and of each failed
+	// run while it keeps crash-looping.
+	OnCrashLoop func(err error)
+}
+
+// Run calls task repeatedly, as opts says, until ctx is done.
+//
+// It returns nil once ctx is done, or once task returns an error
+// wrapping ErrStop. It returns the error of the last run if opts does
+// not restart it, and one wrapping ErrTooManyRestarts and that error
+// if it has been restarted opts.MaxRestarts times in a row already.
+func Run(ctx context.Context, opts Options, task func(context.Context) error) error {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	b := &backoff{min: opts.MinBackoff, max: opts.MaxBackoff}
+	cl := &crashLoopDetector{max: opts.CrashLoopMax, window: opts.CrashLoopWindow}
+	failures := 0
+	for run := 1; ctx.Err() == nil; run++ {
+		start := time.Now()
+		err := task(ctx)
+		d := time.Since(start)
+		if opts.OnExit != nil {
+			opts.OnExit(run, d, err)
+		}
+		switch {
+		case errors.Is(err, ErrStop):
+			return nil
+		case ctx.Err() != nil:
+			return nil
+		case opts.Restart == Never, opts.Restart == OnFailure && err == nil:
+			return err
+		}
+		if err == nil || d > b.max {
+			b.reset()
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if opts.MaxRestarts > 0 && failures > opts.MaxRestarts {
+			return fmt.Errorf("%w after %d failures: %w", ErrTooManyRestarts, failures, err)
+		}
+		if cl.fail(time.Now()) && opts.OnCrashLoop != nil {
+			opts.OnCrashLoop(err)
+		}
+		delay := b.next()
+		if opts.OnRestart != nil {
+			opts.OnRestart(err, delay)
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// backoff computes exponentially increasing retry delays, with
+// jitter, between min and max.
+type backoff struct {
+	min, max time.Duration
+	n        int // number of delays returned since the last reset
+}
+
+// next returns the delay before the next retry.
+//
+// The delay doubles with each call, up to max, and is randomly
+// reduced by up to half.
+func (b *backoff) next() time.Duration {
+	d := b.min
+	for i := 0; i < b.n && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	b.n++
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(rand.Int63n(half))
+	}
+	return d
+}
+
+// reset restores the delay to min.
+func (b *backoff) reset() {
+	b.n = 0
+}
+
+// crashLoopDetector reports when max failures occur within window.
+type crashLoopDetector struct {
+	max    int
+	window time.Duration
+
+	failures []time.Time
+}
+
+// fail records a failure at t, and reports whether the number of
+// failures within the window ending at t has reached max. A
+// non-positive max disables detection.
+func (d *crashLoopDetector) fail(t time.Time) bool {
+	if d.max <= 0 {
+		return false
+	}
+	d.failures = append(d.failures, t)
+	i := 0
+	for i < len(d.failures) && t.Sub(d.failures[i]) > d.window {
+		i++
+	}
+	d.failures = d.failures[i:]
+	return len(d.failures) >= d.max
+}
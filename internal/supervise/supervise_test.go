@@ -0,0 +1,255 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+package supervise
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"golang.org/x/build/internal/heartbeat"
+)
+
+var errFailed = errors.New("failed")
+
+// script returns a task whose runs return results, in order, and then
+// ErrStop, and the number of runs it has made.
+func script(results ...error) (func(context.Context) error, *int) {
+	var runs int
+	return func(context.Context) error {
+		runs++
+		if runs > len(results) {
+			return ErrStop
+		}
+		return results[runs-1]
+	}, &runs
+}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		desc     string
+		opts     Options
+		results  []error
+		wantRuns int
+		wantErr  error
+	}{
+		{
+			desc:     "always",
+			opts:     Options{Restart: Always},
+			results:  []error{nil, errFailed, nil},
+			wantRuns: 4,
+		},
+		{
+			desc:     "on-failure stops after success",
+			opts:     Options{Restart: OnFailure},
+			results:  []error{errFailed, errFailed, nil, nil},
+			wantRuns: 3,
+		},
+		{
+			desc:     "never",
+			opts:     Options{Restart: Never},
+			results:  []error{errFailed, nil},
+			wantRuns: 1,
+			wantErr:  errFailed,
+		},
+		{
+			desc:     "max restarts",
+			opts:     Options{Restart: Always, MaxRestarts: 2},
+			results:  []error{errFailed, errFailed, errFailed, nil},
+			wantRuns: 3,
+			wantErr:  ErrTooManyRestarts,
+		},
+		{
+			desc:     "success resets max restarts",
+			opts:     Options{Restart: Always, MaxRestarts: 2},
+			results:  []error{errFailed, errFailed, nil, errFailed, errFailed},
+			wantRuns: 6,
+		},
+		{
+			desc:     "stop",
+			opts:     Options{Restart: Always},
+			results:  []error{fmt.Errorf("drained: %w", ErrStop), nil},
+			wantRuns: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			c.opts.MinBackoff = time.Millisecond
+			c.opts.MaxBackoff = time.Millisecond
+			var exits []error
+			c.opts.OnExit = func(run int, d time.Duration, err error) {
+				if run != len(exits)+1 {
+					t.Errorf("OnExit(%d, _, _), wanted run %d", run, len(exits)+1)
+				}
+				exits = append(exits, err)
+			}
+			task, runs := script(c.results...)
+			err := Run(context.Background(), c.opts, task)
+			if !errors.Is(err, c.wantErr) || (err == nil) != (c.wantErr == nil) {
+				t.Errorf("Run() = %v, wanted %v", err, c.wantErr)
+			}
+			if *runs != c.wantRuns || len(exits) != c.wantRuns {
+				t.Errorf("Run() made %d runs, reporting %d exits, wanted %d", *runs, len(exits), c.wantRuns)
+			}
+		})
+	}
+}
+
+func TestRunBackoff(t *testing.T) {
+	var delays []time.Duration
+	opts := Options{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 4 * time.Millisecond,
+		OnRestart: func(err error, delay time.Duration) {
+			delays = append(delays, delay)
+		},
+	}
+	task, _ := script(errFailed, errFailed, errFailed, errFailed, nil, errFailed)
+	if err := Run(context.Background(), opts, task); err != nil {
+		t.Fatalf("Run() = %v, wanted nil", err)
+	}
+	// The delay doubles up to MaxBackoff, and a success resets it.
+	max := []time.Duration{1, 2, 4, 4, 1}
+	if len(delays) != len(max) {
+		t.Fatalf("OnRestart called with delays %v, wanted %d calls", delays, len(max))
+	}
+	for i, d := range delays {
+		if m := max[i] * time.Millisecond; d < m/2 || d > m {
+			t.Errorf("delay %d = %v, wanted between %v and %v", i, d, m/2, m)
+		}
+	}
+}
+
+func TestRunCrashLoop(t *testing.T) {
+	var crashLoops int
+	opts := Options{
+		MinBackoff:      time.Millisecond,
+		CrashLoopMax:    3,
+		CrashLoopWindow: time.Hour,
+		OnCrashLoop:     func(error) { crashLoops++ },
+	}
+	task, _ := script(errFailed, errFailed, errFailed, errFailed)
+	Run(context.Background(), opts, task)
+	if crashLoops != 2 {
+		t.Errorf("OnCrashLoop called %d times, wanted 2", crashLoops)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, Options{MinBackoff: time.Hour}, func(context.Context) error { return errFailed })
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v, wanted nil once cancelled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run() did not return once cancelled")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skipf("exec.LookPath(%q) = _, %v", "sh", err)
+	}
+	newCmd := func(script string) func(context.Context) (*exec.Cmd, error) {
+		return func(ctx context.Context) (*exec.Cmd, error) {
+			return exec.Command("sh", "-c", script), nil
+		}
+	}
+	cases := []struct {
+		desc    string
+		c       *Command
+		wantErr error
+	}{
+		{desc: "success", c: &Command{New: newCmd("exit 0")}},
+		{desc: "failure", c: &Command{New: newCmd("exit 1")}, wantErr: new(exec.ExitError)},
+		{
+			desc: "unhealthy",
+			c: &Command{
+				New:       newCmd("exec sleep 60"),
+				Probe:     func(context.Context) error { return errFailed },
+				Heartbeat: heartbeat.Options{Interval: time.Millisecond, Timeout: time.Millisecond, Failures: 2},
+			},
+			wantErr: heartbeat.ErrTimeout,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := c.c.Run(ctx)
+			switch want := c.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("Run() = %v, wanted nil", err)
+				}
+			case *exec.ExitError:
+				if !errors.As(err, &want) {
+					t.Errorf("Run() = %v, wanted an *exec.ExitError", err)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Errorf("Run() = %v, wanted %v", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second}
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max *= time.Second
+		d := b.next()
+		if d < max/2 || d > max {
+			t.Errorf("next() call %d = %v, wanted between %v and %v", i, d, max/2, max)
+		}
+	}
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Errorf("next() after reset() = %v, wanted at most %v", d, time.Second)
+	}
+}
+
+func TestCrashLoopDetector(t *testing.T) {
+	d := &crashLoopDetector{max: 3, window: 10 * time.Minute}
+	start := time.Now()
+	cases := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, false},
+		{time.Minute, false},
+		{2 * time.Minute, true},
+		// Earlier failures are now outside the window.
+		{15 * time.Minute, false},
+		{16 * time.Minute, false},
+		{17 * time.Minute, true},
+		{time.Hour, false},
+	}
+	for _, c := range cases {
+		if got := d.fail(start.Add(c.after)); got != c.want {
+			t.Errorf("fail(start+%v) = %t, wanted %t", c.after, got, c.want)
+		}
+	}
+
+	disabled := &crashLoopDetector{window: time.Hour}
+	for i := 0; i < 10; i++ {
+		if disabled.fail(start) {
+			t.Fatalf("fail() with max 0 = true, wanted false")
+		}
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WriteDir writes the tree rooted at dir to tw, with names relative
+// to dir, using slashes. Directories' names end in a slash.
+//
+// Symlinks are written as symlinks, and regular files that are hard
+// links to files already written are written as hard links to them,
+// where the platform can tell. The archive format has no way to write
+// sparse files, so their holes are written as zeros; Extractor makes
+// holes of them again.
+func WriteDir(tw *tar.Writer, dir string) error {
+	return WriteDirFilter(tw, dir, Filter{})
+}
+
+// A Filter selects the entries of a tree, by the slash-separated
+// paths of entries relative to its root.
+//
+// Patterns are in path.Match syntax. Those containing a slash are
+// matched against an entry's path, and others against its base name.
+// A pattern matching a directory matches everything in it too.
+type Filter struct {
+	// Include, if non-empty, limits the entries selected to those
+	// matching any of its patterns. The directories leading to
+	// them are selected too.
+	Include []string
+
+	// Exclude are patterns of entries not to select, even if
+	// Include matches them.
+	Exclude []string
+}
+
+// Validate reports an error if any of f's patterns is malformed.
+func (f Filter) Validate() error {
+	for _, pats := range [][]string{f.Include, f.Exclude} {
+		for _, pat := range pats {
+			if _, err := path.Match(pat, ""); err != nil {
+				return fmt.Errorf("bad pattern %q: %v", pat, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchAny reports whether any of pats matches the entry with the
+// given path, not counting its parents.
+func matchAny(pats []string, name string) bool {
+	for _, pat := range pats {
+		target := name
+		if !strings.Contains(pat, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pat, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteDirFilter is like WriteDir, but only writes the entries that f
+// selects. Excluded directories aren't walked.
+func WriteDirFilter(tw *tar.Writer, dir string, f Filter) error {
+	links := make(map[fileID]string) // files with several links -> name written as
+	// Directories not written yet, because nothing in them has been
+	// included (yet), from the outermost in.
+	var pending []*tar.Header
+	// includedDir is the innermost directory that Include matched,
+	// all of which is included, or "".
+	var includedDir string
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(p, dir)), "/")
+		if rel == "" {
+			return nil
+		}
+		if matchAny(f.Exclude, rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for len(pending) > 0 && !strings.HasPrefix(rel, pending[len(pending)-1].Name) {
+			pending = pending[:len(pending)-1]
+		}
+		if includedDir != "" && !strings.HasPrefix(rel, includedDir) {
+			includedDir = ""
+		}
+		var linkName string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			linkName, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			linkName = filepath.ToSlash(linkName)
+		}
+		th, err := tar.FileInfoHeader(fi, linkName)
+		if err != nil {
+			return err
+		}
+		th.Name = rel
+		if fi.IsDir() {
+			th.Name += "/"
+		}
+		included := len(f.Include) == 0 || includedDir != "" || matchAny(f.Include, rel)
+		if !included {
+			if fi.IsDir() {
+				pending = append(pending, th)
+			}
+			return nil
+		}
+		if fi.IsDir() && includedDir == "" && len(f.Include) > 0 {
+			includedDir = th.Name
+		}
+		for _, dh := range pending {
+			if err := tw.WriteHeader(dh); err != nil {
+				return err
+			}
+		}
+		pending = pending[:0]
+		if fi.Mode().IsRegular() {
+			if id, ok := hardLinkID(fi); ok {
+				if first, ok := links[id]; ok {
+					th.Typeflag = tar.TypeLink
+					th.Linkname = first
+					th.Size = 0
+					return tw.WriteHeader(th)
+				}
+				links[id] = th.Name
+			}
+		}
+		if err := tw.WriteHeader(th); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			file, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := io.CopyN(tw, file, th.Size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// fileID identifies a file on the host, for finding hard links.
+type fileID struct {
+	dev, ino uint64
+}
+
+// A BadEntryError is an error of Extractor.Extract about a tar entry
+// it refuses to extract.
+type BadEntryError struct {
+	Name   string // of the entry
+	Reason string
+}
+
+func (e *BadEntryError) Error() string {
+	return fmt.Sprintf("tar file entry %s: %s", e.Name, e.Reason)
+}
+
+// An Extractor extracts the entries of a tar file into a directory,
+// preserving symlinks, hard links, and the holes of sparse files.
+//
+// It refuses entries that would write outside of the directory,
+// including through symlinks in it, whether it created them or they
+// were already there, and symlinks that would lead outside of it.
+type Extractor struct {
+	// Dir is the directory to extract into.
+	Dir string
+
+	// MaxModTime, if non-zero, is the latest modification time to
+	// give files. Later ones, such as from a tar file made on a
+	// host with a clock ahead, are clamped to it.
+	MaxModTime time.Time
+
+	// IgnoreSymlinkErrors is whether to skip symlinks that can't
+	// be created, such as on Windows hosts without the privilege,
+	// rather than fail.
+	IgnoreSymlinkErrors bool
+
+	madeDir map[string]bool
+}
+
+// sparseBlock is the size of the runs of zeros in regular files that
+// Extract leaves as holes rather than writes.
+const sparseBlock = 4096
+
+// Extract extracts the entry with header h, whose contents r reads.
+// Entries of unsupported types and ones with invalid names get a
+// *BadEntryError.
+func (x *Extractor) Extract(h *tar.Header, r io.Reader) error {
+	name, ok := x.cleanName(h.Name)
+	if !ok {
+		return &BadEntryError{h.Name, "invalid name"}
+	}
+	parent, ok := x.resolve(path.Dir(name))
+	if !ok {
+		return &BadEntryError{h.Name, "path crosses a symlink leading outside the directory"}
+	}
+	abs := filepath.Join(x.Dir, filepath.FromSlash(name))
+	switch h.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		if err := x.mkdirParent(abs); err != nil {
+			return err
+		}
+		if isSymlink(abs) {
+			// Don't write through it.
+			os.Remove(abs)
+		}
+		if err := writeSparse(abs, h.FileInfo().Mode().Perm(), h.Size, r); err != nil {
+			return err
+		}
+		modTime := h.ModTime
+		if !x.MaxModTime.IsZero() && modTime.After(x.MaxModTime) {
+			modTime = x.MaxModTime
+		}
+		if !modTime.IsZero() {
+			// Failing to set it is benign.
+			os.Chtimes(abs, modTime, modTime)
+		}
+	case tar.TypeDir:
+		if _, ok := x.resolve(name); !ok {
+			return &BadEntryError{h.Name, "symlink leads outside the directory"}
+		}
+		if err := os.MkdirAll(abs, 0755); err != nil {
+			return err
+		}
+		x.noteDir(abs)
+	case tar.TypeSymlink:
+		if !validLinkTarget(parent, h.Linkname) {
+			return &BadEntryError{h.Name, fmt.Sprintf("symlink target %q is outside the directory", h.Linkname)}
+		}
+		if err := x.mkdirParent(abs); err != nil {
+			return err
+		}
+		removeNonDir(abs)
+		if err := os.Symlink(filepath.FromSlash(h.Linkname), abs); err != nil {
+			if x.IgnoreSymlinkErrors {
+				return nil
+			}
+			return err
+		}
+	case tar.TypeLink:
+		target, ok := x.cleanName(h.Linkname)
+		if ok {
+			_, ok = x.resolve(path.Dir(target))
+		}
+		if !ok || isSymlink(filepath.Join(x.Dir, filepath.FromSlash(target))) {
+			return &BadEntryError{h.Name, fmt.Sprintf("invalid hard link target %q", h.Linkname)}
+		}
+		if err := x.mkdirParent(abs); err != nil {
+			return err
+		}
+		removeNonDir(abs)
+		if err := os.Link(filepath.Join(x.Dir, filepath.FromSlash(target)), abs); err != nil {
+			return err
+		}
+	default:
+		return &BadEntryError{h.Name, fmt.Sprintf("unsupported file type %v", h.FileInfo().Mode())}
+	}
+	return nil
+}
+
+// cleanName returns the cleaned form of a tar entry's name, without a
+// trailing slash, and reports whether it's a valid relative path
+// within the directory.
+func (x *Extractor) cleanName(name string) (string, bool) {
+	if name == "" || strings.Contains(name, `\`) || strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	name = path.Clean(name)
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// maxSymlinks is how many symlinks resolve follows before giving up,
+// as for a loop of them.
+const maxSymlinks = 40
+
+// resolve returns the slash-separated path relative to x.Dir that the
+// relative path name leads to, following the symlinks already in
+// x.Dir, and reports whether it stays within x.Dir. Components that
+// don't exist yet are taken to be directories to be made.
+func (x *Extractor) resolve(name string) (string, bool) {
+	resolved := "."
+	rest := strings.Split(name, "/")
+	links := 0
+	for len(rest) > 0 {
+		next := path.Join(resolved, rest[0])
+		rest = rest[1:]
+		if next == ".." || strings.HasPrefix(next, "../") {
+			return "", false
+		}
+		abs := filepath.Join(x.Dir, filepath.FromSlash(next))
+		if !isSymlink(abs) {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", false
+		}
+		target, err := os.Readlink(abs)
+		if err != nil || !validLinkTarget(resolved, filepath.ToSlash(target)) {
+			return "", false
+		}
+		rest = append(strings.Split(filepath.ToSlash(target), "/"), rest...)
+	}
+	return resolved, true
+}
+
+// validLinkTarget reports whether the target of a symlink in the
+// directory dir, relative to the extraction directory, is a relative
+// path that stays within the extraction directory, lexically.
+func validLinkTarget(dir, target string) bool {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) || filepath.VolumeName(filepath.FromSlash(target)) != "" {
+		return false
+	}
+	p := path.Join(dir, target)
+	return p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// isSymlink reports whether abs is a symlink.
+func isSymlink(abs string) bool {
+	fi, err := os.Lstat(abs)
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+func (x *Extractor) mkdirParent(abs string) error {
+	dir := filepath.Dir(abs)
+	if x.madeDir[dir] {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	x.noteDir(dir)
+	return nil
+}
+
+func (x *Extractor) noteDir(dir string) {
+	if x.madeDir == nil {
+		x.madeDir = make(map[string]bool)
+	}
+	x.madeDir[dir] = true
+}
+
+// removeNonDir removes the file at abs, if there is one, so that a
+// link can be made there.
+func removeNonDir(abs string) {
+	if fi, err := os.Lstat(abs); err == nil && !fi.IsDir() {
+		os.Remove(abs)
+	}
+}
+
+// writeSparse writes the size bytes of r to the file abs, seeking
+// over blocks of zeros rather than writing them, so that they're
+// holes on filesystems that support them.
+func writeSparse(abs string, perm os.FileMode, size int64, r io.Reader) error {
+	f, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 32<<10)
+	var zero [sparseBlock]byte
+	var n int64
+	for n < size {
+		chunk := buf
+		if rem := size - n; rem < int64(len(chunk)) {
+			chunk = chunk[:rem]
+		}
+		if _, err = io.ReadFull(r, chunk); err != nil {
+			break
+		}
+		for len(chunk) > 0 && err == nil {
+			b := chunk
+			if len(b) > sparseBlock {
+				b = b[:sparseBlock]
+			}
+			if len(b) == sparseBlock && bytes.Equal(b, zero[:]) {
+				_, err = f.Seek(sparseBlock, io.SeekCurrent)
+			} else {
+				_, err = f.Write(b)
+			}
+			n += int64(len(b))
+			chunk = chunk[len(b):]
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		// Extend the file over any final hole.
+		err = f.Truncate(size)
+	}
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return fmt.Errorf("only wrote %d bytes to %s; expected %d", n, abs, size)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing to %s: %v", abs, err)
+	}
+	return nil
+}
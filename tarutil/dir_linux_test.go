@@ -0,0 +1,30 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tarutil
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtractKeepsHoles(t *testing.T) {
+	src := t.TempDir()
+	makeSparse(t, filepath.Join(src, "sparse"), 64<<20, 32<<20, "data")
+	out, _ := roundTrip(t, src)
+	fi, err := os.Stat(filepath.Join(out, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 64<<20 {
+		t.Errorf("size = %d; want %d", fi.Size(), 64<<20)
+	}
+	// Blocks are 512 bytes. Filesystems without holes, such as
+	// some tmpfs configurations, would need all 64 MiB.
+	if used := fi.Sys().(*syscall.Stat_t).Blocks * 512; used > 1<<20 {
+		t.Errorf("extracted sparse file uses %d bytes on disk; want holes", used)
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tarutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// makeSparse creates a file of size bytes at p with data only at
+// offset off.
+func makeSparse(t *testing.T, p string, size, off int64, data string) {
+	t.Helper()
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte(data), off); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// roundTrip writes dir with WriteDir, extracts the result into a new
+// directory, and returns it along with the headers written.
+func roundTrip(t *testing.T, dir string) (string, map[string]*tar.Header) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := WriteDir(tw, dir); err != nil {
+		t.Fatalf("WriteDir: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	x := &Extractor{Dir: out}
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[h.Name] = h
+		if err := x.Extract(h, tr); err != nil {
+			t.Fatalf("Extract(%q): %v", h.Name, err)
+		}
+	}
+	return out, headers
+}
+
+func TestWriteDirExtract(t *testing.T) {
+	src := t.TempDir()
+	write := func(name, content string) {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "hello")
+	write("sub/b.txt", "world")
+	// Longer than the 100 bytes of a tar header's name, and than
+	// Windows' traditional MAX_PATH.
+	long := strings.Repeat("long-directory-name/", 15) + "c.txt"
+	write(long, "long")
+	makeSparse(t, filepath.Join(src, "sparse"), 1<<20, 512<<10, "data")
+
+	haveSymlink := os.Symlink("a.txt", filepath.Join(src, "symlink")) == nil
+	haveLink := os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "hardlink")) == nil
+
+	out, headers := roundTrip(t, src)
+
+	for name, want := range map[string]string{"a.txt": "hello", "sub/b.txt": "world", long: "long"} {
+		got, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil || string(got) != want {
+			t.Errorf("extracted %s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if h := headers["sub/"]; h == nil || h.Typeflag != tar.TypeDir {
+		t.Errorf("header of sub/ = %+v; want directory", h)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(out, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 1<<20)
+	copy(want[512<<10:], "data")
+	if !bytes.Equal(got, want) {
+		t.Errorf("extracted sparse file differs from the original")
+	}
+
+	if haveSymlink {
+		if h := headers["symlink"]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "a.txt" {
+			t.Errorf("header of symlink = %+v; want symlink to a.txt", h)
+		}
+		if target, err := os.Readlink(filepath.Join(out, "symlink")); err != nil || target != "a.txt" {
+			t.Errorf("extracted symlink = %q, %v; want link to a.txt", target, err)
+		}
+	}
+	if haveLink && runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
+		// Whichever of a.txt and hardlink is walked first is
+		// written as a file.
+		h := headers["hardlink"]
+		if h == nil || h.Typeflag != tar.TypeLink || h.Linkname != "a.txt" {
+			t.Errorf("header of hardlink = %+v; want hard link to a.txt", h)
+		}
+		fa, err1 := os.Stat(filepath.Join(out, "a.txt"))
+		fh, err2 := os.Stat(filepath.Join(out, "hardlink"))
+		if err1 != nil || err2 != nil || !os.SameFile(fa, fh) {
+			t.Errorf("extracted hardlink and a.txt aren't the same file (errors %v, %v)", err1, err2)
+		}
+	}
+}
+
+// canSymlink reports whether symlinks can be made here.
+func canSymlink(t *testing.T) bool {
+	return os.Symlink("target", filepath.Join(t.TempDir(), "link")) == nil
+}
+
+func TestExtractBadEntries(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		headers  []*tar.Header
+		symlinks bool // whether the test needs symlinks
+	}{
+		{"parent directory", []*tar.Header{
+			{Name: "../evil", Typeflag: tar.TypeReg},
+		}, false},
+		{"absolute", []*tar.Header{
+			{Name: "/evil", Typeflag: tar.TypeReg},
+		}, false},
+		{"symlink outside", []*tar.Header{
+			{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		}, false},
+		{"symlink outside from subdirectory", []*tar.Header{
+			{Name: "a/b/dir", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		}, false},
+		{"absolute symlink", []*tar.Header{
+			{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		}, false},
+		{"symlink through symlink", []*tar.Header{
+			{Name: "a/b/", Typeflag: tar.TypeDir},
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "a/b"},
+			{Name: "up/dir", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		}, true},
+		{"hard link outside", []*tar.Header{
+			{Name: "link", Typeflag: tar.TypeLink, Linkname: "../outside"},
+		}, false},
+		{"device", []*tar.Header{
+			{Name: "dev", Typeflag: tar.TypeChar},
+		}, false},
+	} {
+		if tt.symlinks && !canSymlink(t) {
+			continue
+		}
+		x := &Extractor{Dir: t.TempDir(), IgnoreSymlinkErrors: true}
+		var err error
+		for _, h := range tt.headers {
+			if err = x.Extract(h, strings.NewReader("")); err != nil {
+				break
+			}
+		}
+		if _, ok := err.(*BadEntryError); !ok {
+			t.Errorf("%s: Extract error = %v; want *BadEntryError", tt.desc, err)
+		}
+	}
+}
+
+// TestExtractExistingSymlinks checks that Extract doesn't write
+// outside of the directory through symlinks that were already in it,
+// such as made by a command.
+func TestExtractExistingSymlinks(t *testing.T) {
+	if !canSymlink(t) {
+		t.Skip("can't create symlinks")
+	}
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, target := range map[string]string{
+		"abs":      outside,
+		"rel":      filepath.Join("..", filepath.Base(outside)),
+		"file":     secret,
+		"chain":    "rel",
+		"sub":      "real",
+		"sub2":     "real/../sub",
+		"loop":     "loop",
+		"real/up":  "..",
+		"real/out": "../..",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, h := range []*tar.Header{
+		{Name: "abs/x", Typeflag: tar.TypeReg},
+		{Name: "rel/x", Typeflag: tar.TypeReg},
+		{Name: "chain/x", Typeflag: tar.TypeReg},
+		{Name: "real/out/x", Typeflag: tar.TypeReg},
+		{Name: "loop/x", Typeflag: tar.TypeReg},
+		{Name: "abs/d/", Typeflag: tar.TypeDir},
+		{Name: "abs", Typeflag: tar.TypeDir},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "file"},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "abs/secret"},
+		{Name: "abs/link", Typeflag: tar.TypeLink, Linkname: "real/f"},
+	} {
+		x := &Extractor{Dir: dir}
+		if err := x.Extract(h, strings.NewReader("")); err == nil {
+			t.Errorf("Extract(%s %q) = nil; want error", string(h.Typeflag), h.Name)
+		}
+	}
+
+	// A file replaces a symlink, rather than being written through it.
+	x := &Extractor{Dir: dir}
+	if err := x.Extract(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Size: 2, Mode: 0644}, strings.NewReader("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(secret); err != nil || string(got) != "secret" {
+		t.Errorf("file outside = %q, %v; want it unchanged", got, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "file")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("symlink wasn't replaced by a file (%v)", err)
+	}
+
+	// Symlinks that stay within the directory may be written through.
+	for _, name := range []string{"sub/f", "sub2/g", "real/up/real/h"} {
+		if err := x.Extract(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: 2, Mode: 0644}, strings.NewReader("hi")); err != nil {
+			t.Errorf("Extract(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"f", "g", "h"} {
+		if _, err := os.Stat(filepath.Join(dir, "real", name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWriteDirFilter(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{
+		"bin/go",
+		"bin/gofmt",
+		"pkg/tool/compile",
+		"src/cmd/go/go.log",
+		"src/cmd/go/main.go",
+		"src/run.log",
+		"test/bench/a.log",
+	} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		f    Filter
+		want string
+	}{
+		{Filter{}, "bin/ bin/go bin/gofmt pkg/ pkg/tool/ pkg/tool/compile src/ src/cmd/ src/cmd/go/ src/cmd/go/go.log src/cmd/go/main.go src/run.log test/ test/bench/ test/bench/a.log"},
+		{Filter{Include: []string{"bin"}}, "bin/ bin/go bin/gofmt"},
+		{Filter{Include: []string{"bin", "*.log"}}, "bin/ bin/go bin/gofmt src/ src/cmd/ src/cmd/go/ src/cmd/go/go.log src/run.log test/ test/bench/ test/bench/a.log"},
+		{Filter{Include: []string{"bin", "*.log"}, Exclude: []string{"bin/gofmt", "test"}}, "bin/ bin/go src/ src/cmd/ src/cmd/go/ src/cmd/go/go.log src/run.log"},
+		{Filter{Include: []string{"src/*/go"}}, "src/ src/cmd/ src/cmd/go/ src/cmd/go/go.log src/cmd/go/main.go"},
+		{Filter{Exclude: []string{"src", "pkg"}}, "bin/ bin/go bin/gofmt test/ test/bench/ test/bench/a.log"},
+		{Filter{Include: []string{"nothing"}}, ""},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := WriteDirFilter(tw, src, tt.f); err != nil {
+			t.Fatalf("WriteDirFilter(%+v): %v", tt.f, err)
+		}
+		tw.Close()
+		var names []string
+		tr := tar.NewReader(&buf)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, h.Name)
+		}
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("WriteDirFilter(%+v) wrote:\n\t%s\nwant:\n\t%s", tt.f, got, tt.want)
+		}
+	}
+	if err := (Filter{Include: []string{"["}}).Validate(); err == nil {
+		t.Error("Validate accepted a malformed pattern")
+	}
+}
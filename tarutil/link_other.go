@@ -0,0 +1,16 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package tarutil
+
+import "os"
+
+// hardLinkID returns the identity of the file of fi, if it has other
+// hard links. Hard links aren't found on this platform.
+func hardLinkID(fi os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -114,6 +114,22 @@ type ReverseBuilder struct {
 	BusySec      float64 `json:",omitempty"`
 	Version      string  // buildlet version
 	Busy         bool
+
+	// Host metrics from the buildlet's recent heartbeats, if any.
+	LoadAvg     float64 `json:",omitempty"` // 1 minute load average
+	DiskFree    int64   `json:",omitempty"` // bytes free for the work directory
+	Temperature float64 `json:",omitempty"` // degrees Celsius
+	Throttled   bool    `json:",omitempty"` // CPUs recently throttled
+
+	// Draining is why the buildlet isn't being given new builds,
+	// if it isn't, because of its host metrics.
+	Draining string `json:",omitempty"`
+
+	// Labels are the labels the buildlet advertised, and
+	// MaxSessions its hint of how many buildlets with its name
+	// may be used at once, or zero.
+	Labels      map[string]string `json:",omitempty"`
+	MaxSessions int               `json:",omitempty"`
 }
 
 // ReverseHostStatus is part of ReverseBuilderStatus.